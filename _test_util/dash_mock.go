@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -44,9 +45,15 @@ func (d *DashServerMock) Start(addr string) {
 
 	d.wkDir = os.Getenv("TYKCTRL_WKDIR")
 
+	// listen synchronously so callers can use the mock as soon as Start returns
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+
 	go func() {
-		if err := d.s.ListenAndServe(); err != http.ErrServerClosed {
-			fmt.Printf("ERR: ListenAndServe(): %s", err)
+		if err := d.s.Serve(l); err != http.ErrServerClosed {
+			fmt.Printf("ERR: Serve(): %s", err)
 		}
 	}()
 }
@@ -1,6 +1,7 @@
 package ca
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
@@ -11,13 +12,14 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/TykTechnologies/tyk/certs"
 	"github.com/cloudflare/cfssl/api/client"
 	"github.com/cloudflare/cfssl/auth"
 	"github.com/cloudflare/cfssl/csr"
-	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	uuid "github.com/satori/go.uuid"
 
@@ -28,32 +30,63 @@ import (
 var log = logger.GetLogger("tyk-ca")
 
 const (
-	caCol string = "k8s_ca"
+	// CA backends signing the mesh certificates
+	BackendCFSSL        = "cfssl"
+	BackendSPIRE        = "spire"
+	BackendCertManager  = "cert-manager"
+	BackendVault        = "vault"
+	BackendIntermediate = "intermediate"
 )
 
 type Config struct {
 	Addr              string          `yaml:"addr"`
 	Key               string          `yaml:"key"`
 	DefaultNames      []csr.Name      `yaml:"defaultNames"`
-	DefaultKeyRequest *csr.KeyRequest `yaml:"defaultKeyRequest"`
+	DefaultKeyRequest *csr.KeyRequest `yaml:"defaultKeyRequest"` // ECDSA P-256 if unset
 	MongoConnStr      string          `yaml:"mongoConnStr"`
 	CertPath          string          `yaml:"certPath"`
+	NextCertPaths     []string        `yaml:"nextCertPaths"` // upcoming roots published in the trust bundle during a rotation
 	Secure            bool
 	SkipCACheck       bool
+	Backend           string             `yaml:"backend"` // issuer of certificates, cfssl (default), spire, cert-manager, vault or intermediate
+	Spire             SpireConfig        `yaml:"spire"`
+	CertManager       CertManagerConfig  `yaml:"certManager"`
+	Vault             VaultConfig        `yaml:"vault"`
+	Intermediate      IntermediateConfig `yaml:"intermediate"` // online intermediate of an offline root, signing in-process
+	Revocation        RevocationConfig   `yaml:"revocation"`
+	Rotation          RotationConfig     `yaml:"rotation"` // root rotations started with tyk-k8s ca rotate
+	Store             StoreConfig        `yaml:"store"`    // keeps track of issued certs, MongoDB unless configured
+}
+
+// Issuer signs certificates for a common name and optional alternative DNS
+// names and IPs, the Client keeps track of the issued certificates regardless
+// of the backend that signed them
+type Issuer interface {
+	GenerateCert(CN string, hosts ...string) (*Bundle, error)
 }
 
 type CertClient interface {
-	GenerateCert(string) (*Bundle, error)
+	GenerateCert(CN string, hosts ...string) (*Bundle, error)
 	StoreCert(*CertModel) (*CertModel, error)
 	GetCertByFingerprint(string) (*CertModel, error)
 	GetServerCertByLinkedAPIID(string) (*CertModel, error)
+	GetCertByIdentity(string) (*CertModel, error)
+	ListIdentityCerts() ([]*CertModel, error)
+	ListCertsExpiringBefore(time.Time) ([]*CertModel, error)
+	UpdateCert(*CertModel) error
+	Revoke(*CertModel, int) error
 }
 
 type Client struct {
-	CA        *Config
-	storeInit bool
-	storeSess *mgo.Session
-	caCert    []byte
+	Store
+	CA       *Config
+	caCert   []byte
+	issuer   Issuer // signs certificates instead of CFSSL if set
+	ocsp     *ocspResponder
+	rotation *rotationState // root rotation, read from its Secret
+
+	nsMu  sync.Mutex
+	nsCAs map[string]*localIssuer // CAs of the namespace trust domains
 }
 
 type APICertSignRequest struct {
@@ -69,15 +102,21 @@ type Bundle struct {
 }
 
 type CertModel struct {
-	MID             bson.ObjectId `bson:"_id"`
-	UID             string
-	Bundle          *Bundle
-	BundleHistory   []Bundle // On renewal, move bundle here
-	Created         time.Time
-	Expires         time.Time
-	ClientEgressIDs []string // If cert is used as a client cert, IDs of APIs it is attached to
-	ServiceID       string   // If cert is used as a server cert, ID of API it belongs to
-	IsMeshCert      bool
+	MID              bson.ObjectId `bson:"_id"`
+	UID              string
+	Bundle           *Bundle
+	BundleHistory    []Bundle // On renewal, move bundle here
+	Created          time.Time
+	Expires          time.Time
+	ClientEgressIDs  []string // If cert is used as a client cert, IDs of APIs it is attached to
+	ServiceID        string   // If cert is used as a server cert, ID of API it belongs to
+	IsMeshCert       bool
+	Identity         string // If cert is a workload client cert, the service (namespace/name) it identifies
+	TrustDomain      string // If cert is the CA of a namespace, its trust domain
+	Serial           string // Decimal serial number, for OCSP lookups
+	Revoked          bool
+	RevokedAt        time.Time
+	RevocationReason int
 }
 
 func (b *Bundle) Combine() []byte {
@@ -90,24 +129,73 @@ func (b *Bundle) Combine() []byte {
 
 func New(cfg *Config) (*Client, error) {
 	c := &Client{
-		CA: cfg,
+		CA:       cfg,
+		rotation: &rotationState{},
 	}
 
-	if cfg.CertPath == "" {
-		return nil, fmt.Errorf("root CA certificate is required for bundling")
-	}
+	switch cfg.Backend {
+	case "", BackendCFSSL:
+		if cfg.CertPath == "" {
+			return nil, fmt.Errorf("root CA certificate is required for bundling")
+		}
 
-	f, err := ioutil.ReadFile(cfg.CertPath)
-	if err != nil {
-		return nil, err
-	}
+		f, err := ioutil.ReadFile(cfg.CertPath)
+		if err != nil {
+			return nil, err
+		}
+
+		c.caCert = f
 
-	c.caCert = f
+		if cfg.Revocation.OCSPCertPath != "" {
+			c.ocsp, err = newOCSPResponder(f, &cfg.Revocation)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	err = c.initStorage()
+	case BackendSPIRE:
+		iss, err := newSpireIssuer(&cfg.Spire)
+		if err != nil {
+			return nil, err
+		}
+
+		c.issuer = iss
+
+	case BackendCertManager:
+		iss, err := newCertManagerIssuer(&cfg.CertManager)
+		if err != nil {
+			return nil, err
+		}
+		iss.key = cfg.keyRequest()
+
+		c.issuer = iss
+
+	case BackendVault:
+		iss, err := newVaultIssuer(&cfg.Vault)
+		if err != nil {
+			return nil, err
+		}
+
+		c.issuer = iss
+
+	case BackendIntermediate:
+		iss, root, err := newIntermediateIssuer(cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		c.issuer = iss
+		c.caCert = root
+
+	default:
+		return nil, fmt.Errorf("unknown CA backend %q", cfg.Backend)
+	}
+
+	store, err := NewStore(cfg)
 	if err != nil {
 		return nil, err
 	}
+	c.Store = store
 
 	return c, nil
 }
@@ -144,22 +232,59 @@ func (c *Client) prepareRequest() *csr.CertificateRequest {
 		}
 	}
 
-	req.KeyRequest = c.CA.DefaultKeyRequest
-	if c.CA.DefaultKeyRequest == nil {
-		req.KeyRequest = csr.NewKeyRequest()
-	}
+	req.KeyRequest = c.CA.keyRequest()
 
 	return req
 }
 
-func (c *Client) GenerateCert(CN string) (*Bundle, error) {
+// keyRequest returns the configured key type and size, ECDSA P-256 by default
+func (c *Config) keyRequest() *csr.KeyRequest {
+	if c.DefaultKeyRequest == nil {
+		return csr.NewKeyRequest()
+	}
+
+	return c.DefaultKeyRequest
+}
+
+// certHosts returns the DNS names and IPs a cert is issued for, the common
+// name first and without duplicates
+func certHosts(CN string, hosts []string) ([]string, []string) {
+	seen := map[string]bool{}
+	dns, ips := make([]string, 0, len(hosts)+1), make([]string, 0)
+	for _, h := range append([]string{CN}, hosts...) {
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		if net.ParseIP(h) != nil {
+			ips = append(ips, h)
+			continue
+		}
+		dns = append(dns, h)
+	}
+
+	return dns, ips
+}
+
+func (c *Client) GenerateCert(CN string, hosts ...string) (*Bundle, error) {
+	// a rotated root signs in-process
+	if r := c.currentRotation(); r.signs() {
+		return r.issuer.GenerateCert(CN, hosts...)
+	}
+
+	if c.issuer != nil {
+		return c.issuer.GenerateCert(CN, hosts...)
+	}
+
 	if CN == "" {
 		return nil, fmt.Errorf("hostname can't be empty")
 	}
 
-	// Prepare a default request
+	// Prepare a default request, CFSSL sorts hosts into DNS and IP SANs
 	req := c.prepareRequest()
-	req.Hosts = []string{CN}
+	dns, ips := certHosts(CN, hosts)
+	req.Hosts = append(dns, ips...)
 	req.CN = CN
 
 	// API Client for CFSSL
@@ -218,6 +343,11 @@ func (c *Client) GenerateCert(CN string) (*Bundle, error) {
 }
 
 func (c *Client) getPrivateKeyAsPem(pKey crypto.PrivateKey, kr *csr.KeyRequest) ([]byte, error) {
+	return privateKeyPEM(pKey, kr)
+}
+
+// privateKeyPEM encodes a generated private key the way Tyk expects it
+func privateKeyPEM(pKey crypto.PrivateKey, kr *csr.KeyRequest) ([]byte, error) {
 	switch kr.Algo() {
 	case "rsa":
 		pemData := pem.EncodeToMemory(
@@ -247,80 +377,50 @@ func (c *Client) getPrivateKeyAsPem(pKey crypto.PrivateKey, kr *csr.KeyRequest)
 	return nil, errors.New("format not supported")
 }
 
-func (c *Client) initStorage() error {
-	sess, err := mgo.Dial(c.CA.MongoConnStr)
-	if err != nil {
-		return err
-	}
-
-	c.storeInit = true
-	c.storeSess = sess
-	return nil
+// MeshCertIssuer is implemented by CA clients issuing the certificate of the
+// mesh routes
+type MeshCertIssuer interface {
+	GetOrCreateMeshCertID(hosts ...string) (string, error)
 }
 
-func (c *Client) StoreCert(cert *CertModel) (*CertModel, error) {
-	m := c.storeSess.Clone()
-	defer m.Close()
-	if cert.MID.Hex() == "" {
-		cert.MID = bson.NewObjectId()
-	}
-
-	return cert, m.DB("").C(caCol).Insert(cert)
-}
-
-func (c *Client) GetCertByFingerprint(fp string) (*CertModel, error) {
-	m := c.storeSess.Clone()
-	defer m.Close()
-
-	cert := &CertModel{}
-	err := m.DB("").C(caCol).Find(bson.M{"Bundle.Fingerprint": fp}).One(cert)
+// GetOrCreateMeshCertID returns the ID of the certificate of the mesh routes,
+// issuing one for the mesh hostnames if there is none or it doesn't cover
+// all of them
+func (c *Client) GetOrCreateMeshCertID(hosts ...string) (string, error) {
+	found, err := c.GetMeshCert()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return cert, nil
-}
-
-func (c *Client) GetServerCertByLinkedAPIID(serviceID string) (*CertModel, error) {
-	m := c.storeSess.Clone()
-	defer m.Close()
-
-	cert := &CertModel{}
-	err := m.DB("").C(caCol).Find(bson.M{"ServiceID": serviceID}).One(cert)
-	if err != nil {
-		return nil, err
+	if found != nil && !c.StaleCert(found) && covers(found, hosts) {
+		// return the last expiring cert
+		return found.Bundle.Fingerprint, nil
 	}
 
-	return cert, nil
-}
-
-func (c *Client) GetOrCreateMeshCertID() (string, error) {
-	m := c.storeSess.Clone()
-	foundCerts := make([]*CertModel, 0)
-	err := m.DB("").C(caCol).Find(
-		bson.M{
-			"IsMeshCert": true,
-			"Expires": bson.M{
-				"$gt": time.Now(),
-			},
-		}).Sort("-Expires").All(&foundCerts)
-	if err != nil {
-		return "", err
-	}
+	// certs signed by a root being rotated out are replaced, unless that
+	// happened already
+	if found != nil {
+		all, err := c.ListCerts()
+		if err != nil {
+			return "", err
+		}
 
-	if len(foundCerts) > 0 {
-		// return the last expiring cert
-		return foundCerts[0].Bundle.Fingerprint, nil
+		now := time.Now()
+		for _, cm := range all {
+			if cm.IsMeshCert && cm.Expires.After(now) && !c.StaleCert(cm) && covers(cm, hosts) {
+				return cm.Bundle.Fingerprint, nil
+			}
+		}
 	}
 
 	// no cert, let's make one
-	bdl, err := c.GenerateCert("mesh")
+	bdl, err := c.GenerateCert("mesh", hosts...)
 	if err != nil {
 		return "", err
 	}
 
 	// Store it
-	id, err := tyk.CreateCertificate(bdl.Certificate, bdl.PrivateKey)
+	id, err := tyk.Default().CreateCertificate(context.Background(), bdl.Certificate, bdl.PrivateKey)
 	if err != nil {
 		return "", err
 	}
@@ -333,9 +433,36 @@ func (c *Client) GetOrCreateMeshCertID() (string, error) {
 		return "", err
 	}
 
+	// injectors prefer the cert of the last rotation, this one replaces it
+	if prev := c.RotationMeshCert(); prev != "" && prev != cm.Bundle.Fingerprint {
+		if err := c.SetRotationMeshCert(cm.Bundle.Fingerprint); err != nil {
+			log.Warningf("failed to record the mesh certificate %v in the CA rotation: %v", cm.Bundle.Fingerprint, err)
+		}
+	}
+
 	return cm.Bundle.Fingerprint, nil
 }
 
+// covers reports whether a cert is issued for all the hosts, certs that can't
+// be parsed are kept
+func covers(cm *CertModel, hosts []string) bool {
+	if cm.Bundle == nil {
+		return true
+	}
+
+	leaf, err := cm.Bundle.leaf()
+	if err != nil {
+		return true
+	}
+
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
 func NewCertModel(bundle *Bundle) *CertModel {
 	c := &CertModel{}
 	c.Bundle = bundle
@@ -350,5 +477,6 @@ func NewCertModel(bundle *Bundle) *CertModel {
 	}
 
 	c.Expires = cObj.NotAfter
+	c.Serial = cObj.SerialNumber.String()
 	return c
 }
@@ -1,10 +1,31 @@
 package ca
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/cfssl/csr"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 // Requires a CFFSL server to be running
@@ -34,3 +55,641 @@ func TestCA_GenerateSSLCert(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMatchSVID(t *testing.T) {
+	svids := []*x509svid.SVID{
+		{
+			ID:           spiffeid.RequireFromString("spiffe://example.org/ns/bar/sa/foo"),
+			Certificates: []*x509.Certificate{{DNSNames: []string{"foo.bar"}}},
+		},
+		{
+			ID:           spiffeid.RequireFromString("spiffe://example.org/ns/bar/sa/baz"),
+			Certificates: []*x509.Certificate{{DNSNames: []string{"mesh"}}},
+		},
+	}
+
+	cases := map[string]string{
+		"spiffe://example.org/ns/bar/sa/foo": "spiffe://example.org/ns/bar/sa/foo",
+		"foo.bar":                            "spiffe://example.org/ns/bar/sa/foo",
+		"mesh":                               "spiffe://example.org/ns/bar/sa/baz",
+	}
+
+	for name, exp := range cases {
+		svid, err := matchSVID(svids, name)
+		if err != nil || svid.ID.String() != exp {
+			t.Fatalf("expected %v for %v, got %v (%v)", exp, name, svid, err)
+		}
+	}
+
+	if _, err := matchSVID(svids, "spiffe://example.org/ns/bar/sa/qux"); err == nil {
+		t.Fatal("expected an error for an unknown identity")
+	}
+
+	iss, err := newSpireIssuer(&SpireConfig{TrustDomain: "example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{issuer: iss}
+	if id := c.SPIFFEID("bar", "foo"); id != "spiffe://example.org/ns/bar/sa/foo" {
+		t.Fatalf("unexpected SPIFFE ID %v", id)
+	}
+}
+
+func TestCertManagerIssuer(t *testing.T) {
+	name := certificateName("foo.bar")
+	if name != "tyk-mesh-foo-bar" {
+		t.Fatalf("unexpected certificate name %v", name)
+	}
+
+	if long := certificateName(strings.Repeat("a", 80)); len(long) > 63 {
+		t.Fatalf("certificate name %v is too long", long)
+	}
+
+	dyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	kc := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "mesh"},
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte(dummyCert),
+			corev1.TLSPrivateKeyKey: []byte(dummyKey),
+		},
+	})
+
+	iss, err := newCertManagerIssuerWithClients(&CertManagerConfig{Namespace: "mesh", IssuerName: "ca", Timeout: time.Second}, dyn, kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bdl, err := iss.GenerateCert("foo.bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(bdl.Certificate) != dummyCert || bdl.Fingerprint == "" {
+		t.Fatalf("unexpected bundle %+v", bdl)
+	}
+
+	crt, err := dyn.Resource(certificateGVR).Namespace("mesh").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cn, _, _ := unstructured.NestedString(crt.Object, "spec", "commonName"); cn != "foo.bar" {
+		t.Fatalf("unexpected certificate common name %v", cn)
+	}
+
+	if algo, _, _ := unstructured.NestedString(crt.Object, "spec", "privateKey", "algorithm"); algo != "ECDSA" {
+		t.Fatalf("expected an ECDSA key by default, got %v", algo)
+	}
+
+	qux := certificateName("qux.bar")
+	kc.CoreV1().Secrets("mesh").Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: qux, Namespace: "mesh"},
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte(dummyCert),
+			corev1.TLSPrivateKeyKey: []byte(dummyKey),
+		},
+	})
+
+	if _, err := iss.GenerateCert("qux.bar", "qux", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	crt, _ = dyn.Resource(certificateGVR).Namespace("mesh").Get(qux, metav1.GetOptions{})
+	dns, _, _ := unstructured.NestedStringSlice(crt.Object, "spec", "dnsNames")
+	ips, _, _ := unstructured.NestedStringSlice(crt.Object, "spec", "ipAddresses")
+	if strings.Join(dns, ",") != "qux.bar,qux" || strings.Join(ips, ",") != "10.0.0.1" {
+		t.Fatalf("unexpected SANs %v %v", dns, ips)
+	}
+
+	if _, err := iss.GenerateCert("baz.bar"); err == nil {
+		t.Fatal("expected a timeout for a certificate that is never issued")
+	}
+}
+
+func TestVaultIssuer(t *testing.T) {
+	logins := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			logins++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"auth": map[string]interface{}{"client_token": fmt.Sprintf("token-%d", logins), "lease_duration": 3600},
+			})
+
+		case "/v1/pki/issue/mesh":
+			// the first token is revoked
+			if r.Header.Get(vaultTokenHeader) != "token-2" {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+				return
+			}
+
+			req := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req["common_name"] != "foo.bar" || req["ttl"] != "1h0m0s" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"certificate": dummyCert,
+					"private_key": dummyKey,
+					"issuing_ca":  dummyCert,
+				},
+			})
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	iss, err := newVaultIssuer(&VaultConfig{Addr: srv.URL, AuthMethod: VaultAuthAppRole, RoleID: "r", SecretID: "s", Role: "mesh", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bdl, err := iss.GenerateCert("foo.bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if logins != 2 || string(bdl.PrivateKey) != dummyKey || bdl.Fingerprint == "" {
+		t.Fatalf("unexpected bundle after %d logins: %+v", logins, bdl)
+	}
+
+	if _, err := newVaultIssuer(&VaultConfig{Addr: srv.URL, Role: "mesh", AuthMethod: "ldap"}); err == nil {
+		t.Fatal("expected an error for an unsupported auth method")
+	}
+}
+
+func TestClient_Revocation(t *testing.T) {
+	var revoked map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case cfsslRevokePath:
+			json.NewDecoder(r.Body).Decode(&revoked)
+		case cfsslCRLPath:
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": "Y3Js"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Client{CA: &Config{Addr: strings.TrimPrefix(srv.URL, "http://")}}
+	cert := NewCertModel(&Bundle{Certificate: []byte(dummyCert)})
+	if err := c.revokeCFSSL(cert, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked["serial"] != cert.Serial || revoked["reason"] != "keyCompromise" {
+		t.Fatalf("unexpected revocation request %v", revoked)
+	}
+
+	crl, err := c.CRL()
+	if err != nil || string(crl) != "crl" {
+		t.Fatalf("unexpected CRL %q (%v)", crl, err)
+	}
+
+	if _, err := RevocationReason("bogus"); err == nil {
+		t.Fatal("expected an error for an unknown reason")
+	}
+}
+
+func TestSecretStore(t *testing.T) {
+	kc := fake.NewSimpleClientset()
+	s := &docStore{b: newSecretBackendWithClient(kc, "tyk")}
+
+	identity := NewCertModel(&Bundle{Certificate: []byte(dummyCert), Fingerprint: "identity"})
+	identity.Identity = "apps/web"
+	mesh := NewCertModel(&Bundle{Certificate: []byte(dummyCert), Fingerprint: "mesh"})
+	mesh.IsMeshCert = true
+	for _, c := range []*CertModel{identity, mesh} {
+		if _, err := s.StoreCert(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []*CertModel{identity, mesh} {
+		if _, err := kc.CoreV1().Secrets("tyk").Get(certSecretPrefix+c.MID.Hex(), metav1.GetOptions{}); err != nil {
+			t.Fatalf("cert not stored in the configured namespace: %v", err)
+		}
+	}
+
+	// labelled Secrets of other namespaces aren't trusted
+	forged := NewCertModel(&Bundle{Certificate: []byte(dummyCert), Fingerprint: "forged"})
+	forged.IsMeshCert = true
+	(&secretBackend{kc: kc, namespace: "apps"}).put(forged)
+	if found, _ := s.GetCertByFingerprint("forged"); found != nil {
+		t.Fatal("certs outside the configured namespace should be ignored")
+	}
+
+	found, err := s.GetMeshCert()
+	if err != nil || found == nil || found.Bundle.Fingerprint != "mesh" {
+		t.Fatalf("unexpected mesh cert %+v (%v)", found, err)
+	}
+
+	found, err = s.GetCertByIdentity("apps/web")
+	if err != nil || found.MID != identity.MID {
+		t.Fatalf("unexpected identity cert %+v (%v)", found, err)
+	}
+
+	identity.Revoked = true
+	if err := s.UpdateCert(identity); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetCertByIdentity("apps/web"); err == nil {
+		t.Fatal("revoked identity cert still returned")
+	}
+
+	revoked, err := s.ListRevokedCerts()
+	if err != nil || len(revoked) != 1 || revoked[0].Serial != identity.Serial {
+		t.Fatalf("unexpected revoked certs %+v (%v)", revoked, err)
+	}
+
+	if _, err := s.GetCertBySerial(mesh.Serial); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := s.ListCerts()
+	if err != nil || len(all) != 2 || all[0].Expires.Before(all[1].Expires) {
+		t.Fatalf("unexpected certs %+v (%v)", all, err)
+	}
+}
+
+func TestCertHosts(t *testing.T) {
+	dns, ips := certHosts("foo.bar", []string{"foo", "foo.bar", "", "10.0.0.1", "fd00::1", "mesh"})
+	if strings.Join(dns, ",") != "foo.bar,foo,mesh" {
+		t.Fatalf("unexpected DNS names %v", dns)
+	}
+
+	if strings.Join(ips, ",") != "10.0.0.1,fd00::1" {
+		t.Fatalf("unexpected IPs %v", ips)
+	}
+}
+
+func TestCovers(t *testing.T) {
+	kr := csr.NewKeyRequest()
+	rootPEM, rootKeyPEM, err := generateRoot("Root", nil, kr, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpb, _ := pem.Decode(rootPEM)
+	root, _ := x509.ParseCertificate(rpb.Bytes)
+	rootKey, _ := parsePrivateKey(rootKeyPEM)
+
+	iss := &localIssuer{cert: root, key: rootKey, keyReq: kr, validity: time.Hour}
+	bdl, err := iss.GenerateCert("mesh", "mesh.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm := NewCertModel(bdl)
+	if !covers(cm, []string{"mesh", "mesh.local"}) {
+		t.Fatal("expected the mesh cert to cover its hostnames")
+	}
+	if covers(cm, []string{"mesh", "mesh.internal"}) {
+		t.Fatal("a cert missing a mesh hostname should be reissued")
+	}
+	if !covers(&CertModel{Bundle: &Bundle{}}, []string{"mesh"}) {
+		t.Fatal("certs that can't be parsed should be kept")
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ca/bundle" {
+			http.NotFound(w, r)
+			return
+		}
+
+		calls++
+		if calls == 1 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+
+		c := &Client{CA: &Config{}, caCert: []byte(dummyCert)}
+		c.ServeCABundle(w, r)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bundle, err := FetchBundle(ctx, srv.URL+"/ca/bundle", "", false)
+	if err != nil || string(bundle) != dummyCert || calls != 2 {
+		t.Fatalf("unexpected bundle %q after %d calls (%v)", bundle, calls, err)
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := FetchBundle(short, srv.URL+"/missing", "", false); err == nil {
+		t.Fatal("expected an error for an unreachable CA")
+	}
+
+	dir, err := ioutil.TempDir("", "trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	system := filepath.Join(dir, "system.crt")
+	if err := ioutil.WriteFile(system, []byte("system"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteTrustStore(dir, []byte("garbage"), nil); err == nil {
+		t.Fatal("expected an error for an invalid chain")
+	}
+
+	if err := WriteTrustStore(dir, bundle, []string{filepath.Join(dir, "missing"), system}); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, _ := ioutil.ReadFile(filepath.Join(dir, TrustBundleName))
+	if string(merged) != "system\n"+dummyCert {
+		t.Fatalf("unexpected merged bundle %q", merged)
+	}
+}
+
+func TestServeCABundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	next := filepath.Join(dir, "next.pem")
+	if err := ioutil.WriteFile(next, []byte(dummyCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{CA: &Config{NextCertPaths: []string{next}}, caCert: []byte(dummyCert)}
+	rec := httptest.NewRecorder()
+	c.ServeCABundle(rec, httptest.NewRequest("GET", "/ca/bundle.pem", nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" || strings.Count(rec.Body.String(), "BEGIN CERTIFICATE") != 2 {
+		t.Fatalf("unexpected response %v %q: %s", rec.Code, etag, rec.Body)
+	}
+
+	req := httptest.NewRequest("GET", "/ca/bundle.pem", nil)
+	req.Header.Set("If-None-Match", `"stale", `+etag)
+	rec = httptest.NewRecorder()
+	c.ServeCABundle(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("expected a 304 for the current ETag, got %v", rec.Code)
+	}
+
+	c.CA.NextCertPaths = nil
+	rec = httptest.NewRecorder()
+	c.ServeCABundle(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Fatalf("expected the bundle to change once the upcoming root is dropped, got %v", rec.Code)
+	}
+}
+
+func TestClient_Rotation(t *testing.T) {
+	c := &Client{
+		CA:       &Config{Rotation: RotationConfig{Namespace: "tyk"}},
+		caCert:   []byte(dummyCert),
+		rotation: &rotationState{kc: fake.NewSimpleClientset()},
+	}
+
+	status, err := c.StartRotation()
+	if err != nil || status.Phase != RotationPublishing {
+		t.Fatalf("unexpected status %+v (%v)", status, err)
+	}
+
+	if _, err := c.StartRotation(); err == nil {
+		t.Fatal("expected only one rotation at a time")
+	}
+
+	bundle, err := c.CABundle()
+	if err != nil || strings.Count(string(bundle), "BEGIN CERTIFICATE") != 2 {
+		t.Fatalf("expected both roots to be published, got %s (%v)", bundle, err)
+	}
+
+	old := NewCertModel(&Bundle{Certificate: []byte(dummyCert)})
+	if c.StaleCert(old) {
+		t.Fatal("the old root still signs while the new one is published")
+	}
+
+	if status, _ := c.AdvanceRotation(0); status.Phase != RotationPublishing {
+		t.Fatalf("expected to wait for the publish period, got %v", status.Phase)
+	}
+
+	c.SkipRotationWait()
+	if status, _ := c.AdvanceRotation(0); status.Phase != RotationReissuing {
+		t.Fatalf("expected leaves to be reissued, got %v", status.Phase)
+	}
+
+	bdl, err := c.GenerateCert("foo.bar", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := NewCertModel(bdl)
+	if c.StaleCert(leaf) || !c.StaleCert(old) {
+		t.Fatal("expected only certs of the old root to be stale")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(bundle)
+	cpb, _ := pem.Decode(bdl.Certificate)
+	cert, _ := x509.ParseCertificate(cpb.Bytes)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: pool, DNSName: "foo.bar"}); err != nil {
+		t.Fatalf("leaf not trusted by the published bundle: %v", err)
+	}
+
+	if err := c.SetRotationMeshCert("mesh-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := c.AdvanceRotation(3); status.Phase != RotationReissuing || status.Pending != 3 {
+		t.Fatalf("expected to wait for pending certs, got %+v", status)
+	}
+
+	c.AdvanceRotation(0)
+	c.SkipRotationWait()
+	if status, _ := c.AdvanceRotation(0); status.Phase != RotationComplete {
+		t.Fatalf("expected the old root to be retired, got %v", status.Phase)
+	}
+
+	c.rotation.cur = nil // read it back from the Secret
+	bundle, _ = c.CABundle()
+	if strings.Count(string(bundle), "BEGIN CERTIFICATE") != 1 || strings.Contains(string(bundle), dummyCert) {
+		t.Fatalf("expected only the new root to be published, got %s", bundle)
+	}
+
+	if c.RotationMeshCert() != "mesh-2" {
+		t.Fatalf("expected the reissued mesh certificate to be recorded, got %q", c.RotationMeshCert())
+	}
+
+	// a second rotation can be aborted back to the first
+	first := status.Root
+	if status, _ := c.StartRotation(); status.MeshCert != "mesh-2" {
+		t.Fatalf("expected the mesh certificate to be kept by the next rotation, got %q", status.MeshCert)
+	}
+	status, err = c.AbortRotation()
+	if err != nil || status.Phase != RotationComplete || status.Root != first || status.MeshCert != "mesh-2" {
+		t.Fatalf("unexpected status after aborting %+v (%v)", status, err)
+	}
+}
+
+func TestIntermediateIssuer(t *testing.T) {
+	kr := csr.NewKeyRequest()
+	rootPEM, rootKeyPEM, err := generateRoot("Offline Root", nil, kr, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpb, _ := pem.Decode(rootPEM)
+	root, _ := x509.ParseCertificate(rpb.Bytes)
+	rootKey, _ := parsePrivateKey(rootKeyPEM)
+
+	// the online intermediate, as signed by the offline root
+	_, keyPEM, _ := generateRoot("Online Intermediate", nil, kr, time.Hour)
+	key, _ := parsePrivateKey(keyPEM)
+	serial, _ := serialNumber()
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Online Intermediate"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}, root, key.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	kc := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "intermediate", Namespace: "tyk"},
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       interPEM,
+			corev1.TLSPrivateKeyKey: keyPEM,
+			"ca.crt":                rootPEM,
+		},
+	})
+
+	cfg := &Config{Intermediate: IntermediateConfig{Source: IntermediateSecret, Secret: "tyk/intermediate"}}
+	iss, trusted, err := newIntermediateIssuer(cfg, kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(trusted) != string(rootPEM) {
+		t.Fatalf("expected the root to be trusted, got %s", trusted)
+	}
+
+	bdl, err := iss.GenerateCert("foo.bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Count(string(bdl.Bundled), "BEGIN CERTIFICATE") != 3 {
+		t.Fatalf("expected the leaf to be bundled with the full chain, got %s", bdl.Bundled)
+	}
+
+	roots, inters := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(root)
+	inters.AppendCertsFromPEM(interPEM)
+	lpb, _ := pem.Decode(bdl.Certificate)
+	leaf, _ := x509.ParseCertificate(lpb.Bytes)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: inters, DNSName: "foo.bar"}); err != nil {
+		t.Fatalf("leaf not trusted through the intermediate: %v", err)
+	}
+
+	cfg.Intermediate.ChainDepth = 2
+	if _, _, err := newIntermediateIssuer(cfg, kc); err == nil {
+		t.Fatal("expected the chain depth to be enforced")
+	}
+
+	cfg.Intermediate.ChainDepth = 0
+	sec, _ := kc.CoreV1().Secrets("tyk").Get("intermediate", metav1.GetOptions{})
+	sec.Data[corev1.TLSPrivateKeyKey] = rootKeyPEM
+	kc.CoreV1().Secrets("tyk").Update(sec)
+	if _, _, err := newIntermediateIssuer(cfg, kc); err == nil {
+		t.Fatal("expected a key not matching the intermediate to be rejected")
+	}
+}
+
+func TestNamespaceCAs(t *testing.T) {
+	kr := csr.NewKeyRequest()
+	rootPEM, rootKeyPEM, err := generateRoot("Online Intermediate", nil, kr, 4*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpb, _ := pem.Decode(rootPEM)
+	root, _ := x509.ParseCertificate(rpb.Bytes)
+	rootKey, _ := parsePrivateKey(rootKeyPEM)
+
+	c := &Client{
+		CA:     &Config{Intermediate: IntermediateConfig{Namespaces: true}},
+		issuer: &localIssuer{cert: root, key: rootKey, chain: rootPEM, keyReq: kr, validity: time.Hour},
+		Store:  &docStore{b: newSecretBackendWithClient(fake.NewSimpleClientset(), "tyk")},
+	}
+
+	if td := c.TrustDomain("apps"); td != "apps.cluster.local" {
+		t.Fatalf("unexpected trust domain %v", td)
+	}
+
+	issue := func(ns string) *x509.Certificate {
+		bdl, err := c.GenerateNamespaceCert(ns, "web."+ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chain, err := parseChain(bdl.Bundled)
+		if err != nil || len(chain) != 3 {
+			t.Fatalf("expected the leaf bundled with its namespace CA and the intermediate, got %d certs (%v)", len(chain), err)
+		}
+
+		roots, inters := x509.NewCertPool(), x509.NewCertPool()
+		roots.AddCert(root)
+		inters.AddCert(chain[1])
+		if _, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: inters, DNSName: "web." + ns}); err != nil {
+			t.Fatalf("leaf not trusted through the namespace CA: %v", err)
+		}
+
+		return chain[1]
+	}
+
+	apps, again, other := issue("apps"), issue("apps"), issue("other")
+	if apps.Subject.CommonName != "apps.cluster.local" || !apps.Equal(again) {
+		t.Fatalf("expected the CA of apps to be reused, got %v and %v", apps.Subject, again.Subject)
+	}
+
+	if other.Equal(apps) {
+		t.Fatal("expected a CA per namespace")
+	}
+
+	// the CAs are loaded from the store after a restart
+	restarted := &Client{CA: c.CA, issuer: c.issuer, Store: c.Store}
+	if _, err := restarted.GenerateNamespaceCert("apps", "web.apps"); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.nsCAs["apps.cluster.local"].cert.Equal(apps) {
+		t.Fatal("expected the stored CA to be reused after a restart")
+	}
+
+	// without namespace CAs the intermediate signs
+	c.CA.Intermediate.Namespaces = false
+	bdl, err := c.GenerateNamespaceCert("apps", "web.apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain, _ := parseChain(bdl.Bundled); len(chain) != 2 {
+		t.Fatalf("expected the leaf to be signed by the intermediate, got %d certs", len(chain))
+	}
+}
@@ -0,0 +1,231 @@
+package ca
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk/certs"
+	"github.com/cloudflare/cfssl/csr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/kube"
+)
+
+const (
+	defaultCertManagerTimeout = 2 * time.Minute
+	certManagerPollInterval   = time.Second
+	certManagerNamePrefix     = "tyk-mesh-"
+
+	// caSecretKey holds the issuing CA in cert-manager Secrets
+	caSecretKey = "ca.crt"
+)
+
+var (
+	certificateGVR = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+	invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+type CertManagerConfig struct {
+	Namespace   string        `yaml:"namespace"`   // namespace the Certificates and their Secrets are created in
+	IssuerName  string        `yaml:"issuerName"`  // cert-manager issuer signing the mesh certificates
+	IssuerKind  string        `yaml:"issuerKind"`  // Issuer (default) or ClusterIssuer
+	Duration    time.Duration `yaml:"duration"`    // requested certificate lifetime, cert-manager's default if unset
+	RenewBefore time.Duration `yaml:"renewBefore"` // how long before expiry cert-manager renews
+	Timeout     time.Duration `yaml:"timeout"`     // how long to wait for a certificate to be issued
+}
+
+// certManagerIssuer delegates signing to cert-manager, a Certificate resource
+// is created per name and the issued certificate is read from its Secret.
+// cert-manager renews the Secret ahead of expiry, an expired copy in the
+// controller store is replaced by the renewed certificate when reissued.
+type certManagerIssuer struct {
+	cfg *CertManagerConfig
+	key *csr.KeyRequest
+	dyn dynamic.Interface
+	kc  kubernetes.Interface
+}
+
+func newCertManagerIssuer(cfg *CertManagerConfig) (*certManagerIssuer, error) {
+	restCfg, err := kube.RestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dyn, err := dynamic.NewForConfig(restCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	kc, err := kube.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return newCertManagerIssuerWithClients(cfg, dyn, kc)
+}
+
+func newCertManagerIssuerWithClients(cfg *CertManagerConfig, dyn dynamic.Interface, kc kubernetes.Interface) (*certManagerIssuer, error) {
+	if cfg.IssuerName == "" {
+		return nil, fmt.Errorf("an issuer is required for the cert-manager backend")
+	}
+
+	if cfg.Namespace == "" {
+		cfg.Namespace = "default"
+	}
+
+	if cfg.IssuerKind == "" {
+		cfg.IssuerKind = "Issuer"
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultCertManagerTimeout
+	}
+
+	return &certManagerIssuer{cfg: cfg, key: csr.NewKeyRequest(), dyn: dyn, kc: kc}, nil
+}
+
+// certificateName turns a common name into a valid resource name, long names
+// are shortened with a hash suffix to stay unique
+func certificateName(cn string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(cn), "-"), "-")
+	if len(certManagerNamePrefix)+len(name) > 63 {
+		sum := fmt.Sprintf("%x", sha256.Sum256([]byte(cn)))[:8]
+		name = strings.Trim(name[:63-len(certManagerNamePrefix)-9], "-") + "-" + sum
+	}
+
+	return certManagerNamePrefix + name
+}
+
+func (c *certManagerIssuer) certificate(name, cn string, hosts []string) *unstructured.Unstructured {
+	dns, ips := certHosts(cn, hosts)
+	spec := map[string]interface{}{
+		"secretName": name,
+		"commonName": cn,
+		"dnsNames":   toInterfaces(dns),
+		"usages":     []interface{}{"server auth", "client auth"},
+		"issuerRef": map[string]interface{}{
+			"name":  c.cfg.IssuerName,
+			"kind":  c.cfg.IssuerKind,
+			"group": certificateGVR.Group,
+		},
+		"privateKey": map[string]interface{}{
+			"algorithm": strings.ToUpper(c.key.Algo()),
+			"size":      int64(c.key.Size()),
+		},
+	}
+
+	if len(ips) > 0 {
+		spec["ipAddresses"] = toInterfaces(ips)
+	}
+
+	if c.cfg.Duration > 0 {
+		spec["duration"] = c.cfg.Duration.String()
+	}
+
+	if c.cfg.RenewBefore > 0 {
+		spec["renewBefore"] = c.cfg.RenewBefore.String()
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": certificateGVR.GroupVersion().String(),
+		"kind":       "Certificate",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": c.cfg.Namespace,
+			"labels":    map[string]interface{}{"app.kubernetes.io/managed-by": "tyk-k8s"},
+		},
+		"spec": spec,
+	}}
+}
+
+func toInterfaces(s []string) []interface{} {
+	res := make([]interface{}, len(s))
+	for i, v := range s {
+		res[i] = v
+	}
+
+	return res
+}
+
+// GenerateCert requests a certificate from cert-manager and waits for it to be issued
+func (c *certManagerIssuer) GenerateCert(CN string, hosts ...string) (*Bundle, error) {
+	if CN == "" {
+		return nil, fmt.Errorf("hostname can't be empty")
+	}
+
+	name := certificateName(CN)
+	_, err := c.dyn.Resource(certificateGVR).Namespace(c.cfg.Namespace).Create(c.certificate(name, CN, hosts), metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("failed to create certificate %v: %v", name, err)
+	}
+
+	var bdl *Bundle
+	err = wait.PollImmediate(certManagerPollInterval, c.cfg.Timeout, func() (bool, error) {
+		sec, err := c.kc.CoreV1().Secrets(c.cfg.Namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		bdl, err = secretBundle(sec)
+		if err != nil {
+			log.Debugf("certificate %v not ready: %v", name, err)
+			return false, nil
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("certificate %v was not issued: %v", name, err)
+	}
+
+	return bdl, nil
+}
+
+// secretBundle reads a valid certificate from a cert-manager Secret
+func secretBundle(sec *corev1.Secret) (*Bundle, error) {
+	crt, key := sec.Data[corev1.TLSCertKey], sec.Data[corev1.TLSPrivateKeyKey]
+	if len(crt) == 0 || len(key) == 0 {
+		return nil, fmt.Errorf("secret has no key pair")
+	}
+
+	cpb, _ := pem.Decode(crt)
+	if cpb == nil {
+		return nil, fmt.Errorf("secret has no PEM certificate")
+	}
+
+	cObj, err := x509.ParseCertificate(cpb.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(cObj.NotAfter) {
+		return nil, fmt.Errorf("certificate expired on %v", cObj.NotAfter)
+	}
+
+	bundled := append([]byte{}, crt...)
+	bundled = append(bundled, sec.Data[caSecretKey]...)
+
+	return &Bundle{
+		PrivateKey:  key,
+		Certificate: crt,
+		Bundled:     bundled,
+		Fingerprint: certs.HexSHA256(cObj.Raw),
+	}, nil
+}
@@ -0,0 +1,224 @@
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/kube"
+)
+
+const (
+	// Where the key pair of the intermediate is loaded from
+	IntermediateFile   = "file"
+	IntermediateSecret = "secret"
+	IntermediateVault  = "vault"
+
+	intermediateChainKey = "ca.crt"
+
+	defaultLeafValidity = 365 * 24 * time.Hour
+)
+
+// IntermediateConfig configures the intermediate CA of the intermediate
+// backend, the root stays offline and only its certificate is needed
+type IntermediateConfig struct {
+	Source       string        `yaml:"source"`       // file (default), secret or vault
+	CertPath     string        `yaml:"certPath"`     // file: PEM chain from the intermediate up to the root
+	KeyPath      string        `yaml:"keyPath"`      // file: key of the intermediate
+	Secret       string        `yaml:"secret"`       // secret: namespace/name of a Secret with tls.crt, tls.key and ca.crt
+	VaultPath    string        `yaml:"vaultPath"`    // vault: KV path with certificate, private_key and ca_chain, read with the vault settings
+	ChainDepth   int           `yaml:"chainDepth"`   // CAs between the leaves and the root, 1 if unset
+	LeafValidity time.Duration `yaml:"leafValidity"` // lifetime of the issued leaves, a year if unset
+
+	// Namespaces signs the certificates of each namespace with a CA of its
+	// own, issued by the intermediate for the trust domain of the namespace
+	Namespaces        bool          `yaml:"namespaces"`
+	TrustDomainSuffix string        `yaml:"trustDomainSuffix"` // trust domains are <namespace>.<suffix>, cluster.local if unset
+	NamespaceValidity time.Duration `yaml:"namespaceValidity"` // lifetime of the namespace CAs, twice leafValidity if unset
+}
+
+// newIntermediateIssuer loads the intermediate and returns an issuer signing
+// with it and the PEM of the root pods have to trust
+func newIntermediateIssuer(cfg *Config, kc kubernetes.Interface) (*localIssuer, []byte, error) {
+	chainPEM, keyPEM, err := readIntermediate(cfg, kc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the intermediate CA: %w", err)
+	}
+
+	chain, err := parseChain(chainPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid intermediate chain: %w", err)
+	}
+
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid intermediate key: %w", err)
+	}
+
+	if !reflect.DeepEqual(key.Public(), chain[0].PublicKey) {
+		return nil, nil, fmt.Errorf("the key doesn't belong to the intermediate %v", chain[0].Subject.CommonName)
+	}
+
+	depth := cfg.Intermediate.ChainDepth
+	if depth <= 0 {
+		depth = 1
+	}
+
+	if err := verifyChain(chain, depth); err != nil {
+		return nil, nil, err
+	}
+
+	// the namespace CAs are one more CA below the intermediate
+	if cfg.Intermediate.Namespaces && chain[0].MaxPathLenZero {
+		return nil, nil, fmt.Errorf("the path length of %v doesn't allow the namespace CAs below it", chain[0].Subject.CommonName)
+	}
+
+	validity := cfg.Intermediate.LeafValidity
+	if validity <= 0 {
+		validity = defaultLeafValidity
+	}
+
+	// leaves are bundled with the whole chain, the root included
+	full := make([]byte, 0)
+	for _, c := range chain {
+		full = append(full, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	root := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[len(chain)-1].Raw})
+
+	if left := time.Until(chain[0].NotAfter); left < validity {
+		log.Warningf("intermediate %v expires in %v, before the leaves it issues", chain[0].Subject.CommonName, left.Round(time.Hour))
+	}
+
+	return &localIssuer{
+		cert:     chain[0],
+		key:      key,
+		chain:    full,
+		names:    cfg.DefaultNames,
+		keyReq:   cfg.keyRequest(),
+		validity: validity,
+	}, root, nil
+}
+
+// verifyChain checks a chain runs from a CA through depth-1 further CAs to a
+// self-signed root, with every CA signed by the next and allowed by its path
+// length constraint to sign the CAs below it
+func verifyChain(chain []*x509.Certificate, depth int) error {
+	if len(chain)-1 != depth {
+		return fmt.Errorf("expected %d CAs between the leaves and the root, the chain has %d, is the root missing?", depth, len(chain)-1)
+	}
+
+	now := time.Now()
+	for i, c := range chain {
+		if !c.IsCA || !c.BasicConstraintsValid {
+			return fmt.Errorf("%v is not a CA", c.Subject.CommonName)
+		}
+
+		if now.After(c.NotAfter) {
+			return fmt.Errorf("%v expired on %v", c.Subject.CommonName, c.NotAfter)
+		}
+
+		// the CAs below this one in the path, leaves don't count
+		if (c.MaxPathLen > 0 || c.MaxPathLenZero) && i > c.MaxPathLen {
+			return fmt.Errorf("%v only allows %d CAs below it, the chain has %d", c.Subject.CommonName, c.MaxPathLen, i)
+		}
+
+		parent := c
+		if i < len(chain)-1 {
+			parent = chain[i+1]
+		}
+
+		if err := c.CheckSignatureFrom(parent); err != nil {
+			if i == len(chain)-1 {
+				return fmt.Errorf("the chain doesn't end in a self-signed root: %w", err)
+			}
+			return fmt.Errorf("%v is not signed by %v: %w", c.Subject.CommonName, parent.Subject.CommonName, err)
+		}
+	}
+
+	return nil
+}
+
+// readIntermediate returns the PEM chain and key of the intermediate from
+// its configured source
+func readIntermediate(cfg *Config, kc kubernetes.Interface) ([]byte, []byte, error) {
+	ic := &cfg.Intermediate
+	switch ic.Source {
+	case "", IntermediateFile:
+		if ic.CertPath == "" || ic.KeyPath == "" {
+			return nil, nil, fmt.Errorf("certPath and keyPath are required")
+		}
+
+		chain, err := ioutil.ReadFile(ic.CertPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, err := ioutil.ReadFile(ic.KeyPath)
+		return chain, key, err
+
+	case IntermediateSecret:
+		parts := strings.SplitN(ic.Secret, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, nil, fmt.Errorf("secret %q must be namespace/name", ic.Secret)
+		}
+
+		if kc == nil {
+			var err error
+			if kc, err = kube.Client(); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		sec, err := kc.CoreV1().Secrets(parts[0]).Get(parts[1], metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return joinPEM(sec.Data[corev1.TLSCertKey], sec.Data[intermediateChainKey]), sec.Data[corev1.TLSPrivateKeyKey], nil
+
+	case IntermediateVault:
+		if ic.VaultPath == "" {
+			return nil, nil, fmt.Errorf("vaultPath is required")
+		}
+
+		v, err := newVaultClient(&cfg.Vault)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		data, err := v.read(strings.Trim(ic.VaultPath, "/"))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// KV version 2 nests the secret
+		if nested, ok := data["data"].(map[string]interface{}); ok {
+			data = nested
+		}
+
+		crt, _ := data["certificate"].(string)
+		key, _ := data["private_key"].(string)
+		chain, _ := data["ca_chain"].(string)
+		return joinPEM([]byte(crt), []byte(chain)), []byte(key), nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown source %q, must be %v, %v or %v", ic.Source, IntermediateFile, IntermediateSecret, IntermediateVault)
+	}
+}
+
+// joinPEM appends a chain to a certificate unless it holds the chain already
+func joinPEM(cert, chain []byte) []byte {
+	if len(chain) == 0 || strings.Contains(string(cert), strings.TrimSpace(string(chain))) {
+		return cert
+	}
+
+	return appendPEM(append([]byte{}, cert...), chain)
+}
@@ -0,0 +1,182 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/TykTechnologies/tyk/certs"
+	"github.com/cloudflare/cfssl/csr"
+)
+
+// localIssuer signs certificates in-process with a CA key pair held by the
+// controller, a root it generated during a rotation
+type localIssuer struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	chain    []byte // PEM chain bundled with the issued certificates
+	names    []csr.Name
+	keyReq   *csr.KeyRequest
+	validity time.Duration
+}
+
+// pkixName converts the first of the configured names into a subject
+func pkixName(CN string, names []csr.Name) pkix.Name {
+	n := pkix.Name{CommonName: CN}
+	if len(names) == 0 {
+		return n
+	}
+
+	first := names[0]
+	for _, v := range []struct {
+		dst *[]string
+		val string
+	}{
+		{&n.Country, first.C},
+		{&n.Province, first.ST},
+		{&n.Locality, first.L},
+		{&n.Organization, first.O},
+		{&n.OrganizationalUnit, first.OU},
+	} {
+		if v.val != "" {
+			*v.dst = []string{v.val}
+		}
+	}
+
+	return n
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func (l *localIssuer) GenerateCert(CN string, hosts ...string) (*Bundle, error) {
+	if CN == "" {
+		return nil, fmt.Errorf("hostname can't be empty")
+	}
+
+	priv, err := l.keyReq.Generate()
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", priv)
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkixName(CN, l.names),
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(l.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	dns, ips := certHosts(CN, hosts)
+	tpl.DNSNames = dns
+	for _, ip := range ips {
+		tpl.IPAddresses = append(tpl.IPAddresses, net.ParseIP(ip))
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, l.cert, signer.Public(), l.key)
+	if err != nil {
+		return nil, err
+	}
+
+	pKey, err := privateKeyPEM(priv, l.keyReq)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	bundled := append(append([]byte{}, cert...), l.chain...)
+
+	return &Bundle{PrivateKey: pKey, Certificate: cert, Fingerprint: certs.HexSHA256(der), Bundled: bundled}, nil
+}
+
+// generateRoot creates a self-signed root CA, returning its certificate and
+// key as PEM
+func generateRoot(CN string, names []csr.Name, kr *csr.KeyRequest, validity time.Duration) ([]byte, []byte, error) {
+	priv, err := kr.Generate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported key type %T", priv)
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkixName(CN, names),
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, signer.Public(), signer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := privateKeyPEM(priv, kr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// parsePrivateKey reads a PEM encoded PKCS#1, SEC 1 or PKCS#8 private key
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+
+	var key interface{}
+	var err error
+	switch blk.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(blk.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(blk.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(blk.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected %v block", blk.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return signer, nil
+}
@@ -1,15 +1,21 @@
 package ca
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/globalsign/mgo/bson"
 	uuid "github.com/satori/go.uuid"
 )
 
-type Mock struct{}
+// Mock is a CertClient for tests, stored certs are kept in memory
+type Mock struct {
+	mu    sync.Mutex
+	certs []*CertModel
+}
 
-func (m *Mock) GenerateCert(CN string) (*Bundle, error) {
+func (m *Mock) GenerateCert(CN string, hosts ...string) (*Bundle, error) {
 	return &Bundle{
 		PrivateKey:  []byte(dummyKey),
 		Certificate: []byte(dummyCert),
@@ -19,10 +25,19 @@ func (m *Mock) GenerateCert(CN string) (*Bundle, error) {
 
 func (m *Mock) StoreCert(cert *CertModel) (*CertModel, error) {
 	cert.MID = bson.NewObjectId()
+
+	m.mu.Lock()
+	m.certs = append(m.certs, cert)
+	m.mu.Unlock()
+
 	return cert, nil
 }
 
 func (m *Mock) GetCertByFingerprint(fp string) (*CertModel, error) {
+	if c := m.find(func(c *CertModel) bool { return c.Bundle.Fingerprint == fp }); c != nil {
+		return c, nil
+	}
+
 	b := NewCertModel(&Bundle{
 		PrivateKey:  []byte(dummyKey),
 		Certificate: []byte(dummyCert),
@@ -37,7 +52,87 @@ func (m *Mock) GetCertByFingerprint(fp string) (*CertModel, error) {
 }
 
 func (m *Mock) GetServerCertByLinkedAPIID(serviceID string) (*CertModel, error) {
-	return m.GetCertByFingerprint("")
+	if c := m.find(func(c *CertModel) bool { return c.ServiceID == serviceID }); c != nil {
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("no certificate for API %v", serviceID)
+}
+
+// find returns the last stored cert matching a filter
+func (m *Mock) find(match func(*CertModel) bool) *CertModel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.certs) - 1; i >= 0; i-- {
+		if match(m.certs[i]) {
+			return m.certs[i]
+		}
+	}
+
+	return nil
+}
+
+func (m *Mock) GetCertByIdentity(identity string) (*CertModel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.certs) - 1; i >= 0; i-- {
+		if m.certs[i].Identity == identity && !m.certs[i].Revoked {
+			return m.certs[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no certificate for identity %v", identity)
+}
+
+func (m *Mock) ListIdentityCerts() ([]*CertModel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := make([]*CertModel, 0)
+	for _, c := range m.certs {
+		if c.Identity != "" && !c.Revoked {
+			found = append(found, c)
+		}
+	}
+
+	return found, nil
+}
+
+func (m *Mock) ListCertsExpiringBefore(t time.Time) ([]*CertModel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := make([]*CertModel, 0)
+	for _, c := range m.certs {
+		if c.ServiceID != "" && !c.Revoked && c.Expires.Before(t) {
+			found = append(found, c)
+		}
+	}
+
+	return found, nil
+}
+
+func (m *Mock) UpdateCert(cert *CertModel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, c := range m.certs {
+		if c.MID == cert.MID {
+			m.certs[i] = cert
+			return nil
+		}
+	}
+
+	return fmt.Errorf("certificate %v not found", cert.MID.Hex())
+}
+
+func (m *Mock) Revoke(cert *CertModel, reason int) error {
+	cert.Revoked = true
+	cert.RevokedAt = time.Now()
+	cert.RevocationReason = reason
+	return m.UpdateCert(cert)
 }
 
 var dummyFingerPrint = "C50181444CF40FEC3BED58362AB9FC3473525BA3F481D0A3494C72291654D14A"
@@ -0,0 +1,219 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/TykTechnologies/tyk/certs"
+)
+
+const defaultTrustDomainSuffix = "cluster.local"
+
+// NamespaceIssuer is implemented by cert clients signing the certificates of
+// each namespace with an intermediate CA of its own, the trust domain of the
+// namespace. TrustDomain returns an empty name if the CA is not segmented.
+type NamespaceIssuer interface {
+	TrustDomain(namespace string) string
+	GenerateNamespaceCert(namespace, CN string, hosts ...string) (*Bundle, error)
+}
+
+// TrustDomain returns the trust domain of a namespace, <namespace>.<suffix>,
+// if the intermediate backend issues a CA per namespace
+func (c *Client) TrustDomain(namespace string) string {
+	if c.CA == nil || !c.CA.Intermediate.Namespaces || namespace == "" {
+		return ""
+	}
+
+	if _, ok := c.issuer.(*localIssuer); !ok {
+		return ""
+	}
+
+	suffix := c.CA.Intermediate.TrustDomainSuffix
+	if suffix == "" {
+		suffix = defaultTrustDomainSuffix
+	}
+	return namespace + "." + suffix
+}
+
+// GenerateNamespaceCert issues a certificate under the CA of the trust
+// domain of a namespace, creating the CA if there is none or it would
+// expire before the certificate. While a new root signs during a rotation it
+// signs the certificate directly, the namespace CAs are recreated under it
+// once the rotation completes and the old intermediate is replaced.
+func (c *Client) GenerateNamespaceCert(namespace, CN string, hosts ...string) (*Bundle, error) {
+	if c.TrustDomain(namespace) == "" || c.currentRotation().signs() {
+		return c.GenerateCert(CN, hosts...)
+	}
+
+	iss, err := c.namespaceIssuer(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("no CA for namespace %v: %w", namespace, err)
+	}
+
+	return iss.GenerateCert(CN, hosts...)
+}
+
+// namespaceIssuer returns the issuer of the CA of a namespace, loading it
+// from the store or creating it
+func (c *Client) namespaceIssuer(namespace string) (*localIssuer, error) {
+	parent := c.issuer.(*localIssuer)
+	td := c.TrustDomain(namespace)
+
+	c.nsMu.Lock()
+	defer c.nsMu.Unlock()
+
+	// the CA must outlive every leaf it issues
+	renewAt := time.Now().Add(parent.validity)
+	if iss, ok := c.nsCAs[td]; ok && iss.cert.NotAfter.After(renewAt) {
+		return iss, nil
+	}
+
+	all, err := c.ListCerts()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *CertModel
+	for _, cm := range all {
+		if cm.TrustDomain == td && !cm.Revoked && cm.Expires.After(renewAt) {
+			found = cm
+			break
+		}
+	}
+
+	if found == nil {
+		bdl, err := parent.issueCA(td, c.CA.Intermediate.namespaceValidity())
+		if err != nil {
+			return nil, err
+		}
+
+		cm := NewCertModel(bdl)
+		cm.TrustDomain = td
+		if found, err = c.StoreCert(cm); err != nil {
+			return nil, err
+		}
+		log.Infof("created the CA of trust domain %v", td)
+	}
+
+	iss, err := parent.subordinate(found.Bundle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA of trust domain %v: %w", td, err)
+	}
+
+	if c.nsCAs == nil {
+		c.nsCAs = map[string]*localIssuer{}
+	}
+	c.nsCAs[td] = iss
+
+	return iss, nil
+}
+
+// namespaceValidity is the lifetime of the namespace CAs, twice that of the
+// leaves so they are renewed halfway through
+func (ic *IntermediateConfig) namespaceValidity() time.Duration {
+	if ic.NamespaceValidity > 0 {
+		return ic.NamespaceValidity
+	}
+
+	validity := ic.LeafValidity
+	if validity <= 0 {
+		validity = defaultLeafValidity
+	}
+	return 2 * validity
+}
+
+// issueCA signs an intermediate CA for a trust domain that may only sign
+// leaves, the trust domain is its common name and only DNS name
+func (l *localIssuer) issueCA(td string, validity time.Duration) (*Bundle, error) {
+	priv, err := l.keyReq.Generate()
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", priv)
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if validity > time.Until(l.cert.NotAfter) {
+		validity = time.Until(l.cert.NotAfter)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkixName(td, l.names),
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		DNSNames:              []string{td},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, l.cert, signer.Public(), l.key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := privateKeyPEM(priv, l.keyReq)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return &Bundle{
+		PrivateKey:  keyPEM,
+		Certificate: cert,
+		Bundled:     append(append([]byte{}, cert...), l.chain...),
+		Fingerprint: certs.HexSHA256(der),
+	}, nil
+}
+
+// subordinate returns an issuer signing with a CA issued by l, the leaves it
+// issues are bundled with the CA and the chain of l and expire with the CA
+// at the latest
+func (l *localIssuer) subordinate(bdl *Bundle) (*localIssuer, error) {
+	blk, _ := pem.Decode(bdl.Certificate)
+	if blk == nil {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+
+	cert, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cert.CheckSignatureFrom(l.cert); err != nil {
+		return nil, fmt.Errorf("not signed by %v: %w", l.cert.Subject.CommonName, err)
+	}
+
+	key, err := parsePrivateKey(bdl.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	validity := l.validity
+	if left := time.Until(cert.NotAfter); left < validity {
+		validity = left
+	}
+
+	return &localIssuer{
+		cert:     cert,
+		key:      key,
+		chain:    append(append([]byte{}, bdl.Certificate...), l.chain...),
+		names:    l.names,
+		keyReq:   l.keyReq,
+		validity: validity,
+	}, nil
+}
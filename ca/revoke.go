@@ -0,0 +1,288 @@
+package ca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	cfsslRevokePath = "/api/v1/cfssl/revoke"
+	cfsslCRLPath    = "/api/v1/cfssl/crl"
+
+	defaultCRLExpiry    = 7 * 24 * time.Hour
+	ocspResponseTTL     = time.Hour
+	maxOCSPRequestBytes = 64 * 1024
+)
+
+// revocationReasons maps RFC 5280 reason names to their codes
+var revocationReasons = map[string]int{
+	"unspecified":          ocsp.Unspecified,
+	"keyCompromise":        ocsp.KeyCompromise,
+	"cACompromise":         ocsp.CACompromise,
+	"affiliationChanged":   ocsp.AffiliationChanged,
+	"superseded":           ocsp.Superseded,
+	"cessationOfOperation": ocsp.CessationOfOperation,
+	"certificateHold":      ocsp.CertificateHold,
+	"removeFromCRL":        ocsp.RemoveFromCRL,
+	"privilegeWithdrawn":   ocsp.PrivilegeWithdrawn,
+	"aACompromise":         ocsp.AACompromise,
+}
+
+// RevocationReason returns the code of a reason name, unspecified if empty
+func RevocationReason(name string) (int, error) {
+	if name == "" {
+		return ocsp.Unspecified, nil
+	}
+
+	code, ok := revocationReasons[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown revocation reason %q", name)
+	}
+
+	return code, nil
+}
+
+func reasonName(code int) string {
+	for name, c := range revocationReasons {
+		if c == code {
+			return name
+		}
+	}
+
+	return "unspecified"
+}
+
+type RevocationConfig struct {
+	OCSPCertPath string        `yaml:"ocspCertPath"` // OCSP signing cert issued by the CA, enables the responder
+	OCSPKeyPath  string        `yaml:"ocspKeyPath"`
+	CRLExpiry    time.Duration `yaml:"crlExpiry"` // validity of the CRLs requested from CFSSL
+}
+
+// leaf parses the certificate of a bundle
+func (b *Bundle) leaf() (*x509.Certificate, error) {
+	cpb, _ := pem.Decode(b.Certificate)
+	if cpb == nil {
+		return nil, fmt.Errorf("bundle has no PEM certificate")
+	}
+
+	return x509.ParseCertificate(cpb.Bytes)
+}
+
+// Revoke marks a cert as revoked in the store and, for the CFSSL backend,
+// revokes it with CFSSL so it is listed on its CRL
+func (c *Client) Revoke(cert *CertModel, reason int) error {
+	if c.issuer == nil {
+		if err := c.revokeCFSSL(cert, reason); err != nil {
+			return err
+		}
+	}
+
+	cert.Revoked = true
+	cert.RevokedAt = time.Now()
+	cert.RevocationReason = reason
+	return c.UpdateCert(cert)
+}
+
+func (c *Client) revokeCFSSL(cert *CertModel, reason int) error {
+	leaf, err := cert.Bundle.leaf()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"serial":           leaf.SerialNumber.String(),
+		"authority_key_id": strings.ToLower(hex.EncodeToString(leaf.AuthorityKeyId)),
+		"reason":           reasonName(reason),
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.cfsslHTTP().Post(c.cfsslURL(cfsslRevokePath), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to revoke certificate with CFSSL: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CFSSL returned %v revoking certificate %v", resp.StatusCode, leaf.SerialNumber)
+	}
+
+	return nil
+}
+
+func (c *Client) cfsslURL(path string) string {
+	addr := c.CA.Addr
+	if !strings.Contains(addr, "://") {
+		scheme := "http://"
+		if c.CA.Secure {
+			scheme = "https://"
+		}
+		addr = scheme + addr
+	}
+
+	return strings.TrimRight(addr, "/") + path
+}
+
+func (c *Client) cfsslHTTP() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: c.CA.SkipCACheck},
+		},
+	}
+}
+
+// CRL fetches the current DER encoded CRL of the CFSSL CA
+func (c *Client) CRL() ([]byte, error) {
+	if c.issuer != nil {
+		return nil, fmt.Errorf("CRLs are only published for the CFSSL backend")
+	}
+
+	expiry := c.CA.Revocation.CRLExpiry
+	if expiry == 0 {
+		expiry = defaultCRLExpiry
+	}
+
+	resp, err := c.cfsslHTTP().Get(c.cfsslURL(cfsslCRLPath) + "?expiry=" + url.QueryEscape(expiry.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	res := struct {
+		Success bool   `json:"success"`
+		Result  string `json:"result"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+
+	if !res.Success {
+		return nil, fmt.Errorf("CFSSL failed to generate a CRL")
+	}
+
+	return base64.StdEncoding.DecodeString(res.Result)
+}
+
+// ServeCRL handles GET requests for the CRL of the CA
+func (c *Client) ServeCRL(w http.ResponseWriter, r *http.Request) {
+	crl, err := c.CRL()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// ocspResponder signs OCSP responses with a delegated OCSP signing cert
+type ocspResponder struct {
+	issuer *x509.Certificate
+	cert   *x509.Certificate
+	key    crypto.Signer
+}
+
+func newOCSPResponder(caCert []byte, cfg *RevocationConfig) (*ocspResponder, error) {
+	cpb, _ := pem.Decode(caCert)
+	if cpb == nil {
+		return nil, fmt.Errorf("no PEM CA certificate found")
+	}
+
+	issuer, err := x509.ParseCertificate(cpb.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	kp, err := tls.LoadX509KeyPair(cfg.OCSPCertPath, cfg.OCSPKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load OCSP signing key pair: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := kp.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("OCSP signing key is not supported")
+	}
+
+	return &ocspResponder{issuer: issuer, cert: cert, key: key}, nil
+}
+
+// respondOCSP answers an OCSP request from the revocation state in the store
+func (c *Client) respondOCSP(raw []byte) ([]byte, error) {
+	req, err := ocsp.ParseRequest(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tpl := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(ocspResponseTTL),
+		Certificate:  c.ocsp.cert,
+	}
+
+	if cert, err := c.GetCertBySerial(req.SerialNumber.String()); err == nil {
+		tpl.Status = ocsp.Good
+		if cert.Revoked {
+			tpl.Status = ocsp.Revoked
+			tpl.RevokedAt = cert.RevokedAt
+			tpl.RevocationReason = cert.RevocationReason
+		}
+	}
+
+	return ocsp.CreateResponse(c.ocsp.issuer, c.ocsp.cert, tpl, c.ocsp.key)
+}
+
+// OCSPEnabled is true if an OCSP signing cert is configured
+func (c *Client) OCSPEnabled() bool {
+	return c.ocsp != nil
+}
+
+// ServeOCSP handles OCSP requests, POSTed or base64 encoded in the path as per RFC 6960
+func (c *Client) ServeOCSP(w http.ResponseWriter, r *http.Request) {
+	var raw []byte
+	var err error
+	if r.Method == http.MethodPost {
+		raw, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOCSPRequestBytes))
+	} else {
+		raw, err = base64.StdEncoding.DecodeString(mux.Vars(r)["request"])
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := c.respondOCSP(raw)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
@@ -0,0 +1,514 @@
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk/certs"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/kube"
+)
+
+const (
+	// RotationNone: no rotation has been started, the configured CA signs
+	RotationNone = "none"
+	// RotationPublishing: the new root is published next to the old one
+	// until publishPeriod has passed, the old root still signs
+	RotationPublishing = "publishing"
+	// RotationReissuing: the new root signs, leaf certs signed by the old
+	// root are reissued in batches
+	RotationReissuing = "reissuing"
+	// RotationRetiring: all leaves are reissued, the old root stays
+	// published until gracePeriod has passed
+	RotationRetiring = "retiring"
+	// RotationComplete: the old root is no longer published, the new root
+	// signs until the next rotation
+	RotationComplete = "complete"
+
+	rotationSecretName = "tyk-ca-rotation"
+	rotationStatusKey  = "status.json"
+	rotationRootKey    = "root.pem"
+	rotationRootKeyKey = "root-key.pem"
+	rotationPrevKey    = "previous.pem"
+	rotationPrevKeyKey = "previous-key.pem"
+
+	// how long the state read from the Secret is used before it is read again
+	rotationRefresh = 10 * time.Second
+)
+
+// RotationConfig configures root CA rotations started with tyk-k8s ca rotate
+type RotationConfig struct {
+	Namespace     string        `yaml:"namespace"`     // of the Secret holding the rotation state and the generated root, the controller's if unset
+	PublishPeriod time.Duration `yaml:"publishPeriod"` // how long both roots are published before leaves are reissued, 24h if unset
+	GracePeriod   time.Duration `yaml:"gracePeriod"`   // how long the old root stays published after the last leaf was reissued, 24h if unset
+	RootValidity  time.Duration `yaml:"rootValidity"`  // lifetime of generated roots, 10 years if unset
+	LeafValidity  time.Duration `yaml:"leafValidity"`  // lifetime of the leaves they sign, a year if unset
+	BatchSize     int           `yaml:"batchSize"`     // certs reissued per reconciliation, 10 if unset
+}
+
+func (r *RotationConfig) publishPeriod() time.Duration {
+	if r.PublishPeriod > 0 {
+		return r.PublishPeriod
+	}
+	return 24 * time.Hour
+}
+
+func (r *RotationConfig) gracePeriod() time.Duration {
+	if r.GracePeriod > 0 {
+		return r.GracePeriod
+	}
+	return 24 * time.Hour
+}
+
+// BatchSizeOrDefault is the number of server certs reissued at a time
+func (r *RotationConfig) BatchSizeOrDefault() int {
+	if r.BatchSize > 0 {
+		return r.BatchSize
+	}
+	return 10
+}
+
+// RotationStatus is the progress of a root CA rotation, served by the mesh
+// discovery endpoint
+type RotationStatus struct {
+	Phase     string    `json:"phase"`
+	Root      string    `json:"root,omitempty"`     // SHA-256 of the new root
+	Previous  string    `json:"previous,omitempty"` // SHA-256 of the first cert of the chain being retired
+	Started   time.Time `json:"started"`
+	ReissueAt time.Time `json:"reissue_at"` // when the new root starts signing
+	RetireAt  time.Time `json:"retire_at"`  // when the old root is dropped, set once all leaves are reissued
+	Completed time.Time `json:"completed"`
+	Pending   int       `json:"pending"`             // server, identity and mesh certs still signed by the old root
+	MeshCert  string    `json:"mesh_cert,omitempty"` // ID of the mesh certificate reissued by the last rotation, kept by later ones
+}
+
+// Rotator is implemented by CA clients managing root rotations
+type Rotator interface {
+	RotationStatus() (*RotationStatus, error)
+	// StaleCert reports whether a cert was signed by a root being retired
+	StaleCert(*CertModel) bool
+	// AdvanceRotation records the pending certs and moves the rotation on
+	// once the current phase is over
+	AdvanceRotation(pending int) (*RotationStatus, error)
+	RotationBatchSize() int
+	// RotationMeshCert is the ID of the mesh certificate reissued by a
+	// rotation, which every injector uses in place of the one it started
+	// with, empty if none was
+	RotationMeshCert() string
+	SetRotationMeshCert(id string) error
+}
+
+// rotation is the rotation state as read from its Secret, key material is
+// kept out of the status
+type rotation struct {
+	RotationStatus
+	root           *x509.Certificate
+	rootPEM        []byte
+	rootKeyPEM     []byte
+	previousPEM    []byte
+	previousKeyPEM []byte
+	issuer         *localIssuer
+}
+
+// signs reports whether the new root signs leaves in the current phase
+func (r *rotation) signs() bool {
+	switch r.Phase {
+	case RotationReissuing, RotationRetiring, RotationComplete:
+		return true
+	}
+
+	return false
+}
+
+// rotationState caches the rotation state of a client
+type rotationState struct {
+	mu     sync.Mutex
+	kc     kubernetes.Interface
+	loaded time.Time
+	cur    *rotation
+}
+
+func (c *Client) rotationSecrets() (kubernetes.Interface, string, error) {
+	if c.rotation.kc == nil {
+		kc, err := kube.Client()
+		if err != nil {
+			return nil, "", err
+		}
+		c.rotation.kc = kc
+	}
+
+	ns := c.CA.Rotation.Namespace
+	if ns == "" {
+		ns = kube.PodNamespace()
+	}
+
+	return c.rotation.kc, ns, nil
+}
+
+// currentRotation returns the cached rotation state, read again from its
+// Secret once it is older than rotationRefresh. Without a cluster to read it
+// from there is no rotation.
+func (c *Client) currentRotation() *rotation {
+	if c.rotation == nil {
+		return &rotation{RotationStatus: RotationStatus{Phase: RotationNone}}
+	}
+
+	c.rotation.mu.Lock()
+	defer c.rotation.mu.Unlock()
+
+	if c.rotation.cur != nil && time.Since(c.rotation.loaded) < rotationRefresh {
+		return c.rotation.cur
+	}
+
+	r, err := c.loadRotation()
+	if err != nil {
+		log.Warningf("failed to read the CA rotation state: %v", err)
+		if c.rotation.cur == nil {
+			r = &rotation{RotationStatus: RotationStatus{Phase: RotationNone}}
+		} else {
+			r = c.rotation.cur
+		}
+	}
+
+	c.rotation.cur = r
+	c.rotation.loaded = time.Now()
+	return r
+}
+
+func (c *Client) loadRotation() (*rotation, error) {
+	kc, ns, err := c.rotationSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	sec, err := kc.CoreV1().Secrets(ns).Get(rotationSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &rotation{RotationStatus: RotationStatus{Phase: RotationNone}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rotation{
+		rootPEM:        sec.Data[rotationRootKey],
+		rootKeyPEM:     sec.Data[rotationRootKeyKey],
+		previousPEM:    sec.Data[rotationPrevKey],
+		previousKeyPEM: sec.Data[rotationPrevKeyKey],
+	}
+	if err := json.Unmarshal(sec.Data[rotationStatusKey], &r.RotationStatus); err != nil {
+		return nil, fmt.Errorf("invalid rotation status: %w", err)
+	}
+
+	if r.Phase == RotationNone {
+		return r, nil
+	}
+
+	if err := c.loadRotationRoot(r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// loadRotationRoot parses the generated root and creates its issuer
+func (c *Client) loadRotationRoot(r *rotation) error {
+	blk, _ := pem.Decode(r.rootPEM)
+	if blk == nil {
+		return fmt.Errorf("no root certificate in the rotation state")
+	}
+
+	root, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return err
+	}
+
+	key, err := parsePrivateKey(r.rootKeyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid root key: %w", err)
+	}
+
+	validity := c.CA.Rotation.LeafValidity
+	if validity <= 0 {
+		validity = 365 * 24 * time.Hour
+	}
+
+	r.root = root
+	r.issuer = &localIssuer{
+		cert:     root,
+		key:      key,
+		chain:    r.rootPEM,
+		names:    c.CA.DefaultNames,
+		keyReq:   c.CA.keyRequest(),
+		validity: validity,
+	}
+
+	return nil
+}
+
+func (c *Client) saveRotation(r *rotation) error {
+	kc, ns, err := c.rotationSecrets()
+	if err != nil {
+		return err
+	}
+
+	status, err := json.Marshal(r.RotationStatus)
+	if err != nil {
+		return err
+	}
+
+	sec := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      rotationSecretName,
+			Namespace: ns,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "tyk-k8s"},
+		},
+		Data: map[string][]byte{
+			rotationStatusKey:  status,
+			rotationRootKey:    r.rootPEM,
+			rotationRootKeyKey: r.rootKeyPEM,
+			rotationPrevKey:    r.previousPEM,
+			rotationPrevKeyKey: r.previousKeyPEM,
+		},
+	}
+
+	secrets := kc.CoreV1().Secrets(ns)
+	if _, err := secrets.Update(sec); apierrors.IsNotFound(err) {
+		_, err = secrets.Create(sec)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	c.rotation.mu.Lock()
+	c.rotation.cur = r
+	c.rotation.loaded = time.Now()
+	c.rotation.mu.Unlock()
+
+	return nil
+}
+
+// currentChain is the chain that signs leaves before a rotation starts
+func (c *Client) currentChain() ([]byte, []byte, error) {
+	if r := c.currentRotation(); r.Phase == RotationComplete {
+		return r.rootPEM, r.rootKeyPEM, nil
+	}
+
+	if len(c.caCert) > 0 && (c.CA.Backend == "" || c.CA.Backend == BackendCFSSL) {
+		return c.caCert, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("only the %v backend and earlier rotations can be rotated, other backends rotate their roots themselves", BackendCFSSL)
+}
+
+func fingerprint(chain []byte) string {
+	blk, _ := pem.Decode(chain)
+	if blk == nil {
+		return ""
+	}
+
+	return certs.HexSHA256(blk.Bytes)
+}
+
+// StartRotation generates a new root and publishes it in the CA bundle next
+// to the current one. It starts signing once publishPeriod has passed.
+func (c *Client) StartRotation() (*RotationStatus, error) {
+	if c.rotation == nil {
+		return nil, fmt.Errorf("CA rotation is not available")
+	}
+
+	cur := c.currentRotation()
+	switch cur.Phase {
+	case RotationNone, RotationComplete:
+	default:
+		return nil, fmt.Errorf("a rotation is in progress already, it is %v", cur.Phase)
+	}
+
+	prev, prevKey, err := c.currentChain()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	validity := c.CA.Rotation.RootValidity
+	if validity <= 0 {
+		validity = 10 * 365 * 24 * time.Hour
+	}
+
+	rootPEM, keyPEM, err := generateRoot("Tyk Mesh Root CA "+now.UTC().Format("2006-01-02"), c.CA.DefaultNames, c.CA.keyRequest(), validity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate root: %w", err)
+	}
+
+	r := &rotation{
+		RotationStatus: RotationStatus{
+			Phase:     RotationPublishing,
+			Root:      fingerprint(rootPEM),
+			Previous:  fingerprint(prev),
+			Started:   now,
+			ReissueAt: now.Add(c.CA.Rotation.publishPeriod()),
+			MeshCert:  cur.MeshCert,
+		},
+		rootPEM:        rootPEM,
+		rootKeyPEM:     keyPEM,
+		previousPEM:    prev,
+		previousKeyPEM: prevKey,
+	}
+	if err := c.loadRotationRoot(r); err != nil {
+		return nil, err
+	}
+
+	if err := c.saveRotation(r); err != nil {
+		return nil, fmt.Errorf("failed to store the rotation state: %w", err)
+	}
+
+	log.Infof("started CA rotation to root %v, leaves are reissued from %v", r.Root, r.ReissueAt)
+	return &r.RotationStatus, nil
+}
+
+// AbortRotation drops the new root while it is only published, the previous
+// root is restored
+func (c *Client) AbortRotation() (*RotationStatus, error) {
+	cur := c.currentRotation()
+	if cur.Phase != RotationPublishing {
+		return nil, fmt.Errorf("only rotations that are still publishing can be aborted, it is %v", cur.Phase)
+	}
+
+	r := &rotation{RotationStatus: RotationStatus{Phase: RotationNone}}
+	// the previous root came from an earlier rotation, it signs again
+	if len(cur.previousKeyPEM) > 0 {
+		r = &rotation{
+			RotationStatus: RotationStatus{Phase: RotationComplete, Root: cur.Previous, Completed: time.Now(), MeshCert: cur.MeshCert},
+			rootPEM:        cur.previousPEM,
+			rootKeyPEM:     cur.previousKeyPEM,
+		}
+		if err := c.loadRotationRoot(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.saveRotation(r); err != nil {
+		return nil, err
+	}
+
+	log.Infof("aborted CA rotation to root %v", cur.Root)
+	return &r.RotationStatus, nil
+}
+
+// SkipRotationWait ends the wait of the current phase, the rotation moves on
+// with the next reconciliation
+func (c *Client) SkipRotationWait() (*RotationStatus, error) {
+	cur := *c.currentRotation()
+	now := time.Now()
+	switch cur.Phase {
+	case RotationPublishing:
+		cur.ReissueAt = now
+	case RotationRetiring:
+		cur.RetireAt = now
+	default:
+		return nil, fmt.Errorf("the rotation is %v, there is no wait to skip", cur.Phase)
+	}
+
+	if err := c.saveRotation(&cur); err != nil {
+		return nil, err
+	}
+
+	return &cur.RotationStatus, nil
+}
+
+func (c *Client) RotationStatus() (*RotationStatus, error) {
+	if c.rotation == nil {
+		return &RotationStatus{Phase: RotationNone}, nil
+	}
+
+	r, err := c.loadRotation()
+	if err != nil {
+		return nil, err
+	}
+
+	return &r.RotationStatus, nil
+}
+
+func (c *Client) RotationBatchSize() int {
+	return c.CA.Rotation.BatchSizeOrDefault()
+}
+
+func (c *Client) StaleCert(cm *CertModel) bool {
+	r := c.currentRotation()
+	if !r.signs() || cm.Bundle == nil {
+		return false
+	}
+
+	blk, _ := pem.Decode(cm.Bundle.Certificate)
+	if blk == nil {
+		return false
+	}
+
+	cert, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return false
+	}
+
+	return cert.CheckSignatureFrom(r.root) != nil
+}
+
+func (c *Client) RotationMeshCert() string {
+	return c.currentRotation().MeshCert
+}
+
+// SetRotationMeshCert records the mesh certificate reissued for the new root
+// in the rotation state, injectors read it within rotationRefresh
+func (c *Client) SetRotationMeshCert(id string) error {
+	if c.rotation == nil {
+		return fmt.Errorf("CA rotation is not available")
+	}
+
+	cur := *c.currentRotation()
+	if cur.Phase == RotationNone {
+		return fmt.Errorf("no CA rotation has been started")
+	}
+
+	cur.MeshCert = id
+	return c.saveRotation(&cur)
+}
+
+func (c *Client) AdvanceRotation(pending int) (*RotationStatus, error) {
+	cur := *c.currentRotation()
+	now := time.Now()
+	cur.Pending = pending
+
+	switch {
+	case cur.Phase == RotationPublishing && !now.Before(cur.ReissueAt):
+		cur.Phase = RotationReissuing
+		log.Infof("CA rotation: root %v signs from now on, reissuing leaves", cur.Root)
+
+	case cur.Phase == RotationReissuing && pending == 0:
+		cur.Phase = RotationRetiring
+		cur.RetireAt = now.Add(c.CA.Rotation.gracePeriod())
+		log.Infof("CA rotation: all certs reissued, retiring root %v at %v", cur.Previous, cur.RetireAt)
+
+	case cur.Phase == RotationRetiring && !now.Before(cur.RetireAt):
+		cur.Phase = RotationComplete
+		cur.Completed = now
+		cur.previousPEM, cur.previousKeyPEM = nil, nil
+		log.Infof("CA rotation: retired root %v", cur.Previous)
+
+	case cur.Phase == RotationNone || cur.Phase == RotationComplete:
+		return &cur.RotationStatus, nil
+	}
+
+	if err := c.saveRotation(&cur); err != nil {
+		return nil, err
+	}
+
+	return &cur.RotationStatus, nil
+}
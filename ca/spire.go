@@ -0,0 +1,142 @@
+package ca
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk/certs"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+const (
+	defaultSpireSocket  = "unix:///run/spire/sockets/agent.sock"
+	defaultSpireTimeout = 10 * time.Second
+)
+
+type SpireConfig struct {
+	SocketPath  string        `yaml:"socketPath"`  // workload API address of the SPIRE agent
+	TrustDomain string        `yaml:"trustDomain"` // trust domain of the mesh identities
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// SPIFFEClient is implemented by cert clients issuing SPIFFE identities,
+// it returns an empty ID if the configured backend is not SPIFFE based
+type SPIFFEClient interface {
+	SPIFFEID(namespace, serviceAccount string) string
+}
+
+// spireIssuer hands out the X509-SVIDs a SPIRE agent issues to the controller,
+// SPIRE signs the certificates so the registration entries of the workloads
+// must name the controller as their parent
+type spireIssuer struct {
+	cfg *SpireConfig
+	td  spiffeid.TrustDomain
+}
+
+func newSpireIssuer(cfg *SpireConfig) (*spireIssuer, error) {
+	if cfg.TrustDomain == "" {
+		return nil, fmt.Errorf("a trust domain is required for the SPIRE backend")
+	}
+
+	td, err := spiffeid.TrustDomainFromString(cfg.TrustDomain)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SocketPath == "" {
+		cfg.SocketPath = defaultSpireSocket
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultSpireTimeout
+	}
+
+	return &spireIssuer{cfg: cfg, td: td}, nil
+}
+
+// spiffeID maps a kubernetes service account to its SPIFFE ID
+func (s *spireIssuer) spiffeID(namespace, serviceAccount string) string {
+	id, err := spiffeid.FromSegments(s.td, "ns", namespace, "sa", serviceAccount)
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+
+	return id.String()
+}
+
+// matchSVID finds the SVID for a SPIFFE ID or, for any other name, the SVID
+// carrying it as a DNS name
+func matchSVID(svids []*x509svid.SVID, name string) (*x509svid.SVID, error) {
+	for _, svid := range svids {
+		if strings.HasPrefix(name, "spiffe://") {
+			if svid.ID.String() == name {
+				return svid, nil
+			}
+			continue
+		}
+
+		for _, dns := range svid.Certificates[0].DNSNames {
+			if dns == name {
+				return svid, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("SPIRE issued no SVID for %v, register an entry for it with the controller as parent", name)
+}
+
+// GenerateCert fetches the SVID for a SPIFFE ID or DNS name from the agent,
+// the SANs of SVIDs are set by their registration entries so hosts are ignored
+func (s *spireIssuer) GenerateCert(name string, hosts ...string) (*Bundle, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name can't be empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+
+	x509Ctx, err := workloadapi.FetchX509Context(ctx, workloadapi.WithAddr(s.cfg.SocketPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch SVIDs from the SPIRE agent: %v", err)
+	}
+
+	svid, err := matchSVID(x509Ctx.SVIDs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, key, err := svid.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	bundled := append([]byte{}, cert...)
+	if b, ok := x509Ctx.Bundles.Get(svid.ID.TrustDomain()); ok {
+		for _, auth := range b.X509Authorities() {
+			bundled = append(bundled, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: auth.Raw})...)
+		}
+	}
+
+	return &Bundle{
+		PrivateKey:  key,
+		Certificate: cert,
+		Bundled:     bundled,
+		Fingerprint: certs.HexSHA256(svid.Certificates[0].Raw),
+	}, nil
+}
+
+// SPIFFEID returns the SPIFFE ID of a service account if certs are issued by SPIRE
+func (c *Client) SPIFFEID(namespace, serviceAccount string) string {
+	iss, ok := c.issuer.(*spireIssuer)
+	if !ok {
+		return ""
+	}
+
+	return iss.spiffeID(namespace, serviceAccount)
+}
@@ -0,0 +1,173 @@
+package ca
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	// Stores keeping track of issued certs
+	StoreMongo    = "mongo"
+	StoreSecrets  = "secrets"
+	StorePostgres = "postgres"
+	StoreRedis    = "redis"
+)
+
+type StoreConfig struct {
+	Type            string `yaml:"type"`            // mongo (default), secrets, postgres or redis
+	Namespace       string `yaml:"namespace"`       // secrets: namespace of certs not bound to a service
+	PostgresConnStr string `yaml:"postgresConnStr"` // postgres: connection string
+	RedisAddr       string `yaml:"redisAddr"`       // redis: host:port
+	RedisPassword   string `yaml:"redisPassword"`
+	RedisDB         int    `yaml:"redisDB"`
+}
+
+// Store persists issued certs and their revocation state
+type Store interface {
+	StoreCert(*CertModel) (*CertModel, error)
+	UpdateCert(*CertModel) error
+	GetCertByFingerprint(string) (*CertModel, error)
+	GetCertBySerial(string) (*CertModel, error)
+	GetServerCertByLinkedAPIID(string) (*CertModel, error)
+	// GetCertByIdentity returns the latest expiring unrevoked cert of a workload identity
+	GetCertByIdentity(string) (*CertModel, error)
+	// GetMeshCert returns the last expiring unexpired mesh cert, nil if there is none
+	GetMeshCert() (*CertModel, error)
+	ListIdentityCerts() ([]*CertModel, error)
+	ListCertsExpiringBefore(time.Time) ([]*CertModel, error)
+	ListRevokedCerts() ([]*CertModel, error)
+	// ListCerts returns every stored cert, the last expiring first
+	ListCerts() ([]*CertModel, error)
+}
+
+// NewStore creates the store selected in the CA config
+func NewStore(cfg *Config) (Store, error) {
+	switch cfg.Store.Type {
+	case "", StoreMongo:
+		return newMongoStore(cfg.MongoConnStr)
+	case StoreSecrets:
+		b, err := newSecretBackend(cfg.Store.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &docStore{b: b}, nil
+	case StorePostgres:
+		b, err := newSQLBackend("postgres", cfg.Store.PostgresConnStr)
+		if err != nil {
+			return nil, err
+		}
+		return &docStore{b: b}, nil
+	case StoreRedis:
+		return &docStore{b: newRedisBackend(cfg.Store.RedisAddr, cfg.Store.RedisPassword, cfg.Store.RedisDB)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown cert store %q", cfg.Store.Type)
+}
+
+// docBackend keeps cert models as whole documents keyed by their ID
+type docBackend interface {
+	put(*CertModel) error
+	list() ([]*CertModel, error)
+}
+
+// docStore implements the queries of a Store on top of a document backend,
+// filtering in memory as meshes hold a few certs per service
+type docStore struct {
+	b docBackend
+}
+
+func (s *docStore) StoreCert(cert *CertModel) (*CertModel, error) {
+	if cert.MID.Hex() == "" {
+		cert.MID = bson.NewObjectId()
+	}
+
+	return cert, s.b.put(cert)
+}
+
+func (s *docStore) UpdateCert(cert *CertModel) error {
+	if cert.MID.Hex() == "" {
+		return fmt.Errorf("can't update a cert that was never stored")
+	}
+
+	return s.b.put(cert)
+}
+
+// find returns the certs matching a filter, the last expiring first
+func (s *docStore) find(match func(*CertModel) bool) ([]*CertModel, error) {
+	all, err := s.b.list()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]*CertModel, 0)
+	for _, c := range all {
+		if match(c) {
+			found = append(found, c)
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Expires.After(found[j].Expires)
+	})
+
+	return found, nil
+}
+
+func (s *docStore) findOne(what string, match func(*CertModel) bool) (*CertModel, error) {
+	found, err := s.find(match)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no cert found for %v", what)
+	}
+
+	return found[0], nil
+}
+
+func (s *docStore) GetCertByFingerprint(fp string) (*CertModel, error) {
+	return s.findOne(fp, func(c *CertModel) bool { return c.Bundle != nil && c.Bundle.Fingerprint == fp })
+}
+
+func (s *docStore) GetCertBySerial(serial string) (*CertModel, error) {
+	return s.findOne(serial, func(c *CertModel) bool { return c.Serial == serial })
+}
+
+func (s *docStore) GetServerCertByLinkedAPIID(serviceID string) (*CertModel, error) {
+	return s.findOne(serviceID, func(c *CertModel) bool { return c.ServiceID == serviceID })
+}
+
+func (s *docStore) GetCertByIdentity(identity string) (*CertModel, error) {
+	return s.findOne(identity, func(c *CertModel) bool { return c.Identity == identity && !c.Revoked })
+}
+
+func (s *docStore) GetMeshCert() (*CertModel, error) {
+	now := time.Now()
+	found, err := s.find(func(c *CertModel) bool { return c.IsMeshCert && c.Expires.After(now) })
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+
+	return found[0], nil
+}
+
+func (s *docStore) ListIdentityCerts() ([]*CertModel, error) {
+	now := time.Now()
+	return s.find(func(c *CertModel) bool { return c.Identity != "" && !c.Revoked && c.Expires.After(now) })
+}
+
+func (s *docStore) ListCertsExpiringBefore(t time.Time) ([]*CertModel, error) {
+	return s.find(func(c *CertModel) bool { return c.ServiceID != "" && !c.Revoked && c.Expires.Before(t) })
+}
+
+func (s *docStore) ListRevokedCerts() ([]*CertModel, error) {
+	return s.find(func(c *CertModel) bool { return c.Revoked })
+}
+
+func (s *docStore) ListCerts() ([]*CertModel, error) {
+	return s.find(func(c *CertModel) bool { return true })
+}
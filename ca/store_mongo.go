@@ -0,0 +1,190 @@
+package ca
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const caCol string = "k8s_ca"
+
+// mongoStore keeps certs in a MongoDB collection, usually the dashboard database
+type mongoStore struct {
+	sess *mgo.Session
+}
+
+func newMongoStore(connStr string) (*mongoStore, error) {
+	sess, err := mgo.Dial(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mongoStore{sess: sess}, nil
+}
+
+func (s *mongoStore) StoreCert(cert *CertModel) (*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+	if cert.MID.Hex() == "" {
+		cert.MID = bson.NewObjectId()
+	}
+
+	return cert, m.DB("").C(caCol).Insert(cert)
+}
+
+func (s *mongoStore) GetCertByFingerprint(fp string) (*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	cert := &CertModel{}
+	err := m.DB("").C(caCol).Find(bson.M{"Bundle.Fingerprint": fp}).One(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+func (s *mongoStore) GetServerCertByLinkedAPIID(serviceID string) (*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	cert := &CertModel{}
+	err := m.DB("").C(caCol).Find(bson.M{"ServiceID": serviceID}).One(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// GetCertByIdentity returns the latest expiring client cert of a workload identity
+func (s *mongoStore) GetCertByIdentity(identity string) (*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	cert := &CertModel{}
+	err := m.DB("").C(caCol).Find(bson.M{"Identity": identity, "Revoked": bson.M{"$ne": true}}).Sort("-Expires").One(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// ListIdentityCerts returns the unexpired client certs of all workload identities
+func (s *mongoStore) ListIdentityCerts() ([]*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	found := make([]*CertModel, 0)
+	err := m.DB("").C(caCol).Find(
+		bson.M{
+			"Identity": bson.M{"$ne": ""},
+			"Revoked":  bson.M{"$ne": true},
+			"Expires": bson.M{
+				"$gt": time.Now(),
+			},
+		}).All(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// ListCertsExpiringBefore returns the server certs linked to an API that expire before the given time
+func (s *mongoStore) ListCertsExpiringBefore(t time.Time) ([]*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	found := make([]*CertModel, 0)
+	err := m.DB("").C(caCol).Find(
+		bson.M{
+			"ServiceID": bson.M{"$ne": ""},
+			"Revoked":   bson.M{"$ne": true},
+			"Expires": bson.M{
+				"$lt": t,
+			},
+		}).All(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// UpdateCert replaces a stored cert, e.g. after it was renewed
+func (s *mongoStore) UpdateCert(cert *CertModel) error {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	return m.DB("").C(caCol).UpdateId(cert.MID, cert)
+}
+
+// ListRevokedCerts returns all revoked certs
+func (s *mongoStore) ListRevokedCerts() ([]*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	found := make([]*CertModel, 0)
+	err := m.DB("").C(caCol).Find(bson.M{"Revoked": true}).All(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// ListCerts returns every stored cert, the last expiring first
+func (s *mongoStore) ListCerts() ([]*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	found := make([]*CertModel, 0)
+	err := m.DB("").C(caCol).Find(nil).Sort("-Expires").All(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// GetCertBySerial returns the cert with a decimal serial number
+func (s *mongoStore) GetCertBySerial(serial string) (*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	cert := &CertModel{}
+	err := m.DB("").C(caCol).Find(bson.M{"Serial": serial}).One(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// GetMeshCert returns the last expiring unexpired mesh cert, nil if there is none
+func (s *mongoStore) GetMeshCert() (*CertModel, error) {
+	m := s.sess.Clone()
+	defer m.Close()
+
+	found := make([]*CertModel, 0)
+	err := m.DB("").C(caCol).Find(
+		bson.M{
+			"IsMeshCert": true,
+			"Expires": bson.M{
+				"$gt": time.Now(),
+			},
+		}).Sort("-Expires").Limit(1).All(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	return found[0], nil
+}
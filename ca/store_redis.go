@@ -0,0 +1,59 @@
+package ca
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const redisCertKey = "tyk-k8s-certs"
+
+// redisBackend keeps certs as JSON documents in a hash keyed by their ID
+type redisBackend struct {
+	pool *redis.Pool
+}
+
+func newRedisBackend(addr, password string, db int) *redisBackend {
+	return &redisBackend{pool: &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, redis.DialPassword(password), redis.DialDatabase(db))
+		},
+	}}
+}
+
+func (r *redisBackend) put(cert *CertModel) error {
+	js, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", redisCertKey, cert.MID.Hex(), js)
+	return err
+}
+
+func (r *redisBackend) list() ([]*CertModel, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	docs, err := redis.ByteSlices(conn.Do("HVALS", redisCertKey))
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]*CertModel, 0, len(docs))
+	for _, doc := range docs {
+		cert := &CertModel{}
+		if err := json.Unmarshal(doc, cert); err != nil {
+			return nil, err
+		}
+		found = append(found, cert)
+	}
+
+	return found, nil
+}
@@ -0,0 +1,94 @@
+package ca
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/kube"
+)
+
+const (
+	certSecretPrefix = "tyk-mesh-cert-"
+	certSecretKey    = "cert.json"
+	certSecretLabel  = "tyk.io/mesh-cert"
+)
+
+// secretBackend keeps each cert in a Secret in the namespace of the
+// controller. Certs hold their private keys and revocation state, keeping
+// them out of workload namespaces keeps tenants from reading or forging them.
+type secretBackend struct {
+	kc        kubernetes.Interface
+	namespace string
+}
+
+func newSecretBackend(namespace string) (*secretBackend, error) {
+	kc, err := kube.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return newSecretBackendWithClient(kc, namespace), nil
+}
+
+func newSecretBackendWithClient(kc kubernetes.Interface, namespace string) *secretBackend {
+	if namespace == "" {
+		namespace = kube.PodNamespace()
+	}
+
+	return &secretBackend{kc: kc, namespace: namespace}
+}
+
+func (s *secretBackend) put(cert *CertModel) error {
+	js, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+
+	sec := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      certSecretPrefix + cert.MID.Hex(),
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				certSecretLabel:                "true",
+				"app.kubernetes.io/managed-by": "tyk-k8s",
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{certSecretKey: js},
+	}
+
+	secrets := s.kc.CoreV1().Secrets(sec.Namespace)
+	_, err = secrets.Update(sec)
+	if apierrors.IsNotFound(err) {
+		_, err = secrets.Create(sec)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store cert in secret %v/%v: %v", sec.Namespace, sec.Name, err)
+	}
+
+	return nil
+}
+
+func (s *secretBackend) list() ([]*CertModel, error) {
+	secs, err := s.kc.CoreV1().Secrets(s.namespace).List(metav1.ListOptions{LabelSelector: certSecretLabel + "=true"})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]*CertModel, 0, len(secs.Items))
+	for _, sec := range secs.Items {
+		cert := &CertModel{}
+		if err := json.Unmarshal(sec.Data[certSecretKey], cert); err != nil {
+			log.Warningf("skipping malformed cert secret %v/%v: %v", sec.Namespace, sec.Name, err)
+			continue
+		}
+		found = append(found, cert)
+	}
+
+	return found, nil
+}
@@ -0,0 +1,69 @@
+package ca
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	// registers the postgres driver
+	_ "github.com/lib/pq"
+)
+
+const sqlCertTable = "tyk_k8s_certs"
+
+// sqlBackend keeps certs as JSON documents in a table keyed by their ID
+type sqlBackend struct {
+	db *sql.DB
+}
+
+func newSQLBackend(driver, connStr string) (*sqlBackend, error) {
+	db, err := sql.Open(driver, connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY, doc TEXT NOT NULL)`, sqlCertTable))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create cert table: %v", err)
+	}
+
+	return &sqlBackend{db: db}, nil
+}
+
+func (s *sqlBackend) put(cert *CertModel) error {
+	js, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		fmt.Sprintf(`INSERT INTO %s (id, doc) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET doc = EXCLUDED.doc`, sqlCertTable),
+		cert.MID.Hex(), string(js))
+
+	return err
+}
+
+func (s *sqlBackend) list() ([]*CertModel, error) {
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT doc FROM %s`, sqlCertTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make([]*CertModel, 0)
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+
+		cert := &CertModel{}
+		if err := json.Unmarshal([]byte(doc), cert); err != nil {
+			return nil, err
+		}
+		found = append(found, cert)
+	}
+
+	return found, rows.Err()
+}
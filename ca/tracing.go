@@ -0,0 +1,98 @@
+package ca
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"go.jlucktay.dev/tyk-k8s/tracing"
+)
+
+// tracedClient spans the calls of a CertClient as children of the operation
+// it was created for, the clients themselves don't take a context
+type tracedClient struct {
+	CertClient
+	ctx context.Context
+}
+
+// Traced returns a client recording its calls in the trace of ctx
+func Traced(ctx context.Context, cl CertClient) CertClient {
+	if cl == nil {
+		return nil
+	}
+
+	return &tracedClient{CertClient: cl, ctx: ctx}
+}
+
+func (t *tracedClient) GenerateCert(CN string, hosts ...string) (*Bundle, error) {
+	_, span := tracing.Start(t.ctx, "ca.GenerateCert", attribute.String("ca.cn", CN))
+	bdl, err := t.CertClient.GenerateCert(CN, hosts...)
+	tracing.End(span, err)
+
+	return bdl, err
+}
+
+func (t *tracedClient) StoreCert(cm *CertModel) (*CertModel, error) {
+	_, span := tracing.Start(t.ctx, "ca.StoreCert", attribute.String("ca.serial", cm.Serial))
+	stored, err := t.CertClient.StoreCert(cm)
+	tracing.End(span, err)
+
+	return stored, err
+}
+
+func (t *tracedClient) GetCertByFingerprint(fp string) (*CertModel, error) {
+	_, span := tracing.Start(t.ctx, "ca.GetCertByFingerprint", attribute.String("ca.fingerprint", fp))
+	cm, err := t.CertClient.GetCertByFingerprint(fp)
+	tracing.End(span, err)
+
+	return cm, err
+}
+
+func (t *tracedClient) GetServerCertByLinkedAPIID(id string) (*CertModel, error) {
+	_, span := tracing.Start(t.ctx, "ca.GetServerCertByLinkedAPIID", attribute.String("ca.service_id", id))
+	cm, err := t.CertClient.GetServerCertByLinkedAPIID(id)
+	tracing.End(span, err)
+
+	return cm, err
+}
+
+func (t *tracedClient) GetCertByIdentity(identity string) (*CertModel, error) {
+	_, span := tracing.Start(t.ctx, "ca.GetCertByIdentity", attribute.String("ca.identity", identity))
+	cm, err := t.CertClient.GetCertByIdentity(identity)
+	tracing.End(span, err)
+
+	return cm, err
+}
+
+func (t *tracedClient) ListIdentityCerts() ([]*CertModel, error) {
+	_, span := tracing.Start(t.ctx, "ca.ListIdentityCerts")
+	certs, err := t.CertClient.ListIdentityCerts()
+	tracing.End(span, err)
+
+	return certs, err
+}
+
+func (t *tracedClient) ListCertsExpiringBefore(before time.Time) ([]*CertModel, error) {
+	_, span := tracing.Start(t.ctx, "ca.ListCertsExpiringBefore")
+	certs, err := t.CertClient.ListCertsExpiringBefore(before)
+	tracing.End(span, err)
+
+	return certs, err
+}
+
+func (t *tracedClient) UpdateCert(cm *CertModel) error {
+	_, span := tracing.Start(t.ctx, "ca.UpdateCert", attribute.String("ca.serial", cm.Serial))
+	err := t.CertClient.UpdateCert(cm)
+	tracing.End(span, err)
+
+	return err
+}
+
+func (t *tracedClient) Revoke(cm *CertModel, reason int) error {
+	_, span := tracing.Start(t.ctx, "ca.Revoke", attribute.String("ca.serial", cm.Serial), attribute.Int("ca.reason", reason))
+	err := t.CertClient.Revoke(cm, reason)
+	tracing.End(span, err)
+
+	return err
+}
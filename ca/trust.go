@@ -0,0 +1,249 @@
+package ca
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// TrustBundleName is the system trust store with the mesh CA added
+	TrustBundleName = "ca-certificates.crt"
+	// MeshCAName holds the mesh CA chain on its own
+	MeshCAName = "tyk-mesh-ca.pem"
+)
+
+// SystemBundles are the trust stores of the common distros, the first one
+// found is merged with the mesh CA
+var SystemBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu, Alpine
+	"/etc/pki/tls/certs/ca-bundle.crt",   // Fedora, RHEL
+	"/etc/ssl/ca-bundle.pem",             // OpenSUSE
+	"/etc/ssl/cert.pem",                  // Alpine, macOS
+}
+
+// CABundle returns the PEM chains pods have to trust: the chain of the CA
+// that signs the mesh certificates followed by the upcoming roots of
+// nextCertPaths. Backends other than CFSSL serve the chain at certPath if it
+// is set. During a rotation both the old and the new root are published.
+func (c *Client) CABundle() ([]byte, error) {
+	bundle := make([]byte, 0)
+	r := c.currentRotation()
+	switch {
+	case r.Phase == RotationComplete:
+		bundle = append(bundle, r.rootPEM...)
+	case r.Phase != RotationNone:
+		bundle = appendPEM(append(bundle, r.previousPEM...), r.rootPEM)
+	case len(c.caCert) > 0:
+		bundle = append(bundle, c.caCert...)
+	case c.CA.CertPath != "":
+		data, err := ioutil.ReadFile(c.CA.CertPath)
+		if err != nil {
+			return nil, err
+		}
+		bundle = append(bundle, data...)
+	default:
+		return nil, fmt.Errorf("no CA certificate to serve, set certPath to the chain of the %v CA", c.CA.Backend)
+	}
+
+	// roots being rotated in are trusted before they sign anything
+	for _, p := range c.CA.NextCertPaths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upcoming root: %w", err)
+		}
+
+		if _, err := parseChain(data); err != nil {
+			return nil, fmt.Errorf("invalid upcoming root %v: %w", p, err)
+		}
+
+		bundle = appendPEM(bundle, data)
+	}
+
+	return bundle, nil
+}
+
+// appendPEM appends PEM data on a new line
+func appendPEM(bundle, data []byte) []byte {
+	if len(bundle) > 0 && bundle[len(bundle)-1] != '\n' {
+		bundle = append(bundle, '\n')
+	}
+
+	return append(bundle, data...)
+}
+
+// etagMatch reports whether an If-None-Match header matches an ETag
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServeCABundle serves the PEM chains of the mesh CA, fetched by the CA init
+// container of injected pods. Clients polling for changes send the ETag of
+// the bundle they have and get a 304 if it is still current.
+func (c *Client) ServeCABundle(w http.ResponseWriter, r *http.Request) {
+	bundle, err := c.CABundle()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(bundle))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(bundle)
+}
+
+// parseChain checks a PEM chain holds at least one certificate and nothing
+// but certificates
+func parseChain(data []byte) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, 0)
+	for rest := data; ; {
+		var blk *pem.Block
+		blk, rest = pem.Decode(rest)
+		if blk == nil {
+			if len(bytes.TrimSpace(rest)) > 0 {
+				return nil, fmt.Errorf("trailing data after the last certificate")
+			}
+			break
+		}
+
+		if blk.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected %v block", blk.Type)
+		}
+
+		cert, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return chain, nil
+}
+
+// FetchBundle downloads the mesh CA chain from the /ca/bundle endpoint of
+// the controller, retrying until the context is done. caFile verifies the
+// controller, insecure skips the verification.
+func FetchBundle(ctx context.Context, url, caFile string, insecure bool) ([]byte, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}, Timeout: 10 * time.Second}
+
+	var lastErr error
+	for {
+		bundle, err := fetchBundle(ctx, client, url)
+		if err == nil {
+			return bundle, nil
+		}
+		lastErr = err
+		log.Warningf("failed to fetch the mesh CA from %v, retrying: %v", url, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("mesh CA unreachable at %v: %w", url, lastErr)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func fetchBundle(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("controller returned %v: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	if _, err := parseChain(body); err != nil {
+		return nil, fmt.Errorf("invalid CA chain: %w", err)
+	}
+
+	return body, nil
+}
+
+// WriteTrustStore writes the mesh CA chain and the first system bundle found
+// merged with it into dir, the containers of the pod mount the directory or
+// only the merged bundle
+func WriteTrustStore(dir string, meshCA []byte, systemBundles []string) error {
+	if _, err := parseChain(meshCA); err != nil {
+		return fmt.Errorf("invalid CA chain: %w", err)
+	}
+
+	merged := make([]byte, 0)
+	for _, p := range systemBundles {
+		data, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		merged = append(merged, bytes.TrimRight(data, "\n")...)
+		merged = append(merged, '\n')
+		break
+	}
+
+	if len(merged) == 0 {
+		log.Warning("no system trust store found, only the mesh CA will be trusted")
+	}
+	merged = append(merged, meshCA...)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, MeshCAName), meshCA, 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, TrustBundleName), merged, 0644)
+}
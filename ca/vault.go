@@ -0,0 +1,315 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk/certs"
+)
+
+const (
+	// Vault auth methods
+	VaultAuthToken      = "token"
+	VaultAuthAppRole    = "approle"
+	VaultAuthKubernetes = "kubernetes"
+
+	defaultVaultPKIMount  = "pki"
+	defaultVaultTimeout   = 30 * time.Second
+	defaultVaultTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	vaultTokenHeader     = "X-Vault-Token"
+	vaultNamespaceHeader = "X-Vault-Namespace"
+)
+
+type VaultConfig struct {
+	Addr           string        `yaml:"addr"`
+	Namespace      string        `yaml:"namespace"`      // Vault Enterprise namespace
+	AuthMethod     string        `yaml:"authMethod"`     // token (default), approle or kubernetes
+	AuthMount      string        `yaml:"authMount"`      // mount path of the auth method, defaults to its name
+	Token          string        `yaml:"token"`          // token auth
+	RoleID         string        `yaml:"roleID"`         // approle auth
+	SecretID       string        `yaml:"secretID"`       // approle auth
+	KubernetesRole string        `yaml:"kubernetesRole"` // kubernetes auth
+	TokenPath      string        `yaml:"tokenPath"`      // service account token for kubernetes auth
+	PKIMount       string        `yaml:"pkiMount"`       // mount path of the PKI secrets engine
+	Role           string        `yaml:"role"`           // PKI role issuing the mesh certificates
+	TTL            time.Duration `yaml:"ttl"`            // requested certificate lifetime, the role's default if unset
+	CACertPath     string        `yaml:"caCertPath"`     // CA to verify the Vault server with
+	SkipVerify     bool          `yaml:"skipVerify"`
+	Timeout        time.Duration `yaml:"timeout"`
+}
+
+// vaultIssuer issues certificates from the PKI secrets engine of Vault,
+// logging in again whenever its token expires
+type vaultIssuer struct {
+	cfg  *VaultConfig
+	http *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time // zero for tokens that don't expire
+}
+
+func newVaultIssuer(cfg *VaultConfig) (*vaultIssuer, error) {
+	if cfg.Addr == "" || cfg.Role == "" {
+		return nil, fmt.Errorf("an address and PKI role are required for the vault backend")
+	}
+
+	return newVaultClient(cfg)
+}
+
+// newVaultClient creates a client logged in with the configured auth method,
+// without requiring a PKI role
+func newVaultClient(cfg *VaultConfig) (*vaultIssuer, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("a vault address is required")
+	}
+
+	if cfg.AuthMethod == "" {
+		cfg.AuthMethod = VaultAuthToken
+	}
+
+	switch cfg.AuthMethod {
+	case VaultAuthToken, VaultAuthAppRole, VaultAuthKubernetes:
+	default:
+		return nil, fmt.Errorf("unknown vault auth method %q", cfg.AuthMethod)
+	}
+
+	if cfg.AuthMount == "" {
+		cfg.AuthMount = cfg.AuthMethod
+	}
+
+	if cfg.PKIMount == "" {
+		cfg.PKIMount = defaultVaultPKIMount
+	}
+
+	if cfg.TokenPath == "" {
+		cfg.TokenPath = defaultVaultTokenPath
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultVaultTimeout
+	}
+
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.SkipVerify}
+	if cfg.CACertPath != "" {
+		pemData, err := ioutil.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %v", cfg.CACertPath)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	return &vaultIssuer{
+		cfg: cfg,
+		http: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		},
+		token: cfg.Token,
+	}, nil
+}
+
+type vaultResponse struct {
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+}
+
+func (v *vaultIssuer) do(method, path, token string, body interface{}) (*vaultResponse, int, error) {
+	js, err := json.Marshal(body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(v.cfg.Addr, "/")+"/v1/"+path, bytes.NewReader(js))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set(vaultTokenHeader, token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set(vaultNamespaceHeader, v.cfg.Namespace)
+	}
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	vr := &vaultResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(vr); err != nil && resp.StatusCode < 300 {
+		return nil, resp.StatusCode, err
+	}
+
+	if resp.StatusCode >= 300 {
+		return vr, resp.StatusCode, fmt.Errorf("vault returned %d for %v: %v", resp.StatusCode, path, strings.Join(vr.Errors, ", "))
+	}
+
+	return vr, resp.StatusCode, nil
+}
+
+// login returns a valid token, authenticating with the configured method if needed
+func (v *vaultIssuer) login(force bool) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.cfg.AuthMethod == VaultAuthToken {
+		return v.token, nil
+	}
+
+	if !force && v.token != "" && (v.expires.IsZero() || time.Now().Before(v.expires)) {
+		return v.token, nil
+	}
+
+	var body map[string]string
+	switch v.cfg.AuthMethod {
+	case VaultAuthAppRole:
+		body = map[string]string{"role_id": v.cfg.RoleID, "secret_id": v.cfg.SecretID}
+	case VaultAuthKubernetes:
+		jwt, err := ioutil.ReadFile(v.cfg.TokenPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read service account token: %v", err)
+		}
+		body = map[string]string{"role": v.cfg.KubernetesRole, "jwt": strings.TrimSpace(string(jwt))}
+	}
+
+	vr, _, err := v.do(http.MethodPost, "auth/"+v.cfg.AuthMount+"/login", "", body)
+	if err != nil {
+		return "", fmt.Errorf("vault login failed: %v", err)
+	}
+
+	if vr.Auth == nil || vr.Auth.ClientToken == "" {
+		return "", fmt.Errorf("vault login returned no token")
+	}
+
+	v.token = vr.Auth.ClientToken
+	v.expires = time.Time{}
+	if vr.Auth.LeaseDuration > 0 {
+		// renew a little ahead of expiry
+		lease := time.Duration(vr.Auth.LeaseDuration) * time.Second
+		v.expires = time.Now().Add(lease - lease/10)
+	}
+
+	return v.token, nil
+}
+
+// read returns the data of a secret, logging in again once if the token was
+// revoked or expired early
+func (v *vaultIssuer) read(path string) (map[string]interface{}, error) {
+	token, err := v.login(false)
+	if err != nil {
+		return nil, err
+	}
+
+	vr, code, err := v.do(http.MethodGet, path, token, nil)
+	if code == http.StatusForbidden && v.cfg.AuthMethod != VaultAuthToken {
+		if token, err = v.login(true); err != nil {
+			return nil, err
+		}
+		vr, _, err = v.do(http.MethodGet, path, token, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return vr.Data, nil
+}
+
+// GenerateCert issues a certificate for a common name and SANs from the PKI
+// role, the key type and size are set by the role
+func (v *vaultIssuer) GenerateCert(CN string, hosts ...string) (*Bundle, error) {
+	if CN == "" {
+		return nil, fmt.Errorf("hostname can't be empty")
+	}
+
+	body := map[string]string{"common_name": CN}
+	dns, ips := certHosts(CN, hosts)
+	if len(dns) > 1 {
+		body["alt_names"] = strings.Join(dns[1:], ",")
+	}
+	if len(ips) > 0 {
+		body["ip_sans"] = strings.Join(ips, ",")
+	}
+	if v.cfg.TTL > 0 {
+		body["ttl"] = v.cfg.TTL.String()
+	}
+
+	path := v.cfg.PKIMount + "/issue/" + v.cfg.Role
+	token, err := v.login(false)
+	if err != nil {
+		return nil, err
+	}
+
+	vr, code, err := v.do(http.MethodPost, path, token, body)
+	if code == http.StatusForbidden && v.cfg.AuthMethod != VaultAuthToken {
+		// the token was revoked or expired early
+		if token, err = v.login(true); err != nil {
+			return nil, err
+		}
+		vr, _, err = v.do(http.MethodPost, path, token, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return vaultBundle(vr.Data)
+}
+
+// vaultBundle converts the response of a PKI issue request
+func vaultBundle(data map[string]interface{}) (*Bundle, error) {
+	crt, _ := data["certificate"].(string)
+	key, _ := data["private_key"].(string)
+	if crt == "" || key == "" {
+		return nil, fmt.Errorf("vault issued no key pair")
+	}
+
+	cpb, _ := pem.Decode([]byte(crt))
+	if cpb == nil {
+		return nil, fmt.Errorf("vault issued no PEM certificate")
+	}
+
+	cObj, err := x509.ParseCertificate(cpb.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	bundled := strings.TrimSpace(crt) + "\n"
+	if chain, ok := data["ca_chain"].([]interface{}); ok && len(chain) > 0 {
+		for _, c := range chain {
+			if s, ok := c.(string); ok {
+				bundled += strings.TrimSpace(s) + "\n"
+			}
+		}
+	} else if ca, ok := data["issuing_ca"].(string); ok {
+		bundled += strings.TrimSpace(ca) + "\n"
+	}
+
+	return &Bundle{
+		PrivateKey:  []byte(key),
+		Certificate: []byte(crt),
+		Bundled:     []byte(bundled),
+		Fingerprint: certs.HexSHA256(cObj.Raw),
+	}, nil
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+)
+
+var (
+	caRotateStatus   bool
+	caRotateSkipWait bool
+	caRotateAbort    bool
+)
+
+// caCmd groups the commands managing the mesh CA itself
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "manages the mesh CA",
+	Long: `Manages the root CA of the mesh, rotate it with:
+
+	tyk-k8s ca rotate`,
+}
+
+// caRotateCmd starts and steers root CA rotations
+var caRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "rotates the root CA of the mesh",
+	Long: `Generates a new root CA and publishes it in the CA bundle next to the
+current one. Once CA.rotation.publishPeriod has passed the mesh reconciler
+signs with the new root and reissues the server certificates in batches,
+identities and the mesh certificate are reissued when next used. When all
+are reissued the old root stays published for CA.rotation.gracePeriod before
+it is retired. Follow the progress with:
+
+	tyk-k8s ca rotate --status
+
+or the /mesh/ca endpoint of the injector. The new root and the rotation
+state are kept in the tyk-ca-rotation Secret.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		caConf := &ca.Config{}
+		if err := viper.UnmarshalKey("CA", caConf); err != nil {
+			log.Fatalf("couldn't read CA config: %v", err)
+		}
+
+		caClient, err := ca.New(caConf)
+		if err != nil {
+			log.Fatal("failed to init CA client: ", err)
+		}
+
+		var status *ca.RotationStatus
+		switch {
+		case caRotateStatus:
+			status, err = caClient.RotationStatus()
+		case caRotateAbort:
+			status, err = caClient.AbortRotation()
+		case caRotateSkipWait:
+			status, err = caClient.SkipRotationWait()
+		default:
+			status, err = caClient.StartRotation()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		printRotation(status)
+	},
+}
+
+func printRotation(status *ca.RotationStatus) {
+	fmt.Println("phase:", status.Phase)
+	if status.Phase == ca.RotationNone {
+		return
+	}
+
+	fmt.Println("root:", status.Root)
+	if status.Previous != "" {
+		fmt.Println("previous:", status.Previous)
+	}
+
+	for _, t := range []struct {
+		name string
+		at   time.Time
+	}{
+		{"started", status.Started},
+		{"reissue at", status.ReissueAt},
+		{"retire at", status.RetireAt},
+		{"completed", status.Completed},
+	} {
+		if !t.at.IsZero() {
+			fmt.Printf("%s: %s\n", t.name, t.at.Format(time.RFC3339))
+		}
+	}
+
+	if status.Phase == ca.RotationReissuing {
+		fmt.Println("pending certificates:", status.Pending)
+	}
+}
+
+func init() {
+	caRotateCmd.Flags().BoolVar(&caRotateStatus, "status", false, "show the progress of the rotation")
+	caRotateCmd.Flags().BoolVar(&caRotateSkipWait, "skip-wait", false, "end the publish or grace period of the rotation now")
+	caRotateCmd.Flags().BoolVar(&caRotateAbort, "abort", false, "drop the new root while it is only published")
+
+	caCmd.AddCommand(caRotateCmd)
+	rootCmd.AddCommand(caCmd)
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+)
+
+var (
+	caInitURL      string
+	caInitOut      string
+	caInitCAFile   string
+	caInitInsecure bool
+	caInitTimeout  time.Duration
+)
+
+// caInitCmd is run by the CA init container of injected pods
+var caInitCmd = &cobra.Command{
+	Use:   "ca-init",
+	Short: "fetches the mesh CA and writes a trust store including it",
+	Long: `Downloads the current mesh CA chain from the /ca/bundle endpoint of the
+controller and writes it, together with the system trust store merged with
+it, into a directory shared with the other containers of the pod:
+
+	tyk-k8s ca-init --url https://tyk-k8s.tyk:443/ca/bundle --out /var/run/tyk-mesh/certs
+
+The injector adds this as an init container if caInit is enabled. It exits
+with an error if the CA can't be fetched within the timeout, so the pod
+doesn't start without trusting the mesh.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if caInitURL == "" {
+			log.Fatal("--url of the controller CA bundle endpoint is required")
+		}
+
+		if info, err := os.Stat(caInitOut); err != nil || !info.IsDir() {
+			log.Fatalf("output directory %v doesn't exist, is the shared volume mounted?", caInitOut)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), caInitTimeout)
+		defer cancel()
+
+		bundle, err := ca.FetchBundle(ctx, caInitURL, caInitCAFile, caInitInsecure)
+		if err != nil {
+			log.Fatalf("giving up after %v, the pod can't trust the mesh: %v", caInitTimeout, err)
+		}
+
+		if err := ca.WriteTrustStore(caInitOut, bundle, ca.SystemBundles); err != nil {
+			log.Fatalf("failed to write the trust store to %v: %v", caInitOut, err)
+		}
+
+		log.Infof("wrote the mesh CA and merged trust store to %v", caInitOut)
+	},
+}
+
+func init() {
+	caInitCmd.Flags().StringVar(&caInitURL, "url", "", "CA bundle endpoint of the controller")
+	caInitCmd.Flags().StringVar(&caInitOut, "out", "/var/run/tyk-mesh/certs", "directory to write the trust store to")
+	caInitCmd.Flags().StringVar(&caInitCAFile, "ca-file", "", "CA to verify the controller with, the system trust store if unset")
+	caInitCmd.Flags().BoolVar(&caInitInsecure, "insecure", false, "don't verify the certificate of the controller")
+	caInitCmd.Flags().DurationVar(&caInitTimeout, "timeout", time.Minute, "how long to retry before failing")
+
+	rootCmd.AddCommand(caInitCmd)
+}
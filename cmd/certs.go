@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
+)
+
+var (
+	certsExpiring time.Duration
+	certsRevoked  bool
+	certsReason   string
+)
+
+// certsCmd groups the mesh PKI commands
+var certsCmd = &cobra.Command{
+	Use:   "certs",
+	Short: "manages the mesh certificates",
+	Long: `Lists, rotates, revokes and re-uploads the certificates issued by the
+CA for the mesh. Certificates are identified by their Tyk certificate ID as
+shown by:
+
+	tyk-k8s certs list`,
+}
+
+// certsListCmd lists the stored certificates
+var certsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "lists the issued mesh certificates",
+	Long: `Lists the certificates in the controller store with their kind, owner
+and expiry, the last expiring first, e.g. those expiring within a month:
+
+	tyk-k8s certs list --expiring 720h`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		caClient, _ := certsClients()
+
+		certs, err := caClient.ListCerts()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tKIND\tOWNER\tEXPIRES\tSTATUS")
+		for _, cm := range certs {
+			if cm.Revoked && !certsRevoked {
+				continue
+			}
+
+			if certsExpiring > 0 && cm.Expires.After(now.Add(certsExpiring)) {
+				continue
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", certID(cm), injector.CertKind(cm), certOwner(cm), cm.Expires.Format(time.RFC3339), certStatus(cm, now))
+		}
+
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// certsRotateCmd reissues server certificates
+var certsRotateCmd = &cobra.Command{
+	Use:   "rotate <id>...",
+	Short: "reissues server certificates now",
+	Long: `Reissues the server certificates of mesh routes regardless of their
+expiry, uploads them to Tyk and swaps them into their routes, e.g.:
+
+	tyk-k8s certs rotate 5d6e...`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		caClient, whs := certsClients()
+
+		failed := false
+		for _, id := range args {
+			cm, err := caClient.GetCertByFingerprint(id)
+			if err == nil {
+				err = whs.RotateCert(context.Background(), cm)
+			}
+
+			if err != nil {
+				log.Errorf("failed to rotate %v: %v", id, err)
+				failed = true
+				continue
+			}
+
+			fmt.Printf("rotated %v, new ID %v expires %v\n", id, cm.Bundle.Fingerprint, cm.Expires.Format(time.RFC3339))
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// certsRevokeCmd revokes certificates
+var certsRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>...",
+	Short: "revokes certificates",
+	Long: `Revokes certificates and removes them from Tyk. Workload identities are
+removed from the inbound routes of the mesh, server certificates are replaced
+on their route first. Other certificates are rejected, the mesh certificate
+is reissued by rotating the root CA with tyk-k8s ca rotate, e.g.:
+
+	tyk-k8s certs revoke 5d6e... --reason keyCompromise
+
+To revoke the current identity of a service by name, use tyk-k8s revoke.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		reason, err := ca.RevocationReason(certsReason)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		caClient, whs := certsClients()
+
+		failed := false
+		for _, id := range args {
+			cm, err := caClient.GetCertByFingerprint(id)
+			if err == nil {
+				err = whs.RevokeCert(context.Background(), cm, reason)
+			}
+
+			if err != nil {
+				log.Errorf("failed to revoke %v: %v", id, err)
+				failed = true
+				continue
+			}
+
+			fmt.Printf("revoked %v\n", id)
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// certsReuploadCmd restores certificates missing from Tyk
+var certsReuploadCmd = &cobra.Command{
+	Use:   "reupload [id]...",
+	Short: "uploads certificates missing from Tyk",
+	Long: `Uploads stored certificates that are missing from the Tyk certificate
+store again, e.g. after the dashboard was restored from a backup, all valid
+certificates are checked if no IDs are given:
+
+	tyk-k8s certs reupload`,
+	Run: func(cmd *cobra.Command, args []string) {
+		caClient, whs := certsClients()
+
+		certs := make([]*ca.CertModel, 0)
+		if len(args) == 0 {
+			all, err := caClient.ListCerts()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			now := time.Now()
+			for _, cm := range all {
+				if !cm.Revoked && cm.Expires.After(now) {
+					certs = append(certs, cm)
+				}
+			}
+		}
+
+		for _, id := range args {
+			cm, err := caClient.GetCertByFingerprint(id)
+			if err != nil {
+				log.Fatalf("no certificate %v: %v", id, err)
+			}
+			certs = append(certs, cm)
+		}
+
+		failed := false
+		for _, cm := range certs {
+			id := certID(cm)
+			uploaded, err := whs.ReuploadCert(context.Background(), cm)
+			if err != nil {
+				log.Errorf("failed to re-upload %v: %v", id, err)
+				failed = true
+				continue
+			}
+
+			if uploaded {
+				fmt.Printf("uploaded %v as %v\n", id, cm.Bundle.Fingerprint)
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// certsClients creates the CA client and an injector to manage certificates with
+func certsClients() (*ca.Client, *injector.WebhookServer) {
+	whConf := &injector.Config{}
+	if err := viper.UnmarshalKey("Injector", whConf, kube.DecodeHook); err != nil {
+		log.Fatalf("couldn't read injector config: %v", err)
+	}
+
+	caConf := &ca.Config{}
+	if err := viper.UnmarshalKey("CA", caConf); err != nil {
+		log.Fatalf("couldn't read CA config: %v", err)
+	}
+
+	caClient, err := ca.New(caConf)
+	if err != nil {
+		log.Fatal("failed to init CA client: ", err)
+	}
+
+	whs := &injector.WebhookServer{
+		SidecarConfig: whConf,
+		CAConfig:      caConf,
+		CAClient:      caClient,
+	}
+
+	// server certificates are reissued for the cluster IP of their service
+	if kc, err := kube.Client(); err == nil {
+		whs.KubeClient = kc
+	}
+
+	return caClient, whs
+}
+
+func certID(cm *ca.CertModel) string {
+	if cm.Bundle == nil || cm.Bundle.Fingerprint == "" {
+		return "-"
+	}
+
+	return cm.Bundle.Fingerprint
+}
+
+func certOwner(cm *ca.CertModel) string {
+	switch {
+	case cm.Identity != "":
+		return cm.Identity
+	case cm.ServiceID != "":
+		return "api " + cm.ServiceID
+	case cm.TrustDomain != "":
+		return "trust domain " + cm.TrustDomain
+	default:
+		return "-"
+	}
+}
+
+func certStatus(cm *ca.CertModel, now time.Time) string {
+	switch {
+	case cm.Revoked:
+		return "revoked " + cm.RevokedAt.Format(time.RFC3339)
+	case cm.Expires.Before(now):
+		return "expired"
+	default:
+		return "valid"
+	}
+}
+
+func init() {
+	certsListCmd.Flags().DurationVar(&certsExpiring, "expiring", 0, "only list certificates expiring within this period")
+	certsListCmd.Flags().BoolVar(&certsRevoked, "revoked", false, "include revoked certificates")
+	certsRevokeCmd.Flags().StringVar(&certsReason, "reason", "", "RFC 5280 revocation reason, e.g. keyCompromise")
+
+	certsCmd.AddCommand(certsListCmd, certsRotateCmd, certsRevokeCmd, certsReuploadCmd)
+	rootCmd.AddCommand(certsCmd)
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/ingress"
+	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
+	"go.jlucktay.dev/tyk-k8s/logger"
+	"go.jlucktay.dev/tyk-k8s/sidecar"
+	"go.jlucktay.dev/tyk-k8s/slo"
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tracing"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+	"go.jlucktay.dev/tyk-k8s/webserver"
+)
+
+// validator is implemented by the config sections with checks beyond their schema
+type validator interface {
+	Validate() []error
+}
+
+// configSections are the top-level sections of the config and the structs
+// they are read into
+var configSections = []struct {
+	name string
+	conf func() interface{}
+}{
+	{"Logger", func() interface{} { return &logger.Config{} }},
+	{"Server", func() interface{} { return &webserver.Config{} }},
+	{"Tyk", func() interface{} { return &tyk.TykConf{} }},
+	{"Ingress", func() interface{} { return &ingress.Config{} }},
+	{"LeaderElection", func() interface{} { return &kube.LeaderElectionConfig{} }},
+	{"Components", func() interface{} { return &ComponentsConfig{} }},
+	{"SLO", func() interface{} { return &slo.Config{} }},
+	{"Tracing", func() interface{} { return &tracing.Config{} }},
+	{"Store", func() interface{} { return &store.Config{} }},
+	{"Sidecar", func() interface{} { return &sidecar.Config{} }},
+	{"CA", func() interface{} { return &ca.Config{} }},
+	{"Injector", func() interface{} { return &injector.Config{} }},
+}
+
+// configCmd groups the config commands
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "inspect the controller configuration",
+	Long:  `Commands to inspect the controller configuration.`,
+}
+
+// configValidateCmd checks the config file against the schema of every section
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "validates the config file",
+	Long: `Reads the config file, and environment overrides, strictly into every
+section and prints all problems found: unknown sections and fields, missing
+required fields, invalid ports and values, e.g.:
+
+	tyk-k8s config validate --config /etc/tyk-k8s/tyk-k8s.yaml`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		errs := validateConfig()
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+
+		if len(errs) > 0 {
+			log.Fatalf("%d problems found in the config", len(errs))
+		}
+
+		fmt.Println("config is valid")
+	},
+}
+
+// validateConfig decodes every section rejecting unknown fields and runs the
+// checks of the sections, all errors are returned prefixed with their section
+func validateConfig() []error {
+	errs := make([]error, 0)
+
+	known := map[string]bool{}
+	for _, sec := range configSections {
+		known[strings.ToLower(sec.name)] = true
+	}
+
+	for key := range viper.AllSettings() {
+		if !known[key] {
+			errs = append(errs, fmt.Errorf("%v: unknown section", key))
+		}
+	}
+
+	for _, sec := range configSections {
+		conf := sec.conf()
+		err := viper.UnmarshalKey(sec.name, conf, kube.DecodeHook, func(dc *mapstructure.DecoderConfig) {
+			dc.ErrorUnused = true
+		})
+
+		// the fields that could be decoded are still checked
+		if mErr, ok := err.(*mapstructure.Error); ok {
+			for _, e := range mErr.Errors {
+				errs = append(errs, fmt.Errorf("%v: %v", sec.name, strings.TrimPrefix(e, "'' ")))
+			}
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", sec.name, err))
+			continue
+		}
+
+		if v, ok := conf.(validator); ok {
+			for _, e := range v.Validate() {
+				errs = append(errs, fmt.Errorf("%v.%v", sec.name, e))
+			}
+		}
+	}
+
+	return errs
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+var (
+	exportFormat   string
+	exportOrg      string
+	exportOperator bool
+)
+
+// exportCmd dumps the objects the controller created in Tyk
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "exports the APIs and policies created by the controller",
+	Long: `Prints the API definitions created by the controller in every org, with
+the policies created for their limits and the IDs of the certificates they
+use, as a declarative backup:
+
+	tyk-k8s export > tyk-backup.yaml
+
+With --operator they are converted to ApiDefinition and SecurityPolicy
+resources of the Tyk Operator, in the namespaces of their objects, e.g. to
+migrate to it:
+
+	tyk-k8s export --operator --org acme -o yaml > operator.yaml`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if exportFormat != "yaml" && exportFormat != "json" {
+			log.Fatalf("unknown output format %q, must be yaml or json", exportFormat)
+		}
+
+		tykConf := &tyk.TykConf{}
+		if err := viper.UnmarshalKey("Tyk", tykConf); err != nil {
+			log.Fatalf("couldn't read Tyk config: %v", err)
+		}
+
+		stop := make(chan struct{})
+		defer close(stop)
+		watchCredentials(tykConf, stop)
+		if err := tyk.CredentialsLoaded(); err != nil {
+			log.Fatal(err)
+		}
+
+		orgs := tyk.Orgs()
+		if cmd.Flags().Changed("org") {
+			o, err := tyk.ForOrg(exportOrg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			orgs = []*tyk.Org{o}
+		}
+
+		// APIs recorded in the state store are exported even without a change reason
+		var recorded func(string) bool
+		state, err := openState()
+		if err != nil {
+			log.Warningf("exporting without the state store: %v", err)
+		}
+		if state != nil {
+			recorded = func(id string) bool {
+				_, err := state.Get(store.KindAPI, id)
+				return err == nil
+			}
+		}
+
+		ctx := context.Background()
+		exports := make([]*tyk.Export, 0, len(orgs))
+		for _, o := range orgs {
+			exp, err := tyk.ExportOrg(ctx, o, recorded)
+			if err != nil {
+				log.Fatalf("failed to export org %q: %v", o.Name, err)
+			}
+			exports = append(exports, exp)
+		}
+
+		docs := make([]interface{}, 0)
+		for _, exp := range exports {
+			if !exportOperator {
+				docs = append(docs, exp)
+				continue
+			}
+
+			res, err := exp.OperatorResources()
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, r := range res {
+				docs = append(docs, r)
+			}
+		}
+
+		if err := printDocs(docs, exportFormat, exportOperator); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// printDocs writes YAML documents separated by ---, or a JSON array. Lists
+// of resources are wrapped in a List so kubectl can apply them.
+func printDocs(docs []interface{}, format string, resources bool) error {
+	if format == "json" {
+		var out interface{} = docs
+		if resources {
+			out = map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": docs}
+		}
+
+		data, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(data))
+		return err
+	}
+
+	for i, doc := range docs {
+		data, err := yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+
+		if i > 0 {
+			fmt.Fprintln(os.Stdout, "---")
+		}
+		if _, err := os.Stdout.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportFormat, "output", "o", "yaml", "output format, yaml or json")
+	exportCmd.Flags().StringVar(&exportOrg, "org", "", "only export this org, the default org if empty and every org if unset")
+	exportCmd.Flags().BoolVar(&exportOperator, "operator", false, "print Tyk Operator ApiDefinition and SecurityPolicy resources")
+
+	rootCmd.AddCommand(exportCmd)
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
+)
+
+var injectFile string
+
+// injectCmd applies the sidecar mutation to manifests without a cluster
+var injectCmd = &cobra.Command{
+	Use:   "inject",
+	Short: "injects the sidecar into manifests offline",
+	Long: `Reads Pod, Deployment, StatefulSet, DaemonSet, ReplicaSet, Job or CronJob
+manifests from a file or stdin, applies the sidecar mutation of the webhook
+to the ones annotated for injection and writes them to stdout, e.g.:
+
+	tyk-k8s inject -f deployment.yaml | kubectl apply -f -
+
+The sidecar is taken from the Injector config. Routes, certificates and
+workload identities are only created when the webhook admits a pod, pods
+injected offline are marked offline-injected and the webhook creates them
+without adding the sidecar again.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		whConf := &injector.Config{}
+		if err := viper.UnmarshalKey("Injector", whConf, kube.DecodeHook); err != nil {
+			log.Fatalf("couldn't read injector config: %v", err)
+		}
+
+		var in io.Reader = os.Stdin
+		if injectFile != "" && injectFile != "-" {
+			f, err := os.Open(injectFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			in = f
+		}
+
+		if err := injector.InjectManifests(in, os.Stdout, whConf); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	injectCmd.Flags().StringVarP(&injectFile, "filename", "f", "-", "manifest file to inject, - reads stdin")
+
+	rootCmd.AddCommand(injectCmd)
+}
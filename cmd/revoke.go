@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
+)
+
+var (
+	revokeNamespace string
+	revokeReason    string
+)
+
+// revokeCmd revokes the workload identity of a meshed service
+var revokeCmd = &cobra.Command{
+	Use:   "revoke <service>",
+	Short: "revokes the mesh identity of a service",
+	Long: `Revokes the workload identity certificate of a service (its app label)
+and removes it from the inbound routes of the mesh, so compromised sidecars
+can no longer call other services, e.g.:
+
+	tyk-k8s revoke my-app -n default --reason keyCompromise
+
+Pods of the service admitted afterwards are issued a new identity.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		reason, err := ca.RevocationReason(revokeReason)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		whConf := &injector.Config{}
+		if err := viper.UnmarshalKey("Injector", whConf, kube.DecodeHook); err != nil {
+			log.Fatalf("couldn't read injector config: %v", err)
+		}
+
+		caConf := &ca.Config{}
+		if err := viper.UnmarshalKey("CA", caConf); err != nil {
+			log.Fatalf("couldn't read CA config: %v", err)
+		}
+
+		caClient, err := ca.New(caConf)
+		if err != nil {
+			log.Fatal("failed to init CA client: ", err)
+		}
+
+		whs := &injector.WebhookServer{
+			SidecarConfig: whConf,
+			CAConfig:      caConf,
+			CAClient:      caClient,
+		}
+
+		if err := whs.RevokeIdentity(context.Background(), revokeNamespace, args[0], reason); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	revokeCmd.Flags().StringVarP(&revokeNamespace, "namespace", "n", "default", "namespace of the service")
+	revokeCmd.Flags().StringVar(&revokeReason, "reason", "", "RFC 5280 revocation reason, e.g. keyCompromise")
+
+	rootCmd.AddCommand(revokeCmd)
+}
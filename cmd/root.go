@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"strings"
@@ -9,11 +10,16 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"go.jlucktay.dev/tyk-k8s/logger"
 	"go.jlucktay.dev/tyk-k8s/tyk"
 )
 
 var cfgFile string
 
+// DefaultConfig is used when no config file is given or found, so the
+// controller can start without any mounted configuration
+var DefaultConfig []byte
+
 var rootCmd = &cobra.Command{
 	Use:   "tyk-k8s",
 	Short: "Tyk controller utility for kubernetes",
@@ -35,6 +41,12 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.tyk-k8s-controller.yaml)")
+	rootCmd.PersistentFlags().String("log-level", "", "log level of all modules without an override in Logger.levels")
+	rootCmd.PersistentFlags().String("log-format", "", "log format, text or json")
+
+	// flags take precedence over the Logger section and TK8S_LOGGER_LEVEL / TK8S_LOGGER_FORMAT
+	_ = viper.BindPFlag("Logger.level", rootCmd.PersistentFlags().Lookup("log-level"))
+	_ = viper.BindPFlag("Logger.format", rootCmd.PersistentFlags().Lookup("log-format"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -61,9 +73,25 @@ func initConfig() {
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv() // read in environment variables that match
 
-	// If a config file is found, read it in.
+	// If a config file is found, read it in, otherwise fall back to the built-in defaults
 	if err := viper.ReadInConfig(); err != nil {
-		log.Fatal(err)
+		_, notFound := err.(viper.ConfigFileNotFoundError)
+		if !notFound || len(DefaultConfig) == 0 {
+			log.Fatal(err)
+		}
+
+		log.Warning("no config file found, using built-in defaults")
+		viper.SetConfigType("yaml")
+		if err := viper.ReadConfig(bytes.NewReader(DefaultConfig)); err != nil {
+			log.Fatal(err)
+		}
+
+		// the built-in config expects the webhook certificate where the chart mounts it
+		if cert := viper.GetString("Server.certFile"); viper.GetString("Server.certSecret") == "" {
+			if _, err := os.Stat(cert); err != nil {
+				log.Warningf("no webhook certificate at %v, mount one there or name a kubernetes.io/tls Secret in TK8S_SERVER_CERTSECRET", cert)
+			}
+		}
 	}
 
 	// workaround because viper does not treat env vars the same as other config
@@ -72,6 +100,24 @@ func initConfig() {
 		viper.Set(key, val)
 	}
 
-	log.Infof("Using config file: %v", viper.ConfigFileUsed())
+	logConf := &logger.Config{}
+	if err := viper.UnmarshalKey("Logger", logConf); err != nil {
+		log.Fatalf("couldn't read Logger config: %v", err)
+	}
+
+	// invalid settings are reported with the rest of the config when validating it
+	if err := logger.Configure(logConf); err != nil && configValidateCmd.CalledAs() == "" {
+		log.Fatalf("invalid Logger config: %v", err)
+	}
+
+	if viper.ConfigFileUsed() != "" {
+		log.Infof("Using config file: %v", viper.ConfigFileUsed())
+	}
+	// the Tyk section is only checked, not loaded, when validating the config,
+	// and not needed by the CA init container
+	if configValidateCmd.CalledAs() != "" || caInitCmd.CalledAs() != "" {
+		return
+	}
+
 	tyk.Init(nil)
 }
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	sidecarNamespace  string
+	sidecarController string
+	sidecarToken      string
+	sidecarInsecure   bool
+)
+
+// sidecarCmd groups the sidecar debugging commands
+var sidecarCmd = &cobra.Command{
+	Use:   "sidecar",
+	Short: "debug injected sidecar gateways",
+	Long:  `Query the sidecar gateways of meshed pods through the controller.`,
+}
+
+// sidecarExecCmd proxies a read-only control API query to a pod's sidecar
+var sidecarExecCmd = &cobra.Command{
+	Use:   "exec <pod> -- <apis|apis/<id>|health>",
+	Short: "runs a read-only query against a pod's sidecar gateway",
+	Long: `Proxies a read-only control API query to the sidecar gateway of a pod
+via the controller, e.g.:
+
+	tyk-k8s sidecar exec my-pod-1234 -n default -- apis`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		if dash != 1 || len(args) != 2 {
+			return fmt.Errorf("expected: <pod> -- <query>")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		pod, query := args[0], args[1]
+		if sidecarToken == "" {
+			log.Fatal("a controller token is required, set --token")
+		}
+
+		url := fmt.Sprintf("%s/sidecar/%s/%s/%s", strings.TrimRight(sidecarController, "/"), sidecarNamespace, pod, query)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+sidecarToken)
+
+		cl := &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: sidecarInsecure},
+			},
+		}
+
+		resp, err := cl.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("query failed (%v): %s", resp.StatusCode, body)
+		}
+
+		fmt.Println(string(body))
+	},
+}
+
+func init() {
+	sidecarExecCmd.Flags().StringVarP(&sidecarNamespace, "namespace", "n", "default", "namespace of the pod")
+	sidecarExecCmd.Flags().StringVar(&sidecarController, "controller", "https://localhost:443", "base URL of the controller web server")
+	sidecarExecCmd.Flags().StringVar(&sidecarToken, "token", "", "sidecar proxy token configured on the controller")
+	sidecarExecCmd.Flags().BoolVar(&sidecarInsecure, "insecure", false, "skip TLS verification of the controller")
+
+	sidecarCmd.AddCommand(sidecarExecCmd)
+	rootCmd.AddCommand(sidecarCmd)
+}
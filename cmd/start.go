@@ -1,38 +1,145 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"k8s.io/client-go/dynamic"
 
 	"go.jlucktay.dev/tyk-k8s/ca"
 	"go.jlucktay.dev/tyk-k8s/ingress"
 	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
 	"go.jlucktay.dev/tyk-k8s/logger"
+	"go.jlucktay.dev/tyk-k8s/sidecar"
+	"go.jlucktay.dev/tyk-k8s/slo"
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tracing"
+	"go.jlucktay.dev/tyk-k8s/tyk"
 	"go.jlucktay.dev/tyk-k8s/webserver"
 )
 
 var log = logger.GetLogger("main")
 
+const (
+	// Components that can be started on their own
+	componentInjector       = "injector"
+	componentIngress        = "ingress"
+	componentMeshReconciler = "mesh-reconciler"
+)
+
+var allComponents = []string{componentInjector, componentIngress, componentMeshReconciler}
+
+// ComponentsConfig holds the settings of components started by name
+type ComponentsConfig struct {
+	Injector       ComponentConfig `yaml:"injector"`
+	Ingress        ComponentConfig `yaml:"ingress"`
+	MeshReconciler ComponentConfig `yaml:"meshReconciler"`
+}
+
+// ComponentConfig is the web server and lease of a single component
+type ComponentConfig struct {
+	Server    *webserver.Config `yaml:"server"`    // defaults to the Server section
+	LeaseName string            `yaml:"leaseName"` // defaults to the LeaderElection name suffixed with the component
+}
+
+// Validate checks the web servers of the components
+func (c *ComponentsConfig) Validate() []error {
+	errs := make([]error, 0)
+	servers := []struct {
+		name string
+		cfg  *webserver.Config
+	}{
+		{"injector", c.Injector.Server},
+		{"ingress", c.Ingress.Server},
+		{"meshReconciler", c.MeshReconciler.Server},
+	}
+
+	for _, srv := range servers {
+		if srv.cfg == nil {
+			continue
+		}
+
+		for _, err := range srv.cfg.Validate() {
+			errs = append(errs, fmt.Errorf("%v.server.%v", srv.name, err))
+		}
+	}
+
+	return errs
+}
+
 // startCmd represents the start command
 var startCmd = &cobra.Command{
-	Use:   "start",
+	Use:   "start [injector] [ingress] [mesh-reconciler]",
 	Short: "starts the controller",
-	Long:  `Starts the controller.`,
+	Long: `Starts the controller, by default with all of its components:
+
+	injector         the admission webhook, CA endpoints and sidecar proxy
+	ingress          the ingress and service reconcilers and SLO endpoints
+	mesh-reconciler  the rotation of mesh certificates
+
+Components can be started on their own or in any combination so they can be
+scaled separately, e.g.:
+
+	tyk-k8s start injector
+	tyk-k8s start ingress mesh-reconciler
+
+Components started by name are served on the web server of their section in
+Components, sharing a server when their addresses match, and with leader
+election enabled each one elects a leader on its own lease.`,
+	ValidArgs: allComponents,
+	Args:      cobra.OnlyValidArgs,
 	Run: func(cmd *cobra.Command, args []string) {
+		run := map[string]bool{}
+		for _, c := range args {
+			run[c] = true
+		}
+
+		// the component sections only apply to components started by name
+		split := len(run) > 0
+		compConf := &ComponentsConfig{}
+		if split {
+			if err := viper.UnmarshalKey("Components", compConf); err != nil {
+				log.Fatalf("couldn't read Components config: %v", err)
+			}
+		} else {
+			for _, c := range allComponents {
+				run[c] = true
+			}
+		}
+
+		traceConf := &tracing.Config{}
+		if err := viper.UnmarshalKey("Tracing", traceConf); err != nil {
+			log.Fatalf("couldn't read Tracing config: %v", err)
+		}
+
+		shutdownTracing, err := tracing.Init(context.Background(), traceConf)
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		sConf := &webserver.Config{}
-		err := viper.UnmarshalKey("Server", sConf)
+		err = viper.UnmarshalKey("Server", sConf)
 		if err != nil {
 			log.Fatalf("no Server entry found in config file: %v", err)
 		}
-		webserver.Server().Config(sConf)
+
+		// closed on shutdown to stop the watches started below
+		stop := make(chan struct{})
+		servers := &componentServers{base: sConf, stop: stop, byAddr: map[string]*webserver.WebServer{}}
 
 		// Web server mutating webhook
 		whConf := &injector.Config{}
-		err = viper.UnmarshalKey("Injector", whConf)
+		err = viper.UnmarshalKey("Injector", whConf, kube.DecodeHook)
 		if err != nil {
 			log.Fatalf("couldn't read injector config: %v", err)
 		}
@@ -44,57 +151,438 @@ var startCmd = &cobra.Command{
 			log.Fatalf("couldn't read CA config: %v", err)
 		}
 
+		meshed := run[componentInjector] || run[componentMeshReconciler]
+
+		// pods injected until the next restart all run the same sidecar image
+		if run[componentInjector] && whConf.PinSidecarDigest {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := injector.PinSidecarDigest(ctx, whConf); err != nil {
+				log.Warning("failed to pin the sidecar image, injecting it by tag: ", err)
+			}
+			cancel()
+		}
+
 		// Module init - adds a mesh cert ID if none exist
-		err = ModuleInit(whConf, caConf)
-		if err != nil {
-			log.Fatal(err)
+		if meshed {
+			err = ModuleInit(whConf, caConf)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		// Templates managed in the cluster take precedence over the template directory
+		tykConf := &tyk.TykConf{}
+		if err := viper.UnmarshalKey("Tyk", tykConf); err != nil {
+			log.Fatalf("couldn't read Tyk config: %v", err)
 		}
 
+		if tykConf.TemplatesConfigMap != "" {
+			kc, err := kube.Client()
+			if err != nil {
+				log.Fatal("failed to create kubernetes client: ", err)
+			}
+
+			tplStore, err := kube.NewConfigMapTemplateStore(kc, tykConf.TemplatesConfigMap)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if err := tplStore.Start(stop); err != nil {
+				log.Fatal(err)
+			}
+			tyk.SetTemplateStore(tplStore)
+		}
+
+		watchCredentials(tykConf, stop)
+
 		// Ingress controller configuration
 		ingConf := &ingress.Config{}
 		if err := viper.UnmarshalKey("Ingress", ingConf); err != nil {
 			log.Fatalf("couldn't read Ingress config: %v", err)
 		}
-		controller := ingress.Controller().Config(ingConf)
+		kube.SetOpenAPIConfig(&ingConf.OpenAPI)
+		// State store of the APIs and certs created, optional
+		state, err := openState()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		controller := ingress.Controller().Config(ingConf).State(state)
 
 		whs := &injector.WebhookServer{
 			SidecarConfig: whConf,
 			CAConfig:      caConf,
+			State:         state,
+		}
+
+		if kc, err := kube.Client(); err == nil {
+			whs.KubeClient = kc
+		} else {
+			log.Warning("no kubernetes client available for the injector: ", err)
+		}
+
+		if whConf.MeshPolicies.Enabled {
+			restCfg, err := kube.RestConfig()
+			if err == nil {
+				whs.DynamicClient, err = dynamic.NewForConfig(restCfg)
+			}
+			if err != nil {
+				log.Fatal("failed to create the client reading mesh policies: ", err)
+			}
 		}
 
-		if whConf.EnableMeshTLS {
-			caClient, err := ca.New(caConf)
+		var caClient *ca.Client
+		if meshed && whConf.EnableMeshTLS {
+			caClient, err = ca.New(caConf)
 			if err != nil {
 				log.Fatal("failed to init CA client: ", err)
 			}
 
 			whs.CAClient = caClient
+			whs.RecordMeshCert()
 		}
 
-		webserver.Server().AddRoute("POST", "/inject", whs.Serve)
+		if run[componentInjector] {
+			srv := servers.get(compConf.Injector.Server)
 
-		// Ingress controller
-		if err := controller.Start(); err != nil {
-			log.Fatal(err)
+			// revocation status of the built-in CA
+			if caClient != nil {
+				// public, fetched by ca-init and TLS clients without a certificate
+				srv.AddPublicRoute("GET", "/ca/crl", caClient.ServeCRL)
+				srv.AddPublicRoute("GET", "/ca/bundle", caClient.ServeCABundle)
+				srv.AddPublicRoute("GET", "/ca/bundle.pem", caClient.ServeCABundle)
+				if caClient.OCSPEnabled() {
+					srv.AddPublicRoute("POST", "/ca/ocsp", caClient.ServeOCSP)
+					srv.AddPublicRoute("GET", "/ca/ocsp/{request:.+}", caClient.ServeOCSP)
+				}
+			}
+
+			for path, h := range whs.AdmissionRoutes() {
+				srv.AddRoute("POST", path, h, webserver.RequestID, webserver.Logging, webserver.Recovery)
+			}
+
+			// read-only discovery of the services in the mesh, for callers
+			// with a client certificate or the discovery token
+			if whs.KubeClient != nil {
+				if whConf.Discovery.Token == "" {
+					log.Warningf("%v only answers callers with a client certificate, set Injector.discovery.token for the others", injector.MeshServicesRoute)
+				}
+				srv.AddRoute("GET", injector.MeshServicesRoute, whs.ServeMeshServices)
+			}
+			if caClient != nil {
+				srv.AddRoute("GET", injector.MeshCARoute, whs.ServeCARotation)
+			}
+
+			// Read-only sidecar control API proxy for debugging
+			scConf := &sidecar.Config{}
+			if err := viper.UnmarshalKey("Sidecar", scConf); err != nil {
+				log.Fatalf("couldn't read Sidecar config: %v", err)
+			}
+
+			if scConf.Enabled {
+				if scConf.Secret == "" {
+					scConf.Secret = sidecarSecret(whConf)
+				}
+
+				kc, err := kube.Client()
+				if err != nil {
+					log.Fatal("failed to create kubernetes client: ", err)
+				}
+
+				proxy, err := sidecar.NewProxy(scConf, kc)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				srv.AddRoute("GET", sidecar.ProxyRoute, proxy.Serve)
+			}
+		}
+
+		if run[componentIngress] {
+			srv := servers.get(compConf.Ingress.Server)
+
+			// SLO analytics endpoints
+			sloConf := &slo.Config{}
+			if err := viper.UnmarshalKey("SLO", sloConf); err != nil {
+				log.Fatalf("couldn't read SLO config: %v", err)
+			}
+
+			if sloConf.Enabled {
+				exporter := slo.New(sloConf, nil)
+				srv.AddRoute("GET", "/slo", exporter.ServeJSON)
+				srv.AddRoute("GET", "/slo/metrics", exporter.ServeMetrics)
+			}
+		}
+
+		if run[componentMeshReconciler] {
+			// only serves the probes
+			servers.get(compConf.MeshReconciler.Server)
+		}
+
+		// The reconcilers, with leader election enabled only the leading replica
+		// reconciles while every replica serves the admission webhook
+		leConf := &kube.LeaderElectionConfig{}
+		if err := viper.UnmarshalKey("LeaderElection", leConf); err != nil {
+			log.Fatalf("couldn't read LeaderElection config: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var leading int32
+		startController := func(lctx context.Context) {
+			if err := controller.Start(); err != nil {
+				log.Fatal(err)
+			}
+			atomic.StoreInt32(&leading, 1)
+			log.Info("ingress controller started")
+
+			if ingConf.Drift.Mode != "" {
+				go controller.WatchDrift(lctx, whs.RestoreRoutes)
+			}
 		}
-		log.Info("ingress controller started")
 
-		go webserver.Server().Start()
-		log.Info("web server started")
+		startReconciler := func(lctx context.Context) {
+			if !startMeshJobs(lctx, whs) {
+				log.Warning("mesh reconciler has nothing to do, mesh TLS is disabled")
+				return
+			}
+			log.Info("mesh reconciler started")
+		}
+
+		leaders := make([]*leaderJob, 0)
+		if split {
+			if run[componentIngress] {
+				leaders = append(leaders, &leaderJob{lease: compConf.Ingress.LeaseName, component: componentIngress, lead: startController})
+			}
+			if run[componentMeshReconciler] {
+				leaders = append(leaders, &leaderJob{lease: compConf.MeshReconciler.LeaseName, component: componentMeshReconciler, lead: startReconciler})
+			}
+		} else {
+			// certificates are rotated by the leader only
+			leaders = append(leaders, &leaderJob{lease: leConf.Name, lead: func(lctx context.Context) {
+				startController(lctx)
+				startMeshJobs(lctx, whs)
+			}})
+		}
+
+		// every replica admits pods against the current mesh policies
+		if run[componentInjector] && whConf.MeshPolicies.Enabled {
+			go whs.WatchMeshPolicies(ctx)
+		}
+
+		for _, job := range leaders {
+			if !leConf.Enabled {
+				job.lead(ctx)
+				continue
+			}
+
+			kc, err := kube.Client()
+			if err != nil {
+				log.Fatal("failed to create kubernetes client: ", err)
+			}
+
+			jobConf := *leConf
+			jobConf.Name = job.lease
+			if jobConf.Name == "" {
+				jobConf.Name = leConf.Name + "-" + job.component
+			}
+
+			go func(job *leaderJob) {
+				err := kube.RunLeaderElection(ctx, kc, &jobConf, job.lead, func() {
+					if ctx.Err() == nil {
+						// another replica may be reconciling already, restart as a follower
+						log.Fatal("lost leadership, exiting")
+					}
+				})
+				if err != nil {
+					log.Fatal(err)
+				}
+			}(job)
+		}
+
+		for _, srv := range servers.all {
+			go srv.Start()
+		}
+		log.Infof("web server started, components: %v", strings.Join(started(run), ", "))
 
 		WaitForCtrlC()
+		log.Info("shutting down")
 
-		err = webserver.Server().Stop()
-		if err != nil {
-			log.Error(err)
+		// stop advertising readiness before anything else so no new traffic is routed here
+		for _, srv := range servers.all {
+			srv.SetReady(false)
+		}
+
+		if run[componentInjector] && whConf.WebhookConfigName != "" {
+			kc, err := kube.Client()
+			if err == nil {
+				err = injector.DeregisterWebhook(kc, whConf.WebhookConfigName)
+			}
+
+			if err != nil {
+				log.Error("failed to remove webhook registration: ", err)
+			}
+		}
+
+		// drain in-flight admission requests
+		for _, srv := range servers.all {
+			if err := srv.Stop(); err != nil {
+				log.Error(err)
+			}
+		}
+
+		if atomic.LoadInt32(&leading) == 1 {
+			if err := controller.Stop(); err != nil {
+				log.Error(err)
+			}
 		}
 
-		if err := controller.Stop(); err != nil {
-			log.Error(err)
+		// releases the lease so another replica can take over straight away
+		cancel()
+
+		close(stop)
+
+		// flush the spans of the last admissions
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Error("failed to flush traces: ", err)
 		}
+		flushCancel()
+
+		log.Info("shutdown complete")
 	},
 }
 
+// leaderJob is started by the replica holding its lease
+type leaderJob struct {
+	lease     string
+	component string
+	lead      func(context.Context)
+}
+
+// startMeshJobs starts the rotation of mesh certificates, which also drives
+// root CA rotations, and the reconciliation of mesh policies until the
+// context is done. It reports whether there was anything to start.
+func startMeshJobs(ctx context.Context, whs *injector.WebhookServer) bool {
+	if whs.CAClient == nil {
+		return false
+	}
+
+	go whs.RotateCerts(ctx)
+	if whs.SidecarConfig.MeshPolicies.Enabled {
+		go whs.ReconcileMeshPolicies(ctx)
+	}
+
+	return true
+}
+
+// openState opens the state store of the config, nil if none is configured
+func openState() (store.Store, error) {
+	stateConf := &store.Config{}
+	if err := viper.UnmarshalKey("Store", stateConf); err != nil {
+		return nil, fmt.Errorf("couldn't read Store config: %v", err)
+	}
+
+	state, err := store.New(stateConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store: %v", err)
+	}
+
+	return state, nil
+}
+
+// watchCredentials loads the dashboard keys kept in Secrets and reloads them
+// when they are rotated, until stop is closed
+func watchCredentials(conf *tyk.TykConf, stop <-chan struct{}) {
+	refs := map[string]string{"": conf.SecretRef}
+	for _, oc := range conf.Orgs {
+		refs[oc.Name] = oc.SecretRef
+	}
+
+	for org, ref := range refs {
+		if ref == "" {
+			continue
+		}
+
+		kc, err := kube.Client()
+		if err != nil {
+			log.Fatal("failed to create kubernetes client: ", err)
+		}
+
+		org := org
+		sv, err := kube.NewSecretValue(kc, ref, func(key string) { tyk.SetCredential(org, key) })
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := sv.Start(stop); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// componentServers creates the web servers of the started components,
+// components listening on the same address share a server
+type componentServers struct {
+	base   *webserver.Config
+	stop   chan struct{}
+	byAddr map[string]*webserver.WebServer
+	all    []*webserver.WebServer
+}
+
+func (s *componentServers) get(cfg *webserver.Config) *webserver.WebServer {
+	if cfg == nil {
+		cfg = s.base
+	}
+
+	addr := cfg.Addr
+	if addr == "" {
+		addr = webserver.DefaultAddr
+	}
+
+	if srv, ok := s.byAddr[addr]; ok {
+		return srv
+	}
+
+	srv := webserver.New(cfg)
+
+	// the controller is useless without its dashboard keys
+	srv.AddReadyCheck(tyk.CredentialsLoaded)
+
+	// serving certificates delivered as a Secret, e.g. by cert-manager, are reloaded on change
+	if cfg.CertSecret != "" {
+		kc, err := kube.Client()
+		if err != nil {
+			log.Fatal("failed to create kubernetes client: ", err)
+		}
+
+		kp, err := kube.NewSecretKeyPair(kc, cfg.CertSecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := kp.Start(s.stop); err != nil {
+			log.Fatal(err)
+		}
+		srv.SetCertificateSource(kp.GetCertificate)
+	}
+
+	s.byAddr[addr] = srv
+	s.all = append(s.all, srv)
+	return srv
+}
+
+// started lists the selected components in a stable order
+func started(run map[string]bool) []string {
+	names := make([]string, 0, len(run))
+	for _, c := range allComponents {
+		if run[c] {
+			names = append(names, c)
+		}
+	}
+
+	return names
+}
+
 func ModuleInit(sideCarConfig *injector.Config, caConfig *ca.Config) error {
 	if !sideCarConfig.EnableMeshTLS {
 		return nil
@@ -109,7 +597,7 @@ func ModuleInit(sideCarConfig *injector.Config, caConfig *ca.Config) error {
 		return err
 	}
 
-	id, err := certAuth.GetOrCreateMeshCertID()
+	id, err := certAuth.GetOrCreateMeshCertID(sideCarConfig.MeshHostnames.All()...)
 	if err != nil {
 		return err
 	}
@@ -118,6 +606,19 @@ func ModuleInit(sideCarConfig *injector.Config, caConfig *ca.Config) error {
 	return nil
 }
 
+// sidecarSecret finds the gateway secret set on the injected sidecar container
+func sidecarSecret(whConf *injector.Config) string {
+	for _, cnt := range whConf.Containers {
+		for _, env := range cnt.Env {
+			if env.Name == "TYK_GW_SECRET" {
+				return env.Value
+			}
+		}
+	}
+
+	return ""
+}
+
 func init() {
 	rootCmd.AddCommand(startCmd)
 }
@@ -127,7 +628,7 @@ func WaitForCtrlC() {
 	end_waiter.Add(1)
 	var signal_channel chan os.Signal
 	signal_channel = make(chan os.Signal, 1)
-	signal.Notify(signal_channel, os.Interrupt)
+	signal.Notify(signal_channel, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-signal_channel
 		end_waiter.Done()
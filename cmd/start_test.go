@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/injector"
+)
+
+// publishingCA is a CA whose root rotation is still publishing the new root,
+// every reconciliation is reported on advanced
+type publishingCA struct {
+	*ca.Mock
+	advanced chan int
+}
+
+func (p *publishingCA) RotationStatus() (*ca.RotationStatus, error) {
+	return &ca.RotationStatus{Phase: ca.RotationPublishing}, nil
+}
+
+func (p *publishingCA) StaleCert(*ca.CertModel) bool { return false }
+
+func (p *publishingCA) AdvanceRotation(pending int) (*ca.RotationStatus, error) {
+	p.advanced <- pending
+	return p.RotationStatus()
+}
+
+func (p *publishingCA) RotationBatchSize() int { return 1 }
+
+func (p *publishingCA) RotationMeshCert() string { return "" }
+
+func (p *publishingCA) SetRotationMeshCert(string) error { return nil }
+
+func TestStartMeshJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if startMeshJobs(ctx, &injector.WebhookServer{SidecarConfig: &injector.Config{}}) {
+		t.Fatal("expected nothing to start without mesh TLS")
+	}
+
+	// the defaults don't rotate expiring certs, CA rotations move on regardless
+	rot := &publishingCA{Mock: &ca.Mock{}, advanced: make(chan int, 1)}
+	whs := &injector.WebhookServer{
+		SidecarConfig: &injector.Config{EnableMeshTLS: true},
+		CAClient:      rot,
+	}
+
+	if !startMeshJobs(ctx, whs) {
+		t.Fatal("expected the mesh jobs to start")
+	}
+
+	select {
+	case <-rot.advanced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the CA rotation to be reconciled without a rotation threshold")
+	}
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/ingress"
+	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+var syncDryRun bool
+
+// syncCmd reconciles the APIs of the whole cluster once
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "reconciles the gateway APIs with the cluster",
+	Long: `Lists the ingresses, exposed services and injected pods in the watched
+namespaces, compares their routes with the API definitions in the dashboard
+and creates, updates or deletes APIs to converge, e.g. after the dashboard
+was restored from a backup:
+
+	tyk-k8s sync --dry-run
+
+Only APIs created by the controller are deleted, recognised by the change
+reason recorded on them or their record in the state store.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ingConf := &ingress.Config{}
+		if err := viper.UnmarshalKey("Ingress", ingConf); err != nil {
+			log.Fatalf("couldn't read Ingress config: %v", err)
+		}
+		kube.SetOpenAPIConfig(&ingConf.OpenAPI)
+
+		whConf := &injector.Config{}
+		if err := viper.UnmarshalKey("Injector", whConf, kube.DecodeHook); err != nil {
+			log.Fatalf("couldn't read injector config: %v", err)
+		}
+
+		caConf := &ca.Config{}
+		if err := viper.UnmarshalKey("CA", caConf); err != nil {
+			log.Fatalf("couldn't read CA config: %v", err)
+		}
+
+		tykConf := &tyk.TykConf{}
+		if err := viper.UnmarshalKey("Tyk", tykConf); err != nil {
+			log.Fatalf("couldn't read Tyk config: %v", err)
+		}
+
+		kc, err := kube.Client()
+		if err != nil {
+			log.Fatal("failed to create kubernetes client: ", err)
+		}
+
+		stop := make(chan struct{})
+		defer close(stop)
+		watchCredentials(tykConf, stop)
+		if err := tyk.CredentialsLoaded(); err != nil {
+			log.Fatal(err)
+		}
+
+		// the records of the controller find APIs whose change reason was lost
+		state, err := openState()
+		if err != nil {
+			log.Warningf("planning without the state store: %v", err)
+		}
+
+		ctx := context.Background()
+		controller := ingress.Controller().Config(ingConf).State(state)
+		ops, err := controller.Plan(ctx, kc)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, op := range ops {
+			fmt.Println(op)
+		}
+
+		if len(ops) == 0 {
+			fmt.Println("gateway is in sync with the cluster")
+			return
+		}
+
+		if syncDryRun {
+			return
+		}
+
+		if err := ModuleInit(whConf, caConf); err != nil {
+			log.Fatal(err)
+		}
+
+		whs := &injector.WebhookServer{
+			SidecarConfig: whConf,
+			CAConfig:      caConf,
+			KubeClient:    kc,
+			State:         state,
+		}
+
+		if whConf.EnableMeshTLS {
+			caClient, err := ca.New(caConf)
+			if err != nil {
+				log.Fatal("failed to init CA client: ", err)
+			}
+			whs.CAClient = caClient
+		}
+
+		if err := controller.Sync(ctx, ops, whs.RestoreRoutes); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	syncCmd.Flags().BoolVar(&syncDryRun, "dry-run", false, "print the changes without applying them")
+
+	rootCmd.AddCommand(syncCmd)
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
+)
+
+var (
+	upgradeNamespace string
+	upgradeDryRun    bool
+)
+
+// upgradeCmd rolls the workloads running an outdated sidecar
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade-sidecars",
+	Short: "restarts workloads running an outdated sidecar",
+	Long: `Compares the sidecar version recorded on injected pods with the sidecar
+image of the injector config, resolved to a digest if pinSidecarDigest is
+enabled, and triggers a rolling restart of the Deployments, StatefulSets and
+DaemonSets running another version, e.g. after upgrading the sidecar image:
+
+	tyk-k8s upgrade-sidecars -n default --dry-run
+
+Restart the injector before, so it injects the new image. Pods that aren't
+rolled by a workload are listed to be recreated by hand.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		whConf := &injector.Config{}
+		if err := viper.UnmarshalKey("Injector", whConf, kube.DecodeHook); err != nil {
+			log.Fatalf("couldn't read injector config: %v", err)
+		}
+
+		if whConf.PinSidecarDigest {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := injector.PinSidecarDigest(ctx, whConf)
+			cancel()
+			if err != nil {
+				log.Fatal("failed to resolve the sidecar image: ", err)
+			}
+		}
+
+		version := injector.SidecarVersion(whConf)
+		if version == "" {
+			log.Fatal("no tyk-mesh container in the injector config")
+		}
+
+		kc, err := kube.Client()
+		if err != nil {
+			log.Fatal("failed to create kubernetes client: ", err)
+		}
+
+		workloads, bare, err := injector.OutdatedWorkloads(kc, upgradeNamespace, version)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, pod := range bare {
+			fmt.Printf("pod %s runs an outdated sidecar and must be recreated by hand\n", pod)
+		}
+
+		if len(workloads) == 0 {
+			fmt.Println("all workloads run", version)
+			return
+		}
+
+		for _, w := range workloads {
+			if upgradeDryRun {
+				fmt.Println("would restart", w)
+				continue
+			}
+
+			if err := injector.RestartWorkload(kc, w); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("restarted", w)
+		}
+	},
+}
+
+func init() {
+	upgradeCmd.Flags().StringVarP(&upgradeNamespace, "namespace", "n", "", "namespace of the workloads, all namespaces if unset")
+	upgradeCmd.Flags().BoolVar(&upgradeDryRun, "dry-run", false, "list the workloads without restarting them")
+
+	rootCmd.AddCommand(upgradeCmd)
+}
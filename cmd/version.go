@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+	"go.jlucktay.dev/tyk-k8s/version"
+)
+
+var versionClientOnly bool
+
+// versionCmd reports the build and the versions of the connected Tyk components
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "prints the version and checks Tyk compatibility",
+	Long: `Prints the build of the controller, queries the dashboard (or gateway in
+"ce" mode) of every configured org for its version and reads the version of
+the sidecar gateway from its image tag. Features of the controller the
+connected versions don't support are reported and the command fails, e.g.:
+
+	tyk-k8s version
+	tyk-k8s version --client`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("tyk-k8s", version.String())
+		if versionClientOnly {
+			return
+		}
+
+		ctx := context.Background()
+		problems := make([]string, 0)
+		seen := map[string]bool{}
+		for _, o := range tyk.Orgs() {
+			if seen[o.URL()] {
+				continue
+			}
+			seen[o.URL()] = true
+
+			v, err := o.Version(ctx)
+			switch {
+			case err != nil:
+				fmt.Printf("%s %s: unavailable (%v)\n", o.Component(), o.URL(), err)
+			case v == "":
+				fmt.Printf("%s %s: not reported, released before 3.0\n", o.Component(), o.URL())
+			default:
+				fmt.Printf("%s %s: %s\n", o.Component(), o.URL(), v)
+				problems = append(problems, tyk.Incompatibilities(o.Component(), v)...)
+			}
+		}
+
+		whConf := &injector.Config{}
+		if err := viper.UnmarshalKey("Injector", whConf, kube.DecodeHook); err != nil {
+			log.Fatalf("couldn't read injector config: %v", err)
+		}
+
+		for _, cnt := range whConf.Containers {
+			if strings.ToLower(cnt.Name) != "tyk-mesh" {
+				continue
+			}
+
+			tag := imageTag(cnt.Image)
+			fmt.Printf("sidecar %s %s: %s\n", tyk.ComponentGateway, cnt.Image, tag)
+			problems = append(problems, tyk.Incompatibilities(tyk.ComponentGateway, tag)...)
+		}
+
+		for _, p := range problems {
+			fmt.Println("incompatible:", p)
+		}
+
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// imageTag returns the tag of an image reference, "latest" if it has none
+func imageTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[i+1:]
+	}
+
+	// a colon before the last slash separates the registry port
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+
+	return "latest"
+}
+
+func init() {
+	versionCmd.Flags().BoolVar(&versionClientOnly, "client", false, "only print the build of the controller")
+
+	rootCmd.AddCommand(versionCmd)
+}
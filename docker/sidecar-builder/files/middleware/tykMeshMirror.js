@@ -0,0 +1,41 @@
+// Sends a copy of a share of the requests of a mesh route to the mirror set
+// by the injector.tyk.io/mirror-to annotation, config_data.mirror holds the
+// target, the percentage to mirror and the listen path to strip. Responses
+// of the mirror are discarded.
+var tykMeshMirror = new TykJS.TykMiddleware.NewMiddleware({});
+
+tykMeshMirror.NewProcessRequest(function(request, session, spec) {
+    var mirror = spec.config_data && spec.config_data.mirror;
+    if (!mirror || !mirror.target || Math.random() * 100 >= mirror.percent) {
+        return tykMeshMirror.ReturnData(request, {});
+    }
+
+    var resource = request.URL;
+    if (mirror.strip && mirror.strip !== "/" && resource.indexOf(mirror.strip) === 0) {
+        resource = resource.substring(mirror.strip.length);
+    }
+    if (resource.charAt(0) !== "/") {
+        resource = "/" + resource;
+    }
+
+    var headers = {};
+    for (var h in request.Headers) {
+        headers[h] = request.Headers[h][0];
+    }
+    headers["X-Tyk-Mesh-Mirrored"] = "true";
+
+    try {
+        TykMakeHttpRequest(JSON.stringify({
+            Method: request.Method,
+            Body: request.Body,
+            Headers: headers,
+            Domain: mirror.target,
+            Resource: resource,
+            FormData: {}
+        }));
+    } catch (e) {
+        log("mirroring to " + mirror.target + " failed: " + e);
+    }
+
+    return tykMeshMirror.ReturnData(request, {});
+});
@@ -0,0 +1,74 @@
+package ingress
+
+import (
+	"encoding/json"
+	"reflect"
+
+	v1 "k8s.io/api/core/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// AdoptedAPIsAnnotation records the IDs of the existing APIs that were
+// adopted for the routes of an object, by slug as JSON
+const AdoptedAPIsAnnotation = StatusAnnotationPrefix + "adopted-apis"
+
+// adoptedPatch returns the patch adding the APIs adopted for routes to the
+// ones recorded on an object, or nil if none were adopted
+func adoptedPatch(ann map[string]string, routes []*tyk.APIDefOptions) []byte {
+	adopted := map[string]string{}
+	if raw, ok := ann[AdoptedAPIsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(raw), &adopted); err != nil {
+			log.Warningf("ignoring invalid %v annotation: %v", AdoptedAPIsAnnotation, err)
+			adopted = map[string]string{}
+		}
+	}
+
+	merged := make(map[string]string, len(adopted)+len(routes))
+	for slug, id := range adopted {
+		merged[slug] = id
+	}
+	for _, opts := range routes {
+		if opts.AdoptedID != "" {
+			merged[opts.Slug] = opts.AdoptedID
+		}
+	}
+
+	if len(merged) == 0 || reflect.DeepEqual(adopted, merged) {
+		return nil
+	}
+
+	raw, _ := json.Marshal(merged)
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{AdoptedAPIsAnnotation: string(raw)},
+		},
+	})
+
+	return patch
+}
+
+// setIngressAdopted records the APIs adopted for the routes of an ingress
+func (c *ControlServer) setIngressAdopted(ing *netv1beta1.Ingress, routes []*tyk.APIDefOptions) {
+	patch := adoptedPatch(ing.Annotations, routes)
+	if patch == nil || c.client == nil || ing.DeletionTimestamp != nil {
+		return
+	}
+
+	if err := c.patchIngress(ing, patch); err != nil {
+		log.Errorf("failed to record the adopted APIs of ingress %s/%s: %v", ing.Namespace, ing.Name, err)
+	}
+}
+
+// setServiceAdopted records the API adopted for a service
+func (c *ControlServer) setServiceAdopted(svc *v1.Service, opts *tyk.APIDefOptions) {
+	patch := adoptedPatch(svc.Annotations, []*tyk.APIDefOptions{opts})
+	if patch == nil || c.client == nil || svc.DeletionTimestamp != nil {
+		return
+	}
+
+	if err := c.patchService(svc, patch); err != nil {
+		log.Errorf("failed to record the adopted API of service %s/%s: %v", svc.Namespace, svc.Name, err)
+	}
+}
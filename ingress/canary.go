@@ -0,0 +1,203 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+)
+
+const (
+	// CanaryAnnotation marks an ingress as a canary for the primary ingress
+	// serving the same host/path
+	CanaryAnnotation = "tyk.io/canary"
+	// CanaryWeightAnnotation is the percentage of traffic sent to the canary
+	CanaryWeightAnnotation = "tyk.io/canary-weight"
+)
+
+type canaryRoute struct {
+	owner  string
+	host   string
+	path   string
+	target string
+	weight int
+}
+
+// canaryRoutes holds the canary backends keyed by host/path
+type canaryRoutes struct {
+	mu     sync.Mutex
+	routes map[string]canaryRoute
+}
+
+func canaryKey(host, path string) string {
+	return host + path
+}
+
+func isCanary(ing *netv1beta1.Ingress) bool {
+	switch strings.ToLower(ing.Annotations[CanaryAnnotation]) {
+	case "y", "yes", "true", "on":
+		return true
+	}
+
+	return false
+}
+
+func canaryWeight(ing *netv1beta1.Ingress) (int, error) {
+	v, ok := ing.Annotations[CanaryWeightAnnotation]
+	if !ok {
+		return 0, nil
+	}
+
+	w, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid canary weight %q: %v", v, err)
+	}
+
+	if w < 0 || w > 100 {
+		return 0, fmt.Errorf("canary weight must be between 0 and 100, got %d", w)
+	}
+
+	return w, nil
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
+
+// weightedTargets builds a round-robin target list approximating the canary
+// weight, e.g. a weight of 20 yields four primary entries for every canary entry
+func weightedTargets(primary, canary string, weight int) []string {
+	switch {
+	case weight <= 0:
+		return []string{primary}
+	case weight >= 100:
+		return []string{canary}
+	}
+
+	g := gcd(weight, 100-weight)
+	targets := make([]string, 0, 100/g)
+	for i := 0; i < (100-weight)/g; i++ {
+		targets = append(targets, primary)
+	}
+
+	for i := 0; i < weight/g; i++ {
+		targets = append(targets, canary)
+	}
+
+	return targets
+}
+
+// addCanary registers the backends of a canary ingress and splits the traffic
+// of any matching primary routes
+func (c *ControlServer) addCanary(ctx context.Context, ing *netv1beta1.Ingress) error {
+	weight, err := canaryWeight(ing)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]string, 0)
+	for _, rt := range c.ingressRoutes(ing) {
+		cr := canaryRoute{
+			owner:  ingressOwner(ing),
+			host:   rt.Host,
+			path:   rt.Path.Path,
+			target: fmt.Sprintf("http://%s.%s:%d", rt.Path.Backend.ServiceName, ing.Namespace, rt.Path.Backend.ServicePort.IntVal),
+			weight: weight,
+		}
+
+		c.canaries.mu.Lock()
+		c.canaries.routes[canaryKey(cr.host, cr.path)] = cr
+		c.canaries.mu.Unlock()
+
+		primary, ok := c.claims.lookup(cr.host, cr.path)
+		if !ok {
+			log.Infof("no primary route for canary %s%s yet", cr.host, cr.path)
+			continue
+		}
+
+		if err := c.setTargets(ctx, primary, weightedTargets(primary.target, cr.target, weight)); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to apply canary %s: %s", ingressOwner(ing), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// removeCanary drops the canary backends and restores the primary routes
+func (c *ControlServer) removeCanary(ctx context.Context, ing *netv1beta1.Ingress) error {
+	errs := make([]string, 0)
+	for _, rt := range c.ingressRoutes(ing) {
+		key := canaryKey(rt.Host, rt.Path.Path)
+
+		// another canary may have taken over the route since, its split is kept
+		c.canaries.mu.Lock()
+		cr, ok := c.canaries.routes[key]
+		owned := ok && cr.owner == ingressOwner(ing)
+		if owned {
+			delete(c.canaries.routes, key)
+		}
+		c.canaries.mu.Unlock()
+
+		if !owned {
+			continue
+		}
+
+		primary, ok := c.claims.lookup(rt.Host, rt.Path.Path)
+		if !ok {
+			continue
+		}
+
+		if err := c.setTargets(ctx, primary, nil); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove canary %s: %s", ingressOwner(ing), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// applyCanaryFor splits the traffic of a created or updated primary route if
+// a canary has been registered for it
+func (c *ControlServer) applyCanaryFor(ctx context.Context, primary routeClaim) error {
+	c.canaries.mu.Lock()
+	cr, ok := c.canaries.routes[canaryKey(primary.host, primary.path)]
+	c.canaries.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return c.setTargets(ctx, primary, weightedTargets(primary.target, cr.target, cr.weight))
+}
+
+// setTargets updates the load balanced target list of an API, an empty list
+// disables load balancing and routes everything to the primary target
+func (c *ControlServer) setTargets(ctx context.Context, primary routeClaim, targets []string) error {
+	def, err := primary.client.GetBySlug(ctx, primary.id)
+	if err != nil {
+		return err
+	}
+
+	def.Proxy.EnableLoadBalancing = len(targets) > 0
+	def.Proxy.Targets = targets
+	if len(targets) == 0 {
+		def.Proxy.Targets = []string{}
+	}
+
+	log.Infof("setting %d load balanced targets for %s%s", len(targets), primary.host, primary.path)
+	return primary.client.UpdateAPI(ctx, &def.APIDefinition)
+}
@@ -0,0 +1,226 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DriftWarn records an event on the owner of an API that was edited or
+	// deleted in the dashboard
+	DriftWarn = "warn"
+	// DriftEnforce restores the API as well, APIs of objects that no longer
+	// exist are only reported, they are deleted by `tyk-k8s sync`
+	DriftEnforce = "enforce"
+
+	defaultDriftInterval = 5 * time.Minute
+)
+
+// DriftConfig looks for APIs created by the controller that were edited or
+// deleted in the dashboard, by comparing them with their objects like a sync
+type DriftConfig struct {
+	Mode     string        // warn or enforce, disabled if unset
+	Interval time.Duration // how often to compare, 5m if unset
+}
+
+// Validate checks the drift mode, all problems found are returned
+func (c *DriftConfig) Validate() []error {
+	errs := make([]error, 0)
+
+	switch c.Mode {
+	case "", DriftWarn, DriftEnforce:
+	default:
+		errs = append(errs, fmt.Errorf("drift.mode: unknown mode %q, must be %v or %v", c.Mode, DriftWarn, DriftEnforce))
+	}
+
+	if c.Interval < 0 {
+		errs = append(errs, fmt.Errorf("drift.interval: must not be negative"))
+	}
+
+	return errs
+}
+
+// WatchDrift compares the APIs of the watched objects with Tyk every drift
+// interval until ctx is done, see checkDrift
+func (c *ControlServer) WatchDrift(ctx context.Context, restore PodRestorer) {
+	interval := c.cfg.Drift.Interval
+	if interval <= 0 {
+		interval = defaultDriftInterval
+	}
+
+	log.Infof("checking the APIs for drift every %v (%v)", interval, c.cfg.Drift.Mode)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.checkDrift(ctx, restore); err != nil {
+				log.Errorf("failed to check the APIs for drift: %v", err)
+			}
+		}
+	}
+}
+
+// checkDrift plans a sync and reports the drifted APIs on their objects, in
+// enforce mode the APIs are restored and reported as restored instead. A
+// drift is only reported again once it was resolved in between. Orphaned
+// APIs are never deleted here, a missed watch event or a transient listing
+// gap could make a live object look gone.
+func (c *ControlServer) checkDrift(ctx context.Context, restore PodRestorer) error {
+	ops, err := c.Plan(ctx, c.client)
+	if err != nil {
+		return err
+	}
+
+	drifted := map[string]*SyncOp{}
+	for _, op := range ops {
+		key := op.Action + " " + op.Slug
+		reported := c.drifted[key] != nil && c.drifted[key].Reason == op.Reason
+		drifted[key] = op
+
+		if c.cfg.Drift.Mode == DriftEnforce && op.Action != SyncDelete {
+			if err := op.apply(ctx, restore); err != nil {
+				if !reported {
+					c.driftEvent(op, v1.EventTypeWarning, "APIRestoreFailed", fmt.Sprintf("failed to %v API %v: %v", op.Action, op.Slug, err))
+					c.markSynced(op, err, "")
+				}
+				continue
+			}
+
+			delete(drifted, key)
+			c.driftEvent(op, v1.EventTypeNormal, "APIRestored", fmt.Sprintf("%v API %v (%v)", restoredAction(op.Action), op.Slug, op.Reason))
+			c.markSynced(op, nil, "Restored")
+			continue
+		}
+
+		if reported {
+			continue
+		}
+
+		log.Warningf("API %v of %v drifted: %v", op.Slug, op.Owner, op.Reason)
+		c.driftEvent(op, v1.EventTypeWarning, "APIDrifted", fmt.Sprintf("API %v drifted in Tyk: %v", op.Slug, op.Reason))
+		c.markSynced(op, fmt.Errorf("API %v drifted in Tyk: %v", op.Slug, op.Reason), "")
+	}
+
+	// drifts fixed in between, e.g. by the owner
+	for key, op := range c.drifted {
+		if _, ok := drifted[key]; !ok {
+			c.markSynced(op, nil, "InSync")
+		}
+	}
+
+	c.drifted = drifted
+	return nil
+}
+
+func restoredAction(action string) string {
+	if action == SyncCreate {
+		return "recreated"
+	}
+
+	return "restored"
+}
+
+// driftEvent records an event on the object an API belongs to, APIs of
+// objects that no longer exist are only logged
+func (c *ControlServer) driftEvent(op *SyncOp, evType, reason, msg string) {
+	if op.ref.Name == "" || c.client == nil {
+		log.Info(msg)
+		return
+	}
+
+	now := metav1.NewTime(time.Now())
+	ev := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: strings.TrimSuffix(op.ref.Name, "-") + "-",
+			Namespace:    op.ref.Namespace,
+		},
+		InvolvedObject: op.ref,
+		Reason:         reason,
+		Message:        msg,
+		Type:           evType,
+		Source:         v1.EventSource{Component: "tyk-k8s-controller"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := c.client.CoreV1().Events(op.ref.Namespace).Create(ev); err != nil {
+		log.Warningf("failed to record the drift of %v: %v", op.Slug, err)
+	}
+}
+
+// markSynced records the Synced condition of the ingress or service of a
+// drifted API, keeping its other conditions
+func (c *ControlServer) markSynced(op *SyncOp, err error, reason string) {
+	if !c.reportsStatus() {
+		return
+	}
+
+	switch op.ref.Kind {
+	case "Ingress":
+		ing, gerr := c.getIngress(op.ref.Namespace, op.ref.Name)
+		if gerr != nil {
+			log.Warningf("failed to read ingress %v/%v: %v", op.ref.Namespace, op.ref.Name, gerr)
+			return
+		}
+		c.setIngressStatus(ing, syncedConditions(ing.Annotations, err, reason))
+	case "Service":
+		svc, gerr := c.client.CoreV1().Services(op.ref.Namespace).Get(op.ref.Name, metav1.GetOptions{})
+		if gerr != nil {
+			log.Warningf("failed to read service %v/%v: %v", op.ref.Namespace, op.ref.Name, gerr)
+			return
+		}
+		c.setServiceStatus(svc, syncedConditions(svc.Annotations, err, reason))
+	}
+}
+
+// syncedConditions are the recorded conditions of an object with Synced
+// set from the result of a drift check
+func syncedConditions(ann map[string]string, err error, reason string) conditionSet {
+	conds := conditionSet{}
+	for _, cond := range statusConditions(ann) {
+		conds[cond.Type] = cond
+	}
+	conds.set(ConditionSynced, err, reason, "Drifted")
+
+	return conds
+}
+
+// ingressRef refers to an ingress in events
+func (c *ControlServer) ingressRef(ing *netv1beta1.Ingress) v1.ObjectReference {
+	apiVersion := "extensions/v1beta1"
+	if c.isNetworkingIngress {
+		apiVersion = "networking.k8s.io/v1beta1"
+	}
+
+	return v1.ObjectReference{Kind: "Ingress", APIVersion: apiVersion, Namespace: ing.Namespace, Name: ing.Name, UID: ing.UID}
+}
+
+// getIngress reads an ingress from the API the controller watches
+func (c *ControlServer) getIngress(namespace, name string) (*netv1beta1.Ingress, error) {
+	if c.isNetworkingIngress {
+		return c.client.NetworkingV1beta1().Ingresses(namespace).Get(name, metav1.GetOptions{})
+	}
+
+	ext, err := c.client.ExtensionsV1beta1().Ingresses(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	ing, ok := convertIngress(ext)
+	if !ok {
+		return nil, fmt.Errorf("failed to convert ingress %v/%v", namespace, name)
+	}
+
+	return ing, nil
+}
@@ -0,0 +1,278 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	"go.jlucktay.dev/tyk-k8s/injector"
+)
+
+// serviceNameLabel links an EndpointSlice to its Service
+const serviceNameLabel = "kubernetes.io/service-name"
+
+// watchEndpoints keeps the target lists of mesh routes in sync with the ready
+// pods behind their services, using EndpointSlices if enabled and Endpoints otherwise
+func (c *ControlServer) watchEndpoints(factory informers.SharedInformerFactory) {
+	if c.cfg.UseEndpointSlices {
+		informer := factory.Discovery().V1alpha1().EndpointSlices()
+		c.sliceLister = informer.Lister()
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    c.handleEndpointSlice,
+			UpdateFunc: func(_, newObj interface{}) { c.handleEndpointSlice(newObj) },
+			DeleteFunc: c.handleEndpointSlice,
+		})
+		return
+	}
+
+	factory.Core().V1().Endpoints().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.handleEndpoints,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if !reflect.DeepEqual(oldObj.(*v1.Endpoints).Subsets, newObj.(*v1.Endpoints).Subsets) {
+				c.handleEndpoints(newObj)
+			}
+		},
+		DeleteFunc: c.handleEndpointsDelete,
+	})
+}
+
+func (c *ControlServer) handleEndpoints(obj interface{}) {
+	ep, ok := obj.(*v1.Endpoints)
+	if !ok {
+		log.Errorf("type not allowed for endpoints watcher: %v", reflect.TypeOf(obj))
+		return
+	}
+
+	app := c.meshAppOf(ep.Namespace, ep.Name, endpointsPods(ep))
+	if err := c.syncMeshTargets(c.context(), ep.Namespace, app, readyAddresses(ep)); err != nil {
+		log.Error(err)
+	}
+}
+
+// handleEndpointsDelete routes the mesh route of a deleted service back to
+// its service target
+func (c *ControlServer) handleEndpointsDelete(obj interface{}) {
+	ep, ok := obj.(*v1.Endpoints)
+	if !ok {
+		if tomb, isTomb := obj.(cache.DeletedFinalStateUnknown); isTomb {
+			ep, ok = tomb.Obj.(*v1.Endpoints)
+		}
+	}
+
+	if !ok {
+		log.Errorf("type not allowed for endpoints watcher: %v", reflect.TypeOf(obj))
+		return
+	}
+
+	app := c.meshAppOf(ep.Namespace, ep.Name, nil)
+	c.meshApps.Delete(ep.Namespace + "/" + ep.Name)
+	if err := c.syncMeshTargets(c.context(), ep.Namespace, app, nil); err != nil {
+		log.Error(err)
+	}
+}
+
+func (c *ControlServer) handleEndpointSlice(obj interface{}) {
+	slice, ok := obj.(*discoveryv1alpha1.EndpointSlice)
+	if !ok {
+		if tomb, isTomb := obj.(cache.DeletedFinalStateUnknown); isTomb {
+			slice, ok = tomb.Obj.(*discoveryv1alpha1.EndpointSlice)
+		}
+	}
+
+	if !ok {
+		log.Errorf("type not allowed for endpoint slice watcher: %v", reflect.TypeOf(obj))
+		return
+	}
+
+	svc := slice.Labels[serviceNameLabel]
+	if svc == "" {
+		return
+	}
+
+	// a service can be spread over several slices
+	sel := labels.SelectorFromSet(labels.Set{serviceNameLabel: svc})
+	slices, err := c.sliceLister.EndpointSlices(slice.Namespace).List(sel)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	app := c.meshAppOf(slice.Namespace, svc, slicePods(slices))
+	if len(slices) == 0 {
+		c.meshApps.Delete(slice.Namespace + "/" + svc)
+	}
+	if err := c.syncMeshTargets(c.context(), slice.Namespace, app, readySliceAddresses(slices)); err != nil {
+		log.Error(err)
+	}
+}
+
+// endpointsPods returns the names of the pods behind a service
+func endpointsPods(ep *v1.Endpoints) []string {
+	pods := make([]string, 0)
+	for _, ss := range ep.Subsets {
+		for _, addr := range append(ss.Addresses, ss.NotReadyAddresses...) {
+			if addr.TargetRef != nil && addr.TargetRef.Kind == "Pod" {
+				pods = append(pods, addr.TargetRef.Name)
+			}
+		}
+	}
+
+	return pods
+}
+
+// slicePods returns the names of the pods behind a service across slices
+func slicePods(slices []*discoveryv1alpha1.EndpointSlice) []string {
+	pods := make([]string, 0)
+	for _, s := range slices {
+		for _, e := range s.Endpoints {
+			if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+				pods = append(pods, e.TargetRef.Name)
+			}
+		}
+	}
+
+	return pods
+}
+
+// meshAppOf returns the app label of the pods of a service, which names their
+// mesh route and needn't match the name of the service. The label is
+// remembered for when the service has no pods left to look it up from,
+// services without any fall back to their own name.
+func (c *ControlServer) meshAppOf(namespace, svc string, pods []string) string {
+	key := namespace + "/" + svc
+	for _, name := range pods {
+		pod, err := c.getPod(namespace, name)
+		if err != nil {
+			continue
+		}
+
+		if app := pod.Labels["app"]; app != "" {
+			c.meshApps.Store(key, app)
+			return app
+		}
+	}
+
+	if app, ok := c.meshApps.Load(key); ok {
+		return app.(string)
+	}
+
+	return svc
+}
+
+// getPod reads a pod from the informer cache of its namespace, or from the
+// API server if it isn't watched
+func (c *ControlServer) getPod(namespace, name string) (*v1.Pod, error) {
+	factory, ok := c.factories[namespace]
+	if !ok {
+		factory, ok = c.factories[""]
+	}
+	if ok {
+		return factory.Core().V1().Pods().Lister().Pods(namespace).Get(name)
+	}
+
+	if c.client == nil {
+		return nil, fmt.Errorf("no kubernetes client to look up pod %v/%v", namespace, name)
+	}
+
+	return c.client.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+}
+
+// readyAddresses returns the sorted IPs of the ready endpoints of a service
+func readyAddresses(ep *v1.Endpoints) []string {
+	ips := make([]string, 0)
+	for _, ss := range ep.Subsets {
+		for _, addr := range ss.Addresses {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	sort.Strings(ips)
+	return ips
+}
+
+// readySliceAddresses returns the sorted IPs of the ready endpoints across slices
+func readySliceAddresses(slices []*discoveryv1alpha1.EndpointSlice) []string {
+	ips := make([]string, 0)
+	for _, s := range slices {
+		for _, e := range s.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+
+			ips = append(ips, e.Addresses...)
+		}
+	}
+
+	sort.Strings(ips)
+	return ips
+}
+
+// podTargets builds per-pod upstreams from the scheme and port of the service target
+func podTargets(serviceTarget string, ips []string) ([]string, error) {
+	u, err := url.Parse(serviceTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	port := u.Port()
+	if port == "" {
+		return nil, fmt.Errorf("target %v has no port", serviceTarget)
+	}
+
+	tgts := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		tgts = append(tgts, fmt.Sprintf("%s://%s", u.Scheme, net.JoinHostPort(ip, port)))
+	}
+
+	return tgts, nil
+}
+
+// syncMeshTargets load balances a mesh route directly across the ready pods
+// of its service, falling back to the service target when none are ready or
+// the service is gone. Mesh routes are looked up in the org of the
+// namespace, routes placed in another org by a pod annotation are not kept
+// in sync.
+func (c *ControlServer) syncMeshTargets(ctx context.Context, namespace, app string, ips []string) error {
+	org, err := c.tykClient(namespace, nil)
+	if err != nil {
+		return err
+	}
+
+	slug := injector.ResolveMeshSlug(ctx, org, namespace, app)
+	def, err := org.GetBySlug(ctx, slug)
+	if err != nil {
+		// not a meshed service
+		return nil
+	}
+
+	if strings.HasPrefix(def.Proxy.TargetURL, "https://") {
+		log.Warningf("mesh route %v uses TLS, pod IPs can't be verified against its certificate, skipping direct endpoints", slug)
+		return nil
+	}
+
+	tgts, err := podTargets(def.Proxy.TargetURL, ips)
+	if err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(tgts, def.Proxy.Targets) && def.Proxy.EnableLoadBalancing == (len(tgts) > 0) {
+		return nil
+	}
+
+	def.Proxy.EnableLoadBalancing = len(tgts) > 0
+	def.Proxy.Targets = tgts
+
+	log.Infof("updating mesh route %v with %d pod targets", slug, len(tgts))
+	return org.UpdateAPI(ctx, &def.APIDefinition)
+}
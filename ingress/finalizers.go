@@ -0,0 +1,218 @@
+package ingress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// CleanupFinalizer holds back the deletion of published objects until their
+// APIs and certificates are removed from Tyk
+const CleanupFinalizer = "tyk.io/cleanup"
+
+func hasFinalizer(obj metav1.Object) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == CleanupFinalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// finalizerPatch adds or removes the cleanup finalizer, leaving the
+// finalizers of other controllers in place
+func finalizerPatch(add bool) []byte {
+	key := "finalizers"
+	if !add {
+		key = "$deleteFromPrimitiveList/finalizers"
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{key: []string{CleanupFinalizer}},
+	})
+
+	return patch
+}
+
+// finalizing is true for objects waiting for the controller to clean up
+// after them before they are deleted
+func finalizing(obj metav1.Object) bool {
+	return obj.GetDeletionTimestamp() != nil && hasFinalizer(obj)
+}
+
+// cleanedUp is true once for objects cleaned up by their finalizer, their
+// delete events have nothing left to remove
+func (c *ControlServer) cleanedUp(obj metav1.Object) bool {
+	_, ok := c.finalized.LoadAndDelete(obj.GetUID())
+	return ok
+}
+
+func (c *ControlServer) patchIngress(ing *netv1beta1.Ingress, patch []byte) error {
+	var err error
+	if c.isNetworkingIngress {
+		_, err = c.client.NetworkingV1beta1().Ingresses(ing.Namespace).Patch(ing.Name, types.StrategicMergePatchType, patch)
+	} else {
+		_, err = c.client.ExtensionsV1beta1().Ingresses(ing.Namespace).Patch(ing.Name, types.StrategicMergePatchType, patch)
+	}
+
+	return err
+}
+
+// ensureIngressFinalizer adds the cleanup finalizer to a published ingress
+func (c *ControlServer) ensureIngressFinalizer(ing *netv1beta1.Ingress) {
+	if c.cfg == nil || !c.cfg.Finalizers || c.client == nil || hasFinalizer(ing) || ing.DeletionTimestamp != nil {
+		return
+	}
+
+	if err := c.patchIngress(ing, finalizerPatch(true)); err != nil {
+		log.Errorf("failed to add finalizer to ingress %s/%s: %v", ing.Namespace, ing.Name, err)
+	}
+}
+
+// finalizeIngress removes the APIs of an ingress being deleted, the
+// finalizer is only released once they are gone so a failure is retried
+// on the next resync
+func (c *ControlServer) finalizeIngress(ctx context.Context, ing *netv1beta1.Ingress) {
+	var err error
+	if isCanary(ing) {
+		err = c.removeCanary(ctx, ing)
+	} else {
+		err = c.doDelete(ctx, ing)
+	}
+	if err != nil {
+		log.Errorf("failed to clean up ingress %s/%s, keeping its finalizer: %v", ing.Namespace, ing.Name, err)
+		return
+	}
+
+	c.finalized.Store(ing.UID, struct{}{})
+	if err := c.patchIngress(ing, finalizerPatch(false)); err != nil {
+		log.Errorf("failed to remove finalizer from ingress %s/%s: %v", ing.Namespace, ing.Name, err)
+		return
+	}
+
+	log.Infof("cleaned up ingress %s/%s", ing.Namespace, ing.Name)
+}
+
+func (c *ControlServer) patchService(svc *v1.Service, patch []byte) error {
+	_, err := c.client.CoreV1().Services(svc.Namespace).Patch(svc.Name, types.StrategicMergePatchType, patch)
+	return err
+}
+
+// ensureServiceFinalizer adds the cleanup finalizer to a published service
+func (c *ControlServer) ensureServiceFinalizer(svc *v1.Service) {
+	if c.cfg == nil || !c.cfg.Finalizers || c.client == nil || hasFinalizer(svc) || svc.DeletionTimestamp != nil {
+		return
+	}
+
+	if err := c.patchService(svc, finalizerPatch(true)); err != nil {
+		log.Errorf("failed to add finalizer to service %s/%s: %v", svc.Namespace, svc.Name, err)
+	}
+}
+
+// finalizeService removes the API of a service being deleted before
+// releasing its finalizer
+func (c *ControlServer) finalizeService(ctx context.Context, svc *v1.Service) {
+	if err := c.unpublishService(ctx, svc); err != nil {
+		log.Errorf("failed to clean up service %s/%s, keeping its finalizer: %v", svc.Namespace, svc.Name, err)
+		return
+	}
+
+	c.finalized.Store(svc.UID, struct{}{})
+	if err := c.patchService(svc, finalizerPatch(false)); err != nil {
+		log.Errorf("failed to remove finalizer from service %s/%s: %v", svc.Namespace, svc.Name, err)
+		return
+	}
+
+	log.Infof("cleaned up service %s/%s", svc.Namespace, svc.Name)
+}
+
+// deleteAPIs removes the APIs with the given slugs and the certificates
+// only they used, APIs that are already gone are skipped
+func (c *ControlServer) deleteAPIs(ctx context.Context, org tyk.Client, slugs []string) error {
+	all, err := org.FetchAPIs(ctx)
+	if err != nil {
+		return err
+	}
+
+	want := map[string]bool{}
+	for _, slug := range slugs {
+		want[tyk.CleanSlug(slug)] = true
+	}
+
+	errs := make([]string, 0)
+	certs := map[string]bool{}
+	for i := range all {
+		def := &all[i]
+		if !want[def.Slug] {
+			continue
+		}
+
+		id := tyk.ObjectID(def)
+		if err := org.DeleteByID(ctx, id); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", def.Slug, err))
+			continue
+		}
+		log.Info("deleted: ", def.Slug)
+
+		for _, cert := range def.Certificates {
+			certs[cert] = true
+		}
+
+		c.forget(store.KindAPI, id)
+	}
+
+	if err := c.releaseCertificates(ctx, org, certs); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete APIs: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// releaseCertificates deletes the certificates no API of the org uses anymore,
+// ingresses with the same TLS secret share a certificate
+func (c *ControlServer) releaseCertificates(ctx context.Context, org tyk.Client, certs map[string]bool) error {
+	if len(certs) == 0 {
+		return nil
+	}
+
+	all, err := org.FetchAPIs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, def := range all {
+		for _, cert := range def.Certificates {
+			delete(certs, cert)
+		}
+	}
+
+	errs := make([]string, 0)
+	for cert := range certs {
+		if err := org.DeleteCertificate(ctx, cert); err != nil {
+			errs = append(errs, fmt.Sprintf("certificate %s: %v", cert, err))
+			continue
+		}
+		log.Info("deleted certificate: ", cert)
+		c.forget(store.KindCert, cert)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package ingress
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// wildcardHostVar is the mux host variable used by Tyk to match the leftmost
+// label of a wildcard host
+const wildcardHostVar = "{wildcard:[^.]+}"
+
+// ingressRoute is a single host/path pair of an ingress that maps to one API definition
+type ingressRoute struct {
+	Host string
+	Path netv1beta1.HTTPIngressPath
+	ID   string
+}
+
+// tykHostname converts an ingress host into a Tyk custom domain, wildcard
+// hosts (`*.example.com`) are turned into regex domain matches
+func tykHostname(host string) string {
+	if strings.HasPrefix(host, "*.") {
+		return wildcardHostVar + host[1:]
+	}
+
+	return host
+}
+
+// hostsOverlap checks whether two ingress hosts can match the same request,
+// an empty host matches everything
+func hostsOverlap(a, b string) bool {
+	if a == b || a == "" || b == "" {
+		return true
+	}
+
+	matchesWildcard := func(wc, h string) bool {
+		if !strings.HasPrefix(wc, "*.") {
+			return false
+		}
+
+		suffix := wc[1:]
+		if strings.HasPrefix(h, "*.") {
+			return h[1:] == suffix
+		}
+
+		return strings.HasSuffix(h, suffix) && !strings.Contains(strings.TrimSuffix(h, suffix), ".")
+	}
+
+	return matchesWildcard(a, b) || matchesWildcard(b, a)
+}
+
+// ingressRoutes fans an ingress out into its host/path routes. IDs only
+// depend on the host and path of a route, not on the order of the rules: a
+// service path served on a single host keeps the legacy (host-less) ID so
+// that existing API definitions are retained, a service path served on
+// several hosts gets a host-qualified ID for each of them. Routes colliding
+// with an earlier one, see routeCollisions, are dropped.
+func (c *ControlServer) ingressRoutes(ing *netv1beta1.Ingress) []ingressRoute {
+	routes, _ := c.fanOut(ing)
+	return routes
+}
+
+// routeCollisions returns an error naming the routes of an ingress that
+// collide with another of its routes, e.g. the same host and path listed in
+// two rules. Such ingresses are rejected rather than published in part.
+func (c *ControlServer) routeCollisions(ing *netv1beta1.Ingress) error {
+	_, collisions := c.fanOut(ing)
+	if len(collisions) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("ingress %s routes %s more than once", ingressOwner(ing), strings.Join(collisions, ", "))
+}
+
+func (c *ControlServer) fanOut(ing *netv1beta1.Ingress) ([]ingressRoute, []string) {
+	hosts := map[string]int{}
+	for _, r0 := range ing.Spec.Rules {
+		if r0.HTTP == nil {
+			continue
+		}
+
+		for _, p := range r0.HTTP.Paths {
+			hosts[c.generateIngressID(ing.Name, ing.Namespace, p)]++
+		}
+	}
+
+	routes := make([]ingressRoute, 0)
+	collisions := make([]string, 0)
+	seen := map[string]bool{}
+	for _, r0 := range ing.Spec.Rules {
+		if r0.HTTP == nil {
+			continue
+		}
+
+		for _, p := range r0.HTTP.Paths {
+			id := c.generateIngressID(ing.Name, ing.Namespace, p)
+			if hosts[id] > 1 {
+				id = c.generateIngressID(ing.Name, ing.Namespace+"."+r0.Host, p)
+			}
+
+			if seen[id] {
+				collisions = append(collisions, r0.Host+p.Path)
+				continue
+			}
+			seen[id] = true
+
+			routes = append(routes, ingressRoute{Host: r0.Host, Path: p, ID: id})
+		}
+	}
+
+	return routes, collisions
+}
+
+type routeClaim struct {
+	owner  string
+	host   string
+	path   string
+	id     string
+	target string
+	client tyk.Client
+}
+
+// routeClaims tracks which ingress owns which host/path so that two
+// ingresses can't publish overlapping routes
+type routeClaims struct {
+	mu     sync.Mutex
+	claims []routeClaim
+}
+
+func ingressOwner(ing *netv1beta1.Ingress) string {
+	return ing.Namespace + "/" + ing.Name
+}
+
+// claim registers a host/path for an owner, failing if another owner already
+// holds an overlapping route
+func (r *routeClaims) claim(rc routeClaim) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, c := range r.claims {
+		if c.path != rc.path || !hostsOverlap(c.host, rc.host) {
+			continue
+		}
+
+		if c.owner != rc.owner {
+			return fmt.Errorf("route %s%s collides with %s%s claimed by ingress %s", rc.host, rc.path, c.host, c.path, c.owner)
+		}
+
+		if c.host == rc.host {
+			// already ours, refresh the details
+			r.claims[i] = rc
+			return nil
+		}
+	}
+
+	r.claims = append(r.claims, rc)
+	return nil
+}
+
+// lookup returns the claim for an exact host/path
+func (r *routeClaims) lookup(host, path string) (routeClaim, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.claims {
+		if c.host == host && c.path == path {
+			return c, true
+		}
+	}
+
+	return routeClaim{}, false
+}
+
+// release drops all claims held by an owner
+func (r *routeClaims) release(owner string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := r.claims[:0]
+	for _, c := range r.claims {
+		if c.owner != owner {
+			kept = append(kept, c)
+		}
+	}
+
+	r.claims = kept
+}
@@ -1,11 +1,11 @@
 package ingress
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"os"
 	"reflect"
 	"strings"
 	"sync"
@@ -19,17 +19,42 @@ import (
 	"k8s.io/apimachinery/pkg/util/version"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1alpha1"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/clientcmd"
 
 	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
 	"go.jlucktay.dev/tyk-k8s/logger"
+	"go.jlucktay.dev/tyk-k8s/store"
 	"go.jlucktay.dev/tyk-k8s/tyk"
 )
 
 type Config struct {
 	WatchNamespaces []string
+	// DirectEndpoints load balances mesh routes across the ready pods of a
+	// service instead of targeting its ClusterIP
+	DirectEndpoints bool
+	// UseEndpointSlices watches EndpointSlices rather than Endpoints
+	UseEndpointSlices bool
+	// WatchServices publishes services annotated with service.tyk.io/expose
+	// through the gateway without requiring sidecar injection
+	WatchServices bool
+	// Finalizers holds back the deletion of published ingresses and services
+	// until their APIs and certificates are removed from Tyk
+	Finalizers bool
+	// Status records the conditions of published ingresses and services in
+	// status.tyk.io annotations
+	Status bool
+	// Drift looks for APIs edited or deleted in the dashboard periodically
+	Drift DriftConfig
+	// OpenAPI lists the URLs the api.tyk.io/openapi-url annotation may fetch
+	// documents from, none by default
+	OpenAPI kube.OpenAPIConfig
+}
+
+// Validate checks the controller configuration, all problems found are returned
+func (c *Config) Validate() []error {
+	return append(c.Drift.Validate(), c.OpenAPI.Validate()...)
 }
 
 var (
@@ -47,10 +72,21 @@ const (
 
 type ControlServer struct {
 	cfg                 *Config
-	client              *kubernetes.Clientset
+	client              kubernetes.Interface
 	stopCh              chan struct{}
+	ctx                 context.Context // cancelled when the controller stops, bounds the Tyk calls of the handlers
+	cancel              context.CancelFunc
 	factories           map[string]informers.SharedInformerFactory
 	isNetworkingIngress bool
+	claims              *routeClaims
+	canaries            *canaryRoutes
+	sliceLister         discoverylisters.EndpointSliceLister
+	tykClients          tyk.Resolver
+	state               store.Store
+	finalized           sync.Map           // UIDs of the objects cleaned up by their finalizer
+	specs               sync.Map           // checksums of the OpenAPI documents of the objects by owner
+	meshApps            sync.Map           // app labels of the pods of the services by namespace/name
+	drifted             map[string]*SyncOp // drifts reported by the last drift check, by action and slug
 }
 
 func init() {
@@ -81,6 +117,8 @@ func NewController() *ControlServer {
 	if ctrl == nil {
 		ctrl = &ControlServer{
 			factories: make(map[string]informers.SharedInformerFactory),
+			claims:    &routeClaims{},
+			canaries:  &canaryRoutes{routes: map[string]canaryRoute{}},
 		}
 	}
 
@@ -100,23 +138,14 @@ func (c *ControlServer) Config(cfg *Config) *ControlServer {
 	return c
 }
 
-func (c *ControlServer) getClient() (*kubernetes.Clientset, error) {
-	cfgF := os.Getenv("TYK_K8S_KUBECONF")
-	var config *rest.Config
-	var err error
-
-	if cfgF != "" {
-		config, err = clientcmd.BuildConfigFromFlags("", cfgF)
-	} else {
-		config, err = rest.InClusterConfig()
-	}
-
-	// in cluster access
-	if err != nil {
-		return nil, err
-	}
+// State sets the store the APIs and certificates of the controller are recorded in
+func (c *ControlServer) State(s store.Store) *ControlServer {
+	c.state = s
+	return c
+}
 
-	return kubernetes.NewForConfig(config)
+func (c *ControlServer) getClient() (*kubernetes.Clientset, error) {
+	return kube.Client()
 }
 
 func (c *ControlServer) Start() error {
@@ -126,11 +155,16 @@ func (c *ControlServer) Start() error {
 		return err
 	}
 	c.setNetworkingIngress()
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
 	return c.watchAll()
 }
 
 func (c *ControlServer) Stop() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+
 	if c.stopCh == nil {
 		return fmt.Errorf("not started")
 	}
@@ -143,6 +177,16 @@ func (c *ControlServer) Stop() error {
 	}
 }
 
+// context returns the context the event handlers call Tyk with, requests in
+// flight are cancelled when the controller stops
+func (c *ControlServer) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+
+	return c.ctx
+}
+
 func (c *ControlServer) getAPIName(name, service string) string {
 	v := fmt.Sprintf("%s:%s", name, service)
 	log.Info("service name is: ", v)
@@ -158,7 +202,7 @@ func (c *ControlServer) generateIngressID(ingressName, ns string, p netv1beta1.H
 	return sha
 }
 
-func (c *ControlServer) handleTLS(ing *netv1beta1.Ingress) (map[string]string, error) {
+func (c *ControlServer) handleTLS(ctx context.Context, org tyk.Client, ing *netv1beta1.Ingress) (map[string]string, error) {
 	log.Info("checking for TLS entries")
 	certMap := map[string]string{}
 	for _, iTLS := range ing.Spec.TLS {
@@ -179,11 +223,12 @@ func (c *ControlServer) handleTLS(ing *netv1beta1.Ingress) (map[string]string, e
 		}
 
 		log.Info("creating certificate")
-		id, err := tyk.CreateCertificate(crt, key)
+		id, err := org.CreateCertificate(ctx, crt, key)
 		if err != nil {
 			return nil, err
 		}
 		log.Info("certificate created with ID: ", id)
+		c.recordCert(id, ing.Annotations[tyk.OrgAnnotation], store.Owner{Kind: "Ingress", Namespace: ing.Namespace, Name: ing.Name})
 
 		// map the certificate ID to all the host-names
 		for _, n := range iTLS.Hosts {
@@ -205,59 +250,145 @@ func checkAndGetTemplate(ing *netv1beta1.Ingress) string {
 	return tyk.DefaultIngressTemplate
 }
 
-func (c *ControlServer) doAdd(ing *netv1beta1.Ingress) error {
-	tags := []string{"ingress"}
-	hName := ""
+func (c *ControlServer) routeOptions(ing *netv1beta1.Ingress, rt ingressRoute, tags []string) *tyk.APIDefOptions {
+	opts := &tyk.APIDefOptions{}
+	opts.ListenPath = rt.Path.Path
+	svcN := rt.Path.Backend.ServiceName
+	svcP := rt.Path.Backend.ServicePort.IntVal
+	opts.Name = c.getAPIName(ing.Name, svcN)
+	opts.Target = fmt.Sprintf("http://%s.%s:%d", svcN, ing.Namespace, svcP)
+	opts.Slug = rt.ID
+	opts.TemplateName = checkAndGetTemplate(ing)
+	opts.Hostname = tykHostname(rt.Host)
+	opts.Tags = tags
+	opts.Annotations = ing.Annotations
+	opts.ChangeReason = tyk.NewChangeReason("Ingress", ing.Namespace, ing.Name, string(ing.UID))
+	opts.Namespace = ing.Namespace
+	opts.Labels = ing.Labels
+	opts.ServiceName = svcN
+	opts.ServicePort = svcP
+
+	return opts
+}
+
+// tykClient returns the client to publish the APIs of an object with
+func (c *ControlServer) tykClient(namespace string, ann map[string]string) (tyk.Client, error) {
+	if c.tykClients != nil {
+		return c.tykClients(namespace, ann)
+	}
+
+	return tyk.ClientFor(namespace, ann)
+}
+
+// resolveOverrides adds the override document referenced by an object's annotations
+func (c *ControlServer) resolveOverrides(namespace string, ann map[string]string) (map[string]string, error) {
+	var client kubernetes.Interface
+	if c.client != nil {
+		client = c.client
+	}
+
+	return kube.ResolveOverrides(client, namespace, ann)
+}
+
+func (c *ControlServer) doAdd(ctx context.Context, ing *netv1beta1.Ingress) error {
+	tags := tyk.Segments(tyk.SegmentIngress, ing.Namespace, ing.Annotations)
+
+	conds := conditionSet{}
+	defer c.setIngressStatus(ing, conds)
+
+	if err := tyk.ValidateSegments(tyk.SegmentIngress, ing.Namespace, ing.Annotations); err != nil {
+		conds.set(ConditionPublished, err, "", "InvalidSegmentTags")
+		return err
+	}
 
-	certs, err := c.handleTLS(ing)
+	org, err := c.tykClient(ing.Namespace, ing.Annotations)
 	if err != nil {
+		conds.set(ConditionPublished, err, "", "NoTykClient")
 		return err
 	}
 
-	for _, r0 := range ing.Spec.Rules {
-		hName = r0.Host
-		certID, addCert := certs[hName]
-		log.Info("checking if cert for host exists: ", r0.Host, ", (", addCert, ")")
+	certs, err := c.handleTLS(ctx, org, ing)
+	if len(ing.Spec.TLS) > 0 {
+		conds.set(ConditionCertIssued, err, "CertificatesStored", "CertificateFailed")
+	}
+	if err != nil {
+		conds.set(ConditionPublished, err, "", "CertificateFailed")
+		return err
+	}
 
+	for _, r0 := range ing.Spec.Rules {
 		if r0.HTTP == nil {
-			return fmt.Errorf("rule has nil paths, can't route without explicit back end: %v", hName)
+			err := fmt.Errorf("rule has nil paths, can't route without explicit back end: %v", r0.Host)
+			conds.set(ConditionPublished, err, "", "InvalidRule")
+			return err
 		}
 
 		if len(r0.HTTP.Paths) == 0 {
-			return fmt.Errorf("rule has 0 paths, can't route without explicit back end: %v", hName)
-		}
-
-		for _, p := range r0.HTTP.Paths {
-			opts := &tyk.APIDefOptions{}
-			opts.ListenPath = p.Path
-			svcN := p.Backend.ServiceName
-			svcP := p.Backend.ServicePort.IntVal
-			opts.Name = c.getAPIName(ing.Name, svcN)
-			opts.Target = fmt.Sprintf("http://%s.%s:%d", svcN, ing.Namespace, svcP)
-			opts.Slug = c.generateIngressID(ing.Name, ing.Namespace, p)
-			opts.TemplateName = checkAndGetTemplate(ing)
-			opts.Hostname = hName
-			opts.Tags = tags
-			opts.Annotations = ing.Annotations
-
-			if addCert {
-				log.Info("injecting certificate ID")
-				opts.CertificateID = []string{certID}
-			}
+			err := fmt.Errorf("rule has 0 paths, can't route without explicit back end: %v", r0.Host)
+			conds.set(ConditionPublished, err, "", "InvalidRule")
+			return err
+		}
+	}
 
-			_, ok := opLog.Load("add" + opts.Slug)
-			if ok {
-				log.Info("ingress already processed")
-				continue
-			}
+	if err := c.routeCollisions(ing); err != nil {
+		conds.set(ConditionPublished, err, "", "RouteCollision")
+		return err
+	}
 
-			_, err := tyk.CreateService(opts)
-			if err != nil {
-				log.Error(err)
-			} else {
-				// remember we processed this
-				opLog.Store("add-"+opts.Slug, struct{}{})
-			}
+	ann, err := c.resolveOverrides(ing.Namespace, ing.Annotations)
+	if err != nil {
+		conds.set(ConditionPublished, err, "", "InvalidOverrides")
+		return err
+	}
+
+	var published []*tyk.APIDefOptions
+	var failed []string
+	defer func() {
+		c.setPublished(ctx, conds, org, published, failed)
+		c.setIngressAdopted(ing, published)
+		c.recordRoutes(ctx, org, published)
+	}()
+
+	owner := ingressOwner(ing)
+	for _, rt := range c.ingressRoutes(ing) {
+		opts := c.routeOptions(ing, rt, tags)
+		opts.Annotations = ann
+		claim := routeClaim{owner: owner, host: rt.Host, path: rt.Path.Path, id: rt.ID, target: opts.Target, client: org}
+		if err := c.claims.claim(claim); err != nil {
+			log.Error(err)
+			failed = append(failed, err.Error())
+			continue
+		}
+
+		certID, addCert := certs[rt.Host]
+		log.Info("checking if cert for host exists: ", rt.Host, ", (", addCert, ")")
+
+		if addCert {
+			log.Info("injecting certificate ID")
+			opts.CertificateID = []string{certID}
+		}
+
+		_, ok := opLog.Load("add" + opts.Slug)
+		if ok {
+			log.Info("ingress already processed")
+			published = append(published, opts)
+			continue
+		}
+
+		_, _, err := org.CreateOrGetService(ctx, opts)
+		if err != nil {
+			log.Error(err)
+			failed = append(failed, err.Error())
+			continue
+		}
+		published = append(published, opts)
+
+		// remember we processed this
+		opLog.Store("add-"+opts.Slug, struct{}{})
+
+		// a canary may have been registered before its primary route existed
+		if err := c.applyCanaryFor(ctx, claim); err != nil {
+			log.Error(err)
 		}
 	}
 
@@ -271,14 +402,35 @@ func (c *ControlServer) handleIngressAdd(obj interface{}) {
 		return
 	}
 
+	ctx := c.context()
+
+	// the finalizer outlives the ingress class, the ingress was published
+	if finalizing(ing) {
+		c.finalizeIngress(ctx, ing)
+		return
+	}
+
 	if !c.checkIngressManaged(ing) {
 		return
 	}
 
-	err := c.doAdd(ing)
+	if isCanary(ing) {
+		err := c.addCanary(ctx, ing)
+		c.setIngressStatus(ing, canaryConditions(err))
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		c.ensureIngressFinalizer(ing)
+		return
+	}
+
+	err := c.doAdd(ctx, ing)
 	if err != nil {
 		log.Error(err)
+		return
 	}
+	c.ensureIngressFinalizer(ing)
 }
 
 func (c *ControlServer) handleIngressUpdate(oldObj, newObj interface{}) {
@@ -288,60 +440,140 @@ func (c *ControlServer) handleIngressUpdate(oldObj, newObj interface{}) {
 		return
 	}
 
-	if !c.checkIngressManaged(oldIng) {
-		return
-	}
-
 	newIng, ok := convertIngress(newObj)
 	if !ok {
 		log.Errorf("type not allowed: %v", reflect.TypeOf(newIng))
 		return
 	}
 
-	if !c.checkIngressManaged(newIng) {
+	ctx := c.context()
+	if finalizing(newIng) {
+		c.finalizeIngress(ctx, newIng)
+		return
+	}
+
+	if !c.checkIngressManaged(oldIng) || !c.checkIngressManaged(newIng) {
+		return
+	}
+	c.ensureIngressFinalizer(newIng)
+
+	if !c.ingressChanged(oldIng, newIng) && !c.specChanged("Ingress "+ingressOwner(newIng), newIng.Namespace, newIng.Annotations) {
+		return
+	}
+
+	if isCanary(oldIng) || isCanary(newIng) {
+		if err := c.removeCanary(ctx, oldIng); err != nil {
+			log.Error(err)
+		}
+
+		if isCanary(newIng) {
+			err := c.addCanary(ctx, newIng)
+			c.setIngressStatus(newIng, canaryConditions(err))
+			if err != nil {
+				log.Error(err)
+			}
+			return
+		}
+
+		if err := c.doAdd(ctx, newIng); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	oldOrg, err := c.tykClient(oldIng.Namespace, oldIng.Annotations)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	org, err := c.tykClient(newIng.Namespace, newIng.Annotations)
+	if err != nil {
+		log.Error(err)
 		return
 	}
 
-	if !c.ingressChanged(oldIng, newIng) {
+	// routes can't be moved between orgs, re-create them in the new one
+	if org != oldOrg {
+		if err := c.doDelete(ctx, oldIng); err != nil {
+			log.Error(err)
+		}
+
+		if err := c.doAdd(ctx, newIng); err != nil {
+			log.Error(err)
+		}
 		return
 	}
 
-	tags := []string{"ingress"}
-	hName := ""
+	tags := tyk.Segments(tyk.SegmentIngress, newIng.Namespace, newIng.Annotations)
 	createOrUpdateList := map[string]*tyk.APIDefOptions{}
 
-	for _, r0 := range newIng.Spec.Rules {
-		hName = r0.Host
+	conds := conditionSet{}
+	defer c.setIngressStatus(newIng, conds)
+
+	if err := tyk.ValidateSegments(tyk.SegmentIngress, newIng.Namespace, newIng.Annotations); err != nil {
+		log.Error(err)
+		conds.set(ConditionPublished, err, "", "InvalidSegmentTags")
+		return
+	}
+
+	if err := c.routeCollisions(newIng); err != nil {
+		log.Error(err)
+		conds.set(ConditionPublished, err, "", "RouteCollision")
+		return
+	}
 
-		for _, p := range r0.HTTP.Paths {
-			opts := &tyk.APIDefOptions{}
-			opts.ListenPath = p.Path
-			svcN := p.Backend.ServiceName
-			svcP := p.Backend.ServicePort.IntVal
-			opts.Name = c.getAPIName(newIng.Name, svcN)
-			opts.Target = fmt.Sprintf("http://%s.%s:%d", svcN, newIng.Namespace, svcP)
-			opts.Slug = c.generateIngressID(newIng.Name, newIng.Namespace, p)
-			opts.TemplateName = checkAndGetTemplate(newIng)
-			opts.Hostname = hName
-			opts.Tags = tags
-			opts.Annotations = newIng.Annotations
+	ann, err := c.resolveOverrides(newIng.Namespace, newIng.Annotations)
+	if err != nil {
+		log.Error(err)
+		conds.set(ConditionPublished, err, "", "InvalidOverrides")
+		return
+	}
 
-			createOrUpdateList[opts.Slug] = opts
+	var published []*tyk.APIDefOptions
+	var failed []string
+	var claims []routeClaim
+	owner := ingressOwner(newIng)
+	c.claims.release(ingressOwner(oldIng))
+	for _, rt := range c.ingressRoutes(newIng) {
+		opts := c.routeOptions(newIng, rt, tags)
+		opts.Annotations = ann
+		claim := routeClaim{owner: owner, host: rt.Host, path: rt.Path.Path, id: rt.ID, target: opts.Target, client: org}
+		if err := c.claims.claim(claim); err != nil {
+			log.Error(err)
+			failed = append(failed, err.Error())
+			continue
 		}
+
+		createOrUpdateList[opts.Slug] = opts
+		published = append(published, opts)
+		claims = append(claims, claim)
 	}
 
-	err := tyk.UpdateAPIs(createOrUpdateList)
+	err = org.UpdateAPIs(ctx, createOrUpdateList)
 	if err != nil {
 		log.Error(err)
+		failed = append(failed, err.Error())
+		published = nil
 	}
 
+	// the updated definitions are re-templated without the canary targets
+	for _, claim := range claims {
+		if err := c.applyCanaryFor(ctx, claim); err != nil {
+			log.Error(err)
+		}
+	}
+	c.setPublished(ctx, conds, org, published, failed)
+	c.setIngressAdopted(newIng, published)
+	c.recordRoutes(ctx, org, published)
+
 	return
 }
 
 func (c *ControlServer) ingressChanged(old, new *netv1beta1.Ingress) bool {
 	// first check top level changes like annotations
 	// try and get out early with a simple length check
-	if len(old.Annotations) != len(new.Annotations) {
+	if len(withoutStatus(old.Annotations)) != len(withoutStatus(new.Annotations)) {
 		return true
 	}
 	// check regular string annotations
@@ -349,6 +581,20 @@ func (c *ControlServer) ingressChanged(old, new *netv1beta1.Ingress) bool {
 		if old.Annotations[k] != v && k != tyk.TemplateNameKey && strings.Contains(k, "service.tyk.io") {
 			return true
 		}
+
+		if old.Annotations[k] != v && strings.HasPrefix(k, CanaryAnnotation) {
+			return true
+		}
+
+		// OpenAPI documents, GraphQL schemas, the type of the API and its gateways
+		if old.Annotations[k] != v && (strings.HasPrefix(k, "api.tyk.io/") || k == tyk.SegmentTagsAnnotation) {
+			return true
+		}
+	}
+
+	// added or removed hosts
+	if len(new.Spec.Rules) != len(old.Spec.Rules) {
+		return true
 	}
 
 	if len(new.Spec.Rules) > 0 {
@@ -359,7 +605,7 @@ func (c *ControlServer) ingressChanged(old, new *netv1beta1.Ingress) bool {
 			hName := newRule.Host
 
 			// If hostname changed, re-create
-			if hName != old.Spec.Rules[0].Host {
+			if hName != oldRule.Host {
 				return true
 			}
 
@@ -386,20 +632,19 @@ func (c *ControlServer) ingressChanged(old, new *netv1beta1.Ingress) bool {
 	return false
 }
 
-func (c *ControlServer) doDelete(oldIng *netv1beta1.Ingress) error {
-	for _, r0 := range oldIng.Spec.Rules {
-		for _, p := range r0.HTTP.Paths {
-			sid := c.generateIngressID(oldIng.Name, oldIng.Namespace, p)
-			err := tyk.DeleteBySlug(sid)
-			if err != nil {
-				log.Error(err)
-			} else {
-				log.Info("deleted: ", sid)
-			}
-		}
+func (c *ControlServer) doDelete(ctx context.Context, oldIng *netv1beta1.Ingress) error {
+	org, err := c.tykClient(oldIng.Namespace, oldIng.Annotations)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	slugs := make([]string, 0)
+	for _, rt := range c.ingressRoutes(oldIng) {
+		slugs = append(slugs, rt.ID)
+	}
+
+	c.claims.release(ingressOwner(oldIng))
+	return c.deleteAPIs(ctx, org, slugs)
 }
 
 func (c *ControlServer) handleIngressDelete(obj interface{}) {
@@ -409,11 +654,20 @@ func (c *ControlServer) handleIngressDelete(obj interface{}) {
 		return
 	}
 
-	if !c.checkIngressManaged(ing) {
+	if !c.checkIngressManaged(ing) || c.cleanedUp(ing) {
+		return
+	}
+	c.specs.Delete("Ingress " + ingressOwner(ing))
+
+	ctx := c.context()
+	if isCanary(ing) {
+		if err := c.removeCanary(ctx, ing); err != nil {
+			log.Error(err)
+		}
 		return
 	}
 
-	err := c.doDelete(ing)
+	err := c.doDelete(ctx, ing)
 	if err != nil {
 		log.Error(err)
 	}
@@ -486,6 +740,14 @@ func (c *ControlServer) watchAll() error {
 			DeleteFunc: c.handlePodDelete,
 		})
 
+		if c.cfg.DirectEndpoints {
+			c.watchEndpoints(factory)
+		}
+
+		if c.cfg.WatchServices {
+			c.watchServices(factory)
+		}
+
 		c.factories[ns] = factory
 		factory.Start(c.stopCh)
 
@@ -499,7 +761,7 @@ func (c *ControlServer) watchAll() error {
 	return nil
 }
 
-func (c *ControlServer) handlePodDeleteForMesh(pd *v1.Pod) {
+func (c *ControlServer) handlePodDeleteForMesh(ctx context.Context, pd *v1.Pod) {
 	log.Info("pod is injector-managed")
 
 	remPds, err := c.client.CoreV1().Pods(pd.Namespace).List(metav1.ListOptions{})
@@ -534,19 +796,36 @@ func (c *ControlServer) handlePodDeleteForMesh(pd *v1.Pod) {
 		}
 	}
 
+	org, err := c.tykClient(pd.Namespace, pd.Annotations)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
 	log.Info("deleting...")
-	err = tyk.DeleteByID(serviceID)
+	err = org.DeleteByID(ctx, serviceID)
 	if err != nil {
 		log.Error("failed to remove service API: ", err)
 		return
 	}
 
-	err = tyk.DeleteByID(meshID)
+	err = org.DeleteByID(ctx, meshID)
 	if err != nil {
 		log.Error("failed to remove mesh API: ", err)
 		return
 	}
 
+	portIDs := injector.PortServiceIDs(pd)
+	for _, id := range portIDs {
+		if err := org.DeleteByID(ctx, id); err != nil {
+			log.Errorf("failed to remove port API %v: %v", id, err)
+		}
+	}
+
+	for _, id := range append([]string{serviceID, meshID}, portIDs...) {
+		c.forget(store.KindAPI, id)
+	}
+
 	log.Info("successfully removed ", serviceID, " and ", meshID)
 }
 
@@ -570,7 +849,7 @@ func (c *ControlServer) handlePodDelete(obj interface{}) {
 
 	switch v {
 	case "injected":
-		c.handlePodDeleteForMesh(pd)
+		c.handlePodDeleteForMesh(c.context(), pd)
 		return
 	default:
 		return
@@ -1,32 +1,45 @@
 package ingress
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
 	"k8s.io/api/networking/v1beta1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
 
+	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/store"
 	"go.jlucktay.dev/tyk-k8s/tyk"
 )
 
 var (
 	lastResponse string
-	running      = false
+	serverOnce   sync.Once
 )
 
 func serverSetup() {
-	if running {
-		return
-	}
+	serverOnce.Do(startEchoServer)
+}
 
+func startEchoServer() {
 	type resp struct {
 		Echo   string
 		Status string
@@ -37,7 +50,10 @@ func serverSetup() {
 			panic(err)
 		}
 
-		lastResponse = string(body)
+		// keep the last definition written, not the lookups around it
+		if len(body) > 0 {
+			lastResponse = string(body)
+		}
 
 		d := &resp{
 			Echo:   string(body),
@@ -49,9 +65,13 @@ func serverSetup() {
 		fmt.Fprintf(w, string(js))
 	})
 
-	running = true
-	http.ListenAndServe(":9696", nil)
-	running = false
+	// listen synchronously so tests don't race the server start-up
+	l, err := net.Listen("tcp", ":9696")
+	if err != nil {
+		panic(err)
+	}
+
+	go http.Serve(l, nil)
 }
 
 func TestControlServer_getAPIName(t *testing.T) {
@@ -75,7 +95,7 @@ spec:
    - host: cafe.example.com
 `
 
-	go serverSetup()
+	serverSetup()
 	x := NewController()
 
 	ing := &v1beta1.Ingress{}
@@ -90,7 +110,7 @@ spec:
 
 	tyk.Init(tykConf)
 
-	err = x.doAdd(ing)
+	err = x.doAdd(context.Background(), ing)
 	// Should fail
 	if err == nil {
 		t.Fatal(err)
@@ -100,7 +120,7 @@ spec:
 }
 
 func TestControlServer_doAdd(t *testing.T) {
-	go serverSetup()
+	serverSetup()
 	x := NewController()
 	ing := &v1beta1.Ingress{
 		ObjectMeta: v1.ObjectMeta{
@@ -138,7 +158,7 @@ func TestControlServer_doAdd(t *testing.T) {
 
 	tyk.Init(tykConf)
 
-	err := x.doAdd(ing)
+	err := x.doAdd(context.Background(), ing)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,7 +181,7 @@ func TestControlServer_doAdd(t *testing.T) {
 }
 
 func TestControlServer_UpdateAPIs(t *testing.T) {
-	go serverSetup()
+	serverSetup()
 	x := NewController()
 	ing := &v1beta1.Ingress{
 		ObjectMeta: v1.ObjectMeta{
@@ -201,7 +221,7 @@ func TestControlServer_UpdateAPIs(t *testing.T) {
 
 	tyk.Init(tykConf)
 
-	err := x.doAdd(ing)
+	err := x.doAdd(context.Background(), ing)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -284,7 +304,7 @@ func TestControlServer_UpdateAPIs(t *testing.T) {
 }
 
 func TestControlServer_doAddWithCustomTemplate(t *testing.T) {
-	go serverSetup()
+	serverSetup()
 	x := NewController()
 	ing := &v1beta1.Ingress{
 		ObjectMeta: v1.ObjectMeta{
@@ -324,7 +344,7 @@ func TestControlServer_doAddWithCustomTemplate(t *testing.T) {
 
 	tyk.Init(tykConf)
 
-	err := x.doAdd(ing)
+	err := x.doAdd(context.Background(), ing)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -663,3 +683,815 @@ func TestIngressChanged(t *testing.T) {
 		})
 	}
 }
+
+func TestTykHostname(t *testing.T) {
+	if h := tykHostname("*.example.com"); h != "{wildcard:[^.]+}.example.com" {
+		t.Fatal("wildcard host not converted, got ", h)
+	}
+
+	if h := tykHostname("foo.example.com"); h != "foo.example.com" {
+		t.Fatal("plain host should not change, got ", h)
+	}
+}
+
+func TestRouteClaims(t *testing.T) {
+	rc := &routeClaims{}
+	if err := rc.claim(routeClaim{owner: "ns/a", host: "*.example.com", path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rc.claim(routeClaim{owner: "ns/a", host: "foo.example.com", path: "/"}); err != nil {
+		t.Fatal("an ingress should not collide with itself: ", err)
+	}
+
+	if err := rc.claim(routeClaim{owner: "ns/b", host: "foo.example.com", path: "/"}); err == nil {
+		t.Fatal("expected collision with wildcard host")
+	}
+
+	if err := rc.claim(routeClaim{owner: "ns/b", host: "foo.bar.example.com", path: "/"}); err != nil {
+		t.Fatal("wildcard only covers a single label: ", err)
+	}
+
+	if err := rc.claim(routeClaim{owner: "ns/b", host: "foo.example.com", path: "/other"}); err != nil {
+		t.Fatal("different paths should not collide: ", err)
+	}
+
+	rc.release("ns/a")
+	if err := rc.claim(routeClaim{owner: "ns/b", host: "foo.example.com", path: "/"}); err != nil {
+		t.Fatal("released routes should be claimable: ", err)
+	}
+}
+
+func TestIngressRoutesMultiHost(t *testing.T) {
+	x := NewController()
+	backend := v1beta1.IngressBackend{
+		ServiceName: "foo-service",
+		ServicePort: intstr.IntOrString{IntVal: 80},
+	}
+
+	rule := func(host string) v1beta1.IngressRule {
+		return v1beta1.IngressRule{
+			Host: host,
+			IngressRuleValue: v1beta1.IngressRuleValue{
+				HTTP: &v1beta1.HTTPIngressRuleValue{
+					Paths: []v1beta1.HTTPIngressPath{{Path: "/", Backend: backend}},
+				},
+			},
+		}
+	}
+
+	ing := &v1beta1.Ingress{
+		ObjectMeta: v1.ObjectMeta{Name: "multi", Namespace: "ns"},
+		Spec: v1beta1.IngressSpec{
+			Rules: []v1beta1.IngressRule{rule("foo.com"), rule("*.bar.com")},
+		},
+	}
+
+	routes := x.ingressRoutes(ing)
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %v", len(routes))
+	}
+
+	if routes[0].ID == x.generateIngressID("multi", "ns", routes[0].Path) || routes[0].ID == routes[1].ID {
+		t.Fatal("hosts sharing a service path must get distinct host-qualified IDs")
+	}
+
+	// IDs don't depend on the order of the rules
+	ing.Spec.Rules = []v1beta1.IngressRule{rule("*.bar.com"), rule("foo.com")}
+	if swapped := x.ingressRoutes(ing); swapped[0].ID != routes[1].ID || swapped[1].ID != routes[0].ID {
+		t.Fatalf("expected the IDs to follow the hosts, got %+v and %+v", routes, swapped)
+	}
+
+	if err := x.routeCollisions(ing); err != nil {
+		t.Fatal(err)
+	}
+
+	single := &v1beta1.Ingress{
+		ObjectMeta: v1.ObjectMeta{Name: "multi", Namespace: "ns"},
+		Spec:       v1beta1.IngressSpec{Rules: []v1beta1.IngressRule{rule("foo.com")}},
+	}
+	if rts := x.ingressRoutes(single); len(rts) != 1 || rts[0].ID != x.generateIngressID("multi", "ns", rts[0].Path) {
+		t.Fatalf("a service path served on a single host should keep the legacy ID, got %+v", rts)
+	}
+
+	ing.Spec.Rules = append(ing.Spec.Rules, rule("foo.com"))
+	if rts := x.ingressRoutes(ing); len(rts) != 2 {
+		t.Fatalf("expected the duplicate route to be dropped, got %+v", rts)
+	}
+
+	if err := x.routeCollisions(ing); err == nil || !strings.Contains(err.Error(), "foo.com/") {
+		t.Fatalf("expected the duplicate route to be rejected, got %v", err)
+	}
+
+	if x.routeOptions(ing, routes[1], nil).Hostname != "{wildcard:[^.]+}.bar.com" {
+		t.Fatal("wildcard host should be converted to a regex domain")
+	}
+}
+
+func TestWeightedTargets(t *testing.T) {
+	tgts := weightedTargets("http://main", "http://canary", 20)
+	if len(tgts) != 5 {
+		t.Fatalf("expected 5 targets for a weight of 20, got %v", tgts)
+	}
+
+	canaries := 0
+	for _, tgt := range tgts {
+		if tgt == "http://canary" {
+			canaries++
+		}
+	}
+
+	if canaries != 1 {
+		t.Fatalf("expected one canary target, got %v", canaries)
+	}
+
+	if tgts := weightedTargets("http://main", "http://canary", 0); len(tgts) != 1 || tgts[0] != "http://main" {
+		t.Fatalf("a weight of 0 should only target the primary, got %v", tgts)
+	}
+
+	if tgts := weightedTargets("http://main", "http://canary", 100); len(tgts) != 1 || tgts[0] != "http://canary" {
+		t.Fatalf("a weight of 100 should only target the canary, got %v", tgts)
+	}
+}
+
+func TestCanaryWeight(t *testing.T) {
+	ing := &v1beta1.Ingress{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				CanaryAnnotation:       "true",
+				CanaryWeightAnnotation: "20",
+			},
+		},
+	}
+
+	if !isCanary(ing) {
+		t.Fatal("ingress should be detected as canary")
+	}
+
+	w, err := canaryWeight(ing)
+	if err != nil || w != 20 {
+		t.Fatalf("expected weight 20, got %v (%v)", w, err)
+	}
+
+	ing.Annotations[CanaryWeightAnnotation] = "120"
+	if _, err := canaryWeight(ing); err == nil {
+		t.Fatal("weights above 100 should be rejected")
+	}
+}
+
+func TestCanary_Updates(t *testing.T) {
+	mock := tyk.NewMockClient()
+	c := &ControlServer{
+		cfg:        &Config{},
+		claims:     &routeClaims{},
+		canaries:   &canaryRoutes{routes: map[string]canaryRoute{}},
+		tykClients: mock.Resolver(),
+	}
+
+	ingress := func(name, svc string, port int, ann map[string]string) *v1beta1.Ingress {
+		ann[IngressAnnotation] = IngressAnnotationValue
+		return &v1beta1.Ingress{
+			ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "bar", Annotations: ann},
+			Spec: v1beta1.IngressSpec{Rules: []v1beta1.IngressRule{{
+				Host: "foo.com",
+				IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{
+					Paths: []v1beta1.HTTPIngressPath{
+						{Path: "/", Backend: v1beta1.IngressBackend{ServiceName: svc, ServicePort: intstr.FromInt(port)}},
+					},
+				}},
+			}}},
+		}
+	}
+	targets := func() []string {
+		for _, def := range mock.APIs {
+			return def.Proxy.Targets
+		}
+		return nil
+	}
+
+	primary := ingress("foo", "foo", 80, map[string]string{})
+	canary := ingress("foo-canary", "foo-v2", 80, map[string]string{CanaryAnnotation: "true", CanaryWeightAnnotation: "50"})
+	c.handleIngressAdd(primary)
+	c.handleIngressAdd(canary)
+	if len(mock.APIs) != 1 || len(targets()) != 2 {
+		t.Fatalf("expected the primary API to be split with the canary, got %d APIs and %v", len(mock.APIs), targets())
+	}
+
+	// updating the primary route keeps the split
+	updated := ingress("foo", "foo", 8080, map[string]string{})
+	c.handleIngressUpdate(primary, updated)
+	if tgts := targets(); len(tgts) != 2 || tgts[0] != "http://foo.bar:8080" {
+		t.Fatalf("expected the canary to be re-applied to the updated route, got %v", tgts)
+	}
+
+	// another canary took over the route, removing the first one keeps its split
+	other := ingress("foo-other", "foo-v3", 80, map[string]string{CanaryAnnotation: "true", CanaryWeightAnnotation: "50"})
+	c.handleIngressAdd(other)
+	if err := c.removeCanary(context.Background(), canary); err != nil {
+		t.Fatal(err)
+	}
+	if tgts := targets(); len(tgts) != 2 || tgts[1] != "http://foo-v3.bar:80" {
+		t.Fatalf("expected the split of the other canary to be kept, got %v", tgts)
+	}
+}
+
+func TestControlServer_MeshTargets(t *testing.T) {
+	mock := tyk.NewMockClient()
+	if _, err := mock.CreateService(context.Background(), &tyk.APIDefOptions{Slug: "shop-mesh", Target: "http://shop.bar:8080"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the service isn't named after the app label of its pods
+	pod := &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "shop-1", Namespace: "bar", Labels: map[string]string{"app": "shop"}}}
+	c := &ControlServer{
+		cfg:        &Config{DirectEndpoints: true},
+		client:     fake.NewSimpleClientset(pod),
+		tykClients: mock.Resolver(),
+	}
+
+	ep := &corev1.Endpoints{
+		ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "bar"},
+		Subsets: []corev1.EndpointSubset{{Addresses: []corev1.EndpointAddress{
+			{IP: "10.0.0.1", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "shop-1"}},
+		}}},
+	}
+	c.handleEndpoints(ep)
+
+	def, err := mock.GetBySlug(context.Background(), "shop-mesh")
+	if err != nil || !def.Proxy.EnableLoadBalancing || len(def.Proxy.Targets) != 1 || def.Proxy.Targets[0] != "http://10.0.0.1:8080" {
+		t.Fatalf("expected the mesh route of the app to target its pod, got %+v (%v)", def, err)
+	}
+
+	// the service is gone, the route goes back to the service target
+	c.handleEndpointsDelete(cache.DeletedFinalStateUnknown{Obj: ep})
+	def, _ = mock.GetBySlug(context.Background(), "shop-mesh")
+	if def.Proxy.EnableLoadBalancing || len(def.Proxy.Targets) != 0 {
+		t.Fatalf("expected the pod targets to be removed, got %+v", def.Proxy)
+	}
+}
+
+func TestPodTargets(t *testing.T) {
+	ep := &corev1.Endpoints{
+		Subsets: []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.1"}}},
+		},
+	}
+
+	tgts, err := podTargets("http://foo.bar:8080", readyAddresses(ep))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgts) != 2 || tgts[0] != "http://10.0.0.1:8080" || tgts[1] != "http://10.0.0.2:8080" {
+		t.Fatalf("unexpected targets: %v", tgts)
+	}
+
+	notReady := false
+	slices := []*discoveryv1alpha1.EndpointSlice{
+		{Endpoints: []discoveryv1alpha1.Endpoint{
+			{Addresses: []string{"10.0.0.3"}},
+			{Addresses: []string{"10.0.0.4"}, Conditions: discoveryv1alpha1.EndpointConditions{Ready: &notReady}},
+		}},
+	}
+
+	if ips := readySliceAddresses(slices); len(ips) != 1 || ips[0] != "10.0.0.3" {
+		t.Fatalf("only ready endpoints should be used, got %v", ips)
+	}
+
+	if _, err := podTargets("http://foo.bar", nil); err == nil {
+		t.Fatal("targets without a port should fail")
+	}
+}
+
+func TestServiceOptions(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "bar",
+			Annotations: map[string]string{
+				ServiceExposeAnnotation: "true",
+				ServicePortAnnotation:   "http",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "grpc", Port: 9000}, {Name: "http", Port: 8080}},
+		},
+	}
+
+	if !isExposed(svc) {
+		t.Fatal("service should be exposed")
+	}
+
+	opts, err := serviceOptions(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Target != "http://foo.bar:8080" {
+		t.Fatal("expected named port to be used, got ", opts.Target)
+	}
+
+	if opts.ListenPath != "/bar/foo" || opts.Slug != "svc-bar-foo" {
+		t.Fatalf("unexpected listen path or slug: %v %v", opts.ListenPath, opts.Slug)
+	}
+
+	svc.Annotations[ServicePortAnnotation] = "missing"
+	if _, err := serviceOptions(svc); err == nil {
+		t.Fatal("unknown ports should fail")
+	}
+}
+
+func TestControlServer_Plan(t *testing.T) {
+	mock := tyk.NewMockClient()
+	c := &ControlServer{
+		cfg:        &Config{},
+		claims:     &routeClaims{},
+		canaries:   &canaryRoutes{routes: map[string]canaryRoute{}},
+		tykClients: mock.Resolver(),
+		state:      store.NewMemory(),
+	}
+
+	ing := &v1beta1.Ingress{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "bar",
+			Annotations: map[string]string{IngressAnnotation: IngressAnnotationValue},
+		},
+		Spec: v1beta1.IngressSpec{
+			Rules: []v1beta1.IngressRule{{
+				Host: "foo.com",
+				IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{
+					Paths: []v1beta1.HTTPIngressPath{
+						{Path: "/a", Backend: v1beta1.IngressBackend{ServiceName: "a", ServicePort: intstr.FromInt(80)}},
+						{Path: "/b", Backend: v1beta1.IngressBackend{ServiceName: "b", ServicePort: intstr.FromInt(80)}},
+					},
+				}},
+			}},
+		},
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "web-1",
+			Namespace: "bar",
+			Labels:    map[string]string{"app": "web"},
+			Annotations: map[string]string{
+				injector.AdmissionWebhookAnnotationStatusKey:           "injected",
+				injector.AdmissionWebhookAnnotationInboundServiceIDKey: "in",
+			},
+		},
+	}
+
+	ctx := context.Background()
+	routes := c.ingressRoutes(ing)
+	stale := c.routeOptions(ing, routes[0], []string{"ingress"})
+	stale.ListenPath = "/old"
+	for _, opts := range []*tyk.APIDefOptions{
+		stale,
+		{Slug: "web.bar-inbound", ChangeReason: tyk.NewChangeReason("Pod", "bar", "web-0", "")},
+		{Slug: "gone", ChangeReason: tyk.NewChangeReason("Ingress", "bar", "gone", "")},
+		{Slug: "manual"},
+		{Slug: "lost"},
+	} {
+		if _, err := mock.CreateService(ctx, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the change reason of this one was removed in the dashboard, its record is left
+	lost, _ := mock.GetBySlug(ctx, "lost")
+	if err := c.state.Put(&store.Record{Kind: store.KindAPI, ID: tyk.ObjectID(lost), Slug: "lost", Owner: store.Owner{Kind: "Ingress", Namespace: "bar", Name: "lost"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := c.Plan(ctx, fake.NewSimpleClientset(ing, pod))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, op := range ops {
+		got[op.Slug] = op.Action
+	}
+
+	want := map[string]string{
+		tyk.CleanSlug(routes[0].ID): SyncUpdate,
+		tyk.CleanSlug(routes[1].ID): SyncCreate,
+		"web.bar-mesh":              SyncCreate,
+		"gone":                      SyncDelete,
+		"lost":                      SyncDelete,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected plan %v, got %v", want, got)
+	}
+
+	var restored []string
+	err = c.Sync(ctx, ops, func(ctx context.Context, p *corev1.Pod) error {
+		restored = append(restored, p.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(restored) != 1 || restored[0] != "web-1" {
+		t.Fatalf("expected the pod routes to be restored, got %v", restored)
+	}
+
+	if _, err := mock.GetBySlug(ctx, "gone"); err == nil {
+		t.Fatal("expected the orphaned API to be deleted")
+	}
+
+	if _, err := c.state.Get(store.KindAPI, tyk.ObjectID(lost)); err != store.ErrNotFound {
+		t.Fatalf("expected the record of the deleted API to be removed, got %v", err)
+	}
+
+	if recs, _ := c.state.List(); len(recs) == 0 {
+		t.Fatal("expected the created routes to be recorded")
+	}
+
+	if _, err := mock.GetBySlug(ctx, "manual"); err != nil {
+		t.Fatal("APIs not created by the controller should be kept")
+	}
+
+	def, err := mock.GetBySlug(ctx, routes[0].ID)
+	if err != nil || def.Proxy.ListenPath != "/a" {
+		t.Fatalf("expected the listen path to be updated, got %v (%v)", def, err)
+	}
+
+	if _, err := mock.GetBySlug(ctx, routes[1].ID); err != nil {
+		t.Fatal("expected the missing route to be created")
+	}
+}
+
+func TestControlServer_Finalizers(t *testing.T) {
+	mock := tyk.NewMockClient()
+	ing := &v1beta1.Ingress{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "bar",
+			UID:         "ing-uid",
+			Annotations: map[string]string{IngressAnnotation: IngressAnnotationValue},
+		},
+		Spec: v1beta1.IngressSpec{
+			TLS: []v1beta1.IngressTLS{{Hosts: []string{"foo.com"}, SecretName: "foo-tls"}},
+			Rules: []v1beta1.IngressRule{{
+				Host: "foo.com",
+				IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{
+					Paths: []v1beta1.HTTPIngressPath{
+						{Path: "/", Backend: v1beta1.IngressBackend{ServiceName: "foo", ServicePort: intstr.FromInt(80)}},
+					},
+				}},
+			}},
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "foo-tls", Namespace: "bar"},
+		Data:       map[string][]byte{"tls.crt": []byte("crt"), "tls.key": []byte("key")},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "baz",
+			Namespace:   "bar",
+			UID:         "svc-uid",
+			Annotations: map[string]string{ServiceExposeAnnotation: "true"},
+		},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8080}}},
+	}
+
+	kc := fake.NewSimpleClientset(ing, secret, svc)
+	c := &ControlServer{
+		cfg:                 &Config{Finalizers: true},
+		client:              kc,
+		isNetworkingIngress: true,
+		claims:              &routeClaims{},
+		canaries:            &canaryRoutes{routes: map[string]canaryRoute{}},
+		tykClients:          mock.Resolver(),
+	}
+
+	c.handleIngressAdd(ing)
+	c.handleServiceAdd(svc)
+
+	if len(mock.APIs) != 2 || len(mock.Certs) != 1 {
+		t.Fatalf("expected 2 APIs and a certificate, got %d and %d", len(mock.APIs), len(mock.Certs))
+	}
+
+	published, err := kc.NetworkingV1beta1().Ingresses("bar").Get("foo", v1.GetOptions{})
+	if err != nil || !hasFinalizer(published) {
+		t.Fatalf("expected the ingress to get the finalizer, got %v (%v)", published, err)
+	}
+
+	exposed, err := kc.CoreV1().Services("bar").Get("baz", v1.GetOptions{})
+	if err != nil || !hasFinalizer(exposed) {
+		t.Fatalf("expected the service to get the finalizer, got %v (%v)", exposed, err)
+	}
+
+	// the dashboard is unavailable, the finalizers are kept
+	now := v1.Now()
+	deleting := published.DeepCopy()
+	deleting.DeletionTimestamp = &now
+	mock.Err = fmt.Errorf("unavailable")
+	c.handleIngressUpdate(published, deleting)
+
+	if kept, _ := kc.NetworkingV1beta1().Ingresses("bar").Get("foo", v1.GetOptions{}); !hasFinalizer(kept) {
+		t.Fatal("the finalizer should be kept until the APIs are removed")
+	}
+
+	mock.Err = nil
+	c.handleIngressUpdate(published, deleting)
+	c.handleIngressDelete(deleting)
+
+	if len(mock.APIs) != 1 || len(mock.Certs) != 0 {
+		t.Fatalf("expected the ingress API and its certificate to be removed, got %d and %d", len(mock.APIs), len(mock.Certs))
+	}
+
+	if released, _ := kc.NetworkingV1beta1().Ingresses("bar").Get("foo", v1.GetOptions{}); hasFinalizer(released) {
+		t.Fatal("expected the finalizer of the ingress to be removed")
+	}
+
+	deletingSvc := exposed.DeepCopy()
+	deletingSvc.DeletionTimestamp = &now
+	c.handleServiceUpdate(exposed, deletingSvc)
+
+	if len(mock.APIs) != 0 {
+		t.Fatalf("expected the service API to be removed, got %d APIs", len(mock.APIs))
+	}
+
+	if released, _ := kc.CoreV1().Services("bar").Get("baz", v1.GetOptions{}); hasFinalizer(released) {
+		t.Fatal("expected the finalizer of the service to be removed")
+	}
+}
+
+func TestControlServer_Status(t *testing.T) {
+	mock := tyk.NewMockClient()
+	ing := &v1beta1.Ingress{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "bar",
+			Annotations: map[string]string{IngressAnnotation: IngressAnnotationValue},
+		},
+		Spec: v1beta1.IngressSpec{
+			TLS: []v1beta1.IngressTLS{{Hosts: []string{"foo.com"}, SecretName: "foo-tls"}},
+			Rules: []v1beta1.IngressRule{{
+				Host: "foo.com",
+				IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{
+					Paths: []v1beta1.HTTPIngressPath{
+						{Path: "/", Backend: v1beta1.IngressBackend{ServiceName: "foo", ServicePort: intstr.FromInt(80)}},
+					},
+				}},
+			}},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "baz",
+			Namespace:   "bar",
+			Annotations: map[string]string{ServiceExposeAnnotation: "true", ServicePortAnnotation: "http"},
+		},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8080}}},
+	}
+
+	// the TLS secret is missing
+	kc := fake.NewSimpleClientset(ing, svc)
+	c := &ControlServer{
+		cfg:                 &Config{Status: true},
+		client:              kc,
+		isNetworkingIngress: true,
+		claims:              &routeClaims{},
+		canaries:            &canaryRoutes{routes: map[string]canaryRoute{}},
+		tykClients:          mock.Resolver(),
+	}
+
+	c.handleIngressAdd(ing)
+	c.handleServiceAdd(svc)
+
+	failed, _ := kc.NetworkingV1beta1().Ingresses("bar").Get("foo", v1.GetOptions{})
+	conds := statusConditions(failed.Annotations)
+	if len(conds) != 2 || conds[0].Type != ConditionCertIssued || conds[0].Status != corev1.ConditionFalse || conds[1].Reason != "CertificateFailed" {
+		t.Fatalf("expected the certificate and the publication to fail, got %+v", conds)
+	}
+	if failed.Annotations["status.tyk.io/cert-issued"] != "False" || failed.Annotations["status.tyk.io/published"] != "False" {
+		t.Fatalf("expected an annotation per condition, got %v", failed.Annotations)
+	}
+
+	unexposed, _ := kc.CoreV1().Services("bar").Get("baz", v1.GetOptions{})
+	if conds := statusConditions(unexposed.Annotations); len(conds) != 1 || conds[0].Reason != "InvalidService" {
+		t.Fatalf("expected the service with an unknown port not to be published, got %+v", conds)
+	}
+
+	if _, err := kc.CoreV1().Secrets("bar").Create(&corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "foo-tls", Namespace: "bar"},
+		Data:       map[string][]byte{"tls.crt": []byte("crt"), "tls.key": []byte("key")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.handleIngressAdd(failed)
+	published, _ := kc.NetworkingV1beta1().Ingresses("bar").Get("foo", v1.GetOptions{})
+	conds = statusConditions(published.Annotations)
+	if len(conds) != 3 {
+		t.Fatalf("expected the certificate, publication and sync conditions, got %+v", conds)
+	}
+	for _, cond := range conds {
+		if cond.Status != corev1.ConditionTrue {
+			t.Fatalf("expected the ingress to be published, got %+v", conds)
+		}
+	}
+
+	// the status annotations are not a change of the ingress
+	if c.ingressChanged(failed, published) {
+		t.Fatal("status annotations should not republish the ingress")
+	}
+
+	// publishing again records nothing new
+	if patch := statusPatch(published.Annotations, conditionSet{
+		ConditionCertIssued: {Type: ConditionCertIssued, Status: corev1.ConditionTrue, Reason: "CertificatesStored"},
+		ConditionPublished:  {Type: ConditionPublished, Status: corev1.ConditionTrue, Reason: "RoutesPublished"},
+		ConditionSynced:     {Type: ConditionSynced, Status: corev1.ConditionTrue, Reason: "InSync"},
+	}, time.Now().Add(time.Hour)); patch != nil {
+		t.Fatalf("expected the transition times to be kept, got %s", patch)
+	}
+
+	// the route was changed in the dashboard
+	def, _ := mock.GetBySlug(context.Background(), c.ingressRoutes(ing)[0].ID)
+	def.Proxy.ListenPath = "/other"
+	if err := mock.UpdateAPI(context.Background(), &def.APIDefinition); err != nil {
+		t.Fatal(err)
+	}
+	c.handleIngressAdd(published)
+	drifted, _ := kc.NetworkingV1beta1().Ingresses("bar").Get("foo", v1.GetOptions{})
+	if drifted.Annotations["status.tyk.io/synced"] != "False" {
+		t.Fatalf("expected the ingress to be out of sync, got %v", drifted.Annotations)
+	}
+
+	fixed := unexposed.DeepCopy()
+	delete(fixed.Annotations, ServicePortAnnotation)
+	c.handleServiceUpdate(unexposed, fixed)
+	exposed, _ := kc.CoreV1().Services("bar").Get("baz", v1.GetOptions{})
+	if exposed.Annotations["status.tyk.io/published"] != "True" || exposed.Annotations["status.tyk.io/synced"] != "True" {
+		t.Fatalf("expected the service to be published, got %v", exposed.Annotations)
+	}
+
+	hidden := exposed.DeepCopy()
+	hidden.Annotations[ServiceExposeAnnotation] = "false"
+	c.handleServiceUpdate(exposed, hidden)
+	if removed, _ := kc.CoreV1().Services("bar").Get("baz", v1.GetOptions{}); len(withoutStatus(removed.Annotations)) != len(removed.Annotations) {
+		t.Fatalf("expected the status of the unpublished service to be removed, got %v", removed.Annotations)
+	}
+}
+
+func TestControlServer_checkDrift(t *testing.T) {
+	mock := tyk.NewMockClient()
+	ing := &v1beta1.Ingress{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "bar",
+			Annotations: map[string]string{IngressAnnotation: IngressAnnotationValue},
+		},
+		Spec: v1beta1.IngressSpec{
+			Rules: []v1beta1.IngressRule{{
+				Host: "foo.com",
+				IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{
+					Paths: []v1beta1.HTTPIngressPath{
+						{Path: "/a", Backend: v1beta1.IngressBackend{ServiceName: "a", ServicePort: intstr.FromInt(80)}},
+					},
+				}},
+			}},
+		},
+	}
+
+	kc := fake.NewSimpleClientset(ing)
+	c := &ControlServer{
+		cfg:                 &Config{Status: true, Drift: DriftConfig{Mode: DriftWarn}},
+		client:              kc,
+		isNetworkingIngress: true,
+		claims:              &routeClaims{},
+		canaries:            &canaryRoutes{routes: map[string]canaryRoute{}},
+		tykClients:          mock.Resolver(),
+	}
+
+	ctx := context.Background()
+	c.handleIngressAdd(ing)
+	slug := c.ingressRoutes(ing)[0].ID
+
+	def, _ := mock.GetBySlug(ctx, slug)
+	def.Proxy.ListenPath = "/manual"
+	if err := mock.UpdateAPI(ctx, &def.APIDefinition); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fake client doesn't generate names, so the creations are counted
+	events := func() []*corev1.Event {
+		var evs []*corev1.Event
+		for _, a := range kc.Actions() {
+			if a.GetVerb() == "create" && a.GetResource().Resource == "events" {
+				evs = append(evs, a.(k8stesting.CreateAction).GetObject().(*corev1.Event))
+			}
+		}
+		return evs
+	}
+
+	// the drift is reported once and left in place
+	for i := 0; i < 2; i++ {
+		if err := c.checkDrift(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evs := events()
+	if len(evs) != 1 || evs[0].Reason != "APIDrifted" || evs[0].InvolvedObject.Name != "foo" {
+		t.Fatalf("expected a drift event on the ingress, got %+v", evs)
+	}
+	if def, _ := mock.GetBySlug(ctx, slug); def.Proxy.ListenPath != "/manual" {
+		t.Fatal("warn mode should not restore the API")
+	}
+	if drifted, _ := kc.NetworkingV1beta1().Ingresses("bar").Get("foo", v1.GetOptions{}); drifted.Annotations["status.tyk.io/synced"] != "False" ||
+		drifted.Annotations["status.tyk.io/published"] != "True" {
+		t.Fatalf("expected the ingress to be out of sync, got %v", drifted.Annotations)
+	}
+
+	c.cfg.Drift.Mode = DriftEnforce
+	if err := mock.DeleteBySlug(ctx, slug); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkDrift(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if def, err := mock.GetBySlug(ctx, slug); err != nil || def.Proxy.ListenPath != "/a" {
+		t.Fatalf("expected the deleted API to be recreated, got %v (%v)", def, err)
+	}
+	if evs := events(); len(evs) != 2 || evs[1].Reason != "APIRestored" {
+		t.Fatalf("expected the restore to be recorded, got %+v", evs)
+	}
+	if restored, _ := kc.NetworkingV1beta1().Ingresses("bar").Get("foo", v1.GetOptions{}); restored.Annotations["status.tyk.io/synced"] != "True" {
+		t.Fatalf("expected the ingress to be in sync again, got %v", restored.Annotations)
+	}
+
+	// edits outside the route are found by the recorded checksum, orphans
+	// are only reported
+	def, _ = mock.GetBySlug(ctx, slug)
+	def.Name = "renamed"
+	if err := mock.UpdateAPI(ctx, &def.APIDefinition); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mock.CreateService(ctx, &tyk.APIDefOptions{Slug: "gone", ChangeReason: tyk.NewChangeReason("Ingress", "bar", "gone", "")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkDrift(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if def, _ := mock.GetBySlug(ctx, slug); def.Name == "renamed" {
+		t.Fatal("expected the edited API to be restored")
+	}
+	if _, err := mock.GetBySlug(ctx, "gone"); err != nil {
+		t.Fatal("enforce mode should not delete orphaned APIs")
+	}
+	if evs := events(); len(evs) != 3 || evs[2].Reason != "APIRestored" || !strings.Contains(evs[2].Message, "edited") {
+		t.Fatalf("expected the edit to be restored, got %+v", evs)
+	}
+
+	if errs := (&Config{Drift: DriftConfig{Mode: "fix", Interval: -time.Second}}).Validate(); len(errs) != 2 {
+		t.Fatalf("expected an unknown mode and a negative interval, got %v", errs)
+	}
+}
+
+func TestControlServer_Adopt(t *testing.T) {
+	mock := tyk.NewMockClient()
+	mock.Adopt = tyk.AdoptConf{Enabled: true, Namespaces: []string{"bar"}}
+	legacy, _ := mock.CreateService(context.Background(), &tyk.APIDefOptions{Slug: "legacy", ListenPath: "/bar/baz", Target: "http://legacy"})
+
+	svc := &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "baz",
+			Namespace:   "bar",
+			Annotations: map[string]string{ServiceExposeAnnotation: "true", ServicePortAnnotation: "http", tyk.AdoptAnnotation: "true"},
+		},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+	}
+
+	kc := fake.NewSimpleClientset(svc)
+	c := &ControlServer{cfg: &Config{}, client: kc, tykClients: mock.Resolver()}
+	c.handleServiceAdd(svc)
+
+	if def := mock.APIs[legacy]; len(mock.APIs) != 1 || def.Slug != serviceSlug(svc) || def.Proxy.TargetURL != "http://legacy" {
+		t.Fatalf("expected the existing API to be adopted as it is, got %+v", mock.APIs)
+	}
+
+	adopted, _ := kc.CoreV1().Services("bar").Get("baz", v1.GetOptions{})
+	if want := fmt.Sprintf(`{"%v":"%v"}`, serviceSlug(svc), legacy); adopted.Annotations[AdoptedAPIsAnnotation] != want {
+		t.Fatalf("expected %v to record the adopted API, got %v", AdoptedAPIsAnnotation, adopted.Annotations)
+	}
+
+	if adoptedPatch(adopted.Annotations, []*tyk.APIDefOptions{{Slug: serviceSlug(svc), AdoptedID: legacy}}) != nil {
+		t.Fatal("recorded APIs should not be patched again")
+	}
+
+	if err := c.unpublishService(context.Background(), svc); err != nil {
+		t.Fatal(err)
+	}
+	if def, ok := mock.APIs[legacy]; !ok || def.Slug != "legacy" || tyk.Adopted(&def.APIDefinition) {
+		t.Fatalf("expected the adopted API to be released rather than deleted, got %+v", mock.APIs)
+	}
+}
@@ -0,0 +1,40 @@
+package ingress
+
+import (
+	"github.com/TykTechnologies/tyk/apidef"
+
+	"go.jlucktay.dev/tyk-k8s/kube"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// openAPIChecksum returns the checksum of the OpenAPI document an API was imported from
+func openAPIChecksum(def *apidef.APIDefinition) string {
+	sum, _ := def.ConfigData[tyk.OpenAPIChecksumField].(string)
+	return sum
+}
+
+// specChanged fetches the OpenAPI document of an object on resyncs, a
+// document behind a URL or in a ConfigMap changes without the object
+// changing. The first checksum seen for an object is only recorded.
+func (c *ControlServer) specChanged(owner, namespace string, ann map[string]string) bool {
+	if !kube.HasOpenAPI(ann) {
+		c.specs.Delete(owner)
+		return false
+	}
+
+	resolved, err := c.resolveOverrides(namespace, ann)
+	if err != nil {
+		log.Errorf("failed to check the OpenAPI document of %v: %v", owner, err)
+		return false
+	}
+
+	sum := kube.OpenAPIChecksum(resolved)
+	prev, seen := c.specs.Load(owner)
+	c.specs.Store(owner, sum)
+	if seen && prev != sum {
+		log.Infof("OpenAPI document of %v changed, re-importing", owner)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,245 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// ServiceExposeAnnotation publishes a plain service through the central gateway
+	ServiceExposeAnnotation = "service.tyk.io/expose"
+	// ServiceListenPathAnnotation overrides the default /<namespace>/<name> listen path
+	ServiceListenPathAnnotation = "service.tyk.io/listen-path"
+	// ServiceHostnameAnnotation sets the custom domain the API is served on
+	ServiceHostnameAnnotation = "service.tyk.io/hostname"
+	// ServicePortAnnotation selects the service port (name or number) to route to
+	ServicePortAnnotation = "service.tyk.io/port"
+)
+
+// watchServices publishes services annotated for exposure without sidecar injection
+func (c *ControlServer) watchServices(factory informers.SharedInformerFactory) {
+	factory.Core().V1().Services().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.handleServiceAdd,
+		UpdateFunc: c.handleServiceUpdate,
+		DeleteFunc: c.handleServiceDelete,
+	})
+}
+
+func isExposed(svc *v1.Service) bool {
+	switch strings.ToLower(svc.Annotations[ServiceExposeAnnotation]) {
+	case "y", "yes", "true", "on":
+		return true
+	}
+
+	return false
+}
+
+func serviceSlug(svc *v1.Service) string {
+	return fmt.Sprintf("svc-%s-%s", svc.Namespace, svc.Name)
+}
+
+func servicePort(svc *v1.Service) (int32, error) {
+	if len(svc.Spec.Ports) == 0 {
+		return 0, fmt.Errorf("service %s/%s has no ports", svc.Namespace, svc.Name)
+	}
+
+	want, ok := svc.Annotations[ServicePortAnnotation]
+	if !ok {
+		return svc.Spec.Ports[0].Port, nil
+	}
+
+	for _, p := range svc.Spec.Ports {
+		if p.Name == want || fmt.Sprint(p.Port) == want {
+			return p.Port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("service %s/%s has no port %v", svc.Namespace, svc.Name, want)
+}
+
+// serviceOptions builds the API definition options for an exposed service,
+// processor annotations on the service are applied as overrides
+func serviceOptions(svc *v1.Service) (*tyk.APIDefOptions, error) {
+	port, err := servicePort(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	listenPath := fmt.Sprintf("/%s/%s", svc.Namespace, svc.Name)
+	if lp, ok := svc.Annotations[ServiceListenPathAnnotation]; ok && lp != "" {
+		listenPath = lp
+	}
+
+	tpl := tyk.DefaultIngressTemplate
+	if t, ok := svc.Annotations[tyk.TemplateNameKey]; ok {
+		tpl = t
+	}
+
+	return &tyk.APIDefOptions{
+		Name:         fmt.Sprintf("%s.%s", svc.Name, svc.Namespace),
+		Slug:         serviceSlug(svc),
+		Target:       fmt.Sprintf("http://%s.%s:%d", svc.Name, svc.Namespace, port),
+		ListenPath:   listenPath,
+		TemplateName: tpl,
+		Hostname:     svc.Annotations[ServiceHostnameAnnotation],
+		Tags:         tyk.Segments(tyk.SegmentIngress, svc.Namespace, svc.Annotations),
+		Annotations:  svc.Annotations,
+		ChangeReason: tyk.NewChangeReason("Service", svc.Namespace, svc.Name, string(svc.UID)),
+		Namespace:    svc.Namespace,
+		Labels:       svc.Labels,
+		ServiceName:  svc.Name,
+		ServicePort:  port,
+	}, nil
+}
+
+func (c *ControlServer) publishService(ctx context.Context, svc *v1.Service) error {
+	conds := conditionSet{}
+	defer c.setServiceStatus(svc, conds)
+
+	opts, err := serviceOptions(svc)
+	if err != nil {
+		conds.set(ConditionPublished, err, "", "InvalidService")
+		return err
+	}
+
+	if err := tyk.ValidateSegments(tyk.SegmentIngress, svc.Namespace, svc.Annotations); err != nil {
+		conds.set(ConditionPublished, err, "", "InvalidSegmentTags")
+		return err
+	}
+
+	opts.Annotations, err = c.resolveOverrides(svc.Namespace, svc.Annotations)
+	if err != nil {
+		conds.set(ConditionPublished, err, "", "InvalidOverrides")
+		return err
+	}
+
+	org, err := c.tykClient(svc.Namespace, svc.Annotations)
+	if err != nil {
+		conds.set(ConditionPublished, err, "", "NoTykClient")
+		return err
+	}
+
+	log.Infof("publishing service %s/%s on %s", svc.Namespace, svc.Name, opts.ListenPath)
+	if err := org.UpdateAPIs(ctx, map[string]*tyk.APIDefOptions{opts.Slug: opts}); err != nil {
+		c.setPublished(ctx, conds, org, nil, []string{err.Error()})
+		return err
+	}
+
+	c.setPublished(ctx, conds, org, []*tyk.APIDefOptions{opts}, nil)
+	c.setServiceAdopted(svc, opts)
+	c.recordRoutes(ctx, org, []*tyk.APIDefOptions{opts})
+	return nil
+}
+
+func (c *ControlServer) handleServiceAdd(obj interface{}) {
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		log.Errorf("type not allowed for service watcher: %v", reflect.TypeOf(obj))
+		return
+	}
+
+	ctx := c.context()
+
+	// the finalizer outlives the annotation, the service was published
+	if finalizing(svc) {
+		c.finalizeService(ctx, svc)
+		return
+	}
+
+	if !isExposed(svc) {
+		return
+	}
+
+	if err := c.publishService(ctx, svc); err != nil {
+		log.Error(err)
+		return
+	}
+	c.ensureServiceFinalizer(svc)
+}
+
+func (c *ControlServer) handleServiceUpdate(oldObj, newObj interface{}) {
+	oldSvc, ok := oldObj.(*v1.Service)
+	if !ok {
+		log.Errorf("type not allowed for service watcher: %v", reflect.TypeOf(oldObj))
+		return
+	}
+
+	newSvc, ok := newObj.(*v1.Service)
+	if !ok {
+		log.Errorf("type not allowed for service watcher: %v", reflect.TypeOf(newObj))
+		return
+	}
+
+	if finalizing(newSvc) {
+		c.finalizeService(c.context(), newSvc)
+		return
+	}
+
+	owner := fmt.Sprintf("Service %s/%s", newSvc.Namespace, newSvc.Name)
+	if reflect.DeepEqual(withoutStatus(oldSvc.Annotations), withoutStatus(newSvc.Annotations)) && reflect.DeepEqual(oldSvc.Spec.Ports, newSvc.Spec.Ports) &&
+		!c.specChanged(owner, newSvc.Namespace, newSvc.Annotations) {
+		return
+	}
+
+	if isExposed(oldSvc) && !isExposed(newSvc) {
+		c.handleServiceDelete(oldSvc)
+		if hasFinalizer(newSvc) {
+			if err := c.patchService(newSvc, finalizerPatch(false)); err != nil {
+				log.Errorf("failed to remove finalizer from service %s/%s: %v", newSvc.Namespace, newSvc.Name, err)
+			}
+		}
+		if patch := clearStatusPatch(newSvc.Annotations); patch != nil && c.reportsStatus() {
+			if err := c.patchService(newSvc, patch); err != nil {
+				log.Errorf("failed to remove the status of service %s/%s: %v", newSvc.Namespace, newSvc.Name, err)
+			}
+		}
+		return
+	}
+
+	c.handleServiceAdd(newSvc)
+}
+
+func (c *ControlServer) handleServiceDelete(obj interface{}) {
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		if tomb, isTomb := obj.(cache.DeletedFinalStateUnknown); isTomb {
+			svc, ok = tomb.Obj.(*v1.Service)
+		}
+	}
+
+	if !ok {
+		log.Errorf("type not allowed for service watcher: %v", reflect.TypeOf(obj))
+		return
+	}
+
+	if !isExposed(svc) || c.cleanedUp(svc) {
+		return
+	}
+	c.specs.Delete(fmt.Sprintf("Service %s/%s", svc.Namespace, svc.Name))
+
+	if err := c.unpublishService(c.context(), svc); err != nil {
+		log.Error(err)
+	}
+}
+
+func (c *ControlServer) unpublishService(ctx context.Context, svc *v1.Service) error {
+	org, err := c.tykClient(svc.Namespace, svc.Annotations)
+	if err != nil {
+		return err
+	}
+
+	if err := c.deleteAPIs(ctx, org, []string{serviceSlug(svc)}); err != nil {
+		return err
+	}
+
+	log.Infof("removed service %s/%s from the gateway", svc.Namespace, svc.Name)
+	return nil
+}
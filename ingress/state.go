@@ -0,0 +1,97 @@
+package ingress
+
+import (
+	"context"
+
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// ownerOf is the owner recorded for the routes published with opts
+func ownerOf(opts *tyk.APIDefOptions) store.Owner {
+	if opts.ChangeReason == nil {
+		return store.Owner{Namespace: opts.Namespace}
+	}
+
+	r := opts.ChangeReason
+	return store.Owner{Kind: r.Kind, Namespace: r.Namespace, Name: r.Name}
+}
+
+// recordRoutes keeps track of the APIs published for an object in the state
+// store, if one is configured. The store is bookkeeping, failing to write to
+// it doesn't fail the publishing.
+func (c *ControlServer) recordRoutes(ctx context.Context, org tyk.Client, routes []*tyk.APIDefOptions) {
+	if c.state == nil {
+		return
+	}
+
+	for _, opts := range routes {
+		def, err := org.GetBySlug(ctx, opts.Slug)
+		if err != nil {
+			log.Warningf("failed to record API %v: %v", opts.Slug, err)
+			continue
+		}
+
+		r := &store.Record{
+			Kind:  store.KindAPI,
+			ID:    tyk.ObjectID(def),
+			Org:   opts.Annotations[tyk.OrgAnnotation],
+			Slug:  def.Slug,
+			Owner: ownerOf(opts),
+		}
+		if err := c.state.Put(r); err != nil {
+			log.Warningf("failed to record API %v of %v: %v", opts.Slug, r.Owner, err)
+		}
+	}
+}
+
+// recordCert keeps track of a certificate uploaded for an object
+func (c *ControlServer) recordCert(id, org string, owner store.Owner) {
+	if c.state == nil || id == "" {
+		return
+	}
+
+	r := &store.Record{Kind: store.KindCert, ID: id, Org: org, Owner: owner}
+	if err := c.state.Put(r); err != nil {
+		log.Warningf("failed to record certificate %v of %v: %v", id, owner, err)
+	}
+}
+
+// forget removes the record of a deleted API or certificate
+func (c *ControlServer) forget(kind, id string) {
+	if c.state == nil {
+		return
+	}
+
+	var err error
+	if kind == store.KindAPI {
+		err = store.DeleteAPI(c.state, id)
+	} else {
+		err = c.state.Delete(kind, id)
+	}
+	if err != nil {
+		log.Warningf("failed to remove %v %v from the state store: %v", kind, id, err)
+	}
+}
+
+// managedBy returns the object an API was created for, from its change
+// reason or, if that was removed in the dashboard, from its record in the
+// state store
+func (c *ControlServer) managedBy(def *objects.DBApiDefinition) (*tyk.ChangeReason, bool) {
+	if r, ok := tyk.ChangeReasonOf(&def.APIDefinition); ok {
+		return r, true
+	}
+
+	if c.state == nil {
+		return nil, false
+	}
+
+	rec, err := c.state.Get(store.KindAPI, tyk.ObjectID(def))
+	if err != nil {
+		return nil, false
+	}
+
+	return tyk.NewChangeReason(rec.Owner.Kind, rec.Owner.Namespace, rec.Owner.Name, ""), true
+}
@@ -0,0 +1,244 @@
+package ingress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// StatusAnnotationPrefix prefixes the status annotations of published
+	// objects, they are left out when looking for changes
+	StatusAnnotationPrefix = "status.tyk.io/"
+	// StatusConditionsAnnotation holds the conditions of a published object as JSON
+	StatusConditionsAnnotation = StatusAnnotationPrefix + "conditions"
+
+	// ConditionPublished is true once Tyk accepted every route of the object
+	ConditionPublished = "Published"
+	// ConditionCertIssued is true once the certificates of the TLS secrets
+	// of an ingress are in the certificate store, ingresses without TLS and
+	// services don't have it
+	ConditionCertIssued = "CertIssued"
+	// ConditionSynced is true while the routes in Tyk match the object
+	ConditionSynced = "Synced"
+)
+
+// Condition is the state of an aspect of the publication of an object, in
+// the shape of the conditions of the status of Kubernetes resources
+type Condition struct {
+	Type               string             `json:"type"`
+	Status             v1.ConditionStatus `json:"status"`
+	Reason             string             `json:"reason,omitempty"`
+	Message            string             `json:"message,omitempty"`
+	LastTransitionTime metav1.Time        `json:"lastTransitionTime"`
+}
+
+// conditionAnnotation is the annotation holding the status of a condition on
+// its own, e.g. status.tyk.io/cert-issued, so it can be shown as a column
+func conditionAnnotation(t string) string {
+	var b strings.Builder
+	for i, r := range t {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('-')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+
+	return StatusAnnotationPrefix + b.String()
+}
+
+// withoutStatus returns the annotations of an object without the status
+// annotations written by the controller
+func withoutStatus(ann map[string]string) map[string]string {
+	out := make(map[string]string, len(ann))
+	for k, v := range ann {
+		if !strings.HasPrefix(k, StatusAnnotationPrefix) {
+			out[k] = v
+		}
+	}
+
+	return out
+}
+
+// statusConditions returns the conditions recorded on an object
+func statusConditions(ann map[string]string) []Condition {
+	var conds []Condition
+	if raw, ok := ann[StatusConditionsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(raw), &conds); err != nil {
+			log.Warningf("ignoring invalid %v annotation: %v", StatusConditionsAnnotation, err)
+			return nil
+		}
+	}
+
+	return conds
+}
+
+// conditionSet collects the conditions of an object while it is published
+type conditionSet map[string]Condition
+
+func (s conditionSet) set(t string, err error, reason, failReason string) {
+	c := Condition{Type: t, Status: v1.ConditionTrue, Reason: reason}
+	if err != nil {
+		c.Status = v1.ConditionFalse
+		c.Reason = failReason
+		c.Message = err.Error()
+	}
+	s[t] = c
+}
+
+// merge returns the conditions sorted by type, conditions keep the time of
+// their last transition unless their status changed
+func (s conditionSet) merge(old []Condition, now time.Time) []Condition {
+	prev := map[string]Condition{}
+	for _, c := range old {
+		prev[c.Type] = c
+	}
+
+	conds := make([]Condition, 0, len(s))
+	for _, c := range s {
+		c.LastTransitionTime = metav1.NewTime(now.Truncate(time.Second))
+		if p, ok := prev[c.Type]; ok && p.Status == c.Status {
+			c.LastTransitionTime = p.LastTransitionTime
+		}
+		conds = append(conds, c)
+	}
+
+	sort.Slice(conds, func(i, j int) bool { return conds[i].Type < conds[j].Type })
+	return conds
+}
+
+// statusPatch returns the patch recording conditions on an object, or nil
+// if they are already recorded. Annotations of conditions that no longer
+// apply are removed.
+func statusPatch(ann map[string]string, set conditionSet, now time.Time) []byte {
+	old := statusConditions(ann)
+	conds := set.merge(old, now)
+	if reflect.DeepEqual(old, conds) {
+		return nil
+	}
+
+	raw, _ := json.Marshal(conds)
+	updates := map[string]interface{}{StatusConditionsAnnotation: string(raw)}
+	for _, c := range old {
+		updates[conditionAnnotation(c.Type)] = nil
+	}
+	for _, c := range conds {
+		updates[conditionAnnotation(c.Type)] = string(c.Status)
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": updates},
+	})
+
+	return patch
+}
+
+// clearStatusPatch returns the patch removing the status annotations of an
+// object that is no longer published, or nil if it has none
+func clearStatusPatch(ann map[string]string) []byte {
+	updates := map[string]interface{}{}
+	for k := range ann {
+		if strings.HasPrefix(k, StatusAnnotationPrefix) {
+			updates[k] = nil
+		}
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": updates},
+	})
+
+	return patch
+}
+
+// reportsStatus is true if the controller records conditions on objects
+func (c *ControlServer) reportsStatus() bool {
+	return c.cfg != nil && c.cfg.Status && c.client != nil
+}
+
+// setIngressStatus records the conditions of a published ingress
+func (c *ControlServer) setIngressStatus(ing *netv1beta1.Ingress, set conditionSet) {
+	if !c.reportsStatus() || ing.DeletionTimestamp != nil {
+		return
+	}
+
+	patch := statusPatch(ing.Annotations, set, time.Now())
+	if patch == nil {
+		return
+	}
+
+	if err := c.patchIngress(ing, patch); err != nil {
+		log.Errorf("failed to record the status of ingress %s/%s: %v", ing.Namespace, ing.Name, err)
+	}
+}
+
+// setServiceStatus records the conditions of a published service
+func (c *ControlServer) setServiceStatus(svc *v1.Service, set conditionSet) {
+	if !c.reportsStatus() || svc.DeletionTimestamp != nil {
+		return
+	}
+
+	patch := statusPatch(svc.Annotations, set, time.Now())
+	if patch == nil {
+		return
+	}
+
+	if err := c.patchService(svc, patch); err != nil {
+		log.Errorf("failed to record the status of service %s/%s: %v", svc.Namespace, svc.Name, err)
+	}
+}
+
+// setPublished sets the Published condition from the routes published and
+// failed, and Synced from the routes found in Tyk
+func (c *ControlServer) setPublished(ctx context.Context, conds conditionSet, org tyk.Client, published []*tyk.APIDefOptions, failed []string) {
+	var err error
+	if len(failed) > 0 {
+		err = fmt.Errorf("%d of %d routes failed: %v", len(failed), len(failed)+len(published), strings.Join(failed, "; "))
+	}
+	conds.set(ConditionPublished, err, "RoutesPublished", "RouteFailed")
+
+	if len(published) > 0 && c.reportsStatus() {
+		conds.set(ConditionSynced, checkRoutes(ctx, org, published), "InSync", "OutOfSync")
+	}
+}
+
+// canaryConditions are the conditions of a canary ingress, which shifts
+// traffic of the routes of its primary rather than publishing its own
+func canaryConditions(err error) conditionSet {
+	conds := conditionSet{}
+	conds.set(ConditionPublished, err, "CanaryApplied", "CanaryFailed")
+	return conds
+}
+
+// checkRoutes verifies Tyk has the routes of an object with the listen path
+// and hostname they were published with
+func checkRoutes(ctx context.Context, org tyk.Client, routes []*tyk.APIDefOptions) error {
+	for _, opts := range routes {
+		def, err := org.GetBySlug(ctx, opts.Slug)
+		if err != nil {
+			return fmt.Errorf("route %v not found: %w", opts.Slug, err)
+		}
+
+		if def.Proxy.ListenPath != opts.ListenPath || def.Domain != opts.Hostname {
+			return fmt.Errorf("route %v serves %v%v instead of %v%v", opts.Slug, def.Domain, def.Proxy.ListenPath, opts.Hostname, opts.ListenPath)
+		}
+	}
+
+	return nil
+}
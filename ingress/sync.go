@@ -0,0 +1,434 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/injector"
+	"go.jlucktay.dev/tyk-k8s/kube"
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// Changes made by a sync
+	SyncCreate = "create"
+	SyncUpdate = "update"
+	SyncDelete = "delete"
+)
+
+// SyncOp is a change to the APIs of an organisation that converges them with the cluster
+type SyncOp struct {
+	Action string
+	Slug   string
+	Owner  string // kind namespace/name of the object the route belongs to
+	Reason string
+
+	client tyk.Client
+	opts   *tyk.APIDefOptions
+	pod    *v1.Pod            // injected pod to restore the routes of
+	id     string             // object ID of an API to delete
+	ref    v1.ObjectReference // object the route belongs to, empty for deletes
+}
+
+func (o *SyncOp) String() string {
+	return fmt.Sprintf("%-6s %s (%s): %s", o.Action, o.Slug, o.Owner, o.Reason)
+}
+
+// PodRestorer recreates the routes of an injected pod
+type PodRestorer func(context.Context, *v1.Pod) error
+
+// desiredRoute is an API that should exist for a managed object
+type desiredRoute struct {
+	owner string
+	ref   v1.ObjectReference
+	opts  *tyk.APIDefOptions
+	pod   *v1.Pod
+}
+
+// syncScope holds the desired routes of every organisation
+type syncScope struct {
+	clients []tyk.Client
+	routes  map[tyk.Client]map[string]*desiredRoute
+}
+
+func (s *syncScope) add(cl tyk.Client, slug string, rt *desiredRoute) {
+	if _, ok := s.routes[cl]; !ok {
+		s.clients = append(s.clients, cl)
+		s.routes[cl] = map[string]*desiredRoute{}
+	}
+
+	s.routes[cl][tyk.CleanSlug(slug)] = rt
+}
+
+// Plan lists the ingresses, exposed services and injected pods in the watched
+// namespaces and compares their routes with the APIs of their organisations.
+// APIs created by the controller for objects that no longer exist are deleted,
+// they are recognised by their change reason or their record in the state
+// store.
+// Besides their route and tags, APIs are compared with the checksum recorded
+// when they were templated, targets and certificates are left alone as the
+// controller changes them at runtime.
+func (c *ControlServer) Plan(ctx context.Context, kc kubernetes.Interface) ([]*SyncOp, error) {
+	scope := &syncScope{routes: map[tyk.Client]map[string]*desiredRoute{}}
+
+	namespaces := c.cfg.WatchNamespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{v1.NamespaceAll}
+	}
+
+	for _, ns := range namespaces {
+		if err := c.desiredIngressRoutes(kc, ns, scope); err != nil {
+			return nil, err
+		}
+
+		if c.cfg.WatchServices {
+			if err := c.desiredServiceRoutes(kc, ns, scope); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := c.desiredPodRoutes(ctx, kc, ns, scope); err != nil {
+			return nil, err
+		}
+	}
+
+	// orphans may be left in the default org even if no object maps to it
+	def, err := c.tykClient("", nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := scope.routes[def]; !ok {
+		scope.clients = append(scope.clients, def)
+		scope.routes[def] = map[string]*desiredRoute{}
+	}
+
+	ops := make([]*SyncOp, 0)
+	for _, cl := range scope.clients {
+		clOps, err := c.planClient(ctx, cl, scope.routes[cl], namespaces)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, clOps...)
+	}
+
+	sort.SliceStable(ops, func(i, j int) bool {
+		if ops[i].Action != ops[j].Action {
+			return ops[i].Action < ops[j].Action
+		}
+		return ops[i].Slug < ops[j].Slug
+	})
+
+	return ops, nil
+}
+
+func (c *ControlServer) planClient(ctx context.Context, cl tyk.Client, desired map[string]*desiredRoute, namespaces []string) ([]*SyncOp, error) {
+	apis, err := cl.FetchAPIs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := make([]*SyncOp, 0)
+	existing := map[string]bool{}
+	for i := range apis {
+		api := &apis[i]
+		existing[api.Slug] = true
+
+		rt, ok := desired[api.Slug]
+		if !ok {
+			r, managed := c.managedBy(api)
+			if !managed || !c.syncManaged(r, namespaces) {
+				continue
+			}
+
+			reason := "object no longer exists"
+			if tyk.Adopted(&api.APIDefinition) {
+				reason += ", releasing the adopted API"
+			}
+
+			ops = append(ops, &SyncOp{
+				Action: SyncDelete,
+				Slug:   api.Slug,
+				Owner:  fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name),
+				Reason: reason,
+				client: cl,
+				id:     tyk.ObjectID(api),
+			})
+			continue
+		}
+
+		// adopted APIs keep the definition they were created with
+		if rt.opts == nil || tyk.Adopted(&api.APIDefinition) {
+			continue
+		}
+
+		reason := ""
+		switch {
+		case api.Proxy.ListenPath != rt.opts.ListenPath:
+			reason = fmt.Sprintf("listen path %q, want %q", api.Proxy.ListenPath, rt.opts.ListenPath)
+		case api.Domain != rt.opts.Hostname:
+			reason = fmt.Sprintf("domain %q, want %q", api.Domain, rt.opts.Hostname)
+		case openAPIChecksum(&api.APIDefinition) != kube.OpenAPIChecksum(rt.opts.Annotations):
+			reason = "OpenAPI document changed"
+		case !sameTags(api.Tags, rt.opts.Tags):
+			reason = fmt.Sprintf("gateway tags %v, want %v", api.Tags, rt.opts.Tags)
+		case tyk.Edited(&api.APIDefinition):
+			reason = "definition edited in Tyk"
+		}
+
+		if reason != "" {
+			ops = append(ops, &SyncOp{Action: SyncUpdate, Slug: api.Slug, Owner: rt.owner, Reason: reason, client: cl, opts: rt.opts, ref: rt.ref})
+		}
+	}
+
+	restored := map[*v1.Pod]bool{}
+	for slug, rt := range desired {
+		if existing[slug] {
+			continue
+		}
+
+		if rt.pod != nil {
+			// the inbound and mesh routes of a pod are restored together
+			if restored[rt.pod] {
+				continue
+			}
+			restored[rt.pod] = true
+		}
+
+		ops = append(ops, &SyncOp{Action: SyncCreate, Slug: slug, Owner: rt.owner, Reason: "missing", client: cl, opts: rt.opts, pod: rt.pod, ref: rt.ref})
+	}
+
+	return ops, nil
+}
+
+// sameTags compares gateway tags regardless of their order
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	seen := map[string]int{}
+	for _, t := range a {
+		seen[t]++
+	}
+	for _, t := range b {
+		if seen[t]--; seen[t] < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// syncManaged checks if the object an API was created for is reconciled by a sync
+func (c *ControlServer) syncManaged(r *tyk.ChangeReason, namespaces []string) bool {
+	switch r.Kind {
+	case "Ingress", "Pod":
+	case "Service":
+		if !c.cfg.WatchServices {
+			return false
+		}
+	default:
+		return false
+	}
+
+	for _, ns := range namespaces {
+		if ns == v1.NamespaceAll || ns == r.Namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listIngresses lists the ingresses of a namespace from the networking API,
+// falling back to the deprecated extensions API on older clusters
+func listIngresses(kc kubernetes.Interface, ns string) ([]*netv1beta1.Ingress, error) {
+	res := make([]*netv1beta1.Ingress, 0)
+
+	list, err := kc.NetworkingV1beta1().Ingresses(ns).List(metav1.ListOptions{})
+	if err == nil {
+		for i := range list.Items {
+			res = append(res, &list.Items[i])
+		}
+		return res, nil
+	}
+
+	extList, extErr := kc.ExtensionsV1beta1().Ingresses(ns).List(metav1.ListOptions{})
+	if extErr != nil {
+		return nil, err
+	}
+
+	for i := range extList.Items {
+		if ing, ok := convertIngress(&extList.Items[i]); ok {
+			res = append(res, ing)
+		}
+	}
+
+	return res, nil
+}
+
+func (c *ControlServer) desiredIngressRoutes(kc kubernetes.Interface, ns string, scope *syncScope) error {
+	ings, err := listIngresses(kc, ns)
+	if err != nil {
+		return err
+	}
+
+	for _, ing := range ings {
+		// canaries only change the targets of their primary routes
+		if !c.checkIngressManaged(ing) || isCanary(ing) {
+			continue
+		}
+
+		cl, err := c.tykClient(ing.Namespace, ing.Annotations)
+		if err != nil {
+			return err
+		}
+
+		// the routes of a rejected ingress are still kept, they were published before
+		if err := c.routeCollisions(ing); err != nil {
+			log.Warning(err)
+		}
+
+		ann, err := kube.ResolveOverrides(kc, ing.Namespace, ing.Annotations)
+		if err != nil {
+			log.Errorf("skipping ingress %v: %v", ingressOwner(ing), err)
+			continue
+		}
+
+		for _, rt := range c.ingressRoutes(ing) {
+			opts := c.routeOptions(ing, rt, tyk.Segments(tyk.SegmentIngress, ing.Namespace, ing.Annotations))
+			opts.Annotations = ann
+			scope.add(cl, opts.Slug, &desiredRoute{owner: "Ingress " + ingressOwner(ing), ref: c.ingressRef(ing), opts: opts})
+		}
+	}
+
+	return nil
+}
+
+func (c *ControlServer) desiredServiceRoutes(kc kubernetes.Interface, ns string, scope *syncScope) error {
+	svcs, err := kc.CoreV1().Services(ns).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		if !isExposed(svc) {
+			continue
+		}
+
+		opts, err := serviceOptions(svc)
+		if err == nil {
+			opts.Annotations, err = kube.ResolveOverrides(kc, svc.Namespace, svc.Annotations)
+		}
+		if err != nil {
+			log.Errorf("skipping service %s/%s: %v", svc.Namespace, svc.Name, err)
+			continue
+		}
+
+		cl, err := c.tykClient(svc.Namespace, svc.Annotations)
+		if err != nil {
+			return err
+		}
+
+		ref := v1.ObjectReference{Kind: "Service", APIVersion: "v1", Namespace: svc.Namespace, Name: svc.Name, UID: svc.UID}
+		scope.add(cl, opts.Slug, &desiredRoute{owner: fmt.Sprintf("Service %s/%s", svc.Namespace, svc.Name), ref: ref, opts: opts})
+	}
+
+	return nil
+}
+
+func (c *ControlServer) desiredPodRoutes(ctx context.Context, kc kubernetes.Interface, ns string, scope *syncScope) error {
+	pods, err := kc.CoreV1().Pods(ns).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		app, ok := pod.Labels["app"]
+		if !ok || pod.Annotations[injector.AdmissionWebhookAnnotationStatusKey] != "injected" {
+			continue
+		}
+
+		// routes are only created for pods admitted with route creation enabled
+		if _, ok := pod.Annotations[injector.AdmissionWebhookAnnotationInboundServiceIDKey]; !ok {
+			continue
+		}
+
+		cl, err := c.tykClient(pod.Namespace, pod.Annotations)
+		if err != nil {
+			return err
+		}
+
+		owner := fmt.Sprintf("Pod %s/%s", pod.Namespace, pod.Name)
+		ref := v1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID}
+		slugs := append([]string{injector.InboundSlug(pod.Namespace, app), injector.ResolveMeshSlug(ctx, cl, pod.Namespace, app)}, injector.PortSlugs(ctx, cl, pod)...)
+		slugs = append(slugs, injector.ReplicaSlugs(ctx, cl, pod)...)
+		for _, slug := range slugs {
+			if _, ok := scope.routes[cl][tyk.CleanSlug(slug)]; ok {
+				continue
+			}
+			scope.add(cl, slug, &desiredRoute{owner: owner, ref: ref, pod: pod})
+		}
+	}
+
+	return nil
+}
+
+// Sync applies the changes of a plan, restoring the routes of injected pods
+// with restore. Every change is attempted, the first error is returned.
+func (c *ControlServer) Sync(ctx context.Context, ops []*SyncOp, restore PodRestorer) error {
+	var firstErr error
+	for _, op := range ops {
+		err := op.apply(ctx, restore)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case op.Action == SyncDelete:
+			c.forget(store.KindAPI, op.id)
+		case op.pod == nil:
+			c.recordRoutes(ctx, op.client, []*tyk.APIDefOptions{op.opts})
+		}
+	}
+
+	return firstErr
+}
+
+// apply makes the change of an op, restoring the routes of injected pods with restore
+func (o *SyncOp) apply(ctx context.Context, restore PodRestorer) error {
+	var err error
+	switch {
+	case o.Action == SyncDelete:
+		err = o.client.DeleteByID(ctx, o.id)
+	case o.pod != nil:
+		if restore == nil {
+			err = fmt.Errorf("can't restore pod routes without the injector")
+			break
+		}
+		err = restore(ctx, o.pod)
+	default:
+		err = o.client.UpdateAPIs(ctx, map[string]*tyk.APIDefOptions{o.opts.Slug: o.opts})
+	}
+
+	if err != nil {
+		err = fmt.Errorf("failed to %s %v: %w", o.Action, o.Slug, err)
+		log.Error(err)
+		return err
+	}
+
+	log.Infof("%sd %v", o.Action, o.Slug)
+	return nil
+}
@@ -0,0 +1,245 @@
+package injector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// Default paths of the admission endpoints
+const (
+	DefaultInjectPath     = "/inject"
+	DefaultPodPath        = "/inject/pod"
+	DefaultServicePath    = "/inject/service"
+	DefaultValidationPath = "/validate"
+)
+
+// WebhookPaths sets the paths the admission endpoints are served on, so that
+// webhook configurations can give each its own rules and failure policy
+type WebhookPaths struct {
+	Inject     string `yaml:"inject"`     // mutates pods, services and workloads, /inject if unset
+	Pod        string `yaml:"pod"`        // mutates pods and workloads, /inject/pod if unset
+	Service    string `yaml:"service"`    // mutates services, /inject/service if unset
+	Validation string `yaml:"validation"` // rejects objects with invalid injector annotations, /validate if unset
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// paths returns the configured paths by endpoint name
+func (p *WebhookPaths) paths() map[string]string {
+	return map[string]string{
+		"inject":     orDefault(p.Inject, DefaultInjectPath),
+		"pod":        orDefault(p.Pod, DefaultPodPath),
+		"service":    orDefault(p.Service, DefaultServicePath),
+		"validation": orDefault(p.Validation, DefaultValidationPath),
+	}
+}
+
+// Validate checks the paths are absolute and distinct
+func (p *WebhookPaths) Validate() []error {
+	errs := make([]error, 0)
+	seen := map[string]string{}
+	for _, name := range []string{"inject", "pod", "service", "validation"} {
+		path := p.paths()[name]
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("webhookPaths.%v: %q must start with /", name, path))
+		}
+		if other, ok := seen[path]; ok {
+			errs = append(errs, fmt.Errorf("webhookPaths.%v: %q is already used by %v", name, path, other))
+		}
+		seen[path] = name
+	}
+
+	return errs
+}
+
+// AdmissionRoutes returns the admission endpoints by path
+func (whsvr *WebhookServer) AdmissionRoutes() map[string]http.HandlerFunc {
+	p := whsvr.SidecarConfig.WebhookPaths.paths()
+	return map[string]http.HandlerFunc{
+		p["inject"]:     whsvr.Serve,
+		p["pod"]:        whsvr.ServePod,
+		p["service"]:    whsvr.ServeService,
+		p["validation"]: whsvr.ServeValidate,
+	}
+}
+
+// ServePod mutates pods and the pod templates of workloads
+func (whsvr *WebhookServer) ServePod(w http.ResponseWriter, r *http.Request) {
+	whsvr.serveAdmission(w, r, func(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+		req := ar.Request
+		if _, ok := workloadTemplates[req.Kind.Group+"/"+req.Kind.Kind]; !ok && (req.Kind.Group != "" || req.Kind.Kind != "Pod") {
+			return unsupportedKind(req, "pods and workloads")
+		}
+		return whsvr.mutate(ctx, ar)
+	})
+}
+
+// ServeService mutates services
+func (whsvr *WebhookServer) ServeService(w http.ResponseWriter, r *http.Request) {
+	whsvr.serveAdmission(w, r, func(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+		req := ar.Request
+		if req.Kind.Group != "" || req.Kind.Kind != "Service" {
+			return unsupportedKind(req, "services")
+		}
+		return whsvr.processServiceMutations(ctx, ar)
+	})
+}
+
+// ServeValidate rejects pods and services whose injector annotations are
+// invalid, without side effects, so mistakes are reported even by a webhook
+// that fails open
+func (whsvr *WebhookServer) ServeValidate(w http.ResponseWriter, r *http.Request) {
+	whsvr.serveAdmission(w, r, whsvr.validate)
+}
+
+func unsupportedKind(req *v1beta1.AdmissionRequest, supported string) *v1beta1.AdmissionResponse {
+	return badRequest(fmt.Errorf("type %v not supported, this endpoint only admits %v", req.Kind.Kind, supported))
+}
+
+func (whsvr *WebhookServer) validate(_ context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	req := ar.Request
+	for _, ns := range ignoredNamespaces {
+		if req.Namespace == ns {
+			return &v1beta1.AdmissionResponse{Allowed: true}
+		}
+	}
+
+	var errs []error
+	switch {
+	case req.Kind.Group == "" && req.Kind.Kind == "Pod":
+		pod := &corev1.Pod{}
+		if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+			return badRequest(err)
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = req.Namespace
+		}
+		errs = whsvr.validatePod(pod)
+	case req.Kind.Group == "" && req.Kind.Kind == "Service":
+		svc := &corev1.Service{}
+		if err := json.Unmarshal(req.Object.Raw, svc); err != nil {
+			return badRequest(err)
+		}
+		errs = validateAnnotations(svc.Annotations)
+	default:
+		return unsupportedKind(req, "pods and services")
+	}
+
+	if len(errs) == 0 {
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	log.Infof("rejected %v %v/%v: %v", req.Kind.Kind, req.Namespace, req.Name, strings.Join(msgs, "; "))
+
+	return deny(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, strings.Join(msgs, "; "))
+}
+
+// validateAnnotations checks the injector annotations pods and services share
+func validateAnnotations(ann map[string]string) []error {
+	errs := make([]error, 0)
+
+	if v, ok := ann[AdmissionWebhookAnnotationInjectKey]; ok {
+		switch strings.ToLower(v) {
+		case "y", "yes", "true", "on", "n", "no", "false", "off", AdmissionWebhookInjectNever:
+		default:
+			errs = append(errs, fmt.Errorf("%v: unknown value %q, must be true, false or %v", AdmissionWebhookAnnotationInjectKey, v, AdmissionWebhookInjectNever))
+		}
+	}
+
+	if v, ok := ann[AdmissionWebhookAnnotationFailurePolicyKey]; ok {
+		switch strings.ToLower(v) {
+		case FailurePolicyOpen, FailurePolicyClosed:
+		default:
+			errs = append(errs, fmt.Errorf("%v: unknown policy %q, must be %v or %v", AdmissionWebhookAnnotationFailurePolicyKey, v, FailurePolicyOpen, FailurePolicyClosed))
+		}
+	}
+
+	return errs
+}
+
+// injecting reports whether a pod is or will be injected. Validating
+// webhooks see pods after the mutating ones, so pods the injector has
+// already injected are checked too.
+func injecting(meta *metav1.ObjectMeta) bool {
+	if mutationRequired(ignoredNamespaces, meta) {
+		return true
+	}
+
+	switch strings.ToLower(meta.Annotations[AdmissionWebhookAnnotationStatusKey]) {
+	case "injected", StatusOfflineInjected:
+		return true
+	}
+
+	return false
+}
+
+// validatePod checks the annotations of a pod that would fail its injection,
+// pods that aren't injected are only checked for invalid injector settings
+func (whsvr *WebhookServer) validatePod(pod *corev1.Pod) []error {
+	errs := validateAnnotations(pod.Annotations)
+	if !injecting(&pod.ObjectMeta) {
+		return errs
+	}
+
+	if _, err := sidecarLogLevel(pod, whsvr.SidecarConfig); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := namedPorts(pod, whsvr.SidecarConfig.Containers); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, _, err := appPort(pod, whsvr.SidecarConfig); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := meshDNS(pod, whsvr.SidecarConfig); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, _, err := caMountPaths(pod); err != nil && whsvr.SidecarConfig.EnableMeshTLS {
+		errs = append(errs, err)
+	}
+
+	if _, err := identityExemptions(pod, whsvr.SidecarConfig.Containers); err != nil && whsvr.SidecarConfig.WorkloadIdentity {
+		errs = append(errs, err)
+	}
+
+	if _, err := resilienceOptions(pod); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := headerRoutes(pod.Annotations, pod.Namespace); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := tyk.ValidateSegments(tyk.SegmentMesh, pod.Namespace, pod.Annotations); err != nil {
+		errs = append(errs, err)
+	}
+
+	if v := pod.Annotations[AdmissionWebhookAnnotationMirrorToKey]; v != "" {
+		if _, _, _, err := parseMirror(v, pod.Namespace); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
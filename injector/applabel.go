@@ -0,0 +1,66 @@
+package injector
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// defaultAppName derives the service name of a pod without an app label from
+// its controller, e.g. the Deployment of its ReplicaSet, or from its
+// generateName prefix. It returns an empty name if none can be derived.
+func defaultAppName(pod *corev1.Pod) (string, string) {
+	// the ReplicaSets of a Deployment are named <deployment>-<pod-template-hash>
+	strip := func(name string) string {
+		if hash := pod.Labels["pod-template-hash"]; hash != "" {
+			return strings.TrimSuffix(name, "-"+hash)
+		}
+		return name
+	}
+
+	for _, ref := range pod.OwnerReferences {
+		if ref.Controller == nil || !*ref.Controller || ref.Name == "" {
+			continue
+		}
+
+		name := ref.Name
+		if ref.Kind == "ReplicaSet" {
+			name = strip(name)
+		}
+		if len(validation.IsValidLabelValue(name)) == 0 {
+			return name, "owner " + ref.Kind + " " + ref.Name
+		}
+	}
+
+	if pod.GenerateName != "" {
+		name := strip(strings.TrimSuffix(pod.GenerateName, "-"))
+		if name != "" && len(validation.IsValidLabelValue(name)) == 0 {
+			return name, "generateName " + pod.GenerateName
+		}
+	}
+
+	return "", ""
+}
+
+// defaultAppLabel sets the app label of a pod that has none if enabled, it
+// returns true if the label was added
+func (whsvr *WebhookServer) defaultAppLabel(ctx context.Context, pod *corev1.Pod) bool {
+	if _, ok := pod.Labels["app"]; ok || !whsvr.SidecarConfig.DefaultAppLabel {
+		return false
+	}
+
+	name, source := defaultAppName(pod)
+	if name == "" {
+		return false
+	}
+
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	pod.Labels["app"] = name
+
+	warn(ctx, "pod has no app label, using %q derived from its %v", name, source)
+	return true
+}
@@ -0,0 +1,199 @@
+package injector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+)
+
+const (
+	// Port the app of a pod listens on, a number or the name of a container
+	// port, optionally prefixed with its scheme, e.g. "9000", "https:8443" or
+	// "http-api". Detected from the container ports if unset.
+	AdmissionWebhookAnnotationAppPortKey = "injector.tyk.io/app-port"
+
+	defaultAppPort int32 = 80
+)
+
+// tunnels are the ports the iptables init container forwards to the app
+// ports it redirects to the sidecar, so the sidecar can still reach them
+var tunnels = map[int32]int32{
+	80:  6767,
+	443: 6768,
+}
+
+// tlsPort reports whether a container port serves TLS, going by its name
+// (https or https-*, as for service mesh protocol selection) or number
+func tlsPort(p corev1.ContainerPort) bool {
+	return p.Name == "https" || strings.HasPrefix(p.Name, "https-") || p.ContainerPort == 443
+}
+
+// httpPort reports whether a container port is named for HTTP(S)
+func httpPort(p corev1.ContainerPort) bool {
+	for _, prefix := range []string{"http", "https"} {
+		if p.Name == prefix || strings.HasPrefix(p.Name, prefix+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// sidecarPorts returns the ports the injected containers listen on, by the
+// name of their container
+func sidecarPorts(sidecars []corev1.Container) map[int32]string {
+	ports := map[int32]string{sidecarServicePort: "sidecar"}
+	for _, cnt := range sidecars {
+		for _, p := range cnt.Ports {
+			ports[p.ContainerPort] = cnt.Name
+		}
+	}
+	return ports
+}
+
+// appPort returns the port the app of a pod listens on and whether it serves
+// TLS: the port of the annotation, else the container port named http or
+// https, else the only TCP port of the app containers, else port 80. A port
+// of the sidecar that isn't tunnelled is rejected, the inbound route would
+// loop through the sidecar.
+func appPort(pod *corev1.Pod, sidecarConfig *Config) (int32, bool, error) {
+	port, tls, err := findAppPort(pod, sidecarConfig.Containers)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if _, ok := tunnels[port]; ok && !sidecarConfig.Restricted {
+		return port, tls, nil
+	}
+	if sidecar, ok := sidecarPorts(sidecarConfig.Containers)[port]; ok {
+		return 0, false, fmt.Errorf("app port %v is also used by the injected %v container, move the app to another port or point %v at it", port, sidecar, AdmissionWebhookAnnotationAppPortKey)
+	}
+
+	return port, tls, nil
+}
+
+// findAppPort detects or reads the app port of appPort
+func findAppPort(pod *corev1.Pod, sidecars []corev1.Container) (int32, bool, error) {
+	injected := map[string]bool{}
+	for _, cnt := range sidecars {
+		injected[cnt.Name] = true
+	}
+
+	ports := make([]corev1.ContainerPort, 0)
+	for _, cnt := range pod.Spec.Containers {
+		if injected[cnt.Name] {
+			continue
+		}
+		for _, p := range cnt.Ports {
+			if p.Protocol == "" || p.Protocol == corev1.ProtocolTCP {
+				ports = append(ports, p)
+			}
+		}
+	}
+
+	if v, ok := pod.Annotations[AdmissionWebhookAnnotationAppPortKey]; ok {
+		return parseAppPort(v, ports)
+	}
+
+	var named []corev1.ContainerPort
+	for _, p := range ports {
+		if httpPort(p) {
+			named = append(named, p)
+		}
+	}
+
+	switch {
+	case len(named) > 0:
+		// http wins over https if both are named, the sidecar terminates TLS
+		for _, p := range named {
+			if !tlsPort(p) {
+				return p.ContainerPort, false, nil
+			}
+		}
+		return named[0].ContainerPort, true, nil
+	case len(ports) == 1:
+		return ports[0].ContainerPort, tlsPort(ports[0]), nil
+	}
+
+	return defaultAppPort, false, nil
+}
+
+// parseAppPort reads the app port annotation, names are looked up in ports
+func parseAppPort(v string, ports []corev1.ContainerPort) (int32, bool, error) {
+	scheme := ""
+	port := v
+	if i := strings.Index(v, ":"); i >= 0 {
+		scheme, port = v[:i], v[i+1:]
+		if scheme != "http" && scheme != "https" {
+			return 0, false, fmt.Errorf("%v: unknown scheme %q in %q, must be http or https", AdmissionWebhookAnnotationAppPortKey, scheme, v)
+		}
+	}
+
+	var found *corev1.ContainerPort
+	if n, err := strconv.Atoi(port); err == nil {
+		if n < 1 || n > 65535 {
+			return 0, false, fmt.Errorf("%v: port %v is out of range", AdmissionWebhookAnnotationAppPortKey, n)
+		}
+		found = &corev1.ContainerPort{ContainerPort: int32(n)}
+		for i := range ports {
+			if ports[i].ContainerPort == int32(n) {
+				found = &ports[i]
+			}
+		}
+	} else {
+		for i := range ports {
+			if ports[i].Name == port {
+				found = &ports[i]
+			}
+		}
+		if found == nil {
+			return 0, false, fmt.Errorf("%v: the pod has no container port named %q", AdmissionWebhookAnnotationAppPortKey, port)
+		}
+	}
+
+	if scheme != "" {
+		return found.ContainerPort, scheme == "https", nil
+	}
+	return found.ContainerPort, tlsPort(*found), nil
+}
+
+// appTarget is the upstream of an inbound route to a port of the app. The
+// iptables init container redirects the app's ports 80 and 443 to the
+// sidecar, those are reached through their tunnels, restricted pods have no
+// redirect and are proxied to the port directly.
+func appTarget(sidecarConfig *Config, port int32, tls bool) string {
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+
+	if tunnel, ok := tunnels[port]; ok && !sidecarConfig.Restricted {
+		port = tunnel
+	}
+	return hostURL(scheme, "localhost", port)
+}
+
+// inboundTarget is the upstream of the inbound route of a pod, its app port
+func inboundTarget(pod *corev1.Pod, sidecarConfig *Config) (string, error) {
+	port, tls, err := appPort(pod, sidecarConfig)
+	if err != nil {
+		return "", err
+	}
+	return appTarget(sidecarConfig, port, tls), nil
+}
+
+// inboundAnnotations returns the processor annotations of an inbound route.
+// The certificate of an app serving TLS is issued for the names it is called
+// by rather than localhost, it isn't verified unless the pod says otherwise
+// since the hop stays in the pod.
+func inboundAnnotations(podAnn map[string]string, target string) map[string]string {
+	ann := processor.Filter(podAnn)
+	key := string(processor.ValueSetBoolKey) + "proxy.transport.ssl_insecure_skip_verify"
+	if _, ok := ann[key]; !ok && strings.HasPrefix(target, "https://") {
+		ann[key] = "true"
+	}
+	return ann
+}
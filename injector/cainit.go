@@ -0,0 +1,105 @@
+package injector
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	caInitContainerName = "tyk-ca-init"
+	// where the CA init container writes the trust store into the ssl-certs volume
+	caInitDir = "/var/run/tyk-mesh/certs"
+
+	defaultCAInitTimeout = time.Minute
+)
+
+// CAInitConfig configures the init container fetching the mesh CA from the
+// controller at runtime, replacing the ca-pem ConfigMap volume
+type CAInitConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Image    string        `yaml:"image"`    // image with the tyk-k8s binary as its entrypoint, e.g. the controller image
+	URL      string        `yaml:"url"`      // CA bundle endpoint of the controller, e.g. https://tyk-k8s.tyk.svc:443/ca/bundle
+	CAFile   string        `yaml:"caFile"`   // CA in the image to verify the controller with, the system trust store if unset
+	Insecure bool          `yaml:"insecure"` // don't verify the certificate of the controller
+	Timeout  time.Duration `yaml:"timeout"`  // how long to retry before the pod fails to start, a minute if unset
+}
+
+// Validate checks the CA init container configuration
+func (c *CAInitConfig) Validate(initContainers []corev1.Container) []error {
+	errs := make([]error, 0)
+	if !c.Enabled {
+		return errs
+	}
+
+	if c.Image == "" {
+		errs = append(errs, fmt.Errorf("caInit.image: required if the CA init container is enabled"))
+	}
+
+	if !strings.HasPrefix(c.URL, "https://") && !strings.HasPrefix(c.URL, "http://") {
+		errs = append(errs, fmt.Errorf("caInit.url: %q is not an http(s) URL", c.URL))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("caInit.timeout: must not be negative"))
+	}
+
+	// the ConfigMap volume is no longer added to injected pods
+	for i, cnt := range initContainers {
+		for _, m := range cnt.VolumeMounts {
+			if m.Name == volName {
+				errs = append(errs, fmt.Errorf("initContainers[%d]: mounts the %v volume, which isn't added when caInit is enabled", i, volName))
+			}
+		}
+	}
+
+	return errs
+}
+
+// caInitContainer templates the init container fetching the mesh CA into
+// the ssl-certs volume. It runs before the configured init containers, which
+// may redirect the traffic of the pod to the sidecar that isn't running yet.
+func caInitContainer(c *CAInitConfig) corev1.Container {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultCAInitTimeout
+	}
+
+	args := []string{"ca-init", "--url", c.URL, "--out", caInitDir, "--timeout", timeout.String()}
+	if c.CAFile != "" {
+		args = append(args, "--ca-file", c.CAFile)
+	}
+	if c.Insecure {
+		args = append(args, "--insecure")
+	}
+
+	return corev1.Container{
+		Name:  caInitContainerName,
+		Image: c.Image,
+		Args:  args,
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: certVolumenName, MountPath: caInitDir},
+		},
+		// the reason the CA couldn't be fetched shows up in the pod status
+		TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+	}
+}
+
+// initContainers returns the init containers to add to a pod, in restricted
+// mode without those needing privileges
+func initContainers(sidecarConfig *Config) []corev1.Container {
+	configured := sidecarConfig.InitContainers
+	if sidecarConfig.Restricted {
+		configured = restrictedInitContainers(configured)
+	}
+
+	if !sidecarConfig.EnableMeshTLS || !sidecarConfig.CAInit.Enabled {
+		return configured
+	}
+
+	added := make([]corev1.Container, 0, len(configured)+1)
+	added = append(added, caInitContainer(&sidecarConfig.CAInit))
+	return append(added, configured...)
+}
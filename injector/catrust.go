@@ -0,0 +1,108 @@
+package injector
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+)
+
+const (
+	// Where containers find the mesh CA, `[container=]path` pairs separated by
+	// commas, a path without a container applies to all others
+	AdmissionWebhookAnnotationCAMountPathKey = "injector.tyk.io/ca-mount-path"
+	// Overrides mergeCABundle of the config for the pod
+	AdmissionWebhookAnnotationCAMergeKey = "injector.tyk.io/ca-merge-bundle"
+
+	defaultCAMountPath  = "/etc/ssl/certs"
+	defaultCABundleFile = "/etc/ssl/certs/ca-certificates.crt"
+	// the system bundle of the init container, with the mesh CA added
+	mergedBundleName = ca.TrustBundleName
+)
+
+// caMerge reports whether the containers of a pod only get the merged bundle
+// file instead of the whole trust store of the init container
+func caMerge(pod *corev1.Pod, sidecarConfig *Config) bool {
+	switch strings.ToLower(pod.Annotations[AdmissionWebhookAnnotationCAMergeKey]) {
+	case "y", "yes", "true", "on":
+		return true
+	case "n", "no", "false", "off":
+		return false
+	}
+
+	return sidecarConfig.MergeCABundle
+}
+
+// caMountPaths parses the mount path annotation of a pod into the paths of
+// named containers and the path of all others, empty if not overridden
+func caMountPaths(pod *corev1.Pod) (map[string]string, string, error) {
+	named := map[string]string{}
+	def := ""
+	for _, entry := range strings.Split(pod.Annotations[AdmissionWebhookAnnotationCAMountPathKey], ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, p := "", entry
+		if i := strings.Index(entry, "="); i > -1 {
+			name, p = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+
+		if !path.IsAbs(p) {
+			return nil, "", fmt.Errorf("%v: %q is not an absolute path", AdmissionWebhookAnnotationCAMountPathKey, p)
+		}
+
+		if name == "" {
+			def = p
+		} else {
+			named[name] = p
+		}
+	}
+
+	return named, def, nil
+}
+
+// caVolumeMounts returns the CA volume mount of each container of a pod. The
+// trust store of the init container is mounted over caMountPath, or in merge
+// mode only its bundle file over caBundleFile, which keeps the other files
+// of the distro trust store in place. Pods with invalid paths are rejected on
+// admission before they get here.
+func caVolumeMounts(pod *corev1.Pod, sidecarConfig *Config) func(container string) corev1.VolumeMount {
+	merge := caMerge(pod, sidecarConfig)
+	named, def, err := caMountPaths(pod)
+	if err != nil {
+		named, def = map[string]string{}, ""
+	}
+
+	if def == "" {
+		def = sidecarConfig.CAMountPath
+		if merge {
+			def = sidecarConfig.CABundleFile
+		}
+	}
+
+	if def == "" {
+		def = defaultCAMountPath
+		if merge {
+			def = defaultCABundleFile
+		}
+	}
+
+	return func(container string) corev1.VolumeMount {
+		p, ok := named[container]
+		if !ok {
+			p = def
+		}
+
+		mount := corev1.VolumeMount{Name: certVolumenName, MountPath: p}
+		if merge {
+			mount.SubPath = mergedBundleName
+		}
+
+		return mount
+	}
+}
@@ -0,0 +1,193 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// CertKind describes what a stored certificate is used for
+func CertKind(cm *ca.CertModel) string {
+	switch {
+	case cm.IsMeshCert:
+		return "mesh"
+	case cm.TrustDomain != "":
+		return "namespace-ca"
+	case cm.Identity != "":
+		return "identity"
+	case cm.ServiceID != "":
+		return "server"
+	default:
+		return "other"
+	}
+}
+
+// certClient returns the client of the org a certificate was uploaded to,
+// identities live in the org of their namespace, server certs in the org of
+// their API and everything else in the default org
+func (whsvr *WebhookServer) certClient(ctx context.Context, cm *ca.CertModel) (tyk.Client, string, error) {
+	if CertKind(cm) == "server" {
+		cl, err := whsvr.apiClient(ctx, cm.ServiceID)
+		return cl, "", err
+	}
+
+	ns := identityNamespace(cm.Identity)
+	cl, err := whsvr.tykClient(ns, nil)
+	return cl, ns, err
+}
+
+// RotateCert reissues the server certificate of a mesh route straight away,
+// whatever its expiry. Identities are reissued by revoking them instead.
+func (whsvr *WebhookServer) RotateCert(ctx context.Context, cm *ca.CertModel) error {
+	if cm.Revoked {
+		return fmt.Errorf("certificate %v is revoked", cm.Bundle.Fingerprint)
+	}
+
+	if CertKind(cm) != "server" {
+		return fmt.Errorf("only server certificates can be rotated, %v certificates are reissued on revocation or restart", CertKind(cm))
+	}
+
+	return whsvr.rotateCert(ctx, cm)
+}
+
+// RevokeCert revokes a certificate and removes it from Tyk. Identities are
+// removed from the inbound routes of the mesh, server certificates are
+// replaced on their route first so the route keeps serving TLS. The mesh
+// certificate is shared by the mesh routes of every org and held by the
+// running injectors, it is replaced by rotating the root CA instead.
+func (whsvr *WebhookServer) RevokeCert(ctx context.Context, cm *ca.CertModel, reason int) error {
+	if cm.Revoked {
+		return fmt.Errorf("certificate %v is revoked already", cm.Bundle.Fingerprint)
+	}
+
+	switch CertKind(cm) {
+	case "identity":
+		_, ns, err := whsvr.certClient(ctx, cm)
+		if err != nil {
+			return err
+		}
+		return whsvr.revokeIdentityCert(ctx, ns, cm, reason)
+
+	case "server":
+		// the route is served with a new certificate first, the record of
+		// the revoked one is kept for the CRL but no longer linked to the API
+		cl, renewed, err := whsvr.replaceServerCert(ctx, cm)
+		if err != nil {
+			return fmt.Errorf("failed to replace certificate before revoking it: %w", err)
+		}
+
+		sid := cm.ServiceID
+		renewed.ServiceID = sid
+		if _, err := whsvr.caClient(ctx).StoreCert(renewed); err != nil {
+			return fmt.Errorf("failed to store replacement certificate: %w", err)
+		}
+
+		cm.ServiceID = ""
+		if err := whsvr.caClient(ctx).Revoke(cm, reason); err != nil {
+			return fmt.Errorf("failed to revoke certificate: %w", err)
+		}
+
+		whsvr.removeReplacedCert(ctx, cl, cm.Bundle.Fingerprint, renewed.Bundle.Fingerprint)
+
+		log.Infof("revoked server certificate %v of %v", cm.Bundle.Fingerprint, sid)
+		return nil
+
+	case "mesh":
+		return fmt.Errorf("the mesh certificate can't be revoked, rotate the root CA with tyk-k8s ca rotate to reissue it")
+
+	case "namespace-ca":
+		return fmt.Errorf("namespace CAs can't be revoked, they only sign in the controller and are replaced when they expire")
+
+	default:
+		return fmt.Errorf("only identity and server certificates can be revoked, %v is neither", cm.Bundle.Fingerprint)
+	}
+}
+
+// ReuploadCert uploads a stored certificate to Tyk if it is missing there,
+// e.g. after the dashboard was restored from a backup. If Tyk assigns it a
+// different ID, the store and the routes using it are updated. It returns
+// false if the certificate was present already.
+func (whsvr *WebhookServer) ReuploadCert(ctx context.Context, cm *ca.CertModel) (bool, error) {
+	if cm.Revoked {
+		return false, fmt.Errorf("certificate %v is revoked", cm.Bundle.Fingerprint)
+	}
+
+	// namespace CAs sign in the controller, Tyk never sees them
+	if CertKind(cm) == "namespace-ca" {
+		return false, nil
+	}
+
+	cl, _, err := whsvr.certClient(ctx, cm)
+	if err != nil {
+		return false, err
+	}
+
+	old := cm.Bundle.Fingerprint
+	exists, err := cl.CertificateExists(ctx, old)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	// server certificates are uploaded with their chain
+	crt := cm.Bundle.Certificate
+	if CertKind(cm) == "server" && len(cm.Bundle.Bundled) > 0 {
+		crt = cm.Bundle.Bundled
+	}
+
+	id, err := cl.CreateCertificate(ctx, crt, cm.Bundle.PrivateKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to upload certificate to tyk secure store: %w", err)
+	}
+
+	if id == old {
+		return true, nil
+	}
+	whsvr.replaceCert(old, id)
+
+	cm.Bundle.Fingerprint = id
+	if err := whsvr.caClient(ctx).UpdateCert(cm); err != nil {
+		return true, fmt.Errorf("failed to update certificate in controller store: %v", err)
+	}
+
+	switch CertKind(cm) {
+	case "server":
+		def, err := cl.GetByObjectID(ctx, cm.ServiceID)
+		if err != nil {
+			return true, fmt.Errorf("failed to retrieve API definition: %w", err)
+		}
+
+		certs := make([]string, 0, len(def.Certificates)+1)
+		for _, c := range def.Certificates {
+			if c != old && c != id {
+				certs = append(certs, c)
+			}
+		}
+		def.Certificates = append(certs, id)
+
+		if err := cl.UpdateAPI(ctx, &def.APIDefinition); err != nil {
+			return true, fmt.Errorf("failed to store updated API Definition: %w", err)
+		}
+
+	case "identity":
+		certs, err := whsvr.identities(ctx)
+		if err != nil {
+			return true, err
+		}
+
+		affected := make([]string, 0, len(certs))
+		for _, c := range certs {
+			affected = append(affected, c.Identity)
+		}
+		whsvr.updateInboundRoutes(ctx, cl, affected, certs)
+
+	case "mesh":
+		log.Warningf("mesh certificate re-uploaded as %v, restart the controller to inject the new ID", id)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,234 @@
+package injector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// Records the image of the sidecar a pod was injected with, digest pinned if enabled
+	AdmissionWebhookAnnotationSidecarVersionKey = "injector.tyk.io/sidecar-version"
+
+	defaultRegistry = "registry-1.docker.io"
+)
+
+// manifest types a tag can resolve to, multi-arch indexes are pinned as a whole
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// registryClient talks to the registries images are resolved in
+var registryClient = http.DefaultClient
+
+// imageRef is an image reference split into its parts
+type imageRef struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+func parseImageRef(image string) (*imageRef, error) {
+	if image == "" {
+		return nil, fmt.Errorf("empty image reference")
+	}
+
+	ref := &imageRef{registry: defaultRegistry, tag: "latest"}
+	name := image
+	if i := strings.Index(name, "@"); i > -1 {
+		ref.digest = name[i+1:]
+		name = name[:i]
+	}
+
+	// the first component is a registry if it looks like a host
+	if i := strings.Index(name, "/"); i > -1 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.registry = host
+			name = name[i+1:]
+		}
+	}
+
+	if i := strings.LastIndex(name, ":"); i > -1 && !strings.Contains(name[i:], "/") {
+		ref.tag = name[i+1:]
+		name = name[:i]
+	}
+
+	if ref.registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	ref.repository = name
+
+	return ref, nil
+}
+
+// pinned returns the reference of the image at a digest, keeping the tag
+// for readability
+func pinned(image, digest string) string {
+	if i := strings.Index(image, "@"); i > -1 {
+		image = image[:i]
+	}
+
+	return image + "@" + digest
+}
+
+// ResolveDigest looks up the digest the tag of an image currently points to,
+// public images and registries allowing anonymous pulls are supported.
+// References with a digest are returned as they are.
+func ResolveDigest(ctx context.Context, image string) (string, error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return "", err
+	}
+
+	if ref.digest != "" {
+		return ref.digest, nil
+	}
+
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.registry, ref.repository, ref.tag)
+	resp, err := manifestHead(ctx, u, "")
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := anonymousToken(ctx, resp.Header.Get("WWW-Authenticate"), ref.repository)
+		if err != nil {
+			return "", fmt.Errorf("failed to authenticate with %v: %w", ref.registry, err)
+		}
+
+		resp, err = manifestHead(ctx, u, token)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to resolve %v: registry returned %v", image, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("failed to resolve %v: registry returned no digest", image)
+	}
+
+	return digest, nil
+}
+
+func manifestHead(ctx context.Context, u, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := registryClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return resp, nil
+}
+
+// anonymousToken requests a pull token from the realm of a bearer challenge
+func anonymousToken(ctx context.Context, challenge, repository string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported challenge %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, p := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	if params["realm"] == "" {
+		return "", fmt.Errorf("challenge %q has no realm", challenge)
+	}
+
+	q := url.Values{}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repository)
+	}
+	q.Set("scope", scope)
+
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := registryClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %v", resp.Status)
+	}
+
+	tok := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+
+	if tok.Token != "" {
+		return tok.Token, nil
+	}
+
+	return tok.AccessToken, nil
+}
+
+// SidecarVersion is the image of the gateway container recorded on injected
+// pods, pods recording another version run an outdated sidecar
+func SidecarVersion(sidecarConfig *Config) string {
+	for _, cnt := range sidecarConfig.Containers {
+		if strings.ToLower(cnt.Name) == "tyk-mesh" {
+			return cnt.Image
+		}
+	}
+
+	return ""
+}
+
+// PinSidecarDigest replaces the tag of the gateway container image with the
+// digest it points to, so all pods injected until the next restart run the
+// same image even if the tag is moved
+func PinSidecarDigest(ctx context.Context, sidecarConfig *Config) error {
+	for i, cnt := range sidecarConfig.Containers {
+		if strings.ToLower(cnt.Name) != "tyk-mesh" {
+			continue
+		}
+
+		digest, err := ResolveDigest(ctx, cnt.Image)
+		if err != nil {
+			return err
+		}
+
+		sidecarConfig.Containers[i].Image = pinned(cnt.Image, digest)
+		log.Infof("pinned sidecar image %v to %v", cnt.Image, digest)
+	}
+
+	return nil
+}
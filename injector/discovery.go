@@ -0,0 +1,305 @@
+package injector
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// MeshServicesRoute lists the services registered in the mesh
+	MeshServicesRoute = "/mesh/services"
+	// MeshCARoute reports the progress of a root CA rotation
+	MeshCARoute = "/mesh/ca"
+
+	defaultDiscoveryTTL = 30 * time.Second
+	// meshRouteTTL is how long the mesh routes of the listed services are
+	// cached, they only change when the services are redeployed
+	meshRouteTTL = 10 * time.Minute
+)
+
+// MeshService is a service in the mesh as tracked by the controller: its
+// routes, the certificates securing them and the health of its pods
+type MeshService struct {
+	Service          string   `json:"service"`
+	Namespace        string   `json:"namespace"`
+	Org              string   `json:"org,omitempty"`
+	ListenPath       string   `json:"listen_path"`
+	Hostname         string   `json:"hostname"`
+	MeshID           string   `json:"mesh_id"`
+	InboundID        string   `json:"inbound_id"`
+	CertFingerprints []string `json:"cert_fingerprints,omitempty"` // inbound server cert and workload identity
+	Replicas         int      `json:"replicas"`
+	Ready            int      `json:"ready"`
+	Healthy          bool     `json:"healthy"`
+	Error            string   `json:"error,omitempty"` // set if the routes couldn't be looked up
+}
+
+// DiscoveryConf controls the list of mesh services served by the injector
+type DiscoveryConf struct {
+	Token    string        `yaml:"token"`    // bearer token of callers without a verified client certificate
+	CacheTTL time.Duration `yaml:"cacheTTL"` // how long the list is served before the pods are listed again, 30s if unset
+}
+
+// Validate checks the discovery config, all problems found are returned
+func (c *DiscoveryConf) Validate() []error {
+	if c.CacheTTL < 0 {
+		return []error{fmt.Errorf("discovery.cacheTTL: must not be negative")}
+	}
+
+	return nil
+}
+
+func (c *DiscoveryConf) ttl() time.Duration {
+	if c.CacheTTL == 0 {
+		return defaultDiscoveryTTL
+	}
+
+	return c.CacheTTL
+}
+
+// meshRoute is the mesh route of a service as last read from Tyk
+type meshRoute struct {
+	listenPath string
+	hostname   string
+	read       time.Time
+}
+
+// meshDirectory caches the services of the mesh, so requests don't list the
+// pods of the cluster and look up their routes every time. Routes are kept
+// across refreshes, only the routes of new services and the ones read more
+// than meshRouteTTL ago are looked up again.
+type meshDirectory struct {
+	mu       sync.Mutex
+	services []MeshService
+	listed   time.Time
+	routes   map[string]meshRoute // by mesh API ID
+}
+
+// MeshServices lists the services of the injected pods in a namespace, or the
+// whole cluster if empty, with their routes looked up in the org of the pods.
+// A service is healthy while at least one of its pods is ready. The services
+// of the cluster are cached for the cacheTTL of the discovery config.
+func (whsvr *WebhookServer) MeshServices(ctx context.Context, namespace string) ([]MeshService, error) {
+	d := &whsvr.directory
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.services == nil || time.Since(d.listed) >= whsvr.SidecarConfig.Discovery.ttl() {
+		services, err := whsvr.listMeshServices(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+
+		d.services = services
+		d.listed = time.Now()
+	}
+
+	res := make([]MeshService, 0, len(d.services))
+	for _, svc := range d.services {
+		if namespace == metav1.NamespaceAll || svc.Namespace == namespace {
+			res = append(res, svc)
+		}
+	}
+
+	return res, nil
+}
+
+// listMeshServices lists the services of the injected pods of the cluster
+func (whsvr *WebhookServer) listMeshServices(ctx context.Context, d *meshDirectory) ([]MeshService, error) {
+	if whsvr.KubeClient == nil {
+		return nil, fmt.Errorf("no kubernetes client to list the mesh with")
+	}
+
+	pods, err := whsvr.KubeClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+
+	byName := map[string]*MeshService{}
+	first := map[string]*corev1.Pod{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		app, ok := pod.Labels["app"]
+		if !ok || pod.Annotations[AdmissionWebhookAnnotationStatusKey] != "injected" {
+			continue
+		}
+
+		inboundID, ok := pod.Annotations[AdmissionWebhookAnnotationInboundServiceIDKey]
+		if !ok {
+			continue
+		}
+
+		key := pod.Namespace + "/" + app
+		svc, ok := byName[key]
+		if !ok {
+			svc = &MeshService{
+				Service:   app,
+				Namespace: pod.Namespace,
+				Org:       pod.Annotations[tyk.OrgAnnotation],
+				MeshID:    pod.Annotations[AdmissionWebhookAnnotationMeshServiceIDKey],
+				InboundID: inboundID,
+			}
+			byName[key] = svc
+			first[key] = pod
+		}
+
+		svc.Replicas++
+		if podReady(pod) {
+			svc.Ready++
+		}
+	}
+
+	if d.routes == nil {
+		d.routes = map[string]meshRoute{}
+	}
+
+	routes := make(map[string]meshRoute, len(byName))
+	res := make([]MeshService, 0, len(byName))
+	for key, svc := range byName {
+		svc.Healthy = svc.Ready > 0
+		if err := whsvr.describeMeshService(ctx, svc, first[key], d.routes); err != nil {
+			svc.Error = err.Error()
+		} else if svc.MeshID != "" {
+			routes[svc.MeshID] = d.routes[svc.MeshID]
+		}
+
+		res = append(res, *svc)
+	}
+	d.routes = routes
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Namespace != res[j].Namespace {
+			return res[i].Namespace < res[j].Namespace
+		}
+		return res[i].Service < res[j].Service
+	})
+
+	return res, nil
+}
+
+// describeMeshService adds the listen path of the mesh route and the
+// fingerprints of the certificates of a service. The route is taken from
+// routes unless it is missing or stale, routes read from Tyk are added to it.
+func (whsvr *WebhookServer) describeMeshService(ctx context.Context, svc *MeshService, pod *corev1.Pod, routes map[string]meshRoute) error {
+	if whsvr.CAClient != nil {
+		if cm, err := whsvr.caClient(ctx).GetServerCertByLinkedAPIID(svc.InboundID); err == nil && cm.Bundle != nil {
+			svc.CertFingerprints = append(svc.CertFingerprints, cm.Bundle.Fingerprint)
+		}
+	}
+
+	if id, ok := pod.Annotations[AdmissionWebhookAnnotationIdentityCertIDKey]; ok && id != "" {
+		svc.CertFingerprints = append(svc.CertFingerprints, id)
+	}
+
+	if svc.MeshID == "" {
+		return nil
+	}
+
+	route, ok := routes[svc.MeshID]
+	if !ok || time.Since(route.read) >= meshRouteTTL {
+		cl, err := whsvr.tykClient(pod.Namespace, pod.Annotations)
+		if err != nil {
+			return err
+		}
+
+		def, err := cl.GetByObjectID(ctx, svc.MeshID)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve mesh API definition: %w", err)
+		}
+
+		// callers are handed the primary hostname rather than the host template
+		hostname := def.Domain
+		if hostname == meshDomain(whsvr.SidecarConfig) {
+			hostname = meshHost(whsvr.SidecarConfig)
+		}
+
+		route = meshRoute{listenPath: def.Proxy.ListenPath, hostname: hostname, read: time.Now()}
+		routes[svc.MeshID] = route
+	}
+
+	svc.ListenPath = route.listenPath
+	svc.Hostname = route.hostname
+
+	return nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// discoveryAuthorized checks the caller of the discovery presented a client
+// certificate verified by the server, or the bearer token of the config
+func (whsvr *WebhookServer) discoveryAuthorized(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	token := whsvr.SidecarConfig.Discovery.Token
+	if token == "" {
+		return false
+	}
+
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// ServeMeshServices writes the services of the mesh as JSON, filtered by
+// the namespace query parameter if set
+func (whsvr *WebhookServer) ServeMeshServices(w http.ResponseWriter, r *http.Request) {
+	if !whsvr.discoveryAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	res, err := whsvr.MeshServices(r.Context(), r.URL.Query().Get("namespace"))
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "failed to list the mesh services", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+	}
+}
+
+// ServeCARotation writes the status of the root CA rotation as JSON
+func (whsvr *WebhookServer) ServeCARotation(w http.ResponseWriter, r *http.Request) {
+	rot, ok := whsvr.CAClient.(ca.Rotator)
+	if !ok {
+		http.Error(w, "the CA doesn't support rotations", http.StatusNotFound)
+		return
+	}
+
+	status, err := rot.RotationStatus()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,143 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Selects how the pod resolves the mesh hostname, overriding meshDNS of the config
+	AdmissionWebhookAnnotationMeshDNSKey = "injector.tyk.io/mesh-dns"
+
+	// MeshDNSHostAlias pins the mesh hostname to the sidecar, or meshGatewayIP,
+	// in the hosts file of the pod
+	MeshDNSHostAlias = "hostAlias"
+	// MeshDNSSearch adds meshSearchDomain to the DNS search path of the pod,
+	// so the mesh hostname resolves to the mesh Service in that domain
+	MeshDNSSearch = "dnsConfig"
+	// MeshDNSService points a mesh ExternalName Service in the namespace of
+	// the pod at meshGatewayHost
+	MeshDNSService = "service"
+)
+
+func validMeshDNS(strategy string) bool {
+	switch strategy {
+	case MeshDNSHostAlias, MeshDNSSearch, MeshDNSService:
+		return true
+	}
+
+	return false
+}
+
+// meshDNS returns the mesh hostname strategy of a pod, the annotation takes
+// precedence over the config
+func meshDNS(pod *corev1.Pod, sidecarConfig *Config) (string, error) {
+	strategy := sidecarConfig.MeshDNS
+	if ann, ok := pod.Annotations[AdmissionWebhookAnnotationMeshDNSKey]; ok {
+		if !validMeshDNS(ann) {
+			return "", fmt.Errorf("%v: unknown mesh DNS strategy %q, must be %v, %v or %v",
+				AdmissionWebhookAnnotationMeshDNSKey, ann, MeshDNSHostAlias, MeshDNSSearch, MeshDNSService)
+		}
+		strategy = ann
+	}
+
+	switch {
+	case strategy == "":
+		return MeshDNSHostAlias, nil
+	case strategy == MeshDNSSearch && sidecarConfig.MeshSearchDomain == "":
+		return "", fmt.Errorf("the %v mesh DNS strategy requires meshSearchDomain to be configured", MeshDNSSearch)
+	case strategy == MeshDNSService && sidecarConfig.MeshGatewayHost == "":
+		return "", fmt.Errorf("the %v mesh DNS strategy requires meshGatewayHost to be configured", MeshDNSService)
+	case strategy != MeshDNSHostAlias && !singleLabel(meshHost(sidecarConfig)):
+		return "", fmt.Errorf("the %v mesh DNS strategy resolves the mesh hostname to a Service, %q must be a single label",
+			strategy, meshHost(sidecarConfig))
+	}
+
+	return strategy, nil
+}
+
+// addMeshDNS makes the mesh hostname resolvable in the pod, pods asking for
+// an unknown strategy are rejected on admission before they get here
+func addMeshDNS(pod *corev1.Pod, sidecarConfig *Config) *corev1.PodSpec {
+	spec := &pod.Spec
+	strategy, err := meshDNS(pod, sidecarConfig)
+	if err != nil {
+		strategy = MeshDNSHostAlias
+	}
+
+	switch strategy {
+	case MeshDNSSearch:
+		if spec.DNSConfig == nil {
+			spec.DNSConfig = &corev1.PodDNSConfig{}
+		}
+
+		for _, s := range spec.DNSConfig.Searches {
+			if s == sidecarConfig.MeshSearchDomain {
+				return spec
+			}
+		}
+		spec.DNSConfig.Searches = append(spec.DNSConfig.Searches, sidecarConfig.MeshSearchDomain)
+
+	case MeshDNSService:
+		// resolved by the cluster DNS through the search path of the namespace
+
+	default:
+		if len(spec.HostAliases) == 0 {
+			spec.HostAliases = []corev1.HostAlias{}
+		}
+
+		for _, ip := range meshHostIPs(sidecarConfig) {
+			spec.HostAliases = append(spec.HostAliases, corev1.HostAlias{
+				IP:        ip,
+				Hostnames: sidecarConfig.MeshHostnames.of(pod.Namespace),
+			})
+		}
+	}
+
+	return spec
+}
+
+// ensureMeshService creates the mesh ExternalName Service in a namespace,
+// named after the primary mesh hostname. Services of the same name that weren't created by the injector are kept
+func (whsvr *WebhookServer) ensureMeshService(ctx context.Context, ns string) error {
+	if whsvr.KubeClient == nil {
+		return fmt.Errorf("the %v mesh DNS strategy requires a kubernetes client", MeshDNSService)
+	}
+
+	meshHostname := meshHost(whsvr.SidecarConfig)
+	svcs := whsvr.KubeClient.CoreV1().Services(ns)
+	existing, err := svcs.Get(meshHostname, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		if existing.Spec.Type != corev1.ServiceTypeExternalName || existing.Spec.ExternalName != whsvr.SidecarConfig.MeshGatewayHost {
+			log.Warningf("service %v/%v doesn't point at the mesh gateway %v, leaving it as it is",
+				ns, meshHostname, whsvr.SidecarConfig.MeshGatewayHost)
+		}
+		return nil
+	case !apierrors.IsNotFound(err):
+		return fmt.Errorf("failed to look up the mesh service in %v: %w", ns, err)
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      meshHostname,
+			Namespace: ns,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "tyk-k8s"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: whsvr.SidecarConfig.MeshGatewayHost,
+		},
+	}
+
+	if _, err := svcs.Create(svc); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create the mesh service in %v: %w", ns, err)
+	}
+
+	log.Infof("created mesh service %v/%v pointing at %v", ns, meshHostname, whsvr.SidecarConfig.MeshGatewayHost)
+	return nil
+}
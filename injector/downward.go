@@ -0,0 +1,44 @@
+package injector
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// downwardEnv are the fields of the pod exposed to the gateway container, so
+// its logs and analytics can be correlated with the workload
+var downwardEnv = []struct {
+	name, field string
+}{
+	{"POD_NAME", "metadata.name"},
+	{"POD_NAMESPACE", "metadata.namespace"},
+	{"POD_IP", "status.podIP"},
+	{"NODE_NAME", "spec.nodeName"},
+}
+
+// addDownwardEnv adds the downward API env vars to the gateway container,
+// vars set in the config are kept
+func addDownwardEnv(containers []corev1.Container) []corev1.Container {
+	for i, cnt := range containers {
+		if strings.ToLower(cnt.Name) != "tyk-mesh" {
+			continue
+		}
+
+		env := cnt.Env
+		for _, d := range downwardEnv {
+			if hasEnv(env, d.name) {
+				continue
+			}
+			env = setEnv(env, corev1.EnvVar{
+				Name:      d.name,
+				ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: d.field}},
+			})
+		}
+
+		containers[i].Env = env
+		break
+	}
+
+	return containers
+}
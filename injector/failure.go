@@ -0,0 +1,141 @@
+package injector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// Selects the failure policy of a pod, or of all pods of an annotated namespace
+	AdmissionWebhookAnnotationFailurePolicyKey = "injector.tyk.io/failure-policy"
+	// Set on pods admitted without injection, holding the error that prevented it
+	AdmissionWebhookAnnotationInjectionErrorKey = "injector.tyk.io/injection-error"
+
+	// FailurePolicyOpen admits pods without mesh wiring while the control plane is unhealthy
+	FailurePolicyOpen = "open"
+	// FailurePolicyClosed rejects pods that can't be wired into the mesh
+	FailurePolicyClosed = "closed"
+)
+
+// unhealthy is true for errors caused by Tyk or the CA being unavailable,
+// rather than by the pod or the configuration
+func unhealthy(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, tyk.ErrUnavailable) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
+
+// failurePolicy returns the failure policy of a pod. The annotation of its
+// namespace wins over the annotation of the pod, which can only tighten it to
+// closed, so platform teams can force namespaces to fail closed. Without
+// either the policy of the config applies.
+func (whsvr *WebhookServer) failurePolicy(pod *corev1.Pod) string {
+	podPolicy := strings.ToLower(pod.Annotations[AdmissionWebhookAnnotationFailurePolicyKey])
+	if podPolicy == FailurePolicyClosed {
+		return FailurePolicyClosed
+	}
+
+	if whsvr.KubeClient != nil && pod.Namespace != "" {
+		ns, err := whsvr.KubeClient.CoreV1().Namespaces().Get(pod.Namespace, metav1.GetOptions{})
+		if err != nil {
+			log.Warningf("failed to read the failure policy of namespace %v: %v", pod.Namespace, err)
+		} else if p := strings.ToLower(ns.Annotations[AdmissionWebhookAnnotationFailurePolicyKey]); p == FailurePolicyOpen || p == FailurePolicyClosed {
+			return p
+		}
+	}
+
+	if podPolicy == FailurePolicyOpen {
+		return FailurePolicyOpen
+	}
+
+	if whsvr.SidecarConfig.FailurePolicy != "" {
+		return whsvr.SidecarConfig.FailurePolicy
+	}
+
+	if whsvr.SidecarConfig.FailOpen {
+		return FailurePolicyOpen
+	}
+
+	return FailurePolicyClosed
+}
+
+// failOpen admits a pod without injecting it if the control plane is
+// unhealthy and the failure policy of the pod is open, otherwise it returns
+// nil. The error is recorded on the pod and in an event.
+func (whsvr *WebhookServer) failOpen(pod *corev1.Pod, err error) *v1beta1.AdmissionResponse {
+	if !unhealthy(err) || whsvr.failurePolicy(pod) != FailurePolicyOpen {
+		return nil
+	}
+
+	log.Warningf("admitting %s/%s without injection: %v", pod.Namespace, pod.Name, err)
+	whsvr.injectionFailedEvent(pod, err)
+
+	// pods annotated for injection always have annotations
+	patch, perr := json.Marshal([]patchOperation{{
+		Op:    "add",
+		Path:  "/metadata/annotations/" + escapePatchKey(AdmissionWebhookAnnotationInjectionErrorKey),
+		Value: err.Error(),
+	}})
+	if perr != nil {
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	return &v1beta1.AdmissionResponse{
+		Allowed: true,
+		Patch:   patch,
+		PatchType: func() *v1beta1.PatchType {
+			pt := v1beta1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
+
+// injectionFailedEvent records a warning event for a pod admitted without
+// injection, pods are usually not named yet so the event refers to the name
+// they are generated from
+func (whsvr *WebhookServer) injectionFailedEvent(pod *corev1.Pod, err error) {
+	if whsvr.KubeClient == nil {
+		return
+	}
+
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+
+	now := metav1.NewTime(time.Now())
+	ev := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: strings.TrimSuffix(name, "-") + "-",
+			Namespace:    pod.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Namespace:  pod.Namespace,
+			Name:       name,
+			UID:        pod.UID,
+		},
+		Reason:         "InjectionFailed",
+		Message:        fmt.Sprintf("admitted without the mesh sidecar: %v", err),
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "tyk-k8s-injector"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := whsvr.KubeClient.CoreV1().Events(pod.Namespace).Create(ev); err != nil {
+		log.Warningf("failed to record the injection failure of %s/%s: %v", pod.Namespace, name, err)
+	}
+}
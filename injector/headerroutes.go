@@ -0,0 +1,145 @@
+package injector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+)
+
+const (
+	// Routes mesh requests by header value to other mesh services,
+	// `route.tyk.io/header.<header>: <value>=<service>[.namespace],...`.
+	// Annotation keys can't hold the value, `=` is not a valid key character.
+	AdmissionWebhookAnnotationHeaderRoutePrefix = "route.tyk.io/header."
+
+	urlRewritesPath = "version_data.versions.Default.extended_paths.url_rewrites"
+)
+
+// the methods the extended paths of mesh routes are set for, Tyk matches them per method
+var meshRouteMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// headerRoute sends requests with a header value to another mesh service
+type headerRoute struct {
+	header    string
+	value     string
+	service   string
+	namespace string
+}
+
+// headerRoutes parses the header route annotations of a pod, sorted by
+// header and value so the generated triggers are stable
+func headerRoutes(ann map[string]string, namespace string) ([]headerRoute, error) {
+	routes := make([]headerRoute, 0)
+	for k, v := range ann {
+		if !strings.HasPrefix(k, AdmissionWebhookAnnotationHeaderRoutePrefix) {
+			continue
+		}
+
+		header := k[len(AdmissionWebhookAnnotationHeaderRoutePrefix):]
+		if header == "" {
+			return nil, fmt.Errorf("%v: missing header name", k)
+		}
+
+		for _, entry := range strings.Split(v, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("%v: %q must be <value>=<service>[.namespace]", k, entry)
+			}
+
+			svc, ns := parts[1], namespace
+			if i := strings.Index(svc, "."); i > -1 {
+				svc, ns = svc[:i], svc[i+1:]
+			}
+
+			if svc == "" || ns == "" {
+				return nil, fmt.Errorf("%v: invalid service %q", k, parts[1])
+			}
+
+			routes = append(routes, headerRoute{header: header, value: parts[0], service: svc, namespace: ns})
+		}
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].header != routes[j].header {
+			return routes[i].header < routes[j].header
+		}
+		return routes[i].value < routes[j].value
+	})
+
+	return routes, nil
+}
+
+// headerRouteOptions translates the header route annotations of a pod into
+// URL rewrites of its mesh route. Requests are matched against the full
+// path, the listen path included, and the first matching header wins. Like
+// mirrors, the other services are reached through their inbound routes.
+func headerRouteOptions(pod *corev1.Pod, sName, namespace, listenPath string, port int32, tls bool) (map[string]string, error) {
+	ann := map[string]string{}
+	routes, err := headerRoutes(pod.Annotations, namespace)
+	if err != nil || len(routes) == 0 {
+		return ann, err
+	}
+
+	tr := "http"
+	if tls {
+		tr = "https"
+	}
+
+	triggers := make([]map[string]interface{}, 0, len(routes))
+	for _, r := range routes {
+		if r.service == sName && r.namespace == namespace {
+			return nil, fmt.Errorf("%v%v: %v can't route to itself", AdmissionWebhookAnnotationHeaderRoutePrefix, r.header, sName)
+		}
+
+		triggers = append(triggers, map[string]interface{}{
+			"on": "any",
+			"options": map[string]interface{}{
+				"header_matches": map[string]interface{}{
+					r.header: map[string]interface{}{"match_rx": "^" + regexp.QuoteMeta(r.value) + "$"},
+				},
+			},
+			"rewrite_to": hostURL(tr, r.service+"."+r.namespace, port) + "$1",
+		})
+		log.Infof("routing mesh requests of %v.%v with %v: %v to %v.%v", sName, namespace, r.header, r.value, r.service, r.namespace)
+	}
+
+	// requests without a matching header keep their path
+	pattern, keep := "^(.*)", "$1"
+	if lp := "/" + strings.Trim(listenPath, "/"); lp != "/" {
+		pattern, keep = "^"+regexp.QuoteMeta(lp)+"(.*)", lp+"$1"
+	}
+
+	rewrites := make([]map[string]interface{}, 0, len(meshRouteMethods))
+	for _, m := range meshRouteMethods {
+		rewrites = append(rewrites, map[string]interface{}{
+			"path":          "/",
+			"method":        m,
+			"match_pattern": pattern,
+			"rewrite_to":    keep,
+			"triggers":      triggers,
+		})
+	}
+
+	data, err := json.Marshal(rewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	ann[string(processor.ArrayAppendKey)+urlRewritesPath] = string(data)
+	return ann, nil
+}
@@ -0,0 +1,134 @@
+package injector
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// the hostnames of the mesh gateway unless configured otherwise
+var defaultMeshHostnames = []string{"mesh", "mesh.local"}
+
+// MeshHostnameConf names the mesh gateway pods call other services through,
+// e.g. https://mesh/<service>. The first default hostname is the primary
+// one, the name of the mesh Services, so it is the same in all namespaces.
+// The others, and the hostnames listed for a namespace, are aliases pinned to
+// the same address by the hostAlias strategy. Mesh routes are served on all
+// of them and the mesh certificate covers all of them.
+type MeshHostnameConf struct {
+	Default    []string            `yaml:"default"`    // cluster-wide hostnames, the primary first, mesh and mesh.local if unset
+	Namespaces map[string][]string `yaml:"namespaces"` // extra aliases by namespace
+}
+
+// Validate checks the hostnames are DNS names, all problems found are returned
+func (c *MeshHostnameConf) Validate() []error {
+	errs := make([]error, 0)
+	check := func(where string, hosts []string) {
+		seen := map[string]bool{}
+		for _, h := range hosts {
+			for _, msg := range validation.IsDNS1123Subdomain(h) {
+				errs = append(errs, fmt.Errorf("meshHostnames: %v hostname %q: %v", where, h, msg))
+			}
+			if seen[h] {
+				errs = append(errs, fmt.Errorf("meshHostnames: %v hostname %q is listed twice", where, h))
+			}
+			seen[h] = true
+		}
+	}
+
+	check("default", c.Default)
+	primary := c.primary()
+	for ns, hosts := range c.Namespaces {
+		if len(hosts) == 0 {
+			errs = append(errs, fmt.Errorf("meshHostnames: namespace %v has no hostnames, remove it to use the default", ns))
+		}
+		for _, h := range hosts {
+			if h == primary {
+				errs = append(errs, fmt.Errorf("meshHostnames: namespace %v lists the primary hostname %q, namespaces only add aliases", ns, h))
+			}
+		}
+		check("namespace "+ns, hosts)
+	}
+
+	return errs
+}
+
+func (c *MeshHostnameConf) defaults() []string {
+	if len(c.Default) > 0 {
+		return c.Default
+	}
+	return defaultMeshHostnames
+}
+
+// primary returns the cluster-wide hostname mesh routes are served on
+func (c *MeshHostnameConf) primary() string {
+	return c.defaults()[0]
+}
+
+// of returns the mesh hostnames of a namespace, the primary one first, then
+// the default aliases and the aliases of the namespace
+func (c *MeshHostnameConf) of(namespace string) []string {
+	hosts := append([]string{}, c.defaults()...)
+	for _, h := range c.Namespaces[namespace] {
+		if !contains(hosts, h) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// All returns every configured mesh hostname, sorted, the names the mesh
+// certificate is issued for
+func (c *MeshHostnameConf) All() []string {
+	seen := map[string]bool{}
+	all := make([]string, 0)
+	add := func(hosts []string) {
+		for _, h := range hosts {
+			if !seen[h] {
+				seen[h] = true
+				all = append(all, h)
+			}
+		}
+	}
+
+	add(c.of(""))
+	for _, hosts := range c.Namespaces {
+		add(hosts)
+	}
+
+	sort.Strings(all)
+	return all
+}
+
+// meshHost returns the primary mesh hostname, the one the mesh Services are
+// named after and discovery hands out
+func meshHost(sidecarConfig *Config) string {
+	return sidecarConfig.MeshHostnames.primary()
+}
+
+// meshDomain returns the domain of the mesh routes, matching every mesh
+// hostname. Callers and destinations may be in different namespaces, so a
+// route is served on the aliases of all of them.
+func meshDomain(sidecarConfig *Config) string {
+	hosts := sidecarConfig.MeshHostnames.All()
+	if len(hosts) == 1 {
+		return hosts[0]
+	}
+
+	quoted := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		quoted = append(quoted, regexp.QuoteMeta(h))
+	}
+
+	// a host template of the gateway router
+	return "{mesh:" + strings.Join(quoted, "|") + "}"
+}
+
+// singleLabel reports whether a hostname can name a Service, which the
+// dnsConfig and service strategies resolve the mesh hostname to
+func singleLabel(host string) bool {
+	return !strings.Contains(host, ".")
+}
@@ -0,0 +1,442 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	corev1 "k8s.io/api/core/v1"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// AdmissionWebhookAnnotationIdentityCertIDKey tracks the client certificate identifying the pod in the mesh
+	AdmissionWebhookAnnotationIdentityCertIDKey = "injector.tyk.io/identity-cert-id"
+
+	// Inbound routes of the pod that accept callers without a workload
+	// identity, e.g. for probes or callers outside the mesh: a comma separated
+	// list of service, replica and the names of ports with routes of their own,
+	// or * for all of them.
+	AdmissionWebhookAnnotationMTLSExemptKey = "injector.tyk.io/mtls-exempt"
+
+	// the sidecar presents the identity certificate on all upstream connections
+	upstreamCertsVarName = "TYK_GW_SECURITY_CERTIFICATES_UPSTREAM"
+
+	// marks the inbound routes exempted from workload identities in their
+	// config data, so updates of the allowed identities leave them open
+	identityExemptKey = "mesh_identity_exempt"
+)
+
+// identityEnv configures the sidecar gateway to present a client certificate to all upstreams
+func identityEnv(certID string) corev1.EnvVar {
+	return corev1.EnvVar{Name: upstreamCertsVarName, Value: "*:" + certID}
+}
+
+// serviceIdentity names the workload identity of a service
+func serviceIdentity(namespace, sName string) string {
+	return namespace + "/" + sName
+}
+
+// InboundSlug returns the slug of the inbound route of a service, or of a
+// port or replica of it. App labels are only unique within a namespace, the
+// slug is qualified with it like the hostname of the route.
+func InboundSlug(namespace, name string) string {
+	return name + "." + namespace + "-inbound"
+}
+
+// MeshSlug returns the slug of the mesh route of a service, or of a port or
+// replica of it, qualified with the namespace like its inbound route
+func MeshSlug(namespace, name string) string {
+	return name + "." + namespace + "-mesh"
+}
+
+// LegacyMeshSlug returns the slug mesh routes were created with before it was
+// qualified with the namespace
+func LegacyMeshSlug(name string) string {
+	return name + "-mesh"
+}
+
+// ResolveMeshSlug returns the slug of the mesh route of a service in an org.
+// A route created for the namespace under the legacy slug keeps it, a new one
+// would serve the same listen path on the mesh hostnames.
+func ResolveMeshSlug(ctx context.Context, cl tyk.Client, namespace, name string) string {
+	legacy := LegacyMeshSlug(name)
+	if def, err := cl.GetBySlug(ctx, legacy); err == nil && meshRouteOf(def, namespace) {
+		return legacy
+	}
+
+	return MeshSlug(namespace, name)
+}
+
+// meshRouteOf reports whether a mesh route was created for a service of a
+// namespace, from its change reason or else the service it targets
+func meshRouteOf(def *objects.DBApiDefinition, namespace string) bool {
+	if r, ok := tyk.ChangeReasonOf(&def.APIDefinition); ok && r.Namespace != "" {
+		return r.Namespace == namespace
+	}
+
+	u, err := url.Parse(def.Proxy.TargetURL)
+	return err == nil && domainNamespace(u.Hostname()) == namespace
+}
+
+// inboundSlug returns the slug of the inbound route of a workload identity
+func inboundSlug(identity string) string {
+	return InboundSlug(identityNamespace(identity), identityService(identity))
+}
+
+// identityExemptions reads the inbound routes a pod exempts from workload
+// identities
+func identityExemptions(pod *corev1.Pod, sidecars []corev1.Container) (map[string]bool, error) {
+	v := strings.TrimSpace(pod.Annotations[AdmissionWebhookAnnotationMTLSExemptKey])
+	if v == "" {
+		return nil, nil
+	}
+
+	ports, err := namedPorts(pod, sidecars)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{"*": true, "service": true, "replica": true}
+	for _, p := range ports {
+		known[p.Name] = true
+	}
+
+	exempt := map[string]bool{}
+	for _, route := range strings.Split(v, ",") {
+		route = strings.TrimSpace(route)
+		if !known[route] {
+			return nil, fmt.Errorf("%v: the pod has no route %q, must be *, service, replica or the name of a port with a route of its own", AdmissionWebhookAnnotationMTLSExemptKey, route)
+		}
+		exempt[route] = true
+	}
+
+	return exempt, nil
+}
+
+// handleWorkloadIdentity gives the service of a pod a client certificate
+// identifying it in the mesh and restricts the inbound routes of all meshed
+// services to callers presenting one of these certificates. The certificate
+// ID is tracked in the pod annotations so the sidecar can be configured to
+// present it when calling other services. Routes the pod exempts accept any
+// caller.
+func (whsvr *WebhookServer) handleWorkloadIdentity(ctx context.Context, cl tyk.Client, pod *corev1.Pod, namespace string, ann map[string]string) error {
+	if !whsvr.SidecarConfig.WorkloadIdentity {
+		return nil
+	}
+
+	if !whsvr.SidecarConfig.EnableMeshTLS {
+		log.Warning("workload identity requires mesh TLS, skipping")
+		return nil
+	}
+
+	sName, ok := pod.Labels["app"]
+	if !ok {
+		return fmt.Errorf("app label is required for a workload identity")
+	}
+
+	ns := namespace
+	if ns == "" {
+		ns = "default"
+	}
+
+	inboundID, ok := ann[AdmissionWebhookAnnotationInboundServiceIDKey]
+	if !ok {
+		return fmt.Errorf("can't require workload identities without an inbound API ID")
+	}
+
+	exempt, err := identityExemptions(pod, whsvr.SidecarConfig.Containers)
+	if err != nil {
+		return err
+	}
+	exempts := func(route string) bool {
+		return exempt["*"] || exempt[route]
+	}
+
+	identity := serviceIdentity(ns, sName)
+	cert, created, err := whsvr.identityCert(ctx, cl, ns, identity, whsvr.identityName(pod, ns, sName))
+	if err != nil {
+		return err
+	}
+
+	ann[AdmissionWebhookAnnotationIdentityCertIDKey] = cert.Bundle.Fingerprint
+
+	certs, err := whsvr.identities(ctx)
+	if err != nil {
+		return err
+	}
+
+	def, err := cl.GetByObjectID(ctx, inboundID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve inbound API definition: %w", err)
+	}
+
+	sas := whsvr.serviceAccountIndex()
+	if err := whsvr.secureInbound(ctx, cl, def, certs, ns, sName, exempts("service"), sas); err != nil {
+		return err
+	}
+
+	for _, id := range portServiceIDs(ann, AdmissionWebhookAnnotationPortInboundServiceIDsKey) {
+		pDef, err := cl.GetByObjectID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve port inbound API definition: %w", err)
+		}
+
+		port := strings.TrimSuffix(strings.TrimPrefix(pDef.Slug, sName+"-"), "."+ns+"-inbound")
+		if err := whsvr.secureInbound(ctx, cl, pDef, certs, ns, sName, exempts(port), sas); err != nil {
+			return err
+		}
+	}
+
+	if replicaID, ok := ann[AdmissionWebhookAnnotationReplicaInboundServiceIDKey]; ok {
+		rDef, err := cl.GetByObjectID(ctx, replicaID)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve replica inbound API definition: %w", err)
+		}
+
+		if err := whsvr.secureInbound(ctx, cl, rDef, certs, ns, sName, exempts("replica"), sas); err != nil {
+			return err
+		}
+	}
+
+	if !created {
+		return nil
+	}
+
+	// a new identity must be allowed to call the services already in the mesh
+	others := make([]string, 0, len(certs))
+	for _, c := range certs {
+		if c.Identity != identity {
+			others = append(others, c.Identity)
+		}
+	}
+	whsvr.updateInboundRoutes(ctx, cl, others, certs)
+
+	return nil
+}
+
+// identities returns the certs of all workload identities
+func (whsvr *WebhookServer) identities(ctx context.Context) ([]*ca.CertModel, error) {
+	certs, err := whsvr.caClient(ctx).ListIdentityCerts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workload identities: %v", err)
+	}
+
+	return certs, nil
+}
+
+// updateInboundRoutes restricts the inbound routes of identities to the
+// certs their trust domain and mesh policies accept
+func (whsvr *WebhookServer) updateInboundRoutes(ctx context.Context, cl tyk.Client, identities []string, certs []*ca.CertModel) {
+	sas := whsvr.serviceAccountIndex()
+	for _, identity := range identities {
+		def, err := cl.GetBySlug(ctx, inboundSlug(identity))
+		if err != nil {
+			log.Warningf("no inbound route found for identity %v: %v", identity, err)
+			continue
+		}
+
+		if err := whsvr.secureInbound(ctx, cl, def, certs, identityNamespace(identity), identityService(identity), identityExempt(def), sas); err != nil {
+			log.Errorf("failed to update allowed identities on %v: %v", identity, err)
+		}
+	}
+}
+
+// RevokeIdentity revokes the workload identity of a service and removes it
+// from the inbound routes of the mesh, cutting its running pods out of the
+// mesh. Pods of the service admitted afterwards are issued a new identity.
+func (whsvr *WebhookServer) RevokeIdentity(ctx context.Context, namespace, service string, reason int) error {
+	identity := serviceIdentity(namespace, service)
+	cert, err := whsvr.caClient(ctx).GetCertByIdentity(identity)
+	if err != nil {
+		return fmt.Errorf("no workload identity found for %v: %v", identity, err)
+	}
+
+	return whsvr.revokeIdentityCert(ctx, namespace, cert, reason)
+}
+
+func (whsvr *WebhookServer) revokeIdentityCert(ctx context.Context, namespace string, cert *ca.CertModel, reason int) error {
+	identity := cert.Identity
+	if err := whsvr.caClient(ctx).Revoke(cert, reason); err != nil {
+		return fmt.Errorf("failed to revoke identity %v: %w", identity, err)
+	}
+	log.Infof("revoked workload identity certificate of %v", identity)
+
+	certs, err := whsvr.identities(ctx)
+	if err != nil {
+		return err
+	}
+
+	cl, err := whsvr.tykClient(namespace, nil)
+	if err != nil {
+		return err
+	}
+
+	affected := []string{identity}
+	for _, c := range certs {
+		if c.Identity != identity {
+			affected = append(affected, c.Identity)
+		}
+	}
+	whsvr.updateInboundRoutes(ctx, cl, affected, certs)
+
+	if err := cl.DeleteCertificate(ctx, cert.Bundle.Fingerprint); err != nil {
+		log.Warningf("failed to remove revoked certificate from tyk: %v", err)
+	} else {
+		whsvr.forgetCert(cert.Bundle.Fingerprint)
+	}
+
+	return nil
+}
+
+// identityName is the name the identity cert is issued for, the SPIFFE ID of
+// the service account of the pod if the CA issues SPIFFE identities and the
+// hostname of the service otherwise
+func (whsvr *WebhookServer) identityName(pod *corev1.Pod, ns, sName string) string {
+	if sc, ok := whsvr.CAClient.(ca.SPIFFEClient); ok {
+		sa := pod.Spec.ServiceAccountName
+		if sa == "" {
+			sa = "default"
+		}
+
+		if id := sc.SPIFFEID(ns, sa); id != "" {
+			return id
+		}
+	}
+
+	return fmt.Sprintf("%s.%s", sName, ns)
+}
+
+// identityCert returns the client certificate of a workload identity,
+// minting and uploading a new one if there is none, it has expired or was
+// signed by a root being rotated out
+func (whsvr *WebhookServer) identityCert(ctx context.Context, cl tyk.Client, namespace, identity, name string) (*ca.CertModel, bool, error) {
+	cert, err := whsvr.caClient(ctx).GetCertByIdentity(identity)
+	if err == nil && cert != nil && cert.Expires.After(time.Now()) {
+		if !whsvr.staleCert(cert) {
+			return cert, false, nil
+		}
+
+		// the stale cert may outlive the one reissued by the new root
+		if fresh := whsvr.reissuedIdentity(ctx, identity); fresh != nil {
+			return fresh, false, nil
+		}
+	}
+
+	bdl, err := whsvr.generateCert(ctx, namespace, name)
+	if err != nil {
+		return nil, false, fmt.Errorf("can't generate identity certificate: %w", err)
+	}
+
+	certID, err := cl.CreateCertificate(ctx, bdl.Certificate, bdl.PrivateKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to upload identity certificate to tyk secure store: %w", err)
+	}
+	bdl.Fingerprint = certID
+	whsvr.recordOwnedCert(certID, "", store.Owner{Kind: "Identity", Namespace: namespace, Name: identity})
+
+	cert = ca.NewCertModel(bdl)
+	cert.Identity = identity
+	if _, err := whsvr.caClient(ctx).StoreCert(cert); err != nil {
+		return nil, false, fmt.Errorf("failed to store identity certificate in controller store: %v", err)
+	}
+
+	log.Infof("minted workload identity certificate for %v", identity)
+	return cert, true, nil
+}
+
+// reissuedIdentity returns the cert of an identity signed by the new root of
+// a rotation, nil if it wasn't reissued yet
+func (whsvr *WebhookServer) reissuedIdentity(ctx context.Context, identity string) *ca.CertModel {
+	certs, err := whsvr.caClient(ctx).ListIdentityCerts()
+	if err != nil {
+		log.Warningf("failed to list workload identities: %v", err)
+		return nil
+	}
+
+	for _, c := range certs {
+		if c.Identity == identity && !whsvr.staleCert(c) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// staleCert reports whether a cert was signed by a root being rotated out
+func (whsvr *WebhookServer) staleCert(cm *ca.CertModel) bool {
+	rot, ok := whsvr.CAClient.(ca.Rotator)
+	return ok && rot.StaleCert(cm)
+}
+
+// secureInbound applies the workload identities and mesh policies of a
+// service to one of its inbound routes, exempt routes accept any caller. The
+// service accounts of the callers are looked up in sas.
+func (whsvr *WebhookServer) secureInbound(ctx context.Context, cl tyk.Client, def *objects.DBApiDefinition, certs []*ca.CertModel, namespace, service string, exempt bool, sas *serviceAccountIndex) error {
+	allowed, rules := whsvr.inboundAccess(certs, namespace, service, sas)
+	changed := applyIdentities(def, allowed, exempt)
+	if applyPathRules(def, rules) {
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := cl.UpdateAPI(ctx, &def.APIDefinition); err != nil {
+		return fmt.Errorf("failed to update workload identities on %v: %w", def.Slug, err)
+	}
+
+	return nil
+}
+
+// applyIdentities requires the given client certificates on an inbound
+// route, or opens it to any caller if it is exempt, and reports whether it
+// changed
+func applyIdentities(def *objects.DBApiDefinition, allowed []string, exempt bool) bool {
+	if identityExempt(def) == exempt && def.UseMutualTLSAuth != exempt && (exempt || stringsEqual(def.ClientCertificates, allowed)) {
+		return false
+	}
+
+	if exempt {
+		def.UseMutualTLSAuth = false
+		def.ClientCertificates = nil
+		if def.ConfigData == nil {
+			def.ConfigData = map[string]interface{}{}
+		}
+		def.ConfigData[identityExemptKey] = true
+	} else {
+		def.UseMutualTLSAuth = true
+		def.ClientCertificates = allowed
+		delete(def.ConfigData, identityExemptKey)
+	}
+
+	return true
+}
+
+// identityExempt reports whether the pod of an inbound route exempts it from
+// workload identities
+func identityExempt(def *objects.DBApiDefinition) bool {
+	exempt, _ := def.ConfigData[identityExemptKey].(bool)
+	return exempt
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
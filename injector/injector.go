@@ -1,25 +1,37 @@
 package injector
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ghodss/yaml"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"k8s.io/api/admission/v1beta1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
-	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 
 	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/kube"
 	"go.jlucktay.dev/tyk-k8s/logger"
+	"go.jlucktay.dev/tyk-k8s/processor"
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tracing"
 	"go.jlucktay.dev/tyk-k8s/tyk"
 )
 
@@ -41,22 +53,41 @@ const (
 	AdmissionWebhookAnnotationInjectKey = "injector.tyk.io/inject"
 	admissionWebhookAnnotationRouteKey  = "injector.tyk.io/route"
 
+	// AdmissionWebhookInjectNever opts a pod out of injection for good, unlike
+	// other values of the inject annotation it is kept on the pod
+	AdmissionWebhookInjectNever = "never"
+	// Comma separated names of the containers that don't get the CA volume mount
+	AdmissionWebhookAnnotationExcludeContainersKey = "injector.tyk.io/exclude-containers"
+
 	// Internally used by mesh to track API IDs and state
 	AdmissionWebhookAnnotationStatusKey           = "injector.tyk.io/status"
 	AdmissionWebhookAnnotationInboundServiceIDKey = "injector.tyk.io/inbound-service-id"
 	AdmissionWebhookAnnotationMeshServiceIDKey    = "injector.tyk.io/mesh-service-id"
 
-	// Advanced mesh keys for group access policies TBC
+	// Deprecated: never enforced, authorize callers with MeshPolicy resources
 	AdmissionWebhookAnnotationGroupKey            = "injector.tyk.io/group"
 	AdmissionWebhookAnnotationAllowedCallerGroups = "injector.tyk.io/caller-access-groups"
 
-	meshTag = "mesh"
+	defaultClusterDomain = "cluster.local"
 )
 
 type WebhookServer struct {
 	SidecarConfig *Config
 	CAConfig      *ca.Config
 	CAClient      ca.CertClient
+	KubeClient    kubernetes.Interface
+	TykClients    tyk.Resolver      // defaults to tyk.ClientFor
+	State         store.Store       // records the APIs and certs created, optional
+	DynamicClient dynamic.Interface // reads the MeshPolicies, optional
+
+	policyMu sync.Mutex
+	policy   *policyEngine // compiled admission policies, loaded on first use
+
+	meshPolicies meshPolicyCache
+	directory    meshDirectory
+
+	meshCertMu      sync.RWMutex // guards SidecarConfig.MeshCertificateID, replaced during CA rotations
+	retiredMeshCert string       // mesh cert replaced during a CA rotation that mesh routes may still use
 }
 
 type Config struct {
@@ -65,6 +96,164 @@ type Config struct {
 	CreateRoutes      bool               `yaml:"createRoutes"`
 	EnableMeshTLS     bool               `yaml:"enableMeshTLS"`
 	MeshCertificateID string             `yaml:"meshCertificateID"`
+	WebhookConfigName string             `yaml:"webhookConfigName"` // MutatingWebhookConfiguration to remove on shutdown
+	FailOpen          bool               `yaml:"failOpen"`          // deprecated: use failurePolicy open
+	FailurePolicy     string             `yaml:"failurePolicy"`     // open admits pods uninjected while Tyk or the CA are unhealthy, closed (default) rejects them
+	WorkloadIdentity  bool               `yaml:"workloadIdentity"`  // mint client certs per service and require them on inbound routes
+	ClusterDomain     string             `yaml:"clusterDomain"`     // DNS domain of the cluster, cluster.local if unset
+	CAMountPath       string             `yaml:"caMountPath"`       // directory the trust store with the mesh CA is mounted at, /etc/ssl/certs if unset
+	MergeCABundle     bool               `yaml:"mergeCABundle"`     // only mount the merged bundle file over caBundleFile, keeping the distro trust store
+	CABundleFile      string             `yaml:"caBundleFile"`      // mergeCABundle: bundle file read by the containers, /etc/ssl/certs/ca-certificates.crt if unset
+	PinSidecarDigest  bool               `yaml:"pinSidecarDigest"`  // resolve the tag of the sidecar image to a digest on start-up
+	MeshDNS           string             `yaml:"meshDNS"`           // how pods resolve the mesh hostname: hostAlias (default), dnsConfig or service
+	MeshGatewayIP     string             `yaml:"meshGatewayIP"`     // hostAlias: address of the mesh gateway, the sidecar if unset
+	IPFamilies        []string           `yaml:"ipFamilies"`        // hostAlias: families of the pod network, IPv4 and/or IPv6, IPv4 if unset
+	MeshSearchDomain  string             `yaml:"meshSearchDomain"`  // dnsConfig: domain of the mesh gateway Service, e.g. tyk.svc.cluster.local
+	MeshGatewayHost   string             `yaml:"meshGatewayHost"`   // service: DNS name of the shared mesh gateway
+	DefaultAppLabel   bool               `yaml:"defaultAppLabel"`   // derive a missing app label from the owner or generateName of the pod
+	NoDownwardEnv     bool               `yaml:"noDownwardEnv"`     // don't expose the pod name, namespace and IP and the node name to the gateway container
+	Restricted        bool               `yaml:"restricted"`        // harden the injected containers for the restricted Pod Security Standard, without iptables
+
+	// merged into the pod spec so the sidecar images can be pulled from private
+	// registries and run under restricted PodSecurity levels
+	ImagePullSecrets []corev1.LocalObjectReference `yaml:"imagePullSecrets"` // added to the pod unless it has them
+	RuntimeClassName string                        `yaml:"runtimeClassName"` // set on pods without a runtime class
+	SecurityContext  *corev1.SecurityContext       `yaml:"securityContext"`  // defaults of the injected containers, fields they set are kept
+
+	CertRotationThreshold time.Duration `yaml:"certRotationThreshold"` // renew server certs expiring within this period, disabled if 0
+	CertRotationInterval  time.Duration `yaml:"certRotationInterval"`  // how often to check for expiring certs
+
+	CAInit CAInitConfig `yaml:"caInit"` // fetch the mesh CA at runtime instead of mounting the ca-pem ConfigMap
+	Policy PolicyConfig `yaml:"policy"` // Rego policies deciding whether pods and services may be injected
+
+	SidecarLog SidecarLogConfig `yaml:"sidecarLog"` // logging of the injected gateways
+
+	WebhookPaths WebhookPaths `yaml:"webhookPaths"` // paths of the admission endpoints
+
+	MeshHostnames MeshHostnameConf `yaml:"meshHostnames"` // hostnames of the mesh gateway, cluster-wide and by namespace
+
+	TrustDomains TrustDomainConf `yaml:"trustDomains"` // namespaces whose workload identities the inbound routes of a namespace accept
+	MeshPolicies MeshPolicyConf  `yaml:"meshPolicies"` // authorize calls between services with MeshPolicy resources
+
+	NetworkPolicies NetworkPolicyConf `yaml:"networkPolicies"` // keep pods from calling each other around their sidecars
+
+	Discovery DiscoveryConf `yaml:"discovery"` // access to and caching of the list of mesh services
+}
+
+// Validate checks the sidecar configuration, all problems found are returned
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+
+	if len(c.Containers) == 0 {
+		errs = append(errs, fmt.Errorf("containers: at least the sidecar container is required"))
+	}
+
+	meshCnt := false
+	for i, cnt := range c.Containers {
+		errs = append(errs, validateContainer(fmt.Sprintf("containers[%d]", i), &cnt)...)
+		if strings.ToLower(cnt.Name) == "tyk-mesh" {
+			meshCnt = true
+		}
+	}
+
+	// the gateway is tagged and given its identity through the tyk-mesh container
+	if len(c.Containers) > 0 && !meshCnt {
+		errs = append(errs, fmt.Errorf("containers: no container named tyk-mesh"))
+	}
+
+	for i, cnt := range c.InitContainers {
+		errs = append(errs, validateContainer(fmt.Sprintf("initContainers[%d]", i), &cnt)...)
+	}
+
+	errs = append(errs, c.CAInit.Validate(c.InitContainers)...)
+	errs = append(errs, c.Policy.Validate()...)
+	errs = append(errs, c.WebhookPaths.Validate()...)
+	errs = append(errs, c.SidecarLog.Validate()...)
+	errs = append(errs, c.validateRestricted()...)
+	errs = append(errs, c.validateIPFamilies()...)
+	errs = append(errs, c.MeshHostnames.Validate()...)
+	errs = append(errs, c.TrustDomains.Validate()...)
+	errs = append(errs, c.NetworkPolicies.Validate()...)
+	errs = append(errs, c.Discovery.Validate()...)
+
+	if c.MeshDNS == MeshDNSSearch || c.MeshDNS == MeshDNSService {
+		if h := meshHost(c); !singleLabel(h) {
+			errs = append(errs, fmt.Errorf("meshHostnames: the %v mesh DNS strategy resolves the primary hostname to a Service, %q must be a single label", c.MeshDNS, h))
+		}
+	}
+
+	if c.WorkloadIdentity && !c.EnableMeshTLS {
+		errs = append(errs, fmt.Errorf("workloadIdentity: requires enableMeshTLS"))
+	}
+
+	if c.TrustDomains.Enabled && !c.WorkloadIdentity {
+		errs = append(errs, fmt.Errorf("trustDomains: requires workloadIdentity"))
+	}
+
+	if c.MeshPolicies.Enabled && !c.WorkloadIdentity {
+		errs = append(errs, fmt.Errorf("meshPolicies: requires workloadIdentity"))
+	}
+
+	if c.CertRotationThreshold < 0 || c.CertRotationInterval < 0 {
+		errs = append(errs, fmt.Errorf("certRotationThreshold and certRotationInterval must not be negative"))
+	}
+
+	if c.CAMountPath != "" && !path.IsAbs(c.CAMountPath) {
+		errs = append(errs, fmt.Errorf("caMountPath: %q is not an absolute path", c.CAMountPath))
+	}
+
+	if c.CABundleFile != "" && !path.IsAbs(c.CABundleFile) {
+		errs = append(errs, fmt.Errorf("caBundleFile: %q is not an absolute path", c.CABundleFile))
+	}
+
+	switch c.FailurePolicy {
+	case "", FailurePolicyOpen, FailurePolicyClosed:
+	default:
+		errs = append(errs, fmt.Errorf("failurePolicy: unknown policy %q, must be %v or %v", c.FailurePolicy, FailurePolicyOpen, FailurePolicyClosed))
+	}
+
+	switch {
+	case c.MeshDNS == "" || c.MeshDNS == MeshDNSHostAlias:
+	case c.MeshDNS == MeshDNSSearch && c.MeshSearchDomain == "":
+		errs = append(errs, fmt.Errorf("meshSearchDomain: required by the %v mesh DNS strategy", MeshDNSSearch))
+	case !validMeshDNS(c.MeshDNS):
+		errs = append(errs, fmt.Errorf("meshDNS: unknown strategy %q, must be %v, %v or %v", c.MeshDNS, MeshDNSHostAlias, MeshDNSSearch, MeshDNSService))
+	}
+
+	if c.MeshGatewayIP != "" && net.ParseIP(c.MeshGatewayIP) == nil {
+		errs = append(errs, fmt.Errorf("meshGatewayIP: %q is not an IP address", c.MeshGatewayIP))
+	}
+
+	// pods can opt into any strategy with an annotation
+	if c.MeshDNS == MeshDNSService && c.MeshGatewayHost == "" {
+		errs = append(errs, fmt.Errorf("meshGatewayHost: required by the %v mesh DNS strategy", MeshDNSService))
+	}
+
+	if strings.HasPrefix(c.ClusterDomain, ".") || strings.HasSuffix(c.ClusterDomain, ".") {
+		errs = append(errs, fmt.Errorf("clusterDomain: %q must not start or end with a dot", c.ClusterDomain))
+	}
+
+	return errs
+}
+
+func validateContainer(path string, cnt *corev1.Container) []error {
+	errs := make([]error, 0)
+
+	if cnt.Name == "" {
+		errs = append(errs, fmt.Errorf("%v: name is required", path))
+	}
+
+	if cnt.Image == "" {
+		errs = append(errs, fmt.Errorf("%v: image is required", path))
+	}
+
+	for _, p := range cnt.Ports {
+		if p.ContainerPort < 1 || p.ContainerPort > 65535 {
+			errs = append(errs, fmt.Errorf("%v: containerPort %d must be between 1 and 65535", path, p.ContainerPort))
+		}
+	}
+
+	return errs
 }
 
 type namedThing struct {
@@ -120,8 +309,13 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
 
 	// determine whether to perform mutation based on annotation for the target resource
 	var required bool
-	if strings.ToLower(status) == "injected" {
+	if strings.ToLower(annotations[AdmissionWebhookAnnotationInjectKey]) == AdmissionWebhookInjectNever {
 		required = false
+	} else if strings.ToLower(status) == "injected" {
+		required = false
+	} else if strings.ToLower(status) == StatusOfflineInjected {
+		// the routes of pods injected by `tyk-k8s inject` are created on admission
+		required = true
 	} else {
 		switch strings.ToLower(annotations[AdmissionWebhookAnnotationInjectKey]) {
 		default:
@@ -141,15 +335,6 @@ func addContainer(pod *corev1.Pod, added []corev1.Container) *corev1.PodSpec {
 		spec.Containers = []corev1.Container{}
 	}
 
-	if len(spec.HostAliases) == 0 {
-		spec.HostAliases = []corev1.HostAlias{}
-	}
-
-	spec.HostAliases = append(spec.HostAliases, corev1.HostAlias{
-		IP:        "127.0.0.1",
-		Hostnames: []string{"mesh", "mesh.local"},
-	})
-
 	for idx := range added {
 		spec.Containers = append(spec.Containers, added[idx])
 	}
@@ -183,28 +368,14 @@ func updateAnnotation(target, added map[string]string) (patch []patchOperation)
 	return patch
 }
 
-func mutateService(svc *corev1.Service, basePath string, sidecarConfig *Config) (patch []patchOperation) {
-	var sidecarPort int32 = 8080
-
-	sidecarSvcPort := &corev1.ServicePort{
-		Name: "tyk-sidecar",
-		Port: sidecarPort,
-		TargetPort: intstr.IntOrString{
-			IntVal: sidecarPort,
-		},
-	}
-
-	opp := "replace"
-	path := "/spec/ports/0"
-	if len(svc.Spec.Ports) > 1 {
-		opp = "add"
-		path = "/spec/ports"
-	}
+// port of the sidecar added to injected services
+const sidecarServicePort int32 = 8080
 
+func mutateService(svc *corev1.Service, basePath string, routed map[string]bool) (patch []patchOperation) {
 	patch = append(patch, patchOperation{
-		Op:    opp,
-		Path:  path,
-		Value: sidecarSvcPort,
+		Op:    "replace",
+		Path:  basePath,
+		Value: servicePorts(svc, routed),
 	})
 
 	return patch
@@ -215,6 +386,23 @@ func addVolume(spec *corev1.PodSpec, sidecarConfig *Config) *corev1.PodSpec {
 		return spec
 	}
 
+	sslCerts := corev1.Volume{
+		Name: certVolumenName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	}
+
+	if spec.Volumes == nil {
+		spec.Volumes = []corev1.Volume{}
+	}
+
+	// the CA init container fetches the CA instead
+	if sidecarConfig.CAInit.Enabled {
+		spec.Volumes = append(spec.Volumes, sslCerts)
+		return spec
+	}
+
 	// Add the overall shared volume
 	volume := corev1.Volume{
 		Name: volName,
@@ -227,16 +415,6 @@ func addVolume(spec *corev1.PodSpec, sidecarConfig *Config) *corev1.PodSpec {
 		},
 	}
 
-	sslCerts := corev1.Volume{
-		Name: certVolumenName,
-		VolumeSource: corev1.VolumeSource{
-			EmptyDir: &corev1.EmptyDirVolumeSource{},
-		},
-	}
-
-	if spec.Volumes == nil {
-		spec.Volumes = []corev1.Volume{}
-	}
 	spec.Volumes = append(spec.Volumes, volume)
 	spec.Volumes = append(spec.Volumes, sslCerts)
 
@@ -248,25 +426,47 @@ var (
 	certVolumenName = "ssl-certs"
 )
 
-func injectCAVolume(spec *corev1.PodSpec, sidecarConfig *Config) *corev1.PodSpec {
+// excludedContainers returns the names of the containers of a pod that
+// don't get the CA volume mount
+func excludedContainers(pod *corev1.Pod) map[string]bool {
+	excluded := map[string]bool{}
+	for _, name := range strings.Split(pod.Annotations[AdmissionWebhookAnnotationExcludeContainersKey], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			excluded[name] = true
+		}
+	}
+
+	return excluded
+}
+
+func injectCAVolume(pod *corev1.Pod, sidecarConfig *Config) *corev1.PodSpec {
+	spec := &pod.Spec
 	if !sidecarConfig.EnableMeshTLS {
 		return spec
 	}
 
+	excluded := excludedContainers(pod)
+	caMount := caVolumeMounts(pod, sidecarConfig)
+
 	// path := fmt.Sprintf("/spec/containers")
 	for idx := range spec.Containers {
-		// Mount SSL certs from the init container
-		volumeMount := corev1.VolumeMount{
-			Name:      certVolumenName,
-			MountPath: "/etc/ssl/certs",
+		// some images break when their CA bundle is replaced
+		if excluded[spec.Containers[idx].Name] {
+			log.Infof("not mounting the CA volume into excluded container %v", spec.Containers[idx].Name)
+			continue
 		}
 
+		// Mount SSL certs from the init container
+		volumeMount := caMount(spec.Containers[idx].Name)
+
 		// If there is no section, add
 		if spec.Containers[idx].VolumeMounts == nil {
 			log.Info("adding new mount section")
 			spec.Containers[idx].VolumeMounts = []corev1.VolumeMount{}
 		}
-		spec.Containers[idx].VolumeMounts = append(spec.Containers[idx].VolumeMounts, volumeMount)
+		// cap the slice so the append never writes into a mount list shared with the sidecar template
+		mounts := spec.Containers[idx].VolumeMounts
+		spec.Containers[idx].VolumeMounts = append(mounts[:len(mounts):len(mounts)], volumeMount)
 	}
 
 	return spec
@@ -275,27 +475,53 @@ func injectCAVolume(spec *corev1.PodSpec, sidecarConfig *Config) *corev1.PodSpec
 // add tags to the gateway container
 const tagVarName = "TYK_GW_DBAPPCONFOPTIONS_TAGS"
 
-// TODO: For some reason this starts appending the same (or different) tags after multiple deployments
-func preProcessContainerTpl(pod *corev1.Pod, containers []corev1.Container) []corev1.Container {
-	sName, ok := pod.Labels["app"]
-	if !ok {
-		sName = pod.GenerateName + "please-set-app-label"
+func hasEnv(env []corev1.EnvVar, name string) bool {
+	for _, v := range env {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setEnv updates or appends an env var, returning a copy of the env
+func setEnv(env []corev1.EnvVar, v corev1.EnvVar) []corev1.EnvVar {
+	out := make([]corev1.EnvVar, 0, len(env)+1)
+	found := false
+	for _, envVal := range env {
+		if envVal.Name == v.Name {
+			// update the existing variable
+			envVal = v
+			found = true
+		}
+		out = append(out, envVal)
 	}
 
-	tags := fmt.Sprintf("mesh,%s", sName)
-	tagEnv := corev1.EnvVar{Name: tagVarName, Value: tags}
+	if !found {
+		// no exiting var found, create
+		out = append(out, v)
+	}
+
+	return out
+}
+
+// The configured containers are shared by all admissions and must not be
+// modified, the env, command and args are copied before the template
+// variables are substituted, all other sections are shared with the template
+func preProcessContainerTpl(pod *corev1.Pod, tpl []corev1.Container) []corev1.Container {
+	containers := substituteVars(tpl, podVars(pod))
 	for i, cnt := range containers {
 		if strings.ToLower(cnt.Name) == "tyk-mesh" {
-			for ei, envVal := range containers[i].Env {
-				if envVal.Name == tagVarName {
-					// update the existing variable
-					containers[i].Env[ei] = tagEnv
-					return containers
-				}
+			// the tags can be extended in the config with the {MESH_TAGS} variable
+			env := cnt.Env
+			if !hasEnv(env, tagVarName) {
+				env = setEnv(env, corev1.EnvVar{Name: tagVarName, Value: meshTags(pod)})
+			}
+			if certID, ok := pod.Annotations[AdmissionWebhookAnnotationIdentityCertIDKey]; ok && certID != "" {
+				env = setEnv(env, identityEnv(certID))
 			}
 
-			// no exiting var found, create
-			containers[i].Env = append(cnt.Env, corev1.EnvVar{Name: tagVarName, Value: tags})
+			containers[i].Env = env
 			break
 		}
 	}
@@ -303,28 +529,60 @@ func preProcessContainerTpl(pod *corev1.Pod, containers []corev1.Container) []co
 	return containers
 }
 
+// mutatePodSpec adds the sidecar, init containers and volumes to the spec of the pod
+func mutatePodSpec(pod *corev1.Pod, sidecarConfig *Config) *corev1.PodSpec {
+	containers := preProcessContainerTpl(pod, sidecarConfig.Containers)
+	if !sidecarConfig.NoDownwardEnv {
+		containers = addDownwardEnv(containers)
+	}
+	containers = addLogEnv(pod, containers, sidecarConfig)
+	containers = addPortEnv(pod, containers, sidecarConfig)
+	inits := substituteVars(initContainers(sidecarConfig), podVars(pod))
+
+	containers = withSecurityDefaults(containers, sidecarConfig.SecurityContext)
+	inits = withSecurityDefaults(inits, sidecarConfig.SecurityContext)
+	if sidecarConfig.Restricted {
+		containers, inits = harden(containers), harden(inits)
+		addRestrictedVolume(&pod.Spec)
+	}
+
+	spec := addContainer(pod, containers)
+	spec = addMeshDNS(pod, sidecarConfig)
+	spec = addInitContainer(spec, inits)
+	spec = addPodDefaults(spec, sidecarConfig)
+	spec = addVolume(spec, sidecarConfig)
+	return injectCAVolume(pod, sidecarConfig)
+}
+
 // create mutation patch for resoures
-func createPatch(pod *corev1.Pod, svc *corev1.Service, sidecarConfig *Config, annotations map[string]string) ([]byte, error) {
+func createPatch(pod *corev1.Pod, sidecarConfig *Config, annotations, labels map[string]string) ([]byte, error) {
 	var patch []patchOperation
 
-	if svc != nil {
-		patch = append(patch, mutateService(svc, "/spec/ports", sidecarConfig)...)
-		return json.Marshal(patch)
-	}
+	// the sidecar of pods injected offline is in their spec already
+	if !hasSidecar(pod, sidecarConfig) {
+		spec := mutatePodSpec(pod, sidecarConfig)
 
-	spec := addContainer(pod, preProcessContainerTpl(pod, sidecarConfig.Containers))
-	spec = addInitContainer(spec, sidecarConfig.InitContainers)
-	spec = addVolume(spec, sidecarConfig)
-	spec = injectCAVolume(spec, sidecarConfig)
+		patch = append(patch, patchOperation{
+			Op:    "replace",
+			Path:  "/spec",
+			Value: spec,
+		})
 
-	patch = append(patch, patchOperation{
-		Op:    "replace",
-		Path:  "/spec",
-		Value: spec,
-	})
+		if sidecarConfig.Restricted {
+			patch = append(patch, restrictedPatch(spec, len(sidecarConfig.Containers), len(initContainers(sidecarConfig)))...)
+		}
+	}
 
 	patch = append(patch, updateAnnotation(pod.Annotations, annotations)...)
 
+	if labels != nil {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/labels",
+			Value: labels,
+		})
+	}
+
 	return json.Marshal(patch)
 }
 
@@ -342,8 +600,43 @@ func checkAndGetTemplate(pd *corev1.Pod, isMesh bool) string {
 	return tyk.DefaultInboundTemplate
 }
 
+// podChangeReason ties the routes created for a pod to its admission request,
+// the pod UID is usually not assigned yet at admission time
+func podChangeReason(pod *corev1.Pod, req *v1beta1.AdmissionRequest) *tyk.ChangeReason {
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+
+	r := tyk.NewChangeReason("Pod", req.Namespace, name, string(pod.UID))
+	r.AdmissionUID = string(req.UID)
+	return r
+}
+
+// meshAnnotations combines the generated upstream TLS settings with the
+// processor overrides and the rate limit and quota of the pod, explicit pod
+// overrides take precedence
+func meshAnnotations(podAnn, upstreamAnn map[string]string) map[string]string {
+	ann := map[string]string{}
+	for k, v := range upstreamAnn {
+		ann[k] = v
+	}
+
+	for k, v := range processor.Filter(podAnn) {
+		ann[k] = v
+	}
+
+	for _, k := range []string{tyk.PolicyRateAnnotation, tyk.PolicyQuotaAnnotation} {
+		if v, ok := podAnn[k]; ok {
+			ann[k] = v
+		}
+	}
+
+	return ann
+}
+
 // create service routes
-func createServiceRoutes(pod *corev1.Pod, annotations map[string]string, namespace string, tls bool) (map[string]string, error) {
+func (whsvr *WebhookServer) createServiceRoutes(ctx context.Context, cl tyk.Client, pod *corev1.Pod, annotations map[string]string, namespace string, tls bool, reason *tyk.ChangeReason) (map[string]string, error) {
 	_, idExists := annotations[AdmissionWebhookAnnotationInboundServiceIDKey]
 	if idExists {
 		return annotations, nil
@@ -351,7 +644,7 @@ func createServiceRoutes(pod *corev1.Pod, annotations map[string]string, namespa
 
 	sName, ok := pod.Labels["app"]
 	if !ok {
-		return annotations, errors.New("app label is required")
+		return annotations, errors.New("app label is required, set it or enable defaultAppLabel")
 	}
 
 	ns := namespace
@@ -359,45 +652,56 @@ func createServiceRoutes(pod *corev1.Pod, annotations map[string]string, namespa
 		ns = "default"
 	}
 
+	podAnn, err := kube.ResolveLocalOverrides(whsvr.KubeClient, ns, pod.Annotations)
+	if err != nil {
+		return annotations, err
+	}
+
+	var pt int32
+	pt = 8080
+
+	target, err := inboundTarget(pod, whsvr.SidecarConfig)
+	if err != nil {
+		return annotations, err
+	}
+
 	hName := fmt.Sprintf("%s.%s", sName, ns)
-	slugID := sName + "-inbound"
+	slugID := InboundSlug(ns, sName)
 	// inbound listener
 	opts := &tyk.APIDefOptions{
 		Slug:         slugID,
-		Target:       "http://localhost:6767",
+		Target:       target,
 		ListenPath:   "/",
 		TemplateName: checkAndGetTemplate(pod, false),
 		Hostname:     hName,
-		Name:         slugID,
+		Name:         sName + "-inbound",
 		Tags:         []string{sName},
-		Annotations:  annotations,
+		Annotations:  inboundAnnotations(podAnn, target),
+		ChangeReason: reason,
+		Namespace:    ns,
+		Labels:       pod.Labels,
+		Mesh:         true,
+		RedactBodies: whsvr.SidecarConfig.SidecarLog.RedactBodies,
+		ServiceName:  sName,
+		ServicePort:  pt,
 	}
 
-	ibID := ""
-	inboundDef, doNotSkip := tyk.GetBySlug(opts.Slug)
-	if doNotSkip != nil {
-		// error means this service hasn't been created yet
-		inboundID, err := tyk.CreateService(opts)
-		if err != nil {
-			return annotations, fmt.Errorf("failed to create inbound service %v: %v", slugID, err.Error())
-		}
-
-		ibID = inboundID
-	} else {
-		ibID = inboundDef.Id.Hex()
+	// admission retries and replicas of the same pod share one inbound route
+	ibID, _, err := cl.CreateOrGetService(ctx, opts)
+	if err != nil {
+		return annotations, fmt.Errorf("failed to create inbound service %v: %w", slugID, err)
 	}
 
 	annotations[AdmissionWebhookAnnotationInboundServiceIDKey] = ibID
+	whsvr.recordAPI(ibID, slugID, pod, ns)
 
 	// mesh route points to the *service* so we can enable load balancing
-	var pt int32
-	pt = 8080
 
 	tr := "http"
 	if tls {
 		tr = "https"
 	}
-	tgt := fmt.Sprintf("%s://%s:%d", tr, hName, pt)
+	tgt := hostURL(tr, hName, pt)
 	listenPath := sName
 	for k, v := range pod.Annotations {
 		if k == admissionWebhookAnnotationRouteKey {
@@ -405,81 +709,220 @@ func createServiceRoutes(pod *corev1.Pod, annotations map[string]string, namespa
 		}
 	}
 
-	meshID := ""
-	meshSlugID := sName + "-mesh"
+	upstreamAnn, tgt, err := whsvr.upstreamTLSOptions(ctx, cl, pod, ns, tgt)
+	if err != nil {
+		return annotations, err
+	}
+
+	mirrorAnn, err := mirrorOptions(pod, sName, ns, listenPath, pt, tls)
+	if err != nil {
+		return annotations, err
+	}
+	for k, v := range mirrorAnn {
+		upstreamAnn[k] = v
+	}
+
+	routeAnn, err := headerRouteOptions(pod, sName, ns, listenPath, pt, tls)
+	if err != nil {
+		return annotations, err
+	}
+	for k, v := range routeAnn {
+		upstreamAnn[k] = v
+	}
+
+	resilienceAnn, err := resilienceOptions(pod)
+	if err != nil {
+		return annotations, err
+	}
+	for k, v := range resilienceAnn {
+		upstreamAnn[k] = v
+	}
+
+	meshSlugID := ResolveMeshSlug(ctx, cl, ns, sName)
 	// meshHostName := fmt.Sprintf("%s.mesh", sName)
 	meshOpts := &tyk.APIDefOptions{
 		Slug:         meshSlugID,
 		Target:       tgt,
 		ListenPath:   listenPath,
 		TemplateName: checkAndGetTemplate(pod, true),
-		Hostname:     "mesh",
-		Name:         meshSlugID,
-		Tags:         []string{meshTag},
+		Hostname:     meshDomain(whsvr.SidecarConfig),
+		Name:         LegacyMeshSlug(sName),
+		Tags:         tyk.Segments(tyk.SegmentMesh, ns, pod.Annotations),
+		ChangeReason: reason,
+		Namespace:    ns,
+		Labels:       pod.Labels,
+		Mesh:         true,
+		RedactBodies: whsvr.SidecarConfig.SidecarLog.RedactBodies,
+		ServiceName:  sName,
+		ServicePort:  pt,
 	}
 
-	meshDef, doNotSkipMesh := tyk.GetBySlug(meshOpts.Slug)
-	if doNotSkipMesh != nil {
-		// error means this service hasn't been created yet
-		mId, err := tyk.CreateService(meshOpts)
-		if err != nil {
-			return annotations, fmt.Errorf("failed to create mesh service %v: %v", meshSlugID, err.Error())
-		}
-		meshID = mId
-	} else {
-		meshID = meshDef.Id.Hex()
+	meshOpts.Annotations = meshAnnotations(podAnn, upstreamAnn)
+
+	meshID, _, err := cl.CreateOrGetService(ctx, meshOpts)
+	if err != nil {
+		return annotations, fmt.Errorf("failed to create mesh service %v: %w", meshSlugID, err)
 	}
 
 	annotations[AdmissionWebhookAnnotationMeshServiceIDKey] = meshID
+	whsvr.recordAPI(meshID, meshSlugID, pod, ns)
+
+	annotations, err = whsvr.createPortRoutes(ctx, cl, pod, annotations, sName, ns, listenPath, podAnn, tls, reason)
+	if err != nil {
+		return annotations, err
+	}
 
-	return annotations, nil
+	return whsvr.createReplicaRoutes(ctx, cl, pod, annotations, sName, ns, podAnn, tls, reason)
 }
 
-func (whsvr *WebhookServer) generateStoreAndRegisterCertForAPIDef(sid, byoCert string) error {
+// generateStoreAndRegisterCertForAPIDef adds a server certificate to an API
+// definition, registering it again is a no-op as long as it is valid
+func (whsvr *WebhookServer) generateStoreAndRegisterCertForAPIDef(ctx context.Context, cl tyk.Client, sid, byoCert string) error {
 	// Allow us to just manually set a cert ID
 	certID := byoCert
 	if byoCert == "" {
-		certID = ""
-		serverCert, err := whsvr.generateServerCert(sid)
+		var err error
+		certID, err = whsvr.serverCertID(ctx, cl, sid)
 		if err != nil {
-			return fmt.Errorf("can't generate certificate: %v", err)
+			return err
 		}
-		log.Info("MeshTLS: generated server certificate")
+		whsvr.recordCert(certID, sid)
+	}
 
-		certID, err = tyk.CreateCertificate(serverCert.Bundle.Bundled, serverCert.Bundle.PrivateKey)
-		if err != nil {
-			return fmt.Errorf("failed to upload certificate to tyk secure store: %v", err)
+	aDef, err := cl.GetByObjectID(ctx, sid)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve API definition: %w", err)
+	}
+
+	// certs the stored server cert of the API replaced are superseded
+	superseded := map[string]bool{}
+	if stored, err := whsvr.caClient(ctx).GetServerCertByLinkedAPIID(sid); err == nil {
+		for _, b := range stored.BundleHistory {
+			superseded[b.Fingerprint] = b.Fingerprint != certID
 		}
-		log.Info("MeshTLS: uploaded certificate to tyk secure store")
-		serverCert.Bundle.Fingerprint = certID
+	}
 
-		log.Info("MeshTLS: updated API definition to use new cert fingerprint")
-		_, err = whsvr.CAClient.StoreCert(serverCert)
-		if err != nil {
-			return fmt.Errorf("failed to store certificate reference in controller store: %v", err)
+	certs := whsvr.pruneCertificates(ctx, cl, aDef.Certificates, superseded)
+	found := false
+	for _, id := range certs {
+		if id == certID {
+			found = true
+			break
 		}
-		log.Info("MeshTLS: stored new certificate in mongo")
+	}
+	if !found {
+		certs = append(certs, certID)
 	}
 
-	aDef, err := tyk.GetByObjectID(sid)
+	if stringsEqual(certs, aDef.Certificates) {
+		log.Info("MeshTLS: API definition already uses the certificate")
+		return nil
+	}
+
+	aDef.Certificates = certs
+	err = cl.UpdateAPI(ctx, &aDef.APIDefinition)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve API definition: %v", err)
+		return fmt.Errorf("failed to store updated API Definition (%v): %w", tyk.ObjectID(aDef), err)
+	}
+	log.Info("MeshTLS: updated API definition to use new cert fingerprint")
+
+	return nil
+}
+
+// serverCertID returns the ID of the server certificate of an API, a new one
+// is issued if the stored certificate expired or is gone from the tyk store
+func (whsvr *WebhookServer) serverCertID(ctx context.Context, cl tyk.Client, sid string) (string, error) {
+	stored, err := whsvr.caClient(ctx).GetServerCertByLinkedAPIID(sid)
+	if err != nil || stored.Revoked {
+		stored = nil
+	}
+
+	if stored != nil && stored.Expires.After(time.Now()) {
+		ok, err := cl.CertificateExists(ctx, stored.Bundle.Fingerprint)
+		if err != nil {
+			return "", fmt.Errorf("failed to look up certificate in tyk secure store: %w", err)
+		}
+
+		if ok {
+			log.Info("MeshTLS: reusing stored server certificate")
+			return stored.Bundle.Fingerprint, nil
+		}
 	}
 
-	if len(aDef.Certificates) == 0 {
-		aDef.Certificates = make([]string, 0)
+	serverCert, err := whsvr.generateServerCert(ctx, cl, sid)
+	if err != nil {
+		return "", fmt.Errorf("can't generate certificate: %w", err)
 	}
+	log.Info("MeshTLS: generated server certificate")
 
-	aDef.Certificates = append(aDef.Certificates, certID)
-	err = tyk.UpdateAPI(&aDef.APIDefinition)
+	certID, err := cl.CreateCertificate(ctx, serverCert.Bundle.Bundled, serverCert.Bundle.PrivateKey)
 	if err != nil {
-		return fmt.Errorf("failed to store updated API Definition (%v): %v", aDef.Id.Hex(), err)
+		return "", fmt.Errorf("failed to upload certificate to tyk secure store: %w", err)
+	}
+	log.Info("MeshTLS: uploaded certificate to tyk secure store")
+	serverCert.Bundle.Fingerprint = certID
+
+	if stored != nil {
+		// keep a single cert per API so rotation and lookups find the current one
+		stored.BundleHistory = append(stored.BundleHistory, *stored.Bundle)
+		stored.Bundle = serverCert.Bundle
+		stored.Expires = serverCert.Expires
+		err = whsvr.caClient(ctx).UpdateCert(stored)
+	} else {
+		serverCert.ServiceID = sid
+		_, err = whsvr.caClient(ctx).StoreCert(serverCert)
 	}
+	if err != nil {
+		return "", fmt.Errorf("failed to store certificate reference in controller store: %v", err)
+	}
+	log.Info("MeshTLS: stored new certificate in controller store")
 
-	return nil
+	return certID, nil
+}
+
+// pruneCertificates drops duplicate certificate IDs, IDs of superseded or
+// expired certs issued by the controller and IDs no longer in the tyk
+// certificate store
+func (whsvr *WebhookServer) pruneCertificates(ctx context.Context, cl tyk.Client, ids []string, superseded map[string]bool) []string {
+	seen := map[string]bool{}
+	kept := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if superseded[id] {
+			log.Infof("MeshTLS: removing replaced certificate %v from API definition", id)
+			if err := cl.DeleteCertificate(ctx, id); err != nil {
+				log.Warningf("failed to remove replaced certificate %v: %v", id, err)
+			} else {
+				whsvr.forgetCert(id)
+			}
+			continue
+		}
+
+		if cm, err := whsvr.caClient(ctx).GetCertByFingerprint(id); err == nil && cm.Expires.Before(time.Now()) {
+			log.Infof("MeshTLS: removing expired certificate %v from API definition", id)
+			continue
+		}
+
+		ok, err := cl.CertificateExists(ctx, id)
+		if err != nil {
+			log.Warningf("failed to look up certificate %v, keeping it: %v", id, err)
+		} else if !ok {
+			log.Infof("MeshTLS: removing certificate %v missing from tyk secure store", id)
+			whsvr.forgetCert(id)
+			continue
+		}
+
+		kept = append(kept, id)
+	}
+
+	return kept
 }
 
-func (whsvr *WebhookServer) handleMeshTLS(ann map[string]string) error {
+func (whsvr *WebhookServer) handleMeshTLS(ctx context.Context, cl tyk.Client, ann map[string]string) error {
 	if !whsvr.SidecarConfig.EnableMeshTLS {
 		log.Info("mesh TLS disabled, skipping check")
 		// no TLS needed, skip
@@ -501,7 +944,7 @@ func (whsvr *WebhookServer) handleMeshTLS(ann map[string]string) error {
 
 	// Handle inbound ID first as that's a straight TLS cert
 	log.Info("MeshTLS: starting last-mile TLS generation")
-	err := whsvr.generateStoreAndRegisterCertForAPIDef(ingressID, "")
+	err := whsvr.generateStoreAndRegisterCertForAPIDef(ctx, cl, ingressID, "")
 	if err != nil {
 		return err
 	}
@@ -512,16 +955,42 @@ func (whsvr *WebhookServer) handleMeshTLS(ann map[string]string) error {
 		return fmt.Errorf("can't generate server cert without an mesh API ID")
 	}
 
-	err = whsvr.generateStoreAndRegisterCertForAPIDef(meshID, whsvr.SidecarConfig.MeshCertificateID)
+	err = whsvr.generateStoreAndRegisterCertForAPIDef(ctx, cl, meshID, whsvr.meshCertID())
 	if err != nil {
 		return err
 	}
 
+	// so are the routes of the named ports
+	for _, id := range portServiceIDs(ann, AdmissionWebhookAnnotationPortInboundServiceIDsKey) {
+		if err := whsvr.generateStoreAndRegisterCertForAPIDef(ctx, cl, id, ""); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range portServiceIDs(ann, AdmissionWebhookAnnotationPortMeshServiceIDsKey) {
+		if err := whsvr.generateStoreAndRegisterCertForAPIDef(ctx, cl, id, whsvr.meshCertID()); err != nil {
+			return err
+		}
+	}
+
+	// per-replica routes of StatefulSet pods are secured the same way
+	if replicaID, ok := ann[AdmissionWebhookAnnotationReplicaInboundServiceIDKey]; ok {
+		if err := whsvr.generateStoreAndRegisterCertForAPIDef(ctx, cl, replicaID, ""); err != nil {
+			return err
+		}
+	}
+
+	if replicaMeshID, ok := ann[AdmissionWebhookAnnotationReplicaMeshServiceIDKey]; ok {
+		if err := whsvr.generateStoreAndRegisterCertForAPIDef(ctx, cl, replicaMeshID, whsvr.meshCertID()); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (whsvr *WebhookServer) generateServerCert(id string) (*ca.CertModel, error) {
-	apidef, err := tyk.GetByObjectID(id)
+func (whsvr *WebhookServer) generateServerCert(ctx context.Context, cl tyk.Client, id string) (*ca.CertModel, error) {
+	apidef, err := cl.GetByObjectID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -530,8 +999,11 @@ func (whsvr *WebhookServer) generateServerCert(id string) (*ca.CertModel, error)
 	if hostname == "" {
 		return nil, fmt.Errorf("domain cannot be emtpy")
 	}
+	if hostname == meshDomain(whsvr.SidecarConfig) {
+		hostname = meshHost(whsvr.SidecarConfig)
+	}
 
-	bdl, err := whsvr.CAClient.GenerateCert(hostname)
+	bdl, err := whsvr.generateCert(ctx, domainNamespace(hostname), hostname, whsvr.serverCertHosts(hostname)...)
 	if err != nil {
 		return nil, err
 	}
@@ -539,21 +1011,125 @@ func (whsvr *WebhookServer) generateServerCert(id string) (*ca.CertModel, error)
 	return ca.NewCertModel(bdl), nil
 }
 
-func (whsvr *WebhookServer) processPodMutations(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+// generateCert issues a certificate for a service of a namespace, signed by
+// the CA of its trust domain if the CA has one per namespace
+func (whsvr *WebhookServer) generateCert(ctx context.Context, namespace, CN string, hosts ...string) (*ca.Bundle, error) {
+	if ni, ok := whsvr.CAClient.(ca.NamespaceIssuer); ok && ni.TrustDomain(namespace) != "" {
+		return ni.GenerateNamespaceCert(namespace, CN, hosts...)
+	}
+
+	return whsvr.caClient(ctx).GenerateCert(CN, hosts...)
+}
+
+// domainNamespace returns the namespace of the svc.ns or pod.svc.ns domain
+// of an inbound route, empty for other domains
+func domainNamespace(domain string) string {
+	parts := strings.Split(domain, ".")
+	switch len(parts) {
+	case 2:
+		return parts[1]
+	case 3:
+		return parts[2]
+	}
+	return ""
+}
+
+// serverCertHosts returns every name a service is called by from within the
+// cluster for the svc.ns domain of its inbound route, including the mesh
+// hostnames of its namespace and the cluster IP of its Service
+func (whsvr *WebhookServer) serverCertHosts(domain string) []string {
+	parts := strings.Split(domain, ".")
+	clusterDomain := whsvr.SidecarConfig.ClusterDomain
+	if clusterDomain == "" {
+		clusterDomain = defaultClusterDomain
+	}
+
+	// mesh routes are called on any of the mesh hostnames
+	for _, h := range whsvr.SidecarConfig.MeshHostnames.All() {
+		if h == domain {
+			return whsvr.SidecarConfig.MeshHostnames.All()
+		}
+	}
+
+	// StatefulSet replicas are addressed as pod.svc.ns
+	if len(parts) == 3 {
+		hosts := []string{domain, domain + ".svc", domain + ".svc." + clusterDomain}
+		return append(hosts, whsvr.SidecarConfig.MeshHostnames.of(parts[2])...)
+	}
+
+	if len(parts) != 2 {
+		return append([]string{domain}, whsvr.SidecarConfig.MeshHostnames.of("")...)
+	}
+
+	svc, ns := parts[0], parts[1]
+
+	hosts := []string{svc, domain, domain + ".svc", domain + ".svc." + clusterDomain}
+	hosts = append(hosts, whsvr.SidecarConfig.MeshHostnames.of(ns)...)
+	if whsvr.KubeClient == nil {
+		return hosts
+	}
+
+	s, err := whsvr.KubeClient.CoreV1().Services(ns).Get(svc, metav1.GetOptions{})
+	if err != nil {
+		log.Debugf("no cluster IP for %v: %v", domain, err)
+		return hosts
+	}
+
+	if ip := s.Spec.ClusterIP; ip != "" && ip != corev1.ClusterIPNone {
+		hosts = append(hosts, ip)
+	}
+
+	return hosts
+}
+
+// RestoreRoutes creates the inbound and mesh routes of an injected pod again,
+// and their certificates if mesh TLS is enabled, e.g. after the dashboard was
+// restored from a backup. Routes that still exist are left untouched.
+func (whsvr *WebhookServer) RestoreRoutes(ctx context.Context, pod *corev1.Pod) error {
+	cl, err := whsvr.tykClient(pod.Namespace, pod.Annotations)
+	if err != nil {
+		return err
+	}
+
+	r := tyk.NewChangeReason("Pod", pod.Namespace, pod.Name, string(pod.UID))
+	ann, err := whsvr.createServiceRoutes(ctx, cl, pod, map[string]string{}, pod.Namespace, whsvr.SidecarConfig.EnableMeshTLS, r)
+	if err != nil {
+		return err
+	}
+
+	return whsvr.handleMeshTLS(ctx, cl, ann)
+}
+
+// tykClient returns the client to create the routes of an object with
+func (whsvr *WebhookServer) tykClient(namespace string, ann map[string]string) (tyk.Client, error) {
+	if whsvr.TykClients != nil {
+		return whsvr.TykClients(namespace, ann)
+	}
+
+	return tyk.ClientFor(namespace, ann)
+}
+
+// caClient returns the CA client recording its calls in the trace of ctx
+func (whsvr *WebhookServer) caClient(ctx context.Context) ca.CertClient {
+	return ca.Traced(ctx, whsvr.CAClient)
+}
+
+func (whsvr *WebhookServer) processPodMutations(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	req := ar.Request
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		log.Errorf("Could not unmarshal raw object: %v", err)
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		return badRequest(err)
 	}
 
 	log.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
 		req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
 
+	// pods are usually created without a namespace in their metadata
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
 	// determine whether to perform mutation
 	if !mutationRequired(ignoredNamespaces, &pod.ObjectMeta) {
 		log.Infof("Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
@@ -562,41 +1138,120 @@ func (whsvr *WebhookServer) processPodMutations(ar *v1beta1.AdmissionReview) *v1
 		}
 	}
 
+	if resp := whsvr.policyDenied(ctx, req, &pod, pod.Namespace); resp != nil {
+		return resp
+	}
+
+	var labels map[string]string
+	if whsvr.defaultAppLabel(ctx, &pod) {
+		labels = pod.Labels
+	}
+	whsvr.warnPod(ctx, &pod)
+
+	if _, _, err := caMountPaths(&pod); err != nil && whsvr.SidecarConfig.EnableMeshTLS {
+		return invalid(err)
+	}
+
+	if _, err := namedPorts(&pod, whsvr.SidecarConfig.Containers); err != nil {
+		return invalid(err)
+	}
+
+	if _, err := identityExemptions(&pod, whsvr.SidecarConfig.Containers); err != nil && whsvr.SidecarConfig.WorkloadIdentity {
+		return invalid(err)
+	}
+
+	if _, _, err := appPort(&pod, whsvr.SidecarConfig); err != nil {
+		return invalid(err)
+	}
+
+	if _, err := sidecarLogLevel(&pod, whsvr.SidecarConfig); err != nil {
+		return invalid(err)
+	}
+
+	if err := tyk.ValidateSegments(tyk.SegmentMesh, req.Namespace, pod.Annotations); err != nil {
+		return invalid(err)
+	}
+
+	dns, err := meshDNS(&pod, whsvr.SidecarConfig)
+	if err != nil {
+		return invalid(err)
+	}
+
+	if dns == MeshDNSService {
+		if err := whsvr.ensureMeshService(ctx, req.Namespace); err != nil {
+			return failed(err)
+		}
+	}
+
+	// pods without an app label can't be selected by service
+	if pod.Labels["app"] != "" && whsvr.networkPolicies(req.Namespace) {
+		if err := whsvr.ensureNetworkPolicy(ctx, &pod, req.Namespace); err != nil {
+			return failed(err)
+		}
+	}
+
+	// marks the pod as a sidecar for network policies and the sidecar proxy
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	pod.Labels[MeshPodLabel] = "true"
+	labels = pod.Labels
+
+	// routes and certificates are created in the org of the pod
+	cl, err := whsvr.tykClient(req.Namespace, pod.Annotations)
+	if err != nil {
+		if resp := whsvr.failOpen(&pod, err); resp != nil {
+			return resp
+		}
+
+		return failed(err)
+	}
+
 	annotations := pod.Annotations
 	annotations[AdmissionWebhookAnnotationStatusKey] = "injected"
+	annotations[AdmissionWebhookAnnotationSidecarVersionKey] = SidecarVersion(whsvr.SidecarConfig)
 	delete(annotations, AdmissionWebhookAnnotationInjectKey)
 
 	// We create the service routes first, because we need the IDs
 	if whsvr.SidecarConfig.CreateRoutes {
 		var err error
-		annotations, err = createServiceRoutes(&pod, annotations, ar.Request.Namespace, whsvr.SidecarConfig.EnableMeshTLS)
+		annotations, err = whsvr.createServiceRoutes(ctx, cl, &pod, annotations, ar.Request.Namespace, whsvr.SidecarConfig.EnableMeshTLS, podChangeReason(&pod, ar.Request))
 		if err != nil {
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
+			if resp := whsvr.failOpen(&pod, err); resp != nil {
+				return resp
 			}
+
+			return failed(err)
 		}
 	}
 
 	// === TLS Specific operations ===
-	if err := whsvr.handleMeshTLS(annotations); err != nil {
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+	if err := whsvr.handleMeshTLS(ctx, cl, annotations); err != nil {
+		if resp := whsvr.failOpen(&pod, err); resp != nil {
+			return resp
 		}
+
+		return failed(err)
 	}
 	// === End TLS ====
 
+	if err := whsvr.handleWorkloadIdentity(ctx, cl, &pod, req.Namespace, annotations); err != nil {
+		if resp := whsvr.failOpen(&pod, err); resp != nil {
+			return resp
+		}
+
+		return failed(err)
+	}
+
+	// the mesh segment of the sidecar depends on the namespace of the pod
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
 	// Create the patch
-	patchBytes, err := createPatch(&pod, nil, whsvr.SidecarConfig, annotations)
+	patchBytes, err := createPatch(&pod, whsvr.SidecarConfig, annotations, labels)
 	if err != nil {
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		return failed(err)
 	}
 
 	log.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
@@ -610,16 +1265,12 @@ func (whsvr *WebhookServer) processPodMutations(ar *v1beta1.AdmissionReview) *v1
 	}
 }
 
-func (whsvr *WebhookServer) processServiceMutations(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+func (whsvr *WebhookServer) processServiceMutations(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	req := ar.Request
 	var service corev1.Service
 	if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
 		log.Errorf("Could not unmarshal raw object: %v", err)
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		return badRequest(err)
 	}
 
 	log.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
@@ -633,18 +1284,24 @@ func (whsvr *WebhookServer) processServiceMutations(ar *v1beta1.AdmissionReview)
 		}
 	}
 
+	namespace := service.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+	if resp := whsvr.policyDenied(ctx, req, &service, namespace); resp != nil {
+		return resp
+	}
+	routed := whsvr.routedPorts(&service, namespace)
+	warnService(ctx, &service, routed)
+
 	annotations := service.Annotations
 	annotations[AdmissionWebhookAnnotationStatusKey] = "injected"
 	delete(annotations, AdmissionWebhookAnnotationInjectKey)
 
 	// Create the patch
-	patchBytes, err := createPatch(nil, &service, whsvr.SidecarConfig, annotations)
+	patchBytes, err := json.Marshal(mutateService(&service, "/spec/ports", routed))
 	if err != nil {
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		return failed(err)
 	}
 
 	log.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
@@ -659,34 +1316,47 @@ func (whsvr *WebhookServer) processServiceMutations(ar *v1beta1.AdmissionReview)
 }
 
 // main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+func (whsvr *WebhookServer) mutate(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	req := ar.Request
 
 	log.Info("object is: ", req.Kind)
+	// checked first, Knative Services are not core Services
+	if path, ok := workloadTemplates[req.Kind.Group+"/"+req.Kind.Kind]; ok {
+		return whsvr.processWorkloadMutations(ctx, ar, path)
+	}
+
 	switch strings.ToLower(req.Kind.Kind) {
 	case "pod":
-		return whsvr.processPodMutations(ar)
+		return whsvr.processPodMutations(ctx, ar)
 	case "service":
-		return whsvr.processServiceMutations(ar)
+		return whsvr.processServiceMutations(ctx, ar)
 	default:
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: "type not supported",
-			},
-		}
+		return unsupportedKind(req, "pods, services and workloads")
 	}
 }
 
-// Serve method for webhook server
+// Serve method for webhook server, mutating pods, services and workloads
 func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
+	whsvr.serveAdmission(w, r, whsvr.mutate)
+}
+
+// serveAdmission decodes an admission review and replies with the response of review
+func (whsvr *WebhookServer) serveAdmission(w http.ResponseWriter, r *http.Request, review func(context.Context, *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse) {
+	reqLog := logger.FromContext(r.Context(), log)
+
 	var body []byte
 	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			// the web server bounds the body size
+			reqLog.Errorf("can't read body: %v", err)
+			http.Error(w, "request body too large or unreadable", http.StatusRequestEntityTooLarge)
+			return
 		}
+		body = data
 	}
 	if len(body) == 0 {
-		log.Error("empty body")
+		reqLog.Error("empty body")
 		http.Error(w, "empty body", http.StatusBadRequest)
 		return
 	}
@@ -694,22 +1364,39 @@ func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 	// verify the content type is accurate
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		log.Errorf("Content-Type=%s, expect application/json", contentType)
+		reqLog.Errorf("Content-Type=%s, expect application/json", contentType)
 		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
 		return
 	}
 
+	// API servers with tracing enabled propagate the trace of the request
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "admission")
+	defer span.End()
+	ctx, warnings := withWarnings(ctx)
+
 	var admissionResponse *v1beta1.AdmissionResponse
 	ar := v1beta1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		log.Errorf("can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		reqLog.Errorf("can't decode body: %v", err)
+		admissionResponse = badRequest(err)
 	} else {
-		admissionResponse = whsvr.mutate(&ar)
+		if req := ar.Request; req != nil {
+			span.SetAttributes(
+				attribute.String("k8s.kind", req.Kind.Kind),
+				attribute.String("k8s.namespace", req.Namespace),
+				attribute.String("k8s.name", req.Name),
+				attribute.String("k8s.operation", string(req.Operation)),
+				attribute.String("admission.uid", string(req.UID)),
+			)
+		}
+		admissionResponse = recoverReview(ctx, &ar, review)
+	}
+
+	if admissionResponse != nil {
+		span.SetAttributes(attribute.Bool("admission.allowed", admissionResponse.Allowed))
+		if !admissionResponse.Allowed && admissionResponse.Result != nil {
+			span.SetStatus(codes.Error, admissionResponse.Result.Message)
+		}
 	}
 
 	admissionReview := v1beta1.AdmissionReview{}
@@ -720,14 +1407,14 @@ func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	resp, err := json.Marshal(admissionReview)
+	resp, err := marshalReview(&admissionReview, warnings.list())
 	if err != nil {
-		log.Errorf("can't encode response: %v", err)
+		reqLog.Errorf("can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
 	}
-	log.Infof("ready to write reponse ...")
+	reqLog.Infof("ready to write reponse ...")
 	if _, err := w.Write(resp); err != nil {
-		log.Errorf("can't write response: %v", err)
+		reqLog.Errorf("can't write response: %v", err)
 		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 }
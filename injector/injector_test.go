@@ -2,124 +2,219 @@ package injector
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
 	"github.com/ghodss/yaml"
+	"github.com/spf13/viper"
+	"k8s.io/api/admission/v1beta1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
 
-	"go.jlucktay.dev/tyk-k8s/_test_util"
 	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/kube"
+	"go.jlucktay.dev/tyk-k8s/processor"
+	"go.jlucktay.dev/tyk-k8s/store"
 	"go.jlucktay.dev/tyk-k8s/tyk"
 )
 
-func TestWebhookServer_Serve(t *testing.T) {
-	cfg := &Config{}
-	if err := yaml.Unmarshal([]byte(testCfg), cfg); err != nil {
+// reviewOf builds the body of an admission review of an object
+func reviewOf(t *testing.T, kind, ns string, obj interface{}) string {
+	t.Helper()
+	raw, err := json.Marshal(obj)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(cfg.Containers) != 1 {
-		t.Fatalf("yaml should contain at least one container, got %v", len(cfg.Containers))
+	body, err := json.Marshal(&v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		UID:       "1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: kind},
+		Namespace: ns,
+		Operation: v1beta1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if err != nil {
+		t.Fatal(err)
 	}
+	return string(body)
+}
 
-	whs := WebhookServer{
-		SidecarConfig: cfg,
+func TestWebhookServer_Serve(t *testing.T) {
+	injected := func(ann map[string]string) *corev1.Pod {
+		ann[AdmissionWebhookAnnotationInjectKey] = "true"
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{GenerateName: "my-service-", Labels: map[string]string{"app": "my-service"}, Annotations: ann},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "app", Image: "nginx", Ports: []corev1.ContainerPort{{ContainerPort: 80}}},
+			}},
+		}
 	}
 
-	svr := _test_util.DashServerMock{}
-	svr.Start(":8989")
-	defer svr.Stop()
-
 	scenarios := []struct {
-		Payload      string
-		ResponseCode int
-		IsPatched    bool
-		Operations   int
+		name    string
+		payload string
+		tykErr  error
+
+		allowed    bool
+		code       int32 // of rejections
+		operations int   // of the patch, 0 if unpatched
+		slugs      []string
+		annotation string // added by the patch
 	}{
 		{
-			AdmissionReviewJson,
-			200,
-			true,
-			2,
+			name:       "pod",
+			payload:    AdmissionReviewJson,
+			allowed:    true,
+			operations: 3,
+			slugs:      []string{"my-service.dummy-inbound", "my-service.dummy-mesh"},
+			annotation: AdmissionWebhookAnnotationMeshServiceIDKey,
+		},
+		{
+			name:    "injected pod",
+			payload: AdmissionReviewJsonSkip,
+			allowed: true,
+		},
+		{
+			name:    "pod without injection",
+			payload: AdmissionReviewJsonNoInject,
+			allowed: true,
+		},
+		{
+			name: "pod injected offline",
+			payload: reviewOf(t, "Pod", "dummy", &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{GenerateName: "my-service-", Labels: map[string]string{"app": "my-service"}, Annotations: map[string]string{
+					AdmissionWebhookAnnotationStatusKey: StatusOfflineInjected,
+				}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{
+					{Name: "app", Image: "nginx", Ports: []corev1.ContainerPort{{ContainerPort: 80}}},
+					{Name: "sidecar-nginx", Image: "nginx:1.12.2"},
+				}},
+			}),
+			allowed:    true,
+			operations: 2, // the spec isn't replaced
+			slugs:      []string{"my-service.dummy-inbound", "my-service.dummy-mesh"},
+			annotation: AdmissionWebhookAnnotationMeshServiceIDKey,
+		},
+		{
+			name: "service",
+			payload: reviewOf(t, "Service", "dummy", &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-service", Annotations: map[string]string{AdmissionWebhookAnnotationInjectKey: "true"}},
+				Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(80)}}},
+			}),
+			allowed:    true,
+			operations: 1,
+		},
+		{
+			name:    "invalid annotation",
+			payload: reviewOf(t, "Pod", "dummy", injected(map[string]string{AdmissionWebhookAnnotationSidecarLogLevelKey: "loud"})),
+			code:    http.StatusUnprocessableEntity,
+		},
+		{
+			name:    "dashboard unavailable",
+			payload: reviewOf(t, "Pod", "dummy", injected(map[string]string{})),
+			tykErr:  tyk.ErrUnavailable,
+			code:    http.StatusServiceUnavailable,
+		},
+		{
+			name:       "dashboard unavailable, failing open",
+			payload:    reviewOf(t, "Pod", "dummy", injected(map[string]string{AdmissionWebhookAnnotationFailurePolicyKey: FailurePolicyOpen})),
+			tykErr:     tyk.ErrUnavailable,
+			allowed:    true,
+			operations: 1,
+			annotation: AdmissionWebhookAnnotationInjectionErrorKey,
 		},
 		{
-			AdmissionReviewJsonSkip,
-			200,
-			false,
-			0,
+			name:    "dashboard error",
+			payload: reviewOf(t, "Pod", "dummy", injected(map[string]string{})),
+			tykErr:  errors.New("invalid API definition"),
+			code:    http.StatusInternalServerError,
 		},
 		{
-			AdmissionReviewJsonNoInject,
-			200,
-			false,
-			0,
+			name:    "unsupported kind",
+			payload: reviewOf(t, "ConfigMap", "dummy", &corev1.ConfigMap{}),
+			code:    http.StatusBadRequest,
 		},
 	}
 
 	for _, sc := range scenarios {
-		req := httptest.NewRequest("POST", "http://localhost:9797/inject", bytes.NewReader([]byte(sc.Payload)))
-		req.Header.Add("Content-Type", "application/json")
-		rec := httptest.NewRecorder()
-
-		whs.SidecarConfig.CreateRoutes = true
-		whs.SidecarConfig.EnableMeshTLS = true
-		whs.CAClient = &ca.Mock{}
-		tyk.Init(&tyk.TykConf{
-			URL:       "http://localhost:8989",
-			Secret:    "foo",
-			Org:       "1",
-			IsGateway: false,
-		})
-
-		whs.Serve(rec, req)
-
-		if rec.Code != sc.ResponseCode {
-			t.Fatalf("expected code %v got %v", 200, rec.Code)
-		}
-
-		body, err := ioutil.ReadAll(rec.Body)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		var resp map[string]interface{}
-		err = json.Unmarshal(body, &resp)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		responseSec, ok := resp["response"]
-		if !ok {
-			t.Fatalf("no response section in response obect: %v", string(body))
-		}
+		t.Run(sc.name, func(t *testing.T) {
+			cfg := &Config{}
+			if err := yaml.Unmarshal([]byte(testCfg), cfg); err != nil {
+				t.Fatal(err)
+			}
+			cfg.CreateRoutes = true
+			cfg.EnableMeshTLS = true
 
-		patch, ok := responseSec.(map[string]interface{})["patch"]
-		if ok != sc.IsPatched {
-			t.Fatalf("expected patch section: %v, got section %v, payload: %v", sc.IsPatched, ok, string(body))
-		}
+			mock := tyk.NewMockClient()
+			mock.Err = sc.tykErr
+			whs := WebhookServer{SidecarConfig: cfg, CAClient: &ca.Mock{}, TykClients: mock.Resolver()}
 
-		if sc.IsPatched {
-			pStr := patch.(string)
+			req := httptest.NewRequest("POST", DefaultInjectPath, strings.NewReader(sc.payload))
+			req.Header.Add("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			whs.Serve(rec, req)
 
-			sDec, _ := base64.StdEncoding.DecodeString(pStr)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected code %v got %v", http.StatusOK, rec.Code)
+			}
 
-			type jsonPatch struct {
-				Op    string `json:"op"`
-				Path  string `json:"path"`
-				Value string `json:"value"`
+			ar := &v1beta1.AdmissionReview{}
+			if err := json.Unmarshal(rec.Body.Bytes(), ar); err != nil || ar.Response == nil {
+				t.Fatalf("invalid admission response %q: %v", rec.Body.String(), err)
 			}
-			patchArr := make([]jsonPatch, 0)
+			resp := ar.Response
 
-			err = json.Unmarshal(sDec, &patchArr)
+			if resp.Allowed != sc.allowed {
+				t.Fatalf("expected allowed %v, got %+v", sc.allowed, resp.Result)
+			}
+			if !sc.allowed && (resp.Result == nil || resp.Result.Code != sc.code || resp.Result.Status != metav1.StatusFailure) {
+				t.Fatalf("expected a failure with code %v, got %+v", sc.code, resp.Result)
+			}
 
-			if len(patchArr) != sc.Operations {
-				t.Fatalf("not enough patch operations in response: %v", string(sDec))
+			patch := make([]patchOperation, 0)
+			if len(resp.Patch) > 0 {
+				if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(patch) != sc.operations {
+				t.Fatalf("expected %v patch operations, got %s", sc.operations, resp.Patch)
+			}
+			if sc.annotation != "" && !strings.Contains(string(resp.Patch), sc.annotation) && !strings.Contains(string(resp.Patch), escapePatchKey(sc.annotation)) {
+				t.Fatalf("expected %v to be added, got %s", sc.annotation, resp.Patch)
 			}
-		}
 
+			slugs := make([]string, 0)
+			for _, def := range mock.APIs {
+				slugs = append(slugs, def.Slug)
+			}
+			sort.Strings(slugs)
+			if len(slugs) != len(sc.slugs) || (len(slugs) > 0 && !reflect.DeepEqual(slugs, sc.slugs)) {
+				t.Fatalf("expected routes %v, got %v", sc.slugs, slugs)
+			}
+		})
 	}
 }
 
@@ -489,3 +584,2801 @@ var AdmissionReviewJsonSkip = `
   }
 }
 `
+
+func TestWebhookServer_AdmissionRoutes(t *testing.T) {
+	whs := &WebhookServer{SidecarConfig: &Config{}}
+	routes := whs.AdmissionRoutes()
+	for _, p := range []string{DefaultInjectPath, DefaultPodPath, DefaultServicePath, DefaultValidationPath} {
+		if _, ok := routes[p]; !ok {
+			t.Fatalf("expected a route on %v, got %v", p, routes)
+		}
+	}
+
+	paths := &WebhookPaths{Pod: "/inject", Validation: "validate"}
+	if errs := paths.Validate(); len(errs) != 2 {
+		t.Fatalf("expected a duplicate and a relative path to be rejected, got %v", errs)
+	}
+
+	review := func(h http.HandlerFunc, kind string, obj interface{}) *v1beta1.AdmissionResponse {
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := json.Marshal(&v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+			UID:       "1",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: kind},
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+
+		ar := &v1beta1.AdmissionReview{}
+		if err := json.Unmarshal(rec.Body.Bytes(), ar); err != nil || ar.Response == nil {
+			t.Fatalf("invalid admission response %q: %v", rec.Body.String(), err)
+		}
+		return ar.Response
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: map[string]string{
+		AdmissionWebhookAnnotationInjectKey:        "true",
+		AdmissionWebhookAnnotationFailurePolicyKey: "sometimes",
+		AdmissionWebhookAnnotationMirrorToKey:      "bar:150",
+	}}}
+
+	if resp := review(whs.ServeService, "Pod", pod); resp.Allowed || !strings.Contains(resp.Result.Message, "not supported") || resp.Result.Code != http.StatusBadRequest {
+		t.Fatalf("the service endpoint should reject pods, got %+v", resp)
+	}
+
+	resp := review(whs.ServeValidate, "Pod", pod)
+	if resp.Allowed || resp.Result.Status != metav1.StatusFailure || resp.Result.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("pods with invalid annotations should be rejected as invalid, got %+v", resp.Result)
+	}
+	for _, k := range []string{AdmissionWebhookAnnotationFailurePolicyKey, AdmissionWebhookAnnotationMirrorToKey} {
+		if !strings.Contains(resp.Result.Message, k) {
+			t.Fatalf("expected %v to be reported, got %q", k, resp.Result.Message)
+		}
+	}
+
+	pod.Annotations = map[string]string{AdmissionWebhookAnnotationInjectKey: "true", AdmissionWebhookAnnotationMirrorToKey: "bar:50"}
+	if resp := review(whs.ServeValidate, "Pod", pod); !resp.Allowed {
+		t.Fatalf("valid pods should be admitted, got %+v", resp.Result)
+	}
+
+	// pods that aren't injected only have their injector settings checked
+	pod.Annotations = map[string]string{AdmissionWebhookAnnotationMirrorToKey: "bar:150"}
+	if resp := review(whs.ServeValidate, "Pod", pod); !resp.Allowed {
+		t.Fatalf("pods that aren't injected should be admitted, got %+v", resp.Result)
+	}
+	pod.Annotations[AdmissionWebhookAnnotationStatusKey] = "injected"
+	if resp := review(whs.ServeValidate, "Pod", pod); resp.Allowed {
+		t.Fatal("injected pods should be checked")
+	}
+
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: map[string]string{AdmissionWebhookAnnotationInjectKey: "ture"}}}
+	if resp := review(whs.ServeValidate, "Service", svc); resp.Allowed {
+		t.Fatal("services with an unknown inject value should be rejected")
+	}
+}
+
+func TestWebhookServer_serveAdmissionErrors(t *testing.T) {
+	whs := &WebhookServer{SidecarConfig: &Config{}}
+	serve := func(body []byte, review func(context.Context, *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse) *v1beta1.AdmissionResponse {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		whs.serveAdmission(rec, req, review)
+
+		ar := &v1beta1.AdmissionReview{}
+		if err := json.Unmarshal(rec.Body.Bytes(), ar); err != nil || ar.Response == nil {
+			t.Fatalf("invalid admission response %q: %v", rec.Body.String(), err)
+		}
+		return ar.Response
+	}
+
+	body, err := json.Marshal(&v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		UID:    "1",
+		Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Object: runtime.RawExtension{Raw: []byte(`{"spec": []}`)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serve(body, func(context.Context, *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse { panic("boom") })
+	if resp.Allowed || resp.UID != "1" || resp.Result.Code != http.StatusInternalServerError || resp.Result.Reason != metav1.StatusReasonInternalError {
+		t.Fatalf("a panic should reject the object with an internal error, got %+v", resp)
+	}
+
+	resp = serve(body, whs.mutate)
+	if resp.Allowed || resp.Result.Code != http.StatusBadRequest || resp.Result.Status != metav1.StatusFailure {
+		t.Fatalf("an undecodable pod should be a bad request, got %+v", resp.Result)
+	}
+
+	resp = serve([]byte(`{"kind": 1}`), whs.mutate)
+	if resp.Allowed || resp.Result.Code != http.StatusBadRequest {
+		t.Fatalf("an undecodable review should be a bad request, got %+v", resp.Result)
+	}
+
+	if resp := failed(fmt.Errorf("creating route: %w", tyk.ErrUnavailable)); resp.Result.Code != http.StatusServiceUnavailable {
+		t.Fatalf("an unavailable gateway should be reported as such, got %+v", resp.Result)
+	}
+	if resp := failed(errors.New("boom")); resp.Result.Code != http.StatusInternalServerError {
+		t.Fatalf("expected an internal error, got %+v", resp.Result)
+	}
+}
+
+func TestAdmissionWarnings(t *testing.T) {
+	whs := &WebhookServer{SidecarConfig: &Config{Containers: []corev1.Container{{
+		Name:  "tyk-mesh",
+		Ports: []corev1.ContainerPort{{ContainerPort: 8080}},
+	}}}}
+
+	ctx, warnings := withWarnings(context.Background())
+	whs.warnPod(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "foo"}, Annotations: map[string]string{
+			AdmissionWebhookAnnotationCAMountPathKey: "/certs",
+			AdmissionWebhookAnnotationCBSamplesKey:   "10",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Ports: []corev1.ContainerPort{{ContainerPort: 8080}}},
+		}},
+	})
+	if w := warnings.list(); len(w) != 3 {
+		t.Fatalf("expected the port clash and two ignored annotations, got %v", w)
+	}
+
+	raw, err := json.Marshal(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: map[string]string{AdmissionWebhookAnnotationInjectKey: "true"}},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8080, TargetPort: intstr.FromInt(9000)}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(&v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		UID:       "1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Service"},
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", DefaultServicePath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	whs.ServeService(rec, req)
+
+	resp := struct {
+		Response struct {
+			Allowed  bool     `json:"allowed"`
+			Warnings []string `json:"warnings"`
+		} `json:"response"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if !resp.Response.Allowed || len(resp.Response.Warnings) != 1 || !strings.Contains(resp.Response.Warnings[0], "also used by the sidecar port") {
+		t.Fatalf("expected the service to be admitted with a warning, got %v", rec.Body.String())
+	}
+}
+
+func TestDefaultAppLabel(t *testing.T) {
+	controller := true
+	scenarios := []struct {
+		pod  *corev1.Pod
+		name string
+	}{
+		{&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			GenerateName:    "web-5d8f7c9b4d-",
+			Labels:          map[string]string{"pod-template-hash": "5d8f7c9b4d"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-5d8f7c9b4d", Controller: &controller}},
+		}}, "web"},
+		{&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			GenerateName:    "db-",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db", Controller: &controller}},
+		}}, "db"},
+		{&corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "worker-"}}, "worker"},
+		{&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bare"}}, ""},
+	}
+
+	for _, sc := range scenarios {
+		if name, _ := defaultAppName(sc.pod); name != sc.name {
+			t.Fatalf("expected %q, got %q", sc.name, name)
+		}
+	}
+
+	whs := &WebhookServer{SidecarConfig: &Config{}}
+	pod := scenarios[0].pod.DeepCopy()
+	if whs.defaultAppLabel(context.Background(), pod) {
+		t.Fatal("the label should only be defaulted if enabled")
+	}
+
+	whs.SidecarConfig.DefaultAppLabel = true
+	if !whs.defaultAppLabel(context.Background(), pod) || pod.Labels["app"] != "web" {
+		t.Fatalf("expected the app label to be defaulted, got %v", pod.Labels)
+	}
+
+	if whs.defaultAppLabel(context.Background(), pod) {
+		t.Fatal("an existing app label should be kept")
+	}
+
+	patch, err := createPatch(pod, whs.SidecarConfig, map[string]string{}, pod.Labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(patch), `"path":"/metadata/labels"`) {
+		t.Fatalf("expected the labels to be patched, got %s", patch)
+	}
+}
+
+func TestWebhookServer_upstreamTLSOptions(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{},
+		KubeClient: fake.NewSimpleClientset(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "upstream-ca", Namespace: "dummy"},
+			Data:       map[string][]byte{"ca.crt": []byte("ca")},
+		}),
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				AdmissionWebhookAnnotationUpstreamCASecretKey:   "upstream-ca",
+				AdmissionWebhookAnnotationUpstreamSNIKey:        "my-service.internal",
+				AdmissionWebhookAnnotationUpstreamSkipVerifyKey: "true",
+			},
+		},
+	}
+
+	ann, tgt, err := whs.upstreamTLSOptions(context.Background(), mock, pod, "dummy", "https://my-service.dummy:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tgt != "https://my-service.internal:8080" {
+		t.Fatal("SNI override not applied to target, got ", tgt)
+	}
+
+	if ann["bool.service.tyk.io/proxy.transport.ssl_insecure_skip_verify"] != "true" {
+		t.Fatal("skip verify not mapped")
+	}
+
+	pinned := map[string]string{}
+	if err := json.Unmarshal([]byte(ann["object.service.tyk.io/pinned_public_keys"]), &pinned); err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned["my-service.internal"] == "" {
+		t.Fatalf("CA not pinned for upstream host: %v", pinned)
+	}
+
+	// secrets of other namespaces can't be referenced
+	pod.Annotations[AdmissionWebhookAnnotationUpstreamCASecretKey] = "dummy/upstream-ca"
+	if _, _, err := whs.upstreamTLSOptions(context.Background(), mock, pod, "dummy", "https://my-service.dummy:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := whs.upstreamTLSOptions(context.Background(), mock, pod, "other", "https://my-service.other:8080"); err == nil {
+		t.Fatal("secrets outside the namespace of the pod should be rejected")
+	}
+
+	// plain HTTP upstreams are left untouched
+	ann, tgt, err = whs.upstreamTLSOptions(context.Background(), mock, pod, "dummy", "http://my-service.dummy:8080")
+	if err != nil || len(ann) != 0 || tgt != "http://my-service.dummy:8080" {
+		t.Fatalf("expected no changes for http targets, got %v %v %v", ann, tgt, err)
+	}
+}
+
+func TestPreProcessContainerTpl_DoesNotMutateTemplate(t *testing.T) {
+	tpl := []corev1.Container{
+		{Name: "tyk-mesh", Env: []corev1.EnvVar{{Name: "FOO", Value: "bar"}}},
+		{Name: "other"},
+	}
+
+	for _, app := range []string{"one", "two"} {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": app}}}
+		out := preProcessContainerTpl(pod, tpl)
+		if len(out[0].Env) != 2 || out[0].Env[1].Value != "mesh,"+app {
+			t.Fatalf("unexpected env for %v: %v", app, out[0].Env)
+		}
+	}
+
+	if len(tpl[0].Env) != 1 {
+		t.Fatalf("template env was modified: %v", tpl[0].Env)
+	}
+}
+
+func TestPreProcessContainerTpl_Variables(t *testing.T) {
+	tyk.Init(&tyk.TykConf{Org: "5d7f"})
+	tpl := []corev1.Container{{
+		Name: "tyk-mesh",
+		Env: []corev1.EnvVar{
+			{Name: tagVarName, Value: "{MESH_TAGS},edge"},
+			{Name: "TYK_GW_SLAVEOPTIONS_RPCKEY", Value: "{ORG_ID}"},
+			{Name: "INBOUND", Value: "{SERVICE_NAME}.{POD_NAMESPACE}:{INBOUND_API_ID}"},
+		},
+		Args: []string{"--listen-path=/{SERVICE_NAME}"},
+	}}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "shop",
+		Labels:      map[string]string{"app": "cart"},
+		Annotations: map[string]string{AdmissionWebhookAnnotationInboundServiceIDKey: "42"},
+	}}
+
+	out := preProcessContainerTpl(pod, tpl)
+	want := map[string]string{tagVarName: "mesh,cart,edge", "TYK_GW_SLAVEOPTIONS_RPCKEY": "5d7f", "INBOUND": "cart.shop:42"}
+	if len(out[0].Env) != len(want) {
+		t.Fatalf("unexpected env %v", out[0].Env)
+	}
+	for _, v := range out[0].Env {
+		if want[v.Name] != v.Value {
+			t.Fatalf("expected %v=%q, got %q", v.Name, want[v.Name], v.Value)
+		}
+	}
+
+	if out[0].Args[0] != "--listen-path=/cart" || tpl[0].Args[0] != "--listen-path=/{SERVICE_NAME}" {
+		t.Fatalf("args not substituted on a copy: %v, template %v", out[0].Args, tpl[0].Args)
+	}
+}
+
+func TestAddDownwardEnv(t *testing.T) {
+	tpl := []corev1.Container{
+		{Name: "tyk-mesh", Env: []corev1.EnvVar{{Name: "NODE_NAME", Value: "fixed"}}},
+		{Name: "other"},
+	}
+
+	out := addDownwardEnv(substituteVars(tpl, strings.NewReplacer()))
+	fields := map[string]string{}
+	for _, v := range out[0].Env {
+		if v.ValueFrom != nil {
+			fields[v.Name] = v.ValueFrom.FieldRef.FieldPath
+		}
+	}
+
+	if len(fields) != 3 || fields["POD_IP"] != "status.podIP" || out[0].Env[0].Value != "fixed" {
+		t.Fatalf("expected the downward env next to the configured NODE_NAME, got %v", out[0].Env)
+	}
+	if len(out[1].Env) != 0 || len(tpl[0].Env) != 1 {
+		t.Fatal("only the gateway container of a copy should be changed")
+	}
+}
+
+func TestAddLogEnv(t *testing.T) {
+	cfg := &Config{SidecarLog: SidecarLogConfig{Level: "warn", RedactKeys: true}}
+	if errs := (&SidecarLogConfig{Level: "loud"}).Validate(); len(errs) != 1 {
+		t.Fatalf("expected an unknown level to be rejected, got %v", errs)
+	}
+
+	env := func(pod *corev1.Pod, tpl []corev1.Container) map[string]string {
+		out := map[string]string{}
+		for _, v := range addLogEnv(pod, substituteVars(tpl, strings.NewReplacer()), cfg)[0].Env {
+			out[v.Name] = v.Value
+		}
+		return out
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+	configured := []corev1.Container{{Name: "tyk-mesh", Env: []corev1.EnvVar{{Name: logLevelVarName, Value: "info"}}}}
+	if e := env(pod, configured); e[logLevelVarName] != "info" || e[keyLoggingVarName] != "false" {
+		t.Fatalf("the level of the container config should be kept and keys redacted, got %v", e)
+	}
+
+	if e := env(pod, []corev1.Container{{Name: "tyk-mesh"}}); e[logLevelVarName] != "warn" {
+		t.Fatalf("expected the default level, got %v", e)
+	}
+
+	pod.Annotations[AdmissionWebhookAnnotationSidecarLogLevelKey] = "Error"
+	if e := env(pod, configured); e[logLevelVarName] != "error" {
+		t.Fatalf("the annotation should set the level, got %v", e)
+	}
+
+	pod.Annotations[AdmissionWebhookAnnotationSidecarLogLevelKey] = "chatty"
+	if _, err := sidecarLogLevel(pod, cfg); err == nil {
+		t.Fatal("an unknown level should be rejected")
+	}
+
+	// the routes of the sidecars don't record bodies either
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{SidecarConfig: &Config{SidecarLog: SidecarLogConfig{RedactBodies: true}}, TykClients: mock.Resolver()}
+	app := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Labels: map[string]string{"app": "foo"}, Annotations: map[string]string{}}}
+	ann, err := whs.createServiceRoutes(context.Background(), mock, app, app.Annotations, "bar", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{AdmissionWebhookAnnotationInboundServiceIDKey, AdmissionWebhookAnnotationMeshServiceIDKey} {
+		if def, err := mock.GetByObjectID(context.Background(), ann[key]); err != nil || !tyk.BodiesRedacted(&def.APIDefinition) {
+			t.Fatalf("expected the bodies of %v to be redacted (%v)", key, err)
+		}
+	}
+}
+
+func TestMutatePodSpec_PodDefaults(t *testing.T) {
+	nonRoot, privileged := true, true
+	cfg := &Config{
+		Containers:       []corev1.Container{{Name: "tyk-mesh"}},
+		InitContainers:   []corev1.Container{{Name: "run-iptables", SecurityContext: &corev1.SecurityContext{Privileged: &privileged}}},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}, {Name: "shared"}},
+		RuntimeClassName: "gvisor",
+		SecurityContext:  &corev1.SecurityContext{RunAsNonRoot: &nonRoot, Privileged: new(bool)},
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "foo"}, Annotations: map[string]string{}},
+		Spec: corev1.PodSpec{
+			Containers:       []corev1.Container{{Name: "app"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "shared"}},
+		},
+	}
+
+	spec := mutatePodSpec(pod, cfg)
+	if len(spec.ImagePullSecrets) != 2 || spec.RuntimeClassName == nil || *spec.RuntimeClassName != "gvisor" {
+		t.Fatalf("expected the pull secrets to be merged and the runtime class set, got %v %v", spec.ImagePullSecrets, spec.RuntimeClassName)
+	}
+
+	if spec.Containers[0].SecurityContext != nil {
+		t.Fatal("the containers of the pod should be left alone")
+	}
+
+	sidecar := spec.Containers[1].SecurityContext
+	if sidecar == nil || !*sidecar.RunAsNonRoot || *sidecar.Privileged {
+		t.Fatalf("expected the sidecar to get the defaults, got %v", sidecar)
+	}
+
+	if init := spec.InitContainers[0].SecurityContext; !*init.Privileged || !*init.RunAsNonRoot {
+		t.Fatalf("fields set by the init container should be kept, got %v", init)
+	}
+
+	if cfg.InitContainers[0].SecurityContext.RunAsNonRoot != nil || cfg.Containers[0].SecurityContext != nil {
+		t.Fatal("the config was modified")
+	}
+}
+
+func TestCreatePatch_Restricted(t *testing.T) {
+	privileged := true
+	cfg := &Config{
+		Containers:     []corev1.Container{{Name: "tyk-mesh"}},
+		InitContainers: []corev1.Container{{Name: "run-iptables", SecurityContext: &corev1.SecurityContext{Privileged: &privileged}}},
+		EnableMeshTLS:  true,
+		CAInit:         CAInitConfig{Enabled: true, Image: "tykio/tyk-k8s", URL: "https://tyk-k8s.tyk.svc/ca/bundle"},
+		Restricted:     true,
+	}
+	if errs := cfg.validateRestricted(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	if tgt, err := inboundTarget(&corev1.Pod{}, cfg); err != nil || tgt != "http://localhost:80" {
+		t.Fatalf("restricted pods can't be reached through the iptables tunnel, got %v (%v)", tgt, err)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "foo"}, Annotations: map[string]string{}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+
+	data, err := createPatch(pod, cfg, pod.Annotations, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := pod.Spec
+	if len(spec.InitContainers) != 1 || spec.InitContainers[0].Name != caInitContainerName {
+		t.Fatalf("expected only the CA init container, got %v", spec.InitContainers)
+	}
+
+	for _, cnt := range []corev1.Container{spec.Containers[1], spec.InitContainers[0]} {
+		sc := cnt.SecurityContext
+		if sc == nil || !*sc.RunAsNonRoot || !*sc.ReadOnlyRootFilesystem || *sc.AllowPrivilegeEscalation || sc.Capabilities.Drop[0] != "ALL" {
+			t.Fatalf("container %v not hardened: %v", cnt.Name, sc)
+		}
+	}
+	if spec.Containers[0].SecurityContext != nil {
+		t.Fatal("the containers of the pod should be left alone")
+	}
+
+	patch := []patchOperation{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		t.Fatal(err)
+	}
+
+	seccomp := 0
+	for _, op := range patch {
+		if strings.HasSuffix(op.Path, "/securityContext/seccompProfile") {
+			seccomp++
+		}
+	}
+	if seccomp != 2 || !strings.Contains(string(data), `"/spec/containers/1/securityContext/seccompProfile"`) {
+		t.Fatalf("expected the seccomp profile of both injected containers, got %s", data)
+	}
+
+	cfg.CAInit.Enabled = false
+	cfg.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+	if errs := cfg.validateRestricted(); len(errs) != 2 {
+		t.Fatalf("expected a missing CA init and a privileged sidecar to be rejected, got %v", errs)
+	}
+}
+
+func BenchmarkCreatePatch(b *testing.B) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte(testCfg), cfg); err != nil {
+		b.Fatal(err)
+	}
+	cfg.Containers[0].Name = "tyk-mesh"
+	cfg.EnableMeshTLS = true
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// thousands of distinct services
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      map[string]string{"app": fmt.Sprintf("svc-%d", i%5000)},
+				Annotations: map[string]string{},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		}
+
+		if _, err := createPatch(pod, cfg, pod.Annotations, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMutationRequired_Never(t *testing.T) {
+	meta := &metav1.ObjectMeta{Name: "foo", Namespace: "bar", Annotations: map[string]string{
+		AdmissionWebhookAnnotationInjectKey: "Never",
+	}}
+
+	if mutationRequired(ignoredNamespaces, meta) {
+		t.Fatal("pods that never want injection should be skipped")
+	}
+
+	pod := &corev1.Pod{ObjectMeta: *meta}
+	if InjectPod(pod, &Config{}) || pod.Annotations[AdmissionWebhookAnnotationInjectKey] != "Never" {
+		t.Fatal("the never annotation should be kept on the pod")
+	}
+}
+
+func TestInjectCAVolume_ExcludeContainers(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			AdmissionWebhookAnnotationExcludeContainersKey: "legacy, other",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "legacy"}}},
+	}
+
+	spec := injectCAVolume(pod, &Config{EnableMeshTLS: true})
+	if len(spec.Containers[0].VolumeMounts) != 1 || len(spec.Containers[1].VolumeMounts) != 0 {
+		t.Fatalf("expected only the app container to mount the CA volume, got %+v", spec.Containers)
+	}
+}
+
+func TestInjectCAVolume_MountPaths(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			AdmissionWebhookAnnotationCAMountPathKey: "centos=/etc/pki/tls/certs/ca-bundle.crt",
+			AdmissionWebhookAnnotationCAMergeKey:     "true",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "centos"}}},
+	}
+
+	spec := injectCAVolume(pod.DeepCopy(), &Config{EnableMeshTLS: true})
+	want := []corev1.VolumeMount{
+		{Name: certVolumenName, MountPath: defaultCABundleFile, SubPath: mergedBundleName},
+		{Name: certVolumenName, MountPath: "/etc/pki/tls/certs/ca-bundle.crt", SubPath: mergedBundleName},
+	}
+	for i, cnt := range spec.Containers {
+		if !reflect.DeepEqual(cnt.VolumeMounts, want[i:i+1]) {
+			t.Fatalf("unexpected mounts of %v: %+v", cnt.Name, cnt.VolumeMounts)
+		}
+	}
+
+	delete(pod.Annotations, AdmissionWebhookAnnotationCAMergeKey)
+	pod.Annotations[AdmissionWebhookAnnotationCAMountPathKey] = "/usr/local/share/ca-certificates"
+	spec = injectCAVolume(pod.DeepCopy(), &Config{EnableMeshTLS: true, CAMountPath: "/etc/certs"})
+	if m := spec.Containers[1].VolumeMounts[0]; m.MountPath != "/usr/local/share/ca-certificates" || m.SubPath != "" {
+		t.Fatalf("expected the annotation to override the config, got %+v", m)
+	}
+
+	pod.Annotations[AdmissionWebhookAnnotationCAMountPathKey] = "app=certs"
+	if _, _, err := caMountPaths(pod); err == nil {
+		t.Fatal("relative mount paths should be rejected")
+	}
+}
+
+func TestMutatePodSpec_CAInit(t *testing.T) {
+	cfg := &Config{
+		EnableMeshTLS:  true,
+		InitContainers: []corev1.Container{{Name: "run-iptables", Image: "tykio/tyk-k8s-init"}},
+		CAInit:         CAInitConfig{Enabled: true, Image: "tykio/tyk-k8s", URL: "https://tyk-k8s.tyk.svc/ca/bundle", Insecure: true},
+	}
+	if errs := cfg.CAInit.Validate(cfg.InitContainers); len(errs) != 0 {
+		t.Fatalf("expected a valid config, got %v", errs)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	spec := mutatePodSpec(pod, cfg)
+
+	if len(spec.InitContainers) != 2 || spec.InitContainers[0].Name != caInitContainerName {
+		t.Fatalf("expected the CA init container to run first, got %+v", spec.InitContainers)
+	}
+
+	args := strings.Join(spec.InitContainers[0].Args, " ")
+	if args != "ca-init --url https://tyk-k8s.tyk.svc/ca/bundle --out "+caInitDir+" --timeout 1m0s --insecure" {
+		t.Fatalf("unexpected args %q", args)
+	}
+
+	if len(spec.Volumes) != 1 || spec.Volumes[0].Name != certVolumenName {
+		t.Fatalf("expected only the ssl-certs volume, got %+v", spec.Volumes)
+	}
+
+	cfg.InitContainers[0].VolumeMounts = []corev1.VolumeMount{{Name: volName, MountPath: "/var/tmp"}}
+	cfg.CAInit.URL = "tyk-k8s.tyk.svc"
+	if errs := cfg.CAInit.Validate(cfg.InitContainers); len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+}
+
+func TestMeshAnnotations(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		AdmissionWebhookAnnotationInjectKey:                            "true",
+		"string.service.tyk.io/proxy.transport.ssl_min_version":        "771",
+		"bool.service.tyk.io/proxy.transport.ssl_insecure_skip_verify": "false",
+		"num.service.tyk.io/cache_options.cache_timeout":               "20",
+	}}}
+
+	ann := meshAnnotations(pod.Annotations, map[string]string{
+		"bool.service.tyk.io/proxy.transport.ssl_insecure_skip_verify": "true",
+	})
+
+	if _, ok := ann[AdmissionWebhookAnnotationInjectKey]; ok {
+		t.Fatal("injector annotations should not be passed to the processor")
+	}
+
+	if ann["bool.service.tyk.io/proxy.transport.ssl_insecure_skip_verify"] != "false" {
+		t.Fatal("pod overrides should take precedence")
+	}
+
+	if len(ann) != 3 {
+		t.Fatalf("expected 3 processor annotations, got %v", ann)
+	}
+
+	pod.Annotations[tyk.PolicyRateAnnotation] = "100/60"
+	if ann := meshAnnotations(pod.Annotations, nil); ann[tyk.PolicyRateAnnotation] != "100/60" {
+		t.Fatalf("expected the rate limit to be passed on, got %v", ann)
+	}
+}
+
+func TestDeregisterWebhook(t *testing.T) {
+	client := fake.NewSimpleClientset(&admissionregistrationv1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "tyk-mesh"},
+	})
+
+	if err := DeregisterWebhook(client, "tyk-mesh"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get("tyk-mesh", metav1.GetOptions{}); err == nil {
+		t.Fatal("webhook configuration should be removed")
+	}
+
+	if err := DeregisterWebhook(client, "tyk-mesh"); err != nil {
+		t.Fatal("removing a missing configuration should not fail: ", err)
+	}
+}
+
+func TestWebhookServer_failOpen(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"}}
+	unavailable := fmt.Errorf("failed to create inbound service foo: %w", tyk.ErrUnavailable)
+
+	whsvr := &WebhookServer{SidecarConfig: &Config{}}
+	if resp := whsvr.failOpen(pod, unavailable); resp != nil {
+		t.Fatal("pods should be rejected unless failing open")
+	}
+
+	whsvr.SidecarConfig.FailOpen = true
+	resp := whsvr.failOpen(pod, unavailable)
+	if resp == nil || !resp.Allowed || !strings.Contains(string(resp.Patch), "injector.tyk.io~1injection-error") {
+		t.Fatalf("expected the pod to be admitted uninjected with the error recorded, got %+v", resp)
+	}
+
+	if resp := whsvr.failOpen(pod, fmt.Errorf("invalid annotation")); resp != nil {
+		t.Fatal("only dashboard unavailability should fail open")
+	}
+
+	// the namespace annotation takes precedence over the pod and the config
+	kc := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "bar",
+		Annotations: map[string]string{AdmissionWebhookAnnotationFailurePolicyKey: FailurePolicyClosed},
+	}})
+	whsvr = &WebhookServer{SidecarConfig: &Config{FailurePolicy: FailurePolicyOpen}, KubeClient: kc}
+	if resp := whsvr.failOpen(pod, unavailable); resp != nil {
+		t.Fatal("the namespace policy should reject the pod")
+	}
+
+	pod.Annotations = map[string]string{AdmissionWebhookAnnotationFailurePolicyKey: FailurePolicyOpen}
+	if resp := whsvr.failOpen(pod, unavailable); resp != nil {
+		t.Fatal("the pod policy should not loosen the namespace policy")
+	}
+
+	// pods can only tighten the policy of their namespace
+	ns, _ := kc.CoreV1().Namespaces().Get("bar", metav1.GetOptions{})
+	ns.Annotations[AdmissionWebhookAnnotationFailurePolicyKey] = FailurePolicyOpen
+	if _, err := kc.CoreV1().Namespaces().Update(ns); err != nil {
+		t.Fatal(err)
+	}
+
+	pod.Annotations = map[string]string{AdmissionWebhookAnnotationFailurePolicyKey: FailurePolicyClosed}
+	if resp := whsvr.failOpen(pod, unavailable); resp != nil {
+		t.Fatal("the pod policy should tighten the namespace policy")
+	}
+
+	pod.Annotations = nil
+	if resp := whsvr.failOpen(pod, unavailable); resp == nil || !resp.Allowed {
+		t.Fatalf("the namespace policy should admit the pod, got %+v", resp)
+	}
+
+	events, err := kc.CoreV1().Events("bar").List(metav1.ListOptions{})
+	if err != nil || len(events.Items) != 1 || events.Items[0].Reason != "InjectionFailed" {
+		t.Fatalf("expected a warning event, got %+v (%v)", events, err)
+	}
+}
+
+func TestWebhookServer_policyDenied(t *testing.T) {
+	policy := `package tyk.injector
+
+deny[msg] {
+	input.config.enableMeshTLS
+	input.namespace.labels.team != "payments"
+	msg := sprintf("namespace %v may not enable meshTLS", [input.namespace.name])
+}`
+	kc := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "injector-policies", Namespace: "tyk"},
+			Data:       map[string]string{"mesh.rego": policy, "README": "not a module"},
+		},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"team": "payments"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"team": "web"}}},
+	)
+	whsvr := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true, Policy: PolicyConfig{ConfigMap: "tyk/injector-policies"}},
+		KubeClient:    kc,
+	}
+	req := &v1beta1.AdmissionRequest{Kind: metav1.GroupVersionKind{Kind: "Pod"}, Name: "foo"}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}
+
+	if resp := whsvr.policyDenied(context.Background(), req, pod, "payments"); resp != nil {
+		t.Fatalf("pods labelled team=payments should be injected, got %+v", resp.Result)
+	}
+
+	resp := whsvr.policyDenied(context.Background(), req, pod, "web")
+	if resp == nil || resp.Allowed || resp.Result.Message != "admission policy: namespace web may not enable meshTLS" {
+		t.Fatalf("expected the pod to be denied, got %+v", resp)
+	}
+
+	// the last policies that compiled are kept
+	cm, _ := kc.CoreV1().ConfigMaps("tyk").Get("injector-policies", metav1.GetOptions{})
+	cm.Data["mesh.rego"] = "package tyk.injector\n\ndeny[msg] {"
+	cm.ResourceVersion = "2"
+	kc.CoreV1().ConfigMaps("tyk").Update(cm)
+	whsvr.policy.loaded = time.Time{}
+	if resp := whsvr.policyDenied(context.Background(), req, pod, "web"); resp == nil {
+		t.Fatal("a broken module should not drop the loaded policies")
+	}
+
+	// policies that can't be loaded reject pods unless failing open
+	whsvr = &WebhookServer{
+		SidecarConfig: &Config{Policy: PolicyConfig{ConfigMap: "tyk/missing"}},
+		KubeClient:    kc,
+	}
+	if resp := whsvr.policyDenied(context.Background(), req, pod, "web"); resp == nil {
+		t.Fatal("pods should be rejected without policies")
+	}
+
+	whsvr.SidecarConfig.Policy.FailOpen = true
+	if resp := whsvr.policyDenied(context.Background(), req, pod, "web"); resp != nil {
+		t.Fatalf("pods should be injected when failing open, got %+v", resp.Result)
+	}
+
+	if errs := (&PolicyConfig{ConfigMap: "injector-policies", Query: "deny"}).Validate(); len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+}
+
+func TestWebhookServer_createServiceRoutes(t *testing.T) {
+	mock := tyk.NewMockClient()
+	state := store.NewMemory()
+	whs := &WebhookServer{SidecarConfig: &Config{}, TykClients: mock.Resolver(), State: state}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "foo",
+		Labels:      map[string]string{"app": "foo"},
+		Annotations: map[string]string{},
+	}}
+
+	cl, err := whs.tykClient("bar", pod.Annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ann, err := whs.createServiceRoutes(context.Background(), cl, pod, map[string]string{}, "bar", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mock.APIs) != 2 {
+		t.Fatalf("expected an inbound and a mesh API, got %d", len(mock.APIs))
+	}
+
+	owned, err := store.Owned(state, store.Owner{Namespace: "bar", Service: "foo"})
+	if err != nil || len(owned) != 2 {
+		t.Fatalf("expected both APIs to be recorded, got %v (%v)", owned, err)
+	}
+
+	rec, err := state.Get(store.KindAPI, ann[AdmissionWebhookAnnotationInboundServiceIDKey])
+	if err != nil || rec.Slug != "foo.bar-inbound" || rec.Owner.Name != "foo" {
+		t.Fatalf("unexpected record of the inbound API %+v (%v)", rec, err)
+	}
+
+	mesh, err := mock.GetByObjectID(context.Background(), ann[AdmissionWebhookAnnotationMeshServiceIDKey])
+	if err != nil || mesh.Proxy.TargetURL != "http://foo.bar:8080" {
+		t.Fatalf("unexpected mesh API %+v (%v)", mesh, err)
+	}
+
+	again, err := whs.createServiceRoutes(context.Background(), cl, pod, map[string]string{}, "bar", false, nil)
+	if err != nil || again[AdmissionWebhookAnnotationInboundServiceIDKey] != ann[AdmissionWebhookAnnotationInboundServiceIDKey] || len(mock.APIs) != 2 {
+		t.Fatal("replicas of a pod should share their routes")
+	}
+}
+
+func TestSegmentTags(t *testing.T) {
+	tyk.Init(&tyk.TykConf{Org: "1", Segments: tyk.SegmentConf{
+		Namespaces: map[string]tyk.SegmentTags{"payments": {Mesh: []string{"mesh-payments"}}},
+	}})
+	defer tyk.Init(&tyk.TykConf{Org: "1"})
+
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{SidecarConfig: &Config{}, TykClients: mock.Resolver()}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "foo",
+		Namespace:   "payments",
+		Labels:      map[string]string{"app": "foo"},
+		Annotations: map[string]string{AdmissionWebhookAnnotationInjectKey: "true"},
+	}}
+
+	ann, err := whs.createServiceRoutes(context.Background(), mock, pod, map[string]string{}, "payments", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mesh, err := mock.GetByObjectID(context.Background(), ann[AdmissionWebhookAnnotationMeshServiceIDKey])
+	if err != nil || len(mesh.Tags) != 1 || mesh.Tags[0] != "mesh-payments" {
+		t.Fatalf("expected the mesh route in the payments segment, got %+v (%v)", mesh, err)
+	}
+
+	if tags := preProcessContainerTpl(pod, []corev1.Container{{Name: "tyk-mesh"}})[0].Env[0].Value; tags != "mesh-payments,foo" {
+		t.Fatalf("expected the sidecar to load the payments segment, got %v", tags)
+	}
+
+	pod.Namespace = "other"
+	if tags := preProcessContainerTpl(pod, []corev1.Container{{Name: "tyk-mesh"}})[0].Env[0].Value; tags != "mesh,foo" {
+		t.Fatalf("expected the default mesh segment, got %v", tags)
+	}
+
+	// pods can't load the segments of other namespaces
+	pod.Annotations[tyk.SegmentTagsAnnotation] = "mesh, mesh-payments"
+	if tags := preProcessContainerTpl(pod, []corev1.Container{{Name: "tyk-mesh"}})[0].Env[0].Value; tags != "mesh,foo" {
+		t.Fatalf("expected the segments of the namespace, got %v", tags)
+	}
+
+	if errs := whs.validatePod(pod); len(errs) != 1 {
+		t.Fatalf("expected the segments of other namespaces to be rejected, got %v", errs)
+	}
+}
+
+func TestMirrorOptions(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "foo",
+		Labels:      map[string]string{"app": "foo"},
+		Annotations: map[string]string{AdmissionWebhookAnnotationMirrorToKey: "foo-v2:10"},
+	}}
+
+	ann, err := mirrorOptions(pod, "foo", "bar", "foo", 8080, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := apidef.APIDefinition{}
+	base := `{"config_data": {}, "custom_middleware": {"pre": [], "driver": ""}}`
+	if err := processor.ProcessInto(ann, []byte(base), &def); err != nil {
+		t.Fatal(err)
+	}
+
+	mirror, _ := def.ConfigData["mirror"].(map[string]interface{})
+	if mirror["target"] != "https://foo-v2.bar:8080" || mirror["percent"] != float64(10) || mirror["strip"] != "/foo" {
+		t.Fatalf("unexpected mirror config %+v", def.ConfigData)
+	}
+
+	if pre := def.CustomMiddleware.Pre; len(pre) != 1 || pre[0].Name != mirrorMiddlewareName || def.CustomMiddleware.Driver != "otto" {
+		t.Fatalf("expected the mirror middleware, got %+v", def.CustomMiddleware)
+	}
+
+	for v, want := range map[string]string{
+		"foo-v2":         "foo-v2 bar 100",
+		"foo-v2.web:50%": "foo-v2 web 50",
+		"foo-v2:0":       "",
+		"foo-v2:101":     "",
+		".web":           "",
+	} {
+		svc, ns, percent, err := parseMirror(v, "bar")
+		if got := fmt.Sprintf("%v %v %v", svc, ns, percent); (err == nil && got != want) || (err != nil) != (want == "") {
+			t.Errorf("parseMirror(%q) = %q (%v), expected %q", v, got, err, want)
+		}
+	}
+
+	pod.Annotations[AdmissionWebhookAnnotationMirrorToKey] = "foo"
+	if _, err := mirrorOptions(pod, "foo", "bar", "foo", 8080, false); err == nil {
+		t.Fatal("a service should not mirror to itself")
+	}
+}
+
+func TestHeaderRouteOptions(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "foo",
+		Annotations: map[string]string{
+			AdmissionWebhookAnnotationHeaderRoutePrefix + "x-env": "staging=foo-staging, qa=foo-qa.testing",
+		},
+	}}
+
+	ann, err := headerRouteOptions(pod, "foo", "bar", "foo", 8080, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := apidef.APIDefinition{}
+	base := `{"version_data": {"versions": {"Default": {"extended_paths": {}}}}}`
+	if err := processor.ProcessInto(ann, []byte(base), &def); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrites := def.VersionData.Versions["Default"].ExtendedPaths.URLRewrite
+	if len(rewrites) != len(meshRouteMethods) {
+		t.Fatalf("expected a rewrite per method, got %+v", rewrites)
+	}
+
+	rw := rewrites[0]
+	if rw.MatchPattern != "^/foo(.*)" || rw.RewriteTo != "/foo$1" || len(rw.Triggers) != 2 {
+		t.Fatalf("unexpected rewrite %+v", rw)
+	}
+
+	qa := rw.Triggers[0]
+	if qa.RewriteTo != "http://foo-qa.testing:8080$1" || qa.Options.HeaderMatches["x-env"].MatchPattern != "^qa$" {
+		t.Fatalf("unexpected trigger %+v", qa)
+	}
+
+	for _, v := range []string{"staging", "staging=", "staging=foo", "=foo-staging"} {
+		pod.Annotations[AdmissionWebhookAnnotationHeaderRoutePrefix+"x-env"] = v
+		if _, err := headerRouteOptions(pod, "foo", "bar", "foo", 8080, false); err == nil {
+			t.Errorf("expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestResilienceOptions(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		AdmissionWebhookAnnotationCBThresholdKey: "50%",
+		AdmissionWebhookAnnotationCBSamplesKey:   "10",
+		AdmissionWebhookAnnotationTimeoutKey:     "1500ms",
+	}}}
+
+	ann, err := resilienceOptions(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := apidef.APIDefinition{}
+	base := `{"version_data": {"versions": {"Default": {"extended_paths": {}}}}}`
+	if err := processor.ProcessInto(ann, []byte(base), &def); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := def.VersionData.Versions["Default"].ExtendedPaths
+	if len(paths.CircuitBreaker) != len(meshRouteMethods) || len(paths.HardTimeouts) != len(meshRouteMethods) {
+		t.Fatalf("expected a breaker and a timeout per method, got %+v", paths)
+	}
+
+	if cb := paths.CircuitBreaker[0]; cb.ThresholdPercent != 0.5 || cb.Samples != 10 || cb.ReturnToServiceAfter != 30 {
+		t.Fatalf("unexpected circuit breaker %+v", cb)
+	}
+
+	if to := paths.HardTimeouts[0]; to.TimeOut != 2 {
+		t.Fatalf("expected the timeout to be rounded up, got %+v", to)
+	}
+
+	for k, v := range map[string]string{
+		AdmissionWebhookAnnotationCBThresholdKey:   "150%",
+		AdmissionWebhookAnnotationCBReturnAfterKey: "30",
+		AdmissionWebhookAnnotationTimeoutKey:       "-1s",
+		AdmissionWebhookAnnotationRetriesKey:       "3",
+	} {
+		p := pod.DeepCopy()
+		p.Annotations[k] = v
+		if _, err := resilienceOptions(p); err == nil {
+			t.Errorf("expected %v: %q to be rejected", k, v)
+		}
+	}
+}
+
+func TestWebhookServer_meshSlugs(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{SidecarConfig: &Config{}, TykClients: mock.Resolver()}
+	ctx := context.Background()
+
+	// a mesh route created by an earlier version for the foo app of a
+	legacyID, err := mock.CreateService(ctx, &tyk.APIDefOptions{Slug: "foo-mesh", Target: "http://foo.a:8080", ListenPath: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meshIDs := map[string]string{}
+	for _, ns := range []string{"a", "b"} {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   ns,
+			Labels:      map[string]string{"app": "foo"},
+			Annotations: map[string]string{admissionWebhookAnnotationRouteKey: "foo-" + ns},
+		}}
+
+		ann, err := whs.createServiceRoutes(ctx, mock, pod, pod.Annotations, ns, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meshIDs[ns] = ann[AdmissionWebhookAnnotationMeshServiceIDKey]
+	}
+
+	if meshIDs["a"] != legacyID {
+		t.Fatalf("expected the legacy mesh route of the namespace to be kept, got %v", meshIDs["a"])
+	}
+
+	def, err := mock.GetByObjectID(ctx, meshIDs["b"])
+	if err != nil || def.Slug != tyk.CleanSlug("foo.b-mesh") || def.Proxy.TargetURL != "http://foo.b:8080" {
+		t.Fatalf("expected a mesh route of its own for the app of another namespace, got %+v (%v)", def, err)
+	}
+
+	if slug := ResolveMeshSlug(ctx, mock, "b", "foo"); slug != "foo.b-mesh" {
+		t.Fatalf("expected the namespace-qualified slug, got %v", slug)
+	}
+	if slug := ResolveMeshSlug(ctx, mock, "a", "foo"); slug != "foo-mesh" {
+		t.Fatalf("expected the legacy slug, got %v", slug)
+	}
+}
+
+func TestWebhookServer_createReplicaRoutes(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{SidecarConfig: &Config{}, TykClients: mock.Resolver()}
+	ctrl := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "db-0",
+			Labels:          map[string]string{"app": "db"},
+			Annotations:     map[string]string{AdmissionWebhookAnnotationReplicaRoutesKey: "true"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db", Controller: &ctrl}},
+		},
+		Spec: corev1.PodSpec{Hostname: "db-0", Subdomain: "db-headless"},
+	}
+
+	cl, err := whs.tykClient("bar", pod.Annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ann, err := whs.createServiceRoutes(context.Background(), cl, pod, map[string]string{}, "bar", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mock.APIs) != 4 {
+		t.Fatalf("expected service and replica routes, got %d", len(mock.APIs))
+	}
+
+	inbound, err := mock.GetByObjectID(context.Background(), ann[AdmissionWebhookAnnotationReplicaInboundServiceIDKey])
+	if err != nil || inbound.Domain != "db-0.db-headless.bar" || inbound.Slug != "db-0.bar-inbound" {
+		t.Fatalf("unexpected replica inbound API %+v (%v)", inbound, err)
+	}
+
+	mesh, err := mock.GetByObjectID(context.Background(), ann[AdmissionWebhookAnnotationReplicaMeshServiceIDKey])
+	if err != nil || mesh.Proxy.TargetURL != "http://db-0.db-headless.bar:8080" || mesh.Proxy.ListenPath != "db-0" {
+		t.Fatalf("unexpected replica mesh API %+v (%v)", mesh, err)
+	}
+
+	tags := preProcessContainerTpl(pod, []corev1.Container{{Name: "tyk-mesh"}})[0].Env[0].Value
+	if tags != "mesh,db,db-0" {
+		t.Fatalf("expected the sidecar to load the replica route, got tags %v", tags)
+	}
+
+	// only StatefulSet pods get routes of their own
+	pod.OwnerReferences[0].Kind = "ReplicaSet"
+	if slugs := ReplicaSlugs(context.Background(), mock, pod); slugs != nil {
+		t.Fatalf("expected no replica routes, got %v", slugs)
+	}
+}
+
+func TestAppPort(t *testing.T) {
+	cfg := &Config{Containers: []corev1.Container{{Name: "tyk-mesh", Ports: []corev1.ContainerPort{{ContainerPort: 8080}}}}}
+	pod := func(ann map[string]string, ports ...corev1.ContainerPort) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: ann},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "app", Ports: ports},
+				{Name: "tyk-mesh", Ports: []corev1.ContainerPort{{ContainerPort: 8080}}},
+			}},
+		}
+	}
+
+	scenarios := []struct {
+		name   string
+		pod    *corev1.Pod
+		target string
+	}{
+		{"no ports", pod(nil), "http://localhost:6767"},
+		{"single port", pod(nil, corev1.ContainerPort{ContainerPort: 9000}), "http://localhost:9000"},
+		{"single TLS port", pod(nil, corev1.ContainerPort{ContainerPort: 443}), "https://localhost:6768"},
+		{"named http port", pod(nil, corev1.ContainerPort{Name: "metrics", ContainerPort: 9090}, corev1.ContainerPort{Name: "http-api", ContainerPort: 9000}), "http://localhost:9000"},
+		{"named https port", pod(nil, corev1.ContainerPort{Name: "metrics", ContainerPort: 9090}, corev1.ContainerPort{Name: "https", ContainerPort: 8443}), "https://localhost:8443"},
+		{"several unnamed ports", pod(nil, corev1.ContainerPort{ContainerPort: 9000}, corev1.ContainerPort{ContainerPort: 9090}), "http://localhost:6767"},
+		{"annotated port", pod(map[string]string{AdmissionWebhookAnnotationAppPortKey: "9090"}, corev1.ContainerPort{Name: "http", ContainerPort: 9000}), "http://localhost:9090"},
+		{"annotated name", pod(map[string]string{AdmissionWebhookAnnotationAppPortKey: "admin"}, corev1.ContainerPort{Name: "https-admin", ContainerPort: 9443}, corev1.ContainerPort{Name: "admin", ContainerPort: 9000}), "http://localhost:9000"},
+		{"annotated scheme", pod(map[string]string{AdmissionWebhookAnnotationAppPortKey: "https:9000"}), "https://localhost:9000"},
+	}
+
+	for _, sc := range scenarios {
+		if tgt, err := inboundTarget(sc.pod, cfg); err != nil || tgt != sc.target {
+			t.Fatalf("%v: expected %v, got %v (%v)", sc.name, sc.target, tgt, err)
+		}
+	}
+
+	for _, v := range []string{"ftp:21", "70000", "grpc"} {
+		if _, err := inboundTarget(pod(map[string]string{AdmissionWebhookAnnotationAppPortKey: v}), cfg); err == nil {
+			t.Fatalf("expected %q to be rejected", v)
+		}
+	}
+
+	// the inbound route would call the sidecar itself
+	if _, err := inboundTarget(pod(nil, corev1.ContainerPort{Name: "http", ContainerPort: 8080}), cfg); err == nil {
+		t.Fatal("expected an app port used by the sidecar to be rejected")
+	}
+	if _, err := inboundTarget(pod(map[string]string{AdmissionWebhookAnnotationAppPortKey: "8080"}), cfg); err == nil {
+		t.Fatal("expected an annotated app port used by the sidecar to be rejected")
+	}
+
+	ann := inboundAnnotations(map[string]string{}, "https://localhost:8443")
+	if ann["bool.service.tyk.io/proxy.transport.ssl_insecure_skip_verify"] != "true" {
+		t.Fatalf("the certificate of the app can't be verified on localhost, got %v", ann)
+	}
+	if ann := inboundAnnotations(map[string]string{}, "http://localhost:9000"); len(ann) != 0 {
+		t.Fatalf("plain HTTP apps need no transport settings, got %v", ann)
+	}
+}
+
+func TestNamedPorts(t *testing.T) {
+	single := servicePorts(&corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80}}}}, nil)
+	if len(single) != 2 || single[0].Port != 80 || single[0].TargetPort.IntValue() != 8080 || single[1].Name != "tyk-sidecar" {
+		t.Fatalf("expected a single port to be kept and proxied on the sidecar port, got %v", single)
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "foo"},
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromString("web")},
+				{Name: "grpc", Port: 9090},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+				{Name: "metrics", Port: 9100, TargetPort: intstr.FromInt(9100)},
+			},
+		},
+	}
+	ports := servicePorts(svc, map[string]bool{"web": true, "grpc": true})
+	web, grpc := sidecarPort("web"), sidecarPort("grpc")
+	if web == grpc || web < sidecarPortBase || ports[0].TargetPort.IntValue() != int(web) || ports[1].TargetPort.IntValue() != int(grpc) || ports[2].TargetPort.IntValue() != 0 {
+		t.Fatalf("expected the ports to target the sidecar ports of their names, got %v", ports)
+	}
+	if ports[3].TargetPort.IntValue() != 9100 {
+		t.Fatalf("ports without a route should reach the pods directly, got %v", ports[3])
+	}
+	if len(ports) != 7 || ports[5].Name != sidecarPortName(web) || ports[5].Port != web || ports[6].Port != grpc {
+		t.Fatalf("expected the sidecar ports to be added, got %v", ports)
+	}
+
+	// without pods, only ports targeted by name can have routes
+	if routed := guessRoutedPorts(svc); routed != nil {
+		t.Fatalf("a single port targeted by name has no route, got %v", routed)
+	}
+
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{SidecarConfig: &Config{Containers: []corev1.Container{{Name: "tyk-mesh"}}}, TykClients: mock.Resolver()}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Labels: map[string]string{"app": "foo"}, Annotations: map[string]string{}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "app",
+			Ports: []corev1.ContainerPort{{Name: "web", ContainerPort: 80}, {Name: "grpc", ContainerPort: 9090}, {ContainerPort: 9100}},
+		}}},
+	}
+
+	cl, err := whs.tykClient("bar", pod.Annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ann, err := whs.createServiceRoutes(context.Background(), cl, pod, map[string]string{}, "bar", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mock.APIs) != 6 || len(PortServiceIDs(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: ann}})) != 4 {
+		t.Fatalf("expected service and port routes, got %d APIs and %v", len(mock.APIs), ann)
+	}
+
+	inbound, err := mock.GetBySlug(context.Background(), "foo-grpc.bar-inbound")
+	if err != nil || inbound.Proxy.TargetURL != "http://localhost:9090" || inbound.Domain != "foo.bar" {
+		t.Fatalf("unexpected port inbound API %+v (%v)", inbound, err)
+	}
+
+	mesh, err := mock.GetBySlug(context.Background(), "foo-web.bar-mesh")
+	if err != nil || mesh.Proxy.TargetURL != fmt.Sprintf("http://foo.bar:%d", web) || mesh.Proxy.ListenPath != "foo" {
+		t.Fatalf("unexpected port mesh API %+v (%v)", mesh, err)
+	}
+
+	// port 80 is tunnelled to the app
+	if web, err := mock.GetBySlug(context.Background(), "foo-web.bar-inbound"); err != nil || web.Proxy.TargetURL != "http://localhost:6767" {
+		t.Fatalf("unexpected port inbound API %+v (%v)", web, err)
+	}
+
+	env := addPortEnv(pod, []corev1.Container{{Name: "tyk-mesh"}}, whs.SidecarConfig)[0].Env
+	if !hasEnv(env, portWhitelistVarName) {
+		t.Fatal("expected the sidecar to listen on the ports of the routes")
+	}
+
+	pod.Namespace, pod.Annotations = "bar", ann
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "tyk-mesh", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}})
+	if slugs := PortSlugs(context.Background(), cl, pod); len(slugs) != 4 || slugs[0] != "foo-grpc.bar-inbound" || slugs[1] != "foo-grpc.bar-mesh" {
+		t.Fatalf("unexpected port slugs %v", slugs)
+	}
+
+	// the routes of the pods decide which service ports are rewritten
+	pod.Namespace = "bar"
+	pod.Annotations[AdmissionWebhookAnnotationStatusKey] = "injected"
+	whs.KubeClient = fake.NewSimpleClientset(pod)
+	if routed := whs.routedPorts(svc, "bar"); len(routed) != 2 || !routed["web"] || !routed["grpc"] {
+		t.Fatalf("expected the named ports of the pod to be routed, got %v", routed)
+	}
+
+	pod.Spec.Containers[0].Ports[1].ContainerPort = sidecarPort("web")
+	if _, err := namedPorts(pod, whs.SidecarConfig.Containers); err == nil {
+		t.Fatal("expected a container port used by a sidecar port to be rejected")
+	}
+}
+
+func TestWebhookServer_ServeMeshServices(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{SidecarConfig: &Config{Discovery: DiscoveryConf{Token: "secret"}}, TykClients: mock.Resolver()}
+
+	newPod := func(name, ns string, ready corev1.ConditionStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   ns,
+				Labels:      map[string]string{"app": "foo"},
+				Annotations: map[string]string{AdmissionWebhookAnnotationStatusKey: "injected"},
+			},
+			Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}}},
+		}
+	}
+
+	pods := []*corev1.Pod{newPod("foo-1", "bar", corev1.ConditionTrue), newPod("foo-2", "bar", corev1.ConditionFalse), newPod("foo-1", "baz", corev1.ConditionFalse)}
+	for _, pod := range pods {
+		cl, err := whs.tykClient(pod.Namespace, pod.Annotations)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ann, err := whs.createServiceRoutes(context.Background(), cl, pod, pod.Annotations, pod.Namespace, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pod.Annotations = ann
+	}
+
+	// not injected
+	plain := newPod("other", "bar", corev1.ConditionTrue)
+	plain.Annotations = nil
+
+	whs.KubeClient = fake.NewSimpleClientset(pods[0], pods[1], pods[2], plain)
+
+	req := httptest.NewRequest("GET", MeshServicesRoute+"?namespace=bar", nil)
+	rec := httptest.NewRecorder()
+	whs.ServeMeshServices(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected callers without a token to be rejected, got %d", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	whs.ServeMeshServices(rec, req)
+
+	var res []MeshService
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+
+	if len(res) != 1 {
+		t.Fatalf("expected one service in bar, got %+v", res)
+	}
+
+	svc := res[0]
+	if svc.Service != "foo" || svc.Replicas != 2 || svc.Ready != 1 || !svc.Healthy || svc.ListenPath != "foo" || svc.Hostname != "mesh" || svc.Error != "" {
+		t.Fatalf("unexpected service %+v", svc)
+	}
+
+	// the services are cached, neither the pods nor the routes are read again
+	whs.KubeClient = fake.NewSimpleClientset()
+	mock.APIs = map[string]*objects.DBApiDefinition{}
+	all, err := whs.MeshServices(context.Background(), metav1.NamespaceAll)
+	if err != nil || len(all) != 2 || all[1].Namespace != "baz" || all[1].Healthy || all[1].ListenPath != "foo" {
+		t.Fatalf("expected an unhealthy service in baz, got %+v (%v)", all, err)
+	}
+
+	whs.directory.listed = time.Time{}
+	if all, err := whs.MeshServices(context.Background(), metav1.NamespaceAll); err != nil || len(all) != 0 {
+		t.Fatalf("expected the services to be listed again once stale, got %+v (%v)", all, err)
+	}
+}
+
+func TestWebhookServer_handleWorkloadIdentity(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true, WorkloadIdentity: true},
+		CAClient:      &ca.Mock{},
+		TykClients:    mock.Resolver(),
+	}
+
+	join := func(app string) (*corev1.Pod, map[string]string) {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        app,
+			Labels:      map[string]string{"app": app},
+			Annotations: map[string]string{},
+		}}
+
+		ann, err := whs.createServiceRoutes(context.Background(), mock, pod, pod.Annotations, "bar", true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := whs.handleWorkloadIdentity(context.Background(), mock, pod, "bar", ann); err != nil {
+			t.Fatal(err)
+		}
+
+		return pod, ann
+	}
+
+	fooPod, foo := join("foo")
+	_, baz := join("baz")
+
+	if foo[AdmissionWebhookAnnotationIdentityCertIDKey] == "" || foo[AdmissionWebhookAnnotationIdentityCertIDKey] == baz[AdmissionWebhookAnnotationIdentityCertIDKey] {
+		t.Fatalf("expected distinct identities, got %v and %v", foo, baz)
+	}
+
+	// the inbound route of foo must accept the identity of baz, which joined later
+	in, err := mock.GetByObjectID(context.Background(), foo[AdmissionWebhookAnnotationInboundServiceIDKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !in.UseMutualTLSAuth || len(in.ClientCertificates) != 2 {
+		t.Fatalf("expected mutual TLS with both identities, got %v %v", in.UseMutualTLSAuth, in.ClientCertificates)
+	}
+
+	// replicas reuse the identity of their service
+	_, again := join("foo")
+	if again[AdmissionWebhookAnnotationIdentityCertIDKey] != foo[AdmissionWebhookAnnotationIdentityCertIDKey] {
+		t.Fatal("replicas should share their identity")
+	}
+
+	cnts := preProcessContainerTpl(fooPod, []corev1.Container{{Name: "tyk-mesh"}})
+	want := identityEnv(foo[AdmissionWebhookAnnotationIdentityCertIDKey])
+	found := false
+	for _, e := range cnts[0].Env {
+		if e == want {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("expected sidecar to present its identity, got %v", cnts[0].Env)
+	}
+}
+
+func TestWebhookServer_identityExemptions(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true, WorkloadIdentity: true},
+		CAClient:      &ca.Mock{},
+		TykClients:    mock.Resolver(),
+	}
+
+	join := func(app, exempt string) map[string]string {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        app,
+			Labels:      map[string]string{"app": app},
+			Annotations: map[string]string{AdmissionWebhookAnnotationMTLSExemptKey: exempt},
+		}}
+
+		ann, err := whs.createServiceRoutes(context.Background(), mock, pod, pod.Annotations, "bar", true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := whs.handleWorkloadIdentity(context.Background(), mock, pod, "bar", ann); err != nil {
+			t.Fatal(err)
+		}
+
+		return ann
+	}
+
+	inbound := func(ann map[string]string) *objects.DBApiDefinition {
+		def, err := mock.GetByObjectID(context.Background(), ann[AdmissionWebhookAnnotationInboundServiceIDKey])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return def
+	}
+
+	foo := join("foo", "service")
+	if def := inbound(foo); def.UseMutualTLSAuth || len(def.ClientCertificates) != 0 {
+		t.Fatalf("expected an exempt inbound route, got %v %v", def.UseMutualTLSAuth, def.ClientCertificates)
+	}
+
+	// a new identity joining the mesh must not close the exempt route
+	join("baz", "")
+	if def := inbound(foo); def.UseMutualTLSAuth {
+		t.Fatal("the exempt route should stay open when identities are added")
+	}
+
+	// removing the annotation requires identities again
+	join("foo", "")
+	if def := inbound(foo); !def.UseMutualTLSAuth || len(def.ClientCertificates) != 2 {
+		t.Fatalf("expected mutual TLS with both identities, got %v %v", def.UseMutualTLSAuth, def.ClientCertificates)
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AdmissionWebhookAnnotationMTLSExemptKey: "service,metrics"}}}
+	if _, err := identityExemptions(pod, nil); err == nil {
+		t.Fatal("expected an error for a port without a route")
+	}
+}
+
+func TestWebhookServer_trustDomains(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true, WorkloadIdentity: true, TrustDomains: TrustDomainConf{
+			Enabled: true,
+			Allow:   map[string][]string{"bar": {"baz"}},
+		}},
+		CAClient:   &ca.Mock{},
+		TykClients: mock.Resolver(),
+	}
+
+	join := func(app, ns string) map[string]string {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        app,
+			Labels:      map[string]string{"app": app},
+			Annotations: map[string]string{},
+		}}
+
+		ann, err := whs.createServiceRoutes(context.Background(), mock, pod, pod.Annotations, ns, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := whs.handleWorkloadIdentity(context.Background(), mock, pod, ns, ann); err != nil {
+			t.Fatal(err)
+		}
+
+		return ann
+	}
+
+	allowed := func(ann map[string]string) map[string]bool {
+		def, err := mock.GetByObjectID(context.Background(), ann[AdmissionWebhookAnnotationInboundServiceIDKey])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		certs := map[string]bool{}
+		for _, id := range def.ClientCertificates {
+			certs[id] = true
+		}
+		return certs
+	}
+
+	foo, qux, zed := join("foo", "bar"), join("qux", "baz"), join("zed", "other")
+	id := func(ann map[string]string) string {
+		return ann[AdmissionWebhookAnnotationIdentityCertIDKey]
+	}
+
+	// bar accepts baz, the identities joining later included
+	if got := allowed(foo); len(got) != 2 || !got[id(foo)] || !got[id(qux)] {
+		t.Fatalf("expected bar to accept bar and baz, got %v", got)
+	}
+
+	if got := allowed(qux); len(got) != 1 || !got[id(qux)] {
+		t.Fatalf("expected baz to only accept itself, got %v", got)
+	}
+
+	if got := allowed(zed); len(got) != 1 || !got[id(zed)] {
+		t.Fatalf("expected other to only accept itself, got %v", got)
+	}
+
+	if errs := (&TrustDomainConf{Allow: map[string][]string{"bar": {"*", "Not_A_Namespace"}}}).Validate(); len(errs) != 1 {
+		t.Fatalf("expected an error for the invalid caller, got %v", errs)
+	}
+}
+
+func TestWebhookServer_meshPolicies(t *testing.T) {
+	policy := func(ns, name string, spec map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "mesh.tyk.io/v1alpha1",
+			"kind":       "MeshPolicy",
+			"metadata":   map[string]interface{}{"namespace": ns, "name": name},
+			"spec":       spec,
+		}}
+	}
+
+	dyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		policy("bar", "orders", map[string]interface{}{
+			"destinations": []interface{}{"foo"},
+			"sources":      []interface{}{map[string]interface{}{"namespace": "baz", "serviceAccounts": []interface{}{"qux-sa"}}},
+			"rules":        []interface{}{map[string]interface{}{"paths": []interface{}{"/orders"}, "methods": []interface{}{"GET"}}},
+		}),
+		policy("other", "broken", map[string]interface{}{
+			"sources": []interface{}{map[string]interface{}{}},
+			"rules":   []interface{}{map[string]interface{}{"paths": []interface{}{"/"}, "methods": []interface{}{"FETCH"}}},
+		}),
+	)
+
+	kc := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "qux-1", Namespace: "baz", Labels: map[string]string{"app": "qux"}}, Spec: corev1.PodSpec{ServiceAccountName: "qux-sa"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "quux-1", Namespace: "baz", Labels: map[string]string{"app": "quux"}}},
+	)
+
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true, WorkloadIdentity: true, MeshPolicies: MeshPolicyConf{Enabled: true}},
+		CAClient:      &ca.Mock{},
+		TykClients:    mock.Resolver(),
+		KubeClient:    kc,
+		DynamicClient: dyn,
+	}
+
+	if err := whs.LoadMeshPolicies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	join := func(app, ns string) map[string]string {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        app,
+			Labels:      map[string]string{"app": app},
+			Annotations: map[string]string{},
+		}}
+
+		ann, err := whs.createServiceRoutes(context.Background(), mock, pod, pod.Annotations, ns, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := whs.handleWorkloadIdentity(context.Background(), mock, pod, ns, ann); err != nil {
+			t.Fatal(err)
+		}
+
+		return ann
+	}
+
+	inbound := func(ann map[string]string) *objects.DBApiDefinition {
+		def, err := mock.GetByObjectID(context.Background(), ann[AdmissionWebhookAnnotationInboundServiceIDKey])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return def
+	}
+
+	foo, qux, _, zed := join("foo", "bar"), join("qux", "baz"), join("quux", "baz"), join("zed", "other")
+
+	// only qux runs as the service account of the source
+	def := inbound(foo)
+	if len(def.ClientCertificates) != 1 || def.ClientCertificates[0] != qux[AdmissionWebhookAnnotationIdentityCertIDKey] {
+		t.Fatalf("expected foo to only accept qux, got %v", def.ClientCertificates)
+	}
+
+	wl := def.VersionData.Versions["Default"].ExtendedPaths.WhiteList
+	if len(wl) != 1 || wl[0].Path != "/orders" || len(wl[0].MethodActions) != 1 {
+		t.Fatalf("expected GET /orders to be whitelisted, got %+v", wl)
+	}
+
+	// an invalid policy denies every caller
+	if def := inbound(zed); !def.UseMutualTLSAuth || len(def.ClientCertificates) != 0 {
+		t.Fatalf("expected zed to accept no caller, got %v", def.ClientCertificates)
+	}
+
+	// services no policy selects accept every identity
+	if def := inbound(qux); len(def.ClientCertificates) != 4 {
+		t.Fatalf("expected qux to accept all identities, got %v", def.ClientCertificates)
+	}
+
+	// the pods of a namespace are listed once per reconcile
+	kc.ClearActions()
+	certs, _ := whs.identities(context.Background())
+	whs.updateInboundRoutes(context.Background(), mock, []string{"bar/foo", "bar/foo"}, certs)
+	if lists := len(kc.Actions()); lists != 1 {
+		t.Fatalf("expected the pods of baz to be listed once, got %d lists", lists)
+	}
+
+	// removing the rules removes the whitelisted paths
+	if _, err := dyn.Resource(MeshPolicyResource).Namespace("bar").Update(policy("bar", "orders", map[string]interface{}{
+		"sources": []interface{}{map[string]interface{}{"namespace": "*"}},
+	}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := whs.LoadMeshPolicies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	certs, _ = whs.identities(context.Background())
+	whs.updateInboundRoutes(context.Background(), mock, []string{"bar/foo"}, certs)
+	def = inbound(foo)
+	if wl := def.VersionData.Versions["Default"].ExtendedPaths.WhiteList; len(wl) != 0 || len(def.ClientCertificates) != 4 {
+		t.Fatalf("expected foo to accept all identities on all paths, got %v %+v", def.ClientCertificates, wl)
+	}
+}
+
+func TestWebhookServer_rotateExpiringCerts(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true, CertRotationThreshold: time.Hour},
+		CAClient:      &ca.Mock{},
+		TykClients:    mock.Resolver(),
+	}
+
+	ctx := context.Background()
+	id, err := mock.CreateService(ctx, &tyk.APIDefOptions{Slug: "foo.bar-inbound", Hostname: "foo.bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := whs.generateStoreAndRegisterCertForAPIDef(ctx, mock, id, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	def, _ := mock.GetByObjectID(ctx, id)
+	old := def.Certificates[0]
+
+	// nothing to rotate yet
+	whs.rotateExpiringCerts(ctx)
+	if _, ok := mock.Certs[old]; !ok || len(mock.Certs) != 1 {
+		t.Fatal("certificates not due for renewal should not be rotated")
+	}
+
+	cm, err := whs.CAClient.ListCertsExpiringBefore(time.Now().Add(100 * 365 * 24 * time.Hour))
+	if err != nil || len(cm) != 1 {
+		t.Fatalf("expected a stored server certificate, got %v (%v)", cm, err)
+	}
+	cm[0].Expires = time.Now().Add(time.Minute)
+
+	whs.rotateExpiringCerts(ctx)
+	def, _ = mock.GetByObjectID(ctx, id)
+	if len(def.Certificates) != 1 || def.Certificates[0] == old {
+		t.Fatalf("expected the certificate to be swapped, got %v", def.Certificates)
+	}
+
+	if _, ok := mock.Certs[old]; ok {
+		t.Fatal("replaced certificate should be removed from tyk")
+	}
+
+	if len(cm[0].BundleHistory) != 1 || cm[0].Bundle.Fingerprint != def.Certificates[0] {
+		t.Fatalf("unexpected stored certificate %+v", cm[0])
+	}
+}
+
+// rotatingCA is a CA in the reissuing phase of a root rotation, certs
+// created before the rotation that were never rotated are stale
+type rotatingCA struct {
+	*ca.Mock
+	since    time.Time
+	pending  []int
+	meshCert string
+}
+
+func (r *rotatingCA) RotationStatus() (*ca.RotationStatus, error) {
+	return &ca.RotationStatus{Phase: ca.RotationReissuing}, nil
+}
+
+func (r *rotatingCA) StaleCert(cm *ca.CertModel) bool {
+	return len(cm.BundleHistory) == 0 && !cm.Created.After(r.since)
+}
+
+func (r *rotatingCA) AdvanceRotation(pending int) (*ca.RotationStatus, error) {
+	r.pending = append(r.pending, pending)
+	return r.RotationStatus()
+}
+
+func (r *rotatingCA) RotationBatchSize() int { return 1 }
+
+func (r *rotatingCA) RotationMeshCert() string { return r.meshCert }
+
+func (r *rotatingCA) SetRotationMeshCert(id string) error {
+	r.meshCert = id
+	return nil
+}
+
+func (r *rotatingCA) GetOrCreateMeshCertID(hosts ...string) (string, error) {
+	bdl, _ := r.GenerateCert("mesh", hosts...)
+	bdl.Fingerprint = "mesh-2"
+	cm := ca.NewCertModel(bdl)
+	cm.IsMeshCert = true
+	if _, err := r.StoreCert(cm); err != nil {
+		return "", err
+	}
+
+	return bdl.Fingerprint, nil
+}
+
+func TestWebhookServer_reconcileCARotation(t *testing.T) {
+	mock := tyk.NewMockClient()
+	rot := &rotatingCA{Mock: &ca.Mock{}}
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true, WorkloadIdentity: true, MeshCertificateID: "mesh-1"},
+		CAClient:      rot,
+		TykClients:    mock.Resolver(),
+	}
+
+	ctx := context.Background()
+	for _, name := range []string{"foo", "bar"} {
+		id, err := mock.CreateService(ctx, &tyk.APIDefOptions{Slug: InboundSlug("bar", name), Hostname: name + ".bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := whs.generateStoreAndRegisterCertForAPIDef(ctx, mock, id, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := whs.identityCert(ctx, mock, "bar", "bar/foo", "foo.bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	meshBdl, _ := rot.GenerateCert("mesh")
+	meshBdl.Fingerprint = "mesh-1"
+	meshCert := ca.NewCertModel(meshBdl)
+	meshCert.IsMeshCert = true
+	rot.StoreCert(meshCert)
+
+	meshID, err := mock.CreateService(ctx, &tyk.APIDefOptions{Slug: "foo-mesh", Hostname: "mesh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := whs.generateStoreAndRegisterCertForAPIDef(ctx, mock, meshID, whs.meshCertID()); err != nil {
+		t.Fatal(err)
+	}
+
+	rot.since = time.Now()
+	time.Sleep(time.Millisecond)
+
+	whs.reconcileCARotation(ctx)
+	whs.reconcileCARotation(ctx)
+	whs.reconcileCARotation(ctx)
+	if !reflect.DeepEqual(rot.pending, []int{2, 1, 0}) {
+		t.Fatalf("expected the certificates to be reissued one at a time, got pending %v", rot.pending)
+	}
+
+	certs, _ := rot.ListCertsExpiringBefore(time.Now().AddDate(100, 0, 0))
+	for _, cm := range certs {
+		if rot.StaleCert(cm) {
+			t.Fatalf("certificate of %v was not reissued", cm.ServiceID)
+		}
+	}
+
+	if id, err := rot.GetCertByIdentity("bar/foo"); err != nil || rot.StaleCert(id) {
+		t.Fatalf("identity was not reissued: %v", err)
+	}
+
+	def, _ := mock.GetByObjectID(ctx, meshID)
+	if whs.meshCertID() != "mesh-2" || !reflect.DeepEqual(def.Certificates, []string{"mesh-2"}) {
+		t.Fatalf("mesh certificate was not swapped: %v %v", whs.meshCertID(), def.Certificates)
+	}
+
+	// another replica started with the retired cert attaches the reissued one
+	replica := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true, MeshCertificateID: "mesh-1"},
+		CAClient:      rot,
+		TykClients:    mock.Resolver(),
+	}
+
+	otherID, err := mock.CreateService(ctx, &tyk.APIDefOptions{Slug: "baz-mesh", Hostname: "mesh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.generateStoreAndRegisterCertForAPIDef(ctx, mock, otherID, replica.meshCertID()); err != nil {
+		t.Fatal(err)
+	}
+
+	def, _ = mock.GetByObjectID(ctx, otherID)
+	if !reflect.DeepEqual(def.Certificates, []string{"mesh-2"}) {
+		t.Fatalf("expected the other replica to attach the reissued mesh certificate, got %v", def.Certificates)
+	}
+}
+
+func TestWebhookServer_RevokeIdentity(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true, WorkloadIdentity: true},
+		CAClient:      &ca.Mock{},
+		TykClients:    mock.Resolver(),
+	}
+
+	ctx := context.Background()
+	anns := map[string]map[string]string{}
+	for _, app := range []string{"foo", "baz"} {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        app,
+			Labels:      map[string]string{"app": app},
+			Annotations: map[string]string{},
+		}}
+
+		ann, err := whs.createServiceRoutes(ctx, mock, pod, pod.Annotations, "bar", true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := whs.handleWorkloadIdentity(ctx, mock, pod, "bar", ann); err != nil {
+			t.Fatal(err)
+		}
+		anns[app] = ann
+	}
+
+	if err := whs.RevokeIdentity(ctx, "bar", "baz", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked := anns["baz"][AdmissionWebhookAnnotationIdentityCertIDKey]
+	if _, ok := mock.Certs[revoked]; ok {
+		t.Fatal("revoked certificate should be removed from tyk")
+	}
+
+	for _, app := range []string{"foo", "baz"} {
+		in, _ := mock.GetByObjectID(ctx, anns[app][AdmissionWebhookAnnotationInboundServiceIDKey])
+		if len(in.ClientCertificates) != 1 || in.ClientCertificates[0] != anns["foo"][AdmissionWebhookAnnotationIdentityCertIDKey] {
+			t.Fatalf("expected only the identity of foo on %v, got %v", app, in.ClientCertificates)
+		}
+	}
+
+	if err := whs.RevokeIdentity(ctx, "bar", "baz", 1); err == nil {
+		t.Fatal("expected an error revoking an identity twice")
+	}
+}
+
+func TestWebhookServer_generateStoreAndRegisterCertForAPIDef(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true},
+		CAClient:      &ca.Mock{},
+		TykClients:    mock.Resolver(),
+	}
+
+	ctx := context.Background()
+	id, err := mock.CreateService(ctx, &tyk.APIDefOptions{Slug: "foo.bar-inbound", Hostname: "foo.bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := whs.generateStoreAndRegisterCertForAPIDef(ctx, mock, id, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	def, _ := mock.GetByObjectID(ctx, id)
+	if len(def.Certificates) != 1 || len(mock.Certs) != 1 {
+		t.Fatalf("expected a single registered certificate, got %v", def.Certificates)
+	}
+	first := def.Certificates[0]
+
+	// certificates removed from the tyk store are pruned and reissued
+	delete(mock.Certs, first)
+	def.Certificates = append(def.Certificates, "gone")
+	if err := mock.UpdateAPI(ctx, &def.APIDefinition); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := whs.generateStoreAndRegisterCertForAPIDef(ctx, mock, id, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	def, _ = mock.GetByObjectID(ctx, id)
+	if len(def.Certificates) != 1 || def.Certificates[0] == first {
+		t.Fatalf("expected a reissued certificate, got %v", def.Certificates)
+	}
+
+	// expired certificates are replaced
+	second := def.Certificates[0]
+	cm, err := whs.CAClient.GetServerCertByLinkedAPIID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Expires = time.Now().Add(-time.Minute)
+
+	if err := whs.generateStoreAndRegisterCertForAPIDef(ctx, mock, id, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	def, _ = mock.GetByObjectID(ctx, id)
+	if len(def.Certificates) != 1 || def.Certificates[0] == second {
+		t.Fatalf("expected the expired certificate to be replaced, got %v", def.Certificates)
+	}
+
+	if len(cm.BundleHistory) != 2 {
+		t.Fatalf("expected replaced bundles in the history, got %d", len(cm.BundleHistory))
+	}
+}
+
+func TestWebhookServer_serverCertHosts(t *testing.T) {
+	whs := &WebhookServer{
+		SidecarConfig: &Config{},
+		KubeClient: fake.NewSimpleClientset(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"},
+			Spec:       corev1.ServiceSpec{ClusterIP: "10.0.0.10"},
+		}),
+	}
+
+	want := "foo,foo.bar,foo.bar.svc,foo.bar.svc.cluster.local,mesh,mesh.local,10.0.0.10"
+	if hosts := strings.Join(whs.serverCertHosts("foo.bar"), ","); hosts != want {
+		t.Fatalf("expected %v, got %v", want, hosts)
+	}
+
+	whs.SidecarConfig.ClusterDomain = "example.internal"
+	want = "baz,baz.bar,baz.bar.svc,baz.bar.svc.example.internal,mesh,mesh.local"
+	if hosts := strings.Join(whs.serverCertHosts("baz.bar"), ","); hosts != want {
+		t.Fatalf("expected %v, got %v", want, hosts)
+	}
+
+	want = "db-0.db.bar,db-0.db.bar.svc,db-0.db.bar.svc.example.internal,mesh,mesh.local"
+	if hosts := strings.Join(whs.serverCertHosts("db-0.db.bar"), ","); hosts != want {
+		t.Fatalf("expected %v, got %v", want, hosts)
+	}
+
+	// the aliases of the namespace are added, mesh routes get a cert for all of them
+	whs.SidecarConfig.MeshHostnames = MeshHostnameConf{Namespaces: map[string][]string{"bar": {"mesh.internal"}}}
+	want = "baz,baz.bar,baz.bar.svc,baz.bar.svc.example.internal,mesh,mesh.local,mesh.internal"
+	if hosts := strings.Join(whs.serverCertHosts("baz.bar"), ","); hosts != want {
+		t.Fatalf("expected %v, got %v", want, hosts)
+	}
+
+	want = "mesh,mesh.internal,mesh.local"
+	if hosts := strings.Join(whs.serverCertHosts("mesh.internal"), ","); hosts != want {
+		t.Fatalf("expected %v, got %v", want, hosts)
+	}
+}
+
+func TestMeshHostnames(t *testing.T) {
+	cfg := &Config{MeshHostnames: MeshHostnameConf{
+		Default:    []string{"mesh", "mesh.internal"},
+		Namespaces: map[string][]string{"shop": {"gw", "mesh"}},
+	}}
+	if errs := cfg.MeshHostnames.Validate(); len(errs) != 1 {
+		t.Fatalf("expected the primary hostname to be rejected as a namespace alias, got %v", errs)
+	}
+	cfg.MeshHostnames.Namespaces["shop"] = []string{"gw"}
+	if errs := cfg.MeshHostnames.Validate(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+	spec := addMeshDNS(pod, cfg)
+	if len(spec.HostAliases) != 1 || strings.Join(spec.HostAliases[0].Hostnames, ",") != "mesh,mesh.internal" {
+		t.Fatalf("expected the default hostnames to be aliased, got %+v", spec.HostAliases)
+	}
+	spec = addMeshDNS(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "shop"}}, cfg)
+	if len(spec.HostAliases) != 1 || strings.Join(spec.HostAliases[0].Hostnames, ",") != "mesh,mesh.internal,gw" {
+		t.Fatalf("expected the aliases of the namespace to be added, got %+v", spec.HostAliases)
+	}
+
+	// callers in any namespace reach the mesh routes on any of the hostnames
+	if h := meshHost(cfg); h != "mesh" {
+		t.Fatalf("expected the primary hostname, got %v", h)
+	}
+	if d := meshDomain(cfg); d != `{mesh:gw|mesh|mesh\.internal}` {
+		t.Fatalf("expected the mesh routes to match every hostname, got %v", d)
+	}
+	if d := meshDomain(&Config{MeshHostnames: MeshHostnameConf{Default: []string{"mesh"}}}); d != "mesh" {
+		t.Fatalf("expected a single hostname to be the domain, got %v", d)
+	}
+
+	mock := tyk.NewMockClient()
+	shop := &WebhookServer{SidecarConfig: cfg, TykClients: mock.Resolver()}
+	pod = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cart", Namespace: "shop", Labels: map[string]string{"app": "cart"}, Annotations: map[string]string{}}}
+	ann, err := shop.createServiceRoutes(context.Background(), mock, pod, pod.Annotations, "shop", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, _ := mock.GetByObjectID(context.Background(), ann[AdmissionWebhookAnnotationMeshServiceIDKey])
+	if def == nil || def.Domain != meshDomain(cfg) {
+		t.Fatalf("expected the mesh route to be served on every hostname, got %+v", def)
+	}
+
+	whs := &WebhookServer{SidecarConfig: cfg, KubeClient: fake.NewSimpleClientset()}
+	if err := whs.ensureMeshService(context.Background(), "shop"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := whs.KubeClient.CoreV1().Services("shop").Get("mesh", metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the mesh service to be named after the primary hostname: %v", err)
+	}
+
+	// Services can't be named after dotted hostnames
+	cfg.MeshHostnames.Default = []string{"mesh.internal", "mesh"}
+	cfg.MeshDNS = MeshDNSSearch
+	cfg.MeshSearchDomain = "tyk.svc.cluster.local"
+	if _, err := meshDNS(pod, cfg); err == nil {
+		t.Fatal("the dnsConfig strategy should require a single label hostname")
+	}
+
+	bad := MeshHostnameConf{Default: []string{"Mesh_GW", "mesh", "mesh"}, Namespaces: map[string][]string{"shop": {}}}
+	if errs := bad.Validate(); len(errs) != 3 {
+		t.Fatalf("expected an invalid, a duplicate and an empty list, got %v", errs)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden patches of the recorded admission reviews")
+
+// TestReplay_Golden replays the admission reviews recorded in testdata/patches
+// and compares the responses to their .golden files, run with -update to
+// rewrite them after changing a template or patch
+func TestReplay_Golden(t *testing.T) {
+	cfg, err := loadConfig(filepath.Join("testdata", "patches", "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reviews, err := filepath.Glob(filepath.Join("testdata", "patches", "*.json"))
+	if err != nil || len(reviews) == 0 {
+		t.Fatalf("no recorded reviews: %v", err)
+	}
+
+	for _, review := range reviews {
+		t.Run(filepath.Base(review), func(t *testing.T) {
+			body, err := ioutil.ReadFile(review)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, warnings, err := Replay(body, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := json.MarshalIndent(struct {
+				Allowed  bool            `json:"allowed"`
+				Result   *metav1.Status  `json:"result,omitempty"`
+				Patch    json.RawMessage `json:"patch,omitempty"`
+				Warnings []string        `json:"warnings,omitempty"`
+			}{resp.Allowed, resp.Result, resp.Patch, warnings}, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(review, ".json") + ".golden"
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v, run the tests with -update to create it", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("response differs from %v, run the tests with -update if the change is intended:\n%s", golden, got)
+			}
+
+			// replays are stable
+			if again, _, err := Replay(body, cfg); err != nil || !bytes.Equal(again.Patch, resp.Patch) {
+				t.Fatalf("replaying the review twice gave different patches:\n%s\n%s", resp.Patch, again.Patch)
+			}
+		})
+	}
+}
+
+func TestInjectManifests(t *testing.T) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte(testCfg), cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Containers[0].Name = "tyk-mesh"
+
+	in := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+  namespace: bar
+spec:
+  template:
+    metadata:
+      labels:
+        app: foo
+      annotations:
+        injector.tyk.io/inject: "true"
+    spec:
+      containers:
+      - name: app
+        image: foo:1.0
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: skipped
+  namespace: kube-system
+  annotations:
+    injector.tyk.io/inject: "true"
+spec:
+  containers:
+  - name: app
+`
+
+	out := &bytes.Buffer{}
+	if err := InjectManifests(strings.NewReader(in), out, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	docs := strings.Split(out.String(), "---\n")
+	if len(docs) != 3 {
+		t.Fatalf("expected 3 documents, got %d:\n%s", len(docs), out)
+	}
+
+	dep := &struct {
+		Spec struct {
+			Template corev1.Pod `json:"template"`
+		} `json:"spec"`
+	}{}
+	if err := yaml.Unmarshal([]byte(docs[0]), dep); err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := dep.Spec.Template
+	if tpl.Annotations[AdmissionWebhookAnnotationStatusKey] != StatusOfflineInjected {
+		t.Fatalf("template not marked as injected: %v", tpl.Annotations)
+	}
+	if _, ok := tpl.Annotations[AdmissionWebhookAnnotationInjectKey]; ok {
+		t.Fatalf("inject annotation was kept: %v", tpl.Annotations)
+	}
+	if len(tpl.Spec.Containers) != 2 || tpl.Spec.Containers[1].Name != "tyk-mesh" {
+		t.Fatalf("sidecar not added: %v", tpl.Spec.Containers)
+	}
+	tags := ""
+	for _, v := range tpl.Spec.Containers[1].Env {
+		if v.Name == tagVarName {
+			tags = v.Value
+		}
+	}
+	if tags != "mesh,foo" {
+		t.Fatalf("unexpected sidecar env: %v", tpl.Spec.Containers[1].Env)
+	}
+
+	pod := &corev1.Pod{}
+	if err := yaml.Unmarshal([]byte(docs[2]), pod); err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.Containers) != 1 {
+		t.Fatalf("pod in an ignored namespace was injected: %v", pod.Spec.Containers)
+	}
+}
+
+func TestWebhookServer_processWorkloadMutations(t *testing.T) {
+	whs := &WebhookServer{SidecarConfig: &Config{}}
+
+	scenarios := []struct {
+		name  string
+		group string
+		kind  string
+		obj   string
+		patch []map[string]interface{}
+	}{
+		{
+			name:  "rollout",
+			group: "argoproj.io",
+			kind:  "Rollout",
+			obj: `{"metadata":{"name":"web","annotations":{"injector.tyk.io/inject":"true","tyk.io/org":"team-a","injector.tyk.io/inbound-service-id":"abc","other":"x"}},
+				"spec":{"template":{"metadata":{"annotations":{"tyk.io/org":"team-b"}}}}}`,
+			patch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/template/metadata/annotations/injector.tyk.io~1inject", "value": "true"},
+			},
+		},
+		{
+			name:  "knative service",
+			group: "serving.knative.dev",
+			kind:  "Service",
+			obj:   `{"metadata":{"name":"fn","annotations":{"injector.tyk.io/inject":"true"}},"spec":{"template":{"spec":{}}}}`,
+			patch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/template/metadata", "value": map[string]interface{}{
+					"annotations": map[string]interface{}{"injector.tyk.io/inject": "true"},
+				}},
+			},
+		},
+		{
+			name:  "rollout referencing a deployment",
+			group: "argoproj.io",
+			kind:  "Rollout",
+			obj:   `{"metadata":{"name":"web","annotations":{"injector.tyk.io/inject":"true"}},"spec":{"workloadRef":{"kind":"Deployment","name":"web"}}}`,
+		},
+		{
+			name:  "not annotated",
+			group: "serving.knative.dev",
+			kind:  "Service",
+			obj:   `{"metadata":{"name":"fn"},"spec":{"template":{"spec":{}}}}`,
+		},
+		{
+			name:  "already propagated",
+			group: "argoproj.io",
+			kind:  "Rollout",
+			obj: `{"metadata":{"name":"web","annotations":{"injector.tyk.io/inject":"true"}},
+				"spec":{"template":{"metadata":{"annotations":{"injector.tyk.io/inject":"true"}}}}}`,
+		},
+	}
+
+	for _, sc := range scenarios {
+		ar := &v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Group: sc.group, Kind: sc.kind},
+			Namespace: "default",
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: []byte(sc.obj)},
+		}}
+
+		resp := whs.mutate(context.Background(), ar)
+		if !resp.Allowed {
+			t.Fatalf("%v: expected the workload to be admitted, got %v", sc.name, resp.Result)
+		}
+
+		if sc.patch == nil {
+			if resp.Patch != nil {
+				t.Fatalf("%v: expected no patch, got %s", sc.name, resp.Patch)
+			}
+			continue
+		}
+
+		var patch []map[string]interface{}
+		if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(patch, sc.patch) {
+			t.Fatalf("%v: expected patch %v, got %v", sc.name, sc.patch, patch)
+		}
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte(testCfg), cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Containers[0].Name = "tyk-mesh"
+
+	if errs := cfg.Validate(); len(errs) != 0 {
+		t.Fatalf("expected a valid config, got %v", errs)
+	}
+
+	cfg.Containers[0].Name = "gateway"
+	cfg.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 0}}
+	cfg.InitContainers = []corev1.Container{{Name: "init"}}
+	cfg.WorkloadIdentity = true
+	cfg.EnableMeshTLS = false
+	cfg.MeshDNS = MeshDNSSearch
+	cfg.MeshGatewayIP = "mesh"
+
+	errs := cfg.Validate()
+	if len(errs) != 6 {
+		t.Fatalf("expected 6 errors, got %v", errs)
+	}
+}
+
+func TestNetworkPolicyConf(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(strings.NewReader(`
+Injector:
+  networkPolicies:
+    enabled: true
+    egress:
+      - to:
+          - namespaceSelector:
+              matchLabels:
+                name: redis
+        ports:
+          - protocol: TCP
+            port: 6379
+      - ports:
+          - port: https
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{}
+	if err := v.UnmarshalKey("Injector", cfg, kube.DecodeHook); err != nil {
+		t.Fatal(err)
+	}
+
+	egress := cfg.NetworkPolicies.Egress
+	if len(egress) != 2 || *egress[0].Ports[0].Port != intstr.FromInt(6379) || *egress[1].Ports[0].Port != intstr.FromString("https") {
+		t.Fatalf("unexpected egress rules %+v", egress)
+	}
+
+	if errs := cfg.NetworkPolicies.Validate(); len(errs) != 0 {
+		t.Fatalf("expected a valid config, got %v", errs)
+	}
+
+	conf := &NetworkPolicyConf{Enabled: true}
+	if errs := conf.Validate(); len(errs) != 1 {
+		t.Fatalf("expected the egress to Redis and the dashboard to be required, got %v", errs)
+	}
+
+	conf.Egress = []networkingv1.NetworkPolicyEgressRule{{}}
+	if errs := conf.Validate(); len(errs) != 1 {
+		t.Fatalf("expected a rule allowing all egress to be rejected, got %v", errs)
+	}
+}
+
+func TestAddMeshDNS(t *testing.T) {
+	cfg := &Config{MeshSearchDomain: "tyk.svc.cluster.local", MeshGatewayHost: "gw.tyk.svc.cluster.local"}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+	spec := addMeshDNS(pod.DeepCopy(), cfg)
+	if len(spec.HostAliases) != 1 || spec.HostAliases[0].IP != "127.0.0.1" || spec.DNSConfig != nil {
+		t.Fatalf("expected mesh to be pinned to the sidecar, got %+v %+v", spec.HostAliases, spec.DNSConfig)
+	}
+
+	cfg.MeshGatewayIP = "10.0.0.10"
+	if spec := addMeshDNS(pod.DeepCopy(), cfg); spec.HostAliases[0].IP != "10.0.0.10" {
+		t.Fatalf("expected mesh to be pinned to the gateway, got %+v", spec.HostAliases)
+	}
+
+	pod.Annotations[AdmissionWebhookAnnotationMeshDNSKey] = MeshDNSSearch
+	spec = addMeshDNS(pod.DeepCopy(), cfg)
+	if len(spec.HostAliases) != 0 || spec.DNSConfig == nil || !reflect.DeepEqual(spec.DNSConfig.Searches, []string{"tyk.svc.cluster.local"}) {
+		t.Fatalf("expected the search domain to be added, got %+v %+v", spec.HostAliases, spec.DNSConfig)
+	}
+
+	pod.Annotations[AdmissionWebhookAnnotationMeshDNSKey] = "coredns"
+	if _, err := meshDNS(pod, cfg); err == nil {
+		t.Fatal("unknown strategies should be rejected")
+	}
+
+	pod.Annotations[AdmissionWebhookAnnotationMeshDNSKey] = MeshDNSService
+	spec = addMeshDNS(pod.DeepCopy(), cfg)
+	if len(spec.HostAliases) != 0 || spec.DNSConfig != nil {
+		t.Fatalf("expected the cluster DNS to resolve mesh, got %+v %+v", spec.HostAliases, spec.DNSConfig)
+	}
+
+	kc := fake.NewSimpleClientset()
+	whs := &WebhookServer{SidecarConfig: cfg, KubeClient: kc}
+	for i := 0; i < 2; i++ {
+		if err := whs.ensureMeshService(context.Background(), "bar"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	svc, err := kc.CoreV1().Services("bar").Get("mesh", metav1.GetOptions{})
+	if err != nil || svc.Spec.Type != corev1.ServiceTypeExternalName || svc.Spec.ExternalName != cfg.MeshGatewayHost {
+		t.Fatalf("unexpected mesh service %+v (%v)", svc, err)
+	}
+}
+
+func TestWebhookServer_networkPolicies(t *testing.T) {
+	cfg := &Config{
+		Containers: []corev1.Container{{Name: "tyk-mesh"}},
+		NetworkPolicies: NetworkPolicyConf{
+			Gateway: []networkingv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"name": "tyk"}}}},
+		},
+	}
+	kc := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Annotations: map[string]string{AdmissionWebhookAnnotationNetworkPoliciesKey: "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "legacy"}},
+	)
+	whs := &WebhookServer{SidecarConfig: cfg, KubeClient: kc}
+
+	if !whs.networkPolicies("shop") || whs.networkPolicies("legacy") {
+		t.Fatal("expected the namespace annotation to override the config")
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "cart"}}}
+	pod.Spec.Containers = []corev1.Container{{Name: "cart", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 80}, {Name: "admin", ContainerPort: 9000}}}}
+	for i := 0; i < 2; i++ {
+		if err := whs.ensureNetworkPolicy(context.Background(), pod, "shop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	np, err := kc.NetworkingV1().NetworkPolicies("shop").Get("tyk-mesh-cart", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ports []int
+	for _, p := range np.Spec.Ingress[0].Ports {
+		ports = append(ports, p.Port.IntValue())
+	}
+	if want := []int{int(sidecarServicePort), int(sidecarPort("admin")), int(sidecarPort("http"))}; !reflect.DeepEqual(ports, want) {
+		t.Fatalf("expected ingress to the sidecar ports %v only, got %v", want, ports)
+	}
+	if len(np.Spec.Egress) != 3 || np.Spec.PodSelector.MatchLabels[MeshPodLabel] != "true" {
+		t.Fatalf("expected egress to meshed pods, DNS and the gateway, got %+v", np.Spec)
+	}
+
+	// policies of others are left alone
+	np.Labels = nil
+	np.Spec.Egress = nil
+	if _, err := kc.NetworkingV1().NetworkPolicies("shop").Update(np); err != nil {
+		t.Fatal(err)
+	}
+	if err := whs.ensureNetworkPolicy(context.Background(), pod, "shop"); err != nil {
+		t.Fatal(err)
+	}
+	if np, _ := kc.NetworkingV1().NetworkPolicies("shop").Get("tyk-mesh-cart", metav1.GetOptions{}); np.Spec.Egress != nil {
+		t.Fatal("expected the policy to be kept")
+	}
+
+	bad := NetworkPolicyConf{Gateway: []networkingv1.NetworkPolicyPeer{{}}}
+	if errs := bad.Validate(); len(errs) != 1 {
+		t.Fatalf("expected an empty gateway peer to be rejected, got %v", errs)
+	}
+}
+
+func TestIPFamilies(t *testing.T) {
+	cfg := &Config{IPFamilies: []string{IPv6Family, IPv4Family}}
+	if errs := cfg.validateIPFamilies(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+	spec := addMeshDNS(pod, cfg)
+	if len(spec.HostAliases) != 2 || spec.HostAliases[0].IP != "::1" || spec.HostAliases[1].IP != "127.0.0.1" {
+		t.Fatalf("expected mesh to resolve to both loopbacks, IPv6 first, got %+v", spec.HostAliases)
+	}
+
+	if u := hostURL("https", "fd00::10", 8080); u != "https://[fd00::10]:8080" {
+		t.Fatalf("expected the IPv6 address to be bracketed, got %v", u)
+	}
+	if u := hostURL("http", "foo.bar", 8080); u != "http://foo.bar:8080" {
+		t.Fatalf("unexpected URL %v", u)
+	}
+
+	cfg = &Config{IPFamilies: []string{"IPv5", IPv4Family, IPv4Family}, MeshGatewayIP: "fd00::10"}
+	if errs := cfg.validateIPFamilies(); len(errs) != 4 {
+		t.Fatalf("expected too many, unknown and duplicate families and a gateway of another family to be rejected, got %v", errs)
+	}
+}
+
+func TestWebhookServer_RevokeCert(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true},
+		CAClient:      &ca.Mock{},
+		TykClients:    mock.Resolver(),
+	}
+
+	ctx := context.Background()
+	id, err := mock.CreateService(ctx, &tyk.APIDefOptions{Slug: "foo.bar-inbound", Hostname: "foo.bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := whs.generateStoreAndRegisterCertForAPIDef(ctx, mock, id, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := whs.CAClient.GetServerCertByLinkedAPIID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := cm.Bundle.Fingerprint
+
+	if err := whs.RevokeCert(ctx, cm, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the route is served with a replacement
+	renewed, err := whs.CAClient.GetServerCertByLinkedAPIID(id)
+	if err != nil || renewed.Revoked || renewed.UID == cm.UID {
+		t.Fatalf("expected a separate replacement to be linked to the API, got %+v (%v)", renewed, err)
+	}
+
+	def, _ := mock.GetByObjectID(ctx, id)
+	if len(def.Certificates) != 1 || def.Certificates[0] == old || def.Certificates[0] != renewed.Bundle.Fingerprint {
+		t.Fatalf("expected the certificate to be replaced, got %v", def.Certificates)
+	}
+
+	if _, ok := mock.Certs[old]; ok {
+		t.Fatal("revoked certificate should be removed from tyk")
+	}
+
+	// the existing record is revoked rather than a second one stored
+	revoked, err := whs.CAClient.GetCertByFingerprint(old)
+	if err != nil || !revoked.Revoked || revoked.ServiceID != "" || revoked.UID != cm.UID {
+		t.Fatalf("expected the old certificate to be stored as revoked, got %+v (%v)", revoked, err)
+	}
+
+	if err := whs.RevokeCert(ctx, revoked, 1); err == nil {
+		t.Fatal("expected an error revoking a certificate twice")
+	}
+
+	// the mesh certificate is reissued by a root rotation instead
+	meshBdl, _ := whs.CAClient.GenerateCert("mesh")
+	mesh := ca.NewCertModel(meshBdl)
+	mesh.IsMeshCert = true
+	if err := whs.RevokeCert(ctx, mesh, 1); err == nil || !strings.Contains(err.Error(), "ca rotate") {
+		t.Fatalf("expected the mesh certificate to be rejected, got %v", err)
+	}
+
+	if mesh.Revoked {
+		t.Fatal("a rejected certificate should not be revoked")
+	}
+}
+
+func TestWebhookServer_ReuploadCert(t *testing.T) {
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true},
+		CAClient:      &ca.Mock{},
+		TykClients:    mock.Resolver(),
+	}
+
+	ctx := context.Background()
+	id, err := mock.CreateService(ctx, &tyk.APIDefOptions{Slug: "foo.bar-inbound", Hostname: "foo.bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := whs.generateStoreAndRegisterCertForAPIDef(ctx, mock, id, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := whs.CAClient.GetServerCertByLinkedAPIID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploaded, err := whs.ReuploadCert(ctx, cm); err != nil || uploaded {
+		t.Fatalf("certificates present in tyk should be left alone, got %v (%v)", uploaded, err)
+	}
+
+	// lost with a dashboard restore
+	old := cm.Bundle.Fingerprint
+	delete(mock.Certs, old)
+
+	if uploaded, err := whs.ReuploadCert(ctx, cm); err != nil || !uploaded {
+		t.Fatalf("expected the certificate to be uploaded, got %v (%v)", uploaded, err)
+	}
+
+	if _, ok := mock.Certs[cm.Bundle.Fingerprint]; !ok || cm.Bundle.Fingerprint == old {
+		t.Fatalf("expected the stored certificate to get the new ID, got %v", cm.Bundle.Fingerprint)
+	}
+
+	def, _ := mock.GetByObjectID(ctx, id)
+	if len(def.Certificates) != 1 || def.Certificates[0] != cm.Bundle.Fingerprint {
+		t.Fatalf("expected the route to use the new ID, got %v", def.Certificates)
+	}
+}
+
+func TestResolveDigest(t *testing.T) {
+	const digest = "sha256:0123456789abcdef"
+
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if r.URL.Query().Get("scope") != "repository:tyk/sidecar:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"token":"anon"}`)
+		case r.URL.Path != "/v2/tyk/sidecar/manifests/2.8.4":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Header.Get("Authorization") != "Bearer anon":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Header().Set("Docker-Content-Digest", digest)
+		}
+	}))
+	defer srv.Close()
+
+	registryClient = srv.Client()
+	defer func() { registryClient = http.DefaultClient }()
+
+	image := strings.TrimPrefix(srv.URL, "https://") + "/tyk/sidecar:2.8.4"
+	cfg := &Config{Containers: []corev1.Container{{Name: "tyk-mesh", Image: image}}}
+	if err := PinSidecarDigest(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := SidecarVersion(cfg); got != image+"@"+digest {
+		t.Fatalf("expected the image to be pinned, got %v", got)
+	}
+
+	if _, err := ResolveDigest(context.Background(), strings.Replace(image, "2.8.4", "missing", 1)); err == nil {
+		t.Fatal("unknown tags should fail to resolve")
+	}
+
+	ref, err := parseImageRef("tykio/tyk-sidecar")
+	if err != nil || ref.registry != defaultRegistry || ref.repository != "tykio/tyk-sidecar" || ref.tag != "latest" {
+		t.Fatalf("unexpected reference %+v (%v)", ref, err)
+	}
+
+	if ref, _ := parseImageRef("nginx:1.17"); ref.repository != "library/nginx" || ref.tag != "1.17" {
+		t.Fatalf("expected an official image, got %+v", ref)
+	}
+}
+
+func TestOutdatedWorkloads(t *testing.T) {
+	controller := true
+	owned := func(kind, name string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+	}
+	pod := func(name, version string, owners []metav1.OwnerReference) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "bar",
+			OwnerReferences: owners,
+			Annotations: map[string]string{
+				AdmissionWebhookAnnotationStatusKey:         "injected",
+				AdmissionWebhookAnnotationSidecarVersionKey: version,
+			},
+		}}
+	}
+
+	kc := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "bar"}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "bar", OwnerReferences: owned("Deployment", "web")}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "bar"}},
+		pod("web-1-a", "sidecar:1", owned("ReplicaSet", "web-1")),
+		pod("web-1-b", "sidecar:1", owned("ReplicaSet", "web-1")),
+		pod("db-0", "sidecar:2", owned("StatefulSet", "db")),
+		pod("debug", "sidecar:1", nil),
+	)
+
+	workloads, bare, err := OutdatedWorkloads(kc, "", "sidecar:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(workloads) != 1 || workloads[0].Kind != "Deployment" || workloads[0].Name != "web" || !reflect.DeepEqual(workloads[0].Versions, []string{"sidecar:1"}) {
+		t.Fatalf("expected the deployment to be outdated, got %v", workloads)
+	}
+
+	if !reflect.DeepEqual(bare, []string{"bar/debug"}) {
+		t.Fatalf("expected the bare pod to be listed, got %v", bare)
+	}
+
+	if err := RestartWorkload(kc, workloads[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	dep, err := kc.AppsV1().Deployments("bar").Get("web", metav1.GetOptions{})
+	if err != nil || dep.Spec.Template.Annotations[restartAnnotation] == "" {
+		t.Fatalf("expected the deployment to be restarted, got %+v (%v)", dep, err)
+	}
+}
+
+func TestWebhookServer_certRecords(t *testing.T) {
+	mock := tyk.NewMockClient()
+	state := store.NewMemory()
+	whs := &WebhookServer{SidecarConfig: &Config{}, CAClient: &ca.Mock{}, TykClients: mock.Resolver(), State: state}
+
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := mock.CreateCertificate(ctx, []byte("crt"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whs.recordOwnedCert(id, "", store.Owner{Kind: "Identity", Namespace: "bar", Name: "foo.bar"})
+		ids = append(ids, id)
+	}
+
+	// superseded and missing certificates are forgotten with their upload
+	if err := mock.DeleteCertificate(ctx, ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	kept := whs.pruneCertificates(ctx, mock, ids, map[string]bool{ids[0]: true})
+	if len(kept) != 1 || kept[0] != ids[1] {
+		t.Fatalf("expected only %v to be kept, got %v", ids[1], kept)
+	}
+
+	recs, err := state.List()
+	if err != nil || len(recs) != 1 || recs[0].ID != ids[1] {
+		t.Fatalf("expected only the record of %v to be left, got %v (%v)", ids[1], recs, err)
+	}
+
+	// replaced certificates hand their owner on
+	whs.replaceCert(ids[1], "renewed")
+	rec, err := state.Get(store.KindCert, "renewed")
+	if err != nil || rec.Owner.Name != "foo.bar" {
+		t.Fatalf("expected the renewed certificate to keep the owner, got %+v (%v)", rec, err)
+	}
+	if _, err := state.Get(store.KindCert, ids[1]); err != store.ErrNotFound {
+		t.Fatalf("expected the replaced certificate to be forgotten, got %v", err)
+	}
+}
+
+func TestWebhookServer_rotateCert_Org(t *testing.T) {
+	def, team := tyk.NewMockClient(), tyk.NewMockClient()
+	state := store.NewMemory()
+	whs := &WebhookServer{
+		SidecarConfig: &Config{EnableMeshTLS: true},
+		CAClient:      &ca.Mock{},
+		State:         state,
+		TykClients: func(ns string, ann map[string]string) (tyk.Client, error) {
+			if ann[tyk.OrgAnnotation] == "team" {
+				return team, nil
+			}
+			return def, nil
+		},
+	}
+
+	ctx := context.Background()
+	id, err := team.CreateService(ctx, &tyk.APIDefOptions{Slug: "foo.bar-inbound", Hostname: "foo.bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Put(&store.Record{Kind: store.KindAPI, ID: id, Org: "team", Owner: store.Owner{Kind: "Pod", Namespace: "bar", Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := whs.generateStoreAndRegisterCertForAPIDef(ctx, team, id, ""); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := whs.CAClient.GetServerCertByLinkedAPIID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := cm.Bundle.Fingerprint
+
+	if err := whs.rotateCert(ctx, cm); err != nil {
+		t.Fatal(err)
+	}
+
+	api, _ := team.GetByObjectID(ctx, id)
+	if len(api.Certificates) != 1 || api.Certificates[0] == old || len(def.Certs) != 0 {
+		t.Fatalf("expected the certificate to be renewed in the org of the API, got %v", api.Certificates)
+	}
+
+	if cl, _, err := whs.certClient(ctx, cm); err != nil || cl != team {
+		t.Fatalf("expected server certificates to be managed in the org of their API, got %v (%v)", cl, err)
+	}
+}
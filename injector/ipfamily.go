@@ -0,0 +1,83 @@
+package injector
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// IP families of the pod network, as named by Kubernetes
+const (
+	IPv4Family = "IPv4"
+	IPv6Family = "IPv6"
+)
+
+// loopback addresses the mesh hostname is pinned to by family
+var loopbacks = map[string]string{
+	IPv4Family: "127.0.0.1",
+	IPv6Family: "::1",
+}
+
+// ipFamilies returns the configured families of the pod network, IPv4 if unset
+func (c *Config) ipFamilies() []string {
+	if len(c.IPFamilies) == 0 {
+		return []string{IPv4Family}
+	}
+	return c.IPFamilies
+}
+
+// validateIPFamilies checks the families are known and the mesh gateway
+// address belongs to one of them
+func (c *Config) validateIPFamilies() []error {
+	errs := make([]error, 0)
+	if len(c.IPFamilies) > 2 {
+		errs = append(errs, fmt.Errorf("ipFamilies: at most %v and %v can be set", IPv4Family, IPv6Family))
+	}
+
+	seen := map[string]bool{}
+	for _, f := range c.IPFamilies {
+		if _, ok := loopbacks[f]; !ok {
+			errs = append(errs, fmt.Errorf("ipFamilies: unknown family %q, must be %v or %v", f, IPv4Family, IPv6Family))
+		}
+		if seen[f] {
+			errs = append(errs, fmt.Errorf("ipFamilies: %v is listed twice", f))
+		}
+		seen[f] = true
+	}
+
+	if ip := net.ParseIP(c.MeshGatewayIP); ip != nil {
+		family := IPv6Family
+		if ip.To4() != nil {
+			family = IPv4Family
+		}
+
+		found := false
+		for _, f := range c.ipFamilies() {
+			found = found || f == family
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("meshGatewayIP: %v is an %v address, which ipFamilies doesn't include", c.MeshGatewayIP, family))
+		}
+	}
+
+	return errs
+}
+
+// meshHostIPs returns the addresses the mesh hostname is pinned to, the
+// loopback of each family of the pod network unless a gateway is configured
+func meshHostIPs(sidecarConfig *Config) []string {
+	if sidecarConfig.MeshGatewayIP != "" {
+		return []string{sidecarConfig.MeshGatewayIP}
+	}
+
+	ips := make([]string, 0, 2)
+	for _, f := range sidecarConfig.ipFamilies() {
+		ips = append(ips, loopbacks[f])
+	}
+	return ips
+}
+
+// hostURL builds the URL of a host and port, IPv6 addresses are bracketed
+func hostURL(scheme, host string, port int32) string {
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
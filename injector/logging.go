@@ -0,0 +1,87 @@
+package injector
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AdmissionWebhookAnnotationSidecarLogLevelKey sets the log level of the
+	// gateway container of a pod: debug, info, warn or error
+	AdmissionWebhookAnnotationSidecarLogLevelKey = "injector.tyk.io/sidecar-log-level"
+
+	logLevelVarName   = "TYK_LOGLEVEL"
+	keyLoggingVarName = "TYK_GW_ENABLEKEYLOGGING"
+	bodyRecordVarName = "TYK_GW_ANALYTICSCONFIG_ENABLEDETAILEDRECORDING"
+)
+
+// SidecarLogConfig sets the logging of the injected gateways
+type SidecarLogConfig struct {
+	Level        string `yaml:"level"`        // log level unless the pod sets its own, the level of the container config if unset
+	RedactKeys   bool   `yaml:"redactKeys"`   // obfuscate API keys in the gateway logs
+	RedactBodies bool   `yaml:"redactBodies"` // never record request and response bodies in analytics
+}
+
+func validLogLevel(level string) bool {
+	switch level {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
+
+// Validate checks the default log level
+func (c *SidecarLogConfig) Validate() []error {
+	errs := make([]error, 0)
+	if c.Level != "" && !validLogLevel(c.Level) {
+		errs = append(errs, fmt.Errorf("sidecarLog.level: unknown level %q, must be debug, info, warn or error", c.Level))
+	}
+	return errs
+}
+
+// sidecarLogLevel returns the log level of the gateway container of a pod,
+// from its annotation or the config, empty to keep the container config
+func sidecarLogLevel(pod *corev1.Pod, sidecarConfig *Config) (string, error) {
+	if v, ok := pod.Annotations[AdmissionWebhookAnnotationSidecarLogLevelKey]; ok {
+		level := strings.ToLower(v)
+		if !validLogLevel(level) {
+			return "", fmt.Errorf("%v: unknown level %q, must be debug, info, warn or error", AdmissionWebhookAnnotationSidecarLogLevelKey, v)
+		}
+		return level, nil
+	}
+
+	return sidecarConfig.SidecarLog.Level, nil
+}
+
+// addLogEnv sets the logging env of the gateway container. A level set in the
+// container config is only replaced by the annotation of the pod, redaction
+// always applies. Pods with an invalid level are rejected on admission before
+// they get here.
+func addLogEnv(pod *corev1.Pod, containers []corev1.Container, sidecarConfig *Config) []corev1.Container {
+	level, _ := sidecarLogLevel(pod, sidecarConfig)
+	_, podLevel := pod.Annotations[AdmissionWebhookAnnotationSidecarLogLevelKey]
+
+	for i, cnt := range containers {
+		if strings.ToLower(cnt.Name) != "tyk-mesh" {
+			continue
+		}
+
+		env := cnt.Env
+		if level != "" && (podLevel || !hasEnv(env, logLevelVarName)) {
+			env = setEnv(env, corev1.EnvVar{Name: logLevelVarName, Value: level})
+		}
+		if sidecarConfig.SidecarLog.RedactKeys {
+			env = setEnv(env, corev1.EnvVar{Name: keyLoggingVarName, Value: "false"})
+		}
+		if sidecarConfig.SidecarLog.RedactBodies {
+			env = setEnv(env, corev1.EnvVar{Name: bodyRecordVarName, Value: "false"})
+		}
+
+		containers[i].Env = env
+		break
+	}
+
+	return containers
+}
@@ -0,0 +1,175 @@
+package injector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// podTemplatePaths locates the pod template of the workload kinds that can be
+// injected offline, a pod is mutated at the root of the document
+var podTemplatePaths = map[string][]string{
+	"pod":         nil,
+	"deployment":  {"spec", "template"},
+	"statefulset": {"spec", "template"},
+	"daemonset":   {"spec", "template"},
+	"replicaset":  {"spec", "template"},
+	"job":         {"spec", "template"},
+	"cronjob":     {"spec", "jobTemplate", "spec", "template"},
+}
+
+// StatusOfflineInjected marks pods injected by InjectPod, admission creates
+// their routes, certificates and workload identities without injecting the
+// sidecar again
+const StatusOfflineInjected = "offline-injected"
+
+// InjectPod applies the sidecar mutation of the webhook to a pod, it returns
+// false if the pod is not annotated for injection or was injected already.
+// Routes, certificates and workload identities are only created on admission.
+func InjectPod(pod *corev1.Pod, sidecarConfig *Config) bool {
+	if offlineInjected(&pod.ObjectMeta) || !mutationRequired(ignoredNamespaces, &pod.ObjectMeta) {
+		return false
+	}
+
+	pod.Annotations[AdmissionWebhookAnnotationStatusKey] = StatusOfflineInjected
+	pod.Annotations[AdmissionWebhookAnnotationSidecarVersionKey] = SidecarVersion(sidecarConfig)
+	delete(pod.Annotations, AdmissionWebhookAnnotationInjectKey)
+
+	mutatePodSpec(pod, sidecarConfig)
+	return true
+}
+
+// offlineInjected checks if the sidecar of a pod was injected by InjectPod
+func offlineInjected(metadata *metav1.ObjectMeta) bool {
+	return strings.ToLower(metadata.Annotations[AdmissionWebhookAnnotationStatusKey]) == StatusOfflineInjected
+}
+
+// hasSidecar checks if the containers of the sidecar are in a pod already
+func hasSidecar(pod *corev1.Pod, sidecarConfig *Config) bool {
+	for _, sc := range sidecarConfig.Containers {
+		for _, cnt := range pod.Spec.Containers {
+			if cnt.Name == sc.Name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// InjectManifests reads a stream of YAML or JSON documents and writes them to
+// out as YAML, with the pods and pod templates annotated for injection
+// mutated the way the webhook would. Other documents are passed through.
+func InjectManifests(in io.Reader, out io.Writer, sidecarConfig *Config) error {
+	rd := utilyaml.NewYAMLReader(bufio.NewReader(in))
+
+	first := true
+	for {
+		doc, err := rd.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal(doc, &obj); err != nil {
+			return err
+		}
+		// documents holding only comments
+		if len(obj) == 0 {
+			continue
+		}
+
+		if err := injectObject(obj, sidecarConfig); err != nil {
+			return err
+		}
+
+		res, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+
+		if !first {
+			if _, err := io.WriteString(out, "---\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		if _, err := out.Write(res); err != nil {
+			return err
+		}
+	}
+}
+
+func injectObject(obj map[string]interface{}, sidecarConfig *Config) error {
+	kind, _ := obj["kind"].(string)
+	path, ok := podTemplatePaths[strings.ToLower(kind)]
+	if !ok {
+		log.Infof("skipping %v, kind can't be injected", kind)
+		return nil
+	}
+
+	tpl := obj
+	for _, key := range path {
+		next, ok := tpl[key].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%v has no pod template at %v", kind, strings.Join(path, "."))
+		}
+		tpl = next
+	}
+
+	js, err := json.Marshal(tpl)
+	if err != nil {
+		return err
+	}
+
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(js, pod); err != nil {
+		return err
+	}
+
+	// templates are created in the namespace of the workload
+	meta, _ := obj["metadata"].(map[string]interface{})
+	if ns, ok := meta["namespace"].(string); ok && pod.Namespace == "" {
+		pod.Namespace = ns
+	}
+
+	if !InjectPod(pod, sidecarConfig) {
+		return nil
+	}
+
+	spec := map[string]interface{}{}
+	js, err = json.Marshal(pod.Spec)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(js, &spec); err != nil {
+		return err
+	}
+
+	tplMeta, ok := tpl["metadata"].(map[string]interface{})
+	if !ok {
+		tplMeta = map[string]interface{}{}
+		tpl["metadata"] = tplMeta
+	}
+
+	tplMeta["annotations"] = pod.Annotations
+	tpl["spec"] = spec
+
+	return nil
+}
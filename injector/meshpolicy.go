@@ -0,0 +1,504 @@
+package injector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+)
+
+const (
+	// marks the paths a mesh policy whitelisted on an inbound route in its
+	// config data, so they can be replaced when the policies change
+	meshPolicyPathsKey = "mesh_policy_paths"
+
+	defaultMeshPolicyInterval = time.Minute
+)
+
+// MeshPolicyResource is the MeshPolicy custom resource
+var MeshPolicyResource = schema.GroupVersionResource{Group: "mesh.tyk.io", Version: "v1alpha1", Resource: "meshpolicies"}
+
+// MeshPolicy authorizes calls between services of the mesh. It selects
+// destination services in its namespace and allows them to be called by the
+// sources it lists, on the paths and methods of its rules.
+type MeshPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MeshPolicySpec `json:"spec"`
+
+	invalid bool // still selects its destinations, allowing no callers
+}
+
+type MeshPolicySpec struct {
+	Destinations []string           `json:"destinations,omitempty"` // services (app labels) of the namespace, all if empty
+	Sources      []MeshPolicySource `json:"sources"`                // who may call the destinations
+	Rules        []MeshPolicyRule   `json:"rules,omitempty"`        // what they may call, any path and method if empty
+}
+
+// MeshPolicySource selects callers by the workload identity of their service
+type MeshPolicySource struct {
+	Namespace       string   `json:"namespace,omitempty"`       // namespace of the callers, * for all, the policy namespace if empty
+	Services        []string `json:"services,omitempty"`        // services (app labels) of the callers, all if empty
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"` // service accounts the pods of the callers run as, all if empty
+}
+
+// MeshPolicyRule allows methods on paths, paths are Tyk endpoint patterns
+type MeshPolicyRule struct {
+	Paths   []string `json:"paths"`
+	Methods []string `json:"methods,omitempty"` // all if empty
+}
+
+// MeshPolicyConf enables the MeshPolicy resources, which require workloadIdentity
+type MeshPolicyConf struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"` // how often policies are read and applied, every minute if unset
+}
+
+// Validate checks a policy spec, all problems found are returned
+func (s *MeshPolicySpec) Validate() []error {
+	errs := make([]error, 0)
+	for _, d := range s.Destinations {
+		for _, msg := range validation.IsDNS1123Label(d) {
+			errs = append(errs, fmt.Errorf("destinations: %q: %v", d, msg))
+		}
+	}
+
+	if len(s.Sources) == 0 {
+		errs = append(errs, fmt.Errorf("sources: at least one source is required"))
+	}
+
+	for i, src := range s.Sources {
+		if src.Namespace != "" && src.Namespace != "*" {
+			for _, msg := range validation.IsDNS1123Label(src.Namespace) {
+				errs = append(errs, fmt.Errorf("sources[%d].namespace: %q: %v", i, src.Namespace, msg))
+			}
+		}
+	}
+
+	for i, r := range s.Rules {
+		if len(r.Paths) == 0 {
+			errs = append(errs, fmt.Errorf("rules[%d].paths: at least one path is required", i))
+		}
+
+		for _, p := range r.Paths {
+			if _, err := regexp.Compile(p); err != nil || !strings.HasPrefix(p, "/") {
+				errs = append(errs, fmt.Errorf("rules[%d].paths: %q is not a path pattern", i, p))
+			}
+		}
+
+		for _, m := range r.Methods {
+			if !knownMethod(m) {
+				errs = append(errs, fmt.Errorf("rules[%d].methods: unknown method %q", i, m))
+			}
+		}
+	}
+
+	return errs
+}
+
+func knownMethod(m string) bool {
+	for _, known := range meshRouteMethods {
+		if m == known {
+			return true
+		}
+	}
+	return false
+}
+
+// selects reports whether a policy applies to a service of its namespace
+func (p *MeshPolicy) selects(namespace, service string) bool {
+	if p.Namespace != namespace {
+		return false
+	}
+
+	if len(p.Spec.Destinations) == 0 {
+		return true
+	}
+
+	for _, d := range p.Spec.Destinations {
+		if d == service {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether a source of the policy matches a caller
+func (p *MeshPolicy) allows(namespace, service string, serviceAccounts func() map[string]bool) bool {
+	if p.invalid {
+		return false
+	}
+
+	for _, src := range p.Spec.Sources {
+		ns := src.Namespace
+		if ns == "" {
+			ns = p.Namespace
+		}
+		if ns != "*" && ns != namespace {
+			continue
+		}
+
+		if len(src.Services) > 0 && !contains(src.Services, service) {
+			continue
+		}
+
+		if len(src.ServiceAccounts) > 0 {
+			sas := serviceAccounts()
+			matched := false
+			for _, sa := range src.ServiceAccounts {
+				matched = matched || sas[sa]
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// meshPolicyCache holds the valid policies of the cluster, as last read
+type meshPolicyCache struct {
+	mu       sync.RWMutex
+	policies []*MeshPolicy
+}
+
+func (c *meshPolicyCache) set(policies []*MeshPolicy) {
+	c.mu.Lock()
+	c.policies = policies
+	c.mu.Unlock()
+}
+
+// selecting returns the policies applying to a service
+func (c *meshPolicyCache) selecting(namespace, service string) []*MeshPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	found := make([]*MeshPolicy, 0)
+	for _, p := range c.policies {
+		if p.selects(namespace, service) {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// LoadMeshPolicies reads the MeshPolicies of all namespaces. Invalid ones
+// are logged and deny all callers of their destinations, rather than leave
+// them open.
+func (whsvr *WebhookServer) LoadMeshPolicies(ctx context.Context) error {
+	if whsvr.DynamicClient == nil {
+		return fmt.Errorf("no kubernetes client to read mesh policies with")
+	}
+
+	list, err := whsvr.DynamicClient.Resource(MeshPolicyResource).Namespace(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list mesh policies: %w", err)
+	}
+
+	policies := make([]*MeshPolicy, 0, len(list.Items))
+	for _, item := range list.Items {
+		p := &MeshPolicy{}
+		data, err := item.MarshalJSON()
+		if err == nil {
+			err = json.Unmarshal(data, p)
+		}
+		if err != nil {
+			log.Errorf("mesh policy %v/%v can't be read, denying all callers of the namespace: %v", item.GetNamespace(), item.GetName(), err)
+			p = &MeshPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: item.GetNamespace(), Name: item.GetName()}, invalid: true}
+		} else if errs := p.Spec.Validate(); len(errs) > 0 {
+			log.Errorf("mesh policy %v/%v is invalid, denying all callers of its destinations: %v", p.Namespace, p.Name, errs)
+			p.invalid = true
+		}
+
+		policies = append(policies, p)
+	}
+
+	whsvr.meshPolicies.set(policies)
+	return nil
+}
+
+// WatchMeshPolicies keeps the policies admissions are checked against up to
+// date until ctx is done
+func (whsvr *WebhookServer) WatchMeshPolicies(ctx context.Context) {
+	whsvr.everyMeshPolicyInterval(ctx, func() {
+		if err := whsvr.LoadMeshPolicies(ctx); err != nil {
+			log.Error(err)
+		}
+	})
+}
+
+// ReconcileMeshPolicies applies the policies to the inbound routes of the
+// workload identities until ctx is done
+func (whsvr *WebhookServer) ReconcileMeshPolicies(ctx context.Context) {
+	log.Info("reconciling mesh policies")
+	whsvr.everyMeshPolicyInterval(ctx, func() {
+		if err := whsvr.LoadMeshPolicies(ctx); err != nil {
+			log.Error(err)
+			return
+		}
+
+		certs, err := whsvr.identities(ctx)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
+		byNamespace := map[string][]string{}
+		for _, c := range certs {
+			ns := identityNamespace(c.Identity)
+			byNamespace[ns] = append(byNamespace[ns], c.Identity)
+		}
+
+		for ns, identities := range byNamespace {
+			cl, err := whsvr.tykClient(ns, nil)
+			if err != nil {
+				log.Errorf("no tyk client for namespace %v: %v", ns, err)
+				continue
+			}
+			whsvr.updateInboundRoutes(ctx, cl, identities, certs)
+		}
+	})
+}
+
+func (whsvr *WebhookServer) everyMeshPolicyInterval(ctx context.Context, run func()) {
+	interval := whsvr.SidecarConfig.MeshPolicies.Interval
+	if interval <= 0 {
+		interval = defaultMeshPolicyInterval
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		run()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// inboundAccess returns the client certificates the inbound routes of a
+// service accept and the rules of the paths they may call, nil if any. The
+// trust domain of the namespace limits the callers, mesh policies selecting
+// the service limit them further to their sources and merge their rules.
+func (whsvr *WebhookServer) inboundAccess(certs []*ca.CertModel, namespace, service string, sas *serviceAccountIndex) ([]string, []MeshPolicyRule) {
+	trusted := whsvr.SidecarConfig.TrustDomains.allowedIdentities(certs, namespace)
+	if !whsvr.SidecarConfig.MeshPolicies.Enabled {
+		return trusted, nil
+	}
+
+	policies := whsvr.meshPolicies.selecting(namespace, service)
+	if len(policies) == 0 {
+		return trusted, nil
+	}
+
+	byID := map[string]*ca.CertModel{}
+	for _, c := range certs {
+		byID[c.Bundle.Fingerprint] = c
+	}
+
+	allowed := make([]string, 0, len(trusted))
+	for _, id := range trusted {
+		identity := byID[id].Identity
+		ns, svc := identityNamespace(identity), identityService(identity)
+
+		serviceAccounts := func() map[string]bool {
+			return sas.of(ns, svc)
+		}
+
+		for _, p := range policies {
+			if p.allows(ns, svc, serviceAccounts) {
+				allowed = append(allowed, id)
+				break
+			}
+		}
+	}
+
+	var rules []MeshPolicyRule
+	for _, p := range policies {
+		if p.invalid {
+			continue
+		}
+
+		// a policy without rules opens every path
+		if len(p.Spec.Rules) == 0 {
+			return allowed, nil
+		}
+		rules = append(rules, p.Spec.Rules...)
+	}
+
+	return allowed, rules
+}
+
+// serviceAccountIndex caches the service accounts the pods of services run
+// as for one reconcile or admission. The pods of a namespace are listed once,
+// however many identities and routes are checked against the policies.
+type serviceAccountIndex struct {
+	kc          kubernetes.Interface
+	byNamespace map[string]map[string]map[string]bool // namespace, app label, service accounts
+}
+
+func (whsvr *WebhookServer) serviceAccountIndex() *serviceAccountIndex {
+	return &serviceAccountIndex{kc: whsvr.KubeClient, byNamespace: map[string]map[string]map[string]bool{}}
+}
+
+// of returns the service accounts the pods of a service run as
+func (idx *serviceAccountIndex) of(namespace, service string) map[string]bool {
+	byApp, ok := idx.byNamespace[namespace]
+	if !ok {
+		byApp = idx.list(namespace)
+		idx.byNamespace[namespace] = byApp
+	}
+
+	if sas, ok := byApp[service]; ok {
+		return sas
+	}
+
+	return map[string]bool{}
+}
+
+func (idx *serviceAccountIndex) list(namespace string) map[string]map[string]bool {
+	byApp := map[string]map[string]bool{}
+	if idx.kc == nil {
+		return byApp
+	}
+
+	pods, err := idx.kc.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: "app"})
+	if err != nil {
+		log.Warningf("failed to list the pods of %v: %v", namespace, err)
+		return byApp
+	}
+
+	for _, pod := range pods.Items {
+		sa := pod.Spec.ServiceAccountName
+		if sa == "" {
+			sa = "default"
+		}
+
+		app := pod.Labels["app"]
+		if byApp[app] == nil {
+			byApp[app] = map[string]bool{}
+		}
+		byApp[app][sa] = true
+	}
+
+	return byApp
+}
+
+// applyPathRules whitelists the paths and methods of the rules on every
+// version of an API, replacing those whitelisted before, and reports whether
+// it changed. Without rules the whitelisted paths are removed.
+func applyPathRules(def *objects.DBApiDefinition, rules []MeshPolicyRule) bool {
+	methods := map[string]map[string]bool{}
+	for _, r := range rules {
+		ms := r.Methods
+		if len(ms) == 0 {
+			ms = meshRouteMethods
+		}
+
+		for _, p := range r.Paths {
+			if methods[p] == nil {
+				methods[p] = map[string]bool{}
+			}
+			for _, m := range ms {
+				methods[p][m] = true
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(methods))
+	for p := range methods {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	entries := make([]apidef.EndPointMeta, 0, len(paths))
+	for _, p := range paths {
+		actions := map[string]apidef.EndpointMethodMeta{}
+		for m := range methods[p] {
+			actions[m] = apidef.EndpointMethodMeta{Action: apidef.NoAction}
+		}
+		entries = append(entries, apidef.EndPointMeta{Path: p, MethodActions: actions})
+	}
+
+	var previous []apidef.EndPointMeta
+	recorded, _ := def.ConfigData[meshPolicyPathsKey].(string)
+	if recorded != "" {
+		if err := json.Unmarshal([]byte(recorded), &previous); err != nil {
+			log.Warningf("ignoring the mesh policy paths recorded on %v: %v", def.Slug, err)
+		}
+	}
+
+	applied := ""
+	if len(entries) > 0 {
+		data, _ := json.Marshal(entries)
+		applied = string(data)
+	}
+	if applied == recorded {
+		return false
+	}
+
+	replaced := map[string]bool{}
+	for _, e := range previous {
+		replaced[e.Path] = true
+	}
+
+	// unversioned, as the route templates are
+	if len(def.VersionData.Versions) == 0 {
+		def.VersionData.NotVersioned = true
+		def.VersionData.Versions = map[string]apidef.VersionInfo{"Default": {Name: "Default"}}
+	}
+
+	for name, version := range def.VersionData.Versions {
+		kept := make([]apidef.EndPointMeta, 0, len(version.ExtendedPaths.WhiteList))
+		for _, e := range version.ExtendedPaths.WhiteList {
+			if !replaced[e.Path] {
+				kept = append(kept, e)
+			}
+		}
+
+		version.UseExtendedPaths = true
+		version.ExtendedPaths.WhiteList = append(kept, entries...)
+		def.VersionData.Versions[name] = version
+	}
+
+	if def.ConfigData == nil {
+		def.ConfigData = map[string]interface{}{}
+	}
+	if applied == "" {
+		delete(def.ConfigData, meshPolicyPathsKey)
+	} else {
+		def.ConfigData[meshPolicyPathsKey] = applied
+	}
+
+	return true
+}
@@ -0,0 +1,99 @@
+package injector
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+)
+
+const (
+	// Mirrors a share of the mesh traffic of a service to another mesh
+	// service, `<service>[.namespace][:percent]`, all traffic if unset
+	AdmissionWebhookAnnotationMirrorToKey = "injector.tyk.io/mirror-to"
+
+	// JS middleware of the sidecar image sending the copies, responses of
+	// the mirror are discarded
+	mirrorMiddlewareName = "tykMeshMirror"
+	mirrorMiddlewarePath = "/opt/tyk-gateway/middleware/tykMeshMirror.js"
+)
+
+// parseMirror splits a mirror-to annotation into the service, its namespace
+// and the percentage of requests to mirror
+func parseMirror(v, namespace string) (string, string, int, error) {
+	svc, percent := v, 100
+	if i := strings.LastIndex(v, ":"); i > -1 {
+		svc = v[:i]
+		p, err := strconv.Atoi(strings.TrimSuffix(v[i+1:], "%"))
+		if err != nil || p < 1 || p > 100 {
+			return "", "", 0, fmt.Errorf("%v: percentage %q must be between 1 and 100", AdmissionWebhookAnnotationMirrorToKey, v[i+1:])
+		}
+		percent = p
+	}
+
+	ns := namespace
+	if i := strings.Index(svc, "."); i > -1 {
+		svc, ns = svc[:i], svc[i+1:]
+	}
+
+	if svc == "" || ns == "" {
+		return "", "", 0, fmt.Errorf("%v: %q must be <service>[.namespace][:percent]", AdmissionWebhookAnnotationMirrorToKey, v)
+	}
+
+	return svc, ns, percent, nil
+}
+
+// mirrorOptions translates the mirror-to annotation of a pod into processor
+// annotations for the mesh route. The mirror is reached through its inbound
+// route like any mesh service, so it has to be injected as well. Copies are
+// sent by the pre middleware of the sidecar before the request is proxied.
+func mirrorOptions(pod *corev1.Pod, sName, namespace, listenPath string, port int32, tls bool) (map[string]string, error) {
+	ann := map[string]string{}
+	v, ok := pod.Annotations[AdmissionWebhookAnnotationMirrorToKey]
+	if !ok || v == "" {
+		return ann, nil
+	}
+
+	svc, ns, percent, err := parseMirror(v, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if svc == sName && ns == namespace {
+		return nil, fmt.Errorf("%v: %v can't mirror to itself", AdmissionWebhookAnnotationMirrorToKey, sName)
+	}
+
+	tr := "http"
+	if tls {
+		tr = "https"
+	}
+
+	mirror, err := json.Marshal(map[string]interface{}{
+		"target":  hostURL(tr, svc+"."+ns, port),
+		"percent": percent,
+		"strip":   "/" + strings.Trim(listenPath, "/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mw, err := json.Marshal([]map[string]interface{}{{
+		"name":            mirrorMiddlewareName,
+		"path":            mirrorMiddlewarePath,
+		"require_session": false,
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("mirroring %d%% of the mesh traffic of %v.%v to %v.%v", percent, sName, namespace, svc, ns)
+	ann[string(processor.ObjectSetKey)+"config_data.mirror"] = string(mirror)
+	ann[string(processor.ArrayAppendKey)+"custom_middleware.pre"] = string(mw)
+	ann[string(processor.ValueSetStringKey)+"custom_middleware.driver"] = "otto"
+
+	return ann, nil
+}
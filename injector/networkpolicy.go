@@ -0,0 +1,180 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// Turns the NetworkPolicies of the pods of an annotated namespace on or off, overriding networkPolicies of the config
+	AdmissionWebhookAnnotationNetworkPoliciesKey = "injector.tyk.io/network-policies"
+
+	// MeshPodLabel is set on the pods the NetworkPolicies let sidecars call
+	MeshPodLabel = "mesh.tyk.io/injected"
+
+	networkPolicyPrefix = "tyk-mesh-"
+)
+
+// NetworkPolicyConf generates a NetworkPolicy per service of the injected
+// pods, so that they are only reached through their sidecars and only reach
+// other meshed pods, the mesh gateway and DNS. Without them pods can call
+// each other directly, bypassing the routes and policies of the mesh.
+type NetworkPolicyConf struct {
+	Enabled bool                                   `yaml:"enabled"`
+	Gateway []networkingv1.NetworkPolicyPeer       `yaml:"gateway"` // pods of the shared mesh gateway, by namespace and pod selectors
+	Egress  []networkingv1.NetworkPolicyEgressRule `yaml:"egress"`  // further destinations of the pods, e.g. Redis and the dashboard
+}
+
+// Validate checks the peers select something and the sidecars can reach
+// Redis and the dashboard, all problems found are returned
+func (c *NetworkPolicyConf) Validate() []error {
+	errs := make([]error, 0)
+	for i, p := range c.Gateway {
+		if p.PodSelector == nil && p.NamespaceSelector == nil && p.IPBlock == nil {
+			errs = append(errs, fmt.Errorf("networkPolicies: gateway[%d]: a pod selector, namespace selector or IP block is required", i))
+		}
+	}
+
+	if c.Enabled && len(c.Egress) == 0 {
+		errs = append(errs, fmt.Errorf("networkPolicies: egress: required when enabled, the sidecars must reach Redis and the dashboard"))
+	}
+
+	for i, r := range c.Egress {
+		if len(r.To) == 0 && len(r.Ports) == 0 {
+			errs = append(errs, fmt.Errorf("networkPolicies: egress[%d]: a destination or port is required, the rule would allow all egress", i))
+		}
+	}
+
+	return errs
+}
+
+// networkPolicies reports whether the pods of a namespace get
+// NetworkPolicies, the annotation of the namespace overrides the config
+func (whsvr *WebhookServer) networkPolicies(namespace string) bool {
+	if whsvr.KubeClient == nil {
+		return false
+	}
+
+	enabled := whsvr.SidecarConfig.NetworkPolicies.Enabled
+
+	ns, err := whsvr.KubeClient.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		log.Warningf("failed to read the network policies annotation of namespace %v: %v", namespace, err)
+		return enabled
+	}
+
+	if v, ok := ns.Annotations[AdmissionWebhookAnnotationNetworkPoliciesKey]; ok {
+		if on, err := strconv.ParseBool(v); err == nil {
+			if on && len(whsvr.SidecarConfig.NetworkPolicies.Egress) == 0 {
+				log.Warningf("namespace %v: network policies enabled without networkPolicies.egress, its sidecars can't reach Redis and the dashboard", namespace)
+			}
+			return on
+		}
+		log.Warningf("namespace %v: invalid %v annotation %q", namespace, AdmissionWebhookAnnotationNetworkPoliciesKey, v)
+	}
+
+	return enabled
+}
+
+// networkPolicy returns the NetworkPolicy of the service of a pod. Ingress is
+// limited to the ports of its sidecar, egress to meshed pods, the mesh
+// gateway, DNS and the destinations of the config.
+func networkPolicy(pod *corev1.Pod, ns string, cfg *Config) (*networkingv1.NetworkPolicy, error) {
+	sName := pod.Labels["app"]
+
+	ports, err := namedPorts(pod, cfg.Containers)
+	if err != nil {
+		return nil, err
+	}
+
+	tcp, udp := corev1.ProtocolTCP, corev1.ProtocolUDP
+	port := func(p int32) intstr.IntOrString { return intstr.FromInt(int(p)) }
+
+	sp := port(sidecarServicePort)
+	ingress := []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &sp}}
+	if len(ports) > 1 {
+		for _, p := range ports {
+			sp := port(sidecarPort(p.Name))
+			ingress = append(ingress, networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &sp})
+		}
+	}
+
+	dns := port(53)
+	egress := []networkingv1.NetworkPolicyEgressRule{
+		{
+			To: []networkingv1.NetworkPolicyPeer{{
+				NamespaceSelector: &metav1.LabelSelector{},
+				PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{MeshPodLabel: "true"}},
+			}},
+		},
+		{
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dns}, {Protocol: &tcp, Port: &dns}},
+		},
+	}
+
+	if len(cfg.NetworkPolicies.Gateway) > 0 {
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{To: cfg.NetworkPolicies.Gateway})
+	}
+	egress = append(egress, cfg.NetworkPolicies.Egress...)
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      networkPolicyPrefix + sName,
+			Namespace: ns,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "tyk-k8s"},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": sName, MeshPodLabel: "true"}},
+			Ingress:     []networkingv1.NetworkPolicyIngressRule{{Ports: ingress}},
+			Egress:      egress,
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}, nil
+}
+
+// ensureNetworkPolicy creates or updates the NetworkPolicy of the service of
+// a pod. Policies of the same name that weren't created by the injector are kept
+func (whsvr *WebhookServer) ensureNetworkPolicy(ctx context.Context, pod *corev1.Pod, ns string) error {
+	np, err := networkPolicy(pod, ns, whsvr.SidecarConfig)
+	if err != nil {
+		return err
+	}
+
+	nps := whsvr.KubeClient.NetworkingV1().NetworkPolicies(ns)
+	existing, err := nps.Get(np.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		if _, err := nps.Create(np); err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create the network policy of %v/%v: %w", ns, pod.Labels["app"], err)
+		}
+		log.Infof("created network policy %v/%v", ns, np.Name)
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to look up the network policy of %v/%v: %w", ns, pod.Labels["app"], err)
+	}
+
+	if existing.Labels["app.kubernetes.io/managed-by"] != "tyk-k8s" {
+		log.Warningf("network policy %v/%v wasn't created by the injector, leaving it as it is", ns, np.Name)
+		return nil
+	}
+
+	if reflect.DeepEqual(existing.Spec, np.Spec) {
+		return nil
+	}
+
+	existing.Spec = np.Spec
+	if _, err := nps.Update(existing); err != nil {
+		return fmt.Errorf("failed to update the network policy of %v/%v: %w", ns, pod.Labels["app"], err)
+	}
+
+	log.Infof("updated network policy %v/%v", ns, np.Name)
+	return nil
+}
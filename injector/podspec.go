@@ -0,0 +1,83 @@
+package injector
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// withSecurityDefaults returns the containers with the fields of their
+// security context that aren't set filled from the defaults, the contexts are
+// copied since the config is shared
+func withSecurityDefaults(containers []corev1.Container, defaults *corev1.SecurityContext) []corev1.Container {
+	if defaults == nil {
+		return containers
+	}
+
+	out := make([]corev1.Container, len(containers))
+	for i, cnt := range containers {
+		sc := &corev1.SecurityContext{}
+		if cnt.SecurityContext != nil {
+			sc = cnt.SecurityContext.DeepCopy()
+		}
+
+		d := defaults.DeepCopy()
+		if sc.Capabilities == nil {
+			sc.Capabilities = d.Capabilities
+		}
+		if sc.Privileged == nil {
+			sc.Privileged = d.Privileged
+		}
+		if sc.SELinuxOptions == nil {
+			sc.SELinuxOptions = d.SELinuxOptions
+		}
+		if sc.WindowsOptions == nil {
+			sc.WindowsOptions = d.WindowsOptions
+		}
+		if sc.RunAsUser == nil {
+			sc.RunAsUser = d.RunAsUser
+		}
+		if sc.RunAsGroup == nil {
+			sc.RunAsGroup = d.RunAsGroup
+		}
+		if sc.RunAsNonRoot == nil {
+			sc.RunAsNonRoot = d.RunAsNonRoot
+		}
+		if sc.ReadOnlyRootFilesystem == nil {
+			sc.ReadOnlyRootFilesystem = d.ReadOnlyRootFilesystem
+		}
+		if sc.AllowPrivilegeEscalation == nil {
+			sc.AllowPrivilegeEscalation = d.AllowPrivilegeEscalation
+		}
+		if sc.ProcMount == nil {
+			sc.ProcMount = d.ProcMount
+		}
+
+		cnt.SecurityContext = sc
+		out[i] = cnt
+	}
+
+	return out
+}
+
+// addPodDefaults adds the image pull secrets of the sidecar images to the pod
+// and sets its runtime class unless it has one
+func addPodDefaults(spec *corev1.PodSpec, sidecarConfig *Config) *corev1.PodSpec {
+	for _, s := range sidecarConfig.ImagePullSecrets {
+		found := false
+		for _, existing := range spec.ImagePullSecrets {
+			if existing.Name == s.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			spec.ImagePullSecrets = append(spec.ImagePullSecrets, s)
+		}
+	}
+
+	if sidecarConfig.RuntimeClassName != "" && spec.RuntimeClassName == nil {
+		rc := sidecarConfig.RuntimeClassName
+		spec.RuntimeClassName = &rc
+	}
+
+	return spec
+}
@@ -0,0 +1,251 @@
+package injector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultPolicyQuery   = "data.tyk.injector.deny"
+	defaultPolicyRefresh = time.Minute
+)
+
+// PolicyConfig configures the admission policies written in Rego, evaluated
+// for every pod and service that is about to be injected
+type PolicyConfig struct {
+	ConfigMap string        `yaml:"configMap"` // namespace/name of the ConfigMap holding the .rego modules, disabled if unset
+	Query     string        `yaml:"query"`     // set of denial messages, data.tyk.injector.deny if unset
+	Refresh   time.Duration `yaml:"refresh"`   // how often the modules are reloaded, a minute if unset
+	FailOpen  bool          `yaml:"failOpen"`  // inject if the policies can't be loaded or evaluated
+}
+
+// Validate checks the policy configuration
+func (c *PolicyConfig) Validate() []error {
+	errs := make([]error, 0)
+	if c.ConfigMap == "" {
+		return errs
+	}
+
+	if parts := strings.SplitN(c.ConfigMap, "/", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		errs = append(errs, fmt.Errorf("policy.configMap: %q must be namespace/name", c.ConfigMap))
+	}
+
+	if c.Query != "" && !strings.HasPrefix(c.Query, "data.") {
+		errs = append(errs, fmt.Errorf("policy.query: %q must be a data. reference", c.Query))
+	}
+
+	if c.Refresh < 0 {
+		errs = append(errs, fmt.Errorf("policy.refresh: must not be negative"))
+	}
+
+	return errs
+}
+
+// policyEngine keeps the compiled policies, reloaded from their ConfigMap
+// once they are older than the refresh interval
+type policyEngine struct {
+	mu      sync.Mutex
+	loaded  time.Time
+	version string // resource version of the ConfigMap the query was compiled from
+	query   *rego.PreparedEvalQuery
+}
+
+// preparedPolicy returns the compiled policy query, the last one that compiled is
+// kept if the ConfigMap can't be read or its modules don't compile
+func (whsvr *WebhookServer) preparedPolicy(ctx context.Context) (*rego.PreparedEvalQuery, error) {
+	cfg := &whsvr.SidecarConfig.Policy
+	whsvr.policyMu.Lock()
+	if whsvr.policy == nil {
+		whsvr.policy = &policyEngine{}
+	}
+	pe := whsvr.policy
+	whsvr.policyMu.Unlock()
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	refresh := cfg.Refresh
+	if refresh == 0 {
+		refresh = defaultPolicyRefresh
+	}
+
+	if pe.query != nil && time.Since(pe.loaded) < refresh {
+		return pe.query, nil
+	}
+
+	query, version, err := whsvr.compilePolicy(ctx, pe.version)
+	if err != nil {
+		if pe.query != nil {
+			log.Warningf("keeping the last admission policies: %v", err)
+			pe.loaded = time.Now()
+			return pe.query, nil
+		}
+		return nil, err
+	}
+
+	if query != nil {
+		pe.query = query
+		pe.version = version
+	}
+	pe.loaded = time.Now()
+
+	return pe.query, nil
+}
+
+// compilePolicy compiles the .rego modules of the policy ConfigMap, nil if
+// the ConfigMap is still at the given version
+func (whsvr *WebhookServer) compilePolicy(ctx context.Context, version string) (*rego.PreparedEvalQuery, string, error) {
+	cfg := &whsvr.SidecarConfig.Policy
+	if whsvr.KubeClient == nil {
+		return nil, "", fmt.Errorf("admission policies require a kubernetes client")
+	}
+
+	parts := strings.SplitN(cfg.ConfigMap, "/", 2)
+	cm, err := whsvr.KubeClient.CoreV1().ConfigMaps(parts[0]).Get(parts[1], metav1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read the admission policies: %w", err)
+	}
+
+	if version != "" && cm.ResourceVersion == version {
+		return nil, version, nil
+	}
+
+	query := cfg.Query
+	if query == "" {
+		query = defaultPolicyQuery
+	}
+
+	names := make([]string, 0, len(cm.Data))
+	for name := range cm.Data {
+		if strings.HasSuffix(name, ".rego") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return nil, "", fmt.Errorf("no .rego modules in %v", cfg.ConfigMap)
+	}
+
+	opts := []func(*rego.Rego){rego.Query(query)}
+	for _, name := range names {
+		opts = append(opts, rego.Module(name, cm.Data[name]))
+	}
+
+	prepared, err := rego.New(opts...).PrepareForEval(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to compile the admission policies: %w", err)
+	}
+
+	log.Infof("loaded %d admission policy modules from %v", len(names), cfg.ConfigMap)
+	return &prepared, cm.ResourceVersion, nil
+}
+
+// policyInput is the document policies are evaluated against
+func (whsvr *WebhookServer) policyInput(req *v1beta1.AdmissionRequest, obj interface{}, namespace string) (map[string]interface{}, error) {
+	ns := map[string]interface{}{"name": namespace}
+	if whsvr.KubeClient != nil && namespace != "" {
+		n, err := whsvr.KubeClient.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read namespace %v: %w", namespace, err)
+		}
+		ns["labels"] = n.Labels
+		ns["annotations"] = n.Annotations
+	}
+
+	doc := map[string]interface{}{
+		"kind":      req.Kind.Kind,
+		"operation": req.Operation,
+		"userInfo":  req.UserInfo,
+		"object":    obj,
+		"namespace": ns,
+		"config": map[string]interface{}{
+			"enableMeshTLS":    whsvr.SidecarConfig.EnableMeshTLS,
+			"workloadIdentity": whsvr.SidecarConfig.WorkloadIdentity,
+			"createRoutes":     whsvr.SidecarConfig.CreateRoutes,
+		},
+	}
+
+	// policies see the objects as they are in the API
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	input := map[string]interface{}{}
+	err = json.Unmarshal(js, &input)
+	return input, err
+}
+
+// checkPolicy evaluates the admission policies for an object that is about
+// to be injected, returning the reasons to deny it
+func (whsvr *WebhookServer) checkPolicy(ctx context.Context, req *v1beta1.AdmissionRequest, obj interface{}, namespace string) ([]string, error) {
+	if whsvr.SidecarConfig.Policy.ConfigMap == "" {
+		return nil, nil
+	}
+
+	query, err := whsvr.preparedPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := whsvr.policyInput(req, obj, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate the admission policies: %w", err)
+	}
+
+	denied := make([]string, 0)
+	for _, res := range rs {
+		for _, expr := range res.Expressions {
+			switch v := expr.Value.(type) {
+			case []interface{}:
+				for _, msg := range v {
+					denied = append(denied, fmt.Sprint(msg))
+				}
+			case bool:
+				if v {
+					denied = append(denied, "denied by the admission policies")
+				}
+			case string:
+				denied = append(denied, v)
+			}
+		}
+	}
+	sort.Strings(denied)
+
+	return denied, nil
+}
+
+// policyDenied returns the response rejecting an object denied by the
+// admission policies, or nil if it may be injected
+func (whsvr *WebhookServer) policyDenied(ctx context.Context, req *v1beta1.AdmissionRequest, obj interface{}, namespace string) *v1beta1.AdmissionResponse {
+	denied, err := whsvr.checkPolicy(ctx, req, obj, namespace)
+	if err != nil {
+		if whsvr.SidecarConfig.Policy.FailOpen {
+			log.Warningf("injecting without checking the admission policies: %v", err)
+			return nil
+		}
+		denied = []string{err.Error()}
+	}
+
+	if len(denied) == 0 {
+		return nil
+	}
+
+	log.Infof("admission policies denied %v %v/%v: %v", req.Kind.Kind, namespace, req.Name, denied)
+	return forbidden("admission policy: " + strings.Join(denied, "; "))
+}
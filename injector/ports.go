@@ -0,0 +1,374 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// IDs of the inbound and mesh routes of the named ports of a pod, comma separated
+	AdmissionWebhookAnnotationPortInboundServiceIDsKey = "injector.tyk.io/port-inbound-service-ids"
+	AdmissionWebhookAnnotationPortMeshServiceIDsKey    = "injector.tyk.io/port-mesh-service-ids"
+
+	// named ports are mapped to a sidecar port in this range
+	sidecarPortBase  int32 = 18000
+	sidecarPortRange       = 1000
+
+	// lets the sidecar listen on the ports of the routes of named ports, Tyk
+	// refuses API listen ports that aren't whitelisted. The sidecar only
+	// loads the mesh routes and the routes of its pod, all on sidecar ports.
+	portWhitelistVarName = "TYK_GW_DISABLEPORTWHITELIST"
+)
+
+// sidecarPort returns the port the sidecar listens on for a named port. It
+// only depends on the name, so that services and the pods they select agree
+// on it without seeing each other. Unnamed ports use the sidecar port.
+func sidecarPort(name string) int32 {
+	if name == "" {
+		return sidecarServicePort
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return sidecarPortBase + int32(h.Sum32()%sidecarPortRange)
+}
+
+// sidecarPortName is the name of the service port added for a sidecar port
+func sidecarPortName(port int32) string {
+	if port == sidecarServicePort {
+		return "tyk-sidecar"
+	}
+	return fmt.Sprintf("tyk-%d", port)
+}
+
+// namedPorts returns the named TCP ports of the containers of a pod, sorted
+// by name, leaving out the injected containers. Pods with less than two are
+// only reached through the sidecar port and get no routes per port.
+func namedPorts(pod *corev1.Pod, sidecars []corev1.Container) ([]corev1.ContainerPort, error) {
+	injected := map[string]bool{}
+	for _, cnt := range sidecars {
+		injected[cnt.Name] = true
+	}
+
+	used := map[int32]string{}
+	ports := make([]corev1.ContainerPort, 0)
+	seen := map[string]bool{}
+	for _, cnt := range pod.Spec.Containers {
+		if injected[cnt.Name] {
+			continue
+		}
+
+		for _, p := range cnt.Ports {
+			used[p.ContainerPort] = p.Name
+			if p.Name == "" || seen[p.Name] || (p.Protocol != "" && p.Protocol != corev1.ProtocolTCP) {
+				continue
+			}
+			seen[p.Name] = true
+			ports = append(ports, p)
+		}
+	}
+
+	if len(ports) < 2 {
+		return nil, nil
+	}
+
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+
+	mapped := map[int32]string{}
+	for _, p := range ports {
+		sp := sidecarPort(p.Name)
+		if other, ok := mapped[sp]; ok {
+			return nil, fmt.Errorf("ports %v and %v both map to sidecar port %v, rename one of them", other, p.Name, sp)
+		}
+		if other, ok := used[sp]; ok {
+			return nil, fmt.Errorf("port %v maps to sidecar port %v, which is already used by port %q", p.Name, sp, other)
+		}
+		mapped[sp] = p.Name
+	}
+
+	return ports, nil
+}
+
+// servicePortName is the name of the container port a service port reaches,
+// the one it targets by name or else its own
+func servicePortName(p corev1.ServicePort) string {
+	if p.TargetPort.Type == intstr.String {
+		return p.TargetPort.StrVal
+	}
+	return p.Name
+}
+
+// servicePorts maps the ports of a service to the sidecar. A single port is
+// proxied on the sidecar port. The ports of services with several are
+// proxied on the sidecar port of the container port they reach if the pods
+// have a route for it, routed holds the names of those ports. Other ports
+// are left to reach the pods directly. The sidecar ports the mesh routes
+// target are added, the ports callers use are unchanged.
+func servicePorts(svc *corev1.Service, routed map[string]bool) []corev1.ServicePort {
+	ports := make([]corev1.ServicePort, 0, len(svc.Spec.Ports)+1)
+	exposed := map[int32]bool{}
+	for _, p := range svc.Spec.Ports {
+		exposed[p.Port] = true
+	}
+
+	targets := []int32{sidecarServicePort}
+	for _, p := range svc.Spec.Ports {
+		if p.Protocol != "" && p.Protocol != corev1.ProtocolTCP {
+			ports = append(ports, p)
+			continue
+		}
+
+		name := servicePortName(p)
+		if len(svc.Spec.Ports) == 1 {
+			name = ""
+		} else if !routed[name] {
+			ports = append(ports, p)
+			continue
+		}
+
+		sp := sidecarPort(name)
+		p.TargetPort = intstr.FromInt(int(sp))
+		ports = append(ports, p)
+		if sp != sidecarServicePort {
+			targets = append(targets, sp)
+		}
+	}
+
+	for _, sp := range targets {
+		if exposed[sp] {
+			continue
+		}
+		ports = append(ports, corev1.ServicePort{
+			Name:       sidecarPortName(sp),
+			Port:       sp,
+			TargetPort: intstr.FromInt(int(sp)),
+		})
+	}
+
+	return ports
+}
+
+// guessRoutedPorts stands in for the routed ports of a service whose pods
+// can't be looked at, e.g. when the service is created first: the container
+// ports it targets by name, which only have routes if there are several
+func guessRoutedPorts(svc *corev1.Service) map[string]bool {
+	routed := map[string]bool{}
+	for _, p := range svc.Spec.Ports {
+		if p.TargetPort.Type == intstr.String && (p.Protocol == "" || p.Protocol == corev1.ProtocolTCP) {
+			routed[p.TargetPort.StrVal] = true
+		}
+	}
+
+	if len(routed) < 2 {
+		return nil
+	}
+	return routed
+}
+
+// routedPorts returns the names of the ports the pods selected by a service
+// have routes for, guessed from the service if there are no pods yet
+func (whsvr *WebhookServer) routedPorts(svc *corev1.Service, namespace string) map[string]bool {
+	if whsvr.KubeClient == nil || len(svc.Spec.Selector) == 0 {
+		return guessRoutedPorts(svc)
+	}
+
+	pods, err := whsvr.KubeClient.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(svc.Spec.Selector).String(),
+	})
+	if err != nil {
+		log.Warningf("failed to list the pods of service %s/%s: %v", namespace, svc.Name, err)
+		return guessRoutedPorts(svc)
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !injecting(&pod.ObjectMeta) {
+			continue
+		}
+
+		ports, err := namedPorts(pod, whsvr.SidecarConfig.Containers)
+		if err != nil {
+			continue
+		}
+
+		routed := map[string]bool{}
+		for _, p := range ports {
+			routed[p.Name] = true
+		}
+		return routed
+	}
+
+	return guessRoutedPorts(svc)
+}
+
+// addPortEnv lets the sidecar of a pod with routes per port listen on their
+// ports, pods without them keep the port whitelist of the gateway
+func addPortEnv(pod *corev1.Pod, containers []corev1.Container, sidecarConfig *Config) []corev1.Container {
+	if ports, err := namedPorts(pod, sidecarConfig.Containers); err != nil || len(ports) == 0 {
+		return containers
+	}
+
+	for i, cnt := range containers {
+		if cnt.Name != "tyk-mesh" || hasEnv(cnt.Env, portWhitelistVarName) {
+			continue
+		}
+
+		env := make([]corev1.EnvVar, len(cnt.Env), len(cnt.Env)+1)
+		copy(env, cnt.Env)
+		containers[i].Env = append(env, corev1.EnvVar{Name: portWhitelistVarName, Value: "true"})
+	}
+
+	return containers
+}
+
+// PortSlugs returns the slugs of the routes of the named ports of an injected
+// pod, the mesh routes as resolved in the org of cl
+func PortSlugs(ctx context.Context, cl tyk.Client, pod *corev1.Pod) []string {
+	sName := pod.Labels["app"]
+	slugs := make([]string, 0)
+	for _, k := range []string{AdmissionWebhookAnnotationPortInboundServiceIDsKey, AdmissionWebhookAnnotationPortMeshServiceIDsKey} {
+		if _, ok := pod.Annotations[k]; !ok {
+			return nil
+		}
+	}
+
+	// the pod is already injected
+	ports, _ := namedPorts(pod, []corev1.Container{{Name: "tyk-mesh"}})
+	for _, p := range ports {
+		slugs = append(slugs, InboundSlug(pod.Namespace, sName+"-"+p.Name), ResolveMeshSlug(ctx, cl, pod.Namespace, sName+"-"+p.Name))
+	}
+
+	return slugs
+}
+
+// portServiceIDs returns the IDs of the routes per port recorded in an annotation
+func portServiceIDs(ann map[string]string, key string) []string {
+	v := ann[key]
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// PortServiceIDs returns the IDs of the inbound and mesh routes of the named
+// ports of an injected pod
+func PortServiceIDs(pod *corev1.Pod) []string {
+	ids := portServiceIDs(pod.Annotations, AdmissionWebhookAnnotationPortInboundServiceIDsKey)
+	return append(ids, portServiceIDs(pod.Annotations, AdmissionWebhookAnnotationPortMeshServiceIDsKey)...)
+}
+
+// createPortRoutes adds an inbound and a mesh route for each named port of a
+// pod with several. The inbound route listens on the sidecar port of the
+// name and proxies to the container port, the mesh route listens on the
+// same port and targets the service on it, so that callers reach the port
+// of a service on mesh:<sidecar port>/<service>.
+func (whsvr *WebhookServer) createPortRoutes(ctx context.Context, cl tyk.Client, pod *corev1.Pod, annotations map[string]string, sName, ns, listenPath string, podAnn map[string]string, tls bool, reason *tyk.ChangeReason) (map[string]string, error) {
+	ports, err := namedPorts(pod, whsvr.SidecarConfig.Containers)
+	if err != nil || len(ports) == 0 {
+		return annotations, err
+	}
+
+	resilienceAnn, err := resilienceOptions(pod)
+	if err != nil {
+		return annotations, err
+	}
+
+	tr := "http"
+	if tls {
+		tr = "https"
+	}
+
+	hName := fmt.Sprintf("%s.%s", sName, ns)
+	inboundIDs := make([]string, 0, len(ports))
+	meshIDs := make([]string, 0, len(ports))
+	for _, p := range ports {
+		sp := sidecarPort(p.Name)
+		listenPort := map[string]string{string(processor.ValueSetNumKey) + "listen_port": fmt.Sprint(sp)}
+
+		target := appTarget(whsvr.SidecarConfig, p.ContainerPort, tlsPort(p))
+		slugID := InboundSlug(ns, sName+"-"+p.Name)
+		ibAnn := inboundAnnotations(podAnn, target)
+		for k, v := range listenPort {
+			ibAnn[k] = v
+		}
+		opts := &tyk.APIDefOptions{
+			Slug:         slugID,
+			Target:       target,
+			ListenPath:   "/",
+			TemplateName: checkAndGetTemplate(pod, false),
+			Hostname:     hName,
+			Name:         fmt.Sprintf("%s-%s-inbound", sName, p.Name),
+			Tags:         []string{sName},
+			Annotations:  ibAnn,
+			ChangeReason: reason,
+			Namespace:    ns,
+			Labels:       pod.Labels,
+			Mesh:         true,
+			RedactBodies: whsvr.SidecarConfig.SidecarLog.RedactBodies,
+			ServiceName:  sName,
+			ServicePort:  sp,
+		}
+
+		ibID, _, err := cl.CreateOrGetService(ctx, opts)
+		if err != nil {
+			return annotations, fmt.Errorf("failed to create inbound service %v: %w", slugID, err)
+		}
+		inboundIDs = append(inboundIDs, ibID)
+		whsvr.recordAPI(ibID, slugID, pod, ns)
+
+		upstreamAnn, tgt, err := whsvr.upstreamTLSOptions(ctx, cl, pod, ns, hostURL(tr, hName, sp))
+		if err != nil {
+			return annotations, err
+		}
+		for k, v := range resilienceAnn {
+			upstreamAnn[k] = v
+		}
+
+		meshAnn := meshAnnotations(podAnn, upstreamAnn)
+		for k, v := range listenPort {
+			meshAnn[k] = v
+		}
+
+		meshSlugID := ResolveMeshSlug(ctx, cl, ns, sName+"-"+p.Name)
+		meshOpts := &tyk.APIDefOptions{
+			Slug:         meshSlugID,
+			Target:       tgt,
+			ListenPath:   listenPath,
+			TemplateName: checkAndGetTemplate(pod, true),
+			Hostname:     meshDomain(whsvr.SidecarConfig),
+			Name:         LegacyMeshSlug(sName + "-" + p.Name),
+			Tags:         tyk.Segments(tyk.SegmentMesh, ns, pod.Annotations),
+			Annotations:  meshAnn,
+			ChangeReason: reason,
+			Namespace:    ns,
+			Labels:       pod.Labels,
+			Mesh:         true,
+			RedactBodies: whsvr.SidecarConfig.SidecarLog.RedactBodies,
+			ServiceName:  sName,
+			ServicePort:  sp,
+		}
+
+		meshID, _, err := cl.CreateOrGetService(ctx, meshOpts)
+		if err != nil {
+			return annotations, fmt.Errorf("failed to create mesh service %v: %w", meshSlugID, err)
+		}
+		meshIDs = append(meshIDs, meshID)
+		whsvr.recordAPI(meshID, meshSlugID, pod, ns)
+	}
+
+	annotations[AdmissionWebhookAnnotationPortInboundServiceIDsKey] = strings.Join(inboundIDs, ",")
+	annotations[AdmissionWebhookAnnotationPortMeshServiceIDsKey] = strings.Join(meshIDs, ",")
+
+	return annotations, nil
+}
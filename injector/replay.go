@@ -0,0 +1,50 @@
+package injector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"k8s.io/api/admission/v1beta1"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// Replay runs a recorded admission review through the mutating webhook
+// against an in-memory Tyk client and CA, nothing is created in a cluster or
+// Dashboard. The IDs of the routes created for the object are replaced by
+// {API_ID:<slug>} in the patch, so it only changes with the mutation. It
+// lets template and patch changes be checked against reviews recorded from
+// any Kubernetes version, the warnings of the admission are returned too.
+func Replay(body []byte, sidecarConfig *Config) (*v1beta1.AdmissionResponse, []string, error) {
+	ar := v1beta1.AdmissionReview{}
+	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+		return nil, nil, fmt.Errorf("can't decode admission review: %v", err)
+	}
+	if ar.Request == nil {
+		return nil, nil, errors.New("admission review has no request")
+	}
+
+	mock := tyk.NewMockClient()
+	whs := &WebhookServer{SidecarConfig: sidecarConfig, CAClient: &ca.Mock{}, TykClients: mock.Resolver()}
+
+	ctx, warnings := withWarnings(context.Background())
+	resp := recoverReview(ctx, &ar, whs.mutate)
+	resp.UID = ar.Request.UID
+
+	// longest first, so IDs that are prefixes of others are replaced last
+	ids := make([]string, 0, len(mock.APIs))
+	for id := range mock.APIs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return len(ids[i]) > len(ids[j]) })
+	for _, id := range ids {
+		placeholder := fmt.Sprintf("{API_ID:%s}", mock.APIs[id].Slug)
+		resp.Patch = bytes.ReplaceAll(resp.Patch, []byte(id), []byte(placeholder))
+	}
+
+	return resp, warnings.list(), nil
+}
@@ -0,0 +1,159 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// Opts the pods of a StatefulSet into an inbound and mesh route of their own
+	AdmissionWebhookAnnotationReplicaRoutesKey           = "injector.tyk.io/replica-routes"
+	AdmissionWebhookAnnotationReplicaInboundServiceIDKey = "injector.tyk.io/replica-inbound-service-id"
+	AdmissionWebhookAnnotationReplicaMeshServiceIDKey    = "injector.tyk.io/replica-mesh-service-id"
+)
+
+// replicaName returns the stable name of a StatefulSet pod that asked for
+// per-replica routes, and an empty name for all other pods
+func replicaName(pod *corev1.Pod) string {
+	switch strings.ToLower(pod.Annotations[AdmissionWebhookAnnotationReplicaRoutesKey]) {
+	case "y", "yes", "true", "on":
+	default:
+		return ""
+	}
+
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		log.Warningf("%v: per-replica routes are only created for StatefulSet pods", pod.Name)
+		return ""
+	}
+
+	if pod.Spec.Hostname != "" {
+		return pod.Spec.Hostname
+	}
+
+	return pod.Name
+}
+
+// replicaHostname is the DNS name of a replica in the headless service of its
+// StatefulSet, e.g. db-0.db.ns
+func replicaHostname(pod *corev1.Pod, replica, sName, ns string) string {
+	svc := pod.Spec.Subdomain
+	if svc == "" {
+		svc = sName
+	}
+
+	return fmt.Sprintf("%s.%s.%s", replica, svc, ns)
+}
+
+// ReplicaSlugs returns the slugs of the per-replica routes of an injected pod,
+// the mesh route as resolved in the org of cl
+func ReplicaSlugs(ctx context.Context, cl tyk.Client, pod *corev1.Pod) []string {
+	replica := replicaName(pod)
+	if replica == "" {
+		return nil
+	}
+
+	return []string{InboundSlug(pod.Namespace, replica), ResolveMeshSlug(ctx, cl, pod.Namespace, replica)}
+}
+
+// createReplicaRoutes adds an inbound route only loaded by the sidecar of a
+// single StatefulSet replica, and a mesh route to it on the name of the
+// replica, so callers can address e.g. the primary of a database through the
+// mesh. The routes of the service the replica belongs to are unaffected.
+func (whsvr *WebhookServer) createReplicaRoutes(ctx context.Context, cl tyk.Client, pod *corev1.Pod, annotations map[string]string, sName, ns string, podAnn map[string]string, tls bool, reason *tyk.ChangeReason) (map[string]string, error) {
+	replica := replicaName(pod)
+	if replica == "" {
+		return annotations, nil
+	}
+
+	target, err := inboundTarget(pod, whsvr.SidecarConfig)
+	if err != nil {
+		return annotations, err
+	}
+
+	var pt int32 = 8080
+	hName := replicaHostname(pod, replica, sName, ns)
+
+	slugID := InboundSlug(ns, replica)
+	opts := &tyk.APIDefOptions{
+		Slug:         slugID,
+		Target:       target,
+		ListenPath:   "/",
+		TemplateName: checkAndGetTemplate(pod, false),
+		Hostname:     hName,
+		Name:         replica + "-inbound",
+		Tags:         []string{replica},
+		Annotations:  inboundAnnotations(podAnn, target),
+		ChangeReason: reason,
+		Namespace:    ns,
+		Labels:       pod.Labels,
+		Mesh:         true,
+		RedactBodies: whsvr.SidecarConfig.SidecarLog.RedactBodies,
+		ServiceName:  sName,
+		ServicePort:  pt,
+	}
+
+	ibID, _, err := cl.CreateOrGetService(ctx, opts)
+	if err != nil {
+		return annotations, fmt.Errorf("failed to create replica inbound service %v: %w", slugID, err)
+	}
+
+	annotations[AdmissionWebhookAnnotationReplicaInboundServiceIDKey] = ibID
+	whsvr.recordAPI(ibID, slugID, pod, ns)
+
+	tr := "http"
+	if tls {
+		tr = "https"
+	}
+
+	// a replica is dialled by its own name, an SNI override applies to the service
+	rPod := pod.DeepCopy()
+	delete(rPod.Annotations, AdmissionWebhookAnnotationUpstreamSNIKey)
+	upstreamAnn, tgt, err := whsvr.upstreamTLSOptions(ctx, cl, rPod, ns, hostURL(tr, hName, pt))
+	if err != nil {
+		return annotations, err
+	}
+
+	resilienceAnn, err := resilienceOptions(pod)
+	if err != nil {
+		return annotations, err
+	}
+	for k, v := range resilienceAnn {
+		upstreamAnn[k] = v
+	}
+
+	meshSlugID := ResolveMeshSlug(ctx, cl, ns, replica)
+	meshOpts := &tyk.APIDefOptions{
+		Slug:         meshSlugID,
+		Target:       tgt,
+		ListenPath:   replica,
+		TemplateName: checkAndGetTemplate(pod, true),
+		Hostname:     meshDomain(whsvr.SidecarConfig),
+		Name:         LegacyMeshSlug(replica),
+		Tags:         tyk.Segments(tyk.SegmentMesh, ns, pod.Annotations),
+		Annotations:  meshAnnotations(podAnn, upstreamAnn),
+		ChangeReason: reason,
+		Namespace:    ns,
+		Labels:       pod.Labels,
+		Mesh:         true,
+		RedactBodies: whsvr.SidecarConfig.SidecarLog.RedactBodies,
+		ServiceName:  sName,
+		ServicePort:  pt,
+	}
+
+	meshID, _, err := cl.CreateOrGetService(ctx, meshOpts)
+	if err != nil {
+		return annotations, fmt.Errorf("failed to create replica mesh service %v: %w", meshSlugID, err)
+	}
+
+	annotations[AdmissionWebhookAnnotationReplicaMeshServiceIDKey] = meshID
+	whsvr.recordAPI(meshID, meshSlugID, pod, ns)
+
+	return annotations, nil
+}
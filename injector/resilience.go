@@ -0,0 +1,129 @@
+package injector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+)
+
+const (
+	// Circuit breaker of the mesh route, the share of failed requests that
+	// trips it, e.g. 0.5 or 50%
+	AdmissionWebhookAnnotationCBThresholdKey = "mesh.tyk.io/cb-threshold"
+	// Requests sampled before the breaker can trip, 20 if unset
+	AdmissionWebhookAnnotationCBSamplesKey = "mesh.tyk.io/cb-samples"
+	// How long a tripped breaker stays open, 30s if unset
+	AdmissionWebhookAnnotationCBReturnAfterKey = "mesh.tyk.io/cb-return-after"
+	// Upstream timeout of the mesh route, rounded up to whole seconds
+	AdmissionWebhookAnnotationTimeoutKey = "mesh.tyk.io/timeout"
+	// Retries of failed upstream requests, not supported by the sidecar gateway
+	AdmissionWebhookAnnotationRetriesKey = "mesh.tyk.io/retries"
+
+	circuitBreakersPath = "version_data.versions.Default.extended_paths.circuit_breakers"
+	hardTimeoutsPath    = "version_data.versions.Default.extended_paths.hard_timeouts"
+
+	defaultCBSamples     = 20
+	defaultCBReturnAfter = 30 * time.Second
+)
+
+// parseThreshold reads a circuit breaker threshold as a fraction
+func parseThreshold(v string) (float64, error) {
+	pct := strings.HasSuffix(v, "%")
+	f, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+	if err == nil && (pct || f > 1) {
+		f /= 100
+	}
+
+	if err != nil || f <= 0 || f > 1 {
+		return 0, fmt.Errorf("%v: %q must be a fraction or a percentage of failed requests", AdmissionWebhookAnnotationCBThresholdKey, v)
+	}
+
+	return f, nil
+}
+
+// seconds reads a duration annotation in whole seconds, rounding up
+func seconds(key, v string) (int, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%v: %q must be a positive duration", key, v)
+	}
+
+	return int(math.Ceil(d.Seconds())), nil
+}
+
+// resilienceOptions translates the circuit breaker and timeout annotations
+// of a pod into extended paths of its mesh route, covering all its paths.
+// The sidecar gateway can't retry upstream requests, pods asking for
+// retries are rejected rather than silently running without them.
+func resilienceOptions(pod *corev1.Pod) (map[string]string, error) {
+	ann := map[string]string{}
+
+	if v, ok := pod.Annotations[AdmissionWebhookAnnotationRetriesKey]; ok && v != "0" {
+		return nil, fmt.Errorf("%v: the sidecar gateway doesn't retry upstream requests, use a circuit breaker and timeout instead", AdmissionWebhookAnnotationRetriesKey)
+	}
+
+	if v, ok := pod.Annotations[AdmissionWebhookAnnotationCBThresholdKey]; ok {
+		threshold, err := parseThreshold(v)
+		if err != nil {
+			return nil, err
+		}
+
+		samples := defaultCBSamples
+		if s, ok := pod.Annotations[AdmissionWebhookAnnotationCBSamplesKey]; ok {
+			if samples, err = strconv.Atoi(s); err != nil || samples < 1 {
+				return nil, fmt.Errorf("%v: %q must be a positive number of requests", AdmissionWebhookAnnotationCBSamplesKey, s)
+			}
+		}
+
+		returnAfter := int(defaultCBReturnAfter.Seconds())
+		if r, ok := pod.Annotations[AdmissionWebhookAnnotationCBReturnAfterKey]; ok {
+			if returnAfter, err = seconds(AdmissionWebhookAnnotationCBReturnAfterKey, r); err != nil {
+				return nil, err
+			}
+		}
+
+		breakers := make([]map[string]interface{}, 0, len(meshRouteMethods))
+		for _, m := range meshRouteMethods {
+			breakers = append(breakers, map[string]interface{}{
+				"path":                    "/",
+				"method":                  m,
+				"threshold_percent":       threshold,
+				"samples":                 samples,
+				"return_to_service_after": returnAfter,
+			})
+		}
+
+		data, err := json.Marshal(breakers)
+		if err != nil {
+			return nil, err
+		}
+		ann[string(processor.ArrayAppendKey)+circuitBreakersPath] = string(data)
+	}
+
+	if v, ok := pod.Annotations[AdmissionWebhookAnnotationTimeoutKey]; ok {
+		timeout, err := seconds(AdmissionWebhookAnnotationTimeoutKey, v)
+		if err != nil {
+			return nil, err
+		}
+
+		timeouts := make([]map[string]interface{}, 0, len(meshRouteMethods))
+		for _, m := range meshRouteMethods {
+			timeouts = append(timeouts, map[string]interface{}{"path": "/", "method": m, "timeout": timeout})
+		}
+
+		data, err := json.Marshal(timeouts)
+		if err != nil {
+			return nil, err
+		}
+		ann[string(processor.ArrayAppendKey)+hardTimeoutsPath] = string(data)
+	}
+
+	return ann, nil
+}
@@ -0,0 +1,69 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// deny rejects an object, the API server returns the code, reason and
+// message of the status to the client
+func deny(code int32, reason metav1.StatusReason, msg string) *v1beta1.AdmissionResponse {
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  reason,
+			Message: msg,
+		},
+	}
+}
+
+// badRequest rejects a review or object that can't be decoded or handled
+func badRequest(err error) *v1beta1.AdmissionResponse {
+	return deny(http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+}
+
+// invalid rejects an object whose injector annotations are invalid
+func invalid(err error) *v1beta1.AdmissionResponse {
+	return deny(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error())
+}
+
+// forbidden rejects an object that may not be injected
+func forbidden(msg string) *v1beta1.AdmissionResponse {
+	return deny(http.StatusForbidden, metav1.StatusReasonForbidden, msg)
+}
+
+// failed rejects an object the injector failed to wire into the mesh, as
+// unavailable if Tyk or the CA are unhealthy and retrying may succeed
+func failed(err error) *v1beta1.AdmissionResponse {
+	if unhealthy(err) {
+		return deny(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, err.Error())
+	}
+	return deny(http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+}
+
+// recoverReview runs review, rejecting the object instead of crashing the
+// webhook if it panics
+func recoverReview(ctx context.Context, ar *v1beta1.AdmissionReview, review func(context.Context, *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse) (resp *v1beta1.AdmissionResponse) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+
+		kind, ns, name := "object", "", ""
+		if req := ar.Request; req != nil {
+			kind, ns, name = req.Kind.Kind, req.Namespace, req.Name
+		}
+		log.Errorf("panic admitting %v %v/%v: %v\n%s", kind, ns, name, p, debug.Stack())
+		resp = deny(http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("internal error admitting %v: %v", kind, p))
+	}()
+
+	return review(ctx, ar)
+}
@@ -0,0 +1,127 @@
+package injector
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// user the injected containers run as in restricted mode unless they set one
+	restrictedUID int64 = 1000
+
+	// writable directory of the gateway with a read-only root filesystem
+	restrictedTmpVolume = "tyk-tmp"
+	restrictedTmpDir    = "/tmp"
+	pidFileVarName      = "TYK_GW_PIDFILELOCATION"
+)
+
+// needsPrivileges checks if a container can't run under the restricted Pod
+// Security Standard, e.g. the init container redirecting traffic with iptables
+func needsPrivileges(cnt *corev1.Container) bool {
+	sc := cnt.SecurityContext
+	if sc == nil {
+		return false
+	}
+
+	return (sc.Privileged != nil && *sc.Privileged) ||
+		(sc.Capabilities != nil && len(sc.Capabilities.Add) > 0) ||
+		(sc.RunAsUser != nil && *sc.RunAsUser == 0)
+}
+
+// validateRestricted checks the config can be injected in restricted mode
+func (c *Config) validateRestricted() []error {
+	errs := make([]error, 0)
+	if !c.Restricted {
+		return errs
+	}
+
+	// the CA is added to the trust store by the iptables init container otherwise
+	if c.EnableMeshTLS && !c.CAInit.Enabled {
+		errs = append(errs, fmt.Errorf("restricted: requires caInit with enableMeshTLS"))
+	}
+
+	for i, cnt := range c.Containers {
+		if needsPrivileges(&cnt) {
+			errs = append(errs, fmt.Errorf("restricted: containers[%d] %v needs privileges", i, cnt.Name))
+		}
+	}
+
+	return errs
+}
+
+// restrictedInitContainers drops the init containers needing privileges
+func restrictedInitContainers(containers []corev1.Container) []corev1.Container {
+	out := make([]corev1.Container, 0, len(containers))
+	for _, cnt := range containers {
+		if needsPrivileges(&cnt) {
+			continue
+		}
+		out = append(out, cnt)
+	}
+	return out
+}
+
+// harden returns the containers with a security context meeting the
+// restricted Pod Security Standard, except for the seccomp profile, which the
+// client library predates and is set by restrictedPatch
+func harden(containers []corev1.Container) []corev1.Container {
+	no, yes := false, true
+	out := make([]corev1.Container, len(containers))
+	for i, cnt := range containers {
+		sc := &corev1.SecurityContext{}
+		if cnt.SecurityContext != nil {
+			sc = cnt.SecurityContext.DeepCopy()
+		}
+
+		sc.Privileged = &no
+		sc.AllowPrivilegeEscalation = &no
+		sc.RunAsNonRoot = &yes
+		sc.ReadOnlyRootFilesystem = &yes
+		sc.Capabilities = &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+		if sc.RunAsUser == nil || *sc.RunAsUser == 0 {
+			uid := restrictedUID
+			sc.RunAsUser = &uid
+		}
+
+		cnt.SecurityContext = sc
+		cnt.VolumeMounts = append(append([]corev1.VolumeMount{}, cnt.VolumeMounts...),
+			corev1.VolumeMount{Name: restrictedTmpVolume, MountPath: restrictedTmpDir})
+		if strings.ToLower(cnt.Name) == "tyk-mesh" && !hasEnv(cnt.Env, pidFileVarName) {
+			cnt.Env = setEnv(cnt.Env, corev1.EnvVar{Name: pidFileVarName, Value: restrictedTmpDir + "/tyk-gateway.pid"})
+		}
+		out[i] = cnt
+	}
+
+	return out
+}
+
+// addRestrictedVolume adds the writable directory of the hardened containers
+func addRestrictedVolume(spec *corev1.PodSpec) *corev1.PodSpec {
+	for _, v := range spec.Volumes {
+		if v.Name == restrictedTmpVolume {
+			return spec
+		}
+	}
+
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name:         restrictedTmpVolume,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	return spec
+}
+
+// restrictedPatch sets the RuntimeDefault seccomp profile of the containers
+// added to a mutated pod spec, they are the last of each list
+func restrictedPatch(spec *corev1.PodSpec, containers, inits int) []patchOperation {
+	profile := map[string]string{"type": "RuntimeDefault"}
+	patch := make([]patchOperation, 0, containers+inits)
+	for i := len(spec.Containers) - containers; i < len(spec.Containers); i++ {
+		patch = append(patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/securityContext/seccompProfile", i), Value: profile})
+	}
+	for i := len(spec.InitContainers) - inits; i < len(spec.InitContainers); i++ {
+		patch = append(patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/initContainers/%d/securityContext/seccompProfile", i), Value: profile})
+	}
+	return patch
+}
@@ -0,0 +1,458 @@
+package injector
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const defaultCertRotationInterval = time.Hour
+
+// RotateCerts renews the server certificates of mesh routes ahead of their
+// expiry, and reissues them during a root CA rotation, until the context is
+// done. Renewed certificates are uploaded to the org of their API and swapped
+// into the API definition before the old one is removed. During a rotation
+// the workload identities and the shared mesh certificate are reissued too.
+func (whsvr *WebhookServer) RotateCerts(ctx context.Context) {
+	interval := whsvr.SidecarConfig.CertRotationInterval
+	if interval <= 0 {
+		interval = defaultCertRotationInterval
+	}
+
+	log.Infof("reconciling certificates every %v, rotating those expiring within %v", interval, whsvr.SidecarConfig.CertRotationThreshold)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		if whsvr.SidecarConfig.CertRotationThreshold > 0 {
+			whsvr.rotateExpiringCerts(ctx)
+		}
+		whsvr.reconcileCARotation(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (whsvr *WebhookServer) rotateExpiringCerts(ctx context.Context) {
+	expiring, err := whsvr.caClient(ctx).ListCertsExpiringBefore(time.Now().Add(whsvr.SidecarConfig.CertRotationThreshold))
+	if err != nil {
+		log.Errorf("failed to list expiring certificates: %v", err)
+		return
+	}
+
+	for _, cm := range expiring {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := whsvr.rotateCert(ctx, cm); err != nil {
+			log.Errorf("failed to rotate certificate of %v: %v", cm.ServiceID, err)
+		}
+	}
+}
+
+// rotateCert reissues the server certificate of an API, in the org of the API
+func (whsvr *WebhookServer) rotateCert(ctx context.Context, cm *ca.CertModel) error {
+	cl, renewed, err := whsvr.replaceServerCert(ctx, cm)
+	if err != nil {
+		return err
+	}
+
+	old := cm.Bundle.Fingerprint
+	cm.BundleHistory = append(cm.BundleHistory, *cm.Bundle)
+	cm.Bundle = renewed.Bundle
+	cm.Expires = renewed.Expires
+	cm.Serial = renewed.Serial
+	if err := whsvr.caClient(ctx).UpdateCert(cm); err != nil {
+		return fmt.Errorf("failed to update certificate in controller store: %v", err)
+	}
+
+	whsvr.removeReplacedCert(ctx, cl, old, cm.Bundle.Fingerprint)
+
+	log.Infof("rotated certificate of %v, expires %v", cm.ServiceID, cm.Expires)
+	return nil
+}
+
+// replaceServerCert issues and uploads a new server certificate for the API
+// of cm and swaps it into the API definition in place of the certificate of
+// cm, which is left to the caller
+func (whsvr *WebhookServer) replaceServerCert(ctx context.Context, cm *ca.CertModel) (tyk.Client, *ca.CertModel, error) {
+	cl, err := whsvr.apiClient(ctx, cm.ServiceID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	renewed, err := whsvr.generateServerCert(ctx, cl, cm.ServiceID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't generate certificate: %w", err)
+	}
+
+	certID, err := cl.CreateCertificate(ctx, renewed.Bundle.Bundled, renewed.Bundle.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to upload certificate to tyk secure store: %w", err)
+	}
+	renewed.Bundle.Fingerprint = certID
+
+	def, err := cl.GetByObjectID(ctx, cm.ServiceID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve API definition: %w", err)
+	}
+
+	old := cm.Bundle.Fingerprint
+	certs := make([]string, 0, len(def.Certificates)+1)
+	for _, id := range def.Certificates {
+		if id != old && id != certID {
+			certs = append(certs, id)
+		}
+	}
+	def.Certificates = append(certs, certID)
+
+	if err := cl.UpdateAPI(ctx, &def.APIDefinition); err != nil {
+		return nil, nil, fmt.Errorf("failed to store updated API Definition: %w", err)
+	}
+
+	return cl, renewed, nil
+}
+
+// removeReplacedCert removes a certificate replaced by id from Tyk and moves
+// its record in the state store to id
+func (whsvr *WebhookServer) removeReplacedCert(ctx context.Context, cl tyk.Client, old, id string) {
+	whsvr.replaceCert(old, id)
+	if old == id {
+		return
+	}
+
+	if err := cl.DeleteCertificate(ctx, old); err != nil {
+		log.Warningf("failed to remove replaced certificate %v: %v", old, err)
+	}
+}
+
+// reconcileCARotation reissues a batch of the server, identity and mesh
+// certificates signed by a root being rotated out and moves the rotation on
+// once none are left. Pods pick up reissued identities when they are admitted
+// again, the old ones are accepted until the old root is retired.
+func (whsvr *WebhookServer) reconcileCARotation(ctx context.Context) {
+	rot, ok := whsvr.CAClient.(ca.Rotator)
+	if !ok {
+		return
+	}
+
+	status, err := rot.RotationStatus()
+	if err != nil {
+		log.Errorf("failed to read the CA rotation status: %v", err)
+		return
+	}
+
+	r := &reissuing{batch: rot.RotationBatchSize()}
+	if status.Phase == ca.RotationReissuing {
+		if err := whsvr.reissueServerCerts(ctx, rot, r); err != nil {
+			log.Errorf("failed to list server certificates: %v", err)
+			return
+		}
+
+		if err := whsvr.reissueIdentities(ctx, rot, r); err != nil {
+			log.Errorf("failed to list workload identities: %v", err)
+			return
+		}
+
+		if err := whsvr.reissueMeshCert(ctx, rot); err != nil {
+			log.Errorf("failed to reissue the mesh certificate: %v", err)
+			r.pending++
+		}
+	}
+
+	if _, err := rot.AdvanceRotation(r.pending); err != nil {
+		log.Errorf("failed to update the CA rotation: %v", err)
+	}
+}
+
+// reissuing counts the certs a rotation still has to reissue
+type reissuing struct {
+	batch   int
+	pending int
+}
+
+// next reports whether another cert may be reissued in this reconciliation,
+// the cert is pending otherwise
+func (r *reissuing) next(ctx context.Context) bool {
+	if r.batch == 0 || ctx.Err() != nil {
+		r.pending++
+		return false
+	}
+
+	r.batch--
+	return true
+}
+
+func (whsvr *WebhookServer) reissueServerCerts(ctx context.Context, rot ca.Rotator, r *reissuing) error {
+	all, err := whsvr.caClient(ctx).ListCertsExpiringBefore(time.Now().AddDate(100, 0, 0))
+	if err != nil {
+		return err
+	}
+
+	for _, cm := range all {
+		if !rot.StaleCert(cm) || !r.next(ctx) {
+			continue
+		}
+
+		if err := whsvr.rotateCert(ctx, cm); err != nil {
+			log.Errorf("failed to reissue certificate of %v: %v", cm.ServiceID, err)
+			r.pending++
+		}
+	}
+
+	return nil
+}
+
+// reissueIdentities mints a new cert for the identities that only have
+// certs signed by the root being rotated out
+func (whsvr *WebhookServer) reissueIdentities(ctx context.Context, rot ca.Rotator, r *reissuing) error {
+	certs, err := whsvr.identities(ctx)
+	if err != nil {
+		return err
+	}
+
+	fresh := map[string]bool{}
+	stale := map[string]*ca.CertModel{}
+	for _, cm := range certs {
+		if rot.StaleCert(cm) {
+			stale[cm.Identity] = cm
+		} else {
+			fresh[cm.Identity] = true
+		}
+	}
+
+	identities := make([]string, 0, len(stale))
+	for identity := range stale {
+		if !fresh[identity] {
+			identities = append(identities, identity)
+		}
+	}
+	sort.Strings(identities)
+
+	for _, identity := range identities {
+		if !r.next(ctx) {
+			continue
+		}
+
+		if err := whsvr.reissueIdentity(ctx, stale[identity]); err != nil {
+			log.Errorf("failed to reissue workload identity %v: %v", identity, err)
+			r.pending++
+		}
+	}
+
+	return nil
+}
+
+// reissueIdentity mints a new cert for the name of a stale identity cert and
+// allows it on the inbound routes next to the stale one
+func (whsvr *WebhookServer) reissueIdentity(ctx context.Context, cm *ca.CertModel) error {
+	name, err := certName(cm)
+	if err != nil {
+		return err
+	}
+
+	ns := identityNamespace(cm.Identity)
+	cl, err := whsvr.tykClient(ns, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := whsvr.identityCert(ctx, cl, ns, cm.Identity, name); err != nil {
+		return err
+	}
+
+	certs, err := whsvr.identities(ctx)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	identities := make([]string, 0, len(certs))
+	for _, c := range certs {
+		if !seen[c.Identity] {
+			seen[c.Identity] = true
+			identities = append(identities, c.Identity)
+		}
+	}
+	whsvr.updateInboundRoutes(ctx, cl, identities, certs)
+
+	log.Infof("reissued workload identity %v", cm.Identity)
+	return nil
+}
+
+// certName returns the name a cert was issued for
+func certName(cm *ca.CertModel) (string, error) {
+	if cm.Bundle == nil {
+		return "", fmt.Errorf("certificate has no bundle")
+	}
+
+	blk, _ := pem.Decode(cm.Bundle.Certificate)
+	if blk == nil {
+		return "", fmt.Errorf("invalid certificate")
+	}
+
+	cert, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	if cert.Subject.CommonName == "" && len(cert.URIs) > 0 {
+		return cert.URIs[0].String(), nil
+	}
+
+	return cert.Subject.CommonName, nil
+}
+
+// reissueMeshCert replaces the shared mesh certificate if it was issued by
+// the CA and signed by the root being rotated out, then swaps it on the mesh
+// routes of every org. A failed swap is retried on the next reconciliation.
+func (whsvr *WebhookServer) reissueMeshCert(ctx context.Context, rot ca.Rotator) error {
+	if whsvr.retiredMeshCert == "" {
+		old := whsvr.meshCertID()
+		if old == "" {
+			return nil
+		}
+
+		// configured certs aren't in the store
+		cm, err := whsvr.caClient(ctx).GetCertByFingerprint(old)
+		if err != nil || !rot.StaleCert(cm) {
+			return nil
+		}
+
+		issuer, ok := whsvr.CAClient.(ca.MeshCertIssuer)
+		if !ok {
+			return fmt.Errorf("the CA can't issue mesh certificates")
+		}
+
+		id, err := issuer.GetOrCreateMeshCertID(whsvr.SidecarConfig.MeshHostnames.All()...)
+		if err != nil {
+			return err
+		}
+
+		// the other injectors pick it up from the rotation state
+		if err := rot.SetRotationMeshCert(id); err != nil {
+			return fmt.Errorf("failed to record the mesh certificate: %w", err)
+		}
+
+		whsvr.setMeshCertID(id)
+		whsvr.replaceCert(old, id)
+		whsvr.retiredMeshCert = old
+		log.Infof("reissued the mesh certificate %v as %v", old, id)
+	}
+
+	for _, cl := range whsvr.orgClients() {
+		if err := swapCertificate(ctx, cl, whsvr.retiredMeshCert, whsvr.meshCertID()); err != nil {
+			return err
+		}
+	}
+	whsvr.retiredMeshCert = ""
+
+	return nil
+}
+
+// swapCertificate replaces a certificate on the APIs of an org using it
+func swapCertificate(ctx context.Context, cl tyk.Client, old, id string) error {
+	apis, err := cl.FetchAPIs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := range apis {
+		def := &apis[i]
+		used := false
+		certs := make([]string, 0, len(def.Certificates))
+		for _, c := range def.Certificates {
+			if c == old {
+				used = true
+				continue
+			}
+			if c != id {
+				certs = append(certs, c)
+			}
+		}
+		if !used {
+			continue
+		}
+
+		def.Certificates = append(certs, id)
+		if err := cl.UpdateAPI(ctx, &def.APIDefinition); err != nil {
+			return fmt.Errorf("failed to update API %v: %w", tyk.ObjectID(def), err)
+		}
+	}
+
+	return nil
+}
+
+// orgClients returns the clients of every configured org
+func (whsvr *WebhookServer) orgClients() []tyk.Client {
+	if whsvr.TykClients != nil {
+		cl, err := whsvr.TykClients("", nil)
+		if err != nil {
+			log.Errorf("failed to resolve the tyk client: %v", err)
+			return nil
+		}
+		return []tyk.Client{cl}
+	}
+
+	orgs := tyk.Orgs()
+	clients := make([]tyk.Client, 0, len(orgs))
+	for _, o := range orgs {
+		clients = append(clients, o)
+	}
+
+	return clients
+}
+
+// apiClient returns the client of the org an API lives in, from its record in
+// the state store or else by looking the API up in every org
+func (whsvr *WebhookServer) apiClient(ctx context.Context, id string) (tyk.Client, error) {
+	if whsvr.State != nil {
+		if rec, err := whsvr.State.Get(store.KindAPI, id); err == nil {
+			var ann map[string]string
+			if rec.Org != "" {
+				ann = map[string]string{tyk.OrgAnnotation: rec.Org}
+			}
+			return whsvr.tykClient(rec.Owner.Namespace, ann)
+		}
+	}
+
+	for _, cl := range whsvr.orgClients() {
+		if _, err := cl.GetByObjectID(ctx, id); err == nil {
+			return cl, nil
+		}
+	}
+
+	return nil, fmt.Errorf("API %v not found in any org", id)
+}
+
+// meshCertID returns the ID of the certificate of the mesh routes, the one
+// reissued by the last CA rotation if any so every replica attaches the same
+func (whsvr *WebhookServer) meshCertID() string {
+	if rot, ok := whsvr.CAClient.(ca.Rotator); ok {
+		if id := rot.RotationMeshCert(); id != "" {
+			return id
+		}
+	}
+
+	whsvr.meshCertMu.RLock()
+	defer whsvr.meshCertMu.RUnlock()
+	return whsvr.SidecarConfig.MeshCertificateID
+}
+
+func (whsvr *WebhookServer) setMeshCertID(id string) {
+	whsvr.meshCertMu.Lock()
+	defer whsvr.meshCertMu.Unlock()
+	whsvr.SidecarConfig.MeshCertificateID = id
+}
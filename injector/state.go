@@ -0,0 +1,107 @@
+package injector
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"go.jlucktay.dev/tyk-k8s/store"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// podOwner is the owner recorded for the routes created for a pod, pods of
+// workloads are only named after admission
+func podOwner(pod *corev1.Pod, ns string) store.Owner {
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+
+	return store.Owner{Kind: "Pod", Namespace: ns, Name: name, Service: pod.Labels["app"]}
+}
+
+// recordAPI keeps track of an API created for a pod in the state store, if
+// one is configured. The store is bookkeeping, failing to write to it
+// doesn't fail the admission.
+func (whsvr *WebhookServer) recordAPI(id, slug string, pod *corev1.Pod, ns string) {
+	if whsvr.State == nil || id == "" {
+		return
+	}
+
+	r := &store.Record{
+		Kind:  store.KindAPI,
+		ID:    id,
+		Org:   pod.Annotations[tyk.OrgAnnotation],
+		Slug:  slug,
+		Owner: podOwner(pod, ns),
+	}
+
+	if err := whsvr.State.Put(r); err != nil {
+		log.Warningf("failed to record API %v of %v: %v", slug, r.Owner, err)
+	}
+}
+
+// recordCert keeps track of a certificate uploaded for an API, owned by the
+// owner of the API
+func (whsvr *WebhookServer) recordCert(id, apiID string) {
+	if whsvr.State == nil || id == "" {
+		return
+	}
+
+	r := &store.Record{Kind: store.KindCert, ID: id, APIID: apiID}
+	if api, err := whsvr.State.Get(store.KindAPI, apiID); err == nil {
+		r.Org = api.Org
+		r.Owner = api.Owner
+	}
+
+	if err := whsvr.State.Put(r); err != nil {
+		log.Warningf("failed to record certificate %v of API %v: %v", id, apiID, err)
+	}
+}
+
+// recordOwnedCert keeps track of a certificate that isn't attached to a
+// single API, e.g. identity and upstream CA certs
+func (whsvr *WebhookServer) recordOwnedCert(id, org string, owner store.Owner) {
+	if whsvr.State == nil || id == "" {
+		return
+	}
+
+	r := &store.Record{Kind: store.KindCert, ID: id, Org: org, Owner: owner}
+	if err := whsvr.State.Put(r); err != nil {
+		log.Warningf("failed to record certificate %v of %v: %v", id, owner, err)
+	}
+}
+
+// replaceCert moves the record of a replaced certificate to its successor,
+// keeping its API and owner
+func (whsvr *WebhookServer) replaceCert(old, id string) {
+	if whsvr.State == nil || id == "" || old == id {
+		return
+	}
+
+	r, err := whsvr.State.Get(store.KindCert, old)
+	if err != nil {
+		r = &store.Record{Kind: store.KindCert}
+	}
+	r.ID = id
+
+	if err := whsvr.State.Put(r); err != nil {
+		log.Warningf("failed to record certificate %v replacing %v: %v", id, old, err)
+	}
+	whsvr.forgetCert(old)
+}
+
+// forgetCert removes the record of a certificate deleted from Tyk
+func (whsvr *WebhookServer) forgetCert(id string) {
+	if whsvr.State == nil || id == "" {
+		return
+	}
+
+	if err := whsvr.State.Delete(store.KindCert, id); err != nil {
+		log.Warningf("failed to forget certificate %v: %v", id, err)
+	}
+}
+
+// RecordMeshCert records the mesh certificate in use, it is shared by the
+// mesh routes of every org
+func (whsvr *WebhookServer) RecordMeshCert() {
+	whsvr.recordOwnedCert(whsvr.meshCertID(), "", store.Owner{Kind: "Mesh"})
+}
@@ -0,0 +1,84 @@
+package injector
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"go.jlucktay.dev/tyk-k8s/ca"
+)
+
+// TrustDomainConf segments the mesh by namespace at the gateways. The inbound
+// routes of a namespace only accept the workload identities of its own
+// services and of the namespaces allowed to call it, the others are turned
+// away during the TLS handshake. The namespace CAs of the intermediate
+// backend give every namespace a trust domain of its own.
+type TrustDomainConf struct {
+	Enabled bool                `yaml:"enabled"`
+	Allow   map[string][]string `yaml:"allow"` // namespaces that may call the services of a namespace besides its own, * for all
+}
+
+// Validate checks the allowed callers are namespaces, all problems found are returned
+func (c *TrustDomainConf) Validate() []error {
+	errs := make([]error, 0)
+	for ns, callers := range c.Allow {
+		for _, msg := range validation.IsDNS1123Label(ns) {
+			errs = append(errs, fmt.Errorf("trustDomains: namespace %q: %v", ns, msg))
+		}
+
+		for _, caller := range callers {
+			if caller == "*" {
+				continue
+			}
+			for _, msg := range validation.IsDNS1123Label(caller) {
+				errs = append(errs, fmt.Errorf("trustDomains: caller %q of namespace %v: %v", caller, ns, msg))
+			}
+		}
+	}
+
+	return errs
+}
+
+// allows reports whether the services of a namespace accept calls from another
+func (c *TrustDomainConf) allows(namespace, caller string) bool {
+	if !c.Enabled || namespace == caller {
+		return true
+	}
+
+	for _, a := range c.Allow[namespace] {
+		if a == "*" || a == caller {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowedIdentities returns the sorted IDs of the identity certs the inbound
+// routes of a namespace accept
+func (c *TrustDomainConf) allowedIdentities(certs []*ca.CertModel, namespace string) []string {
+	allowed := make([]string, 0, len(certs))
+	for _, cm := range certs {
+		if c.allows(namespace, identityNamespace(cm.Identity)) {
+			allowed = append(allowed, cm.Bundle.Fingerprint)
+		}
+	}
+	sort.Strings(allowed)
+
+	return allowed
+}
+
+// identityNamespace returns the namespace of a workload identity
+func identityNamespace(identity string) string {
+	if i := strings.Index(identity, "/"); i > 0 {
+		return identity[:i]
+	}
+	return ""
+}
+
+// identityService returns the service of a workload identity
+func identityService(identity string) string {
+	return identity[strings.Index(identity, "/")+1:]
+}
@@ -0,0 +1,151 @@
+package injector
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// restartAnnotation is set on pod templates to roll their pods, the same way
+// `kubectl rollout restart` does
+const restartAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// Workload is a controller of pods running an outdated sidecar
+type Workload struct {
+	Kind      string // Deployment, StatefulSet or DaemonSet
+	Namespace string
+	Name      string
+	Versions  []string // sidecar versions its pods were injected with
+}
+
+func (w Workload) String() string {
+	return fmt.Sprintf("%s %s/%s (%s)", w.Kind, w.Namespace, w.Name, strings.Join(w.Versions, ", "))
+}
+
+// workloadOf returns the kind and name of the workload rolling a pod, pods
+// of bare ReplicaSets and Jobs can't be restarted
+func workloadOf(kc kubernetes.Interface, pod *corev1.Pod) (string, string, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "", "", nil
+	}
+
+	switch owner.Kind {
+	case "StatefulSet", "DaemonSet":
+		return owner.Kind, owner.Name, nil
+	case "ReplicaSet":
+		rs, err := kc.AppsV1().ReplicaSets(pod.Namespace).Get(owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", err
+		}
+
+		if dep := metav1.GetControllerOf(rs); dep != nil && dep.Kind == "Deployment" {
+			return dep.Kind, dep.Name, nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// OutdatedWorkloads lists the workloads with injected pods that don't run
+// the current sidecar version, pods not rolled by a workload are returned
+// on their own so they can be recreated by hand
+func OutdatedWorkloads(kc kubernetes.Interface, namespace, version string) ([]Workload, []string, error) {
+	pods, err := kc.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found := map[string]*Workload{}
+	bare := make([]string, 0)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Annotations[AdmissionWebhookAnnotationStatusKey] != "injected" {
+			continue
+		}
+
+		running := pod.Annotations[AdmissionWebhookAnnotationSidecarVersionKey]
+		if running == version {
+			continue
+		}
+		if running == "" {
+			running = "unknown"
+		}
+
+		kind, name, err := workloadOf(kc, pod)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if kind == "" {
+			bare = append(bare, pod.Namespace+"/"+pod.Name)
+			continue
+		}
+
+		key := kind + "/" + pod.Namespace + "/" + name
+		w, ok := found[key]
+		if !ok {
+			w = &Workload{Kind: kind, Namespace: pod.Namespace, Name: name}
+			found[key] = w
+		}
+
+		seen := false
+		for _, v := range w.Versions {
+			seen = seen || v == running
+		}
+		if !seen {
+			w.Versions = append(w.Versions, running)
+		}
+	}
+
+	res := make([]Workload, 0, len(found))
+	for _, w := range found {
+		res = append(res, *w)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].String() < res[j].String() })
+	sort.Strings(bare)
+
+	return res, bare, nil
+}
+
+// RestartWorkload triggers a rolling restart of a workload, its pods are
+// injected again with the current sidecar
+func RestartWorkload(kc kubernetes.Interface, w Workload) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{restartAnnotation: time.Now().UTC().Format(time.RFC3339)},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	apps := kc.AppsV1()
+	switch w.Kind {
+	case "Deployment":
+		_, err = apps.Deployments(w.Namespace).Patch(w.Name, types.StrategicMergePatchType, patch)
+	case "StatefulSet":
+		_, err = apps.StatefulSets(w.Namespace).Patch(w.Name, types.StrategicMergePatchType, patch)
+	case "DaemonSet":
+		_, err = apps.DaemonSets(w.Namespace).Patch(w.Name, types.StrategicMergePatchType, patch)
+	default:
+		return fmt.Errorf("can't restart %v", w)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to restart %v: %w", w, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package injector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// Upstream TLS verification settings for the generated mesh route
+	AdmissionWebhookAnnotationUpstreamCASecretKey   = "injector.tyk.io/upstream-ca-secret"
+	AdmissionWebhookAnnotationUpstreamSNIKey        = "injector.tyk.io/upstream-sni"
+	AdmissionWebhookAnnotationUpstreamSkipVerifyKey = "injector.tyk.io/upstream-skip-verify"
+
+	caSecretKey     = "ca.crt"
+	tlsSecretKeyAlt = "tls.crt"
+)
+
+// secretRef returns the name of a `[namespace/]name` reference. Pods can
+// only reference secrets of their own namespace, the injector can read
+// secrets the pod's owner may not be allowed to.
+func secretRef(ref, namespace string) (string, error) {
+	i := strings.Index(ref, "/")
+	if i < 0 {
+		return ref, nil
+	}
+
+	if ref[:i] != namespace {
+		return "", fmt.Errorf("%v: secret %v isn't in the namespace of the pod %v", AdmissionWebhookAnnotationUpstreamCASecretKey, ref, namespace)
+	}
+
+	return ref[i+1:], nil
+}
+
+// withSNI swaps the host of a target URL for the SNI override, keeping scheme and port
+func withSNI(target, sni string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	if p := u.Port(); p != "" {
+		u.Host = sni + ":" + p
+	} else {
+		u.Host = sni
+	}
+
+	return u.String(), nil
+}
+
+// upstreamTLSOptions translates the upstream TLS annotations of a pod into
+// processor annotations for the mesh route and, if an SNI override is set,
+// the target to use. The SNI name replaces the target host so it is both
+// dialled and verified against, it must therefore resolve to the service.
+// A referenced CA is uploaded to the Tyk certificate store and pinned for the
+// upstream host, so the CA must be part of the chain served by the upstream.
+func (whsvr *WebhookServer) upstreamTLSOptions(ctx context.Context, cl tyk.Client, pod *corev1.Pod, namespace, target string) (map[string]string, string, error) {
+	ann := map[string]string{}
+	if !strings.HasPrefix(target, "https://") {
+		return ann, target, nil
+	}
+
+	if sni, ok := pod.Annotations[AdmissionWebhookAnnotationUpstreamSNIKey]; ok && sni != "" {
+		var err error
+		target, err = withSNI(target, sni)
+		if err != nil {
+			return nil, target, err
+		}
+	}
+
+	switch strings.ToLower(pod.Annotations[AdmissionWebhookAnnotationUpstreamSkipVerifyKey]) {
+	case "y", "yes", "true", "on":
+		log.Warningf("upstream TLS verification disabled for %s, do not use this in production", target)
+		ann[string(processor.ValueSetBoolKey)+"proxy.transport.ssl_insecure_skip_verify"] = "true"
+	}
+
+	ref, ok := pod.Annotations[AdmissionWebhookAnnotationUpstreamCASecretKey]
+	if !ok || ref == "" {
+		return ann, target, nil
+	}
+
+	if whsvr.KubeClient == nil {
+		return nil, target, fmt.Errorf("can't load upstream CA secret %v without a kubernetes client", ref)
+	}
+
+	name, err := secretRef(ref, namespace)
+	if err != nil {
+		return nil, target, err
+	}
+
+	sec, err := whsvr.KubeClient.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, target, fmt.Errorf("failed to load upstream CA secret %v: %v", ref, err)
+	}
+
+	caPem, ok := sec.Data[caSecretKey]
+	if !ok {
+		caPem, ok = sec.Data[tlsSecretKeyAlt]
+	}
+	if !ok {
+		return nil, target, fmt.Errorf("upstream CA secret %v has no %v entry", ref, caSecretKey)
+	}
+
+	certID, err := cl.CreateCertificate(ctx, caPem, nil)
+	if err != nil {
+		return nil, target, fmt.Errorf("failed to upload upstream CA: %w", err)
+	}
+	whsvr.recordOwnedCert(certID, pod.Annotations[tyk.OrgAnnotation], podOwner(pod, namespace))
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, target, err
+	}
+
+	pinned, err := json.Marshal(map[string]string{u.Hostname(): certID})
+	if err != nil {
+		return nil, target, err
+	}
+
+	ann[string(processor.ObjectSetKey)+"pinned_public_keys"] = string(pinned)
+	return ann, target, nil
+}
@@ -0,0 +1,94 @@
+package injector
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+// Variables of the containers and initContainers config, substituted in the
+// env, command and args of the containers added to each pod
+const (
+	VarPodNamespace   = "{POD_NAMESPACE}"
+	VarServiceName    = "{SERVICE_NAME}"     // app label of the pod
+	VarInboundAPIID   = "{INBOUND_API_ID}"   // empty unless routes are created
+	VarMeshAPIID      = "{MESH_API_ID}"      // empty unless routes are created
+	VarMeshTags       = "{MESH_TAGS}"        // gateway tags the sidecar loads its routes by
+	VarOrgID          = "{ORG_ID}"           // Tyk org the routes of the pod are created in
+	VarIdentityCertID = "{IDENTITY_CERT_ID}" // empty without a workload identity
+)
+
+// serviceName returns the app label of a pod, or a placeholder telling to set it
+func serviceName(pod *corev1.Pod) string {
+	if sName, ok := pod.Labels["app"]; ok {
+		return sName
+	}
+	return pod.GenerateName + "please-set-app-label"
+}
+
+// meshTags returns the gateway tags of the sidecar of a pod, it loads the mesh
+// routes of its segment and its own inbound routes
+func meshTags(pod *corev1.Pod) string {
+	tags := strings.Join(append(tyk.Segments(tyk.SegmentMesh, pod.Namespace, pod.Annotations), serviceName(pod)), ",")
+	if replica := replicaName(pod); replica != "" {
+		// loads the inbound route of this replica only
+		tags += "," + replica
+	}
+	return tags
+}
+
+// podVars returns the replacer of the template variables of a pod
+func podVars(pod *corev1.Pod) *strings.Replacer {
+	orgID := ""
+	if o, err := tyk.OrgFor(pod.Namespace, pod.Annotations); err == nil && o != nil {
+		orgID = o.OrgID()
+	}
+
+	return strings.NewReplacer(
+		VarPodNamespace, pod.Namespace,
+		VarServiceName, serviceName(pod),
+		VarInboundAPIID, pod.Annotations[AdmissionWebhookAnnotationInboundServiceIDKey],
+		VarMeshAPIID, pod.Annotations[AdmissionWebhookAnnotationMeshServiceIDKey],
+		VarMeshTags, meshTags(pod),
+		VarOrgID, orgID,
+		VarIdentityCertID, pod.Annotations[AdmissionWebhookAnnotationIdentityCertIDKey],
+	)
+}
+
+// substituteVars returns copies of the containers with the variables replaced,
+// the slices that are changed are copied since the config is shared
+func substituteVars(containers []corev1.Container, vars *strings.Replacer) []corev1.Container {
+	out := make([]corev1.Container, len(containers))
+	for i, cnt := range containers {
+		if len(cnt.Env) > 0 {
+			env := make([]corev1.EnvVar, len(cnt.Env))
+			for j, v := range cnt.Env {
+				if v.ValueFrom == nil {
+					v.Value = vars.Replace(v.Value)
+				}
+				env[j] = v
+			}
+			cnt.Env = env
+		}
+
+		cnt.Command = replaceAll(cnt.Command, vars)
+		cnt.Args = replaceAll(cnt.Args, vars)
+		out[i] = cnt
+	}
+
+	return out
+}
+
+func replaceAll(in []string, vars *strings.Replacer) []string {
+	if in == nil {
+		return nil
+	}
+
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = vars.Replace(s)
+	}
+	return out
+}
@@ -0,0 +1,139 @@
+package injector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// admissionWarnings collects the warnings of an admission request, they are
+// returned with the response and shown by kubectl
+type admissionWarnings struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+type warningsKey struct{}
+
+func withWarnings(ctx context.Context) (context.Context, *admissionWarnings) {
+	w := &admissionWarnings{}
+	return context.WithValue(ctx, warningsKey{}, w), w
+}
+
+// warn records a soft misconfiguration of the object being admitted, the
+// object is still admitted
+func warn(ctx context.Context, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Warning(msg)
+
+	w, ok := ctx.Value(warningsKey{}).(*admissionWarnings)
+	if !ok {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, m := range w.msgs {
+		if m == msg {
+			return
+		}
+	}
+	w.msgs = append(w.msgs, msg)
+}
+
+func (w *admissionWarnings) list() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string{}, w.msgs...)
+}
+
+// warningReview is an AdmissionReview whose response carries warnings, which
+// the admission API of the client library predates. API servers older than
+// 1.19 ignore them.
+type warningReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *v1beta1.AdmissionRequest `json:"request,omitempty"`
+	Response        *warningResponse          `json:"response,omitempty"`
+}
+
+type warningResponse struct {
+	*v1beta1.AdmissionResponse
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// marshalReview encodes an admission review with the warnings added to its response
+func marshalReview(ar *v1beta1.AdmissionReview, warnings []string) ([]byte, error) {
+	if ar.Response == nil || len(warnings) == 0 {
+		return json.Marshal(ar)
+	}
+
+	return json.Marshal(&warningReview{
+		TypeMeta: ar.TypeMeta,
+		Request:  ar.Request,
+		Response: &warningResponse{AdmissionResponse: ar.Response, Warnings: warnings},
+	})
+}
+
+// warnPod warns about the settings of a pod that are ignored or clash with
+// the sidecar
+func (whsvr *WebhookServer) warnPod(ctx context.Context, pod *corev1.Pod) {
+	used := sidecarPorts(whsvr.SidecarConfig.Containers)
+	for _, cnt := range pod.Spec.Containers {
+		for _, p := range cnt.Ports {
+			if sidecar, ok := used[p.ContainerPort]; ok {
+				warn(ctx, "port %v of container %v is also used by the injected %v container", p.ContainerPort, cnt.Name, sidecar)
+			}
+		}
+	}
+
+	// pods without it are rejected when routes are created
+	if _, ok := pod.Labels["app"]; !ok && !whsvr.SidecarConfig.CreateRoutes {
+		warn(ctx, "pod has no app label, its sidecar loads the inbound routes tagged %q", pod.GenerateName+"please-set-app-label")
+	}
+
+	if !whsvr.SidecarConfig.EnableMeshTLS {
+		for _, k := range []string{AdmissionWebhookAnnotationCAMountPathKey, AdmissionWebhookAnnotationCAMergeKey} {
+			if _, ok := pod.Annotations[k]; ok {
+				warn(ctx, "%v is ignored, mesh TLS is disabled", k)
+			}
+		}
+	}
+
+	if _, ok := pod.Annotations[AdmissionWebhookAnnotationMTLSExemptKey]; ok && !whsvr.SidecarConfig.WorkloadIdentity {
+		warn(ctx, "%v is ignored, workload identities are disabled", AdmissionWebhookAnnotationMTLSExemptKey)
+	}
+
+	if _, ok := pod.Annotations[AdmissionWebhookAnnotationCBThresholdKey]; !ok {
+		for _, k := range []string{AdmissionWebhookAnnotationCBSamplesKey, AdmissionWebhookAnnotationCBReturnAfterKey} {
+			if _, ok := pod.Annotations[k]; ok {
+				warn(ctx, "%v is ignored without %v", k, AdmissionWebhookAnnotationCBThresholdKey)
+			}
+		}
+	}
+}
+
+// warnService warns about the ports of a service that clash with the
+// sidecar ports added to it, routed are the ports the pods have routes for
+func warnService(ctx context.Context, svc *corev1.Service, routed map[string]bool) {
+	if len(svc.Spec.Ports) == 1 {
+		if p := svc.Spec.Ports[0]; p.Port == sidecarServicePort && p.TargetPort.IntValue() != int(sidecarServicePort) {
+			warn(ctx, "port %v of service %v is also used by the sidecar port, callers of the mesh reach target port %v", p.Port, svc.Name, p.TargetPort.String())
+		}
+		return
+	}
+
+	targets := map[int32]string{}
+	for _, p := range servicePorts(svc, routed)[:len(svc.Spec.Ports)] {
+		targets[int32(p.TargetPort.IntValue())] = p.Name
+	}
+	for _, p := range svc.Spec.Ports {
+		if name, ok := targets[p.Port]; ok && name != p.Name {
+			warn(ctx, "port %v of service %v is also used by the sidecar port of %v", p.Port, svc.Name, name)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package injector
+
+import (
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DeregisterWebhook removes the mutating webhook configuration so the API
+// server stops sending admission requests, a missing configuration is not an error
+func DeregisterWebhook(client kubernetes.Interface, name string) error {
+	err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	log.Infof("removed mutating webhook configuration %v", name)
+	return nil
+}
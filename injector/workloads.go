@@ -0,0 +1,174 @@
+package injector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// workloadTemplates locates the pod template of the workload kinds outside
+// the core API whose injection annotations are handed down to their pods, by
+// group/kind. Their pods are injected by the pod webhook as usual.
+var workloadTemplates = map[string][]string{
+	"argoproj.io/Rollout":         {"spec", "template"},
+	"serving.knative.dev/Service": {"spec", "template"},
+}
+
+// injectorWritten are the annotations the injector sets on the objects it
+// mutates, they're never copied onto pod templates
+var injectorWritten = map[string]bool{
+	AdmissionWebhookAnnotationStatusKey:           true,
+	AdmissionWebhookAnnotationInboundServiceIDKey: true,
+	AdmissionWebhookAnnotationMeshServiceIDKey:    true,
+	AdmissionWebhookAnnotationIdentityCertIDKey:   true,
+
+	AdmissionWebhookAnnotationReplicaInboundServiceIDKey: true,
+	AdmissionWebhookAnnotationReplicaMeshServiceIDKey:    true,
+
+	AdmissionWebhookAnnotationPortInboundServiceIDsKey: true,
+	AdmissionWebhookAnnotationPortMeshServiceIDsKey:    true,
+}
+
+// isTykAnnotation reports whether an annotation configures the injector or
+// the APIs of a workload, i.e. its prefix is in the tyk.io domain
+func isTykAnnotation(key string) bool {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return false
+	}
+
+	prefix := key[:i]
+	return prefix == "tyk.io" || strings.HasSuffix(prefix, ".tyk.io")
+}
+
+// templateAnnotations returns the Tyk annotations of a workload that are
+// missing from its pod template, annotations set on the template win
+func templateAnnotations(workload, template map[string]string) map[string]string {
+	added := map[string]string{}
+	for k, v := range workload {
+		if !isTykAnnotation(k) || injectorWritten[k] {
+			continue
+		}
+
+		if _, ok := template[k]; ok {
+			continue
+		}
+
+		added[k] = v
+	}
+
+	return added
+}
+
+// escapePatchKey escapes a map key for use in a JSON patch path
+func escapePatchKey(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// processWorkloadMutations opts the pods of an Argo Rollout or Knative Service
+// into the mesh: the Tyk annotations of a workload annotated for injection
+// are copied onto its pod template, on every create and update since a new
+// template replaces the old one.
+func (whsvr *WebhookServer) processWorkloadMutations(ctx context.Context, ar *v1beta1.AdmissionReview, path []string) *v1beta1.AdmissionResponse {
+	req := ar.Request
+
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(req.Object.Raw, &obj); err != nil {
+		log.Errorf("Could not unmarshal raw object: %v", err)
+		return badRequest(err)
+	}
+
+	workload := struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(req.Object.Raw, &workload); err != nil {
+		log.Errorf("Could not unmarshal raw object: %v", err)
+		return badRequest(err)
+	}
+
+	meta := workload.Metadata
+	if meta.Namespace == "" {
+		meta.Namespace = req.Namespace
+	}
+
+	log.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
+		req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
+
+	if !mutationRequired(ignoredNamespaces, &meta) {
+		log.Infof("Skipping mutation for %s %s/%s due to policy check", req.Kind.Kind, meta.Namespace, meta.Name)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	tpl := obj
+	for _, key := range path {
+		next, ok := tpl[key].(map[string]interface{})
+		if !ok {
+			// e.g. rollouts referencing a Deployment, its pods are annotated by its own template
+			warn(ctx, "%s %s/%s has no pod template at %v, annotate the template of the workload it references instead", req.Kind.Kind, meta.Namespace, meta.Name, strings.Join(path, "."))
+			return &v1beta1.AdmissionResponse{
+				Allowed: true,
+			}
+		}
+		tpl = next
+	}
+
+	tplMeta, hasMeta := tpl["metadata"].(map[string]interface{})
+	tplAnn := map[string]string{}
+	rawAnn, hasAnn := tplMeta["annotations"].(map[string]interface{})
+	for k, v := range rawAnn {
+		tplAnn[k] = fmt.Sprint(v)
+	}
+
+	added := templateAnnotations(meta.Annotations, tplAnn)
+	if len(added) == 0 {
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	base := "/" + strings.Join(path, "/")
+	var patch []patchOperation
+	switch {
+	case !hasMeta:
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  base + "/metadata",
+			Value: map[string]interface{}{"annotations": added},
+		})
+	case !hasAnn:
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  base + "/metadata/annotations",
+			Value: added,
+		})
+	default:
+		for k, v := range added {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  base + "/metadata/annotations/" + escapePatchKey(k),
+				Value: v,
+			})
+		}
+	}
+
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return failed(err)
+	}
+
+	log.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+	return &v1beta1.AdmissionResponse{
+		Allowed: true,
+		Patch:   patchBytes,
+		PatchType: func() *v1beta1.PatchType {
+			pt := v1beta1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
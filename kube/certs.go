@@ -0,0 +1,107 @@
+package kube
+
+import (
+	"crypto/tls"
+	"fmt"
+	"reflect"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// SecretKeyPair serves a TLS key pair from a kubernetes.io/tls Secret, such as
+// the ones issued by cert-manager, and swaps it whenever the Secret is updated
+type SecretKeyPair struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewSecretKeyPair creates a key pair for a `namespace/name` Secret reference
+func NewSecretKeyPair(client kubernetes.Interface, ref string) (*SecretKeyPair, error) {
+	namespace, name, err := splitRef(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate secret: %v", err)
+	}
+
+	return &SecretKeyPair{client: client, namespace: namespace, name: name}, nil
+}
+
+// Start watches the Secret until stop is closed, it fails if no valid key pair
+// could be loaded on the first sync
+func (s *SecretKeyPair) Start(stop <-chan struct{}) error {
+	secrets := s.client.CoreV1().Secrets(s.namespace)
+	lw := byName(s.name,
+		func(opts metav1.ListOptions) (runtime.Object, error) { return secrets.List(opts) },
+		func(opts metav1.ListOptions) (watch.Interface, error) { return secrets.Watch(opts) })
+
+	err := watchNamed(lw, &corev1.Secret{}, cache.ResourceEventHandlerFuncs{
+		AddFunc: s.update,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if !reflect.DeepEqual(oldObj.(*corev1.Secret).Data, newObj.(*corev1.Secret).Data) {
+				s.update(newObj)
+			}
+		},
+		DeleteFunc: func(interface{}) {
+			log.Warningf("certificate secret %s/%s deleted, keeping the last loaded key pair", s.namespace, s.name)
+		},
+	}, stop)
+	if err != nil {
+		return fmt.Errorf("certificate secret %s/%s: %v", s.namespace, s.name, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return fmt.Errorf("no valid key pair found in secret %s/%s", s.namespace, s.name)
+	}
+
+	return nil
+}
+
+func (s *SecretKeyPair) update(obj interface{}) {
+	sec, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+
+	if err := s.Load(sec.Data); err != nil {
+		log.Errorf("failed to load key pair from %s/%s, keeping the previous one: %v", s.namespace, s.name, err)
+		return
+	}
+
+	log.Infof("loaded serving key pair from %s/%s", s.namespace, s.name)
+}
+
+// Load parses the tls.crt and tls.key entries, replacing the key pair only if they are valid
+func (s *SecretKeyPair) Load(data map[string][]byte) error {
+	cert, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.mu.Unlock()
+	return nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (s *SecretKeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.cert == nil {
+		return nil, fmt.Errorf("no key pair loaded from %s/%s", s.namespace, s.name)
+	}
+
+	return s.cert, nil
+}
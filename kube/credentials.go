@@ -0,0 +1,85 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const secretValueDefaultKey = "secret"
+
+// SecretValue watches one entry of a Secret, such as a dashboard key, and
+// reports each change of its value, a deleted Secret or entry reports an
+// empty value
+type SecretValue struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	key       string
+	onChange  func(string)
+}
+
+// NewSecretValue creates a watcher for a `namespace/name` Secret reference,
+// use `namespace/name/key` to pick a data key other than secret
+func NewSecretValue(client kubernetes.Interface, ref string, onChange func(string)) (*SecretValue, error) {
+	key := secretValueDefaultKey
+	if parts := strings.SplitN(ref, "/", 3); len(parts) == 3 {
+		ref, key = parts[0]+"/"+parts[1], parts[2]
+	}
+
+	namespace, name, err := splitRef(ref)
+	if err != nil || key == "" {
+		return nil, fmt.Errorf("invalid secret reference %q, expected namespace/name[/key]", ref)
+	}
+
+	return &SecretValue{client: client, namespace: namespace, name: name, key: key, onChange: onChange}, nil
+}
+
+// Start watches the Secret until stop is closed, a missing Secret is not an
+// error, its value is reported once the Secret is created
+func (s *SecretValue) Start(stop <-chan struct{}) error {
+	secrets := s.client.CoreV1().Secrets(s.namespace)
+	lw := byName(s.name,
+		func(opts metav1.ListOptions) (runtime.Object, error) { return secrets.List(opts) },
+		func(opts metav1.ListOptions) (watch.Interface, error) { return secrets.Watch(opts) })
+
+	err := watchNamed(lw, &corev1.Secret{}, cache.ResourceEventHandlerFuncs{
+		AddFunc: s.update,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if string(oldObj.(*corev1.Secret).Data[s.key]) != string(newObj.(*corev1.Secret).Data[s.key]) {
+				s.update(newObj)
+			}
+		},
+		DeleteFunc: func(interface{}) {
+			log.Warningf("secret %s/%s deleted", s.namespace, s.name)
+			s.onChange("")
+		},
+	}, stop)
+	if err != nil {
+		return fmt.Errorf("secret %s/%s: %v", s.namespace, s.name, err)
+	}
+
+	return nil
+}
+
+func (s *SecretValue) update(obj interface{}) {
+	sec, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+
+	v := strings.TrimSpace(string(sec.Data[s.key]))
+	if v == "" {
+		log.Warningf("secret %s/%s has no %v entry", s.namespace, s.name, s.key)
+	} else {
+		log.Infof("loaded %v from secret %s/%s", s.key, s.namespace, s.name)
+	}
+
+	s.onChange(v)
+}
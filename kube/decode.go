@@ -0,0 +1,42 @@
+package kube
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+var jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// DecodeHook lets viper decode the Kubernetes types of the config that
+// implement their own JSON decoding, e.g. the int or string ports of
+// NetworkPolicies, mapstructure can't decode them field by field
+func DecodeHook(dc *mapstructure.DecoderConfig) {
+	dc.DecodeHook = mapstructure.ComposeDecodeHookFunc(
+		// the defaults of viper
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		jsonHook,
+	)
+}
+
+// jsonHook decodes values into types implementing json.Unmarshaler through
+// JSON, other values are left to mapstructure
+func jsonHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to.Kind() == reflect.Ptr || from == to || !reflect.PtrTo(to).Implements(jsonUnmarshaler) {
+		return data, nil
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return data, nil
+	}
+
+	out := reflect.New(to)
+	if err := json.Unmarshal(raw, out.Interface()); err != nil {
+		return nil, err
+	}
+
+	return out.Elem().Interface(), nil
+}
@@ -0,0 +1,61 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// GraphQLSchemaConfigMapAnnotation references a ConfigMap in the same
+	// namespace holding the schema of a GraphQL API, SDL or an introspection
+	// result, use `<name>` or `<name>/<key>` to pick a data key other than
+	// schema.graphql. The upstream is introspected if unset.
+	GraphQLSchemaConfigMapAnnotation = "api.tyk.io/graphql-schema-configmap"
+
+	graphQLSchemaDefaultKey = "schema.graphql"
+)
+
+// ResolveGraphQLSchema returns a copy of the annotations with the GraphQL
+// schema referenced by them set in the config data of the API
+func ResolveGraphQLSchema(client kubernetes.Interface, namespace string, ann map[string]string) (map[string]string, error) {
+	ref, ok := ann[GraphQLSchemaConfigMapAnnotation]
+	if !ok || ref == "" {
+		return ann, nil
+	}
+
+	if ann[tyk.APITypeAnnotation] != tyk.APITypeGraphQL {
+		return nil, fmt.Errorf("%v requires %v: %v", GraphQLSchemaConfigMapAnnotation, tyk.APITypeAnnotation, tyk.APITypeGraphQL)
+	}
+
+	if client == nil {
+		return nil, fmt.Errorf("can't load GraphQL schema %v without a kubernetes client", ref)
+	}
+
+	name, key := ref, graphQLSchemaDefaultKey
+	if i := strings.Index(ref, "/"); i > -1 {
+		name, key = ref[:i], ref[i+1:]
+	}
+
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load GraphQL schema config map %v: %v", ref, err)
+	}
+
+	schema, ok := cm.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("GraphQL schema config map %v has no %v entry", name, key)
+	}
+
+	out := make(map[string]string, len(ann)+1)
+	for k, v := range ann {
+		out[k] = v
+	}
+	out[tyk.GraphQLSchemaKey] = schema
+
+	return out, nil
+}
@@ -0,0 +1,52 @@
+package kube
+
+import (
+	"os"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// KubeConfEnv points to a kubeconfig file for out-of-cluster access
+const KubeConfEnv = "TYK_K8S_KUBECONF"
+
+var (
+	client   *kubernetes.Clientset
+	clientMu sync.Mutex
+)
+
+// RestConfig returns the kubeconfig set in TYK_K8S_KUBECONF if present,
+// otherwise the in-cluster service account config
+func RestConfig() (*rest.Config, error) {
+	cfgF := os.Getenv(KubeConfEnv)
+	if cfgF != "" {
+		return clientcmd.BuildConfigFromFlags("", cfgF)
+	}
+
+	return rest.InClusterConfig()
+}
+
+// Client returns a shared kubernetes client
+func Client() (*kubernetes.Clientset, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if client != nil {
+		return client, nil
+	}
+
+	config, err := RestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client = cl
+	return client, nil
+}
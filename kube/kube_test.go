@@ -0,0 +1,435 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+func TestResolveOverrides(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "overrides", Namespace: "bar"},
+		Data: map[string]string{
+			"overrides.json": `{"use_keyless":false}`,
+			"other.json":     `{"active":false}`,
+		},
+	})
+
+	ann := map[string]string{"string.service.tyk.io/name": "foo"}
+	out, err := ResolveOverrides(nil, "bar", ann)
+	if err != nil || len(out) != 1 {
+		t.Fatal("annotations without a reference should be returned as is")
+	}
+
+	ann[OverridesConfigMapAnnotation] = "overrides"
+	out, err = ResolveOverrides(client, "bar", ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out[string(processor.ObjectMergeKey)] != `{"use_keyless":false}` {
+		t.Fatal("override document not added: ", out)
+	}
+
+	if _, ok := ann[string(processor.ObjectMergeKey)]; ok {
+		t.Fatal("the source annotations should not be modified")
+	}
+
+	// an inline root merge is merged into the document rather than replaced by it
+	ann[string(processor.ObjectMergeKey)] = `{"active":true,"proxy":{"listen_path":"/foo"}}`
+	out, err = ResolveOverrides(client, "bar", ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out[string(processor.ObjectMergeKey)]; got != `{"use_keyless":false,"active":true,"proxy":{"listen_path":"/foo"}}` {
+		t.Fatal("expected the inline root merge to be kept: ", got)
+	}
+	delete(ann, string(processor.ObjectMergeKey))
+
+	ann[OverridesConfigMapAnnotation] = "overrides/other.json"
+	out, err = ResolveOverrides(client, "bar", ann)
+	if err != nil || out[string(processor.ObjectMergeKey)] != `{"active":false}` {
+		t.Fatal("expected the named key to be used: ", out, err)
+	}
+
+	for _, ref := range []string{"overrides/missing", "missing"} {
+		ann[OverridesConfigMapAnnotation] = ref
+		if _, err := ResolveOverrides(client, "bar", ann); err == nil {
+			t.Fatalf("expected %v to fail", ref)
+		}
+	}
+}
+
+func TestResolveOpenAPI(t *testing.T) {
+	spec := `{"openapi": "3.0.0", "paths": {"/pets": {"get": {}}}}`
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "pets", Namespace: "bar"},
+		Data:       map[string]string{"openapi.json": spec},
+	})
+
+	ann := map[string]string{OpenAPIConfigMapAnnotation: "pets"}
+	out, err := ResolveOverrides(client, "bar", ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if OpenAPIChecksum(out) != tyk.OpenAPIChecksum([]byte(spec)) {
+		t.Fatal("expected the config map document to be imported: ", out)
+	}
+
+	served := `{"openapi": "3.0.0", "paths": {"/pets": {"post": {}}}}`
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.URL.Path == "/private" {
+			http.Error(w, "internal secret", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(served))
+	}))
+	defer srv.Close()
+
+	ann = map[string]string{
+		OpenAPIURLAnnotation: srv.URL + "/specs/pets.json",
+		string(processor.ArraySetKey) + "version_data.versions.Default.extended_paths.white_list": "[]",
+	}
+	if _, err := ResolveOpenAPI(nil, "bar", ann); err == nil || fetches != 0 {
+		t.Fatal("URL sources should be disabled by default")
+	}
+
+	SetOpenAPIConfig(&OpenAPIConfig{AllowedURLs: []string{srv.URL + "/specs/", srv.URL + "/private"}})
+	defer SetOpenAPIConfig(&OpenAPIConfig{})
+
+	out, err = ResolveOpenAPI(nil, "bar", ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ResolveOpenAPI(nil, "bar", ann); err != nil || fetches != 1 {
+		t.Fatalf("expected the document to be cached, fetched %v times: %v", fetches, err)
+	}
+
+	_, err = ResolveOpenAPI(nil, "bar", map[string]string{OpenAPIURLAnnotation: srv.URL + "/private"})
+	if err == nil || strings.Contains(err.Error(), "secret") || strings.Contains(err.Error(), "403") {
+		t.Fatal("upstream errors shouldn't be returned: ", err)
+	}
+
+	if _, err := ResolveLocalOverrides(client, "bar", ann); err == nil {
+		t.Fatal("URL sources should be refused during admission")
+	}
+
+	if OpenAPIChecksum(out) != tyk.OpenAPIChecksum([]byte(served)) {
+		t.Fatal("expected the served document to be imported: ", out)
+	}
+
+	if out[string(processor.ArraySetKey)+"version_data.versions.Default.extended_paths.white_list"] != "[]" {
+		t.Fatal("inline annotations should take precedence over imported ones")
+	}
+
+	for _, bad := range []map[string]string{
+		{OpenAPIConfigMapAnnotation: "missing"},
+		{OpenAPIConfigMapAnnotation: "pets/other.json"},
+		{OpenAPIURLAnnotation: "ftp://example.com/spec"},
+		{OpenAPIURLAnnotation: srv.URL + "/specs/pets.json", OpenAPIConfigMapAnnotation: "pets"},
+		{OpenAPIURLAnnotation: srv.URL + "/specsx/pets.json"},
+		{OpenAPIURLAnnotation: "http://169.254.169.254/latest/meta-data"},
+	} {
+		if _, err := ResolveOpenAPI(client, "bar", bad); err == nil {
+			t.Fatalf("expected %v to fail", bad)
+		}
+	}
+}
+
+func TestResolveGraphQLSchema(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "books", Namespace: "bar"},
+		Data:       map[string]string{"schema.graphql": "type Query { books: [String] }"},
+	})
+
+	ann := map[string]string{tyk.APITypeAnnotation: tyk.APITypeGraphQL, GraphQLSchemaConfigMapAnnotation: "books"}
+	out, err := ResolveOverrides(client, "bar", ann)
+	if err != nil || out[tyk.GraphQLSchemaKey] != "type Query { books: [String] }" {
+		t.Fatal("expected the schema to be set: ", out, err)
+	}
+
+	for _, bad := range []map[string]string{
+		{GraphQLSchemaConfigMapAnnotation: "books"},
+		{tyk.APITypeAnnotation: tyk.APITypeGraphQL, GraphQLSchemaConfigMapAnnotation: "books/missing"},
+	} {
+		if _, err := ResolveGraphQLSchema(client, "bar", bad); err == nil {
+			t.Fatalf("expected %v to fail", bad)
+		}
+	}
+}
+
+func TestConfigMapTemplateStore(t *testing.T) {
+	if _, err := NewConfigMapTemplateStore(nil, "no-namespace"); err == nil {
+		t.Fatal("references without a namespace should be rejected")
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "templates", Namespace: "tyk"},
+		Data: map[string]string{
+			"plain":      `{"name":"{{.Name}}"}`,
+			"named.json": `{{ define "custom" }}{"name":"custom-{{.Name}}"}{{ end }}`,
+		},
+	}
+	client := fake.NewSimpleClientset(cm)
+
+	s, err := NewConfigMapTemplateStore(client, "tyk/templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := s.Start(stop); err != nil {
+		t.Fatal(err)
+	}
+
+	render := func(name string) string {
+		tpl, err := s.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tpl.Execute(&b, map[string]string{"Name": "foo"}); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	if render("plain") != `{"name":"foo"}` || render("custom") != `{"name":"custom-foo"}` {
+		t.Fatal("unexpected templates loaded")
+	}
+
+	if _, err := s.Lookup("missing"); err != tyk.ErrTemplateNotFound {
+		t.Fatal("expected not found, got ", err)
+	}
+
+	// broken updates keep the previous templates
+	if err := s.Load(map[string]string{"plain": "{{ broken"}); err == nil {
+		t.Fatal("expected a parse error")
+	}
+
+	// changes are picked up from the watch
+	cm = cm.DeepCopy()
+	cm.Data["plain"] = `{"name":"v2-{{.Name}}"}`
+	if _, err := client.CoreV1().ConfigMaps("tyk").Update(cm); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50 && render("plain") != `{"name":"v2-foo"}`; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if render("plain") != `{"name":"v2-foo"}` {
+		t.Fatal("templates not reloaded")
+	}
+}
+
+func testKeyPair(t *testing.T, cn string) map[string][]byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string][]byte{
+		corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func TestSecretKeyPair(t *testing.T) {
+	sec := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "webhook-tls", Namespace: "tyk"},
+		Data:       testKeyPair(t, "v1"),
+	}
+	client := fake.NewSimpleClientset(sec)
+
+	kp, err := NewSecretKeyPair(client, "tyk/webhook-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := kp.Start(stop); err != nil {
+		t.Fatal(err)
+	}
+
+	commonName := func() string {
+		c, err := kp.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	if commonName() != "v1" {
+		t.Fatal("unexpected certificate loaded")
+	}
+
+	if err := kp.Load(map[string][]byte{corev1.TLSCertKey: []byte("garbage")}); err == nil {
+		t.Fatal("invalid key pairs should be rejected")
+	}
+
+	sec = sec.DeepCopy()
+	sec.Data = testKeyPair(t, "v2")
+	if _, err := client.CoreV1().Secrets("tyk").Update(sec); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50 && commonName() != "v2"; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if commonName() != "v2" {
+		t.Fatal("key pair not reloaded")
+	}
+
+	empty, _ := NewSecretKeyPair(fake.NewSimpleClientset(), "tyk/missing")
+	if err := empty.Start(stop); err == nil {
+		t.Fatal("starting without a valid key pair should fail")
+	}
+}
+
+func TestSecretValue(t *testing.T) {
+	sec := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "dashboard", Namespace: "tyk"},
+		Data:       map[string][]byte{"key": []byte("v1\n")},
+	}
+	client := fake.NewSimpleClientset(sec)
+
+	if _, err := NewSecretValue(client, "dashboard", nil); err == nil {
+		t.Fatal("references without a namespace should be rejected")
+	}
+
+	values := make(chan string, 10)
+	sv, err := NewSecretValue(client, "tyk/dashboard/key", func(v string) { values <- v })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := sv.Start(stop); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() string {
+		select {
+		case v := <-values:
+			return v
+		case <-time.After(time.Second):
+			t.Fatal("no value reported")
+		}
+		return ""
+	}
+
+	if v := next(); v != "v1" {
+		t.Fatalf("expected trimmed value v1, got %q", v)
+	}
+
+	sec = sec.DeepCopy()
+	sec.Data["key"] = []byte("v2")
+	if _, err := client.CoreV1().Secrets("tyk").Update(sec); err != nil {
+		t.Fatal(err)
+	}
+	if v := next(); v != "v2" {
+		t.Fatalf("expected rotated value v2, got %q", v)
+	}
+
+	if err := client.CoreV1().Secrets("tyk").Delete("dashboard", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if v := next(); v != "" {
+		t.Fatalf("a deleted secret should report an empty value, got %q", v)
+	}
+
+	missing, _ := NewSecretValue(fake.NewSimpleClientset(), "tyk/missing", func(string) {})
+	if err := missing.Start(stop); err != nil {
+		t.Fatal("a missing secret should not fail: ", err)
+	}
+}
+
+func TestRunLeaderElection(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cfg := &LeaderElectionConfig{Namespace: "tyk", RetryPeriod: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	led := make(chan struct{})
+	stopped := make(chan struct{})
+	done := make(chan error)
+
+	go func() {
+		done <- RunLeaderElection(ctx, client, cfg, func(context.Context) { close(led) }, func() { close(stopped) })
+	}()
+
+	select {
+	case <-led:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease not acquired")
+	}
+
+	lease, err := client.CoordinationV1().Leases("tyk").Get(defaultLeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != identity() {
+		t.Fatal("lease not held by this replica")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopped callback not called")
+	}
+}
@@ -0,0 +1,128 @@
+package kube
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultLeaseName     = "tyk-k8s-controller"
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// LeaderElectionConfig configures the coordination.k8s.io Lease used to elect
+// the replica running the reconcilers
+type LeaderElectionConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Namespace     string        `yaml:"namespace"` // defaults to the namespace of the controller pod
+	Name          string        `yaml:"name"`
+	LeaseDuration time.Duration `yaml:"leaseDuration"`
+	RenewDeadline time.Duration `yaml:"renewDeadline"`
+	RetryPeriod   time.Duration `yaml:"retryPeriod"`
+}
+
+func (c *LeaderElectionConfig) setDefaults() {
+	if c.Name == "" {
+		c.Name = defaultLeaseName
+	}
+
+	if c.Namespace == "" {
+		c.Namespace = PodNamespace()
+	}
+
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = defaultLeaseDuration
+	}
+
+	if c.RenewDeadline == 0 {
+		c.RenewDeadline = defaultRenewDeadline
+	}
+
+	if c.RetryPeriod == 0 {
+		c.RetryPeriod = defaultRetryPeriod
+	}
+}
+
+// PodNamespace is the namespace the controller runs in, from the downward API
+// or the service account, "default" outside a cluster
+func PodNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+
+	if ns, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+
+	return "default"
+}
+
+// identity names this replica in the lease, the pod name if set via the downward API
+func identity() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return "tyk-k8s"
+	}
+
+	return host
+}
+
+// RunLeaderElection blocks until ctx is cancelled, calling lead when this
+// replica acquires the lease and stopped when it loses or releases it
+func RunLeaderElection(ctx context.Context, client kubernetes.Interface, cfg *LeaderElectionConfig, lead func(context.Context), stopped func()) error {
+	cfg.setDefaults()
+
+	id := identity()
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: cfg.Namespace, Name: cfg.Name},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+	}
+
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            cfg.Name,
+		LeaseDuration:   cfg.LeaseDuration,
+		RenewDeadline:   cfg.RenewDeadline,
+		RetryPeriod:     cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Infof("%s acquired lease %s/%s", id, cfg.Namespace, cfg.Name)
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("%s is no longer leading %s/%s", id, cfg.Namespace, cfg.Name)
+				stopped()
+			},
+			OnNewLeader: func(leader string) {
+				if leader != id {
+					log.Infof("current leader is %s", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("%s waiting for lease %s/%s", id, cfg.Namespace, cfg.Name)
+	le.Run(ctx)
+	return nil
+}
@@ -0,0 +1,256 @@
+package kube
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+const (
+	// OpenAPIURLAnnotation is the http(s) URL of an OpenAPI document the API
+	// is imported from, only URLs allowed by the OpenAPI config are fetched
+	OpenAPIURLAnnotation = "api.tyk.io/openapi-url"
+	// OpenAPIConfigMapAnnotation references a ConfigMap in the same namespace
+	// holding the OpenAPI document instead, use `<name>` or `<name>/<key>` to
+	// pick a data key other than openapi.json
+	OpenAPIConfigMapAnnotation = "api.tyk.io/openapi-configmap"
+
+	openAPIDefaultKey = "openapi.json"
+	openAPIMaxSize    = 5 << 20
+	openAPITimeout    = 10 * time.Second
+	openAPICacheTTL   = 10 * time.Minute
+)
+
+// OpenAPIConfig limits the OpenAPI documents fetched for the
+// api.tyk.io/openapi-url annotation, URL sources are disabled if no URL is
+// allowed
+type OpenAPIConfig struct {
+	// AllowedURLs are the http(s) URL prefixes documents may be fetched
+	// from, the scheme and host must match and the path must start with the
+	// path of the prefix
+	AllowedURLs []string
+	// CacheTTL is how long a fetched document is kept before it is fetched
+	// again, 10m if unset
+	CacheTTL time.Duration
+}
+
+// Validate checks the allowed URLs are http(s) URLs
+func (c *OpenAPIConfig) Validate() []error {
+	errs := make([]error, 0)
+	for _, u := range c.AllowedURLs {
+		if _, err := parseHTTPURL(u); err != nil {
+			errs = append(errs, fmt.Errorf("openAPI.allowedURLs: %q is not an http(s) URL", u))
+		}
+	}
+
+	if c.CacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("openAPI.cacheTTL: must not be negative"))
+	}
+
+	return errs
+}
+
+// allows checks if a document may be fetched from u
+func (c *OpenAPIConfig) allows(u *url.URL) bool {
+	for _, raw := range c.AllowedURLs {
+		prefix, err := parseHTTPURL(raw)
+		if err != nil {
+			continue
+		}
+
+		if !strings.EqualFold(prefix.Scheme, u.Scheme) || !strings.EqualFold(prefix.Host, u.Host) {
+			continue
+		}
+
+		if p := strings.TrimSuffix(prefix.Path, "/"); u.Path == p || strings.HasPrefix(u.Path, p+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseHTTPURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return nil, fmt.Errorf("%q is not an http(s) URL", raw)
+	}
+
+	return u, nil
+}
+
+type cachedOpenAPI struct {
+	doc     []byte
+	fetched time.Time
+}
+
+var (
+	openAPIConf  = &OpenAPIConfig{}
+	openAPICache = map[string]cachedOpenAPI{}
+	openAPIMu    sync.Mutex
+
+	// errOpenAPIFetch is returned for every failed fetch, the details are
+	// only logged as they may reveal what the controller can reach
+	errOpenAPIFetch = errors.New("failed to fetch the OpenAPI document, see the controller logs")
+)
+
+// SetOpenAPIConfig sets the URLs OpenAPI documents may be fetched from and
+// drops the documents fetched so far
+func SetOpenAPIConfig(cfg *OpenAPIConfig) {
+	openAPIMu.Lock()
+	defer openAPIMu.Unlock()
+
+	openAPIConf = cfg
+	openAPICache = map[string]cachedOpenAPI{}
+}
+
+// HasOpenAPI checks if annotations declare an OpenAPI document
+func HasOpenAPI(ann map[string]string) bool {
+	return ann[OpenAPIURLAnnotation] != "" || ann[OpenAPIConfigMapAnnotation] != ""
+}
+
+// fetchOpenAPI loads the OpenAPI document declared in the annotations
+func fetchOpenAPI(client kubernetes.Interface, namespace string, ann map[string]string) ([]byte, error) {
+	u, ref := ann[OpenAPIURLAnnotation], ann[OpenAPIConfigMapAnnotation]
+	if u != "" && ref != "" {
+		return nil, fmt.Errorf("%v and %v are mutually exclusive", OpenAPIURLAnnotation, OpenAPIConfigMapAnnotation)
+	}
+
+	if ref != "" {
+		if client == nil {
+			return nil, fmt.Errorf("can't load OpenAPI document %v without a kubernetes client", ref)
+		}
+
+		name, key := ref, openAPIDefaultKey
+		if i := strings.Index(ref, "/"); i > -1 {
+			name, key = ref[:i], ref[i+1:]
+		}
+
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load OpenAPI config map %v: %v", ref, err)
+		}
+
+		doc, ok := cm.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("OpenAPI config map %v has no %v entry", name, key)
+		}
+
+		return []byte(doc), nil
+	}
+
+	return fetchOpenAPIURL(u)
+}
+
+// fetchOpenAPIURL fetches an OpenAPI document from an allowed URL, documents
+// are cached for the configured TTL so resyncs don't fetch them every time
+func fetchOpenAPIURL(u string) ([]byte, error) {
+	pu, err := parseHTTPURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %q is not an http(s) URL", OpenAPIURLAnnotation, u)
+	}
+
+	openAPIMu.Lock()
+	conf := openAPIConf
+	cached, ok := openAPICache[u]
+	openAPIMu.Unlock()
+
+	if !conf.allows(pu) {
+		return nil, fmt.Errorf("%v: %q is not an allowed OpenAPI URL", OpenAPIURLAnnotation, u)
+	}
+
+	ttl := conf.CacheTTL
+	if ttl == 0 {
+		ttl = openAPICacheTTL
+	}
+	if ok && time.Since(cached.fetched) < ttl {
+		return cached.doc, nil
+	}
+
+	cl := &http.Client{
+		Timeout: openAPITimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 || !conf.allows(req.URL) {
+				return fmt.Errorf("redirect to %v not allowed", req.URL)
+			}
+			return nil
+		},
+	}
+
+	resp, err := cl.Get(u)
+	if err != nil {
+		log.Errorf("failed to fetch OpenAPI document %v: %v", u, err)
+		return nil, errOpenAPIFetch
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("failed to fetch OpenAPI document %v: %v", u, resp.Status)
+		return nil, errOpenAPIFetch
+	}
+
+	doc, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, openAPIMaxSize))
+	if err != nil {
+		log.Errorf("failed to read OpenAPI document %v: %v", u, err)
+		return nil, errOpenAPIFetch
+	}
+
+	openAPIMu.Lock()
+	openAPICache[u] = cachedOpenAPI{doc: doc, fetched: time.Now()}
+	openAPIMu.Unlock()
+
+	return doc, nil
+}
+
+// ResolveOpenAPI returns a copy of the annotations with the OpenAPI document
+// they declare imported as processor annotations. Inline processor
+// annotations take precedence over imported ones.
+func ResolveOpenAPI(client kubernetes.Interface, namespace string, ann map[string]string) (map[string]string, error) {
+	if !HasOpenAPI(ann) {
+		return ann, nil
+	}
+
+	doc, err := fetchOpenAPI(client, namespace, ann)
+	if err != nil {
+		return nil, err
+	}
+
+	imported, err := tyk.OpenAPIAnnotations(doc)
+	if err != nil {
+		if u := ann[OpenAPIURLAnnotation]; u != "" {
+			log.Errorf("failed to import OpenAPI document %v: %v", u, err)
+			return nil, fmt.Errorf("failed to import the OpenAPI document %v, see the controller logs", u)
+		}
+		return nil, err
+	}
+
+	out := make(map[string]string, len(ann)+len(imported))
+	for k, v := range imported {
+		out[k] = v
+	}
+	for k, v := range ann {
+		out[k] = v
+	}
+
+	return out, nil
+}
+
+// OpenAPIChecksum returns the checksum of the imported OpenAPI document of
+// resolved annotations, empty if they declare none
+func OpenAPIChecksum(ann map[string]string) string {
+	return ann[tyk.OpenAPIChecksumKey]
+}
@@ -0,0 +1,87 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+)
+
+const (
+	// OverridesConfigMapAnnotation references a ConfigMap in the same namespace
+	// holding a full or partial API definition override document, use
+	// `<name>` or `<name>/<key>` to pick a data key other than overrides.json
+	OverridesConfigMapAnnotation = "overrides.service.tyk.io/configmap"
+
+	overridesDefaultKey = "overrides.json"
+)
+
+// ResolveOverrides returns a copy of the annotations with the referenced
+// override document added as a root object merge, inline annotations are
+// applied after the document and so take precedence over it. Declared
+// OpenAPI documents and GraphQL schemas are resolved too.
+func ResolveOverrides(client kubernetes.Interface, namespace string, ann map[string]string) (map[string]string, error) {
+	ref, ok := ann[OverridesConfigMapAnnotation]
+	if !ok || ref == "" {
+		return resolveDocuments(client, namespace, ann)
+	}
+
+	if client == nil {
+		return nil, fmt.Errorf("can't load override document %v without a kubernetes client", ref)
+	}
+
+	name, key := ref, overridesDefaultKey
+	if i := strings.Index(ref, "/"); i > -1 {
+		name, key = ref[:i], ref[i+1:]
+	}
+
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load override config map %v: %v", ref, err)
+	}
+
+	doc, ok := cm.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("override config map %v has no %v entry", name, key)
+	}
+
+	out := make(map[string]string, len(ann)+1)
+	for k, v := range ann {
+		out[k] = v
+	}
+
+	// an inline root merge is merged into the document and takes precedence
+	if inline, ok := ann[string(processor.ObjectMergeKey)]; ok {
+		doc, err = processor.Process(map[string]string{string(processor.ObjectMergeKey): inline}, doc)
+		if err != nil {
+			return nil, fmt.Errorf("override document %v: %v", ref, err)
+		}
+	}
+	out[string(processor.ObjectMergeKey)] = doc
+
+	return resolveDocuments(client, namespace, out)
+}
+
+// ResolveLocalOverrides is ResolveOverrides for the admission webhook, only
+// documents in the cluster are loaded, an OpenAPI URL is refused so a pod
+// admission never waits on a fetch
+func ResolveLocalOverrides(client kubernetes.Interface, namespace string, ann map[string]string) (map[string]string, error) {
+	if ann[OpenAPIURLAnnotation] != "" {
+		return nil, fmt.Errorf("%v isn't supported on pods, use %v", OpenAPIURLAnnotation, OpenAPIConfigMapAnnotation)
+	}
+
+	return ResolveOverrides(client, namespace, ann)
+}
+
+// resolveDocuments resolves the API documents referenced by annotations
+func resolveDocuments(client kubernetes.Interface, namespace string, ann map[string]string) (map[string]string, error) {
+	ann, err := ResolveOpenAPI(client, namespace, ann)
+	if err != nil {
+		return nil, err
+	}
+
+	return ResolveGraphQLSchema(client, namespace, ann)
+}
@@ -0,0 +1,120 @@
+package kube
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"go.jlucktay.dev/tyk-k8s/logger"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+var log = logger.GetLogger("kube")
+
+// ConfigMapTemplateStore serves API definition templates from a ConfigMap and
+// reloads them whenever it changes. Each data entry is parsed as a template
+// named after its key, entries may also define further named templates.
+type ConfigMapTemplateStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+
+	mu   sync.RWMutex
+	tpls *template.Template
+}
+
+// NewConfigMapTemplateStore creates a template store for a `namespace/name` reference
+func NewConfigMapTemplateStore(client kubernetes.Interface, ref string) (*ConfigMapTemplateStore, error) {
+	namespace, name, err := splitRef(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template config map: %v", err)
+	}
+
+	return &ConfigMapTemplateStore{client: client, namespace: namespace, name: name}, nil
+}
+
+// Start watches the ConfigMap until stop is closed and blocks until the first sync
+func (s *ConfigMapTemplateStore) Start(stop <-chan struct{}) error {
+	cms := s.client.CoreV1().ConfigMaps(s.namespace)
+	lw := byName(s.name,
+		func(opts metav1.ListOptions) (runtime.Object, error) { return cms.List(opts) },
+		func(opts metav1.ListOptions) (watch.Interface, error) { return cms.Watch(opts) })
+
+	err := watchNamed(lw, &corev1.ConfigMap{}, cache.ResourceEventHandlerFuncs{
+		AddFunc: s.update,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if !reflect.DeepEqual(oldObj.(*corev1.ConfigMap).Data, newObj.(*corev1.ConfigMap).Data) {
+				s.update(newObj)
+			}
+		},
+		DeleteFunc: func(interface{}) {
+			log.Warningf("template config map %s/%s deleted, keeping the last loaded templates", s.namespace, s.name)
+		},
+	}, stop)
+	if err != nil {
+		return fmt.Errorf("template config map %s/%s: %v", s.namespace, s.name, err)
+	}
+
+	return nil
+}
+
+func (s *ConfigMapTemplateStore) update(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	if err := s.Load(cm.Data); err != nil {
+		log.Errorf("failed to reload templates from %s/%s, keeping the previous set: %v", s.namespace, s.name, err)
+		return
+	}
+
+	log.Infof("loaded %d templates from %s/%s", len(cm.Data), s.namespace, s.name)
+}
+
+// Load parses a set of templates keyed by name, replacing the current set only if all parse
+func (s *ConfigMapTemplateStore) Load(data map[string]string) error {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tpls := template.New(s.name)
+	for _, k := range keys {
+		if _, err := tpls.New(k).Parse(data[k]); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.tpls = tpls
+	s.mu.Unlock()
+	return nil
+}
+
+// Lookup implements tyk.TemplateStore
+func (s *ConfigMapTemplateStore) Lookup(name string) (*template.Template, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.tpls == nil {
+		return nil, fmt.Errorf("no templates loaded from %s/%s", s.namespace, s.name)
+	}
+
+	tpl := s.tpls.Lookup(name)
+	if tpl == nil {
+		return nil, tyk.ErrTemplateNotFound
+	}
+
+	return tpl, nil
+}
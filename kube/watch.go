@@ -0,0 +1,53 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const namedResync = 5 * time.Minute
+
+// splitRef splits a `namespace/name` reference
+func splitRef(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected a namespace/name reference, got %q", ref)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// byName restricts a list and watch to the object with the given name
+func byName(name string, list func(metav1.ListOptions) (runtime.Object, error), w func(metav1.ListOptions) (watch.Interface, error)) *cache.ListWatch {
+	sel := fields.OneTermEqualSelector("metadata.name", name).String()
+	return &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			opts.FieldSelector = sel
+			return list(opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			opts.FieldSelector = sel
+			return w(opts)
+		},
+	}
+}
+
+// watchNamed runs an informer for a single object until stop is closed and
+// blocks until its first sync
+func watchNamed(lw *cache.ListWatch, obj runtime.Object, h cache.ResourceEventHandler, stop <-chan struct{}) error {
+	_, ctrl := cache.NewInformer(lw, obj, namedResync, h)
+
+	go ctrl.Run(stop)
+	if !cache.WaitForCacheSync(stop, ctrl.HasSynced) {
+		return fmt.Errorf("failed to sync %T", obj)
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package logger
+
+import (
+	"context"
+
+	"github.com/TykTechnologies/logrus"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by the context, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// FromContext adds the request ID carried by the context to a module logger
+func FromContext(ctx context.Context, log *logrus.Entry) *logrus.Entry {
+	if id := RequestID(ctx); id != "" {
+		return log.WithField("request_id", id)
+	}
+
+	return log
+}
@@ -1,8 +1,105 @@
 package logger
 
-import "github.com/TykTechnologies/logrus"
+import (
+	"fmt"
+	"strings"
+	"sync"
 
+	"github.com/TykTechnologies/logrus"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config selects the log format and the level of every module, modules are
+// named after the "mod" field of their log lines
+type Config struct {
+	Format string            `yaml:"format"` // text (default) or json
+	Level  string            `yaml:"level"`  // info if unset
+	Levels map[string]string `yaml:"levels"` // per-module overrides of the level
+}
+
+// Validate checks the format and levels, all problems found are returned
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+
+	switch strings.ToLower(c.Format) {
+	case "", FormatText, FormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("format: %q must be %v or %v", c.Format, FormatText, FormatJSON))
+	}
+
+	if c.Level != "" {
+		if _, err := logrus.ParseLevel(c.Level); err != nil {
+			errs = append(errs, fmt.Errorf("level: %v", err))
+		}
+	}
+
+	for mod, lvl := range c.Levels {
+		if _, err := logrus.ParseLevel(lvl); err != nil {
+			errs = append(errs, fmt.Errorf("levels.%v: %v", mod, err))
+		}
+	}
+
+	return errs
+}
+
+var (
+	mu      sync.Mutex
+	cfg     = &Config{}
+	modules = map[string]*logrus.Logger{}
+)
+
+// GetLogger returns the logger of a module, each module has its own level
+// so noisy modules can be quieted independently
 func GetLogger(modName string) *logrus.Entry {
-	log := logrus.WithField("app", "tk8s").WithField("mod", modName)
-	return log
+	mu.Lock()
+	defer mu.Unlock()
+
+	l, ok := modules[modName]
+	if !ok {
+		l = logrus.New()
+		apply(l, modName)
+		modules[modName] = l
+	}
+
+	return l.WithField("app", "tk8s").WithField("mod", modName)
+}
+
+// Configure applies the format and levels to the loggers of all modules,
+// including those created later
+func Configure(c *Config) error {
+	if errs := c.Validate(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	cfg = c
+	for mod, l := range modules {
+		apply(l, mod)
+	}
+
+	return nil
+}
+
+func apply(l *logrus.Logger, modName string) {
+	l.Formatter = &logrus.TextFormatter{}
+	if strings.ToLower(cfg.Format) == FormatJSON {
+		l.Formatter = &logrus.JSONFormatter{}
+	}
+
+	lvl := cfg.Level
+	if modLvl, ok := cfg.Levels[strings.ToLower(modName)]; ok {
+		lvl = modLvl
+	}
+
+	l.Level = logrus.InfoLevel
+	if parsed, err := logrus.ParseLevel(lvl); err == nil {
+		l.Level = parsed
+	}
 }
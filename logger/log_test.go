@@ -0,0 +1,62 @@
+package logger
+
+import (
+	"testing"
+
+	"github.com/TykTechnologies/logrus"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	if errs := (&Config{}).Validate(); len(errs) != 0 {
+		t.Fatalf("expected the defaults to be valid, got %v", errs)
+	}
+
+	c := &Config{Format: "JSON", Level: "debug", Levels: map[string]string{"ingress": "warn"}}
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Fatalf("expected a valid config, got %v", errs)
+	}
+
+	bad := &Config{Format: "xml", Level: "loud", Levels: map[string]string{"ingress": "quiet"}}
+	if errs := bad.Validate(); len(errs) != 3 {
+		t.Fatalf("expected an invalid format, level and module level, got %v", errs)
+	}
+
+	if err := Configure(bad); err == nil {
+		t.Fatal("expected an invalid config to be rejected")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	defer Configure(&Config{})
+
+	// created before the config is applied
+	early := GetLogger("test-early").Logger
+	if _, ok := early.Formatter.(*logrus.TextFormatter); !ok || early.Level != logrus.InfoLevel {
+		t.Fatalf("expected text logs at info by default, got %T at %v", early.Formatter, early.Level)
+	}
+
+	err := Configure(&Config{Format: FormatJSON, Level: "warn", Levels: map[string]string{"test-early": "debug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := early.Formatter.(*logrus.JSONFormatter); !ok {
+		t.Fatalf("expected the existing logger to switch to JSON, got %T", early.Formatter)
+	}
+	if early.Level != logrus.DebugLevel {
+		t.Fatalf("expected the module level to take precedence, got %v", early.Level)
+	}
+
+	late := GetLogger("test-late").Logger
+	if _, ok := late.Formatter.(*logrus.JSONFormatter); !ok || late.Level != logrus.WarnLevel {
+		t.Fatalf("expected a new logger to use the global settings, got %T at %v", late.Formatter, late.Level)
+	}
+
+	// the overrides are dropped with the next config
+	if err := Configure(&Config{Level: "error"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := early.Formatter.(*logrus.TextFormatter); !ok || early.Level != logrus.ErrorLevel {
+		t.Fatalf("expected the new config to be re-applied, got %T at %v", early.Formatter, early.Level)
+	}
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	_ "embed"
 	"flag"
 
 	"go.jlucktay.dev/tyk-k8s/cmd"
 )
 
+// the sample configuration doubles as the built-in configuration for
+// evaluation installs that don't mount a config file
+//
+//go:embed sample-tyk-k8s.yaml
+var defaultConfig []byte
+
 func main() {
 	flag.Parse()
+	cmd.DefaultConfig = defaultConfig
 	cmd.Execute()
 }
@@ -3,9 +3,14 @@ package processor
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 
 	"go.jlucktay.dev/tyk-k8s/logger"
@@ -19,13 +24,102 @@ const (
 	ValueSetNumKey    ValueType = "num.service.tyk.io/"
 	ObjectSetKey      ValueType = "object.service.tyk.io/"
 	ArraySetKey       ValueType = "array.service.tyk.io/"
+	DeleteKey         ValueType = "delete.service.tyk.io/"
+	ArrayAppendKey    ValueType = "array-append.service.tyk.io/"
+	ObjectMergeKey    ValueType = "object-merge.service.tyk.io/"
+	ValueSetFloatKey  ValueType = "float.service.tyk.io/"
+	DurationSetKey    ValueType = "duration.service.tyk.io/"
 )
 
 var log = logger.GetLogger("processor")
 
+// merge deep merges src into dst, values in src win unless both sides are objects
+func merge(dst, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		srcObj, srcIsObj := v.(map[string]interface{})
+		dstObj, dstIsObj := dst[k].(map[string]interface{})
+		if srcIsObj && dstIsObj {
+			dst[k] = merge(dstObj, srcObj)
+			continue
+		}
+
+		dst[k] = v
+	}
+
+	return dst
+}
+
+// mergeRoot deep merges a document into the root of a definition key by key,
+// the same way as into a nested object, other keys are left as they are
+func mergeRoot(def string, d map[string]interface{}) (string, error) {
+	if !gjson.Parse(def).IsObject() {
+		return def, errors.New("can't merge into a definition that is not an object")
+	}
+
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var err error
+	for _, k := range keys {
+		pth := escapeKey(k)
+		v := d[k]
+		if obj, ok := v.(map[string]interface{}); ok {
+			if existing := gjson.Get(def, pth); existing.IsObject() {
+				v = merge(existing.Value().(map[string]interface{}), obj)
+			}
+		}
+
+		def, err = sjson.Set(def, pth, v)
+		if err != nil {
+			return def, err
+		}
+	}
+
+	return def, nil
+}
+
+// escapeKey escapes the characters of a key that have a meaning in paths
+func escapeKey(k string) string {
+	var b strings.Builder
+	for _, r := range k {
+		switch r {
+		case '.', '*', '?', '|', '#', '@', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// jsonPath converts an annotation path to a JSON path, since annotation keys
+// are conventionally dashed a single `-` becomes `_` while `--` escapes a
+// literal dash, e.g. `x--api--version` targets the key `x-api-version`
+func jsonPath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] != '-' {
+			b.WriteByte(p[i])
+			continue
+		}
+
+		if i+1 < len(p) && p[i+1] == '-' {
+			b.WriteByte('-')
+			i++
+			continue
+		}
+
+		b.WriteByte('_')
+	}
+
+	return b.String()
+}
+
 func set(key, val, def string, t ValueType) (string, error) {
-	pth := key[len(string(t)):]
-	pth = strings.Replace(pth, "-", "_", -1)
+	pth := jsonPath(key[len(string(t)):])
 
 	switch t {
 	case ValueSetStringKey:
@@ -52,6 +146,23 @@ func set(key, val, def string, t ValueType) (string, error) {
 		}
 
 		return sjson.Set(def, pth, d)
+	case ValueSetFloatKey:
+		log.Info("setting float value: ", pth)
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return def, err
+		}
+
+		return sjson.Set(def, pth, f)
+	case DurationSetKey:
+		// durations are set in seconds, the unit used throughout the API definition
+		log.Info("setting duration value: ", pth)
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return def, err
+		}
+
+		return sjson.Set(def, pth, d.Seconds())
 	case ObjectSetKey:
 		log.Info("setting object: ", pth)
 		d := make(map[string]interface{}, 0)
@@ -70,49 +181,177 @@ func set(key, val, def string, t ValueType) (string, error) {
 		}
 
 		return sjson.Set(def, pth, d)
+	case ArrayAppendKey:
+		log.Info("appending to array: ", pth)
+		d := make([]interface{}, 0)
+		err := json.Unmarshal([]byte(val), &d)
+		if err != nil {
+			return def, err
+		}
+
+		existing := gjson.Get(def, pth)
+		if existing.Exists() {
+			if !existing.IsArray() {
+				return def, fmt.Errorf("can't append to %v, not an array", pth)
+			}
+
+			d = append(existing.Value().([]interface{}), d...)
+		}
+
+		return sjson.Set(def, pth, d)
+	case ObjectMergeKey:
+		log.Info("merging object: ", pth)
+		d := make(map[string]interface{}, 0)
+		err := json.Unmarshal([]byte(val), &d)
+		if err != nil {
+			return def, err
+		}
+
+		// an empty path merges a document into the root of the definition
+		if pth == "" {
+			return mergeRoot(def, d)
+		}
+
+		existing := gjson.Get(def, pth)
+		if existing.Exists() {
+			if !existing.IsObject() {
+				return def, fmt.Errorf("can't merge into %v, not an object", pth)
+			}
+
+			d = merge(existing.Value().(map[string]interface{}), d)
+		}
+
+		return sjson.Set(def, pth, d)
+	case DeleteKey:
+		log.Info("deleting: ", pth)
+		return sjson.Delete(def, pth)
 	default:
 		return def, errors.New("unsupported type")
 	}
 }
 
-func Process(ann map[string]string, def string) (string, error) {
-	var err error
+// valueTypes lists the annotation types in the order they are applied,
+// later types take precedence over earlier ones on overlapping paths:
+// scalar values < whole objects and arrays < merges and appends < deletions
+var valueTypes = []ValueType{
+	ValueSetStringKey, ValueSetBoolKey, ValueSetNumKey, ValueSetFloatKey, DurationSetKey,
+	ObjectSetKey, ArraySetKey,
+	ObjectMergeKey, ArrayAppendKey,
+	DeleteKey,
+}
+
+// valueType returns the annotation type of a key and its precedence rank
+func valueType(key string) (ValueType, int, bool) {
+	for i, t := range valueTypes {
+		if strings.HasPrefix(key, string(t)) {
+			return t, i, true
+		}
+	}
+
+	return "", 0, false
+}
+
+// hasIndex reports whether a path addresses an explicit array index, e.g. `tags.1`
+func hasIndex(pth string) bool {
+	for _, seg := range strings.Split(pth, ".") {
+		if _, err := strconv.Atoi(seg); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter returns the subset of annotations the processor acts on
+func Filter(ann map[string]string) map[string]string {
+	out := map[string]string{}
 	for k, v := range ann {
-		if strings.HasPrefix(k, string(ValueSetStringKey)) {
-			def, err = set(k, v, def, ValueSetStringKey)
-			if err != nil {
-				return def, err
-			}
+		if _, _, ok := valueType(k); ok {
+			out[k] = v
 		}
+	}
 
-		if strings.HasPrefix(k, string(ValueSetNumKey)) {
-			def, err = set(k, v, def, ValueSetNumKey)
-			if err != nil {
-				return def, err
-			}
+	return out
+}
+
+// orderedKeys sorts the processor annotations so they are applied in a stable
+// order: a root document merge first, paths with explicit array indexes last,
+// otherwise by type precedence, then by key
+func orderedKeys(ann map[string]string) []string {
+	keys := make([]string, 0, len(ann))
+	for k := range Filter(ann) {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		// a root document merge is the base all other annotations apply to
+		if keys[i] == string(ObjectMergeKey) || keys[j] == string(ObjectMergeKey) {
+			return keys[i] == string(ObjectMergeKey) && keys[j] != string(ObjectMergeKey)
 		}
 
-		if strings.HasPrefix(k, string(ValueSetBoolKey)) {
-			def, err = set(k, v, def, ValueSetBoolKey)
-			if err != nil {
-				return def, err
-			}
+		ti, ri, _ := valueType(keys[i])
+		tj, rj, _ := valueType(keys[j])
+		ii, ij := hasIndex(keys[i][len(ti):]), hasIndex(keys[j][len(tj):])
+		if ii != ij {
+			return ij
 		}
 
-		if strings.HasPrefix(k, string(ArraySetKey)) {
-			def, err = set(k, v, def, ArraySetKey)
-			if err != nil {
-				return def, err
-			}
+		if ri != rj {
+			return ri < rj
 		}
 
-		if strings.HasPrefix(k, string(ObjectSetKey)) {
-			def, err = set(k, v, def, ObjectSetKey)
-			if err != nil {
-				return def, err
-			}
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+// Process applies the annotation overrides to a JSON definition, see valueTypes for precedence
+func Process(ann map[string]string, def string) (string, error) {
+	var err error
+	for _, k := range orderedKeys(ann) {
+		t, _, _ := valueType(k)
+		def, err = set(k, ann[k], def, t)
+		if err != nil {
+			return def, fmt.Errorf("annotation %s: %v", k, err)
 		}
 	}
 
 	return def, nil
 }
+
+// Validator can be implemented by ProcessInto targets to check the decoded
+// definition before it is handed to the dashboard or gateway
+type Validator interface {
+	Validate() error
+}
+
+// ProcessInto applies the annotation mutations to def and decodes the result
+// into out, which must be a non-nil pointer. Type mismatches introduced by an
+// annotation (e.g. a string set on a bool field) are reported against the
+// offending field, and out is validated if it implements Validator.
+func ProcessInto(ann map[string]string, def []byte, out interface{}) error {
+	if out == nil || reflect.ValueOf(out).Kind() != reflect.Ptr || reflect.ValueOf(out).IsNil() {
+		return errors.New("output must be a non-nil pointer")
+	}
+
+	processed, err := Process(ann, string(def))
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal([]byte(processed), out)
+	if err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return fmt.Errorf("invalid value for %v: expected %v, got %v", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+
+		return err
+	}
+
+	if v, ok := out.(Validator); ok {
+		return v.Validate()
+	}
+
+	return nil
+}
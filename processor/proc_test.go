@@ -2,6 +2,8 @@ package processor
 
 import (
 	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/TykTechnologies/tyk/apidef"
@@ -105,3 +107,289 @@ func TestProc(t *testing.T) {
 		t.Fatal("object not set")
 	}
 }
+
+type validatedDef struct {
+	apidef.APIDefinition
+}
+
+func (v *validatedDef) Validate() error {
+	if v.Proxy.ListenPath == "" {
+		return errors.New("listen path is required")
+	}
+
+	return nil
+}
+
+func TestProcessInto(t *testing.T) {
+	out := &apidef.APIDefinition{}
+	err := ProcessInto(map[string]string{"string.service.tyk.io/proxy.target-url": "http://foo.bar"}, []byte(js), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Proxy.TargetURL != "http://foo.bar" {
+		t.Fatal("string not set")
+	}
+
+	err = ProcessInto(map[string]string{"string.service.tyk.io/use-keyless": "nope"}, []byte(js), out)
+	if err == nil || !strings.Contains(err.Error(), "use_keyless") {
+		t.Fatal("expected a type error naming the field, got ", err)
+	}
+
+	if err := ProcessInto(nil, []byte(js), apidef.APIDefinition{}); err == nil {
+		t.Fatal("non-pointer output should be rejected")
+	}
+
+	err = ProcessInto(map[string]string{"string.service.tyk.io/proxy.listen-path": ""}, []byte(js), &validatedDef{})
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := Filter(map[string]string{
+		"string.service.tyk.io/name": "foo",
+		"injector.tyk.io/inject":     "true",
+		"service.tyk.io/expose":      "true",
+	})
+
+	if len(f) != 1 || f["string.service.tyk.io/name"] != "foo" {
+		t.Fatal("unexpected filtered annotations: ", f)
+	}
+}
+
+func TestProcDelete(t *testing.T) {
+	def, err := Process(map[string]string{
+		"delete.service.tyk.io/definition.strip-path": "",
+		"delete.service.tyk.io/does.not.exist":        "",
+	}, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(def), &d); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := d["definition"].(map[string]interface{})["strip_path"]; ok {
+		t.Fatal("key not deleted")
+	}
+
+	if _, ok := d["definition"].(map[string]interface{})["location"]; !ok {
+		t.Fatal("sibling keys should be kept")
+	}
+}
+
+func TestProcAppendAndMerge(t *testing.T) {
+	testAnnotations := map[string]string{
+		"array-append.service.tyk.io/tags":                                        `["mesh", "v2"]`,
+		"array-append.service.tyk.io/version_data.versions.Default.paths.ignored": `["/health"]`,
+		"array-append.service.tyk.io/allowed-ips-new":                             `["10.0.0.1"]`,
+		"object-merge.service.tyk.io/custom_middleware.id_extractor":              `{"extract_from":"header","extractor_config":{"header_name":"x-id"}}`,
+		"object-merge.service.tyk.io/cache_options":                               `{"cache_timeout":5}`,
+	}
+
+	def, err := Process(testAnnotations, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asDefObj := &apidef.APIDefinition{}
+	if err := json.Unmarshal([]byte(def), asDefObj); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(asDefObj.Tags) != 3 || asDefObj.Tags[0] != "ingress" || asDefObj.Tags[2] != "v2" {
+		t.Fatal("tags not appended: ", asDefObj.Tags)
+	}
+
+	if ign := asDefObj.VersionData.Versions["Default"].Paths.Ignored; len(ign) != 1 || ign[0] != "/health" {
+		t.Fatal("nested array not appended: ", ign)
+	}
+
+	if !strings.Contains(def, `"allowed_ips_new":["10.0.0.1"]`) {
+		t.Fatal("missing arrays should be created")
+	}
+
+	ide := asDefObj.CustomMiddleware.IdExtractor
+	if ide.ExtractFrom != "header" || ide.ExtractorConfig["header_name"] != "x-id" {
+		t.Fatal("nested object not merged: ", ide)
+	}
+
+	if asDefObj.CacheOptions.CacheTimeout != 5 || !asDefObj.CacheOptions.EnableCache {
+		t.Fatal("existing keys should be kept on merge: ", asDefObj.CacheOptions)
+	}
+
+	_, err = Process(map[string]string{"array-append.service.tyk.io/proxy": `["x"]`}, js)
+	if err == nil || !strings.HasPrefix(err.Error(), "annotation array-append.service.tyk.io/proxy: ") {
+		t.Fatal("appending to an object should fail and name the annotation, got ", err)
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	cases := map[string]string{
+		"use-keyless":                    "use_keyless",
+		"global-headers.x--api--version": "global_headers.x-api-version",
+		"a---b":                          "a-_b",
+		"plain.path":                     "plain.path",
+	}
+
+	for in, exp := range cases {
+		if got := jsonPath(in); got != exp {
+			t.Fatalf("expected %q for %q, got %q", exp, in, got)
+		}
+	}
+
+	def, err := Process(map[string]string{"string.service.tyk.io/definition.x--custom--key": "foo"}, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(def, `"x-custom-key":"foo"`) {
+		t.Fatal("escaped dashes not kept: ", def)
+	}
+}
+
+func TestProcFloatAndDuration(t *testing.T) {
+	testAnnotations := map[string]string{
+		"float.service.tyk.io/global-rate-limit.rate":         "2.5",
+		"duration.service.tyk.io/global-rate-limit.per":       "1m30s",
+		"duration.service.tyk.io/cache-options.cache-timeout": "2m",
+	}
+
+	def, err := Process(testAnnotations, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asDefObj := &apidef.APIDefinition{}
+	if err := json.Unmarshal([]byte(def), asDefObj); err != nil {
+		t.Fatal(err)
+	}
+
+	if asDefObj.GlobalRateLimit.Rate != 2.5 {
+		t.Fatal("float not set")
+	}
+
+	if asDefObj.GlobalRateLimit.Per != 90 {
+		t.Fatal("duration not set in seconds")
+	}
+
+	if asDefObj.CacheOptions.CacheTimeout != 120 {
+		t.Fatal("whole durations should decode into integer fields")
+	}
+
+	for _, k := range []string{"float.service.tyk.io/x", "duration.service.tyk.io/x"} {
+		if _, err := Process(map[string]string{k: "nope"}, js); err == nil || !strings.Contains(err.Error(), k) {
+			t.Fatalf("invalid value for %v should fail and name the annotation, got %v", k, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ok := map[string]string{
+		"string.service.tyk.io/proxy.target-url": "http://foo.bar",
+		"injector.tyk.io/inject":                 "true",
+	}
+	if err := Validate(ok, js); err != nil {
+		t.Fatal("valid overrides should pass, templates lacking required fields are not reported: ", err)
+	}
+
+	cases := map[string]string{
+		"string.service.tyk.io/use-keyless":   "yes",
+		"string.service.tyk.io/unknown-field": "foo",
+	}
+
+	for k, v := range cases {
+		ann := map[string]string{k: v, "string.service.tyk.io/proxy.target-url": "http://foo.bar"}
+		err := Validate(ann, js)
+		if err == nil {
+			t.Fatalf("expected %v to fail validation", k)
+		}
+
+		if !strings.Contains(err.Error(), k) {
+			t.Fatalf("expected the error to name %v, got %v", k, err)
+		}
+	}
+}
+
+func TestProcOrder(t *testing.T) {
+	testAnnotations := map[string]string{
+		"string.service.tyk.io/proxy.target-url":  "http://from.string",
+		"object.service.tyk.io/proxy":             `{"listen_path":"/","target_url":"http://from.object"}`,
+		"string.service.tyk.io/tags.0":            "indexed",
+		"array.service.tyk.io/tags":               `["a","b"]`,
+		"delete.service.tyk.io/proxy.listen-path": "",
+		"object-merge.service.tyk.io/proxy":       `{"listen_path":"/merged"}`,
+	}
+
+	first, err := Process(testAnnotations, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// map iteration order is random, the output must not be
+	for i := 0; i < 50; i++ {
+		again, err := Process(testAnnotations, js)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if again != first {
+			t.Fatal("processing is not deterministic")
+		}
+	}
+
+	asDefObj := &apidef.APIDefinition{}
+	if err := json.Unmarshal([]byte(first), asDefObj); err != nil {
+		t.Fatal(err)
+	}
+
+	if asDefObj.Proxy.TargetURL != "http://from.object" {
+		t.Fatal("objects should take precedence over strings, got ", asDefObj.Proxy.TargetURL)
+	}
+
+	if asDefObj.Proxy.ListenPath != "" {
+		t.Fatal("deletes should be applied after merges")
+	}
+
+	if len(asDefObj.Tags) != 2 || asDefObj.Tags[0] != "indexed" {
+		t.Fatal("explicit indexes should be applied last, got ", asDefObj.Tags)
+	}
+}
+
+func TestProcRootMerge(t *testing.T) {
+	def, err := Process(map[string]string{
+		"object-merge.service.tyk.io/":           `{"use_keyless":false,"proxy":{"target_url":"http://from.doc"}}`,
+		"string.service.tyk.io/proxy.target-url": "http://from.annotation",
+	}, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asDefObj := &apidef.APIDefinition{}
+	if err := json.Unmarshal([]byte(def), asDefObj); err != nil {
+		t.Fatal(err)
+	}
+
+	if asDefObj.UseKeylessAccess || asDefObj.Proxy.ListenPath != "/" {
+		t.Fatal("document not merged into the root")
+	}
+
+	if asDefObj.Proxy.TargetURL != "http://from.annotation" {
+		t.Fatal("inline annotations should take precedence over the document")
+	}
+
+	// keys already set are merged into, not replaced
+	def, err = Process(map[string]string{
+		"object-merge.service.tyk.io/": `{"config_data":{"b":2},"x.y":true}`,
+	}, `{"config_data":{"a":1},"name":"foo"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if def != `{"config_data":{"a":1,"b":2},"name":"foo","x.y":true}` {
+		t.Fatal("expected the document to be merged key by key, got ", def)
+	}
+}
@@ -0,0 +1,112 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/TykTechnologies/gojsonschema"
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+var (
+	schema     *gojsonschema.Schema
+	schemaErr  error
+	schemaOnce sync.Once
+)
+
+func apiDefSchema() (*gojsonschema.Schema, error) {
+	schemaOnce.Do(func() {
+		schema, schemaErr = gojsonschema.NewSchema(gojsonschema.NewStringLoader(apidef.Schema))
+	})
+
+	return schema, schemaErr
+}
+
+// schemaViolations returns the APIDefinition schema violations of a definition
+func schemaViolations(def string) (map[string]bool, error) {
+	s, err := apiDefSchema()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.Validate(gojsonschema.NewStringLoader(def))
+	if err != nil {
+		return nil, err
+	}
+
+	v := map[string]bool{}
+	for _, e := range res.Errors() {
+		v[e.String()] = true
+	}
+
+	return v, nil
+}
+
+// checkAgainst validates a processed definition against the APIDefinition
+// struct and schema, only violations not already present in the template are
+// reported since templates are completed by the dashboard
+func checkAgainst(base map[string]bool, def string) error {
+	if err := json.Unmarshal([]byte(def), &apidef.APIDefinition{}); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return fmt.Errorf("invalid value for %v: expected %v, got %v", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+
+		return err
+	}
+
+	v, err := schemaViolations(def)
+	if err != nil {
+		return err
+	}
+
+	introduced := make([]string, 0)
+	for e := range v {
+		if !base[e] {
+			introduced = append(introduced, e)
+		}
+	}
+
+	if len(introduced) > 0 {
+		sort.Strings(introduced)
+		return fmt.Errorf("invalid API definition: %v", strings.Join(introduced, "; "))
+	}
+
+	return nil
+}
+
+// Validate applies the annotations to the template and checks the result is
+// still a valid APIDefinition, the returned error names the offending annotation
+func Validate(ann map[string]string, def string) error {
+	base, err := schemaViolations(def)
+	if err != nil {
+		return err
+	}
+
+	processed, err := Process(ann, def)
+	if err != nil {
+		return err
+	}
+
+	if err := checkAgainst(base, processed); err == nil {
+		return nil
+	}
+
+	keys := orderedKeys(ann)
+
+	// find the annotation that breaks the definition on its own
+	for _, k := range keys {
+		single, err := Process(map[string]string{k: ann[k]}, def)
+		if err != nil {
+			return err
+		}
+
+		if err := checkAgainst(base, single); err != nil {
+			return fmt.Errorf("annotation %v: %v", k, err)
+		}
+	}
+
+	return fmt.Errorf("annotations %v: %v", strings.Join(keys, ", "), checkAgainst(base, processed))
+}
@@ -0,0 +1,199 @@
+package sidecar
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"go.jlucktay.dev/tyk-k8s/logger"
+)
+
+var log = logger.GetLogger("sidecar")
+
+const (
+	// ProxyRoute is the webserver route the debug proxy is mounted on
+	ProxyRoute = "/sidecar/{namespace}/{pod}/{query:.+}"
+
+	defaultPort   = 8080
+	defaultScheme = "http"
+
+	gatewaySecretHeader = "x-tyk-authorization"
+
+	// placeholderToken is the token of the sample config, it must be replaced
+	placeholderToken = "CHANGEME"
+
+	// set by the injector on the pods it injected a sidecar into
+	injectedStatusAnnotation = "injector.tyk.io/status"
+	meshPodLabel             = "mesh.tyk.io/injected"
+)
+
+// Config for the read-only sidecar control API proxy
+type Config struct {
+	Enabled            bool   `yaml:"enabled"`
+	Token              string `yaml:"token"`  // bearer token callers must present
+	Secret             string `yaml:"secret"` // gateway secret of the sidecars, defaults to TYK_GW_SECRET from the injector config
+	Port               int    `yaml:"port"`
+	Scheme             string `yaml:"scheme"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// Validate checks the proxy config, all problems found are returned
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+
+	if c.Enabled && c.Token == "" {
+		errs = append(errs, fmt.Errorf("token: required to enable the sidecar proxy"))
+	}
+
+	if c.Enabled && c.Token == placeholderToken {
+		errs = append(errs, fmt.Errorf("token: replace the placeholder %q of the sample config", placeholderToken))
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %d must be between 1 and 65535", c.Port))
+	}
+
+	if c.Scheme != "" && c.Scheme != "http" && c.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("scheme: %q must be http or https", c.Scheme))
+	}
+
+	return errs
+}
+
+// Proxy forwards whitelisted read-only control API queries to a pod's sidecar gateway
+type Proxy struct {
+	cfg    *Config
+	client kubernetes.Interface
+	http   *http.Client
+}
+
+// queries maps the supported read-only queries to sidecar gateway paths
+var queries = map[string]string{
+	"apis":   "/tyk/apis/",
+	"health": "/hello",
+}
+
+// NewProxy creates a new sidecar proxy using the given kubernetes client to resolve pods
+func NewProxy(cfg *Config, client kubernetes.Interface) (*Proxy, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("a token is required to enable the sidecar proxy")
+	}
+
+	if cfg.Token == placeholderToken {
+		return nil, fmt.Errorf("the sidecar proxy token is still the placeholder %q", placeholderToken)
+	}
+
+	if cfg.Port == 0 {
+		cfg.Port = defaultPort
+	}
+
+	if cfg.Scheme == "" {
+		cfg.Scheme = defaultScheme
+	}
+
+	return &Proxy{
+		cfg:    cfg,
+		client: client,
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify},
+			},
+		},
+	}, nil
+}
+
+// gatewayPath maps a query (e.g. "apis" or "apis/<id>") to the sidecar control API path
+func gatewayPath(query string) (string, error) {
+	query = strings.Trim(query, "/")
+	if p, ok := queries[query]; ok {
+		return p, nil
+	}
+
+	if strings.HasPrefix(query, "apis/") {
+		id := strings.TrimPrefix(query, "apis/")
+		if id != "" && !strings.ContainsAny(id, "/?#") {
+			return queries["apis"] + id, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported query %q", query)
+}
+
+// injected checks a pod runs a sidecar of the injector, the gateway secret
+// is only sent to sidecars so other pods can't collect it
+func injected(pod *corev1.Pod) error {
+	if pod.Annotations[injectedStatusAnnotation] != "injected" || pod.Labels[meshPodLabel] != "true" {
+		return fmt.Errorf("pod %s/%s has no injected sidecar", pod.Namespace, pod.Name)
+	}
+
+	if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" {
+		return fmt.Errorf("pod %s/%s is not running", pod.Namespace, pod.Name)
+	}
+
+	return nil
+}
+
+func (p *Proxy) authorized(r *http.Request) bool {
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(p.cfg.Token)) == 1
+}
+
+// Serve handles GET /sidecar/{namespace}/{pod}/{query}
+func (p *Proxy) Serve(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	pth, err := gatewayPath(vars["query"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pod, err := p.client.CoreV1().Pods(vars["namespace"]).Get(vars["pod"], metav1.GetOptions{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := injected(pod); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	target := fmt.Sprintf("%s://%s%s", p.cfg.Scheme, net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(p.cfg.Port)), pth)
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set(gatewaySecretHeader, p.cfg.Secret)
+
+	log.Infof("proxying sidecar query for %s/%s: %s", pod.Namespace, pod.Name, pth)
+	resp, err := p.http.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,100 @@
+package sidecar
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGatewayPath(t *testing.T) {
+	cases := map[string]string{
+		"apis":     "/tyk/apis/",
+		"health":   "/hello",
+		"apis/123": "/tyk/apis/123",
+	}
+
+	for q, exp := range cases {
+		p, err := gatewayPath(q)
+		if err != nil || p != exp {
+			t.Fatalf("expected %q for %q, got %q (%v)", exp, q, p, err)
+		}
+	}
+
+	for _, q := range []string{"reload", "apis/1/2", "keys"} {
+		if _, err := gatewayPath(q); err == nil {
+			t.Fatalf("query %q should be rejected", q)
+		}
+	}
+}
+
+func TestProxy_Serve(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(gatewaySecretHeader) != "gw-secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer gw.Close()
+
+	host, port, _ := net.SplitHostPort(gw.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	client := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "bar",
+			Annotations: map[string]string{injectedStatusAnnotation: "injected"},
+			Labels:      map[string]string{meshPodLabel: "true"},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: host},
+	}, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "bar"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: host},
+	})
+
+	if _, err := NewProxy(&Config{Token: placeholderToken}, client); err == nil {
+		t.Fatal("the placeholder token should be refused")
+	}
+
+	p, err := NewProxy(&Config{Token: "tok", Secret: "gw-secret", Port: portNum}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc(ProxyRoute, p.Serve).Methods("GET")
+
+	req := httptest.NewRequest("GET", "/sidecar/bar/foo/apis", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized without a token, got %v", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer tok")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	body, _ := ioutil.ReadAll(rec.Body)
+	if rec.Code != http.StatusOK || string(body) != "/tyk/apis/" {
+		t.Fatalf("unexpected proxy response %v: %s", rec.Code, body)
+	}
+
+	// the secret is only sent to injected sidecars
+	req = httptest.NewRequest("GET", "/sidecar/bar/plain/apis", nil)
+	req.Header.Set("Authorization", "Bearer tok")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected pods without a sidecar to be refused, got %v", rec.Code)
+	}
+}
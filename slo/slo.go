@@ -0,0 +1,264 @@
+package slo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.jlucktay.dev/tyk-k8s/logger"
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+var log = logger.GetLogger("slo")
+
+const (
+	defaultObjective = 0.999
+	defaultCacheTTL  = time.Minute
+)
+
+// Config defines the service level objective applied to all mesh services
+// and the windows (in days) burn rates are computed over
+type Config struct {
+	Enabled   bool    `yaml:"enabled"`
+	Objective float64 `yaml:"objective"`
+	Windows   []int   `yaml:"windows"`
+	CacheTTL  string  `yaml:"cacheTTL"`
+}
+
+// UsageFetcher returns the per-API analytics for a date range
+type UsageFetcher func(from, to time.Time) ([]tyk.APIUsage, error)
+
+// WindowStats holds the SLI and burn rate for a single window
+type WindowStats struct {
+	Days        int     `json:"window_days"`
+	Hits        int64   `json:"hits"`
+	Errors      int64   `json:"errors"`
+	SuccessRate float64 `json:"success_rate"`
+	BurnRate    float64 `json:"burn_rate"`
+	Latency     float64 `json:"latency_ms"`
+}
+
+// ServiceSLO is the SLO view of a single service across all windows
+type ServiceSLO struct {
+	Service   string        `json:"service"`
+	Objective float64       `json:"objective"`
+	Windows   []WindowStats `json:"windows"`
+}
+
+// Exporter aggregates dashboard analytics into per-service SLO series
+type Exporter struct {
+	cfg   *Config
+	fetch UsageFetcher
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	cached  []ServiceSLO
+	fetched time.Time
+}
+
+// New creates an exporter, when fetch is nil the dashboard analytics API is used
+func New(cfg *Config, fetch UsageFetcher) *Exporter {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	if cfg.Objective <= 0 || cfg.Objective >= 1 {
+		cfg.Objective = defaultObjective
+	}
+
+	if len(cfg.Windows) == 0 {
+		cfg.Windows = []int{1, 7, 30}
+	}
+
+	if fetch == nil {
+		fetch = tyk.FetchAPIUsage
+	}
+
+	ttl := defaultCacheTTL
+	if cfg.CacheTTL != "" {
+		d, err := time.ParseDuration(cfg.CacheTTL)
+		if err != nil {
+			log.Warningf("invalid cache TTL %q, using default of %v", cfg.CacheTTL, defaultCacheTTL)
+		} else {
+			ttl = d
+		}
+	}
+
+	return &Exporter{cfg: cfg, fetch: fetch, ttl: ttl}
+}
+
+// ServiceName maps a generated API name (e.g. "foo-mesh #mesh") back to the
+// kubernetes service it was created for
+func ServiceName(apiName string) string {
+	n := apiName
+	if i := strings.Index(n, " #"); i > -1 {
+		n = n[:i]
+	}
+
+	n = strings.TrimSuffix(n, "-mesh")
+	n = strings.TrimSuffix(n, "-inbound")
+
+	// ingress APIs are named ingress:service
+	if i := strings.LastIndex(n, ":"); i > -1 {
+		n = n[i+1:]
+	}
+
+	return strings.TrimSpace(n)
+}
+
+// isRoute reports whether a generated API is the mesh or inbound route of a
+// service, by the suffix of its name
+func isRoute(apiName, suffix string) bool {
+	n := apiName
+	if i := strings.Index(n, " #"); i > -1 {
+		n = n[:i]
+	}
+
+	return strings.HasSuffix(strings.TrimSpace(n), suffix)
+}
+
+// aggregate sums the analytics of a window by service. Mesh requests pass
+// the mesh route of the caller and the inbound route of the service, only
+// the inbound route is counted for services that have one.
+func (e *Exporter) aggregate(days int, rows []tyk.APIUsage) map[string]*WindowStats {
+	out := map[string]*WindowStats{}
+	latencySum := map[string]float64{}
+
+	inbound := map[string]bool{}
+	for _, r := range rows {
+		if isRoute(r.ID.APIName, "-inbound") {
+			inbound[ServiceName(r.ID.APIName)] = true
+		}
+	}
+
+	for _, r := range rows {
+		svc := ServiceName(r.ID.APIName)
+		if svc == "" {
+			continue
+		}
+
+		if isRoute(r.ID.APIName, "-mesh") && inbound[svc] {
+			continue
+		}
+
+		ws, ok := out[svc]
+		if !ok {
+			ws = &WindowStats{Days: days}
+			out[svc] = ws
+		}
+
+		ws.Hits += r.Hits
+		ws.Errors += r.Error
+		latencySum[svc] += r.Latency * float64(r.Hits)
+	}
+
+	budget := 1 - e.cfg.Objective
+	for svc, ws := range out {
+		ws.SuccessRate = 1
+		if ws.Hits > 0 {
+			ws.SuccessRate = float64(ws.Hits-ws.Errors) / float64(ws.Hits)
+			ws.Latency = latencySum[svc] / float64(ws.Hits)
+		}
+
+		ws.BurnRate = (1 - ws.SuccessRate) / budget
+	}
+
+	return out
+}
+
+// Collect fetches analytics for every configured window and returns the
+// per-service SLO series, results are cached for the configured TTL
+func (e *Exporter) Collect(now time.Time) ([]ServiceSLO, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.cached != nil && now.Sub(e.fetched) < e.ttl {
+		return e.cached, nil
+	}
+
+	services := map[string]*ServiceSLO{}
+	for _, days := range e.cfg.Windows {
+		rows, err := e.fetch(now.AddDate(0, 0, -days), now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch analytics for %d day window: %v", days, err)
+		}
+
+		for svc, ws := range e.aggregate(days, rows) {
+			s, ok := services[svc]
+			if !ok {
+				s = &ServiceSLO{Service: svc, Objective: e.cfg.Objective}
+				services[svc] = s
+			}
+
+			s.Windows = append(s.Windows, *ws)
+		}
+	}
+
+	res := make([]ServiceSLO, 0, len(services))
+	for _, s := range services {
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Service < res[j].Service })
+
+	e.cached = res
+	e.fetched = now
+	return res, nil
+}
+
+// ServeJSON writes the SLO series as JSON, suitable for a Grafana JSON datasource
+func (e *Exporter) ServeJSON(w http.ResponseWriter, r *http.Request) {
+	res, err := e.Collect(time.Now())
+	if err != nil {
+		// the upstream error may include details of the dashboard
+		log.Error(err)
+		http.Error(w, "failed to fetch analytics from the dashboard", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+	}
+}
+
+// ServeMetrics writes the SLO series in the Prometheus text exposition format
+func (e *Exporter) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	res, err := e.Collect(time.Now())
+	if err != nil {
+		// the upstream error may include details of the dashboard
+		log.Error(err)
+		http.Error(w, "failed to fetch analytics from the dashboard", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP tyk_mesh_slo_objective Configured success rate objective")
+	fmt.Fprintln(w, "# TYPE tyk_mesh_slo_objective gauge")
+	fmt.Fprintf(w, "tyk_mesh_slo_objective %v\n", e.cfg.Objective)
+
+	metrics := []struct {
+		name, help string
+		val        func(ws WindowStats) float64
+	}{
+		{"tyk_mesh_slo_requests", "Requests seen in the window", func(ws WindowStats) float64 { return float64(ws.Hits) }},
+		{"tyk_mesh_slo_errors", "Failed requests seen in the window", func(ws WindowStats) float64 { return float64(ws.Errors) }},
+		{"tyk_mesh_slo_success_rate", "Ratio of successful requests", func(ws WindowStats) float64 { return ws.SuccessRate }},
+		{"tyk_mesh_slo_burn_rate", "Error budget burn rate", func(ws WindowStats) float64 { return ws.BurnRate }},
+		{"tyk_mesh_slo_latency_ms", "Mean request latency", func(ws WindowStats) float64 { return ws.Latency }},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", m.name)
+		for _, s := range res {
+			for _, ws := range s.Windows {
+				fmt.Fprintf(w, "%s{service=%q,window=\"%dd\"} %v\n", m.name, s.Service, ws.Days, m.val(ws))
+			}
+		}
+	}
+}
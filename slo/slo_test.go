@@ -0,0 +1,100 @@
+package slo
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.jlucktay.dev/tyk-k8s/tyk"
+)
+
+func TestServiceName(t *testing.T) {
+	cases := map[string]string{
+		"foo-mesh #mesh":            "foo",
+		"foo-inbound #foo":          "foo",
+		"cafe-ingress:tea #ingress": "tea",
+		"plain":                     "plain",
+	}
+
+	for in, exp := range cases {
+		if got := ServiceName(in); got != exp {
+			t.Fatalf("expected %q for %q, got %q", exp, in, got)
+		}
+	}
+}
+
+func TestExporter_Collect(t *testing.T) {
+	calls := 0
+	fetch := func(from, to time.Time) ([]tyk.APIUsage, error) {
+		calls++
+		return []tyk.APIUsage{
+			{ID: tyk.APIUsageID{APIName: "foo-mesh #mesh"}, Hits: 1000, Error: 2, Latency: 15},
+			{ID: tyk.APIUsageID{APIName: "foo-inbound #foo"}, Hits: 700, Error: 1, Latency: 10},
+			{ID: tyk.APIUsageID{APIName: "foo-inbound #foo"}, Hits: 300, Error: 1, Latency: 12.5},
+			{ID: tyk.APIUsageID{APIName: "bar-mesh #mesh"}, Hits: 0},
+		}, nil
+	}
+
+	e := New(&Config{Objective: 0.99, Windows: []int{1, 7}}, fetch)
+	res, err := e.Collect(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 2 {
+		t.Fatalf("expected 2 services, got %v", len(res))
+	}
+
+	foo := res[1]
+	if foo.Service != "foo" || len(foo.Windows) != 2 {
+		t.Fatalf("unexpected result: %+v", foo)
+	}
+
+	ws := foo.Windows[0]
+	if ws.Hits != 1000 || ws.Errors != 2 {
+		t.Fatalf("expected the 1000 hits and 2 errors of the inbound route only, got %+v", ws)
+	}
+
+	if math.Abs(ws.BurnRate-0.2) > 1e-9 {
+		t.Fatalf("expected burn rate of 0.2, got %v", ws.BurnRate)
+	}
+
+	if math.Abs(ws.Latency-10.75) > 1e-9 {
+		t.Fatalf("expected weighted latency of 10.75, got %v", ws.Latency)
+	}
+
+	if res[0].Windows[0].SuccessRate != 1 {
+		t.Fatal("services without traffic should not burn budget")
+	}
+
+	// second call within the TTL is served from cache
+	if _, err := e.Collect(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 2 {
+		t.Fatalf("expected analytics to be fetched once per window, got %v calls", calls)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeMetrics(rec, httptest.NewRequest("GET", "/slo/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `tyk_mesh_slo_requests{service="foo",window="7d"} 1000`) {
+		t.Fatalf("metrics output missing series: %v", rec.Body.String())
+	}
+}
+
+func TestExporter_ServeMetrics_Error(t *testing.T) {
+	fetch := func(from, to time.Time) ([]tyk.APIUsage, error) {
+		return nil, errors.New("dashboard returned 500 for analytics request: secret details")
+	}
+
+	rec := httptest.NewRecorder()
+	New(nil, fetch).ServeMetrics(rec, httptest.NewRequest("GET", "/slo/metrics", nil))
+	if rec.Code != http.StatusBadGateway || strings.Contains(rec.Body.String(), "secret details") {
+		t.Fatalf("expected a bad gateway without the upstream error, got %v: %v", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("records")
+
+// boltStore keeps records in a local BoltDB file, it suits a single replica
+// with a persistent volume
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store %v: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (b *boltStore) Put(r *Record) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltBucket)
+
+		var old *Record
+		if doc := bkt.Get([]byte(r.Key())); doc != nil {
+			old = &Record{}
+			if err := json.Unmarshal(doc, old); err != nil {
+				old = nil
+			}
+		}
+		stamp(r, old)
+
+		js, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		return bkt.Put([]byte(r.Key()), js)
+	})
+}
+
+func (b *boltStore) Get(kind, id string) (*Record, error) {
+	r := &Record{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		doc := tx.Bucket(boltBucket).Get([]byte(Key(kind, id)))
+		if doc == nil {
+			return ErrNotFound
+		}
+
+		return json.Unmarshal(doc, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (b *boltStore) Delete(kind, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(Key(kind, id)))
+	})
+}
+
+func (b *boltStore) List() ([]*Record, error) {
+	res := make([]*Record, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// keys are iterated in byte order
+		return tx.Bucket(boltBucket).ForEach(func(k, doc []byte) error {
+			r := &Record{}
+			if err := json.Unmarshal(doc, r); err != nil {
+				log.Warningf("skipping malformed record %s: %v", k, err)
+				return nil
+			}
+			res = append(res, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"go.jlucktay.dev/tyk-k8s/kube"
+)
+
+const defaultConfigMapName = "tyk-k8s-state"
+
+// configMapStore keeps records as JSON entries of a single ConfigMap, shared
+// by all replicas. ConfigMaps are limited to 1MiB, which holds a few thousand
+// records.
+type configMapStore struct {
+	kc        kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func newConfigMapStore(namespace, name string) (*configMapStore, error) {
+	kc, err := kube.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return newConfigMapStoreWithClient(kc, namespace, name), nil
+}
+
+func newConfigMapStoreWithClient(kc kubernetes.Interface, namespace, name string) *configMapStore {
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	if name == "" {
+		name = defaultConfigMapName
+	}
+
+	return &configMapStore{kc: kc, namespace: namespace, name: name}
+}
+
+// configMapKey turns a record key into a valid ConfigMap key
+func configMapKey(kind, id string) string {
+	return kind + "." + id
+}
+
+// get returns the ConfigMap of the store, a new one if it doesn't exist yet
+func (c *configMapStore) get() (*corev1.ConfigMap, bool, error) {
+	cm, err := c.kc.CoreV1().ConfigMaps(c.namespace).Get(c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      c.name,
+				Namespace: c.namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "tyk-k8s"},
+			},
+		}, false, nil
+	}
+
+	return cm, err == nil, err
+}
+
+// update applies a change to the ConfigMap, retrying on conflicting writes of other replicas
+func (c *configMapStore) update(change func(data map[string]string) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, exists, err := c.get()
+		if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+
+		if err := change(cm.Data); err != nil {
+			return err
+		}
+
+		cms := c.kc.CoreV1().ConfigMaps(c.namespace)
+		if exists {
+			_, err = cms.Update(cm)
+		} else {
+			_, err = cms.Create(cm)
+		}
+		switch {
+		case apierrors.IsAlreadyExists(err):
+			// created by another replica in the meantime
+			return apierrors.NewConflict(corev1.Resource("configmaps"), c.name, err)
+		case apierrors.IsConflict(err):
+			return err
+		case err != nil:
+			return fmt.Errorf("failed to update state ConfigMap %v/%v: %w", c.namespace, c.name, err)
+		}
+
+		return nil
+	})
+}
+
+func (c *configMapStore) Put(r *Record) error {
+	return c.update(func(data map[string]string) error {
+		var old *Record
+		if doc, ok := data[configMapKey(r.Kind, r.ID)]; ok {
+			old = &Record{}
+			if err := json.Unmarshal([]byte(doc), old); err != nil {
+				old = nil
+			}
+		}
+		stamp(r, old)
+
+		js, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		data[configMapKey(r.Kind, r.ID)] = string(js)
+		return nil
+	})
+}
+
+func (c *configMapStore) Get(kind, id string) (*Record, error) {
+	cm, _, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := cm.Data[configMapKey(kind, id)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	r := &Record{}
+	if err := json.Unmarshal([]byte(doc), r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (c *configMapStore) Delete(kind, id string) error {
+	return c.update(func(data map[string]string) error {
+		delete(data, configMapKey(kind, id))
+		return nil
+	})
+}
+
+func (c *configMapStore) List() ([]*Record, error) {
+	cm, _, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Record, 0, len(cm.Data))
+	for k, doc := range cm.Data {
+		r := &Record{}
+		if err := json.Unmarshal([]byte(doc), r); err != nil {
+			log.Warningf("skipping malformed record %v: %v", k, err)
+			continue
+		}
+		res = append(res, r)
+	}
+	sortRecords(res)
+
+	return res, nil
+}
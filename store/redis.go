@@ -0,0 +1,95 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const redisStateKey = "tyk-k8s-state"
+
+// redisStore keeps records as JSON documents in a hash keyed by kind and ID
+type redisStore struct {
+	pool *redis.Pool
+}
+
+func newRedisStore(addr, password string, db int) *redisStore {
+	return &redisStore{pool: &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, redis.DialPassword(password), redis.DialDatabase(db))
+		},
+	}}
+}
+
+func (s *redisStore) Put(r *Record) error {
+	old, err := s.Get(r.Kind, r.ID)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	stamp(r, old)
+
+	js, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", redisStateKey, r.Key(), js)
+	return err
+}
+
+func (s *redisStore) Get(kind, id string) (*Record, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	doc, err := redis.Bytes(conn.Do("HGET", redisStateKey, Key(kind, id)))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Record{}
+	if err := json.Unmarshal(doc, r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (s *redisStore) Delete(kind, id string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", redisStateKey, Key(kind, id))
+	return err
+}
+
+func (s *redisStore) List() ([]*Record, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	docs, err := redis.ByteSlices(conn.Do("HVALS", redisStateKey))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Record, 0, len(docs))
+	for _, doc := range docs {
+		r := &Record{}
+		if err := json.Unmarshal(doc, r); err != nil {
+			log.Warningf("skipping malformed record: %v", err)
+			continue
+		}
+		res = append(res, r)
+	}
+	sortRecords(res)
+
+	return res, nil
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.jlucktay.dev/tyk-k8s/logger"
+)
+
+var log = logger.GetLogger("store")
+
+// Backends the controller state can be kept in
+const (
+	TypeBolt      = "bolt"
+	TypeConfigMap = "configmap"
+	TypeRedis     = "redis"
+)
+
+// Kinds of objects the controller creates outside the cluster
+const (
+	KindAPI  = "api"
+	KindCert = "cert"
+)
+
+// ErrNotFound is returned for records that aren't in the store
+var ErrNotFound = errors.New("record not found")
+
+// Config selects the backend of the state store, no state is recorded if
+// the type is unset
+type Config struct {
+	Type          string `yaml:"type"`          // bolt, configmap or redis
+	Path          string `yaml:"path"`          // bolt: database file
+	Namespace     string `yaml:"namespace"`     // configmap: namespace of the ConfigMap, defaults to default
+	Name          string `yaml:"name"`          // configmap: name of the ConfigMap, defaults to tyk-k8s-state
+	RedisAddr     string `yaml:"redisAddr"`     // redis: host:port
+	RedisPassword string `yaml:"redisPassword"` // redis
+	RedisDB       int    `yaml:"redisDB"`       // redis
+}
+
+// Validate checks the settings of the selected backend, all problems found are returned
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+
+	switch c.Type {
+	case "", TypeConfigMap:
+	case TypeBolt:
+		if c.Path == "" {
+			errs = append(errs, fmt.Errorf("path: required by the %v store", TypeBolt))
+		}
+	case TypeRedis:
+		if c.RedisAddr == "" {
+			errs = append(errs, fmt.Errorf("redisAddr: required by the %v store", TypeRedis))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("type: unknown store %q, must be %v, %v or %v", c.Type, TypeBolt, TypeConfigMap, TypeRedis))
+	}
+
+	return errs
+}
+
+// Owner is the kubernetes object an API or certificate was created for
+type Owner struct {
+	Kind      string `json:"kind"` // Pod, Service, Ingress, Identity or Mesh
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Service   string `json:"service,omitempty"` // the app label of pods
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("%s %s/%s", o.Kind, o.Namespace, o.Name)
+}
+
+// Record is an API or certificate created by the controller, keyed by its
+// kind and the ID Tyk assigned to it. Org is empty for the org selected by
+// the namespace of the owner.
+type Record struct {
+	Kind    string    `json:"kind"`
+	ID      string    `json:"id"`
+	Org     string    `json:"org,omitempty"`
+	Slug    string    `json:"slug,omitempty"`
+	APIID   string    `json:"api_id,omitempty"` // certs: the API the certificate is attached to
+	Owner   Owner     `json:"owner"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Key identifies a record in the backends
+func (r *Record) Key() string {
+	return Key(r.Kind, r.ID)
+}
+
+// Key identifies the record of an object of a kind
+func Key(kind, id string) string {
+	return kind + "/" + id
+}
+
+// Store records the objects created by the controller and who owns them, so
+// they can be found again without relying on annotations of the owners
+type Store interface {
+	// Put creates or replaces a record, keeping its creation time
+	Put(*Record) error
+	Get(kind, id string) (*Record, error)
+	Delete(kind, id string) error
+	// List returns all records ordered by key
+	List() ([]*Record, error)
+}
+
+// New creates the store selected in the config, nil if none is configured
+func New(cfg *Config) (Store, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case TypeBolt:
+		return newBoltStore(cfg.Path)
+	case TypeConfigMap:
+		return newConfigMapStore(cfg.Namespace, cfg.Name)
+	case TypeRedis:
+		return newRedisStore(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB), nil
+	}
+
+	return nil, fmt.Errorf("unknown state store %q", cfg.Type)
+}
+
+// Owned returns the records of an owner, any field of the owner left empty
+// matches all records
+func Owned(s Store, owner Owner) ([]*Record, error) {
+	all, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	match := func(want, got string) bool { return want == "" || want == got }
+
+	found := make([]*Record, 0)
+	for _, r := range all {
+		if match(owner.Kind, r.Owner.Kind) && match(owner.Namespace, r.Owner.Namespace) &&
+			match(owner.Name, r.Owner.Name) && match(owner.Service, r.Owner.Service) {
+			found = append(found, r)
+		}
+	}
+
+	return found, nil
+}
+
+// stamp sets the times of a record about to be put, keeping the creation
+// time of the record it replaces
+func stamp(r *Record, old *Record) {
+	r.Updated = time.Now().UTC()
+	switch {
+	case old != nil && !old.Created.IsZero():
+		r.Created = old.Created
+	case r.Created.IsZero():
+		r.Created = r.Updated
+	}
+}
+
+func sortRecords(records []*Record) {
+	sort.Slice(records, func(i, j int) bool { return records[i].Key() < records[j].Key() })
+}
+
+// memoryStore keeps records in memory, they are lost on restart
+type memoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewMemory creates a store that isn't persisted, e.g. for tests
+func NewMemory() Store {
+	return &memoryStore{records: map[string]Record{}}
+}
+
+func (m *memoryStore) Put(r *Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var old *Record
+	if o, ok := m.records[r.Key()]; ok {
+		old = &o
+	}
+	stamp(r, old)
+	m.records[r.Key()] = *r
+
+	return nil
+}
+
+func (m *memoryStore) Get(kind, id string) (*Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.records[Key(kind, id)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &r, nil
+}
+
+func (m *memoryStore) Delete(kind, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, Key(kind, id))
+	return nil
+}
+
+func (m *memoryStore) List() ([]*Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]*Record, 0, len(m.records))
+	for _, r := range m.records {
+		r := r
+		res = append(res, &r)
+	}
+	sortRecords(res)
+
+	return res, nil
+}
+
+// DeleteAPI removes the record of an API and of the certificates attached to it
+func DeleteAPI(s Store, id string) error {
+	all, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range all {
+		if r.Kind == KindCert && r.APIID == id {
+			if err := s.Delete(KindCert, r.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.Delete(KindAPI, id)
+}
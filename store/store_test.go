@@ -0,0 +1,92 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStores(t *testing.T) {
+	bolt, err := newBoltStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.db.Close()
+
+	stores := map[string]Store{
+		"memory":    NewMemory(),
+		"bolt":      bolt,
+		"configmap": newConfigMapStoreWithClient(fake.NewSimpleClientset(), "tyk", ""),
+	}
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			pod := Owner{Kind: "Pod", Namespace: "bar", Name: "foo-1", Service: "foo"}
+
+			if _, err := s.Get(KindAPI, "a1"); err != ErrNotFound {
+				t.Fatalf("expected %v, got %v", ErrNotFound, err)
+			}
+
+			if err := s.Put(&Record{Kind: KindAPI, ID: "a1", Slug: "foo-inbound", Owner: pod}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put(&Record{Kind: KindCert, ID: "c1", APIID: "a1", Owner: pod}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put(&Record{Kind: KindAPI, ID: "a2", Owner: Owner{Kind: "Pod", Namespace: "baz", Name: "qux"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			first, err := s.Get(KindAPI, "a1")
+			if err != nil || first.Slug != "foo-inbound" || first.Owner != pod || first.Created.IsZero() {
+				t.Fatalf("unexpected record %+v (%v)", first, err)
+			}
+
+			// replacing a record keeps its creation time
+			if err := s.Put(&Record{Kind: KindAPI, ID: "a1", Slug: "foo-inbound", Owner: pod}); err != nil {
+				t.Fatal(err)
+			}
+			again, err := s.Get(KindAPI, "a1")
+			if err != nil || !again.Created.Equal(first.Created) {
+				t.Fatalf("expected creation time %v to be kept, got %+v (%v)", first.Created, again, err)
+			}
+
+			owned, err := Owned(s, Owner{Namespace: "bar", Service: "foo"})
+			if err != nil || len(owned) != 2 || owned[0].Key() != "api/a1" || owned[1].Key() != "cert/c1" {
+				t.Fatalf("unexpected records of the service %v (%v)", owned, err)
+			}
+
+			if err := DeleteAPI(s, "a1"); err != nil {
+				t.Fatal(err)
+			}
+
+			all, err := s.List()
+			if err != nil || len(all) != 1 || all[0].ID != "a2" {
+				t.Fatalf("expected the API and its cert to be removed, got %v (%v)", all, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		errs int
+	}{
+		{"disabled", Config{}, 0},
+		{"configmap", Config{Type: TypeConfigMap}, 0},
+		{"bolt without path", Config{Type: TypeBolt}, 1},
+		{"redis without address", Config{Type: TypeRedis}, 1},
+		{"unknown", Config{Type: "etcd"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := tt.cfg.Validate(); len(errs) != tt.errs {
+				t.Errorf("expected %d errors, got %v", tt.errs, errs)
+			}
+		})
+	}
+}
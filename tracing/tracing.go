@@ -0,0 +1,144 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"go.jlucktay.dev/tyk-k8s/logger"
+	"go.jlucktay.dev/tyk-k8s/version"
+)
+
+var log = logger.GetLogger("tracing")
+
+const (
+	defaultEndpoint    = "localhost:4318"
+	defaultServiceName = "tyk-k8s"
+
+	instrumentationName = "go.jlucktay.dev/tyk-k8s"
+)
+
+// Config of the OTLP/HTTP exporter spans are sent to, when tracing is disabled
+// spans are no-ops
+type Config struct {
+	Enabled     bool              `yaml:"enabled"`
+	Endpoint    string            `yaml:"endpoint"`    // host:port of the collector, defaults to localhost:4318
+	URLPath     string            `yaml:"urlPath"`     // defaults to /v1/traces
+	Insecure    bool              `yaml:"insecure"`    // send spans over plain HTTP
+	Headers     map[string]string `yaml:"headers"`     // e.g. the API key of a hosted collector
+	ServiceName string            `yaml:"serviceName"` // defaults to tyk-k8s
+	SampleRatio *float64          `yaml:"sampleRatio"` // of new traces, sampled parents are always followed, defaults to 1
+}
+
+// Validate checks the endpoint and sample ratio, all problems found are returned
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+
+	if strings.Contains(c.Endpoint, "://") {
+		errs = append(errs, fmt.Errorf("endpoint: %q must be host:port without a scheme, use insecure for plain HTTP", c.Endpoint))
+	}
+
+	if c.URLPath != "" && !strings.HasPrefix(c.URLPath, "/") {
+		errs = append(errs, fmt.Errorf("urlPath: %q must start with /", c.URLPath))
+	}
+
+	if c.SampleRatio != nil && (*c.SampleRatio < 0 || *c.SampleRatio > 1) {
+		errs = append(errs, fmt.Errorf("sampleRatio: %v must be between 0 and 1", *c.SampleRatio))
+	}
+
+	return errs
+}
+
+// Init installs the global tracer provider and W3C trace context propagation.
+// The returned function flushes buffered spans and must be called on exit.
+func Init(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if cfg == nil || !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if cfg.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(cfg.URLPath))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+
+	exp, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create OTLP exporter: %v", err)
+	}
+
+	name := cfg.ServiceName
+	if name == "" {
+		name = defaultServiceName
+	}
+
+	ratio := 1.0
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", name),
+			attribute.String("service.version", version.Version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+
+	log.Infof("sending traces to %v", endpoint)
+	return tp.Shutdown, nil
+}
+
+// Start starts a span as a child of the span in ctx, if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract returns ctx with the remote span context propagated in the headers
+// of a request, e.g. by an API server with tracing enabled
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject propagates the span context of ctx in the headers of an outgoing
+// request so the spans of the receiver are part of the same trace
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,46 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	ratio := 1.5
+	cfg := &Config{Endpoint: "http://collector:4318", URLPath: "v1/traces", SampleRatio: &ratio}
+	if errs := cfg.Validate(); len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", errs)
+	}
+
+	ratio = 0.1
+	cfg = &Config{Endpoint: "collector:4318", URLPath: "/v1/traces", SampleRatio: &ratio}
+	if errs := cfg.Validate(); len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+}
+
+func TestInit_Disabled(t *testing.T) {
+	shutdown, err := Init(context.Background(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	// spans aren't recorded but remote parents are still propagated
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, span := Start(Extract(context.Background(), header), "test")
+	defer span.End()
+
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("expected the remote trace, got %v", span.SpanContext().TraceID())
+	}
+
+	out := http.Header{}
+	Inject(ctx, out)
+	if out.Get("traceparent") != header.Get("traceparent") {
+		t.Fatalf("expected the remote parent to be propagated, got %q", out.Get("traceparent"))
+	}
+}
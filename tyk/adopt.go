@@ -0,0 +1,192 @@
+package tyk
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/TykTechnologies/tyk-sync/clients/interfaces"
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+const (
+	// AdoptAnnotation asks to adopt an existing API for the routes of an
+	// object, it is only honoured in the namespaces adopt is enabled for
+	AdoptAnnotation = "tyk.io/adopt"
+
+	// AdoptedKey is the config_data key an adopted API records its slug from
+	// before the adoption under, it is restored when the API is released
+	AdoptedKey = "tyk_k8s_adopted"
+)
+
+// AdoptConf lets objects take over APIs that weren't created by the
+// controller but serve the hostname and listen path of one of their routes,
+// instead of creating a second API for it
+type AdoptConf struct {
+	Enabled bool `yaml:"enabled"`
+	// Namespaces whose objects may adopt APIs, "*" allows every namespace
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// Validate checks adoption is limited to some namespaces
+func (c *AdoptConf) Validate() []error {
+	if c.Enabled && len(c.Namespaces) == 0 {
+		return []error{fmt.Errorf("adopt.namespaces: required to enable adoption, use \"*\" for all namespaces")}
+	}
+
+	return nil
+}
+
+// adopting reports whether an API that wasn't created by the controller may
+// be adopted for opts, the object has to ask for it with the annotation and
+// be in a namespace adoption is enabled for
+func adopting(opts *APIDefOptions, c *AdoptConf) bool {
+	if !c.Enabled {
+		return false
+	}
+
+	allowed := false
+	for _, ns := range c.Namespaces {
+		if ns == "*" || ns == opts.Namespace {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	v, ok := opts.Annotations[AdoptAnnotation]
+	if !ok {
+		return false
+	}
+
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warningf("%v: invalid %v annotation %q", opts.Slug, AdoptAnnotation, v)
+		return false
+	}
+
+	return on
+}
+
+// adoptable returns the API of an org serving the hostname and listen path of
+// opts that wasn't created by the controller. Nothing is adopted if several
+// APIs serve the route, the choice is left to the user.
+func adoptable(apis []objects.DBApiDefinition, orgID string, opts *APIDefOptions) *objects.DBApiDefinition {
+	var found *objects.DBApiDefinition
+	for i := range apis {
+		def := &apis[i]
+		if def.Domain != opts.Hostname || def.Proxy.ListenPath != opts.ListenPath {
+			continue
+		}
+
+		if orgID != "" && def.OrgID != "" && def.OrgID != orgID {
+			continue
+		}
+
+		if _, managed := ChangeReasonOf(&def.APIDefinition); managed {
+			continue
+		}
+
+		if found != nil {
+			log.Warningf("not adopting an API for %v, %v and %v both serve %v%v", opts.Slug, ObjectID(found), ObjectID(def), opts.Hostname, opts.ListenPath)
+			return nil
+		}
+		found = def
+	}
+
+	return found
+}
+
+// adopt tags an API with the slug and change reason of opts, the rest of its
+// definition, e.g. its authentication and middleware, is kept as it is
+func adopt(def *apidef.APIDefinition, opts *APIDefOptions) {
+	if def.ConfigData == nil {
+		def.ConfigData = map[string]interface{}{}
+	}
+
+	def.ConfigData[AdoptedKey] = def.Slug
+	def.Slug = cleanSlug(opts.Slug)
+	opts.ChangeReason.Apply(def)
+}
+
+// Adopted reports whether an API was adopted rather than created by the
+// controller. Adopted APIs keep their own definition, they are released
+// instead of deleted when their object is gone.
+func Adopted(def *apidef.APIDefinition) bool {
+	_, ok := def.ConfigData[AdoptedKey]
+	return ok
+}
+
+// Release returns an adopted API to its previous slug and drops the
+// ownership of the controller, it reports false for other APIs
+func Release(def *apidef.APIDefinition) bool {
+	slug, ok := def.ConfigData[AdoptedKey]
+	if !ok {
+		return false
+	}
+
+	if s, ok := slug.(string); ok {
+		def.Slug = s
+	}
+	delete(def.ConfigData, AdoptedKey)
+	delete(def.ConfigData, ChangeReasonKey)
+
+	return true
+}
+
+// adoptService takes over an existing API for opts if they may adopt one and
+// returns its ID, or an empty ID if there was none
+func (o *Org) adoptService(ctx context.Context, opts *APIDefOptions) (string, error) {
+	if !adopting(opts, &o.conf.Adopt) {
+		return "", nil
+	}
+
+	// the API may have been adopted for another object, bypass the lookup cache
+	cl := o.newClient(ctx)
+	all, err := cl.FetchAPIs()
+	if err != nil {
+		return "", err
+	}
+
+	def := adoptable(all, o.conf.Org, opts)
+	if def == nil {
+		return "", nil
+	}
+
+	if err := o.adopt(cl, def, opts); err != nil {
+		return "", err
+	}
+
+	return opts.AdoptedID, nil
+}
+
+func (o *Org) adopt(cl interfaces.UniversalClient, def *objects.DBApiDefinition, opts *APIDefOptions) error {
+	log.Warningf("adopting API %v for %v", ObjectID(def), opts.Slug)
+	defer o.lookups.invalidate()
+
+	adopt(&def.APIDefinition, opts)
+	if err := cl.UpdateAPI(&def.APIDefinition); err != nil {
+		return fmt.Errorf("failed to adopt API %v for %v: %w", ObjectID(def), opts.Slug, err)
+	}
+	o.reloads.trigger()
+
+	opts.AdoptedID = ObjectID(def)
+	return nil
+}
+
+// release updates an API released by Release instead of deleting it
+func (o *Org) release(cl interfaces.UniversalClient, def *objects.DBApiDefinition) error {
+	log.Warningf("releasing adopted API %v as %v", ObjectID(def), def.Slug)
+	defer o.lookups.invalidate()
+
+	if err := cl.UpdateAPI(&def.APIDefinition); err != nil {
+		return err
+	}
+	o.reloads.trigger()
+	o.flights.forget()
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package tyk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/TykTechnologies/tyk/apidef"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+	"go.jlucktay.dev/tyk-k8s/tracing"
+)
+
+const (
+	usageEndpoint = "/api/usage/apis"
+
+	// analytics tags are added as request headers the gateway records as
+	// `<header>-<value>` tags
+	analyticsHeaderPrefix = "k8s-"
+	globalHeadersPath     = "version_data.versions.Default.global_headers"
+
+	// RedactBodiesKey is the config_data key marking APIs whose request and
+	// response bodies must never be recorded in analytics
+	RedactBodiesKey = "tyk_k8s_redact_bodies"
+
+	// detailedRecordingField turns on body recording for a single API on the
+	// gateways supporting it, it isn't part of the definitions of the gateway
+	// version the controller is built against
+	detailedRecordingField = "enable_detailed_recording"
+)
+
+// AnalyticsConf tags the analytics of the generated APIs with the Kubernetes
+// metadata of the objects they are published for. The tags are sent to the
+// upstreams as headers, so tagging is opt-in and never applies to the mesh
+// and inbound routes of the injector.
+type AnalyticsConf struct {
+	Enabled bool `yaml:"enabled"`
+	// Tags maps tag names to Go templates of their values, rendered with the
+	// template variables, requests are tagged `k8s-<name>-<value>`. Empty
+	// values and values of missing keys, e.g. labels the object doesn't
+	// have, are skipped. Unset defaults to namespace, team label and cluster.
+	Tags       map[string]string `yaml:"tags"`
+	Cluster    string            `yaml:"cluster"`    // name of the cluster, .Cluster in the tags
+	Categories bool              `yaml:"categories"` // also add the tag values as dashboard API categories
+}
+
+var defaultAnalyticsTags = map[string]string{
+	"namespace": "{{ .Namespace }}",
+	"team":      `{{ index .Labels "team" }}`,
+	"cluster":   "{{ .Cluster }}",
+}
+
+// APIUsageID identifies the API an aggregated analytics row belongs to
+type APIUsageID struct {
+	APIID   string `json:"api_id"`
+	APIName string `json:"api_name"`
+}
+
+// APIUsage is a single per-API row from the dashboard usage analytics
+type APIUsage struct {
+	ID              APIUsageID `json:"id"`
+	Hits            int64      `json:"hits"`
+	Success         int64      `json:"success"`
+	Error           int64      `json:"error"`
+	Latency         float64    `json:"latency"`
+	UpstreamLatency float64    `json:"upstream_latency"`
+}
+
+type apiUsageResponse struct {
+	Data  []APIUsage `json:"data"`
+	Pages int        `json:"pages"`
+}
+
+func usagePath(from, to time.Time) string {
+	return fmt.Sprintf("%s/%d/%d/%d/%d/%d/%d", usageEndpoint,
+		from.Day(), from.Month(), from.Year(),
+		to.Day(), to.Month(), to.Year())
+}
+
+// FetchAPIUsage retrieves the aggregated per-API analytics (hits, errors and
+// latencies) for the given date range from the dashboard
+func FetchAPIUsage(from, to time.Time) ([]APIUsage, error) {
+	if cfg.Mode == ModeCE {
+		return nil, fmt.Errorf("analytics are only available from the dashboard")
+	}
+
+	o := Default()
+	usage, err := o.guard.traced(context.Background(), "FetchAPIUsage", func(ctx context.Context) (interface{}, error) {
+		return o.fetchAPIUsage(ctx, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usage.([]APIUsage), nil
+}
+
+func (o *Org) fetchAPIUsage(ctx context.Context, from, to time.Time) ([]APIUsage, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(o.conf.URL, "/")+usagePath(from, to), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	q := req.URL.Query()
+	q.Set("by", "Hits")
+	q.Set("sort", "1")
+	q.Set("p", "-1")
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Authorization", o.secret())
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := o.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusErrorf(resp.StatusCode, "dashboard returned %v for analytics request", resp.StatusCode)
+	}
+
+	usage := &apiUsageResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(usage); err != nil {
+		return nil, err
+	}
+
+	return usage.Data, nil
+}
+
+// analyticsTags renders the analytics tags of an API, sorted by name
+func analyticsTags(conf *AnalyticsConf, opts *APIDefOptions) ([][2]string, error) {
+	tags := conf.Tags
+	if tags == nil {
+		tags = defaultAnalyticsTags
+	}
+
+	names := make([]string, 0, len(tags))
+	for n := range tags {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	vars := templateVars(opts)
+	vars["Cluster"] = conf.Cluster
+
+	out := make([][2]string, 0, len(names))
+	for _, n := range names {
+		// missing keys fail the execution instead of rendering "<no value>"
+		tpl, err := template.New(n).Option("missingkey=error").Parse(tags[n])
+		if err != nil {
+			return nil, fmt.Errorf("analytics tag %v: %v", n, err)
+		}
+
+		var v bytes.Buffer
+		if err := tpl.Execute(&v, vars); err != nil {
+			var execErr template.ExecError
+			if !errors.As(err, &execErr) {
+				return nil, fmt.Errorf("analytics tag %v: %v", n, err)
+			}
+
+			log.Debugf("%v: skipping analytics tag %v: %v", opts.Slug, n, err)
+			continue
+		}
+
+		if val := strings.TrimSpace(v.String()); val != "" {
+			out = append(out, [2]string{strings.ToLower(n), val})
+		}
+	}
+
+	return out, nil
+}
+
+// analyticsAnnotations returns the processor annotations tagging the
+// analytics of an API. Gateways only tag analytics records with request
+// headers, each tag is sent to the upstream as a `k8s-<name>` header too.
+// Dashboard categories are `#<category>` suffixes of the API name.
+func analyticsAnnotations(conf *AnalyticsConf, opts *APIDefOptions) (map[string]string, error) {
+	ann := map[string]string{}
+	if !conf.Enabled || opts.Mesh {
+		return ann, nil
+	}
+
+	tags, err := analyticsTags(conf, opts)
+	if err != nil || len(tags) == 0 {
+		return ann, err
+	}
+
+	headers := map[string]string{}
+	names := make([]string, 0, len(tags))
+	categories := make([]string, 0, len(tags))
+	for _, t := range tags {
+		h := analyticsHeaderPrefix + t[0]
+		headers[h] = t[1]
+		names = append(names, h)
+		categories = append(categories, "#"+strings.Join(strings.Fields(t[1]), "-"))
+	}
+
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return nil, err
+	}
+	ann[string(processor.ObjectMergeKey)+globalHeadersPath] = string(data)
+
+	if data, err = json.Marshal(names); err != nil {
+		return nil, err
+	}
+	ann[string(processor.ArrayAppendKey)+"tag_headers"] = string(data)
+
+	// the templates name APIs after their gateway tags too
+	if conf.Categories {
+		name := opts.Name
+		for _, t := range opts.Tags {
+			name += " #" + t
+		}
+		ann[string(processor.ValueSetStringKey)+"name"] = name + " " + strings.Join(categories, " ")
+	}
+
+	return ann, nil
+}
+
+// redactBodies marks an API so its bodies are never recorded in analytics
+func redactBodies(def *apidef.APIDefinition) {
+	if def.ConfigData == nil {
+		def.ConfigData = map[string]interface{}{}
+	}
+
+	def.ConfigData[RedactBodiesKey] = true
+}
+
+// BodiesRedacted reports whether the bodies of an API must never be recorded
+func BodiesRedacted(def *apidef.APIDefinition) bool {
+	redacted, _ := def.ConfigData[RedactBodiesKey].(bool)
+	return redacted
+}
+
+// definitionJSON encodes an API definition, wrapped for the dashboard if
+// nested is set. The API level detailed recording of APIs with redacted
+// bodies is turned off explicitly, so an API edited to record bodies stops
+// doing so the next time the controller writes it.
+func definitionJSON(def *apidef.APIDefinition, nested bool) (json.RawMessage, error) {
+	var in interface{} = def
+	if nested {
+		in = dbDefinition(def)
+	}
+
+	data, err := json.Marshal(in)
+	if err != nil || !BodiesRedacted(def) {
+		return data, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	if !nested {
+		fields[detailedRecordingField] = json.RawMessage("false")
+		return json.Marshal(fields)
+	}
+
+	inner, err := definitionJSON(def, false)
+	if err != nil {
+		return nil, err
+	}
+	fields["api_definition"] = inner
+
+	return json.Marshal(fields)
+}
@@ -0,0 +1,129 @@
+package tyk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/TykTechnologies/tyk/apidef"
+
+	"go.jlucktay.dev/tyk-k8s/version"
+)
+
+// ChangeReasonKey is the config_data key the change reason is recorded under
+const ChangeReasonKey = "tyk_k8s_change"
+
+// ChecksumKey is the config_data key the checksum of a definition templated
+// by the controller is recorded under, edits made in the dashboard change
+// the definition but not the recorded checksum
+const ChecksumKey = "tyk_k8s_checksum"
+
+// ChangeReason ties a change made by the controller back to the cluster event
+// that triggered it. It is stored in the config_data of the API definition
+// so it shows up in the dashboard audit log of the create or update call,
+// deletions are only recorded in the controller log.
+type ChangeReason struct {
+	ControllerVersion string `json:"controller_version"`
+	Kind              string `json:"kind"`
+	Namespace         string `json:"namespace,omitempty"`
+	Name              string `json:"name,omitempty"`
+	ObjectUID         string `json:"object_uid,omitempty"`
+	AdmissionUID      string `json:"admission_uid,omitempty"`
+	Time              string `json:"time"`
+}
+
+// NewChangeReason creates a change reason for the given kubernetes object
+func NewChangeReason(kind, namespace, name, objectUID string) *ChangeReason {
+	return &ChangeReason{
+		ControllerVersion: version.Version,
+		Kind:              kind,
+		Namespace:         namespace,
+		Name:              name,
+		ObjectUID:         objectUID,
+	}
+}
+
+// ChangeReasonOf returns the change reason recorded in an API definition, it
+// is only present on APIs created or updated by the controller
+func ChangeReasonOf(def *apidef.APIDefinition) (*ChangeReason, bool) {
+	v, ok := def.ConfigData[ChangeReasonKey]
+	if !ok {
+		return nil, false
+	}
+
+	if r, ok := v.(ChangeReason); ok {
+		return &r, true
+	}
+
+	// definitions read back from the dashboard hold the decoded JSON object
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+
+	r := &ChangeReason{}
+	if err := json.Unmarshal(js, r); err != nil || r.Kind == "" {
+		return nil, false
+	}
+
+	return r, true
+}
+
+// Apply records the change reason in the API definition
+func (r *ChangeReason) Apply(def *apidef.APIDefinition) {
+	if r == nil {
+		return
+	}
+
+	rc := *r
+	rc.Time = time.Now().UTC().Format(time.RFC3339)
+
+	if def.ConfigData == nil {
+		def.ConfigData = map[string]interface{}{}
+	}
+
+	def.ConfigData[ChangeReasonKey] = rc
+}
+
+// definitionChecksum hashes the templated parts of an API definition. The
+// IDs, the config data and the fields the controller changes without
+// re-templating, load balanced targets, certificates and pinned keys, are
+// left out.
+func definitionChecksum(def *apidef.APIDefinition) string {
+	d := *def
+	d.Id = ""
+	d.APIID = ""
+	d.OrgID = ""
+	d.ConfigData = nil
+	d.Proxy.EnableLoadBalancing = false
+	d.Proxy.Targets = nil
+	d.Certificates = nil
+	d.ClientCertificates = nil
+	d.UpstreamCertificates = nil
+	d.PinnedPublicKeys = nil
+
+	js, err := json.Marshal(&d)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:])
+}
+
+// RecordChecksum records the checksum of a templated API definition
+func RecordChecksum(def *apidef.APIDefinition) {
+	if def.ConfigData == nil {
+		def.ConfigData = map[string]interface{}{}
+	}
+
+	def.ConfigData[ChecksumKey] = definitionChecksum(def)
+}
+
+// Edited reports whether an API definition was changed since the controller
+// templated it, APIs without a recorded checksum are never reported
+func Edited(def *apidef.APIDefinition) bool {
+	recorded, ok := def.ConfigData[ChecksumKey].(string)
+	return ok && recorded != definitionChecksum(def)
+}
@@ -0,0 +1,190 @@
+package tyk
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+)
+
+const (
+	// Authentication of the API: keyless (default), jwt or oidc
+	AuthModeAnnotation = "auth.tyk.io/mode"
+	// jwt: JWKS URL the signing keys are fetched from
+	AuthJWKSAnnotation = "auth.tyk.io/jwks-url"
+	// jwt: base64 encoded public key or HMAC secret, instead of a JWKS URL
+	AuthKeyAnnotation = "auth.tyk.io/key"
+	// jwt: rsa (default), ecdsa or hmac
+	AuthSigningMethodAnnotation = "auth.tyk.io/signing-method"
+	// jwt: claim identifying the caller, sub if unset
+	AuthIdentityClaimAnnotation = "auth.tyk.io/identity-claim"
+	// jwt: claim holding the policy ID of the caller, pol if unset
+	AuthPolicyClaimAnnotation = "auth.tyk.io/policy-claim"
+	// jwt: comma separated policy IDs of callers without a policy claim
+	AuthDefaultPoliciesAnnotation = "auth.tyk.io/default-policies"
+	// jwt: comma separated `<scope>=<policy ID>` pairs read from the scope claim
+	AuthScopePoliciesAnnotation = "auth.tyk.io/scope-policies"
+	// oidc: issuer the tokens must come from
+	AuthIssuerAnnotation = "auth.tyk.io/issuer"
+	// oidc: comma separated `<client ID>=<policy ID>` pairs of the issuer
+	AuthClientPoliciesAnnotation = "auth.tyk.io/client-policies"
+
+	AuthModeKeyless = "keyless"
+	AuthModeJWT     = "jwt"
+	AuthModeOIDC    = "oidc"
+)
+
+var signingMethods = map[string]bool{"rsa": true, "ecdsa": true, "hmac": true}
+
+// pairs parses comma separated `<key>=<value>` pairs
+func pairs(key, v string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("%v: %q must be <key>=<value>", key, p)
+		}
+		out[kv[0]] = kv[1]
+	}
+
+	return out, nil
+}
+
+// list parses a comma separated list
+func list(v string) []string {
+	out := make([]string, 0)
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+// authAnnotations returns the processor annotations configuring the
+// authentication declared in the auth annotations of an object, replacing
+// the keyless access of the templates
+func authAnnotations(ann map[string]string) (map[string]string, error) {
+	out := map[string]string{}
+	mode := strings.ToLower(ann[AuthModeAnnotation])
+	switch mode {
+	case "", AuthModeKeyless:
+		return out, nil
+	case AuthModeJWT, AuthModeOIDC:
+	default:
+		return nil, fmt.Errorf("%v: unknown mode %q, must be %v, %v or %v", AuthModeAnnotation, mode, AuthModeKeyless, AuthModeJWT, AuthModeOIDC)
+	}
+
+	str := func(k, v string) { out[string(processor.ValueSetStringKey)+k] = v }
+	obj := func(k string, v interface{}) error {
+		data, err := json.Marshal(v)
+		out[string(processor.ObjectSetKey)+k] = string(data)
+		return err
+	}
+	out[string(processor.ValueSetBoolKey)+"use_keyless"] = "false"
+
+	if mode == AuthModeOIDC {
+		issuer := ann[AuthIssuerAnnotation]
+		if issuer == "" {
+			return nil, fmt.Errorf("%v: required in %v mode", AuthIssuerAnnotation, mode)
+		}
+
+		clients, err := pairs(AuthClientPoliciesAnnotation, ann[AuthClientPoliciesAnnotation])
+		if err != nil {
+			return nil, err
+		}
+		if len(clients) == 0 {
+			return nil, fmt.Errorf("%v: at least one client is required in %v mode", AuthClientPoliciesAnnotation, mode)
+		}
+
+		// client IDs are base64 encoded in the definition
+		ids := map[string]string{}
+		for c, pol := range clients {
+			ids[base64.StdEncoding.EncodeToString([]byte(c))] = pol
+		}
+
+		out[string(processor.ValueSetBoolKey)+"use_openid"] = "true"
+		err = obj("openid_options", map[string]interface{}{
+			"providers":           []map[string]interface{}{{"issuer": issuer, "client_ids": ids}},
+			"segregate_by_client": false,
+		})
+		return out, err
+	}
+
+	if ann[AuthIssuerAnnotation] != "" {
+		return nil, fmt.Errorf("%v: the gateway only checks issuers in %v mode", AuthIssuerAnnotation, AuthModeOIDC)
+	}
+
+	// the gateway accepts a key or a JWKS URL, both base64 encoded
+	jwks, key := ann[AuthJWKSAnnotation], ann[AuthKeyAnnotation]
+	switch {
+	case jwks != "" && key != "":
+		return nil, fmt.Errorf("%v and %v are mutually exclusive", AuthJWKSAnnotation, AuthKeyAnnotation)
+	case jwks != "":
+		if u, err := url.Parse(jwks); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("%v: %q is not an http(s) URL", AuthJWKSAnnotation, jwks)
+		}
+		str("jwt_source", base64.StdEncoding.EncodeToString([]byte(jwks)))
+	case key != "":
+		if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("%v: must be base64 encoded: %v", AuthKeyAnnotation, err)
+		}
+		str("jwt_source", key)
+	default:
+		return nil, fmt.Errorf("%v or %v: required in %v mode", AuthJWKSAnnotation, AuthKeyAnnotation, mode)
+	}
+
+	method := strings.ToLower(ann[AuthSigningMethodAnnotation])
+	if method == "" {
+		method = "rsa"
+	}
+	if !signingMethods[method] {
+		return nil, fmt.Errorf("%v: unknown signing method %q, must be rsa, ecdsa or hmac", AuthSigningMethodAnnotation, method)
+	}
+
+	identity := ann[AuthIdentityClaimAnnotation]
+	if identity == "" {
+		identity = "sub"
+	}
+
+	polClaim := ann[AuthPolicyClaimAnnotation]
+	if polClaim == "" {
+		polClaim = "pol"
+	}
+
+	scopes, err := pairs(AuthScopePoliciesAnnotation, ann[AuthScopePoliciesAnnotation])
+	if err != nil {
+		return nil, err
+	}
+
+	out[string(processor.ValueSetBoolKey)+"enable_jwt"] = "true"
+	str("jwt_signing_method", method)
+	str("jwt_identity_base_field", identity)
+	str("jwt_policy_field_name", polClaim)
+
+	if defaults := list(ann[AuthDefaultPoliciesAnnotation]); len(defaults) > 0 {
+		data, err := json.Marshal(defaults)
+		if err != nil {
+			return nil, err
+		}
+		out[string(processor.ArraySetKey)+"jwt_default_policies"] = string(data)
+	}
+
+	if len(scopes) > 0 {
+		str("jwt_scope_claim_name", "scope")
+		if err := obj("jwt_scope_to_policy_mapping", scopes); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,58 @@
+package tyk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-sync/clients/interfaces"
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+)
+
+// apiCache keeps the API list fetched for lookups for a short while, writes
+// made through this package invalidate it. Fetches are serialised so that
+// concurrent lookups on a cold cache share a single request.
+type apiCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	apis    []objects.DBApiDefinition
+	expires time.Time
+}
+
+func (c *apiCache) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+	c.apis = nil
+}
+
+// fetch returns the cached API list, or fetches it if the cache is disabled or stale
+func (c *apiCache) fetch(cl interfaces.UniversalClient) ([]objects.DBApiDefinition, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.apis != nil && time.Now().Before(c.expires) {
+		return c.apis, nil
+	}
+
+	apis, err := cl.FetchAPIs()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ttl > 0 {
+		c.apis = apis
+		c.expires = time.Now().Add(c.ttl)
+	}
+
+	return apis, nil
+}
+
+// invalidate drops the cached list, a lookup in flight finishes first so its
+// possibly outdated result is dropped as well
+func (c *apiCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.apis = nil
+}
@@ -0,0 +1,97 @@
+package tyk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.jlucktay.dev/tyk-k8s/tracing"
+)
+
+const (
+	dashboardCertsPath = "/api/certs/"
+	gatewayCertsPath   = "/tyk/certs/"
+)
+
+// DeleteCertificate removes a certificate from the Tyk certificate store, the
+// tyk-sync clients can't delete certificates so the API is called directly
+func (o *Org) DeleteCertificate(ctx context.Context, id string) error {
+	if id == "" {
+		return fmt.Errorf("certificate ID can't be empty")
+	}
+
+	_, err := o.guard.traced(ctx, "DeleteCertificate", func(ctx context.Context) (interface{}, error) {
+		return nil, o.deleteCertificate(ctx, id)
+	})
+
+	return err
+}
+
+func (o *Org) deleteCertificate(ctx context.Context, id string) error {
+	code, err := o.certRequest(ctx, http.MethodDelete, id)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case code == http.StatusNotFound:
+		return fmt.Errorf("certificate %v not found", id)
+	case code >= 300:
+		return statusErrorf(code, "tyk returned %v deleting certificate %v", code, id)
+	}
+
+	return nil
+}
+
+// CertificateExists checks if a certificate is in the Tyk certificate store
+func (o *Org) CertificateExists(ctx context.Context, id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+
+	res, err := o.guard.traced(ctx, "CertificateExists", func(ctx context.Context) (interface{}, error) {
+		code, err := o.certRequest(ctx, http.MethodGet, id)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case code == http.StatusNotFound:
+			return false, nil
+		case code >= 300:
+			return false, statusErrorf(code, "tyk returned %v looking up certificate %v", code, id)
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return res.(bool), nil
+}
+
+// certRequest calls the certificate API of the dashboard or gateway and returns the status code
+func (o *Org) certRequest(ctx context.Context, method, id string) (int, error) {
+	path, header := dashboardCertsPath, "Authorization"
+	if o.conf.Mode == ModeCE {
+		path, header = gatewayCertsPath, "x-tyk-authorization"
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(o.conf.URL, "/")+path+url.PathEscape(id), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(header, o.secret())
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := o.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
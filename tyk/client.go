@@ -0,0 +1,34 @@
+package tyk
+
+import (
+	"context"
+
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+// Client manages the API definitions and certificates of an organisation,
+// calls give up when their context is done
+type Client interface {
+	CreateService(ctx context.Context, opts *APIDefOptions) (string, error)
+	// CreateOrGetService returns the ID of the API with the slug of opts and
+	// whether it was created by this call
+	CreateOrGetService(ctx context.Context, opts *APIDefOptions) (string, bool, error)
+	UpdateAPIs(ctx context.Context, svcs map[string]*APIDefOptions) error
+	UpdateAPI(ctx context.Context, def *apidef.APIDefinition) error
+	GetBySlug(ctx context.Context, slug string) (*objects.DBApiDefinition, error)
+	GetByObjectID(ctx context.Context, id string) (*objects.DBApiDefinition, error)
+	// FetchAPIs returns every API definition of the organisation
+	FetchAPIs(ctx context.Context) ([]objects.DBApiDefinition, error)
+	DeleteBySlug(ctx context.Context, slug string) error
+	DeleteByID(ctx context.Context, id string) error
+	CreateCertificate(ctx context.Context, crt, key []byte) (string, error)
+	DeleteCertificate(ctx context.Context, id string) error
+	// CertificateExists checks if a certificate ID is in the certificate store
+	CertificateExists(ctx context.Context, id string) (bool, error)
+}
+
+// Resolver returns the client to manage the APIs of an object with
+type Resolver func(namespace string, ann map[string]string) (Client, error)
+
+var _ Client = &Org{}
@@ -0,0 +1,53 @@
+package tyk
+
+import (
+	"fmt"
+	"sync"
+)
+
+// dashboard keys loaded from Secrets by org name, orgs with a secret
+// reference only use these so keys can be rotated without a restart
+var (
+	credentialsMu sync.RWMutex
+	credentials   = map[string]string{}
+)
+
+// SetCredential sets the dashboard key of an org, the default org has no
+// name, an empty key removes it
+func SetCredential(org, key string) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+
+	if key == "" {
+		delete(credentials, org)
+		return
+	}
+	credentials[org] = key
+}
+
+// secret returns the dashboard key of the org
+func (o *Org) secret() string {
+	if o.conf.SecretRef == "" {
+		return o.conf.Secret
+	}
+
+	credentialsMu.RLock()
+	defer credentialsMu.RUnlock()
+	return credentials[o.Name]
+}
+
+// CredentialsLoaded fails while an org that reads its dashboard key from a
+// Secret has none, it is used as a readiness check
+func CredentialsLoaded() error {
+	for _, o := range Orgs() {
+		if o.conf.SecretRef != "" && o.secret() == "" {
+			name := o.Name
+			if name == "" {
+				name = "default"
+			}
+			return fmt.Errorf("no dashboard key loaded for the %v org from secret %v", name, o.conf.SecretRef)
+		}
+	}
+
+	return nil
+}
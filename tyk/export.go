@@ -0,0 +1,214 @@
+package tyk
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+// OperatorAPIVersion is the API version of the Tyk Operator resources an
+// export is converted to
+const OperatorAPIVersion = "tyk.tyk.io/v1alpha1"
+
+// Export holds the objects the controller created in an org. Certificates
+// are referenced by ID, their keys stay in the certificate store.
+type Export struct {
+	Org          string                    `json:"org,omitempty"`
+	APIs         []objects.DBApiDefinition `json:"apis"`
+	Policies     []map[string]interface{}  `json:"policies,omitempty"`
+	Certificates []string                  `json:"certificates,omitempty"`
+}
+
+// ExportOrg collects the APIs created by the controller in the org of a
+// client, the policies created for their limits and the certificates they
+// use. APIs are recognised by their change reason or, if recorded is set,
+// by their object ID being recorded in the state store. Policies are only
+// read from the dashboard.
+func ExportOrg(ctx context.Context, cl Client, recorded func(id string) bool) (*Export, error) {
+	apis, err := cl.FetchAPIs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	exp := &Export{APIs: make([]objects.DBApiDefinition, 0)}
+	certs := map[string]bool{}
+	for _, api := range apis {
+		_, managed := ChangeReasonOf(&api.APIDefinition)
+		if !managed && (recorded == nil || !recorded(ObjectID(&api))) {
+			continue
+		}
+
+		exp.APIs = append(exp.APIs, api)
+		for _, id := range apiCertificates(&api.APIDefinition) {
+			certs[id] = true
+		}
+	}
+	sort.Slice(exp.APIs, func(i, j int) bool { return exp.APIs[i].Slug < exp.APIs[j].Slug })
+
+	for id := range certs {
+		exp.Certificates = append(exp.Certificates, id)
+	}
+	sort.Strings(exp.Certificates)
+
+	if o, ok := cl.(*Org); ok {
+		exp.Org = o.Name
+		if o.conf.Mode != ModeCE {
+			if exp.Policies, err = o.ownedPolicies(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return exp, nil
+}
+
+// apiCertificates returns the IDs of the server, client and upstream
+// certificates of an API
+func apiCertificates(def *apidef.APIDefinition) []string {
+	ids := append([]string{}, def.Certificates...)
+	ids = append(ids, def.ClientCertificates...)
+	for _, id := range def.UpstreamCertificates {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// ownedPolicies returns every field of the policies created by the controller
+func (o *Org) ownedPolicies(ctx context.Context) ([]map[string]interface{}, error) {
+	list := &struct {
+		Data []map[string]interface{} `json:"Data"`
+	}{}
+	if err := o.policyRequest(ctx, http.MethodGet, "?p=-1", nil, list); err != nil {
+		return nil, err
+	}
+
+	pols := make([]map[string]interface{}, 0)
+	for _, p := range list.Data {
+		tags, _ := p["tags"].([]interface{})
+		for _, t := range tags {
+			if t == policyTag {
+				pols = append(pols, p)
+				break
+			}
+		}
+	}
+
+	sort.Slice(pols, func(i, j int) bool { return policyName(pols[i]) < policyName(pols[j]) })
+	return pols, nil
+}
+
+func policyName(p map[string]interface{}) string {
+	name, _ := p["name"].(string)
+	return name
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// resourceName turns a slug into the name of a Kubernetes resource
+func resourceName(s string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(s), "-"), "-.")
+	if len(name) > 253 {
+		name = strings.TrimRight(name[:253], "-.")
+	}
+	if name == "" {
+		name = "api"
+	}
+
+	return name
+}
+
+// OperatorResources converts an export to ApiDefinition and SecurityPolicy
+// resources of the Tyk Operator, in the namespaces of the objects the APIs
+// were created for. Policies grant access to the ApiDefinitions by name, the
+// IDs of the dashboard are left out.
+func (e *Export) OperatorResources() ([]map[string]interface{}, error) {
+	res := make([]map[string]interface{}, 0, len(e.APIs)+len(e.Policies))
+	refs := map[string]map[string]interface{}{}
+
+	for i := range e.APIs {
+		def := &e.APIs[i].APIDefinition
+		spec, err := toMap(def)
+		if err != nil {
+			return nil, err
+		}
+		delete(spec, "id")
+		delete(spec, "org_id")
+
+		meta := map[string]interface{}{"name": resourceName(def.Slug)}
+		if r, ok := ChangeReasonOf(def); ok && r.Namespace != "" {
+			meta["namespace"] = r.Namespace
+		}
+		refs[def.APIID] = meta
+
+		res = append(res, map[string]interface{}{
+			"apiVersion": OperatorAPIVersion,
+			"kind":       "ApiDefinition",
+			"metadata":   meta,
+			"spec":       spec,
+		})
+	}
+
+	for _, p := range e.Policies {
+		spec := map[string]interface{}{}
+		for k, v := range p {
+			switch k {
+			case "_id", "id", "org_id", "access_rights":
+			default:
+				spec[k] = v
+			}
+		}
+
+		rights := make([]map[string]interface{}, 0)
+		access, _ := p["access_rights"].(map[string]interface{})
+		for apiID, a := range access {
+			ref, ok := refs[apiID]
+			if !ok {
+				continue
+			}
+
+			right := map[string]interface{}{"name": ref["name"]}
+			if ns, ok := ref["namespace"]; ok {
+				right["namespace"] = ns
+			}
+			if ad, ok := a.(map[string]interface{}); ok {
+				right["versions"] = ad["versions"]
+			}
+			rights = append(rights, right)
+		}
+		sort.Slice(rights, func(i, j int) bool { return rights[i]["name"].(string) < rights[j]["name"].(string) })
+		spec["access_rights_array"] = rights
+
+		meta := map[string]interface{}{"name": resourceName(policyName(p))}
+		if len(rights) > 0 {
+			if ns, ok := rights[0]["namespace"]; ok {
+				meta["namespace"] = ns
+			}
+		}
+
+		res = append(res, map[string]interface{}{
+			"apiVersion": OperatorAPIVersion,
+			"kind":       "SecurityPolicy",
+			"metadata":   meta,
+			"spec":       spec,
+		})
+	}
+
+	return res, nil
+}
+
+func toMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]interface{}{}
+	return m, json.Unmarshal(data, &m)
+}
@@ -0,0 +1,167 @@
+package tyk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+const reloadPath = "/tyk/reload/group"
+
+// fileClient manages the file-based API definitions a CE gateway loads from
+// its app path, the gateway is asked to hot reload after every change if its
+// URL is configured
+type fileClient struct {
+	dir      string
+	url      string
+	secret   string
+	insecure bool
+}
+
+func newFileClient(dir, url, secret string) *fileClient {
+	return &fileClient{dir: dir, url: url, secret: secret}
+}
+
+func (c *fileClient) SetInsecureTLS(val bool) {
+	c.insecure = val
+}
+
+func (c *fileClient) GetActiveID(def *apidef.APIDefinition) string {
+	return def.APIID
+}
+
+func (c *fileClient) file(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid API ID %q", id)
+	}
+
+	return filepath.Join(c.dir, id+".json"), nil
+}
+
+func (c *fileClient) FetchAPIs() ([]objects.DBApiDefinition, error) {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	apis := make([]objects.DBApiDefinition, 0, len(files))
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		def := apidef.APIDefinition{}
+		if err := json.Unmarshal(data, &def); err != nil {
+			return nil, fmt.Errorf("invalid API definition %v: %v", f, err)
+		}
+
+		apis = append(apis, objects.DBApiDefinition{APIDefinition: def})
+	}
+
+	return apis, nil
+}
+
+func (c *fileClient) CreateAPI(def *apidef.APIDefinition) (string, error) {
+	apis, err := c.FetchAPIs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, api := range apis {
+		if api.APIID == def.APIID || api.Proxy.ListenPath == def.Proxy.ListenPath {
+			return "", fmt.Errorf("API %v already exists, update it instead", api.APIID)
+		}
+	}
+
+	if err := c.write(def); err != nil {
+		return "", err
+	}
+
+	return def.APIID, nil
+}
+
+func (c *fileClient) UpdateAPI(def *apidef.APIDefinition) error {
+	f, err := c.file(def.APIID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(f); err != nil {
+		return fmt.Errorf("API %v not found: %v", def.APIID, err)
+	}
+
+	return c.write(def)
+}
+
+func (c *fileClient) DeleteAPI(id string) error {
+	f, err := c.file(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(f); err != nil {
+		return err
+	}
+
+	return c.reload()
+}
+
+func (c *fileClient) CreateCertificate(cert []byte) (string, error) {
+	return "", fmt.Errorf("certificates can't be uploaded to file-based definitions, use the gateway API instead")
+}
+
+// write replaces the definition file atomically so the gateway never loads a partial file
+func (c *fileClient) write(def *apidef.APIDefinition) error {
+	f, err := c.file(def.APIID)
+	if err != nil {
+		return err
+	}
+
+	body, err := definitionJSON(def, false)
+	if err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	if err := json.Indent(&data, body, "", "  "); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), f); err != nil {
+		return err
+	}
+
+	return c.reload()
+}
+
+func (c *fileClient) reload() error {
+	if c.url == "" {
+		log.Debug("no gateway URL set, file-based definitions are picked up on the next reload")
+		return nil
+	}
+
+	return reloadGroup(c.url, c.secret, c.insecure)
+}
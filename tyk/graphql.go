@@ -0,0 +1,220 @@
+package tyk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+	"go.jlucktay.dev/tyk-k8s/tracing"
+)
+
+const (
+	// Type of the API: rest (default) or graphql
+	APITypeAnnotation = "api.tyk.io/type"
+	// graphql: path of the GraphQL endpoint of the upstream, /graphql if unset
+	GraphQLPathAnnotation = "api.tyk.io/graphql-path"
+	// graphql: set to false to reject introspection queries at the gateway
+	GraphQLIntrospectionAnnotation = "api.tyk.io/graphql-introspection"
+
+	APITypeREST    = "rest"
+	APITypeGraphQL = "graphql"
+
+	// GraphQLSchemaField of the config data of an API holds its GraphQL
+	// schema, SDL or an introspection result
+	GraphQLSchemaField = "graphql_schema"
+	// GraphQLSchemaKey is the processor annotation setting it, schemas
+	// resolved from a ConfigMap are set before the API is published
+	GraphQLSchemaKey = string(processor.ValueSetStringKey) + "config_data." + GraphQLSchemaField
+
+	defaultGraphQLPath = "/graphql"
+	introspectTimeout  = 30 * time.Second
+	introspectMaxSize  = 5 << 20
+	introspectionQuery = `{"query": "query { __schema { queryType { name } mutationType { name } subscriptionType { name } types { kind name } } }"}`
+)
+
+var (
+	sdlOperation     = regexp.MustCompile(`(?m)^\s*(?:extend\s+)?type\s+(Query|Mutation|Subscription)\b`)
+	schemaDefinition = regexp.MustCompile(`(?m)^\s*(?:extend\s+)?schema\s*\{([^}]*)\}`)
+	schemaOperation  = regexp.MustCompile(`\b(query|mutation|subscription)\s*:`)
+)
+
+// graphQLSchema is the part of an introspection result that is checked
+type graphQLSchema struct {
+	Data struct {
+		Schema *struct {
+			QueryType        *struct{} `json:"queryType"`
+			MutationType     *struct{} `json:"mutationType"`
+			SubscriptionType *struct{} `json:"subscriptionType"`
+		} `json:"__schema"`
+	} `json:"data"`
+}
+
+// graphQLOperations returns the operation types a schema defines, from its
+// SDL or an introspection result
+func graphQLOperations(schema string) (map[string]bool, error) {
+	ops := map[string]bool{}
+
+	if strings.HasPrefix(strings.TrimSpace(schema), "{") {
+		res := &graphQLSchema{}
+		if err := json.Unmarshal([]byte(schema), res); err != nil || res.Data.Schema == nil {
+			return nil, fmt.Errorf("GraphQL schema is neither SDL nor an introspection result")
+		}
+
+		s := res.Data.Schema
+		ops["query"] = s.QueryType != nil
+		ops["mutation"] = s.MutationType != nil
+		ops["subscription"] = s.SubscriptionType != nil
+		return ops, nil
+	}
+
+	for _, m := range sdlOperation.FindAllStringSubmatch(schema, -1) {
+		ops[strings.ToLower(m[1])] = true
+	}
+
+	// a schema definition can name other root types
+	for _, def := range schemaDefinition.FindAllStringSubmatch(schema, -1) {
+		for _, m := range schemaOperation.FindAllStringSubmatch(def[1], -1) {
+			ops[m[1]] = true
+		}
+	}
+
+	if !ops["query"] {
+		return nil, fmt.Errorf("GraphQL schema has no query type")
+	}
+
+	return ops, nil
+}
+
+// introspect fetches the schema of a GraphQL upstream with an introspection query
+func introspect(ctx context.Context, endpoint string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBufferString(introspectionQuery))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+
+	cl := &http.Client{Timeout: introspectTimeout}
+	resp, err := cl.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to introspect %v: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, introspectMaxSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to introspect %v: %v", endpoint, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to introspect %v: %v", endpoint, resp.Status)
+	}
+
+	return string(data), nil
+}
+
+// graphQLAnnotations returns the processor annotations publishing a GraphQL
+// API. The schema comes from a ConfigMap or is introspected from the target.
+// The gateway proxies GraphQL requests as they are, the endpoint is white
+// listed, request bodies must be GraphQL requests and operation types the
+// schema doesn't define are rejected before reaching the upstream.
+func graphQLAnnotations(ctx context.Context, target string, ann map[string]string) (map[string]string, error) {
+	out := map[string]string{}
+	switch t := strings.ToLower(ann[APITypeAnnotation]); t {
+	case "", APITypeREST:
+		return out, nil
+	case APITypeGraphQL:
+	default:
+		return nil, fmt.Errorf("%v: unknown type %q, must be %v or %v", APITypeAnnotation, t, APITypeREST, APITypeGraphQL)
+	}
+
+	if _, ok := ann[OpenAPIChecksumKey]; ok {
+		return nil, fmt.Errorf("%v: GraphQL APIs can't be imported from an OpenAPI document", APITypeAnnotation)
+	}
+
+	path := ann[GraphQLPathAnnotation]
+	if path == "" {
+		path = defaultGraphQLPath
+	}
+	path = "/" + strings.TrimLeft(path, "/")
+
+	schema, ok := ann[GraphQLSchemaKey]
+	if !ok {
+		s, err := introspect(ctx, strings.TrimRight(target, "/")+path)
+		if err != nil {
+			return nil, err
+		}
+		schema = s
+		out[GraphQLSchemaKey] = schema
+	}
+
+	ops, err := graphQLOperations(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	// operations without a type are queries
+	rejected := make([]string, 0)
+	for _, op := range []string{"mutation", "subscription"} {
+		if !ops[op] {
+			rejected = append(rejected, op)
+		}
+	}
+
+	query := map[string]interface{}{"type": "string", "minLength": 1}
+	not := make([]interface{}, 0)
+	if len(rejected) > 0 {
+		not = append(not, map[string]interface{}{"pattern": `^\s*(` + strings.Join(rejected, "|") + `)\b`})
+	}
+
+	switch strings.ToLower(ann[GraphQLIntrospectionAnnotation]) {
+	case "", "y", "yes", "true", "on":
+	default:
+		not = append(not, map[string]interface{}{"pattern": `__(schema|type)\b`})
+	}
+
+	if len(not) > 0 {
+		query["not"] = map[string]interface{}{"anyOf": not}
+	}
+
+	validate, err := json.Marshal([]map[string]interface{}{{
+		"path":   path,
+		"method": http.MethodPost,
+		"schema": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"query"},
+			"properties": map[string]interface{}{
+				"query":         query,
+				"operationName": map[string]interface{}{"type": []string{"string", "null"}},
+				"variables":     map[string]interface{}{"type": []string{"object", "null"}},
+			},
+		},
+		"error_response_code": http.StatusBadRequest,
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	actions := map[string]interface{}{}
+	for _, m := range []string{http.MethodGet, http.MethodPost, http.MethodOptions} {
+		actions[m] = map[string]interface{}{"action": "no_action", "code": http.StatusOK, "headers": map[string]string{}}
+	}
+
+	white, err := json.Marshal([]map[string]interface{}{{"path": path, "method_actions": actions}})
+	if err != nil {
+		return nil, err
+	}
+
+	out[string(processor.ArraySetKey)+whiteListPath] = string(white)
+	out[string(processor.ArraySetKey)+validateJSONPath] = string(validate)
+	out[string(processor.ValueSetStringKey)+"config_data.api_type"] = APITypeGraphQL
+
+	return out, nil
+}
@@ -0,0 +1,292 @@
+package tyk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-sync/clients/interfaces"
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+
+	"go.jlucktay.dev/tyk-k8s/tracing"
+)
+
+const (
+	defaultBreakerCooldown = 30 * time.Second
+	defaultRateLimitWait   = 5 * time.Second
+	defaultCallTimeout     = 30 * time.Second
+)
+
+// ErrUnavailable is returned without calling the Dashboard while the circuit
+// breaker is open or when a call can't get a rate limit token in time
+var ErrUnavailable = errors.New("tyk dashboard unavailable")
+
+// clientGuard rate limits Dashboard calls and opens a circuit breaker after
+// a number of consecutive failures, failing calls fast until a cooldown has passed
+type clientGuard struct {
+	org     string
+	limiter *rate.Limiter
+	wait    time.Duration
+	timeout time.Duration
+
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newClientGuard(c *TykConf) *clientGuard {
+	g := &clientGuard{
+		wait:      c.RateLimitWait,
+		timeout:   c.CallTimeout,
+		threshold: c.BreakerThreshold,
+		cooldown:  c.BreakerCooldown,
+	}
+
+	if c.RateLimit > 0 {
+		burst := c.RateBurst
+		if burst < 1 {
+			burst = 1
+		}
+		g.limiter = rate.NewLimiter(rate.Limit(c.RateLimit), burst)
+	}
+
+	if g.wait == 0 {
+		g.wait = defaultRateLimitWait
+	}
+
+	if g.timeout == 0 {
+		g.timeout = defaultCallTimeout
+	}
+
+	if g.cooldown == 0 {
+		g.cooldown = defaultBreakerCooldown
+	}
+
+	return g
+}
+
+// do runs a call once the breaker and rate limit allow it, giving up when the
+// context is done or the call timeout passes. The call is passed a context
+// that is cancelled then, so its requests are cancelled with it.
+func (g *clientGuard) do(ctx context.Context, call func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	if g.threshold > 0 && time.Now().Before(g.openUntil) {
+		g.mu.Unlock()
+		return nil, fmt.Errorf("%w: circuit breaker open after %d consecutive failures", ErrUnavailable, g.failures)
+	}
+	g.mu.Unlock()
+
+	if g.limiter != nil {
+		wCtx, cancel := context.WithTimeout(ctx, g.wait)
+		err := g.limiter.Wait(wCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("%w: rate limit exceeded", ErrUnavailable)
+		}
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	type result struct {
+		val interface{}
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		val, err := call(callCtx)
+		done <- result{val, err}
+	}()
+
+	select {
+	case r := <-done:
+		g.record(r.err)
+		return r.val, r.err
+	case <-callCtx.Done():
+		// the caller giving up says nothing about the dashboard's health
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		err := fmt.Errorf("%w: call timed out after %v", ErrUnavailable, g.timeout)
+		g.record(err)
+		return nil, err
+	}
+}
+
+// traced runs a call through the guard in a span of its own, the time spent
+// waiting for a rate limit token is part of the span
+func (g *clientGuard) traced(ctx context.Context, op string, call func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	attrs := []attribute.KeyValue{attribute.String("tyk.operation", op)}
+	if g.org != "" {
+		attrs = append(attrs, attribute.String("tyk.org", g.org))
+	}
+
+	ctx, span := tracing.Start(ctx, "tyk."+op, attrs...)
+	val, err := g.do(ctx, call)
+	tracing.End(span, err)
+
+	return val, err
+}
+
+func (g *clientGuard) record(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !isServerFailure(err) {
+		g.failures = 0
+		return
+	}
+
+	g.failures++
+	if g.threshold > 0 && g.failures >= g.threshold {
+		// after the cooldown the next call probes the Dashboard, another
+		// failure re-opens the breaker straight away
+		log.Warningf("%d consecutive dashboard failures, failing calls for %v", g.failures, g.cooldown)
+		g.openUntil = time.Now().Add(g.cooldown)
+	}
+}
+
+// statusError is returned for the unexpected status codes of the requests
+// the controller makes itself, only 5xx codes count towards the breaker
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func statusErrorf(code int, format string, args ...interface{}) error {
+	return &statusError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// syncStatusRe matches the status codes the tyk-sync clients report in some
+// of their errors, the others only carry the response body
+var syncStatusRe = regexp.MustCompile(`\(code: (\d{3})\)`)
+
+// isServerFailure reports whether an error points at an unhealthy Dashboard:
+// a 5xx response, a timeout or a failure to reach it. Rejected requests, e.g.
+// a 4xx for an invalid definition or an existing certificate, don't count.
+func isServerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, ErrUnavailable) {
+		return true
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	if m := syncStatusRe.FindStringSubmatch(msg); m != nil {
+		return m[1][0] == '5'
+	}
+
+	// bodies of the errors proxies in front of the Dashboard answer with
+	for _, unhealthy := range []string{"internal server error", "bad gateway", "service unavailable", "gateway timeout"} {
+		if strings.Contains(msg, unhealthy) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// guardedClient routes all calls of a client through the guard, bound to the
+// context of the operation the client was created for
+type guardedClient struct {
+	interfaces.UniversalClient
+	guard *clientGuard
+	ctx   context.Context
+}
+
+// bound returns the client with its requests bound to the context of a call,
+// if it supports it
+func (c *guardedClient) bound(ctx context.Context) interfaces.UniversalClient {
+	if b, ok := c.UniversalClient.(interface {
+		bind(ctx context.Context) interfaces.UniversalClient
+	}); ok {
+		return b.bind(ctx)
+	}
+
+	return c.UniversalClient
+}
+
+func (c *guardedClient) CreateAPI(def *apidef.APIDefinition) (string, error) {
+	id, err := c.guard.traced(c.ctx, "CreateAPI", func(ctx context.Context) (interface{}, error) {
+		return c.bound(ctx).CreateAPI(def)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id.(string), nil
+}
+
+func (c *guardedClient) FetchAPIs() ([]objects.DBApiDefinition, error) {
+	apis, err := c.guard.traced(c.ctx, "FetchAPIs", func(ctx context.Context) (interface{}, error) {
+		return c.bound(ctx).FetchAPIs()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return apis.([]objects.DBApiDefinition), nil
+}
+
+func (c *guardedClient) UpdateAPI(def *apidef.APIDefinition) error {
+	_, err := c.guard.traced(c.ctx, "UpdateAPI", func(ctx context.Context) (interface{}, error) {
+		return nil, c.bound(ctx).UpdateAPI(def)
+	})
+
+	return err
+}
+
+func (c *guardedClient) DeleteAPI(id string) error {
+	_, err := c.guard.traced(c.ctx, "DeleteAPI", func(ctx context.Context) (interface{}, error) {
+		return nil, c.bound(ctx).DeleteAPI(id)
+	})
+
+	return err
+}
+
+func (c *guardedClient) CreateCertificate(cert []byte) (string, error) {
+	id, err := c.guard.traced(c.ctx, "CreateCertificate", func(ctx context.Context) (interface{}, error) {
+		return c.bound(ctx).CreateCertificate(cert)
+	})
+	if err != nil {
+		// the existing ID is reported in the error of duplicate certificates
+		return "", err
+	}
+
+	return id.(string), nil
+}
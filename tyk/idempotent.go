@@ -0,0 +1,169 @@
+package tyk
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+)
+
+// flightGroup collapses concurrent calls with the same key into one, and
+// shares the IDs they return with the calls made within the batch window,
+// so the pods of a rollout that are admitted one after another don't look
+// up the same APIs again
+type flightGroup struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*flightCall
+	done  map[string]flightResult
+}
+
+type flightCall struct {
+	done    chan struct{}
+	id      string
+	created bool
+	err     error
+}
+
+type flightResult struct {
+	id string
+	at time.Time
+}
+
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (string, bool, error)) (string, bool, error) {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = map[string]*flightCall{}
+			g.done = map[string]flightResult{}
+		}
+
+		if res, ok := g.done[key]; ok && time.Since(res.at) < g.window {
+			g.mu.Unlock()
+			return res.id, false, nil
+		}
+
+		c, ok := g.calls[key]
+		if !ok {
+			break
+		}
+		g.mu.Unlock()
+
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		}
+
+		// the caller that ran fn gave up, try again on behalf of this one
+		if isContextErr(c.err) && ctx.Err() == nil {
+			continue
+		}
+
+		// only the caller that ran fn created the API
+		return c.id, false, c.err
+	}
+
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.id, c.created, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	if c.err == nil && g.window > 0 {
+		g.done[key] = flightResult{id: c.id, at: time.Now()}
+	}
+	g.mu.Unlock()
+	close(c.done)
+
+	return c.id, c.created, c.err
+}
+
+// forget drops the shared IDs, the APIs they belong to may have been deleted
+func (g *flightGroup) forget() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.done = map[string]flightResult{}
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// CreateOrGetService returns the ID of the API with the slug of opts, adopting
+// or creating it if it does not exist. Concurrent calls for the same slug in
+// this process share one lookup and create, and duplicates created
+// concurrently by other replicas are removed so exactly one API per slug
+// survives.
+func (o *Org) CreateOrGetService(ctx context.Context, opts *APIDefOptions) (string, bool, error) {
+	return o.flights.do(ctx, cleanSlug(opts.Slug), func() (string, bool, error) {
+		if def, err := o.GetBySlug(ctx, opts.Slug); err == nil {
+			return ObjectID(def), false, nil
+		}
+
+		if id, err := o.adoptService(ctx, opts); err != nil || id != "" {
+			return id, false, err
+		}
+
+		id, err := o.CreateService(ctx, opts)
+		if err != nil {
+			return "", false, err
+		}
+
+		kept, err := o.dedupeSlug(ctx, opts.Slug)
+		if err != nil {
+			// the API was created, duplicates will be cleaned up by the next call
+			log.Warningf("failed to check %v for duplicates: %v", opts.Slug, err)
+			return id, true, nil
+		}
+
+		if kept != "" && kept != id {
+			log.Warningf("API %v was created concurrently elsewhere, using %v", opts.Slug, kept)
+			return kept, false, nil
+		}
+
+		return id, true, nil
+	})
+}
+
+// dedupeSlug deletes all but the first API by ID with a slug and returns the ID of the one kept
+func (o *Org) dedupeSlug(ctx context.Context, slug string) (string, error) {
+	// other replicas may have created the duplicates, bypass the lookup cache
+	cl := o.newClient(ctx)
+	all, err := cl.FetchAPIs()
+	if err != nil {
+		return "", err
+	}
+
+	cSlug := cleanSlug(slug)
+	matches := make([]objects.DBApiDefinition, 0, 1)
+	for _, s := range all {
+		if s.Slug == cSlug {
+			matches = append(matches, s)
+		}
+	}
+
+	if len(matches) == 0 {
+		return "", nil
+	}
+
+	defer o.lookups.invalidate()
+
+	// object IDs start with their creation time, CE API IDs are random but
+	// still give every replica the same survivor
+	sort.Slice(matches, func(i, j int) bool { return ObjectID(&matches[i]) < ObjectID(&matches[j]) })
+	for _, dup := range matches[1:] {
+		log.Warningf("removing duplicate API %v for slug %v", ObjectID(&dup), slug)
+		if err := cl.DeleteAPI(cl.GetActiveID(&dup.APIDefinition)); err != nil {
+			return "", err
+		}
+	}
+
+	return ObjectID(&matches[0]), nil
+}
@@ -0,0 +1,285 @@
+package tyk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MockClient is an in-memory Client for tests, API definitions are built
+// from the options directly instead of templates and annotations
+type MockClient struct {
+	mu sync.Mutex
+
+	// APIs by object ID and certificates by ID
+	APIs  map[string]*objects.DBApiDefinition
+	Certs map[string][]byte
+
+	// Err is returned by every call if set
+	Err error
+
+	// Adopt configures the adoption of APIs like in the Tyk config
+	Adopt AdoptConf
+
+	certSeq int
+}
+
+// NewMockClient creates an empty mock client
+func NewMockClient() *MockClient {
+	return &MockClient{
+		APIs:  map[string]*objects.DBApiDefinition{},
+		Certs: map[string][]byte{},
+	}
+}
+
+// Resolver resolves every object to the mock client
+func (m *MockClient) Resolver() Resolver {
+	return func(string, map[string]string) (Client, error) {
+		return m, nil
+	}
+}
+
+func (m *MockClient) CreateService(ctx context.Context, opts *APIDefOptions) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return "", m.Err
+	}
+
+	def := &objects.DBApiDefinition{}
+	def.Id = bson.NewObjectId()
+	def.APIID = uuid.NewV4().String()
+	def.Name = opts.Name
+	def.Slug = cleanSlug(opts.Slug)
+	def.Domain = opts.Hostname
+	def.Tags = opts.Tags
+	def.Certificates = opts.CertificateID
+	def.Proxy.ListenPath = opts.ListenPath
+	def.Proxy.TargetURL = opts.Target
+	opts.ChangeReason.Apply(&def.APIDefinition)
+	if opts.RedactBodies {
+		redactBodies(&def.APIDefinition)
+	}
+	RecordChecksum(&def.APIDefinition)
+
+	m.APIs[def.Id.Hex()] = def
+	return def.Id.Hex(), nil
+}
+
+func (m *MockClient) CreateOrGetService(ctx context.Context, opts *APIDefOptions) (string, bool, error) {
+	if def, err := m.GetBySlug(ctx, opts.Slug); err == nil {
+		return def.Id.Hex(), false, nil
+	}
+
+	if id, err := m.adoptService(ctx, opts); err != nil || id != "" {
+		return id, false, err
+	}
+
+	id, err := m.CreateService(ctx, opts)
+	return id, err == nil, err
+}
+
+func (m *MockClient) UpdateAPIs(ctx context.Context, svcs map[string]*APIDefOptions) error {
+	for _, opts := range svcs {
+		def, err := m.GetBySlug(ctx, opts.Slug)
+		if err != nil {
+			if _, _, err := m.CreateOrGetService(ctx, opts); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if Adopted(&def.APIDefinition) {
+			continue
+		}
+
+		def.Name = opts.Name
+		def.Domain = opts.Hostname
+		def.Proxy.ListenPath = opts.ListenPath
+		def.Proxy.TargetURL = opts.Target
+		opts.ChangeReason.Apply(&def.APIDefinition)
+		if opts.RedactBodies {
+			redactBodies(&def.APIDefinition)
+		}
+		RecordChecksum(&def.APIDefinition)
+		if err := m.UpdateAPI(ctx, &def.APIDefinition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// adoptService tags an API that wasn't created by the controller but
+// serves the route of opts with their slug and owner, if they may adopt it
+func (m *MockClient) adoptService(ctx context.Context, opts *APIDefOptions) (string, error) {
+	if !adopting(opts, &m.Adopt) {
+		return "", nil
+	}
+
+	all, err := m.FetchAPIs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	def := adoptable(all, "", opts)
+	if def == nil {
+		return "", nil
+	}
+
+	adopt(&def.APIDefinition, opts)
+	if err := m.UpdateAPI(ctx, &def.APIDefinition); err != nil {
+		return "", err
+	}
+
+	opts.AdoptedID = def.Id.Hex()
+	return opts.AdoptedID, nil
+}
+
+func (m *MockClient) UpdateAPI(ctx context.Context, def *apidef.APIDefinition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return m.Err
+	}
+
+	if _, ok := m.APIs[def.Id.Hex()]; !ok {
+		return fmt.Errorf("service with id %s not found", def.Id.Hex())
+	}
+
+	m.APIs[def.Id.Hex()] = &objects.DBApiDefinition{APIDefinition: *def}
+	return nil
+}
+
+func (m *MockClient) GetBySlug(ctx context.Context, slug string) (*objects.DBApiDefinition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	cSlug := cleanSlug(slug)
+	for _, def := range m.APIs {
+		if def.Slug == cSlug {
+			d := *def
+			return &d, nil
+		}
+	}
+
+	return nil, fmt.Errorf("service with name %s not found", slug)
+}
+
+func (m *MockClient) GetByObjectID(ctx context.Context, id string) (*objects.DBApiDefinition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	def, ok := m.APIs[id]
+	if !ok {
+		return nil, fmt.Errorf("service with id %s not found", id)
+	}
+
+	d := *def
+	return &d, nil
+}
+
+func (m *MockClient) FetchAPIs(ctx context.Context) ([]objects.DBApiDefinition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	all := make([]objects.DBApiDefinition, 0, len(m.APIs))
+	for _, def := range m.APIs {
+		all = append(all, *def)
+	}
+
+	return all, nil
+}
+
+func (m *MockClient) DeleteBySlug(ctx context.Context, slug string) error {
+	def, err := m.GetBySlug(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	return m.DeleteByID(ctx, def.Id.Hex())
+}
+
+func (m *MockClient) DeleteByID(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return m.Err
+	}
+
+	def, ok := m.APIs[id]
+	if !ok {
+		return fmt.Errorf("service with id %s not found", id)
+	}
+
+	if Release(&def.APIDefinition) {
+		return nil
+	}
+
+	delete(m.APIs, id)
+	return nil
+}
+
+func (m *MockClient) CreateCertificate(ctx context.Context, crt, key []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return "", m.Err
+	}
+
+	m.certSeq++
+	id := fmt.Sprintf("cert-%d", m.certSeq)
+	m.Certs[id] = append(append([]byte{}, crt...), key...)
+	return id, nil
+}
+
+func (m *MockClient) DeleteCertificate(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return m.Err
+	}
+
+	if _, ok := m.Certs[id]; !ok {
+		return fmt.Errorf("certificate %v not found", id)
+	}
+
+	delete(m.Certs, id)
+	return nil
+}
+
+func (m *MockClient) CertificateExists(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return false, m.Err
+	}
+
+	_, ok := m.Certs[id]
+	return ok, nil
+}
+
+var _ Client = &MockClient{}
@@ -0,0 +1,318 @@
+package tyk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/TykTechnologies/tyk/apidef"
+	"github.com/ghodss/yaml"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+)
+
+const (
+	// OpenAPIChecksumField of the config data of an API holds the checksum of
+	// the OpenAPI document it was imported from
+	OpenAPIChecksumField = "openapi_checksum"
+	// OpenAPIChecksumKey is the processor annotation setting it
+	OpenAPIChecksumKey = string(processor.ValueSetStringKey) + "config_data." + OpenAPIChecksumField
+
+	// OpenAPIMockExtension on an operation replies with a mock response
+	// instead of proxying, `{"code": 200, "body": "...", "headers": {...}}`
+	OpenAPIMockExtension = "x-tyk-mock-response"
+
+	whiteListPath    = "version_data.versions.Default.extended_paths.white_list"
+	validateJSONPath = "version_data.versions.Default.extended_paths.validate_json"
+
+	// max depth of nested local schema references
+	maxRefDepth = 32
+)
+
+// the operations of an OpenAPI path item
+var openAPIMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// openAPIDoc is the part of an OpenAPI 3 or Swagger 2 document that is imported
+type openAPIDoc struct {
+	OpenAPI string                                `json:"openapi"`
+	Swagger string                                `json:"swagger"`
+	Paths   map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+type openAPIOperation struct {
+	Parameters  []openAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema map[string]interface{} `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Mock *openAPIMock `json:"x-tyk-mock-response"`
+}
+
+type openAPIParameter struct {
+	In     string                 `json:"in"`
+	Schema map[string]interface{} `json:"schema"`
+}
+
+type openAPIMock struct {
+	Code    int               `json:"code"`
+	Body    interface{}       `json:"body"`
+	Headers map[string]string `json:"headers"`
+}
+
+// OpenAPIChecksum returns the checksum OpenAPI documents are tracked by
+func OpenAPIChecksum(doc []byte) string {
+	sum := sha256.Sum256(doc)
+	return hex.EncodeToString(sum[:])
+}
+
+// OpenAPIAnnotations imports an OpenAPI 3 or Swagger 2 document, JSON or
+// YAML, as processor annotations. The paths of the document become the
+// white list of the API, JSON request bodies are validated against their
+// schema and operations with a x-tyk-mock-response extension are mocked.
+// Local schema references are inlined since the gateway can't resolve them.
+func OpenAPIAnnotations(doc []byte) (map[string]string, error) {
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(doc, &raw); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %v", err)
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &openAPIDoc{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %v", err)
+	}
+
+	if spec.OpenAPI == "" && spec.Swagger == "" {
+		return nil, fmt.Errorf("not an OpenAPI document, openapi or swagger version missing")
+	}
+
+	if len(spec.Paths) == 0 {
+		return nil, fmt.Errorf("OpenAPI document has no paths")
+	}
+
+	// the gateway matches paths as prefixes, longer paths go first
+	paths := make([]string, 0, len(spec.Paths))
+	for p := range spec.Paths {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if len(paths[i]) != len(paths[j]) {
+			return len(paths[i]) > len(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+
+	white := make([]apidef.EndPointMeta, 0, len(paths))
+	validate := make([]apidef.ValidatePathMeta, 0)
+	for _, p := range paths {
+		meta := apidef.EndPointMeta{Path: p, MethodActions: map[string]apidef.EndpointMethodMeta{}}
+
+		for _, m := range openAPIMethods {
+			rawOp, ok := spec.Paths[p][strings.ToLower(m)]
+			if !ok {
+				continue
+			}
+
+			op := &openAPIOperation{}
+			if err := json.Unmarshal(rawOp, op); err != nil {
+				return nil, fmt.Errorf("invalid operation %v %v: %v", m, p, err)
+			}
+
+			action, err := mockAction(op.Mock)
+			if err != nil {
+				return nil, fmt.Errorf("%v %v: %v", m, p, err)
+			}
+			meta.MethodActions[m] = action
+
+			schema := bodySchema(op)
+			if schema == nil {
+				continue
+			}
+
+			inlined, err := inlineRefs(raw, schema, 0)
+			if err != nil {
+				return nil, fmt.Errorf("schema of %v %v: %v", m, p, err)
+			}
+
+			obj, ok := inlined.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("schema of %v %v is not an object", m, p)
+			}
+
+			validate = append(validate, apidef.ValidatePathMeta{
+				Path:              p,
+				Method:            m,
+				Schema:            obj,
+				ErrorResponseCode: http.StatusUnprocessableEntity,
+			})
+		}
+
+		if len(meta.MethodActions) > 0 {
+			white = append(white, meta)
+		}
+	}
+
+	if len(white) == 0 {
+		return nil, fmt.Errorf("OpenAPI document has no operations")
+	}
+
+	ann := map[string]string{OpenAPIChecksumKey: OpenAPIChecksum(doc)}
+
+	data, err = json.Marshal(white)
+	if err != nil {
+		return nil, err
+	}
+	ann[string(processor.ArraySetKey)+whiteListPath] = string(data)
+
+	if len(validate) > 0 {
+		data, err = json.Marshal(validate)
+		if err != nil {
+			return nil, err
+		}
+		ann[string(processor.ArraySetKey)+validateJSONPath] = string(data)
+	}
+
+	return ann, nil
+}
+
+// mockAction returns the white list action of an operation, a reply if it
+// declares a mock response
+func mockAction(mock *openAPIMock) (apidef.EndpointMethodMeta, error) {
+	if mock == nil {
+		return apidef.EndpointMethodMeta{Action: apidef.NoAction, Headers: map[string]string{}}, nil
+	}
+
+	code := mock.Code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if code < 100 || code > 599 {
+		return apidef.EndpointMethodMeta{}, fmt.Errorf("%v: invalid status code %v", OpenAPIMockExtension, code)
+	}
+
+	body := ""
+	switch b := mock.Body.(type) {
+	case nil:
+	case string:
+		body = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return apidef.EndpointMethodMeta{}, err
+		}
+		body = string(data)
+	}
+
+	headers := map[string]string{}
+	for k, v := range mock.Headers {
+		headers[k] = v
+	}
+
+	return apidef.EndpointMethodMeta{Action: apidef.Reply, Code: code, Data: body, Headers: headers}, nil
+}
+
+// bodySchema returns the JSON schema of the request body of an operation,
+// from the request body of OpenAPI 3 or the body parameter of Swagger 2
+func bodySchema(op *openAPIOperation) map[string]interface{} {
+	if op.RequestBody != nil {
+		for ct, c := range op.RequestBody.Content {
+			if strings.HasPrefix(ct, "application/json") && c.Schema != nil {
+				return c.Schema
+			}
+		}
+		return nil
+	}
+
+	for _, p := range op.Parameters {
+		if p.In == "body" && p.Schema != nil {
+			return p.Schema
+		}
+	}
+
+	return nil
+}
+
+// inlineRefs replaces local `#/...` references in a schema with the parts of
+// the document they point to
+func inlineRefs(doc map[string]interface{}, v interface{}, depth int) (interface{}, error) {
+	if depth > maxRefDepth {
+		return nil, fmt.Errorf("references nested deeper than %v, recursive schemas can't be validated", maxRefDepth)
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := t["$ref"].(string); ok {
+			target, err := lookupRef(doc, ref)
+			if err != nil {
+				return nil, err
+			}
+			return inlineRefs(doc, target, depth+1)
+		}
+
+		out := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			c, err := inlineRefs(doc, child, depth)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = c
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, child := range t {
+			c, err := inlineRefs(doc, child, depth)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+
+	return v, nil
+}
+
+// lookupRef resolves a JSON pointer into the document
+func lookupRef(doc map[string]interface{}, ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("only local references are supported, got %q", ref)
+	}
+
+	var cur interface{} = doc
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+
+		switch t := cur.(type) {
+		case map[string]interface{}:
+			next, ok := t[part]
+			if !ok {
+				return nil, fmt.Errorf("reference %q not found", ref)
+			}
+			cur = next
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, fmt.Errorf("reference %q not found", ref)
+			}
+			cur = t[i]
+		default:
+			return nil, fmt.Errorf("reference %q not found", ref)
+		}
+	}
+
+	return cur, nil
+}
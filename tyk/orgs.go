@@ -0,0 +1,221 @@
+package tyk
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OrgAnnotation selects the org an object's APIs are published in by name
+const OrgAnnotation = "tyk.io/org"
+
+// OrgConf holds the credentials of an additional organisation and the
+// namespaces whose APIs are published in it
+type OrgConf struct {
+	Name       string   `yaml:"name"`
+	URL        string   `yaml:"url"` // defaults to the top-level URL
+	Secret     string   `yaml:"secret"`
+	SecretRef  string   `yaml:"secretRef"` // namespace/name[/key] of a Secret holding the secret
+	Org        string   `yaml:"org"`
+	Namespaces []string `yaml:"namespaces"`
+
+	// AnnotationNamespaces may also select the org with the tyk.io/org
+	// annotation, "*" allows every namespace
+	AnnotationNamespaces []string `yaml:"annotationNamespaces"`
+}
+
+// Org is the Client of one organisation, each org has its own lookup cache,
+// rate limit and circuit breaker
+type Org struct {
+	Name string
+
+	// namespaces whose objects may select the org by annotation
+	annotationNS map[string]bool
+
+	conf    *TykConf
+	lookups *apiCache
+	guard   *clientGuard
+	flights *flightGroup
+	reloads *reloader
+
+	// calls the dashboard APIs the tyk-sync client doesn't cover, shared so
+	// connections are reused
+	http *http.Client
+}
+
+var (
+	orgs       map[string]*Org
+	nsOrgs     map[string]*Org
+	defaultOrg *Org
+	orgsMu     sync.RWMutex
+)
+
+func newOrg(name string, c *TykConf) *Org {
+	o := &Org{
+		Name:    name,
+		conf:    c,
+		lookups: &apiCache{},
+		guard:   newClientGuard(c),
+		flights: &flightGroup{window: c.BatchWindow},
+		reloads: newReloader(c),
+		http: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify},
+				IdleConnTimeout: 90 * time.Second,
+			},
+		},
+	}
+	o.lookups.setTTL(c.CacheTTL)
+	o.guard.org = name
+
+	return o
+}
+
+func initOrgs(c *TykConf) error {
+	byName, byNS, err := buildOrgs(c)
+	if err != nil {
+		return err
+	}
+
+	orgsMu.Lock()
+	defer orgsMu.Unlock()
+	orgs = byName
+	nsOrgs = byNS
+	defaultOrg = newOrg("", c)
+
+	// the orgs share the gateways, a burst of changes across them reloads once
+	for _, o := range byName {
+		o.reloads = defaultOrg.reloads
+	}
+
+	return nil
+}
+
+// buildOrgs creates the configured orgs by name and by namespace
+func buildOrgs(c *TykConf) (map[string]*Org, map[string]*Org, error) {
+	byName := map[string]*Org{}
+	byNS := map[string]*Org{}
+	for _, oc := range c.Orgs {
+		if oc.Name == "" {
+			return nil, nil, fmt.Errorf("orgs need a name")
+		}
+
+		if _, ok := byName[oc.Name]; ok {
+			return nil, nil, fmt.Errorf("duplicate org %v", oc.Name)
+		}
+
+		// everything but the credentials is shared with the default org
+		oConf := *c
+		oConf.Orgs = nil
+		oConf.Secret = oc.Secret
+		oConf.SecretRef = oc.SecretRef
+		oConf.Org = oc.Org
+		if oc.URL != "" {
+			oConf.URL = oc.URL
+		}
+
+		o := newOrg(oc.Name, &oConf)
+		o.annotationNS = map[string]bool{}
+		for _, ns := range oc.AnnotationNamespaces {
+			o.annotationNS[ns] = true
+		}
+		byName[oc.Name] = o
+		for _, ns := range oc.Namespaces {
+			if other, ok := byNS[ns]; ok {
+				return nil, nil, fmt.Errorf("namespace %v is mapped to both %v and %v", ns, other.Name, oc.Name)
+			}
+			byNS[ns] = o
+		}
+	}
+
+	return byName, byNS, nil
+}
+
+// Default returns the org configured at the top level
+func Default() *Org {
+	orgsMu.RLock()
+	defer orgsMu.RUnlock()
+	return defaultOrg
+}
+
+// Orgs returns the default org followed by the other configured orgs by name
+func Orgs() []*Org {
+	orgsMu.RLock()
+	defer orgsMu.RUnlock()
+
+	all := make([]*Org, 0, len(orgs)+1)
+	if defaultOrg != nil {
+		all = append(all, defaultOrg)
+	}
+
+	named := make([]*Org, 0, len(orgs))
+	for _, o := range orgs {
+		named = append(named, o)
+	}
+	sort.Slice(named, func(i, j int) bool { return named[i].Name < named[j].Name })
+
+	return append(all, named...)
+}
+
+// ForOrg returns a configured org by name, an empty name is the default org
+func ForOrg(name string) (*Org, error) {
+	if name == "" {
+		return Default(), nil
+	}
+
+	orgsMu.RLock()
+	defer orgsMu.RUnlock()
+	o, ok := orgs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown org %q", name)
+	}
+
+	return o, nil
+}
+
+// ClientFor is the Resolver of the configured orgs
+func ClientFor(namespace string, ann map[string]string) (Client, error) {
+	o, err := OrgFor(namespace, ann)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// OrgFor returns the org to publish the APIs of an object in, selected by
+// its namespace or else the default org. The tyk.io/org annotation can only
+// select the org of the namespace or an org that allows the namespace in its
+// annotationNamespaces, objects can't publish into the orgs of other teams.
+func OrgFor(namespace string, ann map[string]string) (*Org, error) {
+	orgsMu.RLock()
+	nsOrg, mapped := nsOrgs[namespace]
+	orgsMu.RUnlock()
+	if !mapped {
+		nsOrg = Default()
+	}
+
+	name, ok := ann[OrgAnnotation]
+	if !ok || name == nsOrg.Name {
+		return nsOrg, nil
+	}
+
+	o, err := ForOrg(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !o.annotationNS[namespace] && !o.annotationNS["*"] {
+		return nil, fmt.Errorf("org %q can't be selected by objects in namespace %v", name, namespace)
+	}
+
+	return o, nil
+}
+
+func TemplateService(opts *APIDefOptions) ([]byte, error) {
+	return Default().TemplateService(opts)
+}
@@ -0,0 +1,342 @@
+package tyk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+	"go.jlucktay.dev/tyk-k8s/tracing"
+)
+
+const (
+	// Rate limit of the API, `<requests>/<period>`, e.g. 100/60 or 100/1m
+	PolicyRateAnnotation = "policy.tyk.io/rate"
+	// Quota of the API, `<requests>/<period>`, e.g. 10000/day
+	PolicyQuotaAnnotation = "policy.tyk.io/quota"
+
+	// PolicyKey is the config_data key marking the APIs whose limits are
+	// bound by a policy
+	PolicyKey = "tyk_k8s_policy"
+
+	dashboardPoliciesPath = "/api/portal/policies"
+
+	// policies created for an API are tagged with its ID
+	policyTag       = "tyk-k8s"
+	policyAPITagFmt = "api:%s"
+)
+
+// named periods of the quota annotation, months are 30 days
+var quotaPeriods = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+}
+
+// Limits are the rate limit and quota declared in the annotations of an object
+type Limits struct {
+	Rate     float64
+	Per      time.Duration
+	QuotaMax int64
+	QuotaPer time.Duration
+}
+
+// policy is the part of a dashboard policy the limits are kept in
+type policy struct {
+	MID              string                     `json:"_id,omitempty"`
+	Name             string                     `json:"name"`
+	OrgID            string                     `json:"org_id"`
+	Rate             float64                    `json:"rate"`
+	Per              float64                    `json:"per"`
+	QuotaMax         int64                      `json:"quota_max"`
+	QuotaRenewalRate int64                      `json:"quota_renewal_rate"`
+	AccessRights     map[string]policyAccessDef `json:"access_rights"`
+	Partitions       map[string]bool            `json:"partitions"`
+	Active           bool                       `json:"active"`
+	Tags             []string                   `json:"tags"`
+}
+
+type policyAccessDef struct {
+	APIName  string   `json:"api_name"`
+	APIID    string   `json:"api_id"`
+	Versions []string `json:"versions"`
+}
+
+type policyList struct {
+	Data  []policy `json:"Data"`
+	Pages int      `json:"Pages"`
+}
+
+// parseLimit splits `<requests>/<period>`, periods are seconds, durations or
+// the names of quotaPeriods
+func parseLimit(key, v string) (float64, time.Duration, error) {
+	parts := strings.SplitN(v, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%v: %q must be <requests>/<period>", key, v)
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("%v: %q is not a positive number of requests", key, parts[0])
+	}
+
+	p := strings.ToLower(strings.TrimSpace(parts[1]))
+	per, ok := quotaPeriods[p]
+	if !ok {
+		if secs, err := strconv.Atoi(p); err == nil {
+			per = time.Duration(secs) * time.Second
+		} else if per, err = time.ParseDuration(p); err != nil {
+			return 0, 0, fmt.Errorf("%v: unknown period %q", key, parts[1])
+		}
+	}
+
+	if per < time.Second {
+		return 0, 0, fmt.Errorf("%v: the period must be at least a second", key)
+	}
+
+	return n, per, nil
+}
+
+// ParseLimits reads the rate limit and quota annotations, nil if neither is set
+func ParseLimits(ann map[string]string) (*Limits, error) {
+	rate, hasRate := ann[PolicyRateAnnotation]
+	quota, hasQuota := ann[PolicyQuotaAnnotation]
+	if !hasRate && !hasQuota {
+		return nil, nil
+	}
+
+	l := &Limits{}
+	if hasRate {
+		r, per, err := parseLimit(PolicyRateAnnotation, rate)
+		if err != nil {
+			return nil, err
+		}
+		l.Rate, l.Per = r, per
+	}
+
+	if hasQuota {
+		q, per, err := parseLimit(PolicyQuotaAnnotation, quota)
+		if err != nil {
+			return nil, err
+		}
+
+		if q != float64(int64(q)) {
+			return nil, fmt.Errorf("%v: the quota must be a whole number of requests", PolicyQuotaAnnotation)
+		}
+		l.QuotaMax, l.QuotaPer = int64(q), per
+	}
+
+	return l, nil
+}
+
+// limitAnnotations returns the processor annotations enforcing the limits.
+// The template defaults disable rate limits and quotas, keyless APIs get the
+// rate as their global rate limit since the policy only applies to keys.
+func limitAnnotations(l *Limits) map[string]string {
+	ann := map[string]string{}
+	if l == nil {
+		return ann
+	}
+
+	if l.Rate > 0 {
+		ann[string(processor.ValueSetBoolKey)+"disable_rate_limit"] = "false"
+		global, _ := json.Marshal(apidef.GlobalRateLimit{Rate: l.Rate, Per: l.Per.Seconds()})
+		ann[string(processor.ObjectSetKey)+"global_rate_limit"] = string(global)
+	}
+
+	if l.QuotaMax > 0 {
+		ann[string(processor.ValueSetBoolKey)+"disable_quota"] = "false"
+	}
+
+	return ann
+}
+
+// markPolicy records on an API whether a policy binds its limits, APIs that
+// never had limits don't need to look for a policy to remove
+func markPolicy(def *apidef.APIDefinition, l *Limits) {
+	if l == nil {
+		delete(def.ConfigData, PolicyKey)
+		return
+	}
+
+	if def.ConfigData == nil {
+		def.ConfigData = map[string]interface{}{}
+	}
+	def.ConfigData[PolicyKey] = true
+}
+
+// hasPolicy reports whether the limits of an API may be bound by a policy,
+// rate limited APIs from before the marker are looked at too
+func hasPolicy(def *apidef.APIDefinition) bool {
+	if _, ok := def.ConfigData[PolicyKey]; ok {
+		return true
+	}
+
+	return def.GlobalRateLimit.Rate > 0
+}
+
+// warnKeyless reports quotas on keyless APIs, policies only apply to keys
+// and keyless APIs have no global quota
+func warnKeyless(def *apidef.APIDefinition, l *Limits) {
+	if l != nil && l.QuotaMax > 0 && def.UseKeylessAccess {
+		log.Warningf("%v is keyless, its quota only applies to keys and is not enforced", def.Slug)
+	}
+}
+
+// policyFor returns the policy enforcing the limits on an API
+func policyFor(def *apidef.APIDefinition, l *Limits) *policy {
+	return &policy{
+		Name:             def.Slug,
+		OrgID:            def.OrgID,
+		Rate:             l.Rate,
+		Per:              l.Per.Seconds(),
+		QuotaMax:         l.QuotaMax,
+		QuotaRenewalRate: int64(l.QuotaPer.Seconds()),
+		AccessRights: map[string]policyAccessDef{
+			def.APIID: {APIName: def.Name, APIID: def.APIID, Versions: []string{"Default"}},
+		},
+		// only the declared limits are applied to the keys of the policy
+		Partitions: map[string]bool{
+			"acl":        true,
+			"rate_limit": l.Rate > 0,
+			"quota":      l.QuotaMax > 0,
+		},
+		Active: true,
+		Tags:   []string{policyTag, fmt.Sprintf(policyAPITagFmt, def.APIID)},
+	}
+}
+
+// apiPolicies returns the policies created for an API
+func (o *Org) apiPolicies(ctx context.Context, apiID string) ([]policy, error) {
+	list := &policyList{}
+	if err := o.policyRequest(ctx, http.MethodGet, "?p=-1", nil, list); err != nil {
+		return nil, err
+	}
+
+	tag := fmt.Sprintf(policyAPITagFmt, apiID)
+	pols := make([]policy, 0)
+	for _, p := range list.Data {
+		for _, t := range p.Tags {
+			if t == tag {
+				pols = append(pols, p)
+				break
+			}
+		}
+	}
+
+	return pols, nil
+}
+
+// syncPolicy creates or updates the policy enforcing the limits of an API,
+// or removes it once the limits are dropped. Gateways without a dashboard
+// have no policy API, only the global rate limit applies there.
+func (o *Org) syncPolicy(ctx context.Context, def *apidef.APIDefinition, l *Limits) error {
+	if o.conf.Mode == ModeCE {
+		if l != nil && l.QuotaMax > 0 {
+			log.Warningf("quotas require the dashboard, %v is only rate limited", def.Slug)
+		}
+		return nil
+	}
+
+	if l == nil && def.APIID == "" {
+		return nil
+	}
+
+	if def.APIID == "" {
+		return fmt.Errorf("API %v has no ID to bind a policy to", def.Slug)
+	}
+
+	_, err := o.guard.traced(ctx, "SyncPolicy", func(ctx context.Context) (interface{}, error) {
+		existing, err := o.apiPolicies(ctx, def.APIID)
+		if err != nil {
+			return nil, err
+		}
+
+		if l == nil {
+			for _, p := range existing {
+				log.Infof("limits of %v removed, deleting policy %v", def.Slug, p.MID)
+				if err := o.policyRequest(ctx, http.MethodDelete, "/"+url.PathEscape(p.MID), nil, nil); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		}
+
+		pol := policyFor(def, l)
+		if len(existing) > 0 {
+			pol.MID = existing[0].MID
+			return nil, o.policyRequest(ctx, http.MethodPut, "/"+url.PathEscape(pol.MID), pol, nil)
+		}
+
+		log.Infof("creating policy limiting %v", def.Slug)
+		return nil, o.policyRequest(ctx, http.MethodPost, "", pol, nil)
+	})
+
+	return err
+}
+
+// deletePolicies removes the policies created for a deleted API
+func (o *Org) deletePolicies(ctx context.Context, def *objects.DBApiDefinition) {
+	if o.conf.Mode == ModeCE || def == nil || def.APIID == "" || !hasPolicy(&def.APIDefinition) {
+		return
+	}
+
+	if err := o.syncPolicy(ctx, &def.APIDefinition, nil); err != nil {
+		log.Errorf("failed to delete the policies of %v: %v", def.Slug, err)
+	}
+}
+
+// policyRequest calls the policy API of the dashboard, decoding the response into out
+func (o *Org) policyRequest(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(o.conf.URL, "/")+dashboardPoliciesPath+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", o.secret())
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := o.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return statusErrorf(resp.StatusCode, "dashboard returned %v for %v %v: %s", resp.StatusCode, method, dashboardPoliciesPath+path, bytes.TrimSpace(data))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,149 @@
+package tyk
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReloadDebounce = 2 * time.Second
+	defaultReloadMaxDelay = 10 * time.Second
+)
+
+// ReloadConf asks a gateway group to hot reload after APIs are changed, so
+// new routes are live immediately instead of on the next poll of the
+// Dashboard. Bursts of changes, e.g. a Deployment scaling up, are batched
+// into one reload.
+type ReloadConf struct {
+	URL      string        `yaml:"url"`       // gateway API of the group, reloads are disabled if unset
+	Secret   string        `yaml:"secret"`    // secret of the gateway API
+	Debounce time.Duration `yaml:"debounce"`  // reload once no change was made for this long, 2s if unset
+	MaxDelay time.Duration `yaml:"max_delay"` // reload at the latest this long after the first change of a burst, 10s if unset
+}
+
+// Validate checks the reload settings
+func (c *ReloadConf) Validate() []error {
+	errs := make([]error, 0)
+	if c.URL == "" {
+		return errs
+	}
+
+	if u, err := url.Parse(c.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("reload.url: %q is not an absolute URL", c.URL))
+	}
+
+	if c.Debounce < 0 || c.MaxDelay < 0 {
+		errs = append(errs, fmt.Errorf("reload: debounce and maxDelay must not be negative"))
+	}
+
+	return errs
+}
+
+// reloader batches the reloads of a gateway group
+type reloader struct {
+	debounce time.Duration
+	maxDelay time.Duration
+	send     func() error
+
+	mu    sync.Mutex
+	timer *time.Timer
+	first time.Time // first change of the pending reload
+	gen   int
+}
+
+func newReloader(c *TykConf) *reloader {
+	rc := c.Reload
+	if rc.URL == "" {
+		return nil
+	}
+
+	r := &reloader{debounce: rc.Debounce, maxDelay: rc.MaxDelay}
+	if r.debounce == 0 {
+		r.debounce = defaultReloadDebounce
+	}
+	if r.maxDelay == 0 {
+		r.maxDelay = defaultReloadMaxDelay
+	}
+	r.send = func() error {
+		return reloadGroup(rc.URL, rc.Secret, c.InsecureSkipVerify)
+	}
+
+	return r
+}
+
+// trigger schedules a reload after the debounce period, postponing a pending
+// one unless it is due by the max delay. Calls on a nil reloader are no-ops.
+func (r *reloader) trigger() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.timer == nil {
+		r.first = now
+	} else {
+		r.timer.Stop()
+	}
+
+	delay := r.debounce
+	if due := r.first.Add(r.maxDelay).Sub(now); due < delay {
+		delay = due
+	}
+
+	r.gen++
+	gen := r.gen
+	r.timer = time.AfterFunc(delay, func() { r.fire(gen) })
+}
+
+func (r *reloader) fire(gen int) {
+	r.mu.Lock()
+	// superseded by a later trigger
+	if gen != r.gen {
+		r.mu.Unlock()
+		return
+	}
+	r.timer = nil
+	r.mu.Unlock()
+
+	if err := r.send(); err != nil {
+		log.Errorf("failed to hot reload the gateways, new routes are live on their next poll: %v", err)
+		return
+	}
+	log.Debug("hot reloaded the gateways")
+}
+
+// reloadGroup asks a gateway to hot reload its group
+func reloadGroup(gwURL, secret string, insecure bool) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(gwURL, "/")+reloadPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-tyk-authorization", secret)
+
+	cl := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reload gateway: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to reload gateway: %v", resp.Status)
+	}
+
+	return nil
+}
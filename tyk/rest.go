@@ -0,0 +1,366 @@
+package tyk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/TykTechnologies/tyk-sync/clients/interfaces"
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
+	"gopkg.in/mgo.v2/bson"
+
+	"go.jlucktay.dev/tyk-k8s/tracing"
+)
+
+const (
+	dashboardAPIsPath = "/api/apis"
+	gatewayAPIsPath   = "/tyk/apis/"
+)
+
+// restClient manages the APIs and certificates of an org through the API of
+// its dashboard, or of its gateway in "ce" mode. It follows the tyk-sync
+// clients, but its requests go through the shared client of the org and are
+// cancelled with the context the client is bound to.
+type restClient struct {
+	org *Org
+	ctx context.Context
+}
+
+var _ interfaces.UniversalClient = &restClient{}
+
+func newRESTClient(o *Org) *restClient {
+	return &restClient{org: o, ctx: context.Background()}
+}
+
+// bind returns a copy of the client whose requests are cancelled with ctx
+func (c *restClient) bind(ctx context.Context) interfaces.UniversalClient {
+	return &restClient{org: c.org, ctx: ctx}
+}
+
+func (c *restClient) ce() bool {
+	return c.org.conf.Mode == ModeCE
+}
+
+// SetInsecureTLS is a no-op, the shared client of the org is configured with
+// the TLS settings of the org
+func (c *restClient) SetInsecureTLS(bool) {}
+
+func (c *restClient) GetActiveID(def *apidef.APIDefinition) string {
+	if c.ce() {
+		return def.APIID
+	}
+
+	return def.Id.Hex()
+}
+
+func (c *restClient) FetchAPIs() ([]objects.DBApiDefinition, error) {
+	if c.ce() {
+		apis := []apidef.APIDefinition{}
+		if err := c.do(http.MethodGet, gatewayAPIsPath, nil, &apis); err != nil {
+			return nil, err
+		}
+
+		defs := make([]objects.DBApiDefinition, len(apis))
+		for i := range apis {
+			defs[i] = objects.DBApiDefinition{APIDefinition: apis[i]}
+		}
+
+		return defs, nil
+	}
+
+	apis := struct {
+		Apis []objects.DBApiDefinition `json:"apis"`
+	}{}
+	if err := c.do(http.MethodGet, dashboardAPIsPath+"?p=-2", nil, &apis); err != nil {
+		return nil, err
+	}
+
+	return apis.Apis, nil
+}
+
+func (c *restClient) CreateAPI(def *apidef.APIDefinition) (string, error) {
+	apis, err := c.FetchAPIs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, api := range apis {
+		if c.conflicts(&api.APIDefinition, def) {
+			return "", fmt.Errorf("API %v already exists, update it instead", c.GetActiveID(&api.APIDefinition))
+		}
+	}
+
+	if c.ce() {
+		status := struct {
+			Key     string `json:"key"`
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		}{}
+		body, err := definitionJSON(def, false)
+		if err != nil {
+			return "", err
+		}
+
+		if err := c.do(http.MethodPost, gatewayAPIsPath, body, &status); err != nil {
+			return "", err
+		}
+
+		if status.Status != "ok" {
+			return "", fmt.Errorf("API request completed, but with error: %v", status.Message)
+		}
+		c.reload()
+
+		return status.Key, nil
+	}
+
+	status := struct {
+		Status  string
+		Message string
+		Meta    string
+	}{}
+	body, err := definitionJSON(def, true)
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.do(http.MethodPost, dashboardAPIsPath, body, &status); err != nil {
+		return "", err
+	}
+
+	if status.Status != "OK" {
+		return "", fmt.Errorf("API request completed, but with error: %v", status.Message)
+	}
+
+	// the dashboard generates an API ID on create, an ID chosen by the
+	// controller is kept by updating the API
+	if def.APIID != "" && bson.IsObjectIdHex(status.Meta) {
+		def.Id = bson.ObjectIdHex(status.Meta)
+		if err := c.UpdateAPI(def); err != nil {
+			log.Warningf("failed to keep the API ID %v of %v: %v", def.APIID, def.Slug, err)
+		}
+	}
+
+	return status.Meta, nil
+}
+
+// conflicts reports whether an existing API has the ID, slug or route of a
+// new one, as the tyk-sync clients check before creating an API
+func (c *restClient) conflicts(api, def *apidef.APIDefinition) bool {
+	if api.APIID == def.APIID || api.Proxy.ListenPath == def.Proxy.ListenPath && (c.ce() || api.Domain == def.Domain) {
+		return true
+	}
+
+	return !c.ce() && (api.Id == def.Id || api.Slug == def.Slug)
+}
+
+func (c *restClient) UpdateAPI(def *apidef.APIDefinition) error {
+	apis, err := c.FetchAPIs()
+	if err != nil {
+		return err
+	}
+
+	if c.ce() {
+		found := false
+		for _, api := range apis {
+			found = found || api.APIID == def.APIID
+		}
+
+		if def.APIID == "" || !found {
+			return fmt.Errorf("API %v not found, create it instead", def.APIID)
+		}
+
+		body, err := definitionJSON(def, false)
+		if err != nil {
+			return err
+		}
+
+		if err := c.do(http.MethodPut, gatewayAPIsPath+url.PathEscape(def.APIID), body, nil); err != nil {
+			return err
+		}
+		c.reload()
+
+		return nil
+	}
+
+	found := false
+	for _, api := range apis {
+		// prefer API IDs, then object IDs, slugs and listen paths
+		switch {
+		case api.APIID == def.APIID:
+			def.Id = api.Id
+		case api.Id == def.Id, api.Slug == def.Slug, api.Proxy.ListenPath == def.Proxy.ListenPath:
+			if def.APIID == "" {
+				def.APIID = api.APIID
+			}
+			if def.Id == "" {
+				def.Id = api.Id
+			}
+		default:
+			continue
+		}
+
+		found = true
+		break
+	}
+
+	if !found {
+		return fmt.Errorf("API %v not found, create it instead", def.APIID)
+	}
+
+	status := struct {
+		Status  string
+		Message string
+	}{}
+	body, err := definitionJSON(def, true)
+	if err != nil {
+		return err
+	}
+
+	if err := c.do(http.MethodPut, dashboardAPIsPath+"/"+def.Id.Hex(), body, &status); err != nil {
+		return err
+	}
+
+	if status.Status != "OK" {
+		return fmt.Errorf("API request completed, but with error: %v", status.Message)
+	}
+
+	return nil
+}
+
+func (c *restClient) DeleteAPI(id string) error {
+	path := dashboardAPIsPath + "/"
+	if c.ce() {
+		path = gatewayAPIsPath
+	}
+
+	if err := c.do(http.MethodDelete, path+url.PathEscape(id), nil, nil); err != nil {
+		return err
+	}
+
+	if c.ce() {
+		c.reload()
+	}
+
+	return nil
+}
+
+func (c *restClient) CreateCertificate(cert []byte) (string, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	part, err := w.CreateFormFile("cert", "cert.pem")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := part.Write(cert); err != nil {
+		return "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	path := dashboardCertsPath
+	if c.ce() {
+		path = gatewayCertsPath
+	}
+
+	data, err := c.request(http.MethodPost, strings.TrimSuffix(path, "/"), w.FormDataContentType(), body)
+	if err != nil {
+		return "", err
+	}
+
+	resp := objects.CertResponse{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", err
+	}
+
+	if strings.ToLower(resp.Status) != "ok" {
+		return "", fmt.Errorf("API request completed, but with error: %v", resp.Message)
+	}
+
+	return resp.Id, nil
+}
+
+// reload asks the gateway to pick up the changed APIs in the background, as
+// the tyk-sync gateway client does
+func (c *restClient) reload() {
+	go func() {
+		if err := reloadGroup(c.org.conf.URL, c.org.secret(), c.org.conf.InsecureSkipVerify); err != nil {
+			log.Warning(err)
+		}
+	}()
+}
+
+// do sends in as JSON and decodes the response into out
+func (c *restClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	data, err := c.request(method, path, "application/json", body)
+	if err != nil || out == nil {
+		return err
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// request calls the API of the org, other status codes than 200 are returned as errors
+func (c *restClient) request(method, path, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(c.org.conf.URL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ce() {
+		req.Header.Set("x-tyk-authorization", c.org.secret())
+	} else {
+		req.Header.Set("Authorization", c.org.secret())
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	tracing.Inject(c.ctx, req.Header)
+
+	resp, err := c.org.http.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusErrorf(resp.StatusCode, "tyk returned %v for %v %v: %s", resp.StatusCode, method, path, bytes.TrimSpace(data))
+	}
+
+	return data, nil
+}
+
+// dbDefinition wraps a definition for the dashboard, which rejects a null
+// list of hook references
+func dbDefinition(def *apidef.APIDefinition) *objects.DBApiDefinition {
+	db := &objects.DBApiDefinition{APIDefinition: *def}
+	if db.HookReferences == nil {
+		db.HookReferences = make([]interface{}, 0)
+	}
+
+	return db
+}
@@ -0,0 +1,126 @@
+package tyk
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// SegmentTagsAnnotation sets the comma separated gateway tags of the APIs
+	// of an object, for pods the tags of their mesh routes and sidecars
+	SegmentTagsAnnotation = "tyk.io/segment-tags"
+
+	// Kinds of APIs tagged for a gateway group
+	SegmentIngress = "ingress" // ingresses and published services, loaded by the edge gateways
+	SegmentMesh    = "mesh"    // mesh routes, loaded by the sidecars
+)
+
+// the tags used unless configured otherwise
+var defaultSegmentTags = SegmentTags{
+	Ingress: []string{"ingress"},
+	Mesh:    []string{"mesh"},
+}
+
+// SegmentTags are the gateway tags of the APIs of a kind, gateways with
+// node_is_segmented set only load the APIs tagged with one of their tags
+type SegmentTags struct {
+	Ingress []string `yaml:"ingress"`
+	Mesh    []string `yaml:"mesh"`
+}
+
+// SegmentConf maps the objects APIs are published for to the gateway groups
+// loading them, e.g. internal and edge gateways
+type SegmentConf struct {
+	Default    SegmentTags            `yaml:"default"`    // tags of namespaces not listed, ingress and mesh if unset
+	Namespaces map[string]SegmentTags `yaml:"namespaces"` // tags by namespace, unset kinds use the default
+}
+
+func (t SegmentTags) of(kind string) []string {
+	if kind == SegmentMesh {
+		return t.Mesh
+	}
+	return t.Ingress
+}
+
+// Validate checks the configured tags, all problems found are returned
+func (c *SegmentConf) Validate() []error {
+	errs := make([]error, 0)
+	check := func(where string, t SegmentTags) {
+		for _, kind := range []string{SegmentIngress, SegmentMesh} {
+			for _, tag := range t.of(kind) {
+				if tag == "" || strings.ContainsAny(tag, ", ") {
+					errs = append(errs, fmt.Errorf("segments: %v %v tag %q must be a non-empty word", where, kind, tag))
+				}
+			}
+		}
+	}
+
+	check("default", c.Default)
+	for ns, t := range c.Namespaces {
+		check("namespace "+ns, t)
+	}
+
+	return errs
+}
+
+// segmentTags returns the configured tags of the APIs of a kind in a namespace
+func segmentTags(kind, namespace string) []string {
+	var conf SegmentConf
+	if cfg != nil {
+		conf = cfg.Segments
+	}
+
+	if t, ok := conf.Namespaces[namespace]; ok && len(t.of(kind)) > 0 {
+		return append([]string{}, t.of(kind)...)
+	}
+
+	if tags := conf.Default.of(kind); len(tags) > 0 {
+		return append([]string{}, tags...)
+	}
+
+	return append([]string{}, defaultSegmentTags.of(kind)...)
+}
+
+// ValidateSegments checks the tyk.io/segment-tags annotation of an object only
+// picks among the tags configured for the APIs of a kind in its namespace, so
+// objects can't put their APIs on, or load, the segments of other teams
+func ValidateSegments(kind, namespace string, ann map[string]string) error {
+	v, ok := ann[SegmentTagsAnnotation]
+	if !ok {
+		return nil
+	}
+
+	allowed := map[string]bool{}
+	for _, t := range segmentTags(kind, namespace) {
+		allowed[t] = true
+	}
+
+	denied := make([]string, 0)
+	for _, t := range list(v) {
+		if !allowed[t] {
+			denied = append(denied, t)
+		}
+	}
+
+	if len(denied) > 0 {
+		return fmt.Errorf("%v: %v tags %v are not configured for namespace %v", SegmentTagsAnnotation, kind, strings.Join(denied, ", "), namespace)
+	}
+
+	return nil
+}
+
+// Segments returns the gateway tags of the APIs of a kind published for an
+// object, from its tyk.io/segment-tags annotation if it only picks among the
+// tags of its namespace, else the tags configured for its namespace or the
+// default
+func Segments(kind, namespace string, ann map[string]string) []string {
+	if v, ok := ann[SegmentTagsAnnotation]; ok {
+		if err := ValidateSegments(kind, namespace, ann); err != nil {
+			log.Warningf("ignoring the segment tags of an object: %v", err)
+		} else if tags := list(v); len(tags) > 0 {
+			return tags
+		}
+	}
+
+	return segmentTags(kind, namespace)
+}
@@ -0,0 +1,68 @@
+package tyk
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"text/template"
+)
+
+// ErrTemplateNotFound is returned by template stores for unknown template names
+var ErrTemplateNotFound = errors.New("template not found")
+
+// TemplateStore provides the API definition templates referenced by name,
+// e.g. in the template.service.tyk.io annotation
+type TemplateStore interface {
+	Lookup(name string) (*template.Template, error)
+}
+
+var (
+	store   TemplateStore
+	storeMu sync.RWMutex
+)
+
+// SetTemplateStore replaces the template store, a nil store uses the built-in templates
+func SetTemplateStore(s TemplateStore) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	store = s
+}
+
+func templateStore() TemplateStore {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return store
+}
+
+// dirStore parses the *.json templates of a directory on first use, templates
+// are named after their file or any template they define
+type dirStore struct {
+	dir  string
+	once sync.Once
+	tpls *template.Template
+	err  error
+}
+
+// NewDirTemplateStore creates a template store reading from a directory
+func NewDirTemplateStore(dir string) TemplateStore {
+	return &dirStore{dir: dir}
+}
+
+func (d *dirStore) Lookup(name string) (*template.Template, error) {
+	d.once.Do(func() {
+		log.Info("loading templates from ", d.dir)
+		d.tpls, d.err = template.ParseGlob(path.Join(d.dir, "*.json"))
+	})
+
+	if d.err != nil || d.tpls == nil {
+		return nil, fmt.Errorf("no templates loaded: %v", d.err)
+	}
+
+	tpl := d.tpls.Lookup(name)
+	if tpl == nil {
+		return nil, ErrTemplateNotFound
+	}
+
+	return tpl, nil
+}
@@ -2,18 +2,18 @@ package tyk
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"path"
+	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/TykTechnologies/tyk/apidef"
 
-	"github.com/TykTechnologies/tyk-sync/clients/dashboard"
-	"github.com/TykTechnologies/tyk-sync/clients/gateway"
 	"github.com/TykTechnologies/tyk-sync/clients/interfaces"
 	"github.com/TykTechnologies/tyk-sync/clients/objects"
 	uuid "github.com/satori/go.uuid"
@@ -23,6 +23,11 @@ import (
 	"go.jlucktay.dev/tyk-k8s/processor"
 )
 
+// CleanSlug returns a slug as it is stored in the API definition
+func CleanSlug(s string) string {
+	return cleanSlug(s)
+}
+
 func cleanSlug(s string) string {
 	r, _ := regexp.Compile("[^a-zA-Z0-9-_/.]")
 	s = r.ReplaceAllString(s, "")
@@ -38,13 +43,97 @@ func cleanSlug(s string) string {
 }
 
 type TykConf struct {
+	// Mode is "pro" to manage APIs through the Dashboard or "ce" to manage
+	// them on an open-source gateway, through its REST API or, if APIDir is
+	// set, as file-based definitions in the gateway's app path
+	Mode   string `yaml:"mode"`
+	APIDir string `yaml:"api_dir"`
+
 	URL                string `yaml:"url"`
 	Secret             string `yaml:"secret"`
+	SecretRef          string `yaml:"secretRef"` // namespace/name[/key] of a Secret holding the secret, reloaded on change
 	Org                string `yaml:"org"`
 	Templates          string `yaml:"templates"`
-	IsGateway          bool   `yaml:"is_gateway"`
+	TemplatesConfigMap string `yaml:"templates_config_map"` // namespace/name of a ConfigMap holding templates
+	IsGateway          bool   `yaml:"is_gateway"`           // deprecated, same as mode "ce"
 	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
 	IsHybrid           bool   `yaml:"is_hybrid"`
+
+	// CacheTTL is how long API lookups by slug or ID are served from a cached
+	// API list, 0 disables caching
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+
+	// BatchWindow is how long the ID of an API created or looked up for a
+	// pod is shared with the pods of the same service admitted after it,
+	// e.g. during a rollout, 0 only shares it with concurrent admissions
+	BatchWindow time.Duration `yaml:"batch_window"`
+
+	// RateLimit caps Dashboard calls per second with bursts of RateBurst,
+	// calls waiting longer than RateLimitWait fail, 0 disables the limit
+	RateLimit     float64       `yaml:"rate_limit"`
+	RateBurst     int           `yaml:"rate_burst"`
+	RateLimitWait time.Duration `yaml:"rate_limit_wait"`
+
+	// BreakerThreshold consecutive failed calls open the circuit breaker,
+	// calls then fail fast for BreakerCooldown, 0 disables the breaker
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+
+	// CallTimeout bounds every Dashboard call, defaults to 30s
+	CallTimeout time.Duration `yaml:"call_timeout"`
+
+	// Orgs publish the APIs of some namespaces, or of objects annotated with
+	// tyk.io/org, into other organisations, all other settings are shared
+	Orgs []OrgConf `yaml:"orgs"`
+
+	// Analytics tags the analytics of the APIs with Kubernetes metadata
+	Analytics AnalyticsConf `yaml:"analytics"`
+
+	// Segments are the gateway tags of the APIs, by namespace
+	Segments SegmentConf `yaml:"segments"`
+
+	// Reload hot reloads a gateway group after APIs are changed
+	Reload ReloadConf `yaml:"reload"`
+
+	// Adopt lets objects take over APIs that weren't created by the controller
+	Adopt AdoptConf `yaml:"adopt"`
+}
+
+// Validate checks the connection settings, all problems found are returned
+func (c *TykConf) Validate() []error {
+	errs := make([]error, 0)
+
+	if c.Mode != "" && c.Mode != ModePro && c.Mode != ModeCE {
+		errs = append(errs, fmt.Errorf("mode: unknown mode %q, must be %q or %q", c.Mode, ModePro, ModeCE))
+	}
+
+	if c.URL == "" {
+		errs = append(errs, fmt.Errorf("url: required"))
+	} else if u, err := url.Parse(c.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("url: %q is not an absolute URL", c.URL))
+	}
+
+	if c.Secret == "" && c.SecretRef == "" {
+		errs = append(errs, fmt.Errorf("secret: required unless secretRef is set"))
+	}
+
+	if c.RateLimit < 0 || c.RateBurst < 0 || c.BreakerThreshold < 0 {
+		errs = append(errs, fmt.Errorf("rateLimit, rateBurst and breakerThreshold must not be negative"))
+	}
+
+	if c.BatchWindow < 0 {
+		errs = append(errs, fmt.Errorf("batchWindow: must not be negative"))
+	}
+
+	if _, _, err := buildOrgs(c); err != nil {
+		errs = append(errs, fmt.Errorf("orgs: %v", err))
+	}
+
+	errs = append(errs, c.Segments.Validate()...)
+	errs = append(errs, c.Reload.Validate()...)
+	errs = append(errs, c.Adopt.Validate()...)
+
+	return errs
 }
 
 type APIDefOptions struct {
@@ -60,13 +149,33 @@ type APIDefOptions struct {
 	LegacyAPIDef  *objects.DBApiDefinition
 	Annotations   map[string]string
 	CertificateID []string
+	ChangeReason  *ChangeReason
+	OrgID         string // set from the org the API is published in
+	AdoptedID     string // set to the object ID of an existing API adopted for the options
+	Mesh          bool   // a mesh or inbound route of the injector, its requests aren't tagged with analytics headers
+	RedactBodies  bool   // never record the request and response bodies of the API in analytics
+
+	// metadata of the object the API is published for, available to
+	// templates and to Go template expressions in annotation values
+	Namespace   string
+	Labels      map[string]string
+	ServiceName string
+	ServicePort int32
 }
 
 var (
-	cfg                     *TykConf
-	log                     = logger.GetLogger("tyk-api")
-	templates               *template.Template
+	cfg *TykConf
+	log = logger.GetLogger("tyk-api")
+
+	// templates are parsed lazily on first use and shared read-only
+	// afterwards, executing a parsed template is safe for concurrent use
 	defaultIngressTemplates *template.Template
+	defaultTemplatesOnce    sync.Once
+)
+
+const (
+	ModePro = "pro"
+	ModeCE  = "ce"
 )
 
 const (
@@ -77,8 +186,6 @@ const (
 )
 
 func Init(forceConf *TykConf) {
-	defaultIngressTemplates = template.Must(template.New("default").Parse(apiTemplates))
-
 	if forceConf != nil {
 		cfg = forceConf
 	}
@@ -91,9 +198,25 @@ func Init(forceConf *TykConf) {
 		}
 	}
 
+	switch {
+	case cfg.Mode == "" && cfg.IsGateway:
+		cfg.Mode = ModeCE
+	case cfg.Mode == "":
+		cfg.Mode = ModePro
+	case cfg.Mode != ModePro && cfg.Mode != ModeCE:
+		log.Fatalf("unknown mode %q, must be %q or %q", cfg.Mode, ModePro, ModeCE)
+	}
+	cfg.IsGateway = cfg.Mode == ModeCE
+
+	if err := initOrgs(cfg); err != nil {
+		log.Fatalf("failed to load orgs: %v", err)
+	}
+
+	// previously parsed templates are dropped, they are re-parsed on first use
+	SetTemplateStore(nil)
 	if cfg.Templates != "" {
-		log.Info("template directory detected, loading from ", cfg.Templates)
-		templates = template.Must(template.ParseGlob(path.Join(cfg.Templates, "*.json")))
+		log.Info("template directory detected, templates will be loaded from ", cfg.Templates)
+		SetTemplateStore(NewDirTemplateStore(cfg.Templates))
 	}
 
 	if cfg.InsecureSkipVerify {
@@ -101,46 +224,162 @@ func Init(forceConf *TykConf) {
 	}
 }
 
-func newClient() interfaces.UniversalClient {
+func (o *Org) newClient(ctx context.Context) interfaces.UniversalClient {
 	var cl interfaces.UniversalClient
-	var err error
+	if o.conf.Mode == ModeCE && o.conf.APIDir != "" {
+		fc := newFileClient(o.conf.APIDir, o.conf.URL, o.secret())
+		fc.SetInsecureTLS(o.conf.InsecureSkipVerify)
+		cl = fc
+	} else {
+		cl = newRESTClient(o)
+	}
 
-	cl, err = dashboard.NewDashboardClient(cfg.URL, cfg.Secret)
-	if cfg.IsGateway {
-		cl, err = gateway.NewGatewayClient(cfg.URL, cfg.Secret)
+	if o.conf.InsecureSkipVerify {
+		log.Warn("TLS certificate will not be verified")
 	}
 
+	return &guardedClient{UniversalClient: cl, guard: o.guard, ctx: ctx}
+}
+
+func defaultTemplates() *template.Template {
+	defaultTemplatesOnce.Do(func() {
+		defaultIngressTemplates = template.Must(template.New("default").Parse(apiTemplates))
+	})
+
+	return defaultIngressTemplates
+}
+
+// defaultTemplate returns a built-in template by name
+func defaultTemplate(name string) (*template.Template, error) {
+	tpl := defaultTemplates().Lookup(name)
+	if tpl == nil {
+		return nil, ErrTemplateNotFound
+	}
+
+	return tpl, nil
+}
+
+// getTemplate returns a template of the template store, the built-in
+// templates stand in for the ones it doesn't have
+func getTemplate(name string) (*template.Template, error) {
+	st := templateStore()
+	if st == nil {
+		return defaultTemplate(name)
+	}
+
+	tpl, err := st.Lookup(name)
+	if err == ErrTemplateNotFound {
+		if def, defErr := defaultTemplate(name); defErr == nil {
+			log.Debugf("template %v is not in the template store, using the built-in one", name)
+			return def, nil
+		}
+	}
 	if err != nil {
-		log.Fatalf("failed to create tyk API client: %v", err)
+		return nil, err
 	}
 
-	if cfg.InsecureSkipVerify {
-		log.Warn("TLS certificate will not be verified")
-		cl.SetInsecureTLS(cfg.InsecureSkipVerify)
+	return tpl, nil
+}
+
+func templateVars(opts *APIDefOptions) map[string]interface{} {
+	return map[string]interface{}{
+		"Name":          opts.Name,
+		"Slug":          opts.Slug,
+		"Org":           opts.OrgID,
+		"ListenPath":    opts.ListenPath,
+		"Target":        opts.Target,
+		"GatewayTags":   opts.Tags,
+		"HostName":      opts.Hostname,
+		"CertificateID": opts.CertificateID,
+		"Namespace":     opts.Namespace,
+		"Labels":        opts.Labels,
+		"ServiceName":   opts.ServiceName,
+		"ServicePort":   opts.ServicePort,
 	}
+}
 
-	return cl
+// renderAnnotations executes Go template expressions in processor annotation
+// values, e.g. `/{{ .Namespace }}/{{ .Labels.app }}`, with the template variables
+func renderAnnotations(opts *APIDefOptions) (map[string]string, error) {
+	if opts.Annotations == nil {
+		return nil, nil
+	}
+
+	vars := templateVars(opts)
+	out := make(map[string]string, len(opts.Annotations))
+	for k, v := range opts.Annotations {
+		out[k] = v
+	}
+
+	for k, v := range processor.Filter(opts.Annotations) {
+		if !strings.Contains(v, "{{") {
+			continue
+		}
+
+		tpl, err := template.New(k).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("annotation %v: %v", k, err)
+		}
+
+		var rendered bytes.Buffer
+		if err := tpl.Execute(&rendered, vars); err != nil {
+			return nil, fmt.Errorf("annotation %v: %v", k, err)
+		}
+
+		out[k] = rendered.String()
+	}
+
+	return out, nil
 }
 
-func getTemplate(name string) (*template.Template, error) {
-	if cfg.Templates == "" {
-		log.Warning("using default template")
-		return defaultIngressTemplates, nil
+// apiAnnotations renders the annotations of an API and adds the processor
+// annotations generated for its limits, authentication, type and analytics
+// tags, explicit processor annotations take precedence over generated ones
+func apiAnnotations(ctx context.Context, opts *APIDefOptions) (map[string]string, *Limits, error) {
+	ann, err := renderAnnotations(opts)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if templates == nil {
-		return defaultIngressTemplates, errors.New("no templates loaded")
+	limits, err := ParseLimits(ann)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	tpl := templates.Lookup(name)
-	if tpl == nil {
-		return defaultIngressTemplates, errors.New("template not found")
+	auth, err := authAnnotations(ann)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return tpl, nil
+	gql, err := graphQLAnnotations(ctx, opts.Target, ann)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tags, err := analyticsAnnotations(&cfg.Analytics, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := make(map[string]string, len(ann))
+	for _, gen := range []map[string]string{limitAnnotations(limits), auth, gql, tags} {
+		for k, v := range gen {
+			out[k] = v
+		}
+	}
+
+	for k, v := range ann {
+		out[k] = v
+	}
+
+	return out, limits, nil
 }
 
-func TemplateService(opts *APIDefOptions) ([]byte, error) {
+func (o *Org) TemplateService(opts *APIDefOptions) ([]byte, error) {
+	if opts.OrgID == "" {
+		opts.OrgID = o.conf.Org
+	}
+
 	if opts.TemplateName == "" {
 		opts.TemplateName = DefaultIngressTemplate
 	}
@@ -151,26 +390,15 @@ func TemplateService(opts *APIDefOptions) ([]byte, error) {
 		return nil, err
 	}
 	// In hybrid gateway we want slug to be a human readable path - not the Ingress ID
-	if cfg.IsHybrid {
+	if o.conf.IsHybrid {
 		log.Debug("Hybrid gateway. Slug set from listen path.")
 		opts.Slug = opts.ListenPath
 	} else {
 		opts.Slug = cleanSlug(opts.Slug)
 	}
 
-	tplVars := map[string]interface{}{
-		"Name":          opts.Name,
-		"Slug":          opts.Slug,
-		"Org":           cfg.Org,
-		"ListenPath":    opts.ListenPath,
-		"Target":        opts.Target,
-		"GatewayTags":   opts.Tags,
-		"HostName":      opts.Hostname,
-		"CertificateID": opts.CertificateID,
-	}
-
 	var apiDefStr bytes.Buffer
-	err = defTpl.Execute(&apiDefStr, tplVars)
+	err = defTpl.Execute(&apiDefStr, templateVars(opts))
 	if err != nil {
 		return nil, err
 	}
@@ -178,8 +406,8 @@ func TemplateService(opts *APIDefOptions) ([]byte, error) {
 	return apiDefStr.Bytes(), nil
 }
 
-func CreateCertificate(crt, key []byte) (string, error) {
-	cl := newClient()
+func (o *Org) CreateCertificate(ctx context.Context, crt, key []byte) (string, error) {
+	cl := o.newClient(ctx)
 	combined := make([]byte, 0)
 	combined = append(combined, crt...)
 	combined = append(combined, key...)
@@ -202,41 +430,66 @@ func CreateCertificate(crt, key []byte) (string, error) {
 	return id, nil
 }
 
-func CreateService(opts *APIDefOptions) (string, error) {
+func (o *Org) CreateService(ctx context.Context, opts *APIDefOptions) (string, error) {
 	adBytes, err := TemplateService(opts)
 	if err != nil {
 		return "", err
 	}
 
-	postProcessedDef := string(adBytes)
-	log.Debug(postProcessedDef)
-	if opts.Annotations != nil {
-		postProcessedDef, err = processor.Process(opts.Annotations, string(adBytes))
-		if err != nil {
-			return "", err
-		}
+	log.Debug(string(adBytes))
+	ann, limits, err := apiAnnotations(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if err := processor.Validate(ann, string(adBytes)); err != nil {
+		return "", err
 	}
 
 	apiDef := objects.NewDefinition()
-	err = json.Unmarshal([]byte(postProcessedDef), apiDef)
+	err = processor.ProcessInto(ann, adBytes, apiDef)
 	if err != nil {
 		return "", err
 	}
 
-	cl := newClient()
+	opts.ChangeReason.Apply(apiDef)
+	if opts.RedactBodies {
+		redactBodies(apiDef)
+	}
+	markPolicy(apiDef, limits)
+	warnKeyless(apiDef, limits)
+	RecordChecksum(apiDef)
+
+	cl := o.newClient(ctx)
 
-	// IDs are not generated by the GW
-	_, isGW := cl.(*gateway.Client)
-	if isGW {
+	// IDs are not generated by the GW, policies of the dashboard are bound
+	// to the API ID so it is set up front instead of reading the API back
+	if o.conf.Mode == ModeCE {
 		log.Warning("setting new API ID for gateway")
 		apiDef.APIID = uuid.NewV4().String()
+	} else if limits != nil {
+		apiDef.APIID = strings.Replace(uuid.NewV4().String(), "-", "", -1)
 	}
 
-	return cl.CreateAPI(apiDef)
+	defer o.lookups.invalidate()
+	id, err := cl.CreateAPI(apiDef)
+	if err != nil {
+		return "", err
+	}
+	o.reloads.trigger()
+
+	// the API is in place, a missing policy is reported and bound on its next update
+	if limits != nil {
+		if err := o.syncPolicy(ctx, apiDef, limits); err != nil {
+			log.Errorf("failed to bind the limits of %v: %v", apiDef.Slug, err)
+		}
+	}
+
+	return id, nil
 }
 
-func DeleteBySlug(slug string) error {
-	cl := newClient()
+func (o *Org) DeleteBySlug(ctx context.Context, slug string) error {
+	cl := o.newClient(ctx)
 
 	allServices, err := cl.FetchAPIs()
 	if err != nil {
@@ -246,22 +499,36 @@ func DeleteBySlug(slug string) error {
 	cSlug := cleanSlug(slug)
 	for _, s := range allServices {
 		if cSlug == s.Slug {
-			log.Warning("found API entry, deleting: ", s.Id.Hex())
-			return cl.DeleteAPI(cl.GetActiveID(&s.APIDefinition))
+			if Release(&s.APIDefinition) {
+				return o.release(cl, &s)
+			}
+
+			log.Warning("found API entry, deleting: ", ObjectID(&s))
+			defer o.lookups.invalidate()
+			if err := cl.DeleteAPI(cl.GetActiveID(&s.APIDefinition)); err != nil {
+				return err
+			}
+			o.reloads.trigger()
+			o.flights.forget()
+
+			o.deletePolicies(ctx, &s)
+			return nil
 		}
 	}
 
 	return fmt.Errorf("service with name %s not found for removal, remove manually", slug)
 }
 
-func UpdateAPIs(svcs map[string]*APIDefOptions) error {
-	cl := newClient()
+func (o *Org) UpdateAPIs(ctx context.Context, svcs map[string]*APIDefOptions) error {
+	cl := o.newClient(ctx)
 
 	allServices, err := cl.FetchAPIs()
 	if err != nil {
 		return err
 	}
 
+	defer o.lookups.invalidate()
+
 	errs := make([]error, 0)
 	toUpdate := map[string]*APIDefOptions{}
 	toCreate := map[string]*APIDefOptions{}
@@ -269,16 +536,17 @@ func UpdateAPIs(svcs map[string]*APIDefOptions) error {
 	// To update
 	for ingressID, o := range svcs {
 		cSlug := cleanSlug(ingressID)
-		for _, s := range allServices {
-			if cSlug == s.Slug {
-				o.LegacyAPIDef = &s
+		for i := range allServices {
+			if cSlug == allServices[i].Slug {
+				o.LegacyAPIDef = &allServices[i]
 				toUpdate[cSlug] = o
 			}
 		}
 	}
 
-	// To create
-	for ingressID, o := range svcs {
+	// To create, unless an API of the route that wasn't created by the
+	// controller can be adopted
+	for ingressID, opts := range svcs {
 		cSlug := cleanSlug(ingressID)
 		_, updatingAlready := toUpdate[cSlug]
 		if updatingAlready {
@@ -286,54 +554,39 @@ func UpdateAPIs(svcs map[string]*APIDefOptions) error {
 			continue
 		}
 
-		toCreate[cSlug] = o
-	}
-
-	for _, opts := range toUpdate {
-		adBytes, err := TemplateService(opts)
-		if err != nil {
-			errs = append(errs, err)
-			continue
-		}
-
-		postProcessedDef := string(adBytes)
-		log.Debug(postProcessedDef)
-		if opts.Annotations != nil {
-			postProcessedDef, err = processor.Process(opts.Annotations, string(adBytes))
-			if err != nil {
-				errs = append(errs, err)
+		if adopting(opts, &o.conf.Adopt) {
+			if def := adoptable(allServices, o.conf.Org, opts); def != nil {
+				if err := o.adopt(cl, def, opts); err != nil {
+					errs = append(errs, err)
+				}
 				continue
 			}
 		}
 
-		apiDef := objects.NewDefinition()
-		err = json.Unmarshal(adBytes, apiDef)
-		if err != nil {
-			errs = append(errs, err)
+		toCreate[cSlug] = opts
+	}
+
+	for _, opts := range toUpdate {
+		// adopted APIs keep the definition they were created with
+		if Adopted(&opts.LegacyAPIDef.APIDefinition) {
 			continue
 		}
 
-		// Retain identity
-		apiDef.Id = opts.LegacyAPIDef.Id
-		apiDef.APIID = opts.LegacyAPIDef.APIID
-		apiDef.OrgID = opts.LegacyAPIDef.OrgID
-
-		err = cl.UpdateAPI(apiDef)
-		if err != nil {
+		if err := o.replaceService(ctx, cl, opts); err != nil {
 			errs = append(errs, err)
-			continue
 		}
-
 	}
 
 	for _, opts := range toCreate {
-		id, err := CreateService(opts)
+		id, created, err := o.CreateOrGetService(ctx, opts)
 		if err != nil {
 			errs = append(errs, err)
 			continue
 		}
 
-		log.Info("created: ", id)
+		if created {
+			log.Info("created: ", id)
+		}
 	}
 
 	if len(errs) > 0 {
@@ -351,10 +604,68 @@ func UpdateAPIs(svcs map[string]*APIDefOptions) error {
 	return nil
 }
 
-func GetBySlug(slug string) (*objects.DBApiDefinition, error) {
-	cl := newClient()
+// replaceService templates the API of opts over its LegacyAPIDef, keeping
+// the identity of the existing API
+func (o *Org) replaceService(ctx context.Context, cl interfaces.UniversalClient, opts *APIDefOptions) error {
+	adBytes, err := TemplateService(opts)
+	if err != nil {
+		return err
+	}
 
-	allServices, err := cl.FetchAPIs()
+	log.Debug(string(adBytes))
+	ann, limits, err := apiAnnotations(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := processor.Validate(ann, string(adBytes)); err != nil {
+		return err
+	}
+
+	apiDef := objects.NewDefinition()
+	err = processor.ProcessInto(ann, adBytes, apiDef)
+	if err != nil {
+		return err
+	}
+
+	// Retain identity
+	apiDef.Id = opts.LegacyAPIDef.Id
+	apiDef.APIID = opts.LegacyAPIDef.APIID
+	apiDef.OrgID = opts.LegacyAPIDef.OrgID
+
+	// the load balanced targets are set by the controller, e.g. to the pods
+	// of a mesh route or a canary split, not by the template
+	if len(apiDef.Proxy.Targets) == 0 && len(opts.LegacyAPIDef.Proxy.Targets) > 0 {
+		apiDef.Proxy.EnableLoadBalancing = opts.LegacyAPIDef.Proxy.EnableLoadBalancing
+		apiDef.Proxy.Targets = opts.LegacyAPIDef.Proxy.Targets
+	}
+	opts.ChangeReason.Apply(apiDef)
+	if opts.RedactBodies {
+		redactBodies(apiDef)
+	}
+	markPolicy(apiDef, limits)
+	warnKeyless(apiDef, limits)
+	RecordChecksum(apiDef)
+
+	err = cl.UpdateAPI(apiDef)
+	if err != nil {
+		return err
+	}
+	o.reloads.trigger()
+
+	// APIs that had no limits before have no policy to look for
+	if limits == nil && !hasPolicy(&opts.LegacyAPIDef.APIDefinition) {
+		return nil
+	}
+	if err := o.syncPolicy(ctx, apiDef, limits); err != nil {
+		return fmt.Errorf("failed to bind the limits of %v: %w", apiDef.Slug, err)
+	}
+
+	return nil
+}
+
+func (o *Org) GetBySlug(ctx context.Context, slug string) (*objects.DBApiDefinition, error) {
+	allServices, err := o.lookups.fetch(o.newClient(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -369,21 +680,47 @@ func GetBySlug(slug string) (*objects.DBApiDefinition, error) {
 	return nil, fmt.Errorf("service with name %s not found", slug)
 }
 
-func DeleteByID(id string) error {
-	cl := newClient()
-	return cl.DeleteAPI(id)
+// ObjectID is the ID of an API as accepted by GetByObjectID and DeleteByID,
+// the Dashboard object ID or, in CE mode, the API ID
+func ObjectID(def *objects.DBApiDefinition) string {
+	if cfg != nil && cfg.Mode == ModeCE {
+		return def.APIID
+	}
+
+	return def.Id.Hex()
 }
 
-func GetByObjectID(id string) (*objects.DBApiDefinition, error) {
-	cl := newClient()
+func (o *Org) DeleteByID(ctx context.Context, id string) error {
+	// the API ID policies are bound to is only known from the definition
+	def, _ := o.GetByObjectID(ctx, id)
+	defer o.lookups.invalidate()
 
-	allServices, err := cl.FetchAPIs()
+	cl := o.newClient(ctx)
+	if def != nil && Release(&def.APIDefinition) {
+		return o.release(cl, def)
+	}
+
+	if o.conf.Mode == ModeCE {
+		def = nil
+	}
+	if err := cl.DeleteAPI(id); err != nil {
+		return err
+	}
+	o.reloads.trigger()
+	o.flights.forget()
+
+	o.deletePolicies(ctx, def)
+	return nil
+}
+
+func (o *Org) GetByObjectID(ctx context.Context, id string) (*objects.DBApiDefinition, error) {
+	allServices, err := o.lookups.fetch(o.newClient(ctx))
 	if err != nil {
 		return nil, err
 	}
 
 	for _, s := range allServices {
-		if id == s.Id.Hex() {
+		if id == ObjectID(&s) {
 			return &s, nil
 		}
 	}
@@ -391,7 +728,18 @@ func GetByObjectID(id string) (*objects.DBApiDefinition, error) {
 	return nil, fmt.Errorf("service with id %s not found", id)
 }
 
-func UpdateAPI(def *apidef.APIDefinition) error {
-	cl := newClient()
-	return cl.UpdateAPI(def)
+func (o *Org) FetchAPIs(ctx context.Context) ([]objects.DBApiDefinition, error) {
+	return o.newClient(ctx).FetchAPIs()
+}
+
+func (o *Org) UpdateAPI(ctx context.Context, def *apidef.APIDefinition) error {
+	defer o.lookups.invalidate()
+
+	cl := o.newClient(ctx)
+	if err := cl.UpdateAPI(def); err != nil {
+		return err
+	}
+
+	o.reloads.trigger()
+	return nil
 }
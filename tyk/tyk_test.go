@@ -2,9 +2,33 @@ package tyk
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/TykTechnologies/tyk-sync/clients/objects"
+	"github.com/TykTechnologies/tyk/apidef"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/mgo.v2/bson"
+
+	"go.jlucktay.dev/tyk-k8s/processor"
+	"go.jlucktay.dev/tyk-k8s/tracing"
 )
 
 func TestInit(t *testing.T) {
@@ -15,7 +39,7 @@ func TestInit(t *testing.T) {
 	}
 
 	Init(nil)
-	newClient()
+	Default().newClient(context.Background())
 }
 
 var sampleConf = `
@@ -33,3 +57,1442 @@ Injector:
   createRoutes: false
 
 `
+
+func BenchmarkTemplateService(b *testing.B) {
+	Init(&TykConf{Org: "1"})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := TemplateService(&APIDefOptions{
+			Name:         fmt.Sprintf("svc-%d", i%5000),
+			Slug:         fmt.Sprintf("svc-%d-mesh", i%5000),
+			Target:       "http://svc.default:8080",
+			ListenPath:   "/",
+			TemplateName: DefaultMeshTemplate,
+			Tags:         []string{"mesh"},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestChangeReason_Apply(t *testing.T) {
+	def := &apidef.APIDefinition{}
+	r := NewChangeReason("Pod", "default", "foo-", "")
+	r.AdmissionUID = "1234"
+	r.Apply(def)
+
+	rc, ok := def.ConfigData[ChangeReasonKey].(ChangeReason)
+	if !ok {
+		t.Fatal("change reason not recorded")
+	}
+
+	if rc.AdmissionUID != "1234" || rc.Kind != "Pod" || rc.ControllerVersion == "" || rc.Time == "" {
+		t.Fatalf("unexpected change reason: %+v", rc)
+	}
+
+	// nil reasons are a no-op
+	var none *ChangeReason
+	none.Apply(&apidef.APIDefinition{})
+}
+
+func TestEdited(t *testing.T) {
+	def := &apidef.APIDefinition{Name: "foo"}
+	if Edited(def) {
+		t.Fatal("APIs without a checksum should not be reported")
+	}
+
+	RecordChecksum(def)
+	NewChangeReason("Ingress", "default", "foo", "").Apply(def)
+	def.Proxy.Targets = []string{"http://10.0.0.1"}
+	def.Certificates = []string{"cert"}
+	if Edited(def) {
+		t.Fatal("fields changed by the controller at runtime should be ignored")
+	}
+
+	def.UseKeylessAccess = !def.UseKeylessAccess
+	if !Edited(def) {
+		t.Fatal("expected the edit to be found")
+	}
+}
+
+func TestRenderAnnotations(t *testing.T) {
+	Init(&TykConf{Org: "1"})
+
+	opts := &APIDefOptions{
+		Name:        "foo",
+		Namespace:   "bar",
+		Labels:      map[string]string{"app": "foo"},
+		ServicePort: 8080,
+		Annotations: map[string]string{
+			"string.service.tyk.io/proxy.listen-path": "/{{ .Namespace }}/{{ .Labels.app }}",
+			"string.service.tyk.io/proxy.target-url":  "http://{{ .Labels.app }}.{{ .Namespace }}:{{ .ServicePort }}",
+			"injector.tyk.io/inject":                  "{{ not a template",
+		},
+	}
+
+	ann, err := renderAnnotations(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ann["string.service.tyk.io/proxy.listen-path"] != "/bar/foo" {
+		t.Fatal("listen path not rendered: ", ann)
+	}
+
+	if ann["string.service.tyk.io/proxy.target-url"] != "http://foo.bar:8080" {
+		t.Fatal("target not rendered: ", ann)
+	}
+
+	if ann["injector.tyk.io/inject"] != "{{ not a template" {
+		t.Fatal("non-processor annotations should be left alone")
+	}
+
+	opts.Annotations = map[string]string{"string.service.tyk.io/name": "{{ .Labels.missing }}"}
+	if _, err := renderAnnotations(opts); err == nil {
+		t.Fatal("missing keys should fail rendering")
+	}
+}
+
+func TestAuthAnnotations(t *testing.T) {
+	Init(&TykConf{Org: "1"})
+
+	opts := &APIDefOptions{
+		Name:       "foo",
+		Slug:       "foo",
+		ListenPath: "/foo",
+		Target:     "http://foo.bar:8080",
+		Annotations: map[string]string{
+			AuthModeAnnotation:            "jwt",
+			AuthJWKSAnnotation:            "https://idp.example.com/.well-known/jwks.json",
+			AuthDefaultPoliciesAnnotation: "basic",
+			AuthScopePoliciesAnnotation:   "orders:write=writers",
+		},
+	}
+
+	ann, _, err := apiAnnotations(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adBytes, err := TemplateService(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processor.Validate(ann, string(adBytes)); err != nil {
+		t.Fatal(err)
+	}
+
+	def := objects.NewDefinition()
+	if err := processor.ProcessInto(ann, adBytes, def); err != nil {
+		t.Fatal(err)
+	}
+
+	if def.UseKeylessAccess || !def.EnableJWT || def.JWTSigningMethod != "rsa" || def.JWTIdentityBaseField != "sub" {
+		t.Fatalf("expected JWT validation, got %+v", def)
+	}
+
+	if src, _ := base64.StdEncoding.DecodeString(def.JWTSource); string(src) != "https://idp.example.com/.well-known/jwks.json" {
+		t.Fatalf("unexpected JWT source %q", def.JWTSource)
+	}
+
+	if len(def.JWTDefaultPolicies) != 1 || def.JWTScopeToPolicyMapping["orders:write"] != "writers" {
+		t.Fatalf("unexpected policy mapping %v %v", def.JWTDefaultPolicies, def.JWTScopeToPolicyMapping)
+	}
+
+	oidc, err := authAnnotations(map[string]string{
+		AuthModeAnnotation:           "oidc",
+		AuthIssuerAnnotation:         "https://idp.example.com",
+		AuthClientPoliciesAnnotation: "web=basic",
+	})
+	if err != nil || oidc["bool.service.tyk.io/use_openid"] != "true" || !strings.Contains(oidc["object.service.tyk.io/openid_options"], base64.StdEncoding.EncodeToString([]byte("web"))) {
+		t.Fatalf("expected OpenID Connect, got %v (%v)", oidc, err)
+	}
+
+	for _, ann := range []map[string]string{
+		{AuthModeAnnotation: "basic"},
+		{AuthModeAnnotation: "jwt"},
+		{AuthModeAnnotation: "jwt", AuthJWKSAnnotation: "idp.example.com"},
+		{AuthModeAnnotation: "jwt", AuthKeyAnnotation: "c2VjcmV0", AuthSigningMethodAnnotation: "none"},
+		{AuthModeAnnotation: "jwt", AuthKeyAnnotation: "c2VjcmV0", AuthIssuerAnnotation: "https://idp.example.com"},
+		{AuthModeAnnotation: "oidc", AuthIssuerAnnotation: "https://idp.example.com"},
+	} {
+		if _, err := authAnnotations(ann); err == nil {
+			t.Errorf("expected %v to be rejected", ann)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	Init(&TykConf{Org: "1", Segments: SegmentConf{
+		Default:    SegmentTags{Ingress: []string{"edge"}},
+		Namespaces: map[string]SegmentTags{"internal": {Ingress: []string{"internal", "edge"}}},
+	}})
+	defer Init(&TykConf{Org: "1"})
+
+	for _, c := range []struct {
+		kind, ns string
+		ann      map[string]string
+		want     string
+	}{
+		{SegmentIngress, "shop", nil, "edge"},
+		{SegmentIngress, "internal", nil, "internal,edge"},
+		{SegmentMesh, "internal", nil, "mesh"},
+		{SegmentIngress, "internal", map[string]string{SegmentTagsAnnotation: " edge"}, "edge"},
+		// tags of other namespaces and kinds are ignored
+		{SegmentIngress, "shop", map[string]string{SegmentTagsAnnotation: "internal"}, "edge"},
+		{SegmentIngress, "shop", map[string]string{SegmentTagsAnnotation: "mesh"}, "edge"},
+	} {
+		if got := strings.Join(Segments(c.kind, c.ns, c.ann), ","); got != c.want {
+			t.Fatalf("%v tags of %v: got %v, want %v", c.kind, c.ns, got, c.want)
+		}
+	}
+
+	if err := ValidateSegments(SegmentMesh, "shop", map[string]string{SegmentTagsAnnotation: "mesh,team-b"}); err == nil {
+		t.Fatal("expected tags not configured for the namespace to be rejected")
+	}
+
+	conf := &SegmentConf{Namespaces: map[string]SegmentTags{"a": {Mesh: []string{"mesh,a"}}}}
+	if errs := conf.Validate(); len(errs) != 1 {
+		t.Fatalf("expected tags with commas to be rejected, got %v", errs)
+	}
+}
+
+func TestAnalyticsAnnotations(t *testing.T) {
+	Init(&TykConf{Org: "1", Analytics: AnalyticsConf{Enabled: true, Cluster: "eu-1", Categories: true}})
+	defer Init(&TykConf{Org: "1"})
+
+	opts := &APIDefOptions{
+		Name:        "orders",
+		Slug:        "orders",
+		ListenPath:  "/orders",
+		Target:      "http://orders:8080",
+		Namespace:   "shop",
+		Labels:      map[string]string{"app": "orders"},
+		Annotations: map[string]string{},
+	}
+
+	ann, _, err := apiAnnotations(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adBytes, err := TemplateService(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := objects.NewDefinition()
+	if err := processor.ProcessInto(ann, adBytes, def); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := def.VersionData.Versions["Default"].GlobalHeaders
+	if headers["k8s-namespace"] != "shop" || headers["k8s-cluster"] != "eu-1" {
+		t.Fatalf("expected namespace and cluster headers, got %v", headers)
+	}
+
+	if _, ok := headers["k8s-team"]; ok {
+		t.Fatal("empty tags should be skipped")
+	}
+
+	if len(def.TagHeaders) != 2 || def.TagHeaders[0] != "k8s-cluster" || def.TagHeaders[1] != "k8s-namespace" {
+		t.Fatalf("expected the tag headers to be recorded, got %v", def.TagHeaders)
+	}
+
+	if def.Name != "orders #eu-1 #shop" {
+		t.Fatalf("expected categories in the name, got %q", def.Name)
+	}
+
+	opts.Labels["team"] = "payments"
+	tags, err := analyticsAnnotations(&AnalyticsConf{Enabled: true, Tags: map[string]string{"Team": `{{ index .Labels "team" }}`}}, opts)
+	if err != nil || tags["object-merge.service.tyk.io/"+globalHeadersPath] != `{"k8s-team":"payments"}` {
+		t.Fatalf("expected a custom team tag, got %v (%v)", tags, err)
+	}
+
+	if tags, _ := analyticsAnnotations(&AnalyticsConf{Tags: map[string]string{"team": `{{ index .Labels "team" }}`}}, opts); len(tags) != 0 {
+		t.Fatalf("tagging should be opt-in, got %v", tags)
+	}
+
+	mesh := *opts
+	mesh.Mesh = true
+	if tags, _ := analyticsAnnotations(&AnalyticsConf{Enabled: true}, &mesh); len(tags) != 0 {
+		t.Fatalf("mesh routes should not be tagged, got %v", tags)
+	}
+
+	missing := &AnalyticsConf{Enabled: true, Tags: map[string]string{"zone": "{{ .Labels.zone }}", "typo": "{{ .Nope }}", "team": "{{ .Labels.team }}"}}
+	tags, err = analyticsAnnotations(missing, opts)
+	if err != nil || tags["object-merge.service.tyk.io/"+globalHeadersPath] != `{"k8s-team":"payments"}` {
+		t.Fatalf("expected tags of missing keys to be skipped, got %v (%v)", tags, err)
+	}
+
+	if _, err := analyticsAnnotations(&AnalyticsConf{Enabled: true, Tags: map[string]string{"bad": "{{ .Nope"}}, opts); err == nil {
+		t.Fatal("invalid templates should be rejected")
+	}
+}
+
+func TestGraphQLAnnotations(t *testing.T) {
+	Init(&TykConf{Org: "1"})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/query" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data": {"__schema": {"queryType": {"name": "Query"}, "mutationType": null, "subscriptionType": null}}}`))
+	}))
+	defer srv.Close()
+
+	opts := &APIDefOptions{
+		Name:       "books",
+		Slug:       "books",
+		ListenPath: "/books",
+		Target:     srv.URL,
+		Annotations: map[string]string{
+			APITypeAnnotation:              "graphql",
+			GraphQLPathAnnotation:          "query",
+			GraphQLIntrospectionAnnotation: "false",
+		},
+	}
+
+	ann, _, err := apiAnnotations(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adBytes, err := TemplateService(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := objects.NewDefinition()
+	if err := processor.ProcessInto(ann, adBytes, def); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := def.VersionData.Versions["Default"].ExtendedPaths
+	if len(paths.WhiteList) != 1 || paths.WhiteList[0].Path != "/query" || len(paths.WhiteList[0].MethodActions) != 3 {
+		t.Fatalf("expected the GraphQL endpoint to be white listed, got %+v", paths.WhiteList)
+	}
+
+	if schema, _ := def.ConfigData[GraphQLSchemaField].(string); !strings.Contains(schema, "__schema") {
+		t.Fatalf("expected the introspected schema in the config data, got %v", def.ConfigData)
+	}
+
+	if len(paths.ValidateJSON) != 1 {
+		t.Fatalf("expected GraphQL requests to be validated, got %+v", paths.ValidateJSON)
+	}
+	not := fmt.Sprint(paths.ValidateJSON[0].Schema)
+	if !strings.Contains(not, "mutation|subscription") || !strings.Contains(not, "__(schema|type)") {
+		t.Fatalf("expected undefined operations and introspection to be rejected, got %v", not)
+	}
+
+	sdl := "schema {\n  query: Root\n  mutation: Change\n}\n\ntype Root { a: Int }\n"
+	ann, err = graphQLAnnotations(context.Background(), "http://unreachable.invalid", map[string]string{APITypeAnnotation: "graphql", GraphQLSchemaKey: sdl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ann[string(processor.ArraySetKey)+validateJSONPath]; strings.Contains(v, "mutation") || !strings.Contains(v, "subscription") {
+		t.Fatalf("expected only subscriptions to be rejected, got %v", v)
+	}
+
+	for _, bad := range []map[string]string{
+		{APITypeAnnotation: "soap"},
+		{APITypeAnnotation: "graphql", GraphQLSchemaKey: "type Mutation { a: Int }"},
+		{APITypeAnnotation: "graphql", GraphQLSchemaKey: `{"data": {}}`},
+		{APITypeAnnotation: "graphql", GraphQLSchemaKey: "type Query { a: Int }", OpenAPIChecksumKey: "abc"},
+	} {
+		if _, err := graphQLAnnotations(context.Background(), srv.URL, bad); err == nil {
+			t.Fatalf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestOpenAPIAnnotations(t *testing.T) {
+	Init(&TykConf{Org: "1"})
+
+	doc := `
+openapi: 3.0.0
+info: {title: pets, version: "1"}
+paths:
+  /pets:
+    get:
+      x-tyk-mock-response: {code: 200, body: [{name: rex}], headers: {Content-Type: application/json}}
+    post:
+      requestBody:
+        content:
+          application/json:
+            schema: {$ref: "#/components/schemas/Pet"}
+  /pets/{id}:
+    delete: {}
+components:
+  schemas:
+    Pet:
+      type: object
+      required: [name]
+      properties: {name: {type: string}}
+`
+	ann, err := OpenAPIAnnotations([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ann[OpenAPIChecksumKey] != OpenAPIChecksum([]byte(doc)) {
+		t.Fatal("expected the checksum of the document to be recorded")
+	}
+
+	opts := &APIDefOptions{Name: "pets", Slug: "pets", ListenPath: "/pets", Target: "http://pets:8080", Annotations: ann}
+	adBytes, err := TemplateService(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := objects.NewDefinition()
+	if err := processor.ProcessInto(ann, adBytes, def); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := def.VersionData.Versions["Default"].ExtendedPaths
+	if len(paths.WhiteList) != 2 || paths.WhiteList[0].Path != "/pets/{id}" {
+		t.Fatalf("expected the longest path first, got %+v", paths.WhiteList)
+	}
+
+	get := paths.WhiteList[1].MethodActions[http.MethodGet]
+	if get.Action != apidef.Reply || get.Code != 200 || get.Data != `[{"name":"rex"}]` || get.Headers["Content-Type"] != "application/json" {
+		t.Fatalf("expected a mock response, got %+v", get)
+	}
+
+	if post := paths.WhiteList[1].MethodActions[http.MethodPost]; post.Action != apidef.NoAction {
+		t.Fatalf("expected POST to be proxied, got %+v", post)
+	}
+
+	if len(paths.ValidateJSON) != 1 || paths.ValidateJSON[0].Method != http.MethodPost || paths.ValidateJSON[0].Schema["type"] != "object" {
+		t.Fatalf("expected the referenced schema to be inlined, got %+v", paths.ValidateJSON)
+	}
+
+	if def.ConfigData[OpenAPIChecksumField] != ann[OpenAPIChecksumKey] {
+		t.Fatalf("checksum not set in config data: %v", def.ConfigData)
+	}
+
+	for _, bad := range []string{
+		`{"paths": {"/a": {"get": {}}}}`,
+		`{"openapi": "3.0.0", "paths": {}}`,
+		`{"openapi": "3.0.0", "paths": {"/a": {"get": {"x-tyk-mock-response": {"code": 1000}}}}}`,
+		`{"swagger": "2.0", "paths": {"/a": {"post": {"parameters": [{"in": "body", "schema": {"$ref": "other.json#/Pet"}}]}}}}`,
+		`{"openapi": "3.0.0", "paths": {"/a": {"post": {"requestBody": {"content": {"application/json": {"schema": {"$ref": "#/definitions/A"}}}}}}}, "definitions": {"A": {"items": {"$ref": "#/definitions/A"}}}}`,
+	} {
+		if _, err := OpenAPIAnnotations([]byte(bad)); err == nil {
+			t.Fatalf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	g := &flightGroup{}
+	release := make(chan struct{})
+	var calls int32
+
+	var wg sync.WaitGroup
+	created := int32(0)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, c, err := g.do(context.Background(), "slug", func() (string, bool, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "id", true, nil
+			})
+			if err != nil || id != "id" {
+				t.Errorf("unexpected result %q (%v)", id, err)
+			}
+			if c {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+
+	// give the callers time to join the in-flight call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 || created != 1 {
+		t.Fatalf("expected a single create, got %d calls and %d created", calls, created)
+	}
+
+	// IDs are only shared with later calls within the batch window
+	if _, _, err := g.do(context.Background(), "slug", func() (string, bool, error) {
+		atomic.AddInt32(&calls, 1)
+		return "id", false, nil
+	}); err != nil || calls != 2 {
+		t.Fatalf("expected a second lookup without a batch window, got %d calls (%v)", calls, err)
+	}
+
+	g = &flightGroup{window: time.Minute}
+	lookup := func() (string, bool, error) {
+		atomic.AddInt32(&calls, 1)
+		return "id", false, nil
+	}
+	for i := 0; i < 3; i++ {
+		if id, _, err := g.do(context.Background(), "slug", lookup); err != nil || id != "id" {
+			t.Fatalf("unexpected result %q (%v)", id, err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("expected the pods of a rollout to share one lookup, got %d calls", calls-2)
+	}
+
+	g.forget()
+	if _, _, _ = g.do(context.Background(), "slug", lookup); calls != 4 {
+		t.Fatal("expected a lookup after the shared IDs were dropped")
+	}
+
+	// a caller giving up doesn't fail the others waiting for the same API
+	g = &flightGroup{}
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go func() {
+		_, _, _ = g.do(ctx, "slug", func() (string, bool, error) {
+			close(started)
+			<-ctx.Done()
+			return "", false, ctx.Err()
+		})
+	}()
+	<-started
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if id, _, err := g.do(context.Background(), "slug", lookup); err != nil || id != "id" {
+		t.Fatalf("expected the waiting caller to retry, got %q (%v)", id, err)
+	}
+
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	g.calls["other"] = &flightCall{done: make(chan struct{})}
+	if _, _, err := g.do(cancelled, "other", lookup); err != context.Canceled {
+		t.Fatalf("expected a waiting caller to give up with its context, got %v", err)
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&fetches, 1)
+		}
+
+		fmt.Fprint(w, `{"apis": [{"api_definition": {"id": "5d7f3e8e0000000000000001", "slug": "foo"}}], "Status": "OK"}`)
+	}))
+	defer srv.Close()
+
+	old := cfg
+	defer func() {
+		cfg = old
+		Init(&TykConf{})
+	}()
+	Init(&TykConf{URL: srv.URL, Secret: "foo", CacheTTL: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		if _, err := Default().GetBySlug(context.Background(), "foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Default().GetByObjectID(context.Background(), "5d7f3e8e0000000000000001"); err != nil {
+		t.Fatal(err)
+	}
+
+	if fetches != 1 {
+		t.Fatalf("expected lookups to share one fetch, got %d", fetches)
+	}
+
+	if err := Default().DeleteByID(context.Background(), "5d7f3e8e0000000000000001"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Default().GetBySlug(context.Background(), "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if fetches != 2 {
+		t.Fatalf("expected a delete to invalidate the cache, got %d fetches", fetches)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	old := cfg
+	defer func() {
+		cfg = old
+		Init(&TykConf{})
+		SetCredential("", "")
+		SetCredential("a", "")
+	}()
+	Init(&TykConf{Org: "1", SecretRef: "tyk/dashboard", Orgs: []OrgConf{
+		{Name: "a", Org: "2", Secret: "inline"},
+	}})
+
+	if err := CredentialsLoaded(); err == nil {
+		t.Fatal("readiness should fail until the key is loaded")
+	}
+
+	a, err := ForOrg("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := a.secret(); s != "inline" {
+		t.Fatalf("orgs without a reference should use their secret, got %q", s)
+	}
+
+	SetCredential("", "rotated")
+	if err := CredentialsLoaded(); err != nil {
+		t.Fatal(err)
+	}
+	if s := Default().secret(); s != "rotated" {
+		t.Fatalf("expected the loaded key, got %q", s)
+	}
+
+	SetCredential("", "")
+	if err := CredentialsLoaded(); err == nil {
+		t.Fatal("readiness should fail once the key is removed")
+	}
+}
+
+func TestClientGuard(t *testing.T) {
+	ctx := context.Background()
+	call := func(err error) func(context.Context) (interface{}, error) {
+		return func(context.Context) (interface{}, error) { return nil, err }
+	}
+
+	g := newClientGuard(&TykConf{BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	calls := 0
+	fail := func(context.Context) (interface{}, error) {
+		calls++
+		return nil, errors.New("API Returned error: upstream unavailable (code: 502)")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.do(ctx, fail); errors.Is(err, ErrUnavailable) {
+			t.Fatalf("breaker opened early on call %d", i)
+		}
+	}
+
+	if _, err := g.do(ctx, fail); !errors.Is(err, ErrUnavailable) || calls != 2 {
+		t.Fatalf("expected the open breaker to fail fast, got %v after %d calls", err, calls)
+	}
+
+	g = newClientGuard(&TykConf{BreakerThreshold: 1})
+	if _, err := g.do(ctx, call(errors.New("certificate with id already exists"))); err == nil {
+		t.Fatal("expected the call error")
+	}
+	if _, err := g.do(ctx, call(nil)); err != nil {
+		t.Fatalf("benign errors should not open the breaker: %v", err)
+	}
+
+	g = newClientGuard(&TykConf{RateLimit: 0.001, RateBurst: 1, RateLimitWait: time.Millisecond})
+	if _, err := g.do(ctx, call(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.do(ctx, call(nil)); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected the rate limit to be exceeded, got %v", err)
+	}
+
+	g = newClientGuard(&TykConf{BreakerThreshold: 1})
+	if _, err := g.do(ctx, call(statusErrorf(http.StatusForbidden, "dashboard returned 403"))); err == nil {
+		t.Fatal("expected the call error")
+	}
+	if _, err := g.do(ctx, call(nil)); err != nil {
+		t.Fatalf("client errors should not open the breaker: %v", err)
+	}
+
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{statusErrorf(http.StatusServiceUnavailable, "dashboard returned 503"), true},
+		{statusErrorf(http.StatusBadRequest, "dashboard returned 400"), false},
+		{errors.New("API Returned error: {\"Message\":\"invalid definition\"} (code: 400)"), false},
+		{errors.New("API Returned error: <html>502 Bad Gateway</html> for /api/apis"), true},
+		{errors.New("API Returned error: {\"Message\":\"Access denied\"} for /api/apis"), false},
+		{&url.Error{Op: "Get", URL: "https://dashboard", Err: errors.New("connection refused")}, true},
+		{fmt.Errorf("%w: call timed out after 1s", ErrUnavailable), true},
+	} {
+		if got := isServerFailure(tc.err); got != tc.want {
+			t.Errorf("isServerFailure(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+
+	// calls that time out are cancelled instead of left running
+	abandoned := make(chan error, 2)
+	slow := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		abandoned <- ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	g = newClientGuard(&TykConf{CallTimeout: 10 * time.Millisecond})
+	if _, err := g.do(ctx, slow); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected the call to time out, got %v", err)
+	}
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Fatal("expected the context of the call to be cancelled")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := g.do(cancelled, slow); err != context.Canceled {
+		t.Fatalf("expected the cancelled context to be reported, got %v", err)
+	}
+}
+
+func TestMockClient(t *testing.T) {
+	ctx := context.Background()
+	m := NewMockClient()
+	opts := &APIDefOptions{Name: "foo", Slug: "foo-mesh", ListenPath: "/foo", Target: "http://foo"}
+
+	id, created, err := m.CreateOrGetService(ctx, opts)
+	if err != nil || !created {
+		t.Fatalf("expected the API to be created, got %v (%v)", created, err)
+	}
+
+	if again, created, _ := m.CreateOrGetService(ctx, opts); again != id || created {
+		t.Fatal("expected the existing API to be returned")
+	}
+
+	def, err := m.GetByObjectID(ctx, id)
+	if err != nil || def.Proxy.TargetURL != "http://foo" {
+		t.Fatalf("unexpected API %+v (%v)", def, err)
+	}
+
+	if err := m.DeleteBySlug(ctx, "foo-mesh"); err != nil || len(m.APIs) != 0 {
+		t.Fatalf("expected the API to be removed (%v)", err)
+	}
+
+	m.Err = ErrUnavailable
+	if _, err := m.CreateCertificate(ctx, nil, nil); err != ErrUnavailable {
+		t.Fatal("expected the configured error")
+	}
+}
+
+func TestAdoption(t *testing.T) {
+	opts := &APIDefOptions{Slug: "svc-bar-foo", Namespace: "bar", ListenPath: "/bar/foo", ChangeReason: NewChangeReason("Service", "bar", "foo", ""),
+		Annotations: map[string]string{AdoptAnnotation: "true"}}
+	for _, c := range []AdoptConf{{}, {Enabled: true, Namespaces: []string{"other"}}} {
+		if adopting(opts, &c) {
+			t.Fatalf("the annotation should only be honoured in the namespaces of the config, got %+v", c)
+		}
+	}
+
+	// a keyed API created by hand in the dashboard
+	legacy := objects.DBApiDefinition{}
+	legacy.Id = bson.ObjectIdHex("5d7f3e8e0000000000000001")
+	legacy.APIID = "legacy"
+	legacy.Slug = "legacy"
+	legacy.UseStandardAuth = true
+	legacy.Proxy.ListenPath = "/bar/foo"
+	legacy.Proxy.TargetURL = "http://legacy"
+
+	var mu sync.Mutex
+	apis := map[string]objects.DBApiDefinition{legacy.Id.Hex(): legacy}
+	var puts, posts, deletes int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		id := strings.TrimPrefix(r.URL.Path, "/api/apis/")
+		switch r.Method {
+		case http.MethodGet:
+			list := []objects.DBApiDefinition{}
+			for _, a := range apis {
+				list = append(list, a)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"apis": list})
+		case http.MethodPut:
+			def := objects.DBApiDefinition{}
+			json.NewDecoder(r.Body).Decode(&def)
+			apis[id] = def
+			puts++
+			fmt.Fprint(w, `{"Status": "OK"}`)
+		case http.MethodPost:
+			posts++
+			w.WriteHeader(http.StatusInternalServerError)
+		case http.MethodDelete:
+			deletes++
+			delete(apis, id)
+			fmt.Fprint(w, `{"Status": "OK"}`)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	o := newOrg("", &TykConf{URL: srv.URL, Secret: "foo", Adopt: AdoptConf{Enabled: true, Namespaces: []string{"bar"}}})
+	if err := o.UpdateAPIs(ctx, map[string]*APIDefOptions{opts.Slug: opts}); err != nil {
+		t.Fatal(err)
+	}
+
+	def := apis[legacy.Id.Hex()]
+	if posts != 0 || puts != 1 || opts.AdoptedID != legacy.Id.Hex() {
+		t.Fatalf("expected the API to be adopted instead of created, got %v puts and %v posts", puts, posts)
+	}
+	if _, managed := ChangeReasonOf(&def.APIDefinition); !managed || def.Slug != opts.Slug || !Adopted(&def.APIDefinition) {
+		t.Fatalf("expected the API to be tagged with the slug and owner of the service, got %+v", def)
+	}
+	if !def.UseStandardAuth || def.UseKeylessAccess || def.Proxy.TargetURL != "http://legacy" {
+		t.Fatalf("the adopted API should keep its definition, got %+v", def)
+	}
+
+	// updates leave the definition alone
+	if err := o.UpdateAPIs(ctx, map[string]*APIDefOptions{opts.Slug: opts}); err != nil || puts != 1 {
+		t.Fatalf("expected the adopted API to be kept as it is, got %v puts (%v)", puts, err)
+	}
+
+	// deleting the object releases the API
+	if err := o.DeleteByID(ctx, legacy.Id.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	def = apis[legacy.Id.Hex()]
+	if _, managed := ChangeReasonOf(&def.APIDefinition); deletes != 0 || managed || Adopted(&def.APIDefinition) || def.Slug != "legacy" {
+		t.Fatalf("expected the API to be released, got %+v after %v deletes", def, deletes)
+	}
+
+	// managed APIs and ambiguous routes are never adopted
+	all := []objects.DBApiDefinition{legacy, legacy}
+	if adoptable(all, "", opts) != nil {
+		t.Fatal("routes served by several APIs should not be adopted")
+	}
+
+	all = all[:1]
+	opts.ChangeReason.Apply(&all[0].APIDefinition)
+	if adoptable(all, "", opts) != nil {
+		t.Fatal("APIs of the controller can't be adopted")
+	}
+}
+
+func TestOrg_UpdateAPIs_Targets(t *testing.T) {
+	Init(&TykConf{Org: "1"})
+
+	// a mesh route load balanced across its pods
+	mesh := objects.DBApiDefinition{}
+	mesh.Id = bson.ObjectIdHex("5d7f3e8e0000000000000002")
+	mesh.APIID = "mesh"
+	mesh.Slug = "foo-mesh"
+	mesh.Proxy.EnableLoadBalancing = true
+	mesh.Proxy.Targets = []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}
+
+	var updated objects.DBApiDefinition
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]interface{}{"apis": []objects.DBApiDefinition{mesh}})
+		case http.MethodPut:
+			json.NewDecoder(r.Body).Decode(&updated)
+			fmt.Fprint(w, `{"Status": "OK"}`)
+		}
+	}))
+	defer srv.Close()
+
+	o := newOrg("", &TykConf{URL: srv.URL, Secret: "foo", Org: "1"})
+	opts := &APIDefOptions{Name: "foo-mesh", Slug: "foo-mesh", ListenPath: "/foo", Target: "http://foo.bar:8080"}
+	if err := o.UpdateAPIs(context.Background(), map[string]*APIDefOptions{opts.Slug: opts}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !updated.Proxy.EnableLoadBalancing || len(updated.Proxy.Targets) != 2 || updated.Proxy.TargetURL != opts.Target {
+		t.Fatalf("expected the re-templated API to keep its targets, got %+v", updated.Proxy)
+	}
+}
+
+func TestDefinitionJSON(t *testing.T) {
+	def := objects.NewDefinition()
+	def.Name = "foo"
+
+	fields := func(data []byte, nested bool) map[string]interface{} {
+		out := map[string]interface{}{}
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if nested {
+			out, _ = out["api_definition"].(map[string]interface{})
+		}
+		return out
+	}
+
+	for _, nested := range []bool{false, true} {
+		data, err := definitionJSON(def, nested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fields(data, nested)[detailedRecordingField]; ok {
+			t.Fatalf("detailed recording should be left alone unless bodies are redacted, got %s", data)
+		}
+	}
+
+	redactBodies(def)
+	for _, nested := range []bool{false, true} {
+		data, err := definitionJSON(def, nested)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := fields(data, nested)
+		if v, ok := f[detailedRecordingField]; !ok || v != false || f["name"] != "foo" {
+			t.Fatalf("expected detailed recording to be turned off, got %s", data)
+		}
+	}
+}
+
+func TestRESTClient(t *testing.T) {
+	var mu sync.Mutex
+	apis := map[string]apidef.APIDefinition{}
+	var reloads int32
+	hang := make(chan struct{})
+
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-tyk-authorization") != "foo" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		id := strings.TrimPrefix(r.URL.Path, gatewayAPIsPath)
+		switch {
+		case r.URL.Path == reloadPath:
+			atomic.AddInt32(&reloads, 1)
+		case r.URL.Path == "/slow":
+			mu.Unlock()
+			<-hang
+			mu.Lock()
+		case r.Method == http.MethodGet:
+			list := []apidef.APIDefinition{}
+			for _, a := range apis {
+				list = append(list, a)
+			}
+			json.NewEncoder(w).Encode(list)
+		case r.Method == http.MethodPost, r.Method == http.MethodPut:
+			def := apidef.APIDefinition{}
+			json.NewDecoder(r.Body).Decode(&def)
+			apis[def.APIID] = def
+			fmt.Fprintf(w, `{"key": %q, "status": "ok"}`, def.APIID)
+		case r.Method == http.MethodDelete:
+			delete(apis, id)
+		}
+	}))
+	defer gw.Close()
+	// release the hanging request before the server is closed
+	defer close(hang)
+
+	o := newOrg("", &TykConf{URL: gw.URL, Secret: "foo", Mode: ModeCE})
+	cl := o.newClient(context.Background())
+
+	def := &apidef.APIDefinition{APIID: "foo", Slug: "foo"}
+	def.Proxy.ListenPath = "/foo"
+	if id, err := cl.CreateAPI(def); err != nil || id != "foo" {
+		t.Fatalf("expected the API to be created, got %q (%v)", id, err)
+	}
+
+	if _, err := cl.CreateAPI(def); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected the existing API to be reported, got %v", err)
+	}
+
+	def.Proxy.TargetURL = "http://foo"
+	if err := cl.UpdateAPI(def); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := cl.FetchAPIs()
+	if err != nil || len(all) != 1 || all[0].Proxy.TargetURL != "http://foo" {
+		t.Fatalf("expected the updated API, got %+v (%v)", all, err)
+	}
+
+	if err := cl.DeleteAPI(cl.GetActiveID(def)); err != nil || len(apis) != 0 {
+		t.Fatalf("expected the API to be deleted, got %v (%v)", apis, err)
+	}
+
+	// requests are cancelled with the context of the client
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := newRESTClient(o).bind(ctx).(*restClient)
+	done := make(chan error, 1)
+	go func() {
+		_, err := rc.request(http.MethodGet, "/slow", "", nil)
+		done <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the request to be cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request was not cancelled with its context")
+	}
+}
+
+func TestFileClient(t *testing.T) {
+	var reloads int32
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != reloadPath || r.Header.Get("x-tyk-authorization") != "foo" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		atomic.AddInt32(&reloads, 1)
+	}))
+	defer gw.Close()
+
+	dir, err := ioutil.TempDir("", "tyk-apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cl := newFileClient(dir, gw.URL, "foo")
+	def := &apidef.APIDefinition{APIID: "abc", Slug: "foo"}
+	def.Proxy.ListenPath = "/foo"
+
+	if id, err := cl.CreateAPI(def); err != nil || id != "abc" {
+		t.Fatalf("unexpected create result %q (%v)", id, err)
+	}
+
+	if _, err := cl.CreateAPI(def); err == nil {
+		t.Fatal("creating an existing API should fail")
+	}
+
+	def.Proxy.ListenPath = "/bar"
+	if err := cl.UpdateAPI(def); err != nil {
+		t.Fatal(err)
+	}
+
+	apis, err := cl.FetchAPIs()
+	if err != nil || len(apis) != 1 || apis[0].Proxy.ListenPath != "/bar" {
+		t.Fatalf("unexpected APIs %+v (%v)", apis, err)
+	}
+
+	if err := cl.DeleteAPI("../abc"); err == nil {
+		t.Fatal("IDs should not escape the API directory")
+	}
+
+	if err := cl.DeleteAPI("abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	if apis, _ := cl.FetchAPIs(); len(apis) != 0 || reloads != 3 {
+		t.Fatalf("expected no APIs and 3 reloads, got %d APIs and %d reloads", len(apis), reloads)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	var reloads int32
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != reloadPath || r.Header.Get("x-tyk-authorization") != "gw-secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		atomic.AddInt32(&reloads, 1)
+	}))
+	defer gw.Close()
+
+	conf := &TykConf{Reload: ReloadConf{URL: gw.URL, Secret: "gw-secret", Debounce: 20 * time.Millisecond, MaxDelay: 100 * time.Millisecond}}
+	if errs := conf.Reload.Validate(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	r := newReloader(conf)
+	for i := 0; i < 5; i++ {
+		r.trigger()
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if n := atomic.LoadInt32(&reloads); n != 1 {
+		t.Fatalf("expected a burst to reload once, got %d reloads", n)
+	}
+
+	// a steady stream of changes still reloads by the max delay
+	for i := 0; i < 20; i++ {
+		r.trigger()
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&reloads); n < 3 {
+		t.Fatalf("expected reloads within the max delay, got %d reloads", n)
+	}
+
+	if newReloader(&TykConf{}) != nil {
+		t.Fatal("reloads should be disabled without a gateway URL")
+	}
+	var disabled *reloader
+	disabled.trigger()
+
+	bad := ReloadConf{URL: "gateway", Debounce: -1}
+	if errs := bad.Validate(); len(errs) != 2 {
+		t.Fatalf("expected a relative URL and a negative debounce to be rejected, got %v", errs)
+	}
+}
+
+func TestOrgFor(t *testing.T) {
+	old := cfg
+	defer func() {
+		cfg = old
+		Init(&TykConf{})
+	}()
+
+	Init(&TykConf{
+		URL:    "http://dashboard",
+		Secret: "default",
+		Org:    "1",
+		Orgs: []OrgConf{
+			{Name: "team-a", Secret: "a", Org: "2", Namespaces: []string{"a"}},
+			{Name: "team-b", URL: "http://other", Secret: "b", Org: "3", AnnotationNamespaces: []string{"a"}},
+		},
+	})
+
+	cases := []struct {
+		ns   string
+		ann  map[string]string
+		name string
+		org  string
+	}{
+		{"default", nil, "", "1"},
+		{"a", nil, "team-a", "2"},
+		{"a", map[string]string{OrgAnnotation: "team-b"}, "team-b", "3"},
+		{"default", map[string]string{OrgAnnotation: ""}, "", "1"},
+	}
+
+	for _, c := range cases {
+		o, err := OrgFor(c.ns, c.ann)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if o.Name != c.name || o.conf.Org != c.org {
+			t.Fatalf("expected org %q (%v) for %v %v, got %q (%v)", c.name, c.org, c.ns, c.ann, o.Name, o.conf.Org)
+		}
+	}
+
+	if o, _ := ForOrg("team-a"); o.conf.URL != "http://dashboard" {
+		t.Fatal("orgs should default to the top-level URL")
+	}
+
+	if _, err := OrgFor("a", map[string]string{OrgAnnotation: "unknown"}); err == nil {
+		t.Fatal("unknown orgs should be rejected")
+	}
+
+	if _, err := OrgFor("default", map[string]string{OrgAnnotation: "team-a"}); err == nil {
+		t.Fatal("orgs should only be selected from the namespaces they allow")
+	}
+
+	if _, err := OrgFor("a", map[string]string{OrgAnnotation: ""}); err == nil {
+		t.Fatal("objects of a mapped namespace should not fall back to the default org")
+	}
+
+	b, _ := ForOrg("team-b")
+	opts := &APIDefOptions{Name: "foo", Slug: "foo", ListenPath: "/foo", Target: "http://foo"}
+	if _, err := b.TemplateService(opts); err != nil || opts.OrgID != "3" {
+		t.Fatalf("expected the API to be templated for org 3, got %q (%v)", opts.OrgID, err)
+	}
+}
+
+func TestOrg_DeleteCertificate(t *testing.T) {
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.Header.Get("Authorization") != "foo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if r.URL.Path != "/api/certs/abc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		deleted = append(deleted, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	o := newOrg("test", &TykConf{URL: srv.URL, Secret: "foo"})
+	if err := o.DeleteCertificate(context.Background(), "abc"); err != nil || len(deleted) != 1 {
+		t.Fatalf("expected the certificate to be deleted, got %v (%v)", deleted, err)
+	}
+
+	if err := o.DeleteCertificate(context.Background(), "def"); err == nil {
+		t.Fatal("expected an error for an unknown certificate")
+	}
+}
+
+func TestOrg_syncPolicy(t *testing.T) {
+	l, err := ParseLimits(map[string]string{PolicyRateAnnotation: "100/60", PolicyQuotaAnnotation: "10000/day"})
+	if err != nil || l.Rate != 100 || l.Per != time.Minute || l.QuotaMax != 10000 || l.QuotaPer != 24*time.Hour {
+		t.Fatalf("unexpected limits %+v (%v)", l, err)
+	}
+
+	for _, v := range []string{"100", "0/60", "100/0", "100/fortnight", "1.5/day"} {
+		if _, err := ParseLimits(map[string]string{PolicyQuotaAnnotation: v}); err == nil {
+			t.Errorf("expected quota %q to be rejected", v)
+		}
+	}
+
+	ann := limitAnnotations(l)
+	if ann["bool.service.tyk.io/disable_rate_limit"] != "false" || ann["object.service.tyk.io/global_rate_limit"] != `{"rate":100,"per":60}` {
+		t.Fatalf("expected the rate limit to be enabled, got %v", ann)
+	}
+
+	pols := map[string]*policy{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, dashboardPoliciesPath+"/")
+		switch {
+		case r.Header.Get("Authorization") != "foo":
+			w.WriteHeader(http.StatusForbidden)
+		case r.Method == http.MethodGet:
+			list := &policyList{Data: []policy{}}
+			for _, p := range pols {
+				list.Data = append(list.Data, *p)
+			}
+			json.NewEncoder(w).Encode(list)
+		case r.Method == http.MethodPost:
+			p := &policy{}
+			json.NewDecoder(r.Body).Decode(p)
+			p.MID = fmt.Sprintf("p%d", len(pols))
+			pols[p.MID] = p
+		case r.Method == http.MethodPut:
+			p := &policy{}
+			json.NewDecoder(r.Body).Decode(p)
+			pols[id] = p
+		case r.Method == http.MethodDelete:
+			delete(pols, id)
+		}
+	}))
+	defer srv.Close()
+
+	o := newOrg("test", &TykConf{URL: srv.URL, Secret: "foo"})
+	def := &apidef.APIDefinition{APIID: "api1", Slug: "foo-mesh", Name: "foo-mesh"}
+	if err := o.syncPolicy(context.Background(), def, l); err != nil || len(pols) != 1 {
+		t.Fatalf("expected a policy, got %v (%v)", pols, err)
+	}
+
+	p := pols["p0"]
+	if p.Rate != 100 || p.Per != 60 || p.QuotaRenewalRate != 86400 || p.AccessRights["api1"].APIID != "api1" || !p.Partitions["quota"] {
+		t.Fatalf("unexpected policy %+v", p)
+	}
+
+	l.QuotaMax = 0
+	if err := o.syncPolicy(context.Background(), def, l); err != nil || len(pols) != 1 || pols["p0"].Partitions["quota"] {
+		t.Fatalf("expected the policy to be updated, got %+v (%v)", pols, err)
+	}
+
+	if err := o.syncPolicy(context.Background(), def, nil); err != nil || len(pols) != 0 {
+		t.Fatalf("expected the policy to be deleted, got %v (%v)", pols, err)
+	}
+
+	// only APIs that had limits look for a policy to remove
+	if hasPolicy(def) {
+		t.Fatal("APIs without limits should have no policy")
+	}
+	markPolicy(def, l)
+	if !hasPolicy(def) {
+		t.Fatal("expected limited APIs to be marked")
+	}
+	markPolicy(def, nil)
+	if hasPolicy(def) {
+		t.Fatal("expected the marker to be removed with the limits")
+	}
+}
+
+func TestOrg_CertificateExists(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Header.Get("x-tyk-authorization") != "foo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if r.URL.Path != "/tyk/certs/abc" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	o := newOrg("test", &TykConf{URL: srv.URL, Secret: "foo", Mode: ModeCE})
+	if ok, err := o.CertificateExists(context.Background(), "abc"); err != nil || !ok {
+		t.Fatalf("expected the certificate to exist (%v)", err)
+	}
+
+	if ok, err := o.CertificateExists(context.Background(), "def"); err != nil || ok {
+		t.Fatalf("expected the certificate to be missing (%v)", err)
+	}
+}
+
+func TestOrg_CertificateExists_Traced(t *testing.T) {
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	if _, err := tracing.Init(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	ctx, parent := tracing.Start(context.Background(), "admission")
+	o := newOrg("test", &TykConf{URL: srv.URL, Secret: "foo"})
+	if ok, err := o.CertificateExists(ctx, "abc"); err != nil || !ok {
+		t.Fatalf("expected the certificate to exist (%v)", err)
+	}
+	parent.End()
+
+	spans := rec.Ended()
+	if len(spans) != 2 || spans[0].Name() != "tyk.CertificateExists" {
+		t.Fatalf("expected a span of the call, got %v", spans)
+	}
+
+	call := spans[0]
+	if call.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatal("expected the call to be a child of the admission")
+	}
+
+	want := fmt.Sprintf("00-%v-%v-01", call.SpanContext().TraceID(), call.SpanContext().SpanID())
+	if traceparent != want {
+		t.Fatalf("expected the trace to be propagated as %v, got %q", want, traceparent)
+	}
+}
+
+func TestOrg_Version(t *testing.T) {
+	hello := `{"status":"pass","version":"v3.0.1"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hello" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, hello)
+	}))
+	defer srv.Close()
+
+	o := newOrg("test", &TykConf{URL: srv.URL, Mode: ModeCE})
+	if o.Component() != ComponentGateway {
+		t.Fatalf("expected a gateway, got %v", o.Component())
+	}
+
+	if v, err := o.Version(context.Background()); err != nil || v != "v3.0.1" {
+		t.Fatalf("unexpected version %q (%v)", v, err)
+	}
+
+	// older releases don't report their version
+	hello = "Hello Tiki"
+	if v, err := o.Version(context.Background()); err != nil || v != "" {
+		t.Fatalf("unexpected version %q (%v)", v, err)
+	}
+}
+
+func TestIncompatibilities(t *testing.T) {
+	if found := Incompatibilities(ComponentGateway, "v2.3.8"); len(found) != 1 {
+		t.Fatalf("expected the certificate store to be flagged, got %v", found)
+	}
+
+	if found := Incompatibilities(ComponentGateway, "2.8.4"); len(found) != 0 {
+		t.Fatalf("unexpected incompatibilities %v", found)
+	}
+
+	if found := Incompatibilities(ComponentDashboard, "latest"); len(found) != 0 {
+		t.Fatalf("unparseable versions should not be checked, got %v", found)
+	}
+}
+
+func TestExportOrg(t *testing.T) {
+	ctx := context.Background()
+	mock := NewMockClient()
+	for _, opts := range []*APIDefOptions{
+		{Slug: "Cart_Inbound", ListenPath: "/", CertificateID: []string{"c1"}, ChangeReason: NewChangeReason("Pod", "shop", "cart-0", "")},
+		{Slug: "manual", ListenPath: "/manual"},
+	} {
+		if _, err := mock.CreateService(ctx, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exp, err := ExportOrg(ctx, mock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exp.APIs) != 1 || exp.APIs[0].Slug != "Cart_Inbound" || len(exp.Certificates) != 1 || exp.Certificates[0] != "c1" || exp.Policies != nil {
+		t.Fatalf("expected only the API created by the controller, got %+v", exp)
+	}
+
+	// APIs recorded in the state store are exported without a change reason
+	manual, _ := mock.GetBySlug(ctx, "manual")
+	all, err := ExportOrg(ctx, mock, func(id string) bool { return id == ObjectID(manual) })
+	if err != nil || len(all.APIs) != 2 {
+		t.Fatalf("expected the recorded API to be exported too, got %+v (%v)", all, err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"Data": []map[string]interface{}{
+			{"_id": "p1", "name": "Cart_Inbound", "rate": 100, "tags": []string{policyTag},
+				"access_rights": map[string]interface{}{exp.APIs[0].APIID: map[string]interface{}{"versions": []string{"Default"}}}},
+			{"_id": "p2", "name": "manual", "tags": []string{"other"}},
+		}})
+	}))
+	defer srv.Close()
+
+	o := newOrg("acme", &TykConf{URL: srv.URL, Secret: "foo"})
+	if exp.Policies, err = o.ownedPolicies(ctx); err != nil || len(exp.Policies) != 1 {
+		t.Fatalf("expected the policy created by the controller, got %v (%v)", exp.Policies, err)
+	}
+
+	res, err := exp.OperatorResources()
+	if err != nil || len(res) != 2 {
+		t.Fatalf("expected an ApiDefinition and a SecurityPolicy, got %v (%v)", res, err)
+	}
+
+	api, pol := res[0], res[1]
+	meta := api["metadata"].(map[string]interface{})
+	spec := api["spec"].(map[string]interface{})
+	if api["kind"] != "ApiDefinition" || meta["name"] != "cart-inbound" || meta["namespace"] != "shop" || spec["id"] != nil || spec["slug"] != "Cart_Inbound" {
+		t.Fatalf("unexpected ApiDefinition %v", api)
+	}
+
+	rights := pol["spec"].(map[string]interface{})["access_rights_array"].([]map[string]interface{})
+	if pol["kind"] != "SecurityPolicy" || len(rights) != 1 || rights[0]["name"] != "cart-inbound" || rights[0]["namespace"] != "shop" {
+		t.Fatalf("expected the policy to refer to the ApiDefinition, got %v", pol)
+	}
+	if _, ok := pol["spec"].(map[string]interface{})["_id"]; ok {
+		t.Fatal("the dashboard ID should be left out")
+	}
+}
+
+func TestGetTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(dir+"/custom.json", []byte(`{"name": "{{.Name}}"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	SetTemplateStore(NewDirTemplateStore(dir))
+	defer SetTemplateStore(nil)
+
+	if tpl, err := getTemplate("custom.json"); err != nil || tpl.Name() != "custom.json" {
+		t.Fatalf("expected the template of the directory, got %v (%v)", tpl, err)
+	}
+
+	// the built-in templates stand in for the ones missing from the directory
+	if tpl, err := getTemplate("default-mesh"); err != nil || tpl.Name() != "default-mesh" {
+		t.Fatalf("expected the built-in mesh template, got %v (%v)", tpl, err)
+	}
+
+	if _, err := getTemplate("missing"); err != ErrTemplateNotFound {
+		t.Fatalf("expected unknown templates to be reported, got %v", err)
+	}
+}
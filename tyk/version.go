@@ -0,0 +1,123 @@
+package tyk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	utilversion "k8s.io/apimachinery/pkg/util/version"
+
+	"go.jlucktay.dev/tyk-k8s/tracing"
+)
+
+// Components of a Tyk installation the controller depends on
+const (
+	ComponentDashboard = "dashboard"
+	ComponentGateway   = "gateway"
+)
+
+const helloPath = "/hello"
+
+// compatRule is a feature used by the controller that a component only
+// supports from a minimum version on
+type compatRule struct {
+	component string
+	min       string
+	feature   string
+}
+
+var compatRules = []compatRule{
+	{ComponentDashboard, "1.4.0", "the certificate API (/api/certs) used for mesh TLS, workload identities and upstream TLS"},
+	{ComponentGateway, "2.4.0", "the certificate store and mutual TLS used for mesh TLS and workload identities"},
+}
+
+// Incompatibilities lists the features of the controller a version of a
+// component doesn't support, versions that can't be parsed are not checked
+func Incompatibilities(component, version string) []string {
+	v, err := utilversion.ParseGeneric(version)
+	if err != nil {
+		return nil
+	}
+
+	found := make([]string, 0)
+	for _, r := range compatRules {
+		if r.component != component {
+			continue
+		}
+
+		if v.LessThan(utilversion.MustParseGeneric(r.min)) {
+			found = append(found, fmt.Sprintf("%s %s doesn't support %s, %s or later is required", component, version, r.feature, r.min))
+		}
+	}
+
+	return found
+}
+
+// Component returns the component managed by the org, the gateway in "ce"
+// mode and the dashboard otherwise
+func (o *Org) Component() string {
+	if o.conf.Mode == ModeCE {
+		return ComponentGateway
+	}
+
+	return ComponentDashboard
+}
+
+// URL returns the address of the dashboard, or gateway, of the org
+func (o *Org) URL() string {
+	return o.conf.URL
+}
+
+// OrgID returns the ID of the organisation in the dashboard
+func (o *Org) OrgID() string {
+	return o.conf.Org
+}
+
+// Version queries the version of the dashboard, or gateway in "ce" mode, from
+// its health check. Releases before 3.0 don't report it, an empty version is
+// returned for them.
+func (o *Org) Version(ctx context.Context) (string, error) {
+	v, err := o.guard.traced(ctx, "Version", o.version)
+	if err != nil {
+		return "", err
+	}
+
+	return v.(string), nil
+}
+
+func (o *Org) version(ctx context.Context) (interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(o.conf.URL, "/")+helloPath, nil)
+	if err != nil {
+		return "", err
+	}
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := o.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", statusErrorf(resp.StatusCode, "%v returned %v", helloPath, resp.StatusCode)
+	}
+
+	hello := struct {
+		Version string `json:"version"`
+	}{}
+
+	// older releases answer with plain text
+	if err := json.Unmarshal(body, &hello); err != nil {
+		return "", nil
+	}
+
+	return hello.Version, nil
+}
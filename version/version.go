@@ -0,0 +1,19 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build metadata of the controller, set at build time with e.g.
+// -ldflags "-X go.jlucktay.dev/tyk-k8s/version.Version=<version>"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// String describes the build of the controller
+func String() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s %s/%s)", Version, Commit, BuildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,85 @@
+package webserver
+
+import (
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+
+	"go.jlucktay.dev/tyk-k8s/logger"
+)
+
+// RequestIDHeader is read from incoming requests and set on responses
+const RequestIDHeader = "X-Request-Id"
+
+// Middleware wraps a handler
+type Middleware func(http.Handler) http.Handler
+
+// Use adds middleware applied to every route, in the order given
+func (s *WebServer) Use(mws ...Middleware) {
+	for _, mw := range mws {
+		s.mux.Use(mux.MiddlewareFunc(mw))
+	}
+}
+
+// chain wraps a handler so the first middleware is the outermost
+func chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+
+	return h
+}
+
+// RequestID propagates the caller's request ID, or generates one, into the
+// request context so it is included by loggers created with logger.FromContext
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = uuid.NewV4().String()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logger.WithRequestID(r.Context(), id)))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Logging logs the method, path, status and duration of every request
+func Logging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		logger.FromContext(r.Context(), log).WithField("status", rec.status).
+			WithField("duration", time.Since(start).String()).
+			Infof("%s %s", r.Method, r.URL.Path)
+	})
+}
+
+// Recovery turns a panicking handler into a 500 response instead of crashing the controller
+func Recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.FromContext(r.Context(), log).Errorf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
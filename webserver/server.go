@@ -3,8 +3,14 @@ package webserver
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ghodss/yaml"
@@ -18,36 +24,219 @@ var (
 	log    = logger.GetLogger("web")
 )
 
+const (
+	// DefaultAddr is served when no address is configured
+	DefaultAddr = ":9797"
+
+	defaultDrainTimeout      = 5 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	// admission reviews carry the old and new object, each up to the API server's ~1.5MB limit
+	defaultMaxBodyBytes = 3 << 20
+
+	// HealthRoute and ReadyRoute are served by every web server for liveness and readiness probes
+	HealthRoute = "/healthz"
+	ReadyRoute  = "/readyz"
+)
+
 // WebServer config
 type Config struct {
-	Addr     string `yaml:"addr"`     // webhook server port
-	CertFile string `yaml:"certFile"` // path to the x509 certificate for https
-	KeyFile  string `yaml:"keyFile"`  // path to the x509 private key matching `CertFile`
+	Addr         string        `yaml:"addr"`         // webhook server port
+	CertFile     string        `yaml:"certFile"`     // path to the x509 certificate for https
+	KeyFile      string        `yaml:"keyFile"`      // path to the x509 private key matching `CertFile`
+	CertSecret   string        `yaml:"certSecret"`   // namespace/name of a kubernetes.io/tls Secret, used instead of the files
+	DrainTimeout time.Duration `yaml:"drainTimeout"` // how long in-flight requests may take to finish on shutdown
+
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	ReadTimeout       time.Duration `yaml:"readTimeout"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`
+	MaxBodyBytes      int64         `yaml:"maxBodyBytes"` // larger request bodies are rejected
+
+	// TLS hardening, only applies when serving https
+	MinTLSVersion string   `yaml:"minTLSVersion"` // 1.0 to 1.3, defaults to 1.2
+	CipherSuites  []string `yaml:"cipherSuites"`  // standard suite names, defaults to Go's preferences
+	ClientCAFile  string   `yaml:"clientCAFile"`  // require client certificates signed by this CA, e.g. the API server's
+	DisableHTTP2  bool     `yaml:"disableHTTP2"`
 }
 
+// Validate checks the config without applying defaults or reading any
+// files, all problems found are returned
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+
+	if c.Addr != "" {
+		_, port, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("addr: %v", err))
+		} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			errs = append(errs, fmt.Errorf("addr: port %q must be between 1 and 65535", port))
+		}
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("certFile and keyFile must be set together"))
+	}
+
+	if c.CertSecret != "" && len(strings.Split(c.CertSecret, "/")) != 2 {
+		errs = append(errs, fmt.Errorf("certSecret: %q must be namespace/name", c.CertSecret))
+	}
+
+	if c.MinTLSVersion != "" {
+		if _, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(c.MinTLSVersion), "tls")]; !ok {
+			errs = append(errs, fmt.Errorf("minTLSVersion: unsupported version %v", c.MinTLSVersion))
+		}
+	}
+
+	for _, name := range c.CipherSuites {
+		if _, err := cipherSuite(name); err != nil {
+			errs = append(errs, fmt.Errorf("cipherSuites: %v", err))
+		}
+	}
+
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"drainTimeout", c.DrainTimeout},
+		{"readHeaderTimeout", c.ReadHeaderTimeout},
+		{"readTimeout", c.ReadTimeout},
+		{"writeTimeout", c.WriteTimeout},
+		{"idleTimeout", c.IdleTimeout},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			errs = append(errs, fmt.Errorf("%v: must not be negative", d.name))
+		}
+	}
+
+	if c.MaxBodyBytes < 0 {
+		errs = append(errs, fmt.Errorf("maxBodyBytes: must not be negative"))
+	}
+
+	return errs
+}
+
+// CertificateSource provides the serving certificate for each TLS handshake
+type CertificateSource func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
 type WebServer struct {
-	stopCh chan struct{}
-	mux    *mux.Router
-	cfg    *Config
-	srv    *http.Server
+	stopCh  chan struct{}
+	mux     *mux.Router
+	public  *mux.Router // routes served without a client certificate
+	cfg     *Config
+	srv     *http.Server
+	ready   int32
+	certSrc CertificateSource
+	checks  []func() error
 }
 
 func newServer(cfg *Config) *WebServer {
 	s := &WebServer{
 		cfg:    cfg,
 		mux:    mux.NewRouter(),
+		public: mux.NewRouter(),
 		stopCh: make(chan struct{}),
 	}
 
+	s.addProbes()
 	return s
 }
 
-func (s *WebServer) AddRoute(method, route string, handler func(http.ResponseWriter, *http.Request)) {
+// limitBody bounds the request body, reads past the limit fail
+func limitBody(next http.Handler, max int64) http.Handler {
+	if max <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *WebServer) addProbes() {
+	s.mux.HandleFunc(HealthRoute, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}).Methods("GET")
+
+	s.mux.HandleFunc(ReadyRoute, func(w http.ResponseWriter, r *http.Request) {
+		if !s.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		for _, check := range s.checks {
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}).Methods("GET")
+}
+
+// SetCertificateSource serves TLS with certificates from src instead of the
+// configured files, so they can be rotated without a restart
+func (s *WebServer) SetCertificateSource(src CertificateSource) {
+	s.certSrc = src
+}
+
+// AddReadyCheck adds a check the readiness route fails on while it returns an
+// error, checks must be added before the server is started
+func (s *WebServer) AddReadyCheck(check func() error) {
+	s.checks = append(s.checks, check)
+}
+
+// SetReady sets the state reported on the readiness route
+func (s *WebServer) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+
+	atomic.StoreInt32(&s.ready, v)
+}
+
+// Ready reports whether the server accepts new traffic
+func (s *WebServer) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// AddRoute registers a handler, the optional middleware only applies to this route
+func (s *WebServer) AddRoute(method, route string, handler func(http.ResponseWriter, *http.Request), mws ...Middleware) {
 	if s.mux == nil {
 		s.mux = mux.NewRouter()
+		s.addProbes()
+	}
+
+	s.mux.Handle(route, chain(http.HandlerFunc(handler), mws...)).Methods(method)
+}
+
+// AddPublicRoute registers a handler that is served without a client
+// certificate when clientCAFile is set, for public data only
+func (s *WebServer) AddPublicRoute(method, route string, handler func(http.ResponseWriter, *http.Request), mws ...Middleware) {
+	s.AddRoute(method, route, handler, mws...)
+
+	if s.public == nil {
+		s.public = mux.NewRouter()
 	}
+	s.public.Handle(route, http.NotFoundHandler()).Methods(method)
+}
 
-	s.mux.HandleFunc(route, handler).Methods(method)
+// isPublic reports whether a request is for a public route
+func (s *WebServer) isPublic(r *http.Request) bool {
+	if s.public == nil {
+		return false
+	}
+
+	return s.public.Match(r, &mux.RouteMatch{})
 }
 
 func (s *WebServer) Config(cfg *Config) {
@@ -56,7 +245,25 @@ func (s *WebServer) Config(cfg *Config) {
 		cfg = &Config{}
 	}
 	if cfg.Addr == "" {
-		cfg.Addr = ":9797"
+		cfg.Addr = DefaultAddr
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = defaultDrainTimeout
+	}
+	if cfg.ReadHeaderTimeout == 0 {
+		cfg.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = defaultReadTimeout
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = defaultWriteTimeout
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = defaultMaxBodyBytes
 	}
 
 	s.cfg = cfg
@@ -69,26 +276,78 @@ func (s *WebServer) Start() {
 	}
 
 	srv := &http.Server{
-		Addr:    s.cfg.Addr,
-		Handler: s.mux,
+		Addr:              s.cfg.Addr,
+		Handler:           limitBody(s.mux, s.cfg.MaxBodyBytes),
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+	}
+
+	useTLS := s.cfg.CertFile != "" || s.certSrc != nil
+	if useTLS {
+		tc, err := tlsConfig(s.cfg)
+		if err != nil {
+			log.Error("invalid TLS configuration: ", err)
+			return
+		}
+		tc.GetCertificate = s.certSrc
+		srv.TLSConfig = tc
+
+		if tc.ClientCAs != nil {
+			srv.Handler = requireClientCert(srv.Handler, s.isPublic)
+		}
+
+		if s.cfg.DisableHTTP2 {
+			// a non-nil empty map disables the automatic HTTP/2 upgrade
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
 	}
 
 	s.srv = srv
+	s.SetReady(true)
+
+	var err error
+	switch {
+	case !useTLS:
+		err = srv.ListenAndServe()
+	case s.certSrc != nil:
+		err = srv.ListenAndServeTLS("", "")
+	default:
+		err = srv.ListenAndServeTLS(s.cfg.CertFile, s.cfg.KeyFile)
+	}
 
-	if s.cfg.CertFile == "" {
-		log.Error(srv.ListenAndServe())
-	} else {
-		log.Error(srv.ListenAndServeTLS(s.cfg.CertFile, s.cfg.KeyFile))
+	if err != http.ErrServerClosed {
+		log.Error(err)
 	}
 }
 
+// Stop reports the server as not ready, stops accepting new connections and
+// waits up to the drain timeout for in-flight requests to finish
 func (s *WebServer) Stop() error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	err := s.srv.Shutdown(ctx)
-	if err != nil {
-		return err
+	s.SetReady(false)
+	if s.srv == nil {
+		return nil
 	}
-	return nil
+
+	timeout := s.cfg.DrainTimeout
+	if timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Infof("draining web server connections (timeout %v)", timeout)
+	return s.srv.Shutdown(ctx)
+}
+
+// New creates a web server separate from the shared one, e.g. for a component
+// served on its own port
+func New(cfg *Config) *WebServer {
+	s := newServer(nil)
+	s.Config(cfg)
+	return s
 }
 
 func Server() *WebServer {
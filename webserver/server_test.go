@@ -1,9 +1,17 @@
 package webserver
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"go.jlucktay.dev/tyk-k8s/logger"
 )
 
 func TestServer(t *testing.T) {
@@ -34,3 +42,252 @@ func TestServer(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestServer_Drain(t *testing.T) {
+	s := newServer(nil)
+	s.Config(&Config{Addr: ":9798", DrainTimeout: 2 * time.Second})
+
+	started := make(chan struct{})
+	s.AddRoute("GET", "/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(200)
+	})
+
+	go s.Start()
+	time.Sleep(500 * time.Millisecond)
+
+	res, err := http.Get("http://localhost:9798" + ReadyRoute)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatal("expected server to be ready: ", err)
+	}
+
+	done := make(chan int)
+	go func() {
+		res, err := http.Get("http://localhost:9798/slow")
+		if err != nil {
+			done <- 0
+			return
+		}
+		done <- res.StatusCode
+	}()
+
+	<-started
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Ready() {
+		t.Fatal("server should not be ready after stop")
+	}
+
+	if code := <-done; code != 200 {
+		t.Fatalf("in-flight request should be drained, got %v", code)
+	}
+}
+
+func TestServer_ReadyCheck(t *testing.T) {
+	s := newServer(nil)
+	s.Config(&Config{Addr: ":9799"})
+
+	var failing int32 = 1
+	s.AddReadyCheck(func() error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return fmt.Errorf("no credentials")
+		}
+		return nil
+	})
+
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	res, err := http.Get("http://localhost:9799" + ReadyRoute)
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("expected a failing check to fail readiness: ", err)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	res, err = http.Get("http://localhost:9799" + ReadyRoute)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatal("expected server to be ready: ", err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	tc, err := tlsConfig(&Config{})
+	if err != nil || tc.MinVersion != tls.VersionTLS12 || tc.ClientCAs != nil {
+		t.Fatal("unexpected defaults: ", err)
+	}
+
+	tc, err = tlsConfig(&Config{MinTLSVersion: "TLS1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tc.MinVersion != tls.VersionTLS13 || len(tc.CipherSuites) != 1 || tc.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatal("settings not applied")
+	}
+
+	bad := []*Config{
+		{MinTLSVersion: "2.0"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CipherSuites: []string{"nope"}},
+		{ClientCAFile: "/does/not/exist"},
+	}
+	for _, c := range bad {
+		if _, err := tlsConfig(c); err == nil {
+			t.Fatalf("expected %+v to be rejected", c)
+		}
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	s := newServer(&Config{})
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}
+	s.AddRoute("POST", "/inject", ok)
+	s.AddPublicRoute("GET", "/ca/bundle", ok)
+	s.AddPublicRoute("GET", "/ca/ocsp/{request:.+}", ok)
+	s.SetReady(true)
+	h := requireClientCert(s.mux, s.isPublic)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/inject", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatal("requests without a client certificate should be rejected")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", ReadyRoute, nil))
+	if rec.Code != 200 {
+		t.Fatal("probes should not require a client certificate")
+	}
+
+	for _, path := range []string{"/ca/bundle", "/ca/ocsp/MEUw"} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != 200 {
+			t.Fatalf("public route %v should not require a client certificate", path)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/ca/bundle", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatal("only the public method should be exempt")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	s := newServer(&Config{})
+
+	var seenID string
+	s.AddRoute("GET", "/panic", func(w http.ResponseWriter, r *http.Request) {
+		seenID = logger.RequestID(r.Context())
+		panic("boom")
+	}, RequestID, Logging, Recovery)
+
+	req := httptest.NewRequest("GET", "/panic", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatal("panics should be recovered into a 500, got ", rec.Code)
+	}
+
+	if seenID != "abc" || rec.Header().Get(RequestIDHeader) != "abc" {
+		t.Fatal("request ID not propagated")
+	}
+
+	rec = httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest("GET", "/panic", nil))
+	if seenID == "" || seenID == "abc" || rec.Header().Get(RequestIDHeader) != seenID {
+		t.Fatal("expected a generated request ID")
+	}
+
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	s.Use(mark("global"))
+	s.AddRoute("GET", "/ordered", func(w http.ResponseWriter, r *http.Request) {}, mark("first"), mark("second"))
+	s.mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ordered", nil))
+	if strings.Join(order, ",") != "global,first,second" {
+		t.Fatal("unexpected middleware order: ", order)
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	h := limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(200)
+	}), 10)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/inject", strings.NewReader("short")))
+	if rec.Code != 200 {
+		t.Fatal("small bodies should be accepted")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/inject", strings.NewReader("this body is too long")))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal("large bodies should be rejected")
+	}
+
+	c := &Config{}
+	Server().Config(c)
+	if c.ReadTimeout == 0 || c.WriteTimeout == 0 || c.IdleTimeout == 0 || c.ReadHeaderTimeout == 0 || c.MaxBodyBytes == 0 {
+		t.Fatalf("expected defaults to be set: %+v", c)
+	}
+}
+
+func TestNew(t *testing.T) {
+	s := New(&Config{})
+	if s == Server() {
+		t.Fatal("expected a separate server")
+	}
+
+	if s.cfg.Addr != DefaultAddr || s.cfg.MaxBodyBytes != defaultMaxBodyBytes {
+		t.Fatalf("defaults not applied: %+v", s.cfg)
+	}
+
+	s.AddRoute("GET", "/separate", func(w http.ResponseWriter, r *http.Request) {})
+	rec := httptest.NewRecorder()
+	Server().mux.ServeHTTP(rec, httptest.NewRequest("GET", "/separate", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("route leaked into the shared server: %v", rec.Code)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	if errs := (&Config{Addr: ":443", CertFile: "cert.pem", KeyFile: "key.pem", MinTLSVersion: "1.3"}).Validate(); len(errs) != 0 {
+		t.Fatalf("expected a valid config, got %v", errs)
+	}
+
+	cfg := &Config{
+		Addr:          ":70000",
+		CertFile:      "cert.pem",
+		CertSecret:    "no-namespace",
+		MinTLSVersion: "1.4",
+		CipherSuites:  []string{"TLS_FOO"},
+		ReadTimeout:   -time.Second,
+	}
+
+	// all problems are reported at once
+	if errs := cfg.Validate(); len(errs) != 6 {
+		t.Fatalf("expected 6 errors, got %v", errs)
+	}
+}
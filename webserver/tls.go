@@ -0,0 +1,94 @@
+package webserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuite resolves a cipher suite by its standard name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func cipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, nil
+		}
+	}
+
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return 0, fmt.Errorf("cipher suite %v is insecure", name)
+		}
+	}
+
+	return 0, fmt.Errorf("unknown cipher suite %v", name)
+}
+
+// tlsConfig builds the serving TLS configuration, defaulting to TLS 1.2 and
+// Go's cipher suite preferences
+func tlsConfig(cfg *Config) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.MinTLSVersion != "" {
+		v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(cfg.MinTLSVersion), "tls")]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version %v", cfg.MinTLSVersion)
+		}
+		tc.MinVersion = v
+	}
+
+	for _, name := range cfg.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+
+	if cfg.ClientCAFile != "" {
+		caPem, err := ioutil.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in %v", cfg.ClientCAFile)
+		}
+
+		// probes can't present client certificates, requireClientCert enforces
+		// them for everything else
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tc, nil
+}
+
+// requireClientCert rejects requests without a verified client certificate,
+// except for probes and the routes public reports, e.g. the CA bundle fetched
+// by pods before they have a certificate
+func requireClientCert(next http.Handler, public func(*http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == HealthRoute || r.URL.Path == ReadyRoute || (public != nil && public(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}